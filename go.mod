@@ -12,10 +12,8 @@ require (
 	github.com/google/go-containerregistry v0.14.0
 	github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510
 	github.com/hashicorp/go-multierror v1.1.1
-	github.com/jinzhu/copier v0.3.5
 	github.com/maxbrunsfeld/counterfeiter/v6 v6.6.1
 	github.com/package-url/packageurl-go v0.1.1-0.20220203205134-d70459300c8a
-	github.com/psanford/memfs v0.0.0-20210214183328-a001468d78ef
 	github.com/sigstore/cosign/v2 v2.0.1
 	github.com/sirupsen/logrus v1.9.0
 	github.com/spf13/cobra v1.7.0
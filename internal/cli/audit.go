@@ -0,0 +1,63 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/apko/pkg/audit"
+	"chainguard.dev/apko/pkg/build"
+)
+
+// auditFlags are the flags configuring the audit log.
+type auditFlags struct {
+	target     string
+	signingKey string
+	principal  string
+}
+
+func (f *auditFlags) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.target, "audit-log", "", "file or http(s) URL to record the builds and publishes into")
+	cmd.Flags().StringVar(&f.signingKey, "audit-signing-key", "", "PEM encoded ed25519 private key to sign the audit log entries with")
+	cmd.Flags().StringVar(&f.principal, "audit-principal", os.Getenv("USER"), "principal recorded in the audit log entries")
+}
+
+// option returns the build option recording into the audit log, if one is
+// configured.
+func (f *auditFlags) option() (build.Option, error) {
+	if f.target == "" {
+		if f.signingKey != "" {
+			return nil, fmt.Errorf("--audit-signing-key requires --audit-log")
+		}
+		return build.WithAuditLog(nil), nil
+	}
+
+	opts := []audit.Option{audit.WithPrincipal(f.principal)}
+	if f.signingKey != "" {
+		key, err := audit.LoadSigningKey(f.signingKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading audit signing key: %w", err)
+		}
+		opts = append(opts, audit.WithSigningKey(key))
+	}
+	log, err := audit.New(audit.NewSink(f.target), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return build.WithAuditLog(log), nil
+}
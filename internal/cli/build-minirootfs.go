@@ -91,6 +91,9 @@ func BuildMinirootFSCmd(ctx context.Context, opts ...build.Option) error {
 		return err
 	}
 
+	if err := bc.ImageConfiguration.ApplyArchOverride(bc.Options.Arch); err != nil {
+		return err
+	}
 	if err := bc.Refresh(); err != nil {
 		return err
 	}
@@ -19,13 +19,17 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	coci "github.com/sigstore/cosign/v2/pkg/oci"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"golang.org/x/sync/errgroup"
 
+	apkimpl "chainguard.dev/apko/pkg/apk/impl"
+	"chainguard.dev/apko/pkg/audit"
 	"chainguard.dev/apko/pkg/build"
 	"chainguard.dev/apko/pkg/build/oci"
 	"chainguard.dev/apko/pkg/build/types"
@@ -48,6 +52,30 @@ func buildCmd() *cobra.Command {
 	var extraRepos []string
 	var buildOptions []string
 	var logPolicy []string
+	var annotationEnvPrefix string
+	var auditFlags auditFlags
+	var showProgress bool
+	var jobs int
+	var hardened bool
+	var offline bool
+	var userAgent string
+	var headers []string
+	var vars []string
+	var resolverStrategy string
+	var extractionCache string
+	var layerCache string
+	var checkReproducibility bool
+	var streamRootfs bool
+	var memoryBudget int64
+	var failOnCaseCollision bool
+	var dedupFiles bool
+	var sizeBudget int64
+	var sparseFiles bool
+	var timestamps string
+	var unsafePaths bool
+	var hostUIDMap, hostGIDMap []string
+	var fetchLimits apkimpl.FetchLimits
+	var skipVariants bool
 
 	cmd := &cobra.Command{
 		Use:   "build",
@@ -61,6 +89,10 @@ command, e.g.
 
 Along the image, apko will generate CycloneDX and SPDX SBOMs (software 
 bill of materials) describing the image contents.
+
+The variants declared in the configuration are written next to the image,
+e.g. output-dev.tar for the dev variant, with their SBOMs in a directory
+named after the variant.
 `,
 		Example: `  apko build <config.yaml> <tag> <output.tar>`,
 		Args:    cobra.ExactArgs(3),
@@ -86,6 +118,10 @@ bill of materials) describing the image contents.
 			if !writeSBOM {
 				sbomFormats = []string{}
 			}
+			auditOpt, err := auditFlags.option()
+			if err != nil {
+				return err
+			}
 			return BuildCmd(cmd.Context(), args[1], args[2], archs,
 				build.WithConfig(args[0]),
 				build.WithDockerMediatypes(useDockerMediaTypes),
@@ -100,6 +136,30 @@ bill of materials) describing the image contents.
 				build.WithDebugLogging(debugEnabled),
 				build.WithVCS(withVCS),
 				build.WithBuildOptions(buildOptions),
+				build.WithAnnotationsFromEnvironment(annotationEnvPrefix),
+				auditOpt,
+				progressOption(showProgress),
+				build.WithJobs(jobs),
+				build.WithHardened(hardened),
+				build.WithOffline(offline),
+				build.WithFetchLimits(fetchLimits),
+				build.WithUserAgent(userAgent),
+				build.WithHeaders(headers),
+				build.WithVars(vars),
+				build.WithResolverStrategy(resolverStrategy),
+				build.WithExtractionCache(extractionCache),
+				build.WithLayerCache(layerCache),
+				build.WithCheckReproducibility(checkReproducibility),
+				build.WithStreamingFS(streamRootfs),
+				build.WithMemoryBudget(memoryBudget),
+				build.WithFailOnCaseCollision(failOnCaseCollision),
+				build.WithDeduplication(dedupFiles),
+				build.WithSizeBudget(sizeBudget),
+				build.WithSparseFiles(sparseFiles),
+				build.WithTimestampPolicy(timestamps),
+				build.WithUnsafePaths(unsafePaths),
+				build.WithHostIDMap(hostUIDMap, hostGIDMap),
+				build.WithSkipVariants(skipVariants),
 			)
 		},
 	}
@@ -117,30 +177,100 @@ bill of materials) describing the image contents.
 	cmd.Flags().StringSliceVarP(&extraRepos, "repository-append", "r", []string{}, "path to extra repositories to include")
 	cmd.Flags().StringSliceVar(&buildOptions, "build-option", []string{}, "build options to enable")
 	cmd.Flags().StringSliceVar(&logPolicy, "log-policy", []string{}, "logging policy to use")
+	cmd.Flags().StringVar(&annotationEnvPrefix, "annotation-env-prefix", build.DefaultAnnotationEnvPrefix, "prefix of environment variables to add as OCI annotations (empty to disable)")
+	cmd.Flags().BoolVar(&showProgress, "progress", false, "show the progress of installing the packages on stderr")
+	cmd.Flags().IntVar(&jobs, "jobs", 0, "how many architectures to build at once (0 for all of them)")
+	cmd.Flags().BoolVar(&hardened, "hardened", false, "limit how much of the repository indexes and packages is read, for untrusted inputs")
+	cmd.Flags().BoolVar(&offline, "offline", false, "forbid any network access, failing with the list of keys, indexes and packages which are not local")
+	cmd.Flags().IntVar(&fetchLimits.MaxConnections, "max-connections", 0, "how many downloads may run at once (0 for no limit)")
+	cmd.Flags().Int64Var(&fetchLimits.MaxBandwidth, "max-bandwidth", 0, "how many bytes per second may be downloaded in total (0 for no limit)")
+	cmd.Flags().StringVar(&userAgent, "user-agent", "", "User-Agent of the requests for keys, indexes and packages")
+	cmd.Flags().StringArrayVar(&vars, "set", nil, "value of a variable of the configuration, as NAME=value, taking precedence over the environment and its default (can be repeated)")
+	cmd.Flags().StringArrayVar(&headers, "header", nil, "header to add to the requests for keys, indexes and packages to the hosts of the repositories, as \"Name: value\" (can be repeated)")
+	cmd.Flags().StringVar(&resolverStrategy, "resolver-strategy", string(apkimpl.PreferHighest), "which of the versions meeting the constraints to install: highest or lowest")
+	cmd.Flags().StringVar(&extractionCache, "extraction-cache", "", "directory to keep the expanded packages in, so that later builds do not download them again")
+	cmd.Flags().StringVar(&layerCache, "layer-cache", "", "directory to keep the image layers in, so that later builds with the same resolved inputs reuse them")
+	cmd.Flags().BoolVar(&checkReproducibility, "check-reproducibility", false, "build the layers of each image twice, failing with the first file which differs unless they are the same")
+	cmd.Flags().BoolVar(&streamRootfs, "stream-rootfs", false, "write the files of the packages straight to the layer as they are installed, rather than to the working directory")
+	cmd.Flags().Int64Var(&memoryBudget, "memory-budget", 0, "build the filesystem in memory, writing large files to the working directory once this many bytes are held (0 to build it in the working directory)")
+	cmd.Flags().BoolVar(&failOnCaseCollision, "fail-on-case-collision", false, "fail when two paths differ only by case and the working directory is case-insensitive, rather than warning")
+	cmd.Flags().BoolVar(&dedupFiles, "dedup-files", false, "write files with the same content and attributes once in the layer, the others being hardlinks to it")
+	cmd.Flags().Int64Var(&sizeBudget, "size-budget", 0, "fail if the layer takes more than this many bytes, uncompressed (0 for no budget)")
+	cmd.Flags().BoolVar(&sparseFiles, "sparse-files", false, "write files with large runs of zeros as sparse entries in the layer")
+	cmd.Flags().StringVar(&timestamps, "timestamps", "epoch", "what the modification times of the files become in the layer: epoch (SOURCE_DATE_EPOCH), preserve (from the packages), clamp (no later than SOURCE_DATE_EPOCH) or zero")
+	cmd.Flags().BoolVar(&unsafePaths, "unsafe-paths", false, "install the files of packages whose paths go through \"..\" rather than failing, for trusted packages only")
+	cmd.Flags().StringSliceVar(&hostUIDMap, "host-uid-map", nil, "uids to give the files of the working directory for those of the image, as <uid>:<host uid>, e.g. to build without root")
+	cmd.Flags().StringSliceVar(&hostGIDMap, "host-gid-map", nil, "gids to give the files of the working directory for those of the image, as <gid>:<host gid>, e.g. to build without root")
+	cmd.Flags().BoolVar(&skipVariants, "skip-variants", false, "do not build the variants declared in the config")
+	auditFlags.addFlags(cmd)
 
 	return cmd
 }
 
 func BuildCmd(ctx context.Context, imageRef, outputTarGZ string, archs []types.Architecture, opts ...build.Option) error {
+	bc, imgs, err := buildImages(ctx, outputTarGZ, archs, opts...)
+	if err != nil {
+		return err
+	}
+	if bc.Options.SkipVariants {
+		return nil
+	}
+
+	base, err := writeVariantBase(bc, imgs)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(base)
+	// the variants are written next to the image, e.g. output-dev.tar,
+	// with their SBOMs in a directory of their own
+	ext := filepath.Ext(outputTarGZ)
+	for _, variant := range bc.ImageConfiguration.VariantNames() {
+		bc.Logger().Infof("building %s variant", variant)
+		output := strings.TrimSuffix(outputTarGZ, ext) + "-" + variant + ext
+		sbomPath := filepath.Join(bc.Options.SBOMPath, variant)
+		if len(bc.Options.SBOMFormats) != 0 {
+			if err := os.MkdirAll(sbomPath, 0o755); err != nil {
+				return fmt.Errorf("creating SBOM directory of %s variant: %w", variant, err)
+			}
+		}
+		variantOpts := append(variantOptions(bc, variant, base, opts), build.WithSBOM(sbomPath))
+		if _, _, err := buildImages(ctx, output, archs, variantOpts...); err != nil {
+			return fmt.Errorf("building %s variant: %w", variant, err)
+		}
+	}
+	return nil
+}
+
+// buildImages builds the images for all architectures, and writes them
+// along with their index to the tarball.
+func buildImages(ctx context.Context, outputTarGZ string, archs []types.Architecture, opts ...build.Option) (bc *build.Context, imgs map[types.Architecture]coci.SignedImage, err error) {
 	wd, err := os.MkdirTemp("", "apko-*")
 	if err != nil {
-		return fmt.Errorf("failed to create working directory: %w", err)
+		return nil, nil, fmt.Errorf("failed to create working directory: %w", err)
 	}
 	defer os.RemoveAll(wd)
 
-	bc, err := build.New(wd, opts...)
+	bc, err = build.New(wd, opts...)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
+	started := time.Now()
+	var outputs []string
+	defer func() {
+		if auditErr := bc.RecordAudit(ctx, audit.ActionBuild, started, outputs, err); auditErr != nil && err == nil {
+			err = auditErr
+		}
+	}()
+
 	if err := bc.Refresh(); err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	if bc.Options.SBOMPath == "" {
 		dir, err := filepath.Abs(outputTarGZ)
 		if err != nil {
-			return fmt.Errorf("resolving output file path: %w", err)
+			return nil, nil, fmt.Errorf("resolving output file path: %w", err)
 		}
 		bc.Options.SBOMPath = filepath.Dir(dir)
 	}
@@ -172,11 +302,11 @@ func BuildCmd(ctx context.Context, imageRef, outputTarGZ string, archs []types.A
 
 	bc.Logger().Printf("building tags %v", bc.Options.Tags)
 
-	var errg errgroup.Group
 	workDir := bc.Options.WorkDir
-	imgs := map[types.Architecture]coci.SignedImage{}
+	imgs = map[types.Architecture]coci.SignedImage{}
 	contexts := map[types.Architecture]*build.Context{}
-	imageTars := map[types.Architecture]string{}
+	imageTars := map[types.Architecture][]string{}
+	var mu sync.Mutex
 
 	// This is a hack to skip the SBOM generation during
 	// image build. Will be removed when global options are a thing.
@@ -188,53 +318,73 @@ func BuildCmd(ctx context.Context, imageRef, outputTarGZ string, archs []types.A
 	var finalDigest name.Digest
 
 	defer func() {
-		for _, f := range imageTars {
-			_ = os.Remove(f)
+		for _, layers := range imageTars {
+			for _, f := range layers {
+				_ = os.Remove(f)
+			}
 		}
 	}()
 
 	for _, arch := range archs {
-		arch := arch
 		// working directory for this architecture
 		wd := filepath.Join(workDir, arch.ToAPK())
 		bc, err := build.New(wd, opts...)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
 		// we do not generate SBOMs for each arch, only possibly for final image
 		bc.Options.SBOMFormats = []string{}
 		bc.Options.WantSBOM = false
 		bc.ImageConfiguration.Archs = archs
+		bc.Options.Arch = arch
+		bc.Options.WorkDir = wd
 
 		// save the build context for later
 		contexts[arch] = bc
 
-		errg.Go(func() error {
-			bc.Options.Arch = arch
-			bc.Options.WorkDir = wd
+		if err := forArch(bc, arch); err != nil {
+			return nil, nil, err
+		}
+	}
 
-			if err := bc.Refresh(); err != nil {
-				return fmt.Errorf("failed to update build context for %q: %w", arch, err)
-			}
+	if err := runArchs(ctx, archs, bc.Options.Jobs, func(ctx context.Context, arch types.Architecture) error {
+		bc := contexts[arch]
+		if err := bc.Refresh(); err != nil {
+			return fmt.Errorf("failed to update build context for %q: %w", arch, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-			layerTarGZ, err := bc.BuildLayer()
-			if err != nil {
-				return fmt.Errorf("failed to build layer image: %w", err)
-			}
+		layers, err := bc.BuildLayers()
+		if err != nil {
+			return fmt.Errorf("failed to build layer image for %q: %w", arch, err)
+		}
+		mu.Lock()
+		imageTars[arch] = layers
+		mu.Unlock()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-			imageTars[arch] = layerTarGZ
-			img, err := oci.BuildImageFromLayer(
-				layerTarGZ, bc.ImageConfiguration, bc.Logger(), bc.Options)
-			if err != nil {
-				return fmt.Errorf("failed to build OCI image: %w", err)
+		if bc.Options.CheckReproducibility {
+			if err := checkReproducible(filepath.Join(workDir, arch.ToAPK()+"-check"), arch, archs, layers, opts...); err != nil {
+				return err
 			}
-			imgs[arch] = img
-			return nil
-		})
-	}
-	if err := errg.Wait(); err != nil {
-		return err
+		}
+
+		img, err := oci.BuildImageFromLayers(
+			layers, bc.ImageConfiguration, bc.Logger(), bc.Options)
+		if err != nil {
+			return fmt.Errorf("failed to build OCI image for %q: %w", arch, err)
+		}
+		mu.Lock()
+		imgs[arch] = img
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		return nil, nil, err
 	}
 
 	bc.Options.SBOMFormats = formats
@@ -242,7 +392,7 @@ func BuildCmd(ctx context.Context, imageRef, outputTarGZ string, archs []types.A
 
 	if wantSBOM {
 		logrus.Info("Generating arch image SBOMs")
-		for arch, img := range imgs {
+		if err := runArchs(ctx, archs, bc.Options.Jobs, func(ctx context.Context, arch types.Architecture) error {
 			bc := contexts[arch]
 
 			// override the SBOM options
@@ -250,26 +400,64 @@ func BuildCmd(ctx context.Context, imageRef, outputTarGZ string, archs []types.A
 			bc.Options.WantSBOM = true
 			bc.Options.SBOMPath = sbomPath
 
-			if err := bc.GenerateImageSBOM(arch, img); err != nil {
+			if err := bc.GenerateImageSBOM(arch, imgs[arch]); err != nil {
 				return fmt.Errorf("generating sbom for %s: %w", arch, err)
 			}
+			return nil
+		}); err != nil {
+			return nil, nil, err
 		}
 	}
 
 	// finally generate the tar.gz file that includes all of the arch images and an index
 	finalDigest, err = oci.BuildIndex(outputTarGZ, bc.ImageConfiguration, imgs, bc.Options.Tags, bc.Logger())
 	if err != nil {
-		return fmt.Errorf("failed to build index: %w", err)
+		return nil, nil, fmt.Errorf("failed to build index: %w", err)
 	}
 	if wantSBOM {
 		if err := bc.GenerateIndexSBOM(finalDigest, imgs); err != nil {
-			return fmt.Errorf("generating index SBOM: %w", err)
+			return nil, nil, fmt.Errorf("generating index SBOM: %w", err)
 		}
 	}
 
 	bc.Logger().Infof(
 		"Final index tgz at: %s", outputTarGZ,
 	)
+	outputs = []string{outputTarGZ, finalDigest.DigestStr()}
+
+	return bc, imgs, nil
+}
 
+// checkReproducible builds the layers of the architecture again, from scratch
+// in another working directory and without the layer cache, and fails unless
+// they are the same as the layers of the first build.
+func checkReproducible(wd string, arch types.Architecture, archs []types.Architecture, layers []string, opts ...build.Option) error {
+	bc, err := build.New(wd, opts...)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(bc.Options.TempDir())
+
+	bc.Options.SBOMFormats = []string{}
+	bc.Options.WantSBOM = false
+	bc.Options.LayerCache = ""
+	bc.ImageConfiguration.Archs = archs
+	bc.Options.Arch = arch
+	bc.Options.WorkDir = wd
+	if err := forArch(bc, arch); err != nil {
+		return err
+	}
+
+	if err := bc.Refresh(); err != nil {
+		return fmt.Errorf("failed to update build context for %q: %w", arch, err)
+	}
+	again, err := bc.BuildLayers()
+	if err != nil {
+		return fmt.Errorf("failed to build layer image for %q again: %w", arch, err)
+	}
+	if err := build.CompareLayers(layers, again); err != nil {
+		return fmt.Errorf("image for %q is not reproducible: %w", arch, err)
+	}
+	bc.Logger().Infof("image for %q is reproducible", arch)
 	return nil
 }
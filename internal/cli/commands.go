@@ -36,9 +36,16 @@ func New() *cobra.Command {
 	cmd.AddCommand(cranecmd.NewCmdAuthLogin("apko")) // apko login
 	cmd.AddCommand(buildCmd())
 	cmd.AddCommand(buildMinirootFS())
+	cmd.AddCommand(copyCmd())
+	cmd.AddCommand(flatten())
 	cmd.AddCommand(showConfig())
 	cmd.AddCommand(publish())
 	cmd.AddCommand(showPackages())
+	cmd.AddCommand(search())
+	cmd.AddCommand(info())
+	cmd.AddCommand(index())
+	cmd.AddCommand(install())
+	cmd.AddCommand(serve())
 	cmd.AddCommand(version.Version())
 	return cmd
 }
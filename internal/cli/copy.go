@@ -0,0 +1,75 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/apko/pkg/build/oci"
+	"chainguard.dev/apko/pkg/iocomb"
+	"chainguard.dev/apko/pkg/log"
+)
+
+func copyCmd() *cobra.Command {
+	var logPolicy []string
+	var quietEnabled bool
+
+	cmd := &cobra.Command{
+		Use:   "copy",
+		Short: "Copy an image and what is attached to it to another reference",
+		Long: `Copy copies an image or image index to another reference, possibly in another
+registry, along with the signatures, attestations and SBOMs attached to it and
+to its images, so that promoting an image keeps its supply-chain metadata.
+
+The manifests are copied as they are, so the copy has the same digest as the
+source, which is printed.`,
+		Example: `  apko copy <src> <dst>`,
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(logPolicy) == 0 {
+				if quietEnabled {
+					logPolicy = []string{"builtin:discard"}
+				} else {
+					logPolicy = []string{"builtin:stderr"}
+				}
+			}
+
+			logWriter, err := iocomb.Combine(logPolicy)
+			if err != nil {
+				return fmt.Errorf("invalid logging policy: %w", err)
+			}
+			return CopyCmd(cmd.Context(), args[0], args[1], log.NewLogger(logWriter))
+		},
+	}
+
+	cmd.Flags().BoolVar(&quietEnabled, "quiet", false, "disable logging")
+	cmd.Flags().StringSliceVar(&logPolicy, "log-policy", []string{}, "logging policy to use")
+
+	return cmd
+}
+
+// CopyCmd copies src to dst along with what is attached to it, and prints the
+// digest of the copy.
+func CopyCmd(ctx context.Context, src, dst string, logger log.Logger) error {
+	digest, err := oci.CopyWithReferrers(ctx, src, dst, logger)
+	if err != nil {
+		return err
+	}
+	fmt.Println(digest.String())
+	return nil
+}
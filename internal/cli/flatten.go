@@ -0,0 +1,243 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+	coci "github.com/sigstore/cosign/v2/pkg/oci"
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/apko/pkg/build"
+	"chainguard.dev/apko/pkg/build/oci"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/iocomb"
+	"chainguard.dev/apko/pkg/log"
+	"chainguard.dev/apko/pkg/sbom"
+)
+
+func flatten() *cobra.Command {
+	var imageRefs string
+	var buildDate string
+	var sbomPath string
+	var sbomFormats []string
+	var logPolicy []string
+	var debugEnabled bool
+	var quietEnabled bool
+	var writeSBOM bool
+	var local bool
+
+	cmd := &cobra.Command{
+		Use:   "flatten",
+		Short: "Squash an image into a single layer and publish it",
+		Long: `Flatten pulls an image or image index, squashes the layers of each of its
+images into a single reproducible layer, regenerates the SBOM from the apk
+database found in the image, and publishes the result.
+
+The runtime configuration and annotations of the original images are kept.`,
+		Example: `  apko flatten <image> <tag...>`,
+		Args:    cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(logPolicy) == 0 {
+				if quietEnabled {
+					logPolicy = []string{"builtin:discard"}
+				} else {
+					logPolicy = []string{"builtin:stderr"}
+				}
+			}
+
+			logWriter, err := iocomb.Combine(logPolicy)
+			if err != nil {
+				return fmt.Errorf("invalid logging policy: %w", err)
+			}
+			logger := log.NewLogger(logWriter)
+
+			if !writeSBOM {
+				sbomFormats = []string{}
+			}
+			return FlattenCmd(cmd.Context(), args[0], imageRefs,
+				build.WithTags(args[1:]...),
+				build.WithBuildDate(buildDate),
+				build.WithSBOM(sbomPath),
+				build.WithSBOMFormats(sbomFormats),
+				build.WithLogger(logger),
+				build.WithDebugLogging(debugEnabled),
+				build.WithLocal(local),
+			)
+		},
+	}
+
+	cmd.Flags().StringVar(&imageRefs, "image-refs", "", "path to file where a list of the published image references will be written")
+	cmd.Flags().BoolVar(&debugEnabled, "debug", false, "enable debug logging")
+	cmd.Flags().BoolVar(&quietEnabled, "quiet", false, "disable logging")
+	cmd.Flags().StringVar(&buildDate, "build-date", "", "date used for the timestamps of the files inside the image")
+	cmd.Flags().BoolVar(&writeSBOM, "sbom", true, "generate an SBOM")
+	cmd.Flags().StringVar(&sbomPath, "sbom-path", "", "path to write the SBOMs")
+	cmd.Flags().StringSliceVar(&sbomFormats, "sbom-formats", sbom.DefaultOptions.Formats, "SBOM formats to output")
+	cmd.Flags().StringSliceVar(&logPolicy, "log-policy", []string{}, "logging policy to use")
+	cmd.Flags().BoolVar(&local, "local", false, "publish image just to local Docker daemon")
+
+	return cmd
+}
+
+// FlattenCmd squashes each image of src into a single layer and publishes the
+// results, as an index if src is one, to the tags set in the build options.
+func FlattenCmd(ctx context.Context, src string, outputRefs string, opts ...build.Option) error {
+	wd, err := os.MkdirTemp("", "apko-*")
+	if err != nil {
+		return fmt.Errorf("failed to create working directory: %w", err)
+	}
+	defer os.RemoveAll(wd)
+
+	bc, err := build.New(wd, opts...)
+	if err != nil {
+		return err
+	}
+	tmp := bc.Options.TempDir()
+	defer os.RemoveAll(tmp)
+
+	origs, mediaType, err := oci.FetchImages(src, bc.Logger())
+	if err != nil {
+		return err
+	}
+	docker := mediaType == ggcrtypes.DockerManifestList || mediaType == ggcrtypes.DockerManifestSchema2
+	bc.Options.UseDockerMediaTypes = docker
+
+	archs := make([]types.Architecture, 0, len(origs))
+	for arch := range origs {
+		archs = append(archs, arch)
+	}
+	sort.Slice(archs, func(i, j int) bool {
+		return archs[i].String() < archs[j].String()
+	})
+	bc.Logger().Infof("flattening %s for %d architectures: %+v", src, len(archs), archs)
+
+	formats := bc.Options.SBOMFormats
+	wantSBOM := bc.Options.WantSBOM
+
+	var finalDigest name.Digest
+	var idx coci.SignedImageIndex
+	builtReferences := []string{}
+	imgs := map[types.Architecture]coci.SignedImage{}
+	contexts := map[types.Architecture]*build.Context{}
+
+	for _, arch := range archs {
+		wd := filepath.Join(wd, arch.ToAPK())
+		bc, err := build.New(wd, opts...)
+		if err != nil {
+			return err
+		}
+		bc.Options.Arch = arch
+		bc.Options.UseDockerMediaTypes = docker
+		// SBOMs are generated once the image digests are known
+		bc.Options.SBOMFormats = []string{}
+		bc.Options.WantSBOM = false
+		contexts[arch] = bc
+
+		if err := bc.ExtractImage(origs[arch]); err != nil {
+			return fmt.Errorf("flattening %s image: %w", arch, err)
+		}
+		if _, err := fs.Stat(bc.FS(), "lib/apk/db/installed"); err != nil && wantSBOM {
+			bc.Logger().Warnf("no apk database found in %s image, not generating SBOMs", arch)
+			wantSBOM = false
+		}
+
+		layerTarGZ, err := bc.ImageLayoutToLayer()
+		if err != nil {
+			return fmt.Errorf("failed to build layer for %q: %w", arch, err)
+		}
+
+		var img coci.SignedImage
+		finalDigest, img, err = oci.PublishFlattenedImage(
+			origs[arch], layerTarGZ, bc.Options.SourceDateEpoch, arch, bc.Logger(),
+			bc.Options.SBOMPath, bc.Options.SBOMFormats, bc.Options.Local, true, bc.Options.Tags...,
+		)
+		if err != nil {
+			return fmt.Errorf("publishing %s image: %w", arch, err)
+		}
+		builtReferences = append(builtReferences, finalDigest.String())
+		imgs[arch] = img
+	}
+
+	if mediaType.IsIndex() {
+		finalDigest, idx, err = publishIndex(bc, imgs)
+		if err != nil {
+			return fmt.Errorf("publishing image index: %w", err)
+		}
+		builtReferences = append(builtReferences, finalDigest.String())
+	}
+
+	if bc.Options.Local {
+		bc.Logger().Printf("using local option, exiting early")
+		fmt.Println(strings.Split(finalDigest.String(), "@")[0])
+		return nil
+	}
+
+	sbomPath := bc.Options.SBOMPath
+	if sbomPath == "" {
+		sbomPath = tmp
+	}
+
+	if wantSBOM {
+		bc.Options.Log.Infof("Generating arch image SBOMs")
+		for arch, img := range imgs {
+			bc := contexts[arch]
+			bc.Options.WantSBOM = true
+			bc.Options.SBOMFormats = formats
+			bc.Options.SBOMPath = sbomPath
+
+			if err := bc.GenerateImageSBOM(arch, img); err != nil {
+				return fmt.Errorf("generating sbom for %s: %w", arch, err)
+			}
+			if _, err := oci.PostAttachSBOM(
+				img, sbomPath, formats, arch, bc.Logger(), bc.Options.Tags...,
+			); err != nil {
+				return fmt.Errorf("attaching sboms to %s image: %w", arch, err)
+			}
+		}
+
+		if idx != nil {
+			bc.Options.SBOMFormats = formats
+			bc.Options.SBOMPath = sbomPath
+			if err := bc.GenerateIndexSBOM(finalDigest, imgs); err != nil {
+				return fmt.Errorf("generating index SBOM: %w", err)
+			}
+			if _, err := oci.PostAttachSBOM(
+				idx, sbomPath, formats, types.Architecture{}, bc.Logger(), bc.Options.Tags...,
+			); err != nil {
+				return fmt.Errorf("attaching sboms to index: %w", err)
+			}
+		}
+	}
+
+	if outputRefs != "" {
+		//nolint:gosec // Make image ref file readable by non-root
+		if err := os.WriteFile(outputRefs, []byte(strings.Join(builtReferences, "\n")+"\n"), 0666); err != nil {
+			return fmt.Errorf("failed to write digest: %w", err)
+		}
+	}
+
+	fmt.Println(finalDigest)
+
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	apkimpl "chainguard.dev/apko/pkg/apk/impl"
+)
+
+func index() *cobra.Command {
+	var output string
+	var description string
+	var signingKey string
+
+	cmd := &cobra.Command{
+		Use:   "index",
+		Short: "Generate the APKINDEX.tar.gz of a directory of packages",
+		Long: `Generate the APKINDEX.tar.gz of a directory of .apk files, e.g. packages/x86_64,
+so that it can be used as a repository, optionally signed with an RSA key.`,
+		Example: `  apko index packages/x86_64
+  apko index packages/x86_64 --signing-key local-signing.rsa`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output == "" {
+				output = filepath.Join(args[0], "APKINDEX.tar.gz")
+			}
+			return IndexCmd(cmd.Context(), args[0], output, description, signingKey)
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "where to write the index (defaults to APKINDEX.tar.gz in the directory)")
+	cmd.Flags().StringVar(&description, "description", "", "description of the repository, e.g. its version")
+	cmd.Flags().StringVar(&signingKey, "signing-key", "", "RSA private key to sign the index with, named as its public key without .pub")
+
+	return cmd
+}
+
+// IndexCmd writes the APKINDEX.tar.gz of the .apk files of the directory to
+// the output, signed with the key if any.
+func IndexCmd(ctx context.Context, dir, output, description, signingKey string) error {
+	data, err := apkimpl.GenerateIndex(dir, description, apkimpl.InputLimits{})
+	if err != nil {
+		return fmt.Errorf("failed to generate index of %s: %w", dir, err)
+	}
+	if signingKey != "" {
+		keyData, err := os.ReadFile(signingKey)
+		if err != nil {
+			return fmt.Errorf("failed to read signing key: %w", err)
+		}
+		key, err := apkimpl.ParseRSAPrivateKey(keyData, "")
+		if err != nil {
+			return fmt.Errorf("failed to parse signing key %s: %w", signingKey, err)
+		}
+		if data, err = apkimpl.SignIndexData(data, key, filepath.Base(signingKey)+".pub"); err != nil {
+			return fmt.Errorf("failed to sign index: %w", err)
+		}
+	}
+	// #nosec G306 -- repository indexes are public
+	if err := os.WriteFile(output, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	apkimpl "chainguard.dev/apko/pkg/apk/impl"
+	"chainguard.dev/apko/pkg/build"
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+func info() *cobra.Command {
+	var extraKeys []string
+	var extraRepos []string
+	var archstrs []string
+	var all bool
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "info",
+		Short: "Show the metadata of a package of the repositories of a configuration",
+		Long: `Show the metadata of a package of the repositories of a configuration, the
+one which would be installed, or every version and provider of it with --all.`,
+		Example: `  apko info <config.yaml> busybox
+  apko info <config.yaml> 'busybox<1.36' --all --json`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return InfoCmd(cmd.Context(), types.ParseArchitectures(archstrs), args[1], all, asJSON,
+				build.WithConfig(args[0]),
+				build.WithExtraKeys(extraKeys),
+				build.WithExtraRepos(extraRepos),
+			)
+		},
+	}
+
+	cmd.Flags().BoolVar(&all, "all", false, "show every version and provider of the package, not only the one which would be installed")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "show the metadata as JSON")
+	cmd.Flags().StringSliceVarP(&extraKeys, "keyring-append", "k", []string{}, "path to extra keys to include in the keyring")
+	cmd.Flags().StringSliceVarP(&extraRepos, "repository-append", "r", []string{}, "path to extra repositories to include")
+	cmd.Flags().StringSliceVar(&archstrs, "arch", nil, "architectures to show the package of (e.g., x86_64,ppc64le,arm64) -- default is all, unless specified in config. Can also use 'host' to indicate arch of host this is running on")
+
+	return cmd
+}
+
+// InfoCmd shows the metadata of the package of the repositories for each
+// architecture, as text or JSON.
+func InfoCmd(ctx context.Context, archs []types.Architecture, pkgName string, all, asJSON bool, opts ...build.Option) error {
+	infos := map[string][]apkimpl.PackageInfo{}
+	if err := forEachArch(archs, opts, func(arch types.Architecture, bc *build.Context) error {
+		pkgs, err := bc.Info(pkgName)
+		if err != nil {
+			return fmt.Errorf("failed to get package info: %w", err)
+		}
+		if !all {
+			pkgs = pkgs[:1]
+		}
+		if asJSON {
+			infos[arch.ToAPK()] = pkgs
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, arch)
+		for _, pkg := range pkgs {
+			for _, field := range []struct{ name, value string }{
+				{"name", pkg.Name},
+				{"version", pkg.Version},
+				{"arch", pkg.Arch},
+				{"description", pkg.Description},
+				{"license", pkg.License},
+				{"url", pkg.URL},
+				{"origin", pkg.Origin},
+				{"maintainer", pkg.Maintainer},
+				{"commit", pkg.Commit},
+				{"build time", pkg.BuildTime.UTC().String()},
+				{"size", fmt.Sprint(pkg.Size)},
+				{"installed size", fmt.Sprint(pkg.InstalledSize)},
+				{"dependencies", strings.Join(pkg.Dependencies, " ")},
+				{"provides", strings.Join(pkg.Provides, " ")},
+				{"install if", strings.Join(pkg.InstallIf, " ")},
+				{"checksum", pkg.Checksum},
+				{"repository", pkg.Repository},
+			} {
+				if field.value != "" {
+					fmt.Fprintf(w, "  %s:\t%s\n", field.name, field.value)
+				}
+			}
+			fmt.Fprintln(w)
+		}
+		return w.Flush()
+	}); err != nil {
+		return err
+	}
+	if !asJSON {
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(infos)
+}
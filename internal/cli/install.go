@@ -0,0 +1,110 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/apko/pkg/build"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/iocomb"
+	"chainguard.dev/apko/pkg/log"
+)
+
+func install() *cobra.Command {
+	var debugEnabled bool
+	var quietEnabled bool
+	var buildArch string
+	var fakerootDB string
+	var logPolicy []string
+
+	cmd := &cobra.Command{
+		Use:   "install",
+		Short: "Install the root filesystem of an image into a directory",
+		Long: `Install the root filesystem of an image from a YAML configuration file into a
+directory, e.g. to look into it.
+
+What cannot be set on the files on disk, e.g. their owners, devices and extended
+attributes when not running as root, is kept in a database next to the directory,
+as fakeroot does.`,
+		Example: `  apko install <config.yaml> <dir>`,
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(logPolicy) == 0 {
+				if quietEnabled {
+					logPolicy = []string{"builtin:discard"}
+				} else {
+					logPolicy = []string{"builtin:stderr"}
+				}
+			}
+
+			logWriter, err := iocomb.Combine(logPolicy)
+			if err != nil {
+				return fmt.Errorf("invalid logging policy: %w", err)
+			}
+			logger := log.NewLogger(logWriter)
+
+			if fakerootDB == "" {
+				fakerootDB = filepath.Clean(args[1]) + ".fakeroot"
+			}
+			return InstallCmd(cmd.Context(), args[1],
+				build.WithConfig(args[0]),
+				build.WithArch(types.ParseArchitecture(buildArch)),
+				build.WithLogger(logger),
+				build.WithDebugLogging(debugEnabled),
+				build.WithFakerootDB(fakerootDB),
+			)
+		},
+	}
+
+	cmd.Flags().BoolVar(&debugEnabled, "debug", false, "enable debug logging")
+	cmd.Flags().BoolVar(&quietEnabled, "quiet", false, "disable logging")
+	cmd.Flags().StringVar(&buildArch, "build-arch", runtime.GOARCH, "architecture to install for -- default is Go runtime architecture")
+	cmd.Flags().StringVar(&fakerootDB, "fakeroot-db", "", "where to keep the owners, devices and extended attributes of the files (defaults to <dir>.fakeroot)")
+	cmd.Flags().StringSliceVar(&logPolicy, "log-policy", []string{}, "logging policy to use")
+
+	return cmd
+}
+
+// InstallCmd installs the root filesystem of the image into the directory.
+func InstallCmd(ctx context.Context, dir string, opts ...build.Option) error {
+	bc, err := build.New(dir, opts...)
+	if err != nil {
+		return err
+	}
+
+	if err := bc.ImageConfiguration.ApplyArchOverride(bc.Options.Arch); err != nil {
+		return err
+	}
+	if err := bc.Refresh(); err != nil {
+		return err
+	}
+
+	if len(bc.ImageConfiguration.Archs) != 0 {
+		bc.Logger().Printf("WARNING: ignoring archs in config, only installing for current arch (%s)", bc.Options.Arch)
+	}
+
+	if _, err := bc.BuildImage(); err != nil {
+		return fmt.Errorf("failed to install image: %w", err)
+	}
+	bc.Logger().Printf("installed image in %s", dir)
+
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+// runArchs runs fn for each architecture, at most jobs at once, or all at
+// once if jobs is not positive. The first failure cancels the context passed
+// to the others, and keeps the ones not started yet from starting. The
+// errors of the architectures which failed are returned in the order of the
+// architectures, so that what is reported does not depend on scheduling.
+func runArchs(ctx context.Context, archs []types.Architecture, jobs int, fn func(context.Context, types.Architecture) error) error {
+	g, gctx := errgroup.WithContext(ctx)
+	if jobs > 0 {
+		g.SetLimit(jobs)
+	}
+	errs := make([]error, len(archs))
+	for i, arch := range archs {
+		i, arch := i, arch
+		g.Go(func() error {
+			if err := gctx.Err(); err != nil {
+				return err
+			}
+			errs[i] = fn(gctx, arch)
+			return errs[i]
+		})
+	}
+	waitErr := g.Wait()
+
+	var failed archErrors
+	for i, err := range errs {
+		// architectures cancelled because another failed did not fail
+		// themselves
+		if err == nil || (errors.Is(err, context.Canceled) && ctx.Err() == nil) {
+			continue
+		}
+		failed = append(failed, archError{arch: archs[i], err: err})
+	}
+	switch {
+	case len(failed) > 0:
+		return failed
+	case waitErr != nil:
+		// only cancelled architectures, because ctx was
+		return waitErr
+	default:
+		return nil
+	}
+}
+
+type archError struct {
+	arch types.Architecture
+	err  error
+}
+
+// archErrors are the errors of the architectures which failed, in the order
+// of the architectures.
+type archErrors []archError
+
+func (e archErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].err.Error()
+	}
+	msgs := make([]string, 0, len(e))
+	for _, ae := range e {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", ae.arch, ae.err))
+	}
+	return fmt.Sprintf("%d architectures failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the error of the first architecture which failed.
+func (e archErrors) Unwrap() error {
+	return e[0].err
+}
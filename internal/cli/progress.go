@@ -0,0 +1,191 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+
+	apkimpl "chainguard.dev/apko/pkg/apk/impl"
+	"chainguard.dev/apko/pkg/build"
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+const progressBarWidth = 20
+
+// progressBars shows how installing the packages of each architecture goes,
+// as a line of progress bars redrawn in place on a terminal, or as a line per
+// installed package otherwise.
+type progressBars struct {
+	out      io.Writer
+	terminal bool
+
+	mu    sync.Mutex
+	archs map[string]*archProgress
+}
+
+func newProgressBars(out *os.File) *progressBars {
+	return &progressBars{
+		out:      out,
+		terminal: term.IsTerminal(int(out.Fd())),
+		archs:    map[string]*archProgress{},
+	}
+}
+
+var _ apkimpl.Progress = (*archProgress)(nil)
+
+// progressOption returns the build option showing progress bars on stderr if
+// show is set, which forArch splits by architecture.
+func progressOption(show bool) build.Option {
+	if !show {
+		return build.WithProgress(nil)
+	}
+	return build.WithProgress(newProgressBars(os.Stderr))
+}
+
+// forArch makes the build context one of an architecture: it applies the
+// override of the architecture to its configuration, which the context of
+// the index is kept free of, and gives it a progress of its own, if it
+// reports to progress bars, as the architectures are built at once.
+func forArch(bc *build.Context, arch types.Architecture) error {
+	if err := bc.ImageConfiguration.ApplyArchOverride(arch); err != nil {
+		return err
+	}
+	if p, ok := bc.Options.Progress.(*progressBars); ok {
+		bc.Options.Progress = p.arch(arch.ToAPK())
+	}
+	return nil
+}
+
+func (p *progressBars) arch(name string) *archProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	a := &archProgress{bars: p, name: name}
+	p.archs[name] = a
+	return a
+}
+
+// progressBars reports to the architectures only, but is a Progress so that
+// it can be passed as a build option.
+func (p *progressBars) Start(string, int, int) {}
+func (p *progressBars) Download(int64, int64)  {}
+func (p *progressBars) Extract(int)            {}
+func (p *progressBars) Done()                  {}
+
+// draw redraws the line of progress bars. It must be called with the lock
+// held.
+func (p *progressBars) draw() {
+	names := make([]string, 0, len(p.archs))
+	for name := range p.archs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bars := make([]string, 0, len(names))
+	for _, name := range names {
+		bars = append(bars, p.archs[name].String())
+	}
+	fmt.Fprintf(p.out, "\r\x1b[K%s", strings.Join(bars, "  "))
+}
+
+// archProgress is the progress of installing the packages of an
+// architecture.
+type archProgress struct {
+	bars *progressBars
+	name string
+
+	pkg        string
+	n, total   int
+	read, size int64
+	files      int
+	finished   bool
+}
+
+func (a *archProgress) Start(pkg string, n, total int) {
+	a.update(func() {
+		a.pkg, a.n, a.total = pkg, n, total
+		a.read, a.size, a.files, a.finished = 0, 0, 0, false
+	})
+}
+
+func (a *archProgress) Download(read, size int64) {
+	a.update(func() { a.read, a.size = read, size })
+}
+
+func (a *archProgress) Extract(files int) {
+	a.update(func() { a.files = files })
+}
+
+func (a *archProgress) Done() {
+	a.bars.mu.Lock()
+	defer a.bars.mu.Unlock()
+	if !a.bars.terminal {
+		fmt.Fprintf(a.bars.out, "%s: installed %s (%d/%d, %d files)\n", a.name, a.pkg, a.n, a.total, a.files)
+		return
+	}
+	a.finished = a.n == a.total
+	a.bars.draw()
+	if a.bars.allDone() {
+		fmt.Fprintln(a.bars.out)
+	}
+}
+
+func (a *archProgress) update(f func()) {
+	a.bars.mu.Lock()
+	defer a.bars.mu.Unlock()
+	f()
+	if a.bars.terminal {
+		a.bars.draw()
+	}
+}
+
+// allDone reports whether every architecture installed all its packages. It
+// must be called with the lock held.
+func (p *progressBars) allDone() bool {
+	for _, a := range p.archs {
+		if !a.finished {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the progress bar of the architecture, filled by the number
+// of packages installed, with the package being installed and how much of it
+// is downloaded.
+func (a *archProgress) String() string {
+	installed := a.n - 1
+	if a.finished {
+		installed = a.n
+	}
+	filled := 0
+	if a.total > 0 {
+		filled = installed * progressBarWidth / a.total
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	if a.finished {
+		return fmt.Sprintf("%s [%s] %d/%d", a.name, bar, a.n, a.total)
+	}
+	s := fmt.Sprintf("%s [%s] %d/%d %s", a.name, bar, a.n, a.total, a.pkg)
+	if a.size > 0 && a.read < a.size {
+		s += fmt.Sprintf(" %d%%", a.read*100/a.size)
+	}
+	return s
+}
@@ -17,18 +17,21 @@ package cli
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	coci "github.com/sigstore/cosign/v2/pkg/oci"
 	"github.com/spf13/cobra"
-	"golang.org/x/sync/errgroup"
 
+	apkimpl "chainguard.dev/apko/pkg/apk/impl"
+	"chainguard.dev/apko/pkg/audit"
 	"chainguard.dev/apko/pkg/build"
 	"chainguard.dev/apko/pkg/build/oci"
 	"chainguard.dev/apko/pkg/build/types"
@@ -59,6 +62,34 @@ func publish() *cobra.Command {
 	var writeSBOM bool
 	var local bool
 	var stageTags string
+	var annotationEnvPrefix string
+	var streamLayers bool
+	var skipVariants bool
+	var auditFlags auditFlags
+	var showProgress bool
+	var jobs int
+	var hardened bool
+	var offline bool
+	var userAgent string
+	var headers []string
+	var vars []string
+	var resolverStrategy string
+	var extractionCache string
+	var layerCache string
+	var streamRootfs bool
+	var memoryBudget int64
+	var failOnCaseCollision bool
+	var dedupFiles bool
+	var sizeBudget int64
+	var sparseFiles bool
+	var timestamps string
+	var unsafePaths bool
+	var hostUIDMap, hostGIDMap []string
+	var fetchLimits apkimpl.FetchLimits
+	var resume bool
+	var publishState string
+	var expiresAfter string
+	var tier string
 
 	cmd := &cobra.Command{
 		Use:   "publish",
@@ -87,11 +118,21 @@ in a keychain.`,
 			if !writeSBOM {
 				sbomFormats = []string{}
 			}
+			if streamLayers && local {
+				return fmt.Errorf("--stream cannot be used with --local")
+			}
+			if resume && publishState == "" {
+				return fmt.Errorf("--resume requires --publish-state")
+			}
 			archs := types.ParseArchitectures(archstrs)
 			annotations, err := parseAnnotations(rawAnnotations)
 			if err != nil {
 				return fmt.Errorf("parsing annotations from command line: %w", err)
 			}
+			auditOpt, err := auditFlags.option()
+			if err != nil {
+				return err
+			}
 			if err := PublishCmd(cmd.Context(), imageRefs, archs,
 				build.WithConfig(args[0]),
 				build.WithDockerMediatypes(useDockerMediaTypes),
@@ -113,6 +154,32 @@ in a keychain.`,
 				build.WithLocal(local),
 				build.WithStageTags(stageTags),
 				build.WithBuildOptions(buildOptions),
+				build.WithAnnotationsFromEnvironment(annotationEnvPrefix),
+				build.WithStreamLayers(streamLayers),
+				build.WithSkipVariants(skipVariants),
+				build.WithExpiry(expiresAfter, tier),
+				build.WithPublishState(publishState, resume),
+				auditOpt,
+				progressOption(showProgress),
+				build.WithJobs(jobs),
+				build.WithHardened(hardened),
+				build.WithOffline(offline),
+				build.WithFetchLimits(fetchLimits),
+				build.WithUserAgent(userAgent),
+				build.WithHeaders(headers),
+				build.WithVars(vars),
+				build.WithResolverStrategy(resolverStrategy),
+				build.WithExtractionCache(extractionCache),
+				build.WithLayerCache(layerCache),
+				build.WithStreamingFS(streamRootfs),
+				build.WithMemoryBudget(memoryBudget),
+				build.WithFailOnCaseCollision(failOnCaseCollision),
+				build.WithDeduplication(dedupFiles),
+				build.WithSizeBudget(sizeBudget),
+				build.WithSparseFiles(sparseFiles),
+				build.WithTimestampPolicy(timestamps),
+				build.WithUnsafePaths(unsafePaths),
+				build.WithHostIDMap(hostUIDMap, hostGIDMap),
 			); err != nil {
 				return err
 			}
@@ -139,24 +206,160 @@ in a keychain.`,
 	cmd.Flags().StringSliceVar(&buildOptions, "build-option", []string{}, "build options to enable")
 	cmd.Flags().StringSliceVar(&logPolicy, "log-policy", []string{}, "logging policy to use")
 	cmd.Flags().StringSliceVar(&rawAnnotations, "annotations", []string{}, "OCI annotations to add. Separate with colon (key:value)")
+	cmd.Flags().StringVar(&annotationEnvPrefix, "annotation-env-prefix", build.DefaultAnnotationEnvPrefix, "prefix of environment variables to add as OCI annotations (empty to disable)")
 	cmd.Flags().BoolVar(&local, "local", false, "publish image just to local Docker daemon")
 	cmd.Flags().StringVar(&stageTags, "stage-tags", "", "path to file to write list of tags to instead of publishing them")
+	cmd.Flags().BoolVar(&skipVariants, "skip-variants", false, "do not publish the variants declared in the config")
+	cmd.Flags().BoolVar(&streamLayers, "stream", false, "stream layers to the registry as they are built instead of writing them to disk first (layer digests differ from non-streamed builds)")
+	cmd.Flags().StringVar(&expiresAfter, "expires-after", "", "how long registries keep the images, e.g. 2w, set as the quay.expires-after annotation and label")
+	cmd.Flags().StringVar(&tier, "tier", "", "retention tier of the images, for registry policies keyed on it")
+	cmd.Flags().BoolVar(&showProgress, "progress", false, "show the progress of installing the packages on stderr")
+	cmd.Flags().IntVar(&jobs, "jobs", 0, "how many architectures to build and publish at once (0 for all of them)")
+	cmd.Flags().BoolVar(&hardened, "hardened", false, "limit how much of the repository indexes and packages is read, for untrusted inputs")
+	cmd.Flags().BoolVar(&offline, "offline", false, "forbid any network access, failing with the list of keys, indexes and packages which are not local")
+	cmd.Flags().IntVar(&fetchLimits.MaxConnections, "max-connections", 0, "how many downloads may run at once (0 for no limit)")
+	cmd.Flags().Int64Var(&fetchLimits.MaxBandwidth, "max-bandwidth", 0, "how many bytes per second may be downloaded in total (0 for no limit)")
+	cmd.Flags().StringVar(&userAgent, "user-agent", "", "User-Agent of the requests for keys, indexes and packages")
+	cmd.Flags().StringArrayVar(&vars, "set", nil, "value of a variable of the configuration, as NAME=value, taking precedence over the environment and its default (can be repeated)")
+	cmd.Flags().StringArrayVar(&headers, "header", nil, "header to add to the requests for keys, indexes and packages to the hosts of the repositories, as \"Name: value\" (can be repeated)")
+	cmd.Flags().StringVar(&resolverStrategy, "resolver-strategy", string(apkimpl.PreferHighest), "which of the versions meeting the constraints to install: highest or lowest")
+	cmd.Flags().StringVar(&extractionCache, "extraction-cache", "", "directory to keep the expanded packages in, so that later builds do not download them again")
+	cmd.Flags().StringVar(&layerCache, "layer-cache", "", "directory to keep the image layers in, so that later builds with the same resolved inputs reuse them")
+	cmd.Flags().BoolVar(&streamRootfs, "stream-rootfs", false, "write the files of the packages straight to the layer as they are installed, rather than to the working directory")
+	cmd.Flags().Int64Var(&memoryBudget, "memory-budget", 0, "build the filesystem in memory, writing large files to the working directory once this many bytes are held (0 to build it in the working directory)")
+	cmd.Flags().BoolVar(&failOnCaseCollision, "fail-on-case-collision", false, "fail when two paths differ only by case and the working directory is case-insensitive, rather than warning")
+	cmd.Flags().BoolVar(&dedupFiles, "dedup-files", false, "write files with the same content and attributes once in the layer, the others being hardlinks to it")
+	cmd.Flags().Int64Var(&sizeBudget, "size-budget", 0, "fail if the layer takes more than this many bytes, uncompressed (0 for no budget)")
+	cmd.Flags().BoolVar(&sparseFiles, "sparse-files", false, "write files with large runs of zeros as sparse entries in the layer")
+	cmd.Flags().StringVar(&timestamps, "timestamps", "epoch", "what the modification times of the files become in the layer: epoch (SOURCE_DATE_EPOCH), preserve (from the packages), clamp (no later than SOURCE_DATE_EPOCH) or zero")
+	cmd.Flags().BoolVar(&unsafePaths, "unsafe-paths", false, "install the files of packages whose paths go through \"..\" rather than failing, for trusted packages only")
+	cmd.Flags().StringSliceVar(&hostUIDMap, "host-uid-map", nil, "uids to give the files of the working directory for those of the image, as <uid>:<host uid>, e.g. to build without root")
+	cmd.Flags().StringSliceVar(&hostGIDMap, "host-gid-map", nil, "gids to give the files of the working directory for those of the image, as <gid>:<host gid>, e.g. to build without root")
+	cmd.Flags().StringVar(&publishState, "publish-state", "", "path to file recording the images published so far, for --resume")
+	cmd.Flags().BoolVar(&resume, "resume", false, "resume a failed publish of the same inputs recorded in --publish-state, publishing only the images it did not publish and the index")
+	auditFlags.addFlags(cmd)
 
 	return cmd
 }
 
 func PublishCmd(ctx context.Context, outputRefs string, archs []types.Architecture, opts ...build.Option) error {
+	res, err := publishWithVariants(ctx, archs, opts...)
+	if err != nil {
+		return err
+	}
+	bc := res.bc
+	builtReferences := res.references
+	stagedTags := res.stagedTags
+
+	if bc.Options.StageTags != "" {
+		tmp := map[string]bool{}
+		for _, tag := range stagedTags {
+			tmp[tag] = true
+		}
+		sortedUniqueTags := make([]string, 0, len(tmp))
+		for k := range tmp {
+			sortedUniqueTags = append(sortedUniqueTags, k)
+		}
+		sort.Strings(sortedUniqueTags)
+		bc.Logger().Printf("Writing list of tags to %s (%d total)", bc.Options.StageTags, len(sortedUniqueTags))
+
+		//nolint:gosec // Make tags file readable by non-root
+		if err := os.WriteFile(bc.Options.StageTags, []byte(strings.Join(sortedUniqueTags, "\n")+"\n"), 0666); err != nil {
+			return fmt.Errorf("failed to write tags: %w", err)
+		}
+	}
+
+	// If saving local, exit early (no SBOMs etc.)
+	if bc.Options.Local {
+		fmt.Println(strings.Split(res.digest.String(), "@")[0])
+		return nil
+	}
+
+	// If provided, this is the name of the file to write digest referenced into
+	if outputRefs != "" {
+		//nolint:gosec // Make image ref file readable by non-root
+		if err := os.WriteFile(outputRefs, []byte(strings.Join(builtReferences, "\n")+"\n"), 0666); err != nil {
+			return fmt.Errorf("failed to write digest: %w", err)
+		}
+	}
+
+	// Write the image digest to STDOUT in order to enable command
+	// composition e.g. kn service create --image=$(apko publish ...)
+	fmt.Println(res.digest)
+
+	return nil
+}
+
+// publishWithVariants publishes the images and, unless they are skipped,
+// the variants of the configuration, whose references and staged tags are
+// added to those of the images.
+func publishWithVariants(ctx context.Context, archs []types.Architecture, opts ...build.Option) (*published, error) {
+	res, err := publishImages(ctx, archs, opts...)
+	if err != nil {
+		return nil, err
+	}
+	bc := res.bc
+	if bc.Options.SkipVariants {
+		return res, nil
+	}
+
+	base, err := writeVariantBase(bc, res.images)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(base)
+	for _, variant := range bc.ImageConfiguration.VariantNames() {
+		bc.Logger().Infof("publishing %s variant", variant)
+		variantRes, err := publishImages(ctx, archs, variantOptions(bc, variant, base, opts)...)
+		if err != nil {
+			return nil, fmt.Errorf("publishing %s variant: %w", variant, err)
+		}
+		bc.Logger().Printf("published %s variant as %s", variant, variantRes.digest)
+		res.references = append(res.references, variantRes.references...)
+		res.stagedTags = append(res.stagedTags, variantRes.stagedTags...)
+	}
+	return res, nil
+}
+
+// published describes the outcome of publishImages.
+type published struct {
+	// bc is the build context the images were built from
+	bc *build.Context
+	// digest is the digest of the index, or of the image if there is just one
+	digest name.Digest
+	// images are the images of each architecture
+	images map[types.Architecture]coci.SignedImage
+	// references are the digest references of everything which was published
+	references []string
+	// stagedTags are the tags which were staged instead of being published
+	stagedTags []string
+}
+
+// publishImages builds and publishes the images for all architectures, and
+// the index if there is more than one.
+func publishImages(ctx context.Context, archs []types.Architecture, opts ...build.Option) (res *published, err error) {
 	wd, err := os.MkdirTemp("", "apko-*")
 	if err != nil {
-		return fmt.Errorf("failed to create working directory: %w", err)
+		return nil, fmt.Errorf("failed to create working directory: %w", err)
 	}
 	defer os.RemoveAll(wd)
 
 	bc, err := build.New(wd, opts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	started := time.Now()
+	defer func() {
+		var outputs []string
+		if res != nil {
+			outputs = append(append(outputs, res.references...), res.stagedTags...)
+		}
+		if auditErr := bc.RecordAudit(ctx, audit.ActionPublish, started, outputs, err); auditErr != nil && err == nil {
+			err = auditErr
+		}
+	}()
+
 	// cases:
 	// - archs set: use those archs
 	// - archs not set, bc.ImageConfiguration.Archs set: use Config archs
@@ -171,6 +374,10 @@ func PublishCmd(ctx context.Context, outputRefs string, archs []types.Architectu
 	}
 	// save the final set we will build
 	archs = bc.ImageConfiguration.Archs
+	state, err := bc.PublishState()
+	if err != nil {
+		return nil, err
+	}
 	bc.Logger().Infof(
 		"Publishing images for %d architectures: %+v",
 		len(bc.ImageConfiguration.Archs),
@@ -184,11 +391,12 @@ func PublishCmd(ctx context.Context, outputRefs string, archs []types.Architectu
 
 	bc.Logger().Printf("building tags %v", bc.Options.Tags)
 
-	var errg errgroup.Group
 	workDir := bc.Options.WorkDir
 	imgs := map[types.Architecture]coci.SignedImage{}
+	digests := map[types.Architecture]name.Digest{}
 	contexts := map[types.Architecture]*build.Context{}
-	imageTars := map[types.Architecture]string{}
+	imageTars := map[types.Architecture][]string{}
+	var mu sync.Mutex
 
 	// This is a hack to skip the SBOM generation during
 	// image build. Will be removed when global options are a thing.
@@ -200,93 +408,124 @@ func PublishCmd(ctx context.Context, outputRefs string, archs []types.Architectu
 	var finalDigest name.Digest
 	var idx coci.SignedImageIndex
 
-	// References, collect'em all!
-	builtReferences := []string{}
-	additionalTags := []string{}
-
-	mtx := sync.Mutex{}
-
 	for _, arch := range archs {
-		arch := arch
 		// working directory for this architecture
 		wd := filepath.Join(workDir, arch.ToAPK())
 		bc, err := build.New(wd, opts...)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// we do not generate SBOMs for each arch, only possibly for final image
 		bc.Options.SBOMFormats = []string{}
 		bc.Options.WantSBOM = false
 		bc.ImageConfiguration.Archs = archs
+		bc.Options.Arch = arch
+		bc.Options.WorkDir = wd
 
 		// save the build context for later
 		contexts[arch] = bc
 
-		errg.Go(func() error {
-			bc.Options.Arch = arch
-			bc.Options.WorkDir = wd
+		if err := forArch(bc, arch); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := runArchs(ctx, archs, bc.Options.Jobs, func(ctx context.Context, arch types.Architecture) error {
+		bc := contexts[arch]
+		if err := bc.Refresh(); err != nil {
+			return fmt.Errorf("failed to update build context for %q: %w", arch, err)
+		}
 
-			if err := bc.Refresh(); err != nil {
-				return fmt.Errorf("failed to update build context for %q: %w", arch, err)
+		resumed, ok, err := state.Image(arch)
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var digest name.Digest
+		var img coci.SignedImage
+		if ok {
+			// the image is still built, for its tags and SBOM, but not
+			// published again
+			bc.Logger().Infof("%s image was published already as %s, resuming", arch, resumed)
+			if _, err := bc.BuildLayers(); err != nil {
+				return fmt.Errorf("failed to build layer image for %q: %w", arch, err)
+			}
+			if img, err = oci.FetchImage(resumed); err != nil {
+				return fmt.Errorf("resuming %s image: %w", arch, err)
+			}
+			digest = resumed
+		} else if bc.Options.StreamLayers {
+			layerTar, err := bc.BuildLayerStream()
+			if err != nil {
+				return fmt.Errorf("failed to build layer image for %q: %w", arch, err)
 			}
 
-			layerTarGZ, err := bc.BuildLayer()
+			digest, img, err = publishImageStream(bc, layerTar, arch)
+			if err != nil {
+				return fmt.Errorf("publishing %s image: %w", arch, err)
+			}
+		} else {
+			layers, err := bc.BuildLayers()
 			if err != nil {
 				return fmt.Errorf("failed to build layer image for %q: %w", arch, err)
 			}
-			imageTars[arch] = layerTarGZ
+			mu.Lock()
+			imageTars[arch] = layers
+			mu.Unlock()
 			// TODO(kaniini): clean up everything correctly for multitag scenario
 			// defer os.Remove(layerTarGZ)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 
-			var img coci.SignedImage
-			finalDigest, img, err = publishImage(bc, layerTarGZ, arch)
+			digest, img, err = publishImage(bc, layers, arch)
 			if err != nil {
 				return fmt.Errorf("publishing %s image: %w", arch, err)
 			}
-			// This should be the same across architectures
-			additionalTags = bc.Options.Tags
+		}
+		if err := state.Record(arch, digest); err != nil {
+			return err
+		}
 
-			builtReferences = append(builtReferences, finalDigest.String())
-			mtx.Lock()
-			imgs[arch] = img
-			mtx.Unlock()
-			return nil
-		})
+		mu.Lock()
+		imgs[arch] = img
+		digests[arch] = digest
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
-	if err := errg.Wait(); err != nil {
-		return err
+	// References, collect'em all, in the order of the architectures
+	builtReferences := make([]string, 0, len(archs)+1)
+	for _, arch := range archs {
+		builtReferences = append(builtReferences, digests[arch].String())
 	}
+	finalDigest = digests[archs[0]]
+	// This should be the same across architectures
+	additionalTags := contexts[archs[0]].Options.Tags
 
 	if len(archs) > 1 {
 		finalDigest, idx, err = publishIndex(bc, imgs)
 		if err != nil {
-			return fmt.Errorf("publishing image index: %w", err)
+			return nil, fmt.Errorf("publishing image index: %w", err)
 		}
 		builtReferences = append(builtReferences, finalDigest.String())
 	}
 
+	var stagedTags []string
 	if bc.Options.StageTags != "" {
 		allTags := bc.Options.Tags
 		allTags = append(allTags, additionalTags...)
-		tmp := map[string]bool{}
 		for _, tag := range allTags {
 			if !strings.Contains(tag, ":") {
 				tag = fmt.Sprintf("%s:latest", tag)
 			}
-			tmp[tag] = true
-		}
-		sortedUniqueTags := make([]string, 0, len(tmp))
-		for k := range tmp {
-			sortedUniqueTags = append(sortedUniqueTags, k)
-		}
-		sort.Strings(sortedUniqueTags)
-		bc.Logger().Printf("Writing list of tags to %s (%d total)", bc.Options.StageTags, len(sortedUniqueTags))
-
-		//nolint:gosec // Make tags file readable by non-root
-		if err := os.WriteFile(bc.Options.StageTags, []byte(strings.Join(sortedUniqueTags, "\n")+"\n"), 0666); err != nil {
-			return fmt.Errorf("failed to write tags: %w", err)
+			stagedTags = append(stagedTags, tag)
 		}
 	} else {
 		skipLocalCopy := strings.HasPrefix(finalDigest.Name(), fmt.Sprintf("%s/", oci.LocalDomain))
@@ -296,7 +535,7 @@ func PublishCmd(ctx context.Context, outputRefs string, archs []types.Architectu
 				continue
 			}
 			if err := oci.Copy(finalDigest.Name(), at); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
@@ -304,8 +543,7 @@ func PublishCmd(ctx context.Context, outputRefs string, archs []types.Architectu
 	// If saving local, exit early (no SBOMs etc.)
 	if bc.Options.Local {
 		bc.Logger().Printf("using local option, exiting early")
-		fmt.Println(strings.Split(finalDigest.String(), "@")[0])
-		return nil
+		return &published{bc: bc, digest: finalDigest, images: imgs, references: builtReferences, stagedTags: stagedTags}, nil
 	}
 
 	bc.Options.SBOMFormats = formats
@@ -316,8 +554,8 @@ func PublishCmd(ctx context.Context, outputRefs string, archs []types.Architectu
 
 	if wantSBOM {
 		bc.Options.Log.Infof("Generating arch image SBOMs")
-		for arch, img := range imgs {
-			bc := contexts[arch]
+		if err := runArchs(ctx, archs, bc.Options.Jobs, func(ctx context.Context, arch types.Architecture) error {
+			bc, img := contexts[arch], imgs[arch]
 
 			bc.Options.WantSBOM = true
 			bc.Options.SBOMFormats = formats
@@ -326,56 +564,53 @@ func PublishCmd(ctx context.Context, outputRefs string, archs []types.Architectu
 			if err := bc.GenerateImageSBOM(arch, img); err != nil {
 				return fmt.Errorf("generating sbom for %s: %w", arch, err)
 			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 
 			if _, err := oci.PostAttachSBOM(
 				img, sbomPath, bc.Options.SBOMFormats, arch, bc.Logger(), bc.Options.Tags...,
 			); err != nil {
 				return fmt.Errorf("attaching sboms to %s image: %w", arch, err)
 			}
+			return nil
+		}); err != nil {
+			return nil, err
 		}
 
 		if err := bc.GenerateIndexSBOM(finalDigest, imgs); err != nil {
-			return fmt.Errorf("generating index SBOM: %w", err)
+			return nil, fmt.Errorf("generating index SBOM: %w", err)
 		}
 
 		if idx != nil {
 			if _, err := oci.PostAttachSBOM(
 				idx, sbomPath, bc.Options.SBOMFormats, types.Architecture{}, bc.Logger(), bc.Options.Tags...,
 			); err != nil {
-				return fmt.Errorf("attaching sboms to index: %w", err)
+				return nil, fmt.Errorf("attaching sboms to index: %w", err)
 			}
 		}
 	}
 
-	// If provided, this is the name of the file to write digest referenced into
-	if outputRefs != "" {
-		//nolint:gosec // Make image ref file readable by non-root
-		if err := os.WriteFile(outputRefs, []byte(strings.Join(builtReferences, "\n")+"\n"), 0666); err != nil {
-			return fmt.Errorf("failed to write digest: %w", err)
-		}
+	if err := state.Done(); err != nil {
+		return nil, err
 	}
-
-	// Write the image digest to STDOUT in order to enable command
-	// composition e.g. kn service create --image=$(apko publish ...)
-	fmt.Println(finalDigest)
-
-	return nil
+	return &published{bc: bc, digest: finalDigest, images: imgs, references: builtReferences, stagedTags: stagedTags}, nil
 }
 
 // publishImage publishes a specific architecture image
-func publishImage(bc *build.Context, layerTarGZ string, arch types.Architecture) (imgDigest name.Digest, img coci.SignedImage, err error) {
+func publishImage(bc *build.Context, layers []string, arch types.Architecture) (imgDigest name.Digest, img coci.SignedImage, err error) {
 	shouldPushTags := bc.Options.StageTags == ""
 	if bc.Options.UseDockerMediaTypes {
-		imgDigest, img, err = oci.PublishDockerImageFromLayer(
-			layerTarGZ, bc.ImageConfiguration, bc.Options.SourceDateEpoch, arch, bc.Logger(),
+		imgDigest, img, err = oci.PublishDockerImageFromLayers(
+			layers, bc.ImageConfiguration, bc.Options.SourceDateEpoch, arch, bc.Logger(),
 			bc.Options.SBOMPath, bc.Options.SBOMFormats, bc.Options.Local, shouldPushTags, bc.Options.Tags...,
 		)
 		if err != nil {
 			return name.Digest{}, nil, fmt.Errorf("failed to build Docker image for %q: %w", arch, err)
 		}
 	} else {
-		imgDigest, img, err = oci.PublishImageFromLayer(
-			layerTarGZ, bc.ImageConfiguration, bc.Options.SourceDateEpoch, arch, bc.Logger(),
+		imgDigest, img, err = oci.PublishImageFromLayers(
+			layers, bc.ImageConfiguration, bc.Options.SourceDateEpoch, arch, bc.Logger(),
 			bc.Options.SBOMPath, bc.Options.SBOMFormats, bc.Options.Local, shouldPushTags, bc.Options.Tags...,
 		)
 		if err != nil {
@@ -385,6 +620,30 @@ func publishImage(bc *build.Context, layerTarGZ string, arch types.Architecture)
 	return imgDigest, img, nil
 }
 
+// publishImageStream publishes a specific architecture image, streaming
+// its layer to the registry
+func publishImageStream(bc *build.Context, layerTar io.ReadCloser, arch types.Architecture) (imgDigest name.Digest, img coci.SignedImage, err error) {
+	shouldPushTags := bc.Options.StageTags == ""
+	if bc.Options.UseDockerMediaTypes {
+		imgDigest, img, err = oci.PublishDockerImageFromLayerStream(
+			layerTar, bc.ImageConfiguration, bc.Options.SourceDateEpoch, arch, bc.Logger(),
+			bc.Options.SBOMPath, bc.Options.SBOMFormats, shouldPushTags, bc.Options.Tags...,
+		)
+		if err != nil {
+			return name.Digest{}, nil, fmt.Errorf("failed to build Docker image for %q: %w", arch, err)
+		}
+	} else {
+		imgDigest, img, err = oci.PublishImageFromLayerStream(
+			layerTar, bc.ImageConfiguration, bc.Options.SourceDateEpoch, arch, bc.Logger(),
+			bc.Options.SBOMPath, bc.Options.SBOMFormats, shouldPushTags, bc.Options.Tags...,
+		)
+		if err != nil {
+			return name.Digest{}, nil, fmt.Errorf("failed to build OCI image for %q: %w", arch, err)
+		}
+	}
+	return imgDigest, img, nil
+}
+
 // publishIndex publishes the new image index
 func publishIndex(bc *build.Context, imgs map[types.Architecture]coci.SignedImage) (
 	indexDigest name.Digest, idx coci.SignedImageIndex, err error,
@@ -0,0 +1,89 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	apkimpl "chainguard.dev/apko/pkg/apk/impl"
+	"chainguard.dev/apko/pkg/build"
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+func search() *cobra.Command {
+	var extraKeys []string
+	var extraRepos []string
+	var archstrs []string
+	var query apkimpl.SearchQuery
+
+	cmd := &cobra.Command{
+		Use:   "search",
+		Short: "Search the repositories of a configuration for packages",
+		Long: `Search the repositories of a configuration for packages whose name matches a
+glob, which provide something matching a glob, or whose description contains
+a text, and show their versions and origins.`,
+		Example: `  apko search <config.yaml> 'py3-*'
+  apko search <config.yaml> --provides 'cmd:bash'`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				query.Name = args[1]
+			}
+			if query == (apkimpl.SearchQuery{}) {
+				return fmt.Errorf("a name, --provides or --description is required")
+			}
+			return SearchCmd(cmd.Context(), types.ParseArchitectures(archstrs), query,
+				build.WithConfig(args[0]),
+				build.WithExtraKeys(extraKeys),
+				build.WithExtraRepos(extraRepos),
+			)
+		},
+	}
+
+	cmd.Flags().StringVar(&query.Provides, "provides", "", "glob matching something the packages provide, e.g. so:libssl.so.*")
+	cmd.Flags().StringVar(&query.Description, "description", "", "text the description of the packages contains, ignoring case")
+	cmd.Flags().StringSliceVarP(&extraKeys, "keyring-append", "k", []string{}, "path to extra keys to include in the keyring")
+	cmd.Flags().StringSliceVarP(&extraRepos, "repository-append", "r", []string{}, "path to extra repositories to include")
+	cmd.Flags().StringSliceVar(&archstrs, "arch", nil, "architectures to search (e.g., x86_64,ppc64le,arm64) -- default is all, unless specified in config. Can also use 'host' to indicate arch of host this is running on")
+
+	return cmd
+}
+
+// SearchCmd shows the packages of the repositories matching the query, for
+// each architecture.
+func SearchCmd(ctx context.Context, archs []types.Architecture, query apkimpl.SearchQuery, opts ...build.Option) error {
+	return forEachArch(archs, opts, func(arch types.Architecture, bc *build.Context) error {
+		pkgs, err := bc.Search(query)
+		if err != nil {
+			return fmt.Errorf("failed to search packages: %w", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, arch)
+		fmt.Fprintln(w, "  NAME\tVERSION\tORIGIN\tREPOSITORY")
+		for _, pkg := range pkgs {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", pkg.Name, pkg.Version, pkg.Origin, pkg.Repository().Uri)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Println()
+		return nil
+	})
+}
@@ -0,0 +1,491 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+
+	"chainguard.dev/apko/pkg/build"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/iocomb"
+	"chainguard.dev/apko/pkg/log"
+)
+
+// maxServedConfigSize bounds the size of the configurations of the builds
+// requested, all of which are far smaller.
+const maxServedConfigSize = 1 << 20
+
+// keepFinishedBuilds is how long the outcome of a build can be asked for once
+// it is finished.
+const keepFinishedBuilds = time.Hour
+
+func serve() *cobra.Command {
+	var addr string
+	var tenantsFile string
+	var debugEnabled bool
+	var quietEnabled bool
+	var logPolicy []string
+	var hardened bool
+	var maxConcurrentBuilds int
+
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Build and publish images for the tenants of a shared build service",
+		Long: `Serve the builds of several tenants, e.g. teams sharing a build service, over HTTP.
+
+The tenants are read from a YAML file. Each has the token its requests carry as a
+bearer token, and what it may build: the repositories, keys, registries, bases and
+sources it may use, how large its builds may be, and its own temporary and cache
+directories.
+
+A build is requested with a POST of its configuration to /v1/builds, with the tags
+to publish the image as, and optionally its architectures, the values of its
+variables and its priority, as the tag, arch, set and priority query parameters.
+The configuration may not include others, which would be read from the service.
+
+The builds are queued, higher priorities first, and run once there are fewer than
+--max-concurrent-builds running overall, and than the max-concurrent-builds of
+their tenant. The request returns the id of the build right away: a GET of
+/v1/builds/<id> returns its state and outcome, and a DELETE cancels it. The number
+of builds queued and running, and of those finished, by tenant, are served as
+Prometheus metrics on /metrics, which requires no token.`,
+		Example: `  apko serve --tenants tenants.yaml --addr :8080
+  curl -H "Authorization: Bearer $TOKEN" --data-binary @config.yaml \
+    "http://localhost:8080/v1/builds?tag=registry.example.com/team/app:latest"
+  curl -H "Authorization: Bearer $TOKEN" http://localhost:8080/v1/builds/<id>`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(logPolicy) == 0 {
+				if quietEnabled {
+					logPolicy = []string{"builtin:discard"}
+				} else {
+					logPolicy = []string{"builtin:stderr"}
+				}
+			}
+
+			logWriter, err := iocomb.Combine(logPolicy)
+			if err != nil {
+				return fmt.Errorf("invalid logging policy: %w", err)
+			}
+			logger := log.NewLogger(logWriter)
+
+			return ServeCmd(cmd.Context(), addr, tenantsFile, maxConcurrentBuilds, logger,
+				build.WithDebugLogging(debugEnabled),
+				build.WithHardened(hardened),
+			)
+		},
+	}
+
+	cmd.Flags().StringVar(&addr, "addr", ":8080", "address to listen on")
+	cmd.Flags().StringVar(&tenantsFile, "tenants", "", "path to the YAML file of the tenants")
+	cmd.Flags().BoolVar(&debugEnabled, "debug", false, "enable debug logging")
+	cmd.Flags().BoolVar(&quietEnabled, "quiet", false, "disable logging")
+	cmd.Flags().StringSliceVar(&logPolicy, "log-policy", []string{}, "logging policy to use")
+	cmd.Flags().BoolVar(&hardened, "hardened", true, "limit how much of the repository indexes and packages is read, as the configurations are untrusted")
+	cmd.Flags().IntVar(&maxConcurrentBuilds, "max-concurrent-builds", 4, "how many builds may run at once overall, the others waiting in the queue (0 for no limit)")
+	_ = cmd.MarkFlagRequired("tenants")
+
+	return cmd
+}
+
+// ServeCmd serves the builds of the tenants of the file on the address,
+// running at most maxConcurrentBuilds of them at once, if positive, until the
+// context is done, which cancels the builds. The options apply to all the
+// builds.
+func ServeCmd(ctx context.Context, addr, tenantsFile string, maxConcurrentBuilds int, logger log.Logger, opts ...build.Option) error {
+	tenants, err := loadTenants(tenantsFile)
+	if err != nil {
+		return err
+	}
+
+	s := newBuildServer(ctx, tenants, build.NewQueue(maxConcurrentBuilds), logger, opts...)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+
+	logger.Infof("serving the builds of %d tenants on %s", len(tenants), addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// serveTenant is a tenant of apko serve, whose requests carry its token as a
+// bearer token. The priorities of its builds are lowered to MaxPriority, so
+// that tenants cannot put theirs ahead of the others unless allowed to.
+type serveTenant struct {
+	build.Tenant `yaml:",inline"`
+	Token        string `yaml:"token"`
+	MaxPriority  int    `yaml:"max-priority,omitempty"`
+}
+
+// loadTenants reads the tenants of apko serve, as a list under "tenants".
+// Unknown fields are rejected, rather than leaving a tenant less restricted
+// than intended.
+func loadTenants(path string) ([]serveTenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading tenants: %w", err)
+	}
+	var cfg struct {
+		Tenants []serveTenant `yaml:"tenants"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parsing tenants %s: %w", path, err)
+	}
+
+	names, tokens := map[string]bool{}, map[string]bool{}
+	for _, t := range cfg.Tenants {
+		switch {
+		case t.Name == "":
+			return nil, fmt.Errorf("tenant without a name in %s", path)
+		case t.Token == "":
+			return nil, fmt.Errorf("tenant %s has no token", t.Name)
+		case names[t.Name]:
+			return nil, fmt.Errorf("tenant %s is there twice", t.Name)
+		case tokens[t.Token]:
+			return nil, fmt.Errorf("tenant %s has the token of another one", t.Name)
+		}
+		names[t.Name], tokens[t.Token] = true, true
+	}
+	if len(cfg.Tenants) == 0 {
+		return nil, fmt.Errorf("no tenants in %s", path)
+	}
+	return cfg.Tenants, nil
+}
+
+// buildServer serves the builds of its tenants, each restricted to what its
+// tenant is allowed to use, and queued until they can run.
+type buildServer struct {
+	ctx     context.Context
+	tenants []serveTenant
+	queue   *build.Queue
+	logger  log.Logger
+	opts    []build.Option
+
+	mu sync.Mutex
+	// builds are the builds queued, running or finished lately, by id
+	builds map[string]*servedBuild
+	// finished counts the finished builds by tenant and outcome
+	finished map[string]map[string]int
+}
+
+// servedBuild is a build of a tenant, and its outcome once it is finished.
+type servedBuild struct {
+	tenant string
+	qb     *build.QueuedBuild
+	res    *published
+}
+
+// servedBuildStatus is what the service returns of a build.
+type servedBuildStatus struct {
+	ID         string                 `json:"id"`
+	State      build.QueuedBuildState `json:"state"`
+	Digest     string                 `json:"digest,omitempty"`
+	References []string               `json:"references,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+func newBuildServer(ctx context.Context, tenants []serveTenant, queue *build.Queue, logger log.Logger, opts ...build.Option) *buildServer {
+	return &buildServer{
+		ctx:      ctx,
+		tenants:  tenants,
+		queue:    queue,
+		logger:   logger,
+		opts:     opts,
+		builds:   map[string]*servedBuild{},
+		finished: map[string]map[string]int{},
+	}
+}
+
+func (s *buildServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/builds", s.handleBuilds)
+	mux.HandleFunc("/v1/builds/", s.handleBuild)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	return mux
+}
+
+// tenant returns the tenant whose token the request carries, if any.
+func (s *buildServer) tenant(r *http.Request) *serveTenant {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	for i, t := range s.tenants {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+			return &s.tenants[i]
+		}
+	}
+	return nil
+}
+
+func (s *buildServer) handleBuilds(w http.ResponseWriter, r *http.Request) {
+	t := s.tenant(r)
+	if t == nil {
+		http.Error(w, "unknown tenant", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "builds are requested with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	tags := q["tag"]
+	if len(tags) == 0 {
+		http.Error(w, "no tag to publish the image as", http.StatusBadRequest)
+		return
+	}
+	priority := 0
+	if p := q.Get("priority"); p != "" {
+		var err error
+		if priority, err = strconv.Atoi(p); err != nil {
+			http.Error(w, fmt.Sprintf("invalid priority %q", p), http.StatusBadRequest)
+			return
+		}
+	}
+	if priority > t.MaxPriority {
+		priority = t.MaxPriority
+	}
+	ic, err := parseServedConfig(http.MaxBytesReader(w, r.Body, maxServedConfigSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logger := s.logger.WithFields(log.Fields{"tenant": t.Name})
+	opts := append([]build.Option{build.WithLogger(logger)}, s.opts...)
+	opts = append(opts,
+		build.WithImageConfiguration(ic),
+		build.WithTags(tags...),
+		build.WithVars(q["set"]),
+		build.WithAssertions(build.RequireGroupFile(true), build.RequirePasswdFile(true)),
+		// the directories of the service are not those of the tenant
+		build.WithVCS(false),
+	)
+	if t.CacheDir != "" {
+		opts = append(opts,
+			build.WithExtractionCache(filepath.Join(t.CacheDir, "packages")),
+			build.WithLayerCache(filepath.Join(t.CacheDir, "layers")),
+		)
+	}
+	// the tenant checks the build once all the other options are applied
+	opts = append(opts, build.WithTenant(t.Tenant))
+
+	archs := types.ParseArchitectures(q["arch"])
+
+	// the build outlives the request, until the service is stopped
+	sb := &servedBuild{tenant: t.Name}
+	sb.qb = s.queue.Submit(s.ctx, t.Tenant, priority, func(ctx context.Context) error {
+		res, err := publishWithVariants(ctx, archs, opts...)
+		sb.res = res
+		return err
+	})
+	logger.Infof("queued build %s with priority %d", sb.qb.ID, priority)
+
+	s.mu.Lock()
+	s.builds[sb.qb.ID] = sb
+	s.mu.Unlock()
+	go s.finish(sb, logger)
+
+	w.Header().Set("Location", "/v1/builds/"+sb.qb.ID)
+	writeJSON(w, http.StatusAccepted, sb.status())
+}
+
+// finish waits for the build to finish, counts its outcome, and forgets it
+// once its outcome was kept long enough.
+func (s *buildServer) finish(sb *servedBuild, logger log.Logger) {
+	err := sb.qb.Wait()
+	outcome := "succeeded"
+	switch {
+	case errors.Is(err, context.Canceled):
+		outcome = "cancelled"
+		logger.Infof("build %s cancelled", sb.qb.ID)
+	case err != nil:
+		outcome = "failed"
+		logger.Errorf("build %s failed: %v", sb.qb.ID, err)
+	default:
+		logger.Infof("build %s published %s", sb.qb.ID, sb.res.digest)
+	}
+
+	s.mu.Lock()
+	if s.finished[sb.tenant] == nil {
+		s.finished[sb.tenant] = map[string]int{}
+	}
+	s.finished[sb.tenant][outcome]++
+	s.mu.Unlock()
+
+	time.AfterFunc(keepFinishedBuilds, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.builds, sb.qb.ID)
+	})
+}
+
+// handleBuild returns the state and outcome of a build of the tenant, or
+// cancels it.
+func (s *buildServer) handleBuild(w http.ResponseWriter, r *http.Request) {
+	t := s.tenant(r)
+	if t == nil {
+		http.Error(w, "unknown tenant", http.StatusUnauthorized)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/builds/")
+	s.mu.Lock()
+	sb, ok := s.builds[id]
+	s.mu.Unlock()
+	// the builds of other tenants are not there for this one
+	if !ok || sb.tenant != t.Name {
+		http.Error(w, fmt.Sprintf("no build %s", id), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, sb.status())
+	case http.MethodDelete:
+		if !s.queue.Cancel(id) {
+			http.Error(w, fmt.Sprintf("build %s is finished", id), http.StatusConflict)
+			return
+		}
+		// a running build stops once it notices
+		writeJSON(w, http.StatusAccepted, sb.status())
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		http.Error(w, "builds are looked up with a GET and cancelled with a DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMetrics serves the number of builds queued, running and finished of
+// each tenant, in the Prometheus text format.
+func (s *buildServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := s.queue.Stats()
+	s.mu.Lock()
+	finished := map[string]map[string]int{}
+	for tenant, outcomes := range s.finished {
+		finished[tenant] = map[string]int{}
+		for outcome, n := range outcomes {
+			finished[tenant][outcome] = n
+		}
+	}
+	s.mu.Unlock()
+
+	names := make([]string, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		names = append(names, t.Name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# HELP apko_serve_builds_queued Builds waiting in the queue.\n# TYPE apko_serve_builds_queued gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "apko_serve_builds_queued{tenant=%s} %d\n", strconv.Quote(name), stats.ByTenant[name].Queued)
+	}
+	fmt.Fprintf(&buf, "# HELP apko_serve_builds_running Builds running.\n# TYPE apko_serve_builds_running gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "apko_serve_builds_running{tenant=%s} %d\n", strconv.Quote(name), stats.ByTenant[name].Running)
+	}
+	fmt.Fprintf(&buf, "# HELP apko_serve_builds_finished_total Builds finished, by outcome.\n# TYPE apko_serve_builds_finished_total counter\n")
+	for _, name := range names {
+		for _, outcome := range []string{"succeeded", "failed", "cancelled"} {
+			fmt.Fprintf(&buf, "apko_serve_builds_finished_total{tenant=%s,outcome=%q} %d\n", strconv.Quote(name), outcome, finished[name][outcome])
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// status returns the state of the build, and its outcome once it is
+// finished.
+func (sb *servedBuild) status() servedBuildStatus {
+	st := servedBuildStatus{ID: sb.qb.ID, State: sb.qb.State()}
+	if st.State != build.BuildDone {
+		return st
+	}
+	if err := sb.qb.Wait(); err != nil {
+		st.Error = err.Error()
+	} else if sb.res != nil {
+		st.Digest = sb.res.digest.String()
+		st.References = sb.res.references
+	}
+	return st
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// parseServedConfig parses the configuration of a requested build. It may
+// not include others, which would be read from the service, and its paths
+// on the host must be absolute, as they are not relative to anything of the
+// tenant.
+func parseServedConfig(r io.Reader) (types.ImageConfiguration, error) {
+	var ic types.ImageConfiguration
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return ic, fmt.Errorf("reading configuration: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &ic); err != nil {
+		return ic, fmt.Errorf("parsing configuration: %w", err)
+	}
+	if ic.Include != "" || len(ic.Extends) != 0 {
+		return ic, fmt.Errorf("configurations built by the service cannot include others")
+	}
+	for _, mut := range ic.Paths {
+		if mut.Type == types.PathCopy && !filepath.IsAbs(mut.Source) {
+			return ic, fmt.Errorf("path %s copies the relative path %s", mut.Path, mut.Source)
+		}
+		if mut.Type == types.PathArchive && !filepath.IsAbs(mut.Source) && !types.IsArchiveURL(mut.Source) {
+			return ic, fmt.Errorf("path %s extracts the relative path %s", mut.Path, mut.Source)
+		}
+	}
+	if ic.Base.Layout != "" && !filepath.IsAbs(ic.Base.Layout) {
+		return ic, fmt.Errorf("the base layout is at the relative path %s", ic.Base.Layout)
+	}
+	return ic, nil
+}
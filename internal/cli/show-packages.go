@@ -16,12 +16,15 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"text/tabwriter"
 
 	"github.com/spf13/cobra"
 
+	apkimpl "chainguard.dev/apko/pkg/apk/impl"
 	"chainguard.dev/apko/pkg/build"
 	"chainguard.dev/apko/pkg/build/types"
 )
@@ -30,6 +33,8 @@ func showPackages() *cobra.Command {
 	var extraKeys []string
 	var extraRepos []string
 	var archstrs []string
+	var plan bool
+	var asJSON bool
 
 	cmd := &cobra.Command{
 		Use:   "show-packages",
@@ -41,6 +46,16 @@ The result is similar to the first stages of a build, but does not actuall insta
 		Args:    cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			archs := types.ParseArchitectures(archstrs)
+			if plan {
+				return ShowPlanCmd(cmd.Context(), archs, asJSON,
+					build.WithConfig(args[0]),
+					build.WithExtraKeys(extraKeys),
+					build.WithExtraRepos(extraRepos),
+				)
+			}
+			if asJSON {
+				return fmt.Errorf("--json requires --plan")
+			}
 			return ShowPackagesCmd(cmd.Context(), archs,
 				build.WithConfig(args[0]),
 				build.WithExtraKeys(extraKeys),
@@ -52,11 +67,65 @@ The result is similar to the first stages of a build, but does not actuall insta
 	cmd.Flags().StringSliceVarP(&extraKeys, "keyring-append", "k", []string{}, "path to extra keys to include in the keyring")
 	cmd.Flags().StringSliceVarP(&extraRepos, "repository-append", "r", []string{}, "path to extra repositories to include")
 	cmd.Flags().StringSliceVar(&archstrs, "arch", nil, "architectures to build for (e.g., x86_64,ppc64le,arm64) -- default is all, unless specified in config. Can also use 'host' to indicate arch of host this is running on")
+	cmd.Flags().BoolVar(&plan, "plan", false, "show the ordered install plan, with the download and installed size of each package")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "show the install plan as JSON")
 
 	return cmd
 }
 
 func ShowPackagesCmd(ctx context.Context, archs []types.Architecture, opts ...build.Option) error {
+	return forEachArch(archs, opts, func(arch types.Architecture, bc *build.Context) error {
+		pkgs, _, err := bc.BuildPackageList()
+		if err != nil {
+			return fmt.Errorf("failed to get package list for image: %w", err)
+		}
+		fmt.Println(arch)
+		for _, pkg := range pkgs {
+			fmt.Printf("  %s %s\n", pkg.Name, pkg.Version)
+		}
+		fmt.Println()
+		return nil
+	})
+}
+
+// ShowPlanCmd shows what building the image would install for each
+// architecture, in order, with the sizes of the packages, as text or JSON.
+func ShowPlanCmd(ctx context.Context, archs []types.Architecture, asJSON bool, opts ...build.Option) error {
+	plans := map[string]*apkimpl.Plan{}
+	if err := forEachArch(archs, opts, func(arch types.Architecture, bc *build.Context) error {
+		plan, err := bc.Plan()
+		if err != nil {
+			return fmt.Errorf("failed to plan image: %w", err)
+		}
+		if asJSON {
+			plans[arch.ToAPK()] = plan
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, arch)
+		fmt.Fprintln(w, "  ACTION\tPACKAGE\tVERSION\tSIZE\tINSTALLED SIZE")
+		for _, pkg := range plan.Packages {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%d\t%d\n", pkg.Action, pkg.Name, pkg.Version, pkg.Size, pkg.InstalledSize)
+		}
+		fmt.Fprintf(w, "  total\t%d packages\t\t%d\t%d\n", len(plan.Packages), plan.DownloadSize, plan.InstalledSize)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Println()
+		return nil
+	}); err != nil {
+		return err
+	}
+	if !asJSON {
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plans)
+}
+
+// forEachArch calls fn with the build context of each architecture to build.
+func forEachArch(archs []types.Architecture, opts []build.Option, fn func(types.Architecture, *build.Context) error) error {
 	wd, err := os.MkdirTemp("", "apko-*")
 	if err != nil {
 		return fmt.Errorf("failed to create working directory: %w", err)
@@ -116,19 +185,16 @@ func ShowPackagesCmd(ctx context.Context, archs []types.Architecture, opts ...bu
 		bc.Options.Arch = arch
 		bc.Options.WorkDir = wd
 
+		if err := bc.ImageConfiguration.ApplyArchOverride(arch); err != nil {
+			return err
+		}
 		if err := bc.Refresh(); err != nil {
 			return fmt.Errorf("failed to update build context for %q: %w", arch, err)
 		}
 
-		pkgs, _, err := bc.BuildPackageList()
-		if err != nil {
-			return fmt.Errorf("failed to get package list for image: %w", err)
-		}
-		fmt.Println(arch)
-		for _, pkg := range pkgs {
-			fmt.Printf("  %s %s\n", pkg.Name, pkg.Version)
+		if err := fn(arch, bc); err != nil {
+			return err
 		}
-		fmt.Println()
 	}
 	return nil
 }
@@ -0,0 +1,66 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	coci "github.com/sigstore/cosign/v2/pkg/oci"
+
+	"chainguard.dev/apko/pkg/build"
+	"chainguard.dev/apko/pkg/build/oci"
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+// writeVariantBase writes the images of the configuration to an OCI image
+// layout, for the variants only adding to them to be built on top of them
+// rather than from scratch, and returns its path. Nothing is written, and
+// the path is empty, unless some variant can be built that way.
+func writeVariantBase(bc *build.Context, imgs map[types.Architecture]coci.SignedImage) (string, error) {
+	// streamed layers cannot be built on top of a base image
+	if bc.Options.StreamLayers || bc.Options.StreamingFS {
+		return "", nil
+	}
+	found := false
+	for _, variant := range bc.ImageConfiguration.VariantNames() {
+		found = found || bc.ImageConfiguration.VariantAddsOnly(variant)
+	}
+	if !found {
+		return "", nil
+	}
+
+	dir, err := os.MkdirTemp("", "apko-variant-base-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create variant base directory: %w", err)
+	}
+	if err := oci.WriteLayout(dir, imgs); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// variantOptions returns the options building the variant, on top of the
+// images of the configuration in the layout base if the variant only adds
+// to them.
+func variantOptions(bc *build.Context, variant, base string, opts []build.Option) []build.Option {
+	opts = append(opts[:len(opts):len(opts)], build.WithVariant(variant))
+	if base != "" && bc.ImageConfiguration.VariantAddsOnly(variant) {
+		bc.Logger().Infof("building %s variant on top of the image", variant)
+		opts = append(opts, build.WithVariantBase(base))
+	}
+	return opts
+}
@@ -18,8 +18,12 @@ package apk
 
 import (
 	"archive/tar"
+	"errors"
 	"fmt"
 	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
@@ -58,7 +62,19 @@ func NewWithOptions(fsys apkfs.FullFS, o options.Options) (*APK, error) {
 		apkimpl.WithLogger(o.Logger()),
 		apkimpl.WithArch(o.Arch.ToAPK()),
 		apkimpl.WithIgnoreMknodErrors(true),
+		apkimpl.WithProgress(o.Progress),
+		apkimpl.WithInputLimits(o.InputLimits),
+		apkimpl.WithOffline(o.Offline),
+		apkimpl.WithUserAgent(o.UserAgent),
+		apkimpl.WithHeaders(o.Headers),
+		apkimpl.WithResolverStrategy(o.ResolverStrategy),
+		apkimpl.WithExtractionCache(o.ExtractionCache),
+		apkimpl.WithUnsafePaths(o.UnsafePaths),
+		apkimpl.WithKeepInstalled(o.KeepInstalled),
 	)
+	if o.Transport != nil {
+		apkImpl.SetClient(&http.Client{Transport: o.Transport})
+	}
 	a := &APK{
 		Options: o,
 		impl:    apkImpl,
@@ -72,12 +88,27 @@ type Option func(*APK) error
 // Initialize sets the image in Context.WorkDir according to the image configuration,
 // and does everything short of installing the packages.
 func (a *APK) Initialize(ic *types.ImageConfiguration) error {
+	credentials, err := repositoryCredentials(ic.Contents.Credentials)
+	if err != nil {
+		return err
+	}
+	a.impl.SetCredentials(credentials)
+
 	// initialize apk
 	alpineVersions := parseOptionsFromRepositories(ic.Contents.Repositories)
 	if err := a.impl.InitDB(alpineVersions...); err != nil {
 		return fmt.Errorf("failed to initialize apk database: %w", err)
 	}
 
+	if err := a.impl.SetSignaturePolicy(signaturePolicy(ic.Contents.SignaturePolicy)); err != nil {
+		return err
+	}
+	a.impl.SetPermissiveFileCollisions(ic.Contents.FileCollisions == types.FileCollisionsWarn)
+	a.impl.SetNoarchFallback(ic.Contents.NoarchFallback)
+	if err := a.impl.SetPathExclusions(apkimpl.PathExclusions{All: ic.Contents.Exclude, Packages: ic.Contents.PackageExclude}); err != nil {
+		return err
+	}
+
 	var eg errgroup.Group
 
 	eg.Go(func() error {
@@ -107,9 +138,76 @@ func (a *APK) Initialize(ic *types.ImageConfiguration) error {
 		return err
 	}
 
+	// the keys package can only be looked up once the repositories are set
+	if ic.Contents.KeyringPackage != "" {
+		if err := a.impl.BootstrapKeyring(ic.Contents.KeyringPackage, ic.Contents.KeyringFingerprints); err != nil {
+			return fmt.Errorf("failed to bootstrap apk keyring: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// signaturePolicy converts the signature policy of an image configuration
+// into the one apk understands.
+func signaturePolicy(sp types.SignaturePolicy) apkimpl.SignaturePolicy {
+	policy := apkimpl.SignaturePolicy{
+		Default: apkimpl.SignatureMode(sp.Default),
+	}
+	for _, rp := range sp.Repositories {
+		policy.Repositories = append(policy.Repositories, apkimpl.RepositorySignaturePolicy{
+			Repository: rp.Repository,
+			Keys:       rp.Keys,
+			Mode:       apkimpl.SignatureMode(rp.Mode),
+		})
+	}
+	return policy
+}
+
+// repositoryCredentials gathers the credentials of the image configuration,
+// then those of HTTP_AUTH, then those of the .netrc file at $NETRC, or else
+// in the home directory.
+func repositoryCredentials(configured []types.RepositoryCredentials) ([]apkimpl.Credentials, error) {
+	var credentials []apkimpl.Credentials
+	for _, c := range configured {
+		password := c.Password
+		if c.PasswordEnv != "" {
+			var ok bool
+			if password, ok = os.LookupEnv(c.PasswordEnv); !ok {
+				return nil, fmt.Errorf("password of %s: environment variable %s is not set", c.Repository, c.PasswordEnv)
+			}
+		}
+		credentials = append(credentials, apkimpl.Credentials{Repository: c.Repository, Username: c.Username, Password: password})
+	}
+
+	fromEnv, err := apkimpl.ParseHTTPAuth(os.Getenv("HTTP_AUTH"))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP_AUTH: %w", err)
+	}
+	credentials = append(credentials, fromEnv...)
+
+	netrc := os.Getenv("NETRC")
+	if netrc == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return credentials, nil
+		}
+		netrc = filepath.Join(home, ".netrc")
+	}
+	f, err := os.Open(netrc)
+	if errors.Is(err, os.ErrNotExist) {
+		return credentials, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fromNetrc, err := apkimpl.ParseNetrc(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", netrc, err)
+	}
+	return append(credentials, fromNetrc...), nil
+}
+
 // Install install packages. Only works if already initialized.
 func (a *APK) Install() error {
 	// sync reality with desired apk world
@@ -122,10 +220,36 @@ func (a *APK) ResolvePackages() (toInstall []*repository.RepositoryPackage, conf
 	return a.impl.ResolveWorld()
 }
 
+// GetWorld gets the packages requested at the top level, as written in
+// /etc/apk/world, without their dependencies.
+func (a *APK) GetWorld() ([]string, error) {
+	return a.impl.GetWorld()
+}
+
+// Search returns the packages of the repositories matching the query, by
+// name and from the highest version to the lowest. Only works if already
+// initialized.
+func (a *APK) Search(query apkimpl.SearchQuery) ([]*repository.RepositoryPackage, error) {
+	return a.impl.Search(query)
+}
+
+// Info returns the metadata of the packages of the repositories matching the
+// name, starting with the one which would be installed. Only works if already
+// initialized.
+func (a *APK) Info(pkgName string) ([]apkimpl.PackageInfo, error) {
+	return a.impl.Info(pkgName)
+}
+
 func (a *APK) GetInstalled() ([]*apkimpl.InstalledPackage, error) {
 	return a.impl.GetInstalled()
 }
 
+// Audit checks the files of the root against the installed database, e.g.
+// to find drift in a built image.
+func (a *APK) Audit() (*apkimpl.AuditReport, error) {
+	return a.impl.Audit()
+}
+
 // AdditionalTags is a helper function used in conjunction with the --package-version-tag flag
 // If --package-version-tag is set to a package name (e.g. go), then this function
 // returns a list of all images that should be published with the associated version of that package tagged (e.g. 1.18)
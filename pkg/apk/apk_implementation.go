@@ -33,6 +33,20 @@ type apkImplementation interface {
 	// of files to append to the existing ones.
 	// Can provide file locations or URLs.
 	InitKeyring(keyfiles, extraKeyfiles []string) error
+	// BootstrapKeyring adds the keys shipped in the given keys package, e.g. wolfi-keys, to the keyring.
+	// The repositories must already be set, and are verified with the new keys. The package is only
+	// trusted if keys already in the keyring verify the repositories, or if fingerprints pin its keys.
+	BootstrapKeyring(packageName string, fingerprints []string) error
+	// SetSignaturePolicy sets the keys which may sign each repository, and how strictly that is checked.
+	SetSignaturePolicy(policy apkimpl.SignaturePolicy) error
+	// SetPermissiveFileCollisions sets whether packages may overwrite the files of other packages, with a warning.
+	SetPermissiveFileCollisions(permissive bool)
+	// SetCredentials sets the credentials of the requests to private repositories.
+	SetCredentials(credentials []apkimpl.Credentials)
+	// SetNoarchFallback sets whether packages are also resolved from the noarch index of each repository.
+	SetNoarchFallback(fallback bool)
+	// SetPathExclusions sets the paths not to install from packages.
+	SetPathExclusions(exclusions apkimpl.PathExclusions) error
 	// SetWorld set the list of packages in the world file. Replaces any existing ones.
 	SetWorld(packages []string) error
 	// GetWorld get the list of packages in the world file.
@@ -46,8 +60,14 @@ type apkImplementation interface {
 	SetRepositories(repos []string) error
 	// GetRepositories gets the list of repositories in use, including pinned ones with their names.
 	GetRepositories() ([]string, error)
+	// Search returns the packages of the repositories matching the query.
+	Search(query apkimpl.SearchQuery) ([]*repository.RepositoryPackage, error)
+	// Info returns the metadata of the packages of the repositories matching the name.
+	Info(pkgName string) ([]apkimpl.PackageInfo, error)
 	// GetInstalled gets the list of installed packages.
 	GetInstalled() ([]*apkimpl.InstalledPackage, error)
+	// Audit checks the files of the root against the installed database.
+	Audit() (*apkimpl.AuditReport, error)
 	// ListInitFiles lists the directories and files that are installed via InitDB
 	ListInitFiles() []tar.Header
 }
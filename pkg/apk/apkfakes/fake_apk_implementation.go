@@ -11,6 +11,30 @@ import (
 )
 
 type FakeApkImplementation struct {
+	AuditStub        func() (*impl.AuditReport, error)
+	auditMutex       sync.RWMutex
+	auditArgsForCall []struct {
+	}
+	auditReturns struct {
+		result1 *impl.AuditReport
+		result2 error
+	}
+	auditReturnsOnCall map[int]struct {
+		result1 *impl.AuditReport
+		result2 error
+	}
+	BootstrapKeyringStub        func(string, []string) error
+	bootstrapKeyringMutex       sync.RWMutex
+	bootstrapKeyringArgsForCall []struct {
+		arg1 string
+		arg2 []string
+	}
+	bootstrapKeyringReturns struct {
+		result1 error
+	}
+	bootstrapKeyringReturnsOnCall map[int]struct {
+		result1 error
+	}
 	FixateWorldStub        func(bool, bool, bool, *time.Time) error
 	fixateWorldMutex       sync.RWMutex
 	fixateWorldArgsForCall []struct {
@@ -61,6 +85,19 @@ type FakeApkImplementation struct {
 		result1 []string
 		result2 error
 	}
+	InfoStub        func(string) ([]impl.PackageInfo, error)
+	infoMutex       sync.RWMutex
+	infoArgsForCall []struct {
+		arg1 string
+	}
+	infoReturns struct {
+		result1 []impl.PackageInfo
+		result2 error
+	}
+	infoReturnsOnCall map[int]struct {
+		result1 []impl.PackageInfo
+		result2 error
+	}
 	InitDBStub        func(...string) error
 	initDBMutex       sync.RWMutex
 	initDBArgsForCall []struct {
@@ -108,6 +145,45 @@ type FakeApkImplementation struct {
 		result2 []string
 		result3 error
 	}
+	SearchStub        func(impl.SearchQuery) ([]*repository.RepositoryPackage, error)
+	searchMutex       sync.RWMutex
+	searchArgsForCall []struct {
+		arg1 impl.SearchQuery
+	}
+	searchReturns struct {
+		result1 []*repository.RepositoryPackage
+		result2 error
+	}
+	searchReturnsOnCall map[int]struct {
+		result1 []*repository.RepositoryPackage
+		result2 error
+	}
+	SetCredentialsStub        func([]impl.Credentials)
+	setCredentialsMutex       sync.RWMutex
+	setCredentialsArgsForCall []struct {
+		arg1 []impl.Credentials
+	}
+	SetNoarchFallbackStub        func(bool)
+	setNoarchFallbackMutex       sync.RWMutex
+	setNoarchFallbackArgsForCall []struct {
+		arg1 bool
+	}
+	SetPathExclusionsStub        func(impl.PathExclusions) error
+	setPathExclusionsMutex       sync.RWMutex
+	setPathExclusionsArgsForCall []struct {
+		arg1 impl.PathExclusions
+	}
+	setPathExclusionsReturns struct {
+		result1 error
+	}
+	setPathExclusionsReturnsOnCall map[int]struct {
+		result1 error
+	}
+	SetPermissiveFileCollisionsStub        func(bool)
+	setPermissiveFileCollisionsMutex       sync.RWMutex
+	setPermissiveFileCollisionsArgsForCall []struct {
+		arg1 bool
+	}
 	SetRepositoriesStub        func([]string) error
 	setRepositoriesMutex       sync.RWMutex
 	setRepositoriesArgsForCall []struct {
@@ -119,6 +195,17 @@ type FakeApkImplementation struct {
 	setRepositoriesReturnsOnCall map[int]struct {
 		result1 error
 	}
+	SetSignaturePolicyStub        func(impl.SignaturePolicy) error
+	setSignaturePolicyMutex       sync.RWMutex
+	setSignaturePolicyArgsForCall []struct {
+		arg1 impl.SignaturePolicy
+	}
+	setSignaturePolicyReturns struct {
+		result1 error
+	}
+	setSignaturePolicyReturnsOnCall map[int]struct {
+		result1 error
+	}
 	SetWorldStub        func([]string) error
 	setWorldMutex       sync.RWMutex
 	setWorldArgsForCall []struct {
@@ -134,6 +221,129 @@ type FakeApkImplementation struct {
 	invocationsMutex sync.RWMutex
 }
 
+func (fake *FakeApkImplementation) Audit() (*impl.AuditReport, error) {
+	fake.auditMutex.Lock()
+	ret, specificReturn := fake.auditReturnsOnCall[len(fake.auditArgsForCall)]
+	fake.auditArgsForCall = append(fake.auditArgsForCall, struct {
+	}{})
+	stub := fake.AuditStub
+	fakeReturns := fake.auditReturns
+	fake.recordInvocation("Audit", []interface{}{})
+	fake.auditMutex.Unlock()
+	if stub != nil {
+		return stub()
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fakeReturns.result1, fakeReturns.result2
+}
+
+func (fake *FakeApkImplementation) AuditCallCount() int {
+	fake.auditMutex.RLock()
+	defer fake.auditMutex.RUnlock()
+	return len(fake.auditArgsForCall)
+}
+
+func (fake *FakeApkImplementation) AuditCalls(stub func() (*impl.AuditReport, error)) {
+	fake.auditMutex.Lock()
+	defer fake.auditMutex.Unlock()
+	fake.AuditStub = stub
+}
+
+func (fake *FakeApkImplementation) AuditReturns(result1 *impl.AuditReport, result2 error) {
+	fake.auditMutex.Lock()
+	defer fake.auditMutex.Unlock()
+	fake.AuditStub = nil
+	fake.auditReturns = struct {
+		result1 *impl.AuditReport
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeApkImplementation) AuditReturnsOnCall(i int, result1 *impl.AuditReport, result2 error) {
+	fake.auditMutex.Lock()
+	defer fake.auditMutex.Unlock()
+	fake.AuditStub = nil
+	if fake.auditReturnsOnCall == nil {
+		fake.auditReturnsOnCall = make(map[int]struct {
+			result1 *impl.AuditReport
+			result2 error
+		})
+	}
+	fake.auditReturnsOnCall[i] = struct {
+		result1 *impl.AuditReport
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeApkImplementation) BootstrapKeyring(arg1 string, arg2 []string) error {
+	var arg2Copy []string
+	if arg2 != nil {
+		arg2Copy = make([]string, len(arg2))
+		copy(arg2Copy, arg2)
+	}
+	fake.bootstrapKeyringMutex.Lock()
+	ret, specificReturn := fake.bootstrapKeyringReturnsOnCall[len(fake.bootstrapKeyringArgsForCall)]
+	fake.bootstrapKeyringArgsForCall = append(fake.bootstrapKeyringArgsForCall, struct {
+		arg1 string
+		arg2 []string
+	}{arg1, arg2Copy})
+	stub := fake.BootstrapKeyringStub
+	fakeReturns := fake.bootstrapKeyringReturns
+	fake.recordInvocation("BootstrapKeyring", []interface{}{arg1, arg2Copy})
+	fake.bootstrapKeyringMutex.Unlock()
+	if stub != nil {
+		return stub(arg1, arg2)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeApkImplementation) BootstrapKeyringCallCount() int {
+	fake.bootstrapKeyringMutex.RLock()
+	defer fake.bootstrapKeyringMutex.RUnlock()
+	return len(fake.bootstrapKeyringArgsForCall)
+}
+
+func (fake *FakeApkImplementation) BootstrapKeyringCalls(stub func(string, []string) error) {
+	fake.bootstrapKeyringMutex.Lock()
+	defer fake.bootstrapKeyringMutex.Unlock()
+	fake.BootstrapKeyringStub = stub
+}
+
+func (fake *FakeApkImplementation) BootstrapKeyringArgsForCall(i int) (string, []string) {
+	fake.bootstrapKeyringMutex.RLock()
+	defer fake.bootstrapKeyringMutex.RUnlock()
+	argsForCall := fake.bootstrapKeyringArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *FakeApkImplementation) BootstrapKeyringReturns(result1 error) {
+	fake.bootstrapKeyringMutex.Lock()
+	defer fake.bootstrapKeyringMutex.Unlock()
+	fake.BootstrapKeyringStub = nil
+	fake.bootstrapKeyringReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeApkImplementation) BootstrapKeyringReturnsOnCall(i int, result1 error) {
+	fake.bootstrapKeyringMutex.Lock()
+	defer fake.bootstrapKeyringMutex.Unlock()
+	fake.BootstrapKeyringStub = nil
+	if fake.bootstrapKeyringReturnsOnCall == nil {
+		fake.bootstrapKeyringReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.bootstrapKeyringReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeApkImplementation) FixateWorld(arg1 bool, arg2 bool, arg3 bool, arg4 *time.Time) error {
 	fake.fixateWorldMutex.Lock()
 	ret, specificReturn := fake.fixateWorldReturnsOnCall[len(fake.fixateWorldArgsForCall)]
@@ -366,6 +576,70 @@ func (fake *FakeApkImplementation) GetWorldReturnsOnCall(i int, result1 []string
 	}{result1, result2}
 }
 
+func (fake *FakeApkImplementation) Info(arg1 string) ([]impl.PackageInfo, error) {
+	fake.infoMutex.Lock()
+	ret, specificReturn := fake.infoReturnsOnCall[len(fake.infoArgsForCall)]
+	fake.infoArgsForCall = append(fake.infoArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	stub := fake.InfoStub
+	fakeReturns := fake.infoReturns
+	fake.recordInvocation("Info", []interface{}{arg1})
+	fake.infoMutex.Unlock()
+	if stub != nil {
+		return stub(arg1)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fakeReturns.result1, fakeReturns.result2
+}
+
+func (fake *FakeApkImplementation) InfoCallCount() int {
+	fake.infoMutex.RLock()
+	defer fake.infoMutex.RUnlock()
+	return len(fake.infoArgsForCall)
+}
+
+func (fake *FakeApkImplementation) InfoCalls(stub func(string) ([]impl.PackageInfo, error)) {
+	fake.infoMutex.Lock()
+	defer fake.infoMutex.Unlock()
+	fake.InfoStub = stub
+}
+
+func (fake *FakeApkImplementation) InfoArgsForCall(i int) string {
+	fake.infoMutex.RLock()
+	defer fake.infoMutex.RUnlock()
+	argsForCall := fake.infoArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeApkImplementation) InfoReturns(result1 []impl.PackageInfo, result2 error) {
+	fake.infoMutex.Lock()
+	defer fake.infoMutex.Unlock()
+	fake.InfoStub = nil
+	fake.infoReturns = struct {
+		result1 []impl.PackageInfo
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeApkImplementation) InfoReturnsOnCall(i int, result1 []impl.PackageInfo, result2 error) {
+	fake.infoMutex.Lock()
+	defer fake.infoMutex.Unlock()
+	fake.InfoStub = nil
+	if fake.infoReturnsOnCall == nil {
+		fake.infoReturnsOnCall = make(map[int]struct {
+			result1 []impl.PackageInfo
+			result2 error
+		})
+	}
+	fake.infoReturnsOnCall[i] = struct {
+		result1 []impl.PackageInfo
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeApkImplementation) InitDB(arg1 ...string) error {
 	fake.initDBMutex.Lock()
 	ret, specificReturn := fake.initDBReturnsOnCall[len(fake.initDBArgsForCall)]
@@ -611,6 +885,232 @@ func (fake *FakeApkImplementation) ResolveWorldReturnsOnCall(i int, result1 []*r
 	}{result1, result2, result3}
 }
 
+func (fake *FakeApkImplementation) Search(arg1 impl.SearchQuery) ([]*repository.RepositoryPackage, error) {
+	fake.searchMutex.Lock()
+	ret, specificReturn := fake.searchReturnsOnCall[len(fake.searchArgsForCall)]
+	fake.searchArgsForCall = append(fake.searchArgsForCall, struct {
+		arg1 impl.SearchQuery
+	}{arg1})
+	stub := fake.SearchStub
+	fakeReturns := fake.searchReturns
+	fake.recordInvocation("Search", []interface{}{arg1})
+	fake.searchMutex.Unlock()
+	if stub != nil {
+		return stub(arg1)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fakeReturns.result1, fakeReturns.result2
+}
+
+func (fake *FakeApkImplementation) SearchCallCount() int {
+	fake.searchMutex.RLock()
+	defer fake.searchMutex.RUnlock()
+	return len(fake.searchArgsForCall)
+}
+
+func (fake *FakeApkImplementation) SearchCalls(stub func(impl.SearchQuery) ([]*repository.RepositoryPackage, error)) {
+	fake.searchMutex.Lock()
+	defer fake.searchMutex.Unlock()
+	fake.SearchStub = stub
+}
+
+func (fake *FakeApkImplementation) SearchArgsForCall(i int) impl.SearchQuery {
+	fake.searchMutex.RLock()
+	defer fake.searchMutex.RUnlock()
+	argsForCall := fake.searchArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeApkImplementation) SearchReturns(result1 []*repository.RepositoryPackage, result2 error) {
+	fake.searchMutex.Lock()
+	defer fake.searchMutex.Unlock()
+	fake.SearchStub = nil
+	fake.searchReturns = struct {
+		result1 []*repository.RepositoryPackage
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeApkImplementation) SearchReturnsOnCall(i int, result1 []*repository.RepositoryPackage, result2 error) {
+	fake.searchMutex.Lock()
+	defer fake.searchMutex.Unlock()
+	fake.SearchStub = nil
+	if fake.searchReturnsOnCall == nil {
+		fake.searchReturnsOnCall = make(map[int]struct {
+			result1 []*repository.RepositoryPackage
+			result2 error
+		})
+	}
+	fake.searchReturnsOnCall[i] = struct {
+		result1 []*repository.RepositoryPackage
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeApkImplementation) SetCredentials(arg1 []impl.Credentials) {
+	var arg1Copy []impl.Credentials
+	if arg1 != nil {
+		arg1Copy = make([]impl.Credentials, len(arg1))
+		copy(arg1Copy, arg1)
+	}
+	fake.setCredentialsMutex.Lock()
+	fake.setCredentialsArgsForCall = append(fake.setCredentialsArgsForCall, struct {
+		arg1 []impl.Credentials
+	}{arg1Copy})
+	stub := fake.SetCredentialsStub
+	fake.recordInvocation("SetCredentials", []interface{}{arg1Copy})
+	fake.setCredentialsMutex.Unlock()
+	if stub != nil {
+		fake.SetCredentialsStub(arg1)
+	}
+}
+
+func (fake *FakeApkImplementation) SetCredentialsCallCount() int {
+	fake.setCredentialsMutex.RLock()
+	defer fake.setCredentialsMutex.RUnlock()
+	return len(fake.setCredentialsArgsForCall)
+}
+
+func (fake *FakeApkImplementation) SetCredentialsCalls(stub func([]impl.Credentials)) {
+	fake.setCredentialsMutex.Lock()
+	defer fake.setCredentialsMutex.Unlock()
+	fake.SetCredentialsStub = stub
+}
+
+func (fake *FakeApkImplementation) SetCredentialsArgsForCall(i int) []impl.Credentials {
+	fake.setCredentialsMutex.RLock()
+	defer fake.setCredentialsMutex.RUnlock()
+	argsForCall := fake.setCredentialsArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeApkImplementation) SetNoarchFallback(arg1 bool) {
+	fake.setNoarchFallbackMutex.Lock()
+	fake.setNoarchFallbackArgsForCall = append(fake.setNoarchFallbackArgsForCall, struct {
+		arg1 bool
+	}{arg1})
+	stub := fake.SetNoarchFallbackStub
+	fake.recordInvocation("SetNoarchFallback", []interface{}{arg1})
+	fake.setNoarchFallbackMutex.Unlock()
+	if stub != nil {
+		fake.SetNoarchFallbackStub(arg1)
+	}
+}
+
+func (fake *FakeApkImplementation) SetNoarchFallbackCallCount() int {
+	fake.setNoarchFallbackMutex.RLock()
+	defer fake.setNoarchFallbackMutex.RUnlock()
+	return len(fake.setNoarchFallbackArgsForCall)
+}
+
+func (fake *FakeApkImplementation) SetNoarchFallbackCalls(stub func(bool)) {
+	fake.setNoarchFallbackMutex.Lock()
+	defer fake.setNoarchFallbackMutex.Unlock()
+	fake.SetNoarchFallbackStub = stub
+}
+
+func (fake *FakeApkImplementation) SetNoarchFallbackArgsForCall(i int) bool {
+	fake.setNoarchFallbackMutex.RLock()
+	defer fake.setNoarchFallbackMutex.RUnlock()
+	argsForCall := fake.setNoarchFallbackArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeApkImplementation) SetPathExclusions(arg1 impl.PathExclusions) error {
+	fake.setPathExclusionsMutex.Lock()
+	ret, specificReturn := fake.setPathExclusionsReturnsOnCall[len(fake.setPathExclusionsArgsForCall)]
+	fake.setPathExclusionsArgsForCall = append(fake.setPathExclusionsArgsForCall, struct {
+		arg1 impl.PathExclusions
+	}{arg1})
+	stub := fake.SetPathExclusionsStub
+	fakeReturns := fake.setPathExclusionsReturns
+	fake.recordInvocation("SetPathExclusions", []interface{}{arg1})
+	fake.setPathExclusionsMutex.Unlock()
+	if stub != nil {
+		return stub(arg1)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeApkImplementation) SetPathExclusionsCallCount() int {
+	fake.setPathExclusionsMutex.RLock()
+	defer fake.setPathExclusionsMutex.RUnlock()
+	return len(fake.setPathExclusionsArgsForCall)
+}
+
+func (fake *FakeApkImplementation) SetPathExclusionsCalls(stub func(impl.PathExclusions) error) {
+	fake.setPathExclusionsMutex.Lock()
+	defer fake.setPathExclusionsMutex.Unlock()
+	fake.SetPathExclusionsStub = stub
+}
+
+func (fake *FakeApkImplementation) SetPathExclusionsArgsForCall(i int) impl.PathExclusions {
+	fake.setPathExclusionsMutex.RLock()
+	defer fake.setPathExclusionsMutex.RUnlock()
+	argsForCall := fake.setPathExclusionsArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeApkImplementation) SetPathExclusionsReturns(result1 error) {
+	fake.setPathExclusionsMutex.Lock()
+	defer fake.setPathExclusionsMutex.Unlock()
+	fake.SetPathExclusionsStub = nil
+	fake.setPathExclusionsReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeApkImplementation) SetPathExclusionsReturnsOnCall(i int, result1 error) {
+	fake.setPathExclusionsMutex.Lock()
+	defer fake.setPathExclusionsMutex.Unlock()
+	fake.SetPathExclusionsStub = nil
+	if fake.setPathExclusionsReturnsOnCall == nil {
+		fake.setPathExclusionsReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.setPathExclusionsReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeApkImplementation) SetPermissiveFileCollisions(arg1 bool) {
+	fake.setPermissiveFileCollisionsMutex.Lock()
+	fake.setPermissiveFileCollisionsArgsForCall = append(fake.setPermissiveFileCollisionsArgsForCall, struct {
+		arg1 bool
+	}{arg1})
+	stub := fake.SetPermissiveFileCollisionsStub
+	fake.recordInvocation("SetPermissiveFileCollisions", []interface{}{arg1})
+	fake.setPermissiveFileCollisionsMutex.Unlock()
+	if stub != nil {
+		fake.SetPermissiveFileCollisionsStub(arg1)
+	}
+}
+
+func (fake *FakeApkImplementation) SetPermissiveFileCollisionsCallCount() int {
+	fake.setPermissiveFileCollisionsMutex.RLock()
+	defer fake.setPermissiveFileCollisionsMutex.RUnlock()
+	return len(fake.setPermissiveFileCollisionsArgsForCall)
+}
+
+func (fake *FakeApkImplementation) SetPermissiveFileCollisionsCalls(stub func(bool)) {
+	fake.setPermissiveFileCollisionsMutex.Lock()
+	defer fake.setPermissiveFileCollisionsMutex.Unlock()
+	fake.SetPermissiveFileCollisionsStub = stub
+}
+
+func (fake *FakeApkImplementation) SetPermissiveFileCollisionsArgsForCall(i int) bool {
+	fake.setPermissiveFileCollisionsMutex.RLock()
+	defer fake.setPermissiveFileCollisionsMutex.RUnlock()
+	argsForCall := fake.setPermissiveFileCollisionsArgsForCall[i]
+	return argsForCall.arg1
+}
+
 func (fake *FakeApkImplementation) SetRepositories(arg1 []string) error {
 	var arg1Copy []string
 	if arg1 != nil {
@@ -677,6 +1177,67 @@ func (fake *FakeApkImplementation) SetRepositoriesReturnsOnCall(i int, result1 e
 	}{result1}
 }
 
+func (fake *FakeApkImplementation) SetSignaturePolicy(arg1 impl.SignaturePolicy) error {
+	fake.setSignaturePolicyMutex.Lock()
+	ret, specificReturn := fake.setSignaturePolicyReturnsOnCall[len(fake.setSignaturePolicyArgsForCall)]
+	fake.setSignaturePolicyArgsForCall = append(fake.setSignaturePolicyArgsForCall, struct {
+		arg1 impl.SignaturePolicy
+	}{arg1})
+	stub := fake.SetSignaturePolicyStub
+	fakeReturns := fake.setSignaturePolicyReturns
+	fake.recordInvocation("SetSignaturePolicy", []interface{}{arg1})
+	fake.setSignaturePolicyMutex.Unlock()
+	if stub != nil {
+		return stub(arg1)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeApkImplementation) SetSignaturePolicyCallCount() int {
+	fake.setSignaturePolicyMutex.RLock()
+	defer fake.setSignaturePolicyMutex.RUnlock()
+	return len(fake.setSignaturePolicyArgsForCall)
+}
+
+func (fake *FakeApkImplementation) SetSignaturePolicyCalls(stub func(impl.SignaturePolicy) error) {
+	fake.setSignaturePolicyMutex.Lock()
+	defer fake.setSignaturePolicyMutex.Unlock()
+	fake.SetSignaturePolicyStub = stub
+}
+
+func (fake *FakeApkImplementation) SetSignaturePolicyArgsForCall(i int) impl.SignaturePolicy {
+	fake.setSignaturePolicyMutex.RLock()
+	defer fake.setSignaturePolicyMutex.RUnlock()
+	argsForCall := fake.setSignaturePolicyArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeApkImplementation) SetSignaturePolicyReturns(result1 error) {
+	fake.setSignaturePolicyMutex.Lock()
+	defer fake.setSignaturePolicyMutex.Unlock()
+	fake.SetSignaturePolicyStub = nil
+	fake.setSignaturePolicyReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeApkImplementation) SetSignaturePolicyReturnsOnCall(i int, result1 error) {
+	fake.setSignaturePolicyMutex.Lock()
+	defer fake.setSignaturePolicyMutex.Unlock()
+	fake.SetSignaturePolicyStub = nil
+	if fake.setSignaturePolicyReturnsOnCall == nil {
+		fake.setSignaturePolicyReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.setSignaturePolicyReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeApkImplementation) SetWorld(arg1 []string) error {
 	var arg1Copy []string
 	if arg1 != nil {
@@ -746,6 +1307,10 @@ func (fake *FakeApkImplementation) SetWorldReturnsOnCall(i int, result1 error) {
 func (fake *FakeApkImplementation) Invocations() map[string][][]interface{} {
 	fake.invocationsMutex.RLock()
 	defer fake.invocationsMutex.RUnlock()
+	fake.auditMutex.RLock()
+	defer fake.auditMutex.RUnlock()
+	fake.bootstrapKeyringMutex.RLock()
+	defer fake.bootstrapKeyringMutex.RUnlock()
 	fake.fixateWorldMutex.RLock()
 	defer fake.fixateWorldMutex.RUnlock()
 	fake.getInstalledMutex.RLock()
@@ -754,6 +1319,8 @@ func (fake *FakeApkImplementation) Invocations() map[string][][]interface{} {
 	defer fake.getRepositoriesMutex.RUnlock()
 	fake.getWorldMutex.RLock()
 	defer fake.getWorldMutex.RUnlock()
+	fake.infoMutex.RLock()
+	defer fake.infoMutex.RUnlock()
 	fake.initDBMutex.RLock()
 	defer fake.initDBMutex.RUnlock()
 	fake.initKeyringMutex.RLock()
@@ -762,8 +1329,20 @@ func (fake *FakeApkImplementation) Invocations() map[string][][]interface{} {
 	defer fake.listInitFilesMutex.RUnlock()
 	fake.resolveWorldMutex.RLock()
 	defer fake.resolveWorldMutex.RUnlock()
+	fake.searchMutex.RLock()
+	defer fake.searchMutex.RUnlock()
+	fake.setCredentialsMutex.RLock()
+	defer fake.setCredentialsMutex.RUnlock()
+	fake.setNoarchFallbackMutex.RLock()
+	defer fake.setNoarchFallbackMutex.RUnlock()
+	fake.setPathExclusionsMutex.RLock()
+	defer fake.setPathExclusionsMutex.RUnlock()
+	fake.setPermissiveFileCollisionsMutex.RLock()
+	defer fake.setPermissiveFileCollisionsMutex.RUnlock()
 	fake.setRepositoriesMutex.RLock()
 	defer fake.setRepositoriesMutex.RUnlock()
+	fake.setSignaturePolicyMutex.RLock()
+	defer fake.setSignaturePolicyMutex.RUnlock()
 	fake.setWorldMutex.RLock()
 	defer fake.setWorldMutex.RUnlock()
 	copiedInvocations := map[string][][]interface{}{}
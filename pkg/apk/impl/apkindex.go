@@ -0,0 +1,177 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// indexFromArchive reads an APKINDEX.tar.gz, signed or not, into an index.
+// The archive is the gzip stream of the signature, if any, followed by the
+// one of the index, which read at once are a single tar archive.
+func indexFromArchive(r io.Reader, limits InputLimits) (*repository.ApkIndex, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	index := &repository.ApkIndex{}
+	tr := tar.NewReader(limitReader(gz, limits.MaxIndexSize, "uncompressed repository index"))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Name {
+		case "APKINDEX":
+			if index.Packages, err = parsePackageIndex(tr, limits); err != nil {
+				return nil, fmt.Errorf("parsing APKINDEX: %w", err)
+			}
+		case "DESCRIPTION":
+			scanner := newLineScanner(tr, limits)
+			if scanner.Scan() {
+				index.Description = strings.TrimSpace(scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, fmt.Errorf("parsing DESCRIPTION: %w", err)
+			}
+		}
+	}
+	return index, nil
+}
+
+// parsePackageIndex parses the packages of an APKINDEX, which are blocks of
+// "<field>:<value>" lines separated by blank lines.
+func parsePackageIndex(r io.Reader, limits InputLimits) ([]*repository.Package, error) {
+	var packages []*repository.Package
+	pkg := &repository.Package{}
+	add := func() error {
+		if pkg.Name == "" {
+			return nil
+		}
+		if limits.MaxIndexPackages > 0 && len(packages) >= limits.MaxIndexPackages {
+			return fmt.Errorf("more packages than the limit of %d", limits.MaxIndexPackages)
+		}
+		packages = append(packages, pkg)
+		pkg = &repository.Package{}
+		return nil
+	}
+
+	scanner := newLineScanner(r, limits)
+	linenr := 0
+	for scanner.Scan() {
+		linenr++
+		line := scanner.Text()
+		if line == "" {
+			if err := add(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(line) < 2 || line[1] != ':' {
+			return nil, fmt.Errorf("cannot parse line %d: expected \":\" not found", linenr)
+		}
+		if err := parsePackageField(pkg, line[:1], line[2:]); err != nil {
+			return nil, fmt.Errorf("cannot parse line %d: %w", linenr, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot parse line %d: %w", linenr+1, err)
+	}
+	// the last package may not be followed by a blank line
+	if err := add(); err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+// parsePackageField sets the field of the package a line of an APKINDEX or
+// of the installed database is about. Unknown fields are ignored.
+func parsePackageField(pkg *repository.Package, token, val string) error {
+	switch token {
+	case "P":
+		pkg.Name = val
+	case "V":
+		pkg.Version = val
+	case "A":
+		pkg.Arch = val
+	case "L":
+		pkg.License = val
+	case "T":
+		pkg.Description = val
+	case "o":
+		pkg.Origin = val
+	case "m":
+		pkg.Maintainer = val
+	case "U":
+		pkg.URL = val
+	case "D":
+		pkg.Dependencies = strings.Fields(val)
+	case "p":
+		pkg.Provides = strings.Fields(val)
+	case "c":
+		pkg.RepoCommit = val
+	case "t":
+		i, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse build time %s: %w", val, err)
+		}
+		pkg.BuildTime = time.Unix(i, 0)
+	case "i":
+		pkg.InstallIf = strings.Fields(val)
+	case "S":
+		size, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse size field %s: %w", val, err)
+		}
+		pkg.Size = size
+	case "I":
+		installedSize, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse installed size field %s: %w", val, err)
+		}
+		pkg.InstalledSize = installedSize
+	case "k":
+		priority, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse provider priority field %s: %w", val, err)
+		}
+		pkg.ProviderPriority = priority
+	case "C":
+		// Handle SHA1 checksums:
+		if strings.HasPrefix(val, "Q1") {
+			checksum, err := base64.StdEncoding.DecodeString(val[2:])
+			if err != nil {
+				return fmt.Errorf("cannot parse checksum %s: %w", val, err)
+			}
+			pkg.Checksum = checksum
+		}
+	}
+	return nil
+}
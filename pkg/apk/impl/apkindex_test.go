@@ -0,0 +1,155 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testPackageIndex = `C:Q1eT0rBzSiuDaCoz5aTnhE9ftFnss=
+P:busybox
+V:1.36.0-r0
+A:x86_64
+S:510235
+I:958464
+T:Size optimized toolbox of many common UNIX utilities
+U:https://busybox.net/
+L:GPL-2.0-only
+o:busybox
+m:Someone <someone@example.com>
+t:1673000000
+c:0123456789abcdef
+D:so:libc.musl-x86_64.so.1
+p:cmd:busybox=1.36.0-r0 cmd:sh=1.36.0-r0
+
+P:busybox-binsh
+V:1.36.0-r0
+A:x86_64
+D:busybox=1.36.0-r0
+i:busybox`
+
+func TestParsePackageIndex(t *testing.T) {
+	pkgs, err := parsePackageIndex(strings.NewReader(testPackageIndex), InputLimits{})
+	require.NoError(t, err)
+	require.Len(t, pkgs, 2)
+
+	busybox := pkgs[0]
+	require.Equal(t, "busybox", busybox.Name)
+	require.Equal(t, "1.36.0-r0", busybox.Version)
+	require.Equal(t, uint64(510235), busybox.Size)
+	require.Equal(t, uint64(958464), busybox.InstalledSize)
+	require.Equal(t, time.Unix(1673000000, 0), busybox.BuildTime)
+	require.Equal(t, []string{"so:libc.musl-x86_64.so.1"}, busybox.Dependencies)
+	require.Equal(t, []string{"cmd:busybox=1.36.0-r0", "cmd:sh=1.36.0-r0"}, busybox.Provides)
+	require.Len(t, busybox.Checksum, 20)
+
+	// the last package is not followed by a blank line
+	require.Equal(t, "busybox-binsh", pkgs[1].Name)
+	require.Equal(t, []string{"busybox"}, pkgs[1].InstallIf)
+}
+
+func TestParsePackageIndexErrors(t *testing.T) {
+	for _, c := range []struct {
+		desc   string
+		index  string
+		limits InputLimits
+	}{{
+		desc:  "line without field",
+		index: "P:busybox\nV\n",
+	}, {
+		desc:  "line without colon",
+		index: "P:busybox\nVV1.36.0-r0\n",
+	}, {
+		desc:  "invalid size",
+		index: "P:busybox\nS:big\n",
+	}, {
+		desc:  "invalid checksum",
+		index: "P:busybox\nC:Q1!!!\n",
+	}, {
+		desc:   "too many packages",
+		index:  testPackageIndex,
+		limits: InputLimits{MaxIndexPackages: 1},
+	}, {
+		desc:   "line too long",
+		index:  "P:" + strings.Repeat("a", 100) + "\n",
+		limits: InputLimits{MaxLineSize: 64},
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			_, err := parsePackageIndex(strings.NewReader(c.index), c.limits)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestIndexFromArchive(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "APKINDEX.tar.gz"))
+	require.NoError(t, err)
+
+	index, err := indexFromArchive(bytes.NewReader(b), InputLimits{})
+	require.NoError(t, err)
+	require.NotEmpty(t, index.Packages)
+
+	_, err = indexFromArchive(bytes.NewReader(b), InputLimits{MaxIndexSize: 1024})
+	require.ErrorContains(t, err, "larger than the limit")
+}
+
+func TestLimitReader(t *testing.T) {
+	b, err := io.ReadAll(limitReader(strings.NewReader("12345"), 5, "input"))
+	require.NoError(t, err)
+	require.Equal(t, "12345", string(b))
+
+	_, err = io.ReadAll(limitReader(strings.NewReader("123456"), 5, "input"))
+	require.EqualError(t, err, "input is larger than the limit of 5 bytes")
+
+	b, err = io.ReadAll(limitReader(strings.NewReader("123456"), 0, "input"))
+	require.NoError(t, err)
+	require.Equal(t, "123456", string(b))
+}
+
+func FuzzParsePackageIndex(f *testing.F) {
+	f.Add([]byte(testPackageIndex))
+	f.Add([]byte("P:busybox\nV\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pkgs, err := parsePackageIndex(bytes.NewReader(data), HardenedInputLimits())
+		if err == nil && len(pkgs) > HardenedInputLimits().MaxIndexPackages {
+			t.Fatalf("%d packages parsed, more than the limit", len(pkgs))
+		}
+	})
+}
+
+func FuzzIndexFromArchive(f *testing.F) {
+	if b, err := os.ReadFile(filepath.Join("testdata", "APKINDEX.tar.gz")); err == nil {
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = indexFromArchive(bytes.NewReader(data), InputLimits{MaxIndexSize: 1 << 20})
+	})
+}
+
+func FuzzParseInstalled(f *testing.F) {
+	f.Add([]byte(testPackageIndex + "\nF:usr/bin\nM:0:0:755\nR:busybox\na:0:0:755\n\n"))
+	f.Add([]byte("P:busybox\nM:0:0:755\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = parseInstalled(bytes.NewReader(data))
+	})
+}
@@ -13,19 +13,13 @@
 // limitations under the License.
 package impl
 
+import "chainguard.dev/apko/pkg/arch"
+
+// noarchArch is the architecture of the packages which work on any, e.g.
+// scripts or data.
+const noarchArch = "noarch"
+
+// ArchToAPK returns the apk name of an architecture, e.g. x86_64 for amd64.
 func ArchToAPK(in string) string {
-	switch in {
-	case "i386", "386":
-		return "x86"
-	case "amd64":
-		return "x86_64"
-	case "arm64":
-		return "aarch64"
-	case "arm/v6":
-		return "armhf"
-	case "arm/v7":
-		return "armv7"
-	default:
-		return in
-	}
+	return arch.ToAPK(in)
 }
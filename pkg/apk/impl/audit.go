@@ -0,0 +1,163 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// auditIgnored are the directories of the database and the keys of apk,
+// which no package owns.
+var auditIgnored = []string{"etc/apk", "lib/apk"}
+
+// AuditReport is how the root differs from its installed database, as paths
+// relative to the root.
+type AuditReport struct {
+	// Added are the files and directories which no installed package owns.
+	Added []string
+	// Removed are those which an installed package owns, but are missing.
+	Removed []string
+	// Modified are those whose type changed, or whose content, or target for
+	// symlinks, does not match its checksum.
+	Modified []string
+}
+
+// Clean reports whether the root matches its installed database.
+func (r *AuditReport) Clean() bool {
+	return len(r.Added) == 0 && len(r.Removed) == 0 && len(r.Modified) == 0
+}
+
+// Audit checks the files of the root against the installed database, e.g.
+// to find drift in a built image, as apk audit does. The owners and
+// permissions of the files are not checked.
+func (a *APKImplementation) Audit() (*AuditReport, error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, err
+	}
+	report := &AuditReport{}
+	owned := map[string]bool{"": true}
+	for _, pkg := range installed {
+		for _, f := range pkg.Files {
+			name := strings.Trim(path.Clean("/"+f.Name), "/")
+			if owned[name] {
+				continue
+			}
+			owned[name] = true
+			modified, err := a.auditFile(name, f)
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				report.Removed = append(report.Removed, name)
+			case err != nil:
+				return nil, fmt.Errorf("failed to audit %s of %s: %w", name, pkg.Name, err)
+			case modified:
+				report.Modified = append(report.Modified, name)
+			}
+		}
+	}
+
+	// what InitDB creates, e.g. /dev/null, is not owned by packages either
+	for _, d := range baseDirectories {
+		owned[strings.Trim(d.path, "/")] = true
+	}
+	for _, f := range a.ListInitFiles() {
+		for name := strings.Trim(path.Clean("/"+f.Name), "/"); name != "" && name != "."; name = path.Dir(name) {
+			owned[name] = true
+		}
+	}
+
+	if err := fs.WalkDir(a.fs, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		for _, ignored := range auditIgnored {
+			if name == ignored {
+				return fs.SkipDir
+			}
+		}
+		if !owned[name] {
+			report.Added = append(report.Added, name)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to walk the root: %w", err)
+	}
+
+	sort.Strings(report.Added)
+	sort.Strings(report.Removed)
+	sort.Strings(report.Modified)
+	return report, nil
+}
+
+// auditFile reports whether the file no longer matches its entry in the
+// installed database.
+func (a *APKImplementation) auditFile(name string, f *tar.Header) (bool, error) {
+	fi, err := a.fs.Lstat(name)
+	if err != nil {
+		return false, err
+	}
+	isSymlink := fi.Mode()&fs.ModeSymlink != 0
+	if f.Typeflag == tar.TypeDir {
+		// directories may be kept as symlinks to others, see installAPKFiles
+		if isSymlink {
+			fi, err = a.fs.Stat(name)
+			if err != nil {
+				return true, nil
+			}
+		}
+		return !fi.IsDir(), nil
+	}
+	if fi.IsDir() {
+		return true, nil
+	}
+	checksum := f.PAXRecords[paxRecordsChecksumKey]
+	if checksum == "" {
+		return false, nil
+	}
+	h := sha1.New() //nolint:gosec // this is what apk tools is using
+	switch {
+	case isSymlink:
+		target, err := a.fs.Readlink(name)
+		if err != nil {
+			return false, err
+		}
+		_, _ = io.WriteString(h, target)
+	case fi.Mode().IsRegular():
+		file, err := a.fs.Open(name)
+		if err != nil {
+			return false, err
+		}
+		defer file.Close()
+		if _, err := io.Copy(h, file); err != nil {
+			return false, err
+		}
+	default:
+		// devices and pipes have no checksum
+		return true, nil
+	}
+	return checksum != "Q1"+base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+func TestAudit(t *testing.T) {
+	checksum := func(content string) map[string]string {
+		sum := sha1.Sum([]byte(content)) //nolint:gosec // this is what apk tools is using
+		return map[string]string{paxRecordsChecksumKey: "Q1" + base64.StdEncoding.EncodeToString(sum[:])}
+	}
+	src := apkfs.NewMemFS()
+	a, err := NewAPKImplementation(WithFS(src), WithIgnoreMknodErrors(true), WithOffline(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB())
+
+	require.NoError(t, src.MkdirAll("usr/bin", 0o755))
+	for name, content := range map[string]string{"usr/bin/foo": "foo", "usr/bin/bar": "bar", "usr/bin/baz": "baz"} {
+		require.NoError(t, src.WriteFile(name, []byte(content), 0o755))
+	}
+	require.NoError(t, src.Symlink("foo", "usr/bin/link"))
+	require.NoError(t, a.addInstalledPackage(&repository.Package{Name: "test", Version: "1.0.0"}, []tar.Header{
+		{Name: "usr", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin/foo", Typeflag: tar.TypeReg, Mode: 0o755, PAXRecords: checksum("foo")},
+		{Name: "usr/bin/bar", Typeflag: tar.TypeReg, Mode: 0o755, PAXRecords: checksum("bar")},
+		{Name: "usr/bin/baz", Typeflag: tar.TypeReg, Mode: 0o755},
+		{Name: "usr/bin/link", Typeflag: tar.TypeSymlink, Mode: 0o777, PAXRecords: checksum("foo")},
+		{Name: "usr/bin/gone", Typeflag: tar.TypeReg, Mode: 0o755, PAXRecords: checksum("gone")},
+	}))
+
+	report, err := a.Audit()
+	require.NoError(t, err)
+	require.Equal(t, []string{"usr/bin/gone"}, report.Removed)
+	require.Empty(t, report.Added)
+	require.Empty(t, report.Modified)
+
+	// files without a checksum are only checked to exist
+	require.NoError(t, src.WriteFile("usr/bin/bar", []byte("changed"), 0o755))
+	require.NoError(t, src.WriteFile("usr/bin/baz", []byte("changed"), 0o755))
+	require.NoError(t, src.WriteFile("usr/bin/extra", []byte("extra"), 0o755))
+	require.NoError(t, src.MkdirAll("usr/lib", 0o755))
+	require.NoError(t, src.Remove("usr/bin/link"))
+	require.NoError(t, src.Symlink("bar", "usr/bin/link"))
+
+	report, err = a.Audit()
+	require.NoError(t, err)
+	require.Equal(t, &AuditReport{
+		Added:    []string{"usr/bin/extra", "usr/lib"},
+		Removed:  []string{"usr/bin/gone"},
+		Modified: []string{"usr/bin/bar", "usr/bin/link"},
+	}, report)
+	require.False(t, report.Clean())
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Credentials authenticate the requests to private repositories with HTTP
+// basic auth.
+type Credentials struct {
+	// Repository is what the credentials are for: either a URL prefix, e.g.
+	// https://apk.example.com/os, matching the repository and whatever is
+	// under it, or a host, e.g. apk.example.com, matching the https
+	// requests to that very host. Empty matches nothing, so that passwords
+	// are never sent to hosts they were not given for.
+	Repository string
+	Username   string
+	Password   string
+}
+
+// SetCredentials sets the credentials of the requests for keys, indexes and
+// packages. A request uses the credentials with the longest matching URL
+// prefix, or else those of its host; the first of those given wins a tie,
+// so that more trusted sources can come first.
+func (a *APKImplementation) SetCredentials(credentials []Credentials) {
+	a.credentials = credentials
+}
+
+// matchCredentials returns the credentials for the URL.
+func matchCredentials(credentials []Credentials, target *url.URL) (Credentials, bool) {
+	u := target.Scheme + "://" + target.Host + target.Path
+	var (
+		best      Credentials
+		bestScore = -1
+	)
+	for _, c := range credentials {
+		score := -1
+		switch {
+		case c.Repository == "":
+		case strings.Contains(c.Repository, "://"):
+			prefix := strings.TrimSuffix(c.Repository, "/")
+			if u == prefix || strings.HasPrefix(u, prefix+"/") {
+				// any prefix beats a host
+				score = 1 + len(prefix)
+			}
+		case target.Scheme == "https" && hostMatches(c.Repository, target):
+			score = 0
+		}
+		if score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+	return best, bestScore >= 0
+}
+
+// hostMatches reports whether the host, with or without a port, is the one
+// of the URL. A host without a port only matches the default port.
+func hostMatches(host string, target *url.URL) bool {
+	if strings.EqualFold(host, target.Host) {
+		return true
+	}
+	return target.Port() == "" && strings.EqualFold(host, target.Hostname())
+}
+
+// ParseHTTPAuth parses credentials given in the environment, e.g. in
+// HTTP_AUTH, as whitespace separated basic:<host>:<username>:<password>
+// entries.
+func ParseHTTPAuth(value string) ([]Credentials, error) {
+	var credentials []Credentials
+	for i, entry := range strings.Fields(value) {
+		parts := strings.SplitN(entry, ":", 4)
+		if len(parts) != 4 || parts[0] != "basic" || parts[1] == "" {
+			// do not echo the entry, which may hold a password
+			return nil, fmt.Errorf("invalid HTTP auth entry #%d, must be basic:<host>:<username>:<password>", i+1)
+		}
+		credentials = append(credentials, Credentials{Repository: parts[1], Username: parts[2], Password: parts[3]})
+	}
+	return credentials, nil
+}
+
+// ParseNetrc parses the credentials of a .netrc file, as used by curl and
+// git. The default entry, if any, is left out, as its credentials would go
+// to any host.
+func ParseNetrc(r io.Reader) ([]Credentials, error) {
+	// the tokens, without comments and macro definitions, which hold no
+	// credentials and run up to a blank line
+	var tokens []string
+	scanner := bufio.NewScanner(r)
+	inMacro := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if inMacro {
+			inMacro = line != ""
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i, f := range fields {
+			if f == "macdef" {
+				fields, inMacro = fields[:i], true
+				break
+			}
+		}
+		tokens = append(tokens, fields...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var (
+		credentials []Credentials
+		def         *Credentials
+		current     *Credentials
+	)
+	for i := 0; i < len(tokens); i++ {
+		switch token := tokens[i]; token {
+		case "machine", "default":
+			if current != nil && current != def {
+				credentials = append(credentials, *current)
+			}
+			if token == "default" {
+				def = &Credentials{}
+				current = def
+				continue
+			}
+			if i+1 == len(tokens) {
+				return nil, fmt.Errorf("netrc: machine without a name")
+			}
+			i++
+			current = &Credentials{Repository: tokens[i]}
+		case "login", "password", "account":
+			if current == nil {
+				return nil, fmt.Errorf("netrc: %s outside of a machine", token)
+			}
+			if i+1 == len(tokens) {
+				return nil, fmt.Errorf("netrc: %s without a value", token)
+			}
+			i++
+			switch token {
+			case "login":
+				current.Username = tokens[i]
+			case "password":
+				current.Password = tokens[i]
+			}
+		default:
+			return nil, fmt.Errorf("netrc: unexpected %q", token)
+		}
+	}
+	if current != nil && current != def {
+		credentials = append(credentials, *current)
+	}
+	return credentials, nil
+}
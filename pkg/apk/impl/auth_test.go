@@ -0,0 +1,122 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchCredentials(t *testing.T) {
+	credentials := []Credentials{
+		{Username: "default"},
+		{Repository: "apk.example.com", Username: "host"},
+		{Repository: "https://apk.example.com/os", Username: "os"},
+		{Repository: "https://apk.example.com/os/edge/", Username: "edge"},
+		{Repository: "apk.example.com", Username: "host-again"},
+		{Repository: "apk.example.com:8443", Username: "port"},
+		{Repository: "http://mirror.example.com/os", Username: "mirror"},
+	}
+	for _, tt := range []struct {
+		url, username string
+	}{
+		{"https://apk.example.com/os/x86_64/APKINDEX.tar.gz", "os"},
+		{"https://apk.example.com/os/edge/x86_64/APKINDEX.tar.gz", "edge"},
+		{"https://apk.example.com/osx/x86_64/APKINDEX.tar.gz", "host"},
+		{"https://apk.example.com:8443/other", "port"},
+		{"http://mirror.example.com/os/x86_64/APKINDEX.tar.gz", "mirror"},
+		// hosts only match https on their own port, and nothing matches
+		// other hosts
+		{"https://apk.example.com:9443/other", ""},
+		{"http://apk.example.com/os/x86_64/APKINDEX.tar.gz", ""},
+		{"https://other.example.com/os", ""},
+		{"https://apk.example.com.evil.com/os", ""},
+	} {
+		u, err := url.Parse(tt.url)
+		require.NoError(t, err)
+		c, ok := matchCredentials(credentials, u)
+		require.Equal(t, tt.username != "", ok, tt.url)
+		require.Equal(t, tt.username, c.Username, tt.url)
+	}
+}
+
+func TestParseHTTPAuth(t *testing.T) {
+	credentials, err := ParseHTTPAuth("basic:apk.example.com:user:pass:word\n basic:cdn.example.com:other:secret")
+	require.NoError(t, err)
+	require.Equal(t, []Credentials{
+		{Repository: "apk.example.com", Username: "user", Password: "pass:word"},
+		{Repository: "cdn.example.com", Username: "other", Password: "secret"},
+	}, credentials)
+
+	credentials, err = ParseHTTPAuth("")
+	require.NoError(t, err)
+	require.Empty(t, credentials)
+
+	for _, invalid := range []string{"apk.example.com:user:pass", "bearer:apk.example.com:user:pass", "basic::user:pass"} {
+		_, err := ParseHTTPAuth(invalid)
+		require.Error(t, err, invalid)
+		require.NotContains(t, err.Error(), "user:pass", "the password must not leak")
+	}
+}
+
+func TestParseNetrc(t *testing.T) {
+	credentials, err := ParseNetrc(strings.NewReader(`# private repositories
+default login anonymous password guest
+machine apk.example.com
+  login user
+  password secret
+macdef init
+machine ignored.example.com login nobody
+
+machine other.example.com login other password s3cret account ignored
+`))
+	require.NoError(t, err)
+	require.Equal(t, []Credentials{
+		{Repository: "apk.example.com", Username: "user", Password: "secret"},
+		{Repository: "other.example.com", Username: "other", Password: "s3cret"},
+	}, credentials, "the default entry is left out")
+
+	for _, invalid := range []string{"login user", "machine", "machine apk.example.com login", "machine apk.example.com port 443"} {
+		_, err := ParseNetrc(strings.NewReader(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestHTTPClientCredentials(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		got = append(got, user+":"+pass)
+	}))
+	defer srv.Close()
+
+	a := &APKImplementation{}
+	res, err := a.httpClient().Get(srv.URL + "/os/APKINDEX.tar.gz")
+	require.NoError(t, err)
+	res.Body.Close()
+
+	a.SetCredentials([]Credentials{{Repository: srv.URL + "/os", Username: "user", Password: "secret"}})
+	for _, p := range []string{"/os/APKINDEX.tar.gz", "/other/APKINDEX.tar.gz"} {
+		res, err := a.httpClient().Get(srv.URL + p)
+		require.NoError(t, err)
+		res.Body.Close()
+	}
+	require.Equal(t, []string{":", "user:secret", ":"}, got)
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// FileCollision is a path installed by a package which another package
+// installed already.
+type FileCollision struct {
+	Path string
+	// Packages are the packages which installed the path before.
+	Packages []string
+}
+
+// FileCollisionError is returned when a package installs paths which other
+// packages installed already.
+type FileCollisionError struct {
+	Package    string
+	Collisions []FileCollision
+}
+
+func (e *FileCollisionError) Error() string {
+	paths := make([]string, 0, len(e.Collisions))
+	for _, c := range e.Collisions {
+		paths = append(paths, fmt.Sprintf("/%s (from %s)", c.Path, strings.Join(c.Packages, ", ")))
+	}
+	return fmt.Sprintf("package %s overwrites files installed by other packages: %s", e.Package, strings.Join(paths, ", "))
+}
+
+// SetPermissiveFileCollisions sets whether a package may overwrite the files
+// installed by other packages, in which case the collisions are only logged as
+// warnings. By default, they fail the install, unless the package replaces
+// the other ones, as with the replaces of its .PKGINFO.
+func (a *APKImplementation) SetPermissiveFileCollisions(permissive bool) {
+	a.permissiveFileCollisions = permissive
+}
+
+// checkFileCollisions returns the files just installed by a package which
+// other installed packages own, unless the package replaces them, and then
+// records the package as their owner. Directories may be shared by any
+// number of packages, and are not collisions.
+func (a *APKImplementation) checkFileCollisions(pkgName string, replaces []string, files []tar.Header) error {
+	// the owners are read from the installed database once, then kept up
+	// to date as the packages are installed
+	if a.fileOwners == nil {
+		installed, err := a.GetInstalled()
+		if err != nil {
+			return err
+		}
+		a.fileOwners = map[string][]string{}
+		for _, pkg := range installed {
+			for _, f := range pkg.Files {
+				if f.Typeflag == tar.TypeDir {
+					continue
+				}
+				p := path.Clean(f.Name)
+				a.fileOwners[p] = append(a.fileOwners[p], pkg.Name)
+			}
+		}
+	}
+
+	replaced := map[string]bool{}
+	for _, r := range replaces {
+		name, _, _, _ := resolvePackageNameVersionPin(r)
+		replaced[name] = true
+	}
+
+	var collisions []FileCollision
+	for _, f := range files {
+		if f.Typeflag == tar.TypeDir {
+			continue
+		}
+		p := path.Clean(f.Name)
+		var others []string
+		for _, owner := range a.fileOwners[p] {
+			if owner != pkgName && !replaced[owner] {
+				others = append(others, owner)
+			}
+		}
+		if len(others) > 0 {
+			collisions = append(collisions, FileCollision{Path: p, Packages: others})
+		}
+		// the file is now the one of the package
+		a.fileOwners[p] = append(others, pkgName)
+	}
+	if len(collisions) == 0 {
+		return nil
+	}
+	sort.Slice(collisions, func(i, j int) bool {
+		return collisions[i].Path < collisions[j].Path
+	})
+
+	collisionErr := &FileCollisionError{Package: pkgName, Collisions: collisions}
+	if !a.permissiveFileCollisions {
+		return collisionErr
+	}
+	for _, c := range collisions {
+		a.logger.Warnf("file collision: package=%s path=/%s owners=%s", pkgName, c.Path, strings.Join(c.Packages, ","))
+	}
+	return nil
+}
@@ -15,11 +15,27 @@
 package impl
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
 	"strings"
 )
 
+// ErrUnsafePath is the error for an entry of a package whose path, or the
+// path it is a hardlink to, goes through "..", which could take it out of
+// the filesystem it is installed to.
+var ErrUnsafePath = errors.New("path leaves the root of the filesystem")
+
+// checkPath returns an error for a path with a ".." part.
+func checkPath(name string) error {
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return fmt.Errorf("%w: %s", ErrUnsafePath, name)
+		}
+	}
+	return nil
+}
+
 // Sanitize archive file pathing from "G305: Zip Slip vulnerability"
 func sanitizeArchivePath(d, t string) (v string, err error) {
 	v = filepath.Join(d, t)
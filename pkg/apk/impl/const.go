@@ -29,6 +29,8 @@ const (
 	triggersFilePath  = "lib/apk/db/triggers"
 	// which PAX record we use in the tar header
 	paxRecordsChecksumKey = "APK-TOOLS.checksum.SHA1"
+	// prefix of the PAX records holding extended attributes
+	paxRecordsXattrPrefix = "SCHILY.xattr."
 
 	// for fetching the alpine keys
 	alpineReleasesURL = "https://alpinelinux.org/releases.json"
@@ -0,0 +1,156 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// PackageFile is a file which a package installs.
+type PackageFile struct {
+	// Name is the path of the file, relative to the root.
+	Name     string
+	Mode     os.FileMode
+	Size     int64
+	UID      int
+	GID      int
+	Linkname string
+	// Checksum is the checksum apk-tools records for the file in the
+	// installed database, "Q1" and the base64 encoded SHA-1 of its content,
+	// or of its target for symlinks. Directories have none.
+	Checksum string
+}
+
+// ListAPKFiles returns the files the .apk package read from r installs, in
+// the order it installs them, without installing them.
+func ListAPKFiles(r io.Reader) ([]PackageFile, error) {
+	expanded, err := expandApk(r)
+	if err != nil {
+		return nil, fmt.Errorf("expanding apk: %w", err)
+	}
+	defer os.RemoveAll(expanded.TempDir)
+
+	f, err := os.Open(expanded.PackageDataTarGzFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return listPackageDataFiles(f)
+}
+
+// ListPackageFiles resolves the package in the repositories, e.g. "busybox" or
+// "busybox=1.36.0-r0", and returns the files it installs, without installing
+// them.
+func (a *APKImplementation) ListPackageFiles(pkgName string) ([]PackageFile, error) {
+	indexes, err := a.getRepositoryIndexes(false)
+	if err != nil {
+		return nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	named := make([]NamedIndex, 0, len(indexes))
+	for _, index := range indexes {
+		named = append(named, index)
+	}
+	pkgs, err := NewPkgResolver(named).ResolvePackage(pkgName)
+	if err != nil {
+		return nil, err
+	}
+	r, err := a.fetchPackage(pkgs[0])
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	files, err := ListAPKFiles(r)
+	if err != nil {
+		return nil, fmt.Errorf("listing files of package %s: %w", pkgs[0].Name, err)
+	}
+	return files, nil
+}
+
+// listPackageDataFiles returns the files in the package data section of an
+// apk, a tar.gz stream.
+func listPackageDataFiles(r io.Reader) ([]PackageFile, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	var files []PackageFile
+	// records of the PAX global extended headers seen so far
+	globalRecords := map[string]string{}
+	checksums := map[string]string{}
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			for k, v := range header.PAXRecords {
+				if v == "" {
+					delete(globalRecords, k)
+				} else {
+					globalRecords[k] = v
+				}
+			}
+			continue
+		}
+		if err := applyGlobalPAXRecords(header, globalRecords); err != nil {
+			return nil, fmt.Errorf("invalid PAX global header for %s: %w", header.Name, err)
+		}
+		// like installAPKFiles, skip the hidden files ahead of the data, such as
+		// the .PKGINFO of apks with a single section
+		if len(files) == 0 && strings.HasPrefix(header.Name, ".") && !strings.Contains(header.Name, "/") {
+			continue
+		}
+
+		file := PackageFile{
+			Name:     header.Name,
+			Mode:     header.FileInfo().Mode(),
+			Size:     header.Size,
+			UID:      header.Uid,
+			GID:      header.Gid,
+			Linkname: header.Linkname,
+		}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			w := sha1.New() //nolint:gosec // this is what apk tools is using
+			if _, err := io.Copy(w, tr); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", header.Name, err)
+			}
+			file.Checksum = fmt.Sprintf("Q1%s", base64.StdEncoding.EncodeToString(w.Sum(nil)))
+			checksums[header.Name] = file.Checksum
+		case tar.TypeSymlink:
+			sum := sha1.Sum([]byte(header.Linkname)) //nolint:gosec // this is what apk tools is using
+			file.Checksum = fmt.Sprintf("Q1%s", base64.StdEncoding.EncodeToString(sum[:]))
+		case tar.TypeLink:
+			file.Checksum = checksums[header.Linkname]
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
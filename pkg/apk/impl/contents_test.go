@@ -0,0 +1,50 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListPackageDataFiles(t *testing.T) {
+	data := testKeysPackageData(t, []tar.Header{
+		{Name: ".PKGINFO", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "usr", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin/hello", Typeflag: tar.TypeReg, Mode: 0o755, Uid: 0, Gid: 0},
+		{Name: "usr/bin/hi", Typeflag: tar.TypeSymlink, Linkname: "hello", Mode: 0o777},
+		{Name: "usr/bin/hey", Typeflag: tar.TypeLink, Linkname: "usr/bin/hello", Mode: 0o755},
+		{Name: "usr/share/.hidden", Typeflag: tar.TypeReg, Mode: 0o600, Uid: 1000, Gid: 1000},
+	}, map[string]string{
+		".PKGINFO":          "pkgname = hello\n",
+		"usr/bin/hello":     "hello world\n",
+		"usr/share/.hidden": "secret",
+	})
+
+	files, err := listPackageDataFiles(data)
+	require.NoError(t, err)
+	require.Equal(t, []PackageFile{
+		{Name: "usr", Mode: os.ModeDir | 0o755},
+		{Name: "usr/bin", Mode: os.ModeDir | 0o755},
+		{Name: "usr/bin/hello", Mode: 0o755, Size: 12, Checksum: "Q1IlljY7PeQLBvmB+4XYIxLowO1RE="},
+		{Name: "usr/bin/hi", Mode: os.ModeSymlink | 0o777, Linkname: "hello", Checksum: "Q1qvTGHdzF6KLavt4PO0gs2a6pQ00="},
+		{Name: "usr/bin/hey", Mode: 0o755, Linkname: "usr/bin/hello", Checksum: "Q1IlljY7PeQLBvmB+4XYIxLowO1RE="},
+		{Name: "usr/share/.hidden", Mode: 0o600, Size: 6, UID: 1000, GID: 1000, Checksum: "Q15en6G6MezRroT3XKqkdPOmY/BfQ="},
+	}, files)
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// PathExclusions are the paths which are not installed from packages, with
+// everything under them, e.g. /usr/share/man, to make images smaller. Each
+// is a path, or a pattern as for path.Match, e.g. /usr/share/locale/*.
+type PathExclusions struct {
+	// All are not installed from any package.
+	All []string
+	// Packages are not installed from the packages of each name.
+	Packages map[string][]string
+}
+
+// SetPathExclusions sets the paths not to install from packages. Excluded
+// files are left out of the installed database as well.
+func (a *APKImplementation) SetPathExclusions(exclusions PathExclusions) error {
+	all, err := newPathMatcher(exclusions.All)
+	if err != nil {
+		return err
+	}
+	packages := make(map[string]pathMatcher, len(exclusions.Packages))
+	for name, paths := range exclusions.Packages {
+		m, err := newPathMatcher(paths)
+		if err != nil {
+			return fmt.Errorf("package %s: %w", name, err)
+		}
+		packages[name] = m
+	}
+	a.excludeAll, a.excludePackages = all, packages
+	return nil
+}
+
+// excludedFor returns the paths not to install from the package.
+func (a *APKImplementation) excludedFor(pkgName string) pathMatcher {
+	return append(append(pathMatcher{}, a.excludeAll...), a.excludePackages[pkgName]...)
+}
+
+// pathMatcher are patterns of paths relative to the root, as in tar headers.
+type pathMatcher []string
+
+func newPathMatcher(paths []string) (pathMatcher, error) {
+	m := make(pathMatcher, 0, len(paths))
+	for _, p := range paths {
+		pattern := strings.Trim(path.Clean("/"+p), "/")
+		if pattern == "" {
+			return nil, fmt.Errorf("cannot exclude the root directory")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid excluded path %s: %w", p, err)
+		}
+		m = append(m, pattern)
+	}
+	return m, nil
+}
+
+// matches reports whether the path, relative to the root, or any of its
+// parents matches one of the patterns.
+func (m pathMatcher) matches(name string) bool {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	for _, pattern := range m {
+		for p := name; p != ""; {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+			i := strings.LastIndex(p, "/")
+			if i < 0 {
+				break
+			}
+			p = p[:i]
+		}
+	}
+	return false
+}
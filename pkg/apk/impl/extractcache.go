@@ -0,0 +1,213 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+const (
+	cachedControlFilename = "control.tar.gz"
+	cachedDataFilename    = "data.tar"
+	// the SHA-256 hash of the whole .apk file, for the packages pinned to one
+	cachedAPKHashFilename = "apk.sha256"
+)
+
+// WithExtractionCache sets a directory to keep the expanded packages in, by
+// the checksum of their control section, so that later installs of the same
+// packages neither download nor decompress them again. If not provided,
+// packages are expanded each time.
+func WithExtractionCache(dir string) Option {
+	return func(o *opts) error {
+		o.extractionCache = dir
+		return nil
+	}
+}
+
+// packageSections are where the sections of a package to install are.
+type packageSections struct {
+	control string
+	data    string
+	// dataCompressed is set for a data section which is a .tar.gz, rather
+	// than the .tar of the cache
+	dataCompressed bool
+}
+
+// openData returns the tar stream of the data section.
+func (s *packageSections) openData() (io.ReadCloser, error) {
+	f, err := os.Open(s.data)
+	if err != nil {
+		return nil, err
+	}
+	if !s.dataCompressed {
+		return f, nil
+	}
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFileReader{Reader: gr, f: f}, nil
+}
+
+// source returns the file the tar stream of the data section is read from,
+// if it is read as is, so that the content of its files may be referenced.
+func (s *packageSections) source() string {
+	if s.dataCompressed {
+		return ""
+	}
+	return s.data
+}
+
+type gzipFileReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (r *gzipFileReader) Close() error {
+	r.Reader.Close()
+	return r.f.Close()
+}
+
+// extractionCacheDir returns the directory the package is cached in, if
+// there is a cache and the package has a checksum to key it by.
+func (a *APKImplementation) extractionCacheDir(pkg *repository.RepositoryPackage) (string, bool) {
+	if a.extractionCache == "" || len(pkg.Checksum) == 0 {
+		return "", false
+	}
+	return filepath.Join(a.extractionCache, hex.EncodeToString(pkg.Checksum)), true
+}
+
+// cachedSections returns the sections of the package from the cache, or nil
+// if it is not cached. The hash of the whole .apk file is checked for the
+// packages pinned to one.
+func (a *APKImplementation) cachedSections(pkg *repository.RepositoryPackage) (*packageSections, error) {
+	dir, ok := a.extractionCacheDir(pkg)
+	if !ok {
+		return nil, nil
+	}
+	sections := &packageSections{
+		control: filepath.Join(dir, cachedControlFilename),
+		data:    filepath.Join(dir, cachedDataFilename),
+	}
+	for _, p := range []string{sections.control, sections.data} {
+		if _, err := os.Stat(p); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unable to read extraction cache for package %s: %w", pkg.Name, err)
+		}
+	}
+	if pin, pinned := a.checksumPins[pkg.Name]; pinned {
+		b, err := os.ReadFile(filepath.Join(dir, cachedAPKHashFilename))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read extraction cache for package %s: %w", pkg.Name, err)
+		}
+		if actual := strings.TrimSpace(string(b)); actual != pin {
+			return nil, &ChecksumMismatchError{
+				Package:  fmt.Sprintf("%s-%s", pkg.Name, pkg.Version),
+				URL:      pkg.Url(),
+				Section:  "apk",
+				Expected: pin,
+				Actual:   actual,
+			}
+		}
+	}
+	a.logger.Debugf("installing %s (%s) from the extraction cache", pkg.Name, pkg.Version)
+	return sections, nil
+}
+
+// cacheSections keeps the sections of the expanded package in the cache,
+// with the data section decompressed. Packages which do not match their
+// checksum are not cached, so that the cache only holds what the checksums
+// it is keyed by are of.
+func (a *APKImplementation) cacheSections(pkg *repository.RepositoryPackage, expanded *apkExpanded, apkHash string) error {
+	dir, ok := a.extractionCacheDir(pkg)
+	if !ok {
+		return nil
+	}
+	if verifyPackageChecksum(pkg, expanded) != nil {
+		return nil
+	}
+	if err := os.MkdirAll(a.extractionCache, 0o755); err != nil {
+		return err
+	}
+	// write it aside, then move it in place, so that builds sharing the cache
+	// never see a partial entry
+	tmp, err := os.MkdirTemp(a.extractionCache, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := copyFileTo(expanded.ControlDataTarGzFilename, filepath.Join(tmp, cachedControlFilename)); err != nil {
+		return err
+	}
+	data, err := (&packageSections{data: expanded.PackageDataTarGzFilename, dataCompressed: true}).openData()
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	out, err := os.Create(filepath.Join(tmp, cachedDataFilename))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, data); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// #nosec G306 -- the cache holds public packages
+	if err := os.WriteFile(filepath.Join(tmp, cachedAPKHashFilename), []byte(apkHash+"\n"), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		// another build cached it first
+		if _, statErr := os.Stat(dir); statErr == nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// copyFileTo copies a file of the host.
+func copyFileTo(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
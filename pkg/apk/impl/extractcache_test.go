@@ -0,0 +1,103 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+func TestExtractionCache(t *testing.T) {
+	var data bytes.Buffer
+	gw := gzip.NewWriter(&data)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0o755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "usr/foo", Typeflag: tar.TypeReg, Mode: 0o644, Size: 3}))
+	_, err := tw.Write([]byte("foo"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	expanded, checksum := testExpandedPackage(t, "pkgname = foo\n", data.Bytes())
+
+	src := apkfs.NewMemFS()
+	a, err := NewAPKImplementation(WithFS(src), WithExtractionCache(t.TempDir()))
+	require.NoError(t, err)
+	repo := &repository.RepositoryWithIndex{Repository: &repository.Repository{Uri: "https://example.com/os/x86_64"}}
+	pkg := repository.NewRepositoryPackage(&repository.Package{Name: "foo", Version: "1.0.0-r0", Checksum: checksum}, repo)
+
+	sections, err := a.cachedSections(pkg)
+	require.NoError(t, err)
+	require.Nil(t, sections, "nothing is cached yet")
+
+	// packages not matching their checksum are not cached
+	corrupted := repository.NewRepositoryPackage(&repository.Package{Name: "foo", Version: "1.0.0-r0", Checksum: []byte("corrupted")}, repo)
+	require.NoError(t, a.cacheSections(corrupted, expanded, "0123"))
+	sections, err = a.cachedSections(corrupted)
+	require.NoError(t, err)
+	require.Nil(t, sections)
+
+	require.NoError(t, a.cacheSections(pkg, expanded, "0123"))
+	sections, err = a.cachedSections(pkg)
+	require.NoError(t, err)
+	require.NotNil(t, sections)
+	require.False(t, sections.dataCompressed)
+
+	// the cached data installs as the package would
+	dataIn, err := sections.openData()
+	require.NoError(t, err)
+	defer dataIn.Close()
+	files, err := a.installAPKTarExcept(dataIn, nil, sections.source())
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	b, err := src.ReadFile("usr/foo")
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(b))
+	// which the file references rather than copies, until it is written to
+	f, err := src.OpenFile("usr/foo", os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("b"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	b, err = src.ReadFile("usr/foo")
+	require.NoError(t, err)
+	require.Equal(t, "boo", string(b))
+	dataIn, err = sections.openData()
+	require.NoError(t, err)
+	defer dataIn.Close()
+	_, err = a.installAPKTarExcept(dataIn, nil, sections.source())
+	require.NoError(t, err)
+	b, err = src.ReadFile("usr/foo")
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(b))
+
+	// the hash of the whole file is kept for pins
+	a.checksumPins = map[string]string{"foo": "0123"}
+	_, err = a.cachedSections(pkg)
+	require.NoError(t, err)
+	a.checksumPins = map[string]string{"foo": "4567"}
+	_, err = a.cachedSections(pkg)
+	var mismatch *ChecksumMismatchError
+	require.True(t, errors.As(err, &mismatch), "unexpected error %v", err)
+	require.Equal(t, "apk", mismatch.Section)
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// FetchLimits throttle the downloads of keys, indexes and packages, e.g. so
+// that builds on shared machines leave bandwidth to the others. Zero values
+// do not limit anything.
+type FetchLimits struct {
+	// MaxConnections is how many requests may be in flight at once.
+	MaxConnections int
+	// MaxBandwidth is how many bytes per second may be downloaded in total.
+	MaxBandwidth int64
+}
+
+// IsZero reports whether the limits do not limit anything.
+func (l FetchLimits) IsZero() bool {
+	return l.MaxConnections <= 0 && l.MaxBandwidth <= 0
+}
+
+// NewLimitedTransport returns a transport doing the requests with base, or
+// with http.DefaultTransport if nil, within the limits. The clients sharing
+// the transport share the limits, e.g. those of all the architectures of a
+// build.
+func NewLimitedTransport(base http.RoundTripper, limits FetchLimits) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &limitedTransport{base: base}
+	if limits.MaxConnections > 0 {
+		t.conns = make(chan struct{}, limits.MaxConnections)
+	}
+	if limits.MaxBandwidth > 0 {
+		t.bandwidth = &bandwidthLimiter{rate: limits.MaxBandwidth}
+	}
+	return t
+}
+
+type limitedTransport struct {
+	base http.RoundTripper
+	// conns holds a token for each request in flight, until its body is
+	// closed.
+	conns     chan struct{}
+	bandwidth *bandwidthLimiter
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release := func() {}
+	if t.conns != nil {
+		select {
+		case t.conns <- struct{}{}:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		var once sync.Once
+		release = func() { once.Do(func() { <-t.conns }) }
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &limitedBody{ReadCloser: res.Body, bandwidth: t.bandwidth, release: release}
+	return res, nil
+}
+
+// limitedBody reads a response body within the bandwidth, giving the
+// connection back once closed.
+type limitedBody struct {
+	io.ReadCloser
+	bandwidth *bandwidthLimiter
+	release   func()
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.bandwidth != nil && int64(len(p)) > b.bandwidth.rate {
+		// keep the waits short
+		p = p[:b.bandwidth.rate]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.bandwidth != nil && n > 0 {
+		b.bandwidth.wait(n)
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
+
+// bandwidthLimiter paces reads to the rate, in bytes per second, by
+// delaying each of them until the bytes read before are paid for.
+type bandwidthLimiter struct {
+	rate int64
+
+	mu sync.Mutex
+	// next is when all the bytes read so far are paid for.
+	next time.Time
+}
+
+func (b *bandwidthLimiter) wait(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	b.next = b.next.Add(time.Duration(int64(n) * int64(time.Second) / b.rate))
+	d := b.next.Sub(now)
+	b.mu.Unlock()
+	time.Sleep(d)
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// countingTransport serves the body to all requests, counting those in
+// flight until their bodies are closed.
+type countingTransport struct {
+	body     []byte
+	inFlight int32
+	max      int32
+}
+
+func (t *countingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	n := atomic.AddInt32(&t.inFlight, 1)
+	for {
+		m := atomic.LoadInt32(&t.max)
+		if n <= m || atomic.CompareAndSwapInt32(&t.max, m, n) {
+			break
+		}
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: &countingBody{Reader: bytes.NewReader(t.body), t: t}}, nil
+}
+
+type countingBody struct {
+	io.Reader
+	t *countingTransport
+}
+
+func (b *countingBody) Close() error {
+	atomic.AddInt32(&b.t.inFlight, -1)
+	return nil
+}
+
+func TestLimitedTransportConnections(t *testing.T) {
+	base := &countingTransport{body: []byte("index")}
+	client := &http.Client{Transport: NewLimitedTransport(base, FetchLimits{MaxConnections: 2})}
+
+	done := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() {
+			res, err := client.Get("https://example.com/APKINDEX.tar.gz")
+			if err == nil {
+				time.Sleep(10 * time.Millisecond)
+				_, err = io.ReadAll(res.Body)
+				res.Body.Close()
+			}
+			done <- err
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		require.NoError(t, <-done)
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&base.max))
+
+	// waiting for a connection gives up with the request
+	transport := NewLimitedTransport(base, FetchLimits{MaxConnections: 1})
+	res, err := (&http.Client{Transport: transport}).Get("https://example.com/APKINDEX.tar.gz")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://example.com/APKINDEX.tar.gz", nil)
+	require.NoError(t, err)
+	_, err = transport.RoundTrip(req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestLimitedTransportBandwidth(t *testing.T) {
+	base := &countingTransport{body: make([]byte, 3000)}
+	client := &http.Client{Transport: NewLimitedTransport(base, FetchLimits{MaxBandwidth: 10000})}
+
+	start := time.Now()
+	res, err := client.Get("https://example.com/hello-1.0-r0.apk")
+	require.NoError(t, err)
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Len(t, data, 3000)
+	require.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+}
+
+func TestLimitedTransportIndexes(t *testing.T) {
+	index := testWriteIndex(t, "", &repository.Package{Name: "busybox", Version: "1.36.0-r0", Arch: "x86_64"})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/os/x86_64/"+indexFilename && r.URL.Path != "/extras/x86_64/"+indexFilename {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(index)
+	}))
+	defer srv.Close()
+
+	// a single connection is enough for several indexes and the noarch
+	// fallbacks, each of them being given back before the next request
+	client := &http.Client{Transport: NewLimitedTransport(srv.Client().Transport, FetchLimits{MaxConnections: 1})}
+	repos := []string{srv.URL + "/os", srv.URL + "/extras"}
+	done := make(chan error, 1)
+	go func() {
+		indexes, err := GetRepositoryIndexes(repos, nil, "x86_64", WithIgnoreSignatures(true), WithHTTPClient(client), WithIndexNoarch(true))
+		if err == nil && len(indexes) != 2 {
+			err = fmt.Errorf("got %d indexes, expected 2", len(indexes))
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("fetching the indexes did not complete with one connection")
+	}
+}
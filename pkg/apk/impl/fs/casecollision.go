@@ -0,0 +1,61 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CaseCollision is a path which differs only by case from another one, so
+// that both cannot be on a case-insensitive disk, e.g. on macOS or Windows.
+type CaseCollision struct {
+	Path     string
+	Existing string
+}
+
+func (c *CaseCollision) Error() string {
+	return fmt.Sprintf("%s collides with %s on a case-insensitive filesystem", c.Path, c.Existing)
+}
+
+// CaseCollisionFS is a filesystem which can report the paths which collide
+// by case with others on disk.
+type CaseCollisionFS interface {
+	// CaseCollisions returns the paths kept in memory only as they collide
+	// with others, sorted by path.
+	CaseCollisions() []CaseCollision
+}
+
+// DirFSWithCaseCollisionError fails to create a path which differs only by
+// case from one already in the directory, if it is case-insensitive, with a
+// *CaseCollision error. By default, such paths are kept in memory only, and
+// reported by CaseCollisions.
+func DirFSWithCaseCollisionError(fail bool) DirFSOption {
+	return func(opts *dirFSOpts) error {
+		opts.failOnCollision = fail
+		return nil
+	}
+}
+
+func (f *dirFS) CaseCollisions() []CaseCollision {
+	f.caseMapMutex.Lock()
+	defer f.caseMapMutex.Unlock()
+	collisions := make([]CaseCollision, 0, len(f.collisions))
+	for p, existing := range f.collisions {
+		collisions = append(collisions, CaseCollision{Path: p, Existing: existing})
+	}
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i].Path < collisions[j].Path })
+	return collisions
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// SyncFS is a filesystem which keeps some of what it is asked for aside,
+// e.g. the owners of files it cannot chown, until Sync writes it out.
+type SyncFS interface {
+	Sync() error
+}
+
+// DirFSWithFakerootDB keeps what cannot be set on the files of the directory
+// on disk, e.g. their owners, devices and extended attributes when not running
+// as root, in a database at the path, as fakeroot does. It is read when the
+// filesystem is created, if it exists, and written by Sync, so that the
+// directory can be picked up again later, e.g. to write it to a tarball. The
+// path should be outside of the directory.
+func DirFSWithFakerootDB(path string) DirFSOption {
+	return func(opts *dirFSOpts) error {
+		opts.fakerootDB = path
+		return nil
+	}
+}
+
+// fakerootEntry is what the database keeps of a file.
+type fakerootEntry struct {
+	Path   string            `json:"path"`
+	Mode   fs.FileMode       `json:"mode"`
+	UID    int               `json:"uid"`
+	GID    int               `json:"gid"`
+	Dev    int               `json:"dev,omitempty"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// Sync writes the fakeroot database, if any, with the attributes of all the
+// files, as those in memory override the ones on disk.
+func (f *dirFS) Sync() error {
+	if f.fakerootDB == "" {
+		return nil
+	}
+	var entries []fakerootEntry
+	if err := fs.WalkDir(f.overrides, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			return nil
+		}
+		fi, err := f.overrides.Lstat(path)
+		if err != nil {
+			return err
+		}
+		entry := fakerootEntry{Path: path, Mode: fi.Mode()}
+		if hdr, ok := fi.Sys().(*tar.Header); ok {
+			entry.UID, entry.GID = hdr.Uid, hdr.Gid
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			entries = append(entries, entry)
+			return nil
+		}
+		if fi.Mode()&fs.ModeDevice != 0 {
+			if entry.Dev, err = f.overrides.Readnod(path); err != nil {
+				return err
+			}
+		}
+		xattrs, err := f.overrides.ListXattrs(path)
+		if err != nil {
+			return err
+		}
+		if len(xattrs) > 0 {
+			entry.Xattrs = xattrs
+		}
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("listing files for the fakeroot database: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write it aside, then move it in place, so that it is never partial
+	tmp := f.fakerootDB + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.fakerootDB)
+}
+
+// loadFakerootDB applies the attributes of the files of the database, if it
+// exists, over those read from disk. Files no longer on disk are left out.
+func (f *dirFS) loadFakerootDB() error {
+	b, err := os.ReadFile(f.fakerootDB)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []fakerootEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("parsing fakeroot database %s: %w", f.fakerootDB, err)
+	}
+	for _, e := range entries {
+		path := filepath.Clean(e.Path)
+		fi, err := f.overrides.Lstat(path)
+		if err != nil {
+			continue
+		}
+		// devices and pipes which could not be created are regular files on disk
+		if t := e.Mode.Type(); t&(fs.ModeDevice|fs.ModeNamedPipe) != 0 && fi.Mode().Type() != t {
+			if err := f.overrides.Remove(path); err != nil {
+				return err
+			}
+			kind := uint32(unix.S_IFIFO)
+			switch {
+			case t&fs.ModeCharDevice != 0:
+				kind = unix.S_IFCHR
+			case t&fs.ModeDevice != 0:
+				kind = unix.S_IFBLK
+			}
+			if err := f.overrides.Mknod(path, kind|uint32(e.Mode.Perm()), e.Dev); err != nil {
+				return err
+			}
+		}
+		if e.Mode&fs.ModeSymlink != 0 {
+			if err := f.overrides.Lchown(path, e.UID, e.GID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := f.overrides.Chmod(path, e.Mode.Perm()|e.Mode&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+			return err
+		}
+		if err := f.overrides.Chown(path, e.UID, e.GID); err != nil {
+			return err
+		}
+		for attr, data := range e.Xattrs {
+			if err := f.overrides.SetXattr(path, attr, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestFakerootDB(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "rootfs")
+	db := dir + ".fakeroot"
+	fsys := DirFS(dir, WithCreateDir(true), DirFSWithFakerootDB(db))
+	require.NotNil(t, fsys, "fs should be created")
+
+	require.NoError(t, fsys.MkdirAll("dev", 0o755))
+	require.NoError(t, fsys.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, fsys.WriteFile("usr/bin/ping", []byte("ping"), 0o755))
+	require.NoError(t, fsys.Chown("usr/bin/ping", 1000, 1001))
+	require.NoError(t, fsys.SetXattr("usr/bin/ping", "user.origin", []byte("wolfi")))
+	require.NoError(t, fsys.Symlink("ping", "usr/bin/ping6"))
+	require.NoError(t, fsys.Lchown("usr/bin/ping6", 1000, 1001))
+	require.NoError(t, fsys.Mknod("dev/null", unix.S_IFCHR|0o666, int(unix.Mkdev(1, 3))))
+	require.NoError(t, fsys.(SyncFS).Sync())
+
+	// whatever could be set on disk, the database has it all
+	reopened := DirFS(dir, DirFSWithFakerootDB(db))
+	require.NotNil(t, reopened, "fs should be created")
+
+	fi, err := reopened.Stat("usr/bin/ping")
+	require.NoError(t, err)
+	hdr := fi.Sys().(*tar.Header)
+	require.Equal(t, 1000, hdr.Uid)
+	require.Equal(t, 1001, hdr.Gid)
+	require.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+	xattrs, err := reopened.ListXattrs("usr/bin/ping")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"user.origin": []byte("wolfi")}, xattrs)
+
+	fi, err = reopened.Lstat("usr/bin/ping6")
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSymlink, fi.Mode().Type())
+	require.Equal(t, 1000, fi.Sys().(*tar.Header).Uid)
+
+	fi, err = reopened.Stat("dev/null")
+	require.NoError(t, err)
+	require.Equal(t, os.ModeDevice|os.ModeCharDevice, fi.Mode().Type())
+	dev, err := reopened.Readnod("dev/null")
+	require.NoError(t, err)
+	require.Equal(t, int(unix.Mkdev(1, 3)), dev)
+}
+
+func TestFakerootDBMissing(t *testing.T) {
+	dir := t.TempDir()
+	fsys := DirFS(dir, DirFSWithFakerootDB(filepath.Join(t.TempDir(), "missing")))
+	require.NotNil(t, fsys, "a database which does not exist yet is empty")
+}
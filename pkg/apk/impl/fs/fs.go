@@ -16,6 +16,7 @@ package fs
 import (
 	"io"
 	"io/fs"
+	"time"
 )
 
 // FullFS is a filesystem that supports all filesystem operations.
@@ -27,8 +28,12 @@ type FullFS interface {
 	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
 	ReadFile(name string) ([]byte, error)
 	WriteFile(name string, b []byte, mode fs.FileMode) error
+	// ReadDir returns the entries of the directory sorted by name, as
+	// os.ReadDir does, so that walking any implementation goes in the same
+	// order, which reproducible layers depend on.
 	ReadDir(name string) ([]fs.DirEntry, error)
 	Mknod(path string, mode uint32, dev int) error
+	Mkfifo(path string, perm fs.FileMode) error
 	Readnod(name string) (dev int, err error)
 	Symlink(oldname, newname string) error
 	Link(oldname, newname string) error
@@ -39,6 +44,31 @@ type FullFS interface {
 	Remove(name string) error
 	Chmod(path string, perm fs.FileMode) error
 	Chown(path string, uid int, gid int) error
+	Lchown(path string, uid int, gid int) error
+	// SetModTime sets the modification time of the entry, not following a
+	// final symlink. Entries otherwise have the time they were created at,
+	// with every implementation, whatever is written to them after that.
+	SetModTime(path string, mtime time.Time) error
+	SetXattr(path string, attr string, data []byte) error
+	GetXattr(path string, attr string) ([]byte, error)
+	RemoveXattr(path string, attr string) error
+	ListXattrs(path string) (map[string][]byte, error)
+}
+
+// FileReference is the content of a file kept elsewhere, e.g. in the package
+// extraction cache: Size bytes from Offset of the file at Path on disk.
+type FileReference struct {
+	Path   string
+	Offset int64
+	Size   int64
+}
+
+// ReferenceFS is a filesystem which can create files referencing their
+// content rather than copying it, which it only does once they are written
+// to. The content referenced must not change for as long as the files do.
+type ReferenceFS interface {
+	FullFS
+	WriteFileReference(name string, ref FileReference, mode fs.FileMode) error
 }
 
 // File is an interface for a file. It includes Read, Write, Close.
@@ -65,6 +95,11 @@ type ReadnodFS interface {
 	Readnod(name string) (dev int, err error)
 }
 
+type XattrFS interface {
+	fs.FS
+	ListXattrs(path string) (map[string][]byte, error)
+}
+
 type OpenReaderAtReadLinkFS interface {
 	OpenReaderAtFS
 	ReadLinkFS
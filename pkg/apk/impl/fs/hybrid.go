@@ -0,0 +1,60 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"os"
+)
+
+// minSpillSize is the size from which files are spilled to disk, as writing
+// out small ones would save little memory for a lot of files.
+const minSpillSize = 64 << 10
+
+// NewHybridFS returns a filesystem kept in memory, like NewMemFS, but for the
+// content of large files, which goes to files in the directory once more than
+// budget bytes are held in memory. It is read from there, until written to
+// again. Small files stay in memory regardless.
+func NewHybridFS(dir string, budget int64) FullFS {
+	m := NewMemFS().(*memFS)
+	m.spillDir = dir
+	m.budget = budget
+	return m
+}
+
+// spill writes the content of the file to disk, if it is large and the memory
+// held is over the budget.
+func (m *memFS) spill(n *node) error {
+	if m.spillDir == "" || m.used <= m.budget || n.ref != nil || len(n.data) < minSpillSize {
+		return nil
+	}
+	f, err := os.CreateTemp(m.spillDir, "spill-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(n.data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	m.used -= int64(len(n.data))
+	n.ref = &FileReference{Path: f.Name(), Size: int64(len(n.data))}
+	n.data = nil
+	n.spilled = true
+	return nil
+}
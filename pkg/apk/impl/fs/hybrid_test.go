@@ -0,0 +1,69 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHybridFSSpill(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHybridFS(dir, 100<<10)
+	spilled := func() int {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		return len(entries)
+	}
+
+	small := []byte("small")
+	large := bytes.Repeat([]byte("x"), 80<<10)
+	require.NoError(t, h.WriteFile("small", small, 0o644))
+	require.NoError(t, h.WriteFile("large1", large, 0o644))
+	require.Equal(t, 0, spilled(), "under the budget")
+
+	require.NoError(t, h.WriteFile("large2", large, 0o644))
+	require.Equal(t, 1, spilled(), "over the budget")
+	for _, name := range []string{"small", "large1", "large2"} {
+		b, err := h.ReadFile(name)
+		require.NoError(t, err)
+		if name == "small" {
+			require.Equal(t, small, b)
+		} else {
+			require.Equal(t, large, b)
+		}
+	}
+	fi, err := h.Stat("large2")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(large)), fi.Size())
+
+	// writing to it brings it back, until closed
+	f, err := h.OpenFile("large2", os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("more"))
+	require.NoError(t, err)
+	require.Equal(t, 0, spilled())
+	require.NoError(t, f.Close())
+	require.Equal(t, 1, spilled())
+	b, err := h.ReadFile("large2")
+	require.NoError(t, err)
+	require.Equal(t, append(append([]byte{}, large...), "more"...), b)
+
+	require.NoError(t, h.Remove("large2"))
+	require.Equal(t, 0, spilled())
+}
@@ -23,6 +23,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -33,8 +34,16 @@ const pathSep = "/"
 
 type memFS struct {
 	tree *node
+	// spillDir is where to write the content of large files, once more than
+	// budget bytes are held in memory, if set. used is how many are.
+	spillDir string
+	budget   int64
+	used     int64
 }
 
+// NewMemFS returns a filesystem kept in memory. It is a ReferenceFS: files
+// may reference content on disk, e.g. in the extraction cache, which is only
+// copied into memory once they are written to.
 func NewMemFS() FullFS {
 	return &memFS{
 		tree: &node{
@@ -46,16 +55,36 @@ func NewMemFS() FullFS {
 	}
 }
 
-// getNode returns the node for the given path. If the path is not found, it
-// returns an error
+// maxSymlinks bounds how many symlinks resolving a path may go through, as
+// Linux does, so that loops fail rather than recurse forever.
+const maxSymlinks = 40
+
+// getNode returns the node for the given path, following symlinks. If the
+// path is not found, it returns an error
 func (m *memFS) getNode(path string) (*node, error) {
+	return m.resolve(path, true, 0)
+}
+
+// lgetNode is getNode, returning the symlink itself if the path is one.
+func (m *memFS) lgetNode(path string) (*node, error) {
+	return m.resolve(path, false, 0)
+}
+
+// resolve returns the node for the given path, following the symlinks of
+// its parents, and its own if followLast is set. links is how many symlinks
+// were followed to get to the path.
+func (m *memFS) resolve(path string, followLast bool, links int) (*node, error) {
 	if path == "/" || path == "." {
 		return m.tree, nil
 	}
 	parts := strings.Split(path, pathSep)
+	last := len(parts) - 1
+	for last >= 0 && parts[last] == "" {
+		last--
+	}
 	node := m.tree
 	traversed := make([]string, 0)
-	for _, part := range parts {
+	for i, part := range parts {
 		if part == "" {
 			continue
 		}
@@ -68,16 +97,20 @@ func (m *memFS) getNode(path string) (*node, error) {
 			return nil, os.ErrNotExist
 		}
 		// what if it is a symlink?
-		if childNode.mode&os.ModeSymlink != 0 {
-			// getNode requires working on the absolute path, so we just resolve the path to an absolute path,
+		if childNode.mode&os.ModeSymlink != 0 && (followLast || i != last) {
+			if links++; links > maxSymlinks {
+				return nil, unix.ELOOP
+			}
+			// resolve works on the absolute path, so we just resolve the path to an absolute path,
 			// rather than struggling to clean up the path.
 			// But, we have to make sure that we set it relative to where we are currently, rather than the parent of the path.
 			// For example, /usr/lib64/foo/bar when /usr/lib64 -> lib, we want to resolve to /usr/lib rather than /usr/lib64/foo/lib
+			// Joining to the root also keeps ../ from going above it.
 			linkTarget := childNode.linkTarget
 			if !filepath.IsAbs(linkTarget) {
-				linkTarget = filepath.Join(strings.Join(traversed, pathSep), linkTarget)
+				linkTarget = filepath.Join(pathSep, strings.Join(traversed, pathSep), linkTarget)
 			}
-			targetNode, err := m.getNode(linkTarget)
+			targetNode, err := m.resolve(linkTarget, true, links)
 			if err != nil {
 				return nil, err
 			}
@@ -88,6 +121,7 @@ func (m *memFS) getNode(path string) (*node, error) {
 	}
 	return node, nil
 }
+
 func (m *memFS) Mkdir(path string, perms fs.FileMode) error {
 	// first see if the parent exists
 	parent := filepath.Dir(path)
@@ -119,18 +153,11 @@ func (m *memFS) Stat(path string) (fs.FileInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	if node.mode&fs.ModeSymlink != 0 {
-		targetNode, err := m.getNode(node.linkTarget)
-		if err != nil {
-			return nil, err
-		}
-		node = targetNode
-	}
 	return node.fileInfo(path), nil
 }
 
 func (m *memFS) Lstat(path string) (fs.FileInfo, error) {
-	node, err := m.getNode(path)
+	node, err := m.lgetNode(path)
 	if err != nil {
 		return nil, err
 	}
@@ -188,6 +215,12 @@ func (m *memFS) Open(name string) (fs.File, error) {
 }
 
 func (m *memFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	return m.openFile(name, flag, perm, 0)
+}
+
+// openFile is OpenFile, where links is how many symlinks were followed to
+// get to the name.
+func (m *memFS) openFile(name string, flag int, perm fs.FileMode, links int) (File, error) {
 	parent := filepath.Dir(name)
 	base := filepath.Base(name)
 	parentAnode, err := m.getNode(parent)
@@ -220,11 +253,14 @@ func (m *memFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error)
 	}
 	// what if it is a symlink? Follow the symlink
 	if anode.mode&os.ModeSymlink != 0 {
+		if links++; links > maxSymlinks {
+			return nil, unix.ELOOP
+		}
 		linkTarget := anode.linkTarget
 		if !filepath.IsAbs(linkTarget) {
-			linkTarget = filepath.Join(parent, linkTarget)
+			linkTarget = filepath.Join(pathSep, parent, linkTarget)
 		}
-		return m.OpenFile(linkTarget, flag, perm)
+		return m.openFile(linkTarget, flag, perm, links)
 	}
 
 	return newMemFile(anode, name, m, flag), nil
@@ -255,6 +291,18 @@ func (m *memFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
 	return nil
 }
 
+func (m *memFS) WriteFileReference(name string, ref FileReference, mode fs.FileMode) error {
+	if ref.Offset < 0 || ref.Size < 0 {
+		return fmt.Errorf("invalid reference to %d bytes at %d of %s", ref.Size, ref.Offset, ref.Path)
+	}
+	f, err := m.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	f.(*memFile).node.ref = &ref
+	return f.Close()
+}
+
 func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
 	anode, err := m.getNode(name)
 	if err != nil {
@@ -267,6 +315,8 @@ func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
 	for name, node := range anode.children {
 		de = append(de, fs.FileInfoToDirEntry(node.fileInfo(name)))
 	}
+	// the children are in a map, which has no order
+	sort.Slice(de, func(i, j int) bool { return de[i].Name() < de[j].Name() })
 	return de, nil
 }
 
@@ -284,9 +334,19 @@ func (m *memFS) Mknod(path string, mode uint32, dev int) error {
 	if _, ok := anode.children[base]; ok {
 		return os.ErrExist
 	}
+	var ftype fs.FileMode
+	switch mode & unix.S_IFMT {
+	case unix.S_IFBLK:
+		ftype = os.ModeDevice
+	case unix.S_IFIFO:
+		ftype = os.ModeNamedPipe
+	default:
+		// character devices, which used to be the only kind supported, are the default
+		ftype = os.ModeDevice | os.ModeCharDevice
+	}
 	anode.children[base] = &node{
 		name:       base,
-		mode:       fs.FileMode(mode) | os.ModeCharDevice | os.ModeDevice,
+		mode:       fs.FileMode(mode)&fs.ModePerm | ftype,
 		modTime:    time.Now(),
 		createTime: time.Now(),
 		major:      unix.Major(uint64(dev)),
@@ -296,6 +356,10 @@ func (m *memFS) Mknod(path string, mode uint32, dev int) error {
 	return nil
 }
 
+func (m *memFS) Mkfifo(path string, perm fs.FileMode) error {
+	return m.Mknod(path, unix.S_IFIFO|uint32(perm.Perm()), 0)
+}
+
 func (m *memFS) Readnod(path string) (dev int, err error) {
 	parent := filepath.Dir(path)
 	base := filepath.Base(path)
@@ -307,7 +371,7 @@ func (m *memFS) Readnod(path string) (dev int, err error) {
 	if !ok {
 		return 0, os.ErrNotExist
 	}
-	if anode.mode&os.ModeDevice != os.ModeDevice || anode.mode&os.ModeCharDevice != os.ModeCharDevice {
+	if anode.mode&os.ModeDevice != os.ModeDevice {
 		return 0, fmt.Errorf("not a device")
 	}
 	return int(unix.Mkdev(anode.major, anode.minor)), nil
@@ -332,6 +396,73 @@ func (m *memFS) Chown(path string, uid int, gid int) error {
 	return nil
 }
 
+func (m *memFS) Lchown(path string, uid int, gid int) error {
+	anode, err := m.lgetNode(path)
+	if err != nil {
+		return err
+	}
+	anode.uid = uid
+	anode.gid = gid
+	return nil
+}
+
+func (m *memFS) SetModTime(path string, mtime time.Time) error {
+	anode, err := m.lgetNode(path)
+	if err != nil {
+		return err
+	}
+	anode.modTime = mtime
+	return nil
+}
+
+func (m *memFS) SetXattr(path string, attr string, data []byte) error {
+	anode, err := m.getNode(path)
+	if err != nil {
+		return err
+	}
+	if anode.xattrs == nil {
+		anode.xattrs = map[string][]byte{}
+	}
+	anode.xattrs[attr] = append([]byte{}, data...)
+	return nil
+}
+
+func (m *memFS) GetXattr(path string, attr string) ([]byte, error) {
+	anode, err := m.getNode(path)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := anode.xattrs[attr]
+	if !ok {
+		return nil, unix.ENODATA
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (m *memFS) RemoveXattr(path string, attr string) error {
+	anode, err := m.getNode(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := anode.xattrs[attr]; !ok {
+		return unix.ENODATA
+	}
+	delete(anode.xattrs, attr)
+	return nil
+}
+
+func (m *memFS) ListXattrs(path string) (map[string][]byte, error) {
+	anode, err := m.getNode(path)
+	if err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte, len(anode.xattrs))
+	for attr, data := range anode.xattrs {
+		xattrs[attr] = append([]byte{}, data...)
+	}
+	return xattrs, nil
+}
+
 func (m *memFS) Create(name string) (File, error) {
 	return m.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
 }
@@ -346,10 +477,12 @@ func (m *memFS) Symlink(oldname, newname string) error {
 	if _, ok := anode.children[base]; ok {
 		return os.ErrExist
 	}
+	// the target is kept as is, even if it does not exist (yet)
 	anode.children[base] = &node{
 		name:       base,
 		mode:       0777 | os.ModeSymlink,
 		modTime:    time.Now(),
+		createTime: time.Now(),
 		linkTarget: oldname,
 	}
 	return nil
@@ -375,16 +508,10 @@ func (m *memFS) Link(oldname, newname string) error {
 }
 
 func (m *memFS) Readlink(name string) (target string, err error) {
-	parent := filepath.Dir(name)
-	base := filepath.Base(name)
-	parentNode, err := m.getNode(parent)
+	anode, err := m.lgetNode(name)
 	if err != nil {
 		return "", err
 	}
-	anode, ok := parentNode.children[base]
-	if !ok {
-		return "", os.ErrNotExist
-	}
 	if anode.mode&os.ModeSymlink == 0 {
 		return "", fmt.Errorf("file is not a link")
 	}
@@ -401,8 +528,11 @@ func (m *memFS) Remove(name string) error {
 	if _, ok := anode.children[base]; !ok {
 		return os.ErrNotExist
 	}
-	if anode.children[base].linkCount > 0 {
-		anode.children[base].linkCount--
+	if child := anode.children[base]; child.linkCount > 0 {
+		child.linkCount--
+	} else {
+		m.used -= int64(len(child.data))
+		child.dropSpill()
 	}
 	delete(anode.children, base)
 	return nil
@@ -414,6 +544,8 @@ type memFile struct {
 	name     string
 	offset   int64
 	openMode int
+	// source is the file with the referenced content, once read from
+	source *os.File
 }
 
 func newMemFile(node *node, name string, fs *memFS, openMode int) *memFile {
@@ -424,10 +556,13 @@ func newMemFile(node *node, name string, fs *memFS, openMode int) *memFile {
 		openMode: openMode,
 	}
 	if openMode&os.O_APPEND != 0 {
-		m.offset = int64(len(node.data))
+		m.offset = node.size()
 	}
 	if openMode&os.O_TRUNC != 0 {
+		fs.used -= int64(len(node.data))
+		node.dropSpill()
 		node.data = nil
+		node.ref = nil
 	}
 	return m
 }
@@ -443,32 +578,63 @@ func (f *memFile) Close() error {
 	if f.node == nil || f.fs == nil {
 		return os.ErrClosed
 	}
+	var err error
+	if f.openMode&(os.O_WRONLY|os.O_RDWR) != 0 {
+		err = f.fs.spill(f.node)
+	}
 	f.fs = nil
 	f.node = nil
-	return nil
+	if f.source != nil {
+		if cerr := f.source.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 func (f *memFile) Read(b []byte) (int, error) {
 	if f.node == nil || f.fs == nil {
 		return 0, os.ErrClosed
 	}
-	if f.offset >= int64(len(f.node.data)) {
-		return 0, io.EOF
-	}
-	n := copy(b, f.node.data[f.offset:])
+	n, err := f.readAt(b, f.offset)
 	f.offset += int64(n)
-	return n, nil
+	return n, err
 }
 
 func (f *memFile) ReadAt(p []byte, off int64) (n int, err error) {
 	if f.node == nil || f.fs == nil {
 		return 0, os.ErrClosed
 	}
-	if off >= int64(len(f.node.data)) {
+	return f.readAt(p, off)
+}
+
+// readAt reads the content in memory, or else the referenced one.
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	ref := f.node.ref
+	if ref == nil {
+		if off >= int64(len(f.node.data)) {
+			return 0, io.EOF
+		}
+		return copy(p, f.node.data[off:]), nil
+	}
+	if off >= ref.Size {
 		return 0, io.EOF
 	}
-	n = copy(p, f.node.data[off:])
-	return n, nil
+	if f.source == nil {
+		source, err := os.Open(ref.Path)
+		if err != nil {
+			return 0, err
+		}
+		f.source = source
+	}
+	if int64(len(p)) > ref.Size-off {
+		p = p[:ref.Size-off]
+	}
+	n, err := f.source.ReadAt(p, ref.Offset+off)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
 }
 func (f *memFile) Seek(offset int64, whence int) (int64, error) {
 	if f.node == nil || f.fs == nil {
@@ -480,7 +646,7 @@ func (f *memFile) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekCurrent:
 		f.offset += offset
 	case io.SeekEnd:
-		f.offset = int64(len(f.node.data)) + offset
+		f.offset = f.node.size() + offset
 	default:
 		return 0, errors.New("invalid whence")
 	}
@@ -494,11 +660,20 @@ func (f *memFile) Write(p []byte) (n int, err error) {
 	if f.openMode&os.O_APPEND != 0 && f.openMode&os.O_RDWR != 0 && f.openMode&os.O_WRONLY != 0 {
 		return 0, errors.New("file not opened in write mode")
 	}
+	before := int64(len(f.node.data))
+	if err := f.node.materialize(); err != nil {
+		return 0, err
+	}
+	if f.offset > int64(len(f.node.data)) {
+		// writing past the end leaves zeros in between
+		f.node.data = append(f.node.data, make([]byte, f.offset-int64(len(f.node.data)))...)
+	}
 	if f.offset+int64(len(p)) > int64(len(f.node.data)) {
 		f.node.data = append(f.node.data[:f.offset], p...)
 	} else {
 		copy(f.node.data[f.offset:], p)
 	}
+	f.fs.used += int64(len(f.node.data)) - before
 	f.offset += int64(len(p))
 	return len(p), nil
 }
@@ -514,7 +689,47 @@ type node struct {
 	linkTarget   string
 	linkCount    int // extra links, so 0 means a single pointer. O-based, like most compuuter counting systems.
 	major, minor uint32
+	xattrs       map[string][]byte
 	children     map[string]*node
+	// ref is where the content is, if it is not in data, until it is written to
+	ref *FileReference
+	// spilled is set if ref is a file of its own, written to save memory
+	spilled bool
+}
+
+func (n *node) size() int64 {
+	if n.ref != nil {
+		return n.ref.Size
+	}
+	return int64(len(n.data))
+}
+
+// materialize reads the referenced content into memory, to modify it.
+func (n *node) materialize() error {
+	if n.ref == nil {
+		return nil
+	}
+	f, err := os.Open(n.ref.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data := make([]byte, n.ref.Size)
+	if _, err := f.ReadAt(data, n.ref.Offset); err != nil && !(errors.Is(err, io.EOF) && len(data) == 0) {
+		return fmt.Errorf("reading %d bytes at %d of %s: %w", n.ref.Size, n.ref.Offset, n.ref.Path, err)
+	}
+	n.dropSpill()
+	n.data, n.ref = data, nil
+	return nil
+}
+
+// dropSpill removes the file the content was spilled to, if any, once the
+// node no longer references it.
+func (n *node) dropSpill() {
+	if n.spilled {
+		_ = os.Remove(n.ref.Path)
+		n.spilled = false
+	}
 }
 
 func (n *node) fileInfo(name string) fs.FileInfo {
@@ -533,7 +748,11 @@ func (m *memFileInfo) Name() string {
 	return m.name
 }
 func (m *memFileInfo) Size() int64 {
-	return int64(len(m.data))
+	// as with lstat(2), the size of a symlink is the length of its target
+	if m.mode&fs.ModeSymlink != 0 {
+		return int64(len(m.linkTarget))
+	}
+	return m.size()
 }
 func (m *memFileInfo) Mode() fs.FileMode {
 	return m.mode
@@ -545,9 +764,14 @@ func (m *memFileInfo) IsDir() bool {
 	return m.dir
 }
 func (m *memFileInfo) Sys() any {
-	return &tar.Header{
+	hdr := &tar.Header{
 		Mode: int64(m.mode),
 		Uid:  m.uid,
 		Gid:  m.gid,
 	}
+	if m.mode&fs.ModeSymlink != 0 {
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = m.linkTarget
+	}
+	return hdr
 }
@@ -1,11 +1,15 @@
 package fs
 
 import (
+	"archive/tar"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 func TestMemFSMkdir(t *testing.T) {
@@ -199,6 +203,119 @@ func TestMemFSSymlink(t *testing.T) {
 	require.NoError(t, err, "error reading target of link file %s", link)
 	require.Equal(t, target, actualTarget, "target of %s should be %s", link, target)
 }
+func TestMemFSSymlinkLstat(t *testing.T) {
+	m := NewMemFS()
+	require.NoError(t, m.MkdirAll("usr/lib", 0o755))
+	require.NoError(t, m.WriteFile("usr/lib/libfoo.so.1", []byte("foo"), 0o644))
+	require.NoError(t, m.Symlink("libfoo.so.1", "usr/lib/libfoo.so"))
+	require.NoError(t, m.Symlink("../../../usr/lib/libfoo.so.1", "usr/lib/above"))
+	require.NoError(t, m.Symlink("missing", "usr/lib/dangling"))
+	require.NoError(t, m.Symlink("loop2", "usr/lib/loop1"))
+	require.NoError(t, m.Symlink("loop1", "usr/lib/loop2"))
+
+	t.Run("relative", func(t *testing.T) {
+		fi, err := m.Lstat("usr/lib/libfoo.so")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+		require.Equal(t, int64(len("libfoo.so.1")), fi.Size())
+		fi, err = m.Stat("usr/lib/libfoo.so")
+		require.NoError(t, err)
+		require.True(t, fi.Mode().IsRegular())
+		b, err := m.ReadFile("usr/lib/libfoo.so")
+		require.NoError(t, err)
+		require.Equal(t, "foo", string(b))
+	})
+	t.Run("above the root", func(t *testing.T) {
+		b, err := m.ReadFile("usr/lib/above")
+		require.NoError(t, err)
+		require.Equal(t, "foo", string(b))
+	})
+	t.Run("dangling", func(t *testing.T) {
+		fi, err := m.Lstat("usr/lib/dangling")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+		target, err := m.Readlink("usr/lib/dangling")
+		require.NoError(t, err)
+		require.Equal(t, "missing", target)
+		_, err = m.Stat("usr/lib/dangling")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+	t.Run("loop", func(t *testing.T) {
+		_, err := m.Stat("usr/lib/loop1")
+		require.Error(t, err)
+		_, err = m.ReadFile("usr/lib/loop1")
+		require.Error(t, err)
+		_, err = m.Lstat("usr/lib/loop1")
+		require.NoError(t, err)
+	})
+	t.Run("directory entries", func(t *testing.T) {
+		entries, err := m.ReadDir("usr/lib")
+		require.NoError(t, err)
+		types := map[string]fs.FileMode{}
+		for _, e := range entries {
+			types[e.Name()] = e.Type()
+		}
+		require.Equal(t, fs.ModeSymlink, types["libfoo.so"])
+		require.Equal(t, fs.ModeSymlink, types["dangling"])
+		require.Equal(t, fs.FileMode(0), types["libfoo.so.1"])
+	})
+}
+
+func TestMemFSLchown(t *testing.T) {
+	m := NewMemFS()
+	require.NoError(t, m.WriteFile("target", []byte("foo"), 0o644))
+	require.NoError(t, m.Symlink("target", "link"))
+	require.NoError(t, m.Lchown("link", 10, 20))
+
+	fi, err := m.Lstat("link")
+	require.NoError(t, err)
+	hdr := fi.Sys().(*tar.Header)
+	require.Equal(t, 10, hdr.Uid)
+	require.Equal(t, 20, hdr.Gid)
+
+	// the target keeps its owner
+	fi, err = m.Stat("target")
+	require.NoError(t, err)
+	hdr = fi.Sys().(*tar.Header)
+	require.Equal(t, 0, hdr.Uid)
+	require.Equal(t, 0, hdr.Gid)
+}
+
+func TestMemFSFileReference(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "data.tar")
+	require.NoError(t, os.WriteFile(source, []byte("headerfoobartrailer"), 0o600))
+
+	m := NewMemFS()
+	ref := FileReference{Path: source, Offset: 6, Size: 6}
+	require.NoError(t, m.(ReferenceFS).WriteFileReference("foo", ref, 0o644))
+	require.NoError(t, m.Link("foo", "bar"))
+
+	fi, err := m.Stat("foo")
+	require.NoError(t, err)
+	require.Equal(t, int64(6), fi.Size())
+	b, err := m.ReadFile("bar")
+	require.NoError(t, err)
+	require.Equal(t, "foobar", string(b))
+
+	// writing copies the content, leaving the source alone
+	f, err := m.OpenFile("foo", os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("F"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	b, err = m.ReadFile("bar")
+	require.NoError(t, err)
+	require.Equal(t, "Foobar", string(b))
+	b, err = os.ReadFile(source)
+	require.NoError(t, err)
+	require.Equal(t, "headerfoobartrailer", string(b))
+
+	// a reference past the end of the source fails to read
+	require.NoError(t, m.(ReferenceFS).WriteFileReference("short", FileReference{Path: source, Offset: 16, Size: 6}, 0o644))
+	_, err = m.ReadFile("short")
+	require.Error(t, err)
+}
+
 func TestMemFSHardlink(t *testing.T) {
 	var (
 		m           = NewMemFS()
@@ -298,3 +415,77 @@ func TestMemFSMidLevelSymlink(t *testing.T) {
 		require.Equal(t, truedir, actualTarget, "target of %s should be %s", fullLinkdir, truedir)
 	})
 }
+
+func TestMemFSXattrs(t *testing.T) {
+	m := NewMemFS()
+	require.NoError(t, m.MkdirAll("bin", 0755))
+	require.NoError(t, m.WriteFile("bin/ping", []byte("ping"), 0755))
+	require.NoError(t, m.Link("bin/ping", "bin/ping6"))
+
+	capability := []byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x20, 0x00, 0x00}
+	require.NoError(t, m.SetXattr("bin/ping", "security.capability", capability))
+	require.NoError(t, m.SetXattr("bin/ping", "user.comment", []byte("hello")))
+
+	data, err := m.GetXattr("bin/ping", "security.capability")
+	require.NoError(t, err)
+	require.Equal(t, capability, data)
+
+	// hardlinks share their attributes
+	xattrs, err := m.ListXattrs("bin/ping6")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"security.capability": capability, "user.comment": []byte("hello")}, xattrs)
+
+	require.NoError(t, m.RemoveXattr("bin/ping", "user.comment"))
+	_, err = m.GetXattr("bin/ping", "user.comment")
+	require.Error(t, err)
+	require.Error(t, m.RemoveXattr("bin/ping", "user.comment"))
+	_, err = m.ListXattrs("bin/missing")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestMemFSSpecialFiles(t *testing.T) {
+	m := NewMemFS()
+	require.NoError(t, m.MkdirAll("dev", 0755))
+
+	require.NoError(t, m.Mknod("dev/null", unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))))
+	require.NoError(t, m.Mknod("dev/loop0", unix.S_IFBLK|0660, int(unix.Mkdev(7, 0))))
+	require.NoError(t, m.Mkfifo("dev/initctl", 0600))
+
+	for _, tt := range []struct {
+		name string
+		mode os.FileMode
+		dev  int
+	}{
+		{"dev/null", os.ModeDevice | os.ModeCharDevice | 0666, int(unix.Mkdev(1, 3))},
+		{"dev/loop0", os.ModeDevice | 0660, int(unix.Mkdev(7, 0))},
+		{"dev/initctl", os.ModeNamedPipe | 0600, -1},
+	} {
+		fi, err := m.Stat(tt.name)
+		require.NoError(t, err)
+		require.Equal(t, tt.mode, fi.Mode(), "mode of %s", tt.name)
+		dev, err := m.Readnod(tt.name)
+		if tt.dev < 0 {
+			require.Error(t, err, "pipe %s is not a device", tt.name)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tt.dev, dev, "device of %s", tt.name)
+	}
+}
+
+func TestMemFSWritePastEnd(t *testing.T) {
+	m := NewMemFS()
+	f, err := m.OpenFile("sparse", os.O_CREATE|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("a"))
+	require.NoError(t, err)
+	_, err = f.Seek(4, io.SeekCurrent)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("b"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	b, err := m.ReadFile("sparse")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a\x00\x00\x00\x00b"), b)
+}
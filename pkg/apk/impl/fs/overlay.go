@@ -0,0 +1,578 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// WhiteoutPrefix marks, in the upper filesystem of an overlay, a file
+	// removed from the lower one, as in OCI image layers: .wh.foo hides foo.
+	WhiteoutPrefix = ".wh."
+	// OpaqueWhiteout marks, in the upper filesystem of an overlay, a directory
+	// whose contents in the lower one are hidden.
+	OpaqueWhiteout = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+type overlayFS struct {
+	lower FullFS
+	upper FullFS
+}
+
+// OverlayFS returns a filesystem with the files of upper over those of lower,
+// e.g. an image being built over a base image, or over a root filesystem kept
+// from an earlier build, without copying it. Changes only go to upper: files
+// of lower are copied up before being modified, and removing them leaves
+// whiteouts in upper, as OCI image layers do, so that upper on its own is the
+// difference to lower. Whiteouts are not listed in the overlay.
+func OverlayFS(lower, upper FullFS) FullFS {
+	return &overlayFS{lower: lower, upper: upper}
+}
+
+// clean returns the name relative to the root, "." for the root itself.
+func clean(name string) string {
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return "."
+	}
+	return p[1:]
+}
+
+func whiteout(name string) string {
+	return path.Join(path.Dir(name), WhiteoutPrefix+path.Base(name))
+}
+
+func exists(fsys FullFS, name string) bool {
+	_, err := fsys.Lstat(name)
+	return err == nil
+}
+
+// inLower reports whether the overlay shows the file of lower, which is
+// neither removed nor in a directory replaced in upper.
+func (o *overlayFS) inLower(name string) bool {
+	if name != "." {
+		dir := "."
+		for _, part := range strings.Split(name, "/") {
+			if exists(o.upper, path.Join(dir, OpaqueWhiteout)) || exists(o.upper, path.Join(dir, WhiteoutPrefix+part)) {
+				return false
+			}
+			dir = path.Join(dir, part)
+		}
+	}
+	return exists(o.lower, name)
+}
+
+// layer returns the filesystem with the file, or nil if there is none. The
+// name has no symlinks but the last element, as returned by resolve.
+func (o *overlayFS) layer(name string) FullFS {
+	if exists(o.upper, name) {
+		return o.upper
+	}
+	if o.inLower(name) {
+		return o.lower
+	}
+	return nil
+}
+
+// resolve returns the name without any symlinks, but for the last element
+// unless followLast, even if they point from one filesystem to the other,
+// e.g. lib -> usr/lib in lower with the files of usr/lib in upper. The last
+// element may not exist.
+func (o *overlayFS) resolve(name string, followLast bool) (string, error) {
+	parts := strings.Split(clean(name), "/")
+	resolved := "."
+	links := 0
+	for i := 0; i < len(parts); i++ {
+		if parts[i] == "." {
+			continue
+		}
+		next := path.Join(resolved, parts[i])
+		last := i == len(parts)-1
+		if last && !followLast {
+			return next, nil
+		}
+		l := o.layer(next)
+		if l == nil {
+			if last {
+				return next, nil
+			}
+			return "", fs.ErrNotExist
+		}
+		fi, err := l.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", unix.ELOOP
+		}
+		target, err := l.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		// joining to the root keeps ../ from going above it
+		if !path.IsAbs(target) {
+			target = path.Join("/", resolved, target)
+		}
+		parts = append(strings.Split(clean(target), "/"), parts[i+1:]...)
+		resolved, i = ".", -1
+	}
+	return resolved, nil
+}
+
+// find returns the filesystem with the file and its name there.
+func (o *overlayFS) find(op, name string, followLast bool) (FullFS, string, error) {
+	r, err := o.resolve(name, followLast)
+	if err != nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	l := o.layer(r)
+	if l == nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return l, r, nil
+}
+
+// copyUp copies the file, and the directories above it, from lower to upper,
+// unless upper has it already.
+func (o *overlayFS) copyUp(name string) error {
+	if exists(o.upper, name) {
+		return nil
+	}
+	if err := o.copyUp(path.Dir(name)); err != nil {
+		return err
+	}
+	fi, err := o.lower.Lstat(name)
+	if err != nil {
+		return err
+	}
+	mode := fi.Mode()
+	switch {
+	case mode.IsDir():
+		err = o.upper.Mkdir(name, mode.Perm())
+	case mode&fs.ModeSymlink != 0:
+		var target string
+		if target, err = o.lower.Readlink(name); err == nil {
+			err = o.upper.Symlink(target, name)
+		}
+	case mode&fs.ModeNamedPipe != 0:
+		err = o.upper.Mkfifo(name, mode.Perm())
+	case mode&fs.ModeDevice != 0:
+		var dev int
+		if dev, err = o.lower.Readnod(name); err == nil {
+			kind := uint32(unix.S_IFBLK)
+			if mode&fs.ModeCharDevice != 0 {
+				kind = unix.S_IFCHR
+			}
+			err = o.upper.Mknod(name, kind|uint32(mode.Perm()), dev)
+		}
+	case mode.IsRegular():
+		var b []byte
+		if b, err = o.lower.ReadFile(name); err == nil {
+			err = o.upper.WriteFile(name, b, mode.Perm())
+		}
+	default:
+		err = fmt.Errorf("unsupported file type %v", mode.Type())
+	}
+	if err != nil {
+		return fmt.Errorf("copying up %s: %w", name, err)
+	}
+	if err := o.upper.SetModTime(name, fi.ModTime()); err != nil {
+		return err
+	}
+
+	if mode&fs.ModeSymlink != 0 {
+		if hdr, ok := fi.Sys().(*tar.Header); ok {
+			return o.upper.Lchown(name, hdr.Uid, hdr.Gid)
+		}
+		return nil
+	}
+	if err := o.upper.Chmod(name, mode.Perm()); err != nil {
+		return err
+	}
+	if hdr, ok := fi.Sys().(*tar.Header); ok {
+		if err := o.upper.Chown(name, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	xattrs, err := o.lower.ListXattrs(name)
+	if err != nil {
+		return err
+	}
+	for attr, data := range xattrs {
+		if err := o.upper.SetXattr(name, attr, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepare readies upper to create the file, which does not exist in the
+// overlay, and reports whether it replaces one removed from lower.
+func (o *overlayFS) prepare(name string) (bool, error) {
+	if err := o.copyUp(path.Dir(name)); err != nil {
+		return false, err
+	}
+	wh := whiteout(name)
+	if !exists(o.upper, wh) {
+		return false, nil
+	}
+	return true, o.upper.Remove(wh)
+}
+
+// create resolves the name of a file to create, which must not exist yet,
+// and readies upper for it.
+func (o *overlayFS) create(op, name string) (string, bool, error) {
+	r, err := o.resolve(name, false)
+	if err != nil {
+		return "", false, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if o.layer(r) != nil {
+		return "", false, &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+	replaced, err := o.prepare(r)
+	return r, replaced, err
+}
+
+// modify returns the name in upper of the file to modify, copying it up.
+func (o *overlayFS) modify(op, name string, followLast bool) (string, error) {
+	_, r, err := o.find(op, name, followLast)
+	if err != nil {
+		return "", err
+	}
+	return r, o.copyUp(r)
+}
+
+func (o *overlayFS) Mkdir(name string, perm fs.FileMode) error {
+	r, replaced, err := o.create("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if err := o.upper.Mkdir(r, perm); err != nil {
+		return err
+	}
+	if replaced {
+		// the new directory has none of the files of the removed one
+		return o.upper.WriteFile(path.Join(r, OpaqueWhiteout), nil, 0o644)
+	}
+	return nil
+}
+
+func (o *overlayFS) MkdirAll(name string, perm fs.FileMode) error {
+	dir := "."
+	for _, part := range strings.Split(clean(name), "/") {
+		dir = path.Join(dir, part)
+		fi, err := o.Stat(dir)
+		switch {
+		case err == nil && !fi.IsDir():
+			return fmt.Errorf("path is not a directory")
+		case err == nil:
+		case errors.Is(err, fs.ErrNotExist):
+			if err := o.Mkdir(dir, perm); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	l, r, err := o.find("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return l.Open(r)
+}
+
+func (o *overlayFS) OpenReaderAt(name string) (File, error) {
+	l, r, err := o.find("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return l.OpenReaderAt(r)
+}
+
+func (o *overlayFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		l, r, err := o.find("open", name, true)
+		if err != nil {
+			return nil, err
+		}
+		return l.OpenFile(r, flag, perm)
+	}
+	r, err := o.resolve(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	switch o.layer(r) {
+	case o.upper:
+	case o.lower:
+		if err := o.copyUp(r); err != nil {
+			return nil, err
+		}
+	default:
+		if flag&os.O_CREATE == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		if _, err := o.prepare(r); err != nil {
+			return nil, err
+		}
+	}
+	return o.upper.OpenFile(r, flag, perm)
+}
+
+func (o *overlayFS) ReadFile(name string) ([]byte, error) {
+	l, r, err := o.find("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return l.ReadFile(r)
+}
+
+func (o *overlayFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
+	f, err := o.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	return err
+}
+
+// ReadDir lists the files of upper and those of lower which are not removed
+// or replaced, sorted by name.
+func (o *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	r, err := o.resolve(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	var (
+		entries = map[string]fs.DirEntry{}
+		hidden  = map[string]bool{}
+		opaque  bool
+	)
+	switch o.layer(r) {
+	case nil:
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	case o.upper:
+		upper, err := o.upper.ReadDir(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range upper {
+			switch n := e.Name(); {
+			case n == OpaqueWhiteout:
+				opaque = true
+			case strings.HasPrefix(n, WhiteoutPrefix):
+				hidden[strings.TrimPrefix(n, WhiteoutPrefix)] = true
+			default:
+				entries[n] = e
+			}
+		}
+	}
+	if !opaque && o.inLower(r) {
+		if fi, err := o.lower.Stat(r); err == nil && fi.IsDir() {
+			lower, err := o.lower.ReadDir(r)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range lower {
+				if _, ok := entries[e.Name()]; !ok && !hidden[e.Name()] {
+					entries[e.Name()] = e
+				}
+			}
+		}
+	}
+	de := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		de = append(de, e)
+	}
+	sort.Slice(de, func(i, j int) bool { return de[i].Name() < de[j].Name() })
+	return de, nil
+}
+
+func (o *overlayFS) Mknod(name string, mode uint32, dev int) error {
+	r, _, err := o.create("mknod", name)
+	if err != nil {
+		return err
+	}
+	return o.upper.Mknod(r, mode, dev)
+}
+
+func (o *overlayFS) Mkfifo(name string, perm fs.FileMode) error {
+	r, _, err := o.create("mkfifo", name)
+	if err != nil {
+		return err
+	}
+	return o.upper.Mkfifo(r, perm)
+}
+
+func (o *overlayFS) Readnod(name string) (int, error) {
+	l, r, err := o.find("readnod", name, true)
+	if err != nil {
+		return 0, err
+	}
+	return l.Readnod(r)
+}
+
+func (o *overlayFS) Symlink(oldname, newname string) error {
+	r, _, err := o.create("symlink", newname)
+	if err != nil {
+		return err
+	}
+	return o.upper.Symlink(oldname, r)
+}
+
+// Link hardlinks the files in upper, copying up the target if it is in lower.
+func (o *overlayFS) Link(oldname, newname string) error {
+	target, err := o.modify("link", oldname, true)
+	if err != nil {
+		return err
+	}
+	r, _, err := o.create("link", newname)
+	if err != nil {
+		return err
+	}
+	return o.upper.Link(target, r)
+}
+
+func (o *overlayFS) Readlink(name string) (string, error) {
+	l, r, err := o.find("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	return l.Readlink(r)
+}
+
+func (o *overlayFS) Stat(name string) (fs.FileInfo, error) {
+	l, r, err := o.find("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return l.Lstat(r)
+}
+
+func (o *overlayFS) Lstat(name string) (fs.FileInfo, error) {
+	l, r, err := o.find("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return l.Lstat(r)
+}
+
+func (o *overlayFS) Create(name string) (File, error) {
+	return o.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
+}
+
+// Remove removes the file from upper, and leaves a whiteout in its place if
+// lower has it as well.
+func (o *overlayFS) Remove(name string) error {
+	l, r, err := o.find("remove", name, false)
+	if err != nil {
+		return err
+	}
+	if l == o.upper {
+		if err := o.upper.Remove(r); err != nil {
+			return err
+		}
+	}
+	if !o.inLower(r) {
+		return nil
+	}
+	if err := o.copyUp(path.Dir(r)); err != nil {
+		return err
+	}
+	return o.upper.WriteFile(whiteout(r), nil, 0o644)
+}
+
+func (o *overlayFS) Chmod(name string, perm fs.FileMode) error {
+	r, err := o.modify("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.Chmod(r, perm)
+}
+
+func (o *overlayFS) Chown(name string, uid, gid int) error {
+	r, err := o.modify("chown", name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.Chown(r, uid, gid)
+}
+
+func (o *overlayFS) Lchown(name string, uid, gid int) error {
+	r, err := o.modify("lchown", name, false)
+	if err != nil {
+		return err
+	}
+	return o.upper.Lchown(r, uid, gid)
+}
+
+func (o *overlayFS) SetModTime(name string, mtime time.Time) error {
+	r, err := o.modify("setmodtime", name, false)
+	if err != nil {
+		return err
+	}
+	return o.upper.SetModTime(r, mtime)
+}
+
+func (o *overlayFS) SetXattr(name, attr string, data []byte) error {
+	r, err := o.modify("setxattr", name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.SetXattr(r, attr, data)
+}
+
+func (o *overlayFS) GetXattr(name, attr string) ([]byte, error) {
+	l, r, err := o.find("getxattr", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return l.GetXattr(r, attr)
+}
+
+func (o *overlayFS) RemoveXattr(name, attr string) error {
+	r, err := o.modify("removexattr", name, true)
+	if err != nil {
+		return err
+	}
+	return o.upper.RemoveXattr(r, attr)
+}
+
+func (o *overlayFS) ListXattrs(name string) (map[string][]byte, error) {
+	l, r, err := o.find("listxattr", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return l.ListXattrs(r)
+}
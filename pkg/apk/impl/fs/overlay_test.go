@@ -0,0 +1,147 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testOverlayLower(t *testing.T) FullFS {
+	lower := NewMemFS()
+	require.NoError(t, lower.MkdirAll("usr/lib", 0o755))
+	require.NoError(t, lower.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, lower.Symlink("usr/lib", "lib"))
+	require.NoError(t, lower.WriteFile("usr/lib/libc.so", []byte("libc"), 0o755))
+	require.NoError(t, lower.WriteFile("etc/os-release", []byte("ID=base"), 0o644))
+	require.NoError(t, lower.WriteFile("etc/apk/world", []byte("base"), 0o644))
+	require.NoError(t, lower.Chown("etc/os-release", 10, 20))
+	return lower
+}
+
+func readDirNames(t *testing.T, fsys FullFS, name string) []string {
+	entries, err := fsys.ReadDir(name)
+	require.NoError(t, err)
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestOverlayRead(t *testing.T) {
+	lower := testOverlayLower(t)
+	upper := NewMemFS()
+	require.NoError(t, upper.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, upper.WriteFile("usr/bin/sh", []byte("sh"), 0o755))
+	o := OverlayFS(lower, upper)
+
+	b, err := o.ReadFile("etc/os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=base", string(b))
+	b, err = o.ReadFile("usr/bin/sh")
+	require.NoError(t, err)
+	require.Equal(t, "sh", string(b))
+	require.Equal(t, []string{"bin", "lib"}, readDirNames(t, o, "usr"))
+
+	fi, err := o.Lstat("lib")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+	b, err = o.ReadFile("lib/libc.so")
+	require.NoError(t, err)
+	require.Equal(t, "libc", string(b))
+
+	_, err = o.Stat("missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestOverlayCopyUp(t *testing.T) {
+	lower := testOverlayLower(t)
+	upper := NewMemFS()
+	o := OverlayFS(lower, upper)
+
+	require.NoError(t, o.WriteFile("etc/os-release", []byte("ID=image"), 0o644))
+	require.NoError(t, o.Chmod("usr/lib/libc.so", 0o700))
+	// writing through a symlink of lower lands where it points to in upper
+	require.NoError(t, o.WriteFile("lib/libfoo.so", []byte("foo"), 0o755))
+
+	b, err := o.ReadFile("etc/os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=image", string(b))
+	b, err = lower.ReadFile("etc/os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=base", string(b), "lower is never modified")
+
+	// the copy keeps the ownership of the original
+	fi, err := upper.Stat("etc/os-release")
+	require.NoError(t, err)
+	hdr := fi.Sys().(*tar.Header)
+	require.Equal(t, 10, hdr.Uid)
+	require.Equal(t, 20, hdr.Gid)
+
+	fi, err = o.Stat("usr/lib/libc.so")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o700), fi.Mode().Perm())
+	fi, err = lower.Stat("usr/lib/libc.so")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o755), fi.Mode().Perm())
+
+	b, err = upper.ReadFile("usr/lib/libfoo.so")
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(b))
+	require.Equal(t, []string{"libc.so", "libfoo.so"}, readDirNames(t, o, "lib"))
+}
+
+func TestOverlayRemove(t *testing.T) {
+	lower := testOverlayLower(t)
+	upper := NewMemFS()
+	o := OverlayFS(lower, upper)
+
+	require.NoError(t, o.Remove("etc/os-release"))
+	_, err := o.Stat("etc/os-release")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Equal(t, []string{"apk"}, readDirNames(t, o, "etc"))
+	_, err = lower.Stat("etc/os-release")
+	require.NoError(t, err, "lower is never modified")
+	// upper has the whiteout, as an image layer would
+	_, err = upper.Stat("etc/.wh.os-release")
+	require.NoError(t, err)
+
+	// creating it again drops the whiteout
+	require.NoError(t, o.WriteFile("etc/os-release", []byte("ID=image"), 0o644))
+	require.Equal(t, []string{"os-release"}, readDirNames(t, upper, "etc"))
+
+	// a directory made again is empty
+	require.NoError(t, o.Remove("etc/apk"))
+	require.NoError(t, o.Mkdir("etc/apk", 0o755))
+	require.Empty(t, readDirNames(t, o, "etc/apk"))
+	_, err = o.Stat("etc/apk/world")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = upper.Stat("etc/apk/.wh..wh..opq")
+	require.NoError(t, err)
+
+	require.ErrorIs(t, o.Remove("missing"), fs.ErrNotExist)
+}
+
+func TestOverlayCreateExisting(t *testing.T) {
+	o := OverlayFS(testOverlayLower(t), NewMemFS())
+	require.ErrorIs(t, o.Mkdir("etc", 0o755), fs.ErrExist)
+	require.ErrorIs(t, o.Symlink("usr/lib", "lib"), fs.ErrExist)
+	require.NoError(t, o.MkdirAll("etc/apk/keys", 0o755))
+	require.Equal(t, []string{"keys", "world"}, readDirNames(t, o, "etc/apk"))
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// ErrReadOnly is the error for changing a read-only filesystem.
+var ErrReadOnly = errors.New("filesystem is read-only")
+
+// readOnlyFS is a FullFS which refuses any change.
+type readOnlyFS struct {
+	fsys FullFS
+}
+
+// ReadOnlyFS returns a view of the filesystem which can be read, but not
+// changed, e.g. once the packages are installed, for what only reads it. Any
+// change fails with a *fs.PathError wrapping ErrReadOnly.
+func ReadOnlyFS(fsys FullFS) FullFS {
+	if ro, ok := fsys.(*readOnlyFS); ok {
+		return ro
+	}
+	return &readOnlyFS{fsys: fsys}
+}
+
+func readOnly(op, path string) error {
+	return &fs.PathError{Op: op, Path: path, Err: ErrReadOnly}
+}
+
+// readOnlyFile is a file of a read-only filesystem, which cannot be written
+// to either.
+type readOnlyFile struct {
+	File
+	name string
+}
+
+func (f *readOnlyFile) Write(p []byte) (int, error) {
+	return 0, readOnly("write", f.name)
+}
+
+func (r *readOnlyFS) Open(name string) (fs.File, error) {
+	return r.OpenReaderAt(name)
+}
+
+func (r *readOnlyFS) OpenReaderAt(name string) (File, error) {
+	f, err := r.fsys.OpenReaderAt(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyFile{File: f, name: name}, nil
+}
+
+func (r *readOnlyFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, readOnly("open", name)
+	}
+	return r.OpenReaderAt(name)
+}
+
+func (r *readOnlyFS) ReadFile(name string) ([]byte, error) { return r.fsys.ReadFile(name) }
+
+func (r *readOnlyFS) ReadDir(name string) ([]fs.DirEntry, error) { return r.fsys.ReadDir(name) }
+
+func (r *readOnlyFS) Readnod(name string) (int, error) { return r.fsys.Readnod(name) }
+
+func (r *readOnlyFS) Readlink(name string) (string, error) { return r.fsys.Readlink(name) }
+
+func (r *readOnlyFS) Stat(name string) (fs.FileInfo, error) { return r.fsys.Stat(name) }
+
+func (r *readOnlyFS) Lstat(name string) (fs.FileInfo, error) { return r.fsys.Lstat(name) }
+
+func (r *readOnlyFS) GetXattr(name, attr string) ([]byte, error) {
+	return r.fsys.GetXattr(name, attr)
+}
+
+func (r *readOnlyFS) ListXattrs(name string) (map[string][]byte, error) {
+	return r.fsys.ListXattrs(name)
+}
+
+func (r *readOnlyFS) Mkdir(name string, perm fs.FileMode) error { return readOnly("mkdir", name) }
+
+func (r *readOnlyFS) MkdirAll(name string, perm fs.FileMode) error { return readOnly("mkdir", name) }
+
+func (r *readOnlyFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
+	return readOnly("write", name)
+}
+
+func (r *readOnlyFS) Mknod(name string, mode uint32, dev int) error { return readOnly("mknod", name) }
+
+func (r *readOnlyFS) Mkfifo(name string, perm fs.FileMode) error { return readOnly("mkfifo", name) }
+
+func (r *readOnlyFS) Symlink(oldname, newname string) error { return readOnly("symlink", newname) }
+
+func (r *readOnlyFS) Link(oldname, newname string) error { return readOnly("link", newname) }
+
+func (r *readOnlyFS) Create(name string) (File, error) { return nil, readOnly("create", name) }
+
+func (r *readOnlyFS) Remove(name string) error { return readOnly("remove", name) }
+
+func (r *readOnlyFS) Chmod(name string, perm fs.FileMode) error { return readOnly("chmod", name) }
+
+func (r *readOnlyFS) Chown(name string, uid, gid int) error { return readOnly("chown", name) }
+
+func (r *readOnlyFS) Lchown(name string, uid, gid int) error { return readOnly("lchown", name) }
+
+func (r *readOnlyFS) SetModTime(name string, mtime time.Time) error {
+	return readOnly("setmodtime", name)
+}
+
+func (r *readOnlyFS) SetXattr(name, attr string, data []byte) error {
+	return readOnly("setxattr", name)
+}
+
+func (r *readOnlyFS) RemoveXattr(name, attr string) error {
+	return readOnly("removexattr", name)
+}
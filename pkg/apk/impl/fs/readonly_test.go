@@ -0,0 +1,59 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlyFS(t *testing.T) {
+	fsys := NewMemFS()
+	require.NoError(t, fsys.MkdirAll("etc", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/os-release", []byte("ID=test"), 0o644))
+	ro := ReadOnlyFS(fsys)
+
+	b, err := ro.ReadFile("etc/os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=test", string(b))
+	f, err := ro.Open("etc/os-release")
+	require.NoError(t, err)
+	b, err = io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "ID=test", string(b))
+	require.NoError(t, f.Close())
+	require.Equal(t, []string{"os-release"}, readDirNames(t, ro, "etc"))
+
+	require.ErrorIs(t, ro.WriteFile("etc/os-release", []byte("ID=other"), 0o644), ErrReadOnly)
+	require.ErrorIs(t, ro.Remove("etc/os-release"), ErrReadOnly)
+	require.ErrorIs(t, ro.Chmod("etc", 0o700), ErrReadOnly)
+	require.ErrorIs(t, ro.MkdirAll("usr/bin", 0o755), ErrReadOnly)
+	_, err = ro.OpenFile("etc/os-release", os.O_RDWR, 0o644)
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.EqualError(t, ro.Symlink("os-release", "etc/release"), "symlink etc/release: filesystem is read-only")
+
+	r, err := ro.OpenFile("etc/os-release", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	_, err = r.Write([]byte("x"))
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.NoError(t, r.Close())
+
+	b, err = fsys.ReadFile("etc/os-release")
+	require.NoError(t, err)
+	require.Equal(t, "ID=test", string(b), "unchanged")
+}
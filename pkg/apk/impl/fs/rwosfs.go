@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -31,6 +32,9 @@ type dirFSOpts struct {
 	caseSensitive    bool
 	caseSensitiveSet bool
 	mkdir            bool
+	uidMap, gidMap   map[int]int
+	fakerootDB       string
+	failOnCollision  bool
 }
 
 // DirFSOption is an option for DirFS
@@ -57,6 +61,18 @@ func WithCreateDir(createDir bool) DirFSOption {
 	}
 }
 
+// DirFSWithIDMap sets the owners to give files on disk for the ones asked for, e.g.
+// the subordinate ids of the user running an unprivileged build. Ids not in the maps
+// are used as they are. Either way, the filesystem reports the owners asked for, so
+// that they are what ends up in images.
+func DirFSWithIDMap(uids, gids map[int]int) DirFSOption {
+	return func(opts *dirFSOpts) error {
+		opts.uidMap = uids
+		opts.gidMap = gids
+		return nil
+	}
+}
+
 func DirFS(dir string, opts ...DirFSOption) FullFS {
 	var options dirFSOpts
 	for _, opt := range opts {
@@ -113,9 +129,14 @@ func DirFS(dir string, opts ...DirFSOption) FullFS {
 		caseMap = map[string]string{}
 	}
 	f := &dirFS{
-		base:      dir,
-		overrides: m,
-		caseMap:   caseMap,
+		base:            dir,
+		overrides:       m,
+		caseMap:         caseMap,
+		uidMap:          options.uidMap,
+		gidMap:          options.gidMap,
+		fakerootDB:      options.fakerootDB,
+		collisions:      map[string]string{},
+		failOnCollision: options.failOnCollision,
 	}
 	// need to populate the overrides with appropriate info
 	root := os.DirFS(dir)
@@ -140,10 +161,10 @@ func DirFS(dir string, opts ...DirFSOption) FullFS {
 		case fs.ModeSymlink:
 			var target string
 			target, err = os.Readlink(filepath.Join(dir, path))
-			if err != nil {
+			if err == nil {
 				err = f.overrides.Symlink(target, path)
 			}
-		case fs.ModeCharDevice:
+		case fs.ModeDevice | fs.ModeCharDevice, fs.ModeDevice:
 			var dev int
 			sys := fi.Sys()
 			st1, ok1 := sys.(*syscall.Stat_t)
@@ -156,7 +177,13 @@ func DirFS(dir string, opts ...DirFSOption) FullFS {
 			default:
 				return fmt.Errorf("unsupported type %T", sys)
 			}
-			err = f.overrides.Mknod(path, uint32(unix.S_IFCHR|mode), dev)
+			devType := uint32(unix.S_IFCHR)
+			if mode&fs.ModeCharDevice == 0 {
+				devType = unix.S_IFBLK
+			}
+			err = f.overrides.Mknod(path, devType|uint32(perm), dev)
+		case fs.ModeNamedPipe:
+			err = f.overrides.Mkfifo(path, perm)
 		default:
 			var memFile File
 			memFile, err = f.overrides.OpenFile(path, os.O_CREATE, perm)
@@ -164,9 +191,18 @@ func DirFS(dir string, opts ...DirFSOption) FullFS {
 				_ = memFile.Close()
 			}
 		}
+		if err == nil {
+			err = f.overrides.SetModTime(path, fi.ModTime())
+		}
 		return err
 	})
 
+	if f.fakerootDB != "" {
+		if err := f.loadFakerootDB(); err != nil {
+			return nil
+		}
+	}
+
 	return f
 }
 
@@ -194,6 +230,15 @@ type dirFS struct {
 	// can exist on disk. Maps the case-sensitive to the case-insensitive variant
 	caseMap      map[string]string
 	caseMapMutex sync.Mutex
+	// uidMap and gidMap are the owners to give files on disk for the ones asked for
+	uidMap, gidMap map[int]int
+	// fakerootDB is where to keep the overrides, if anywhere
+	fakerootDB string
+	// collisions are the paths kept in memory only, as they differ from
+	// others on disk by case, with those others. They are errors rather
+	// if failOnCollision is set.
+	collisions      map[string]string
+	failOnCollision bool
 }
 
 func (f *dirFS) Readlink(name string) (string, error) {
@@ -216,7 +261,7 @@ func (f *dirFS) Open(name string) (fs.File, error) {
 }
 
 func (f *dirFS) open(name string) (*fileImpl, error) {
-	fullpath, err := f.sanitizePath(name)
+	fullpath, err := f.diskPath(name, true)
 	if err != nil {
 		return nil, err
 	}
@@ -276,16 +321,29 @@ func (f *dirFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error)
 			return nil, err
 		}
 		// do we create it on disk?
-		if f.createOnDisk(name) {
+		onDisk, err := f.createOnDisk(name)
+		if err != nil {
+			_ = file.Close()
+			_ = f.overrides.Remove(name)
+			return nil, err
+		}
+		if onDisk {
 			_ = file.Close()
-			file, err = os.OpenFile(filepath.Join(f.base, name), flag, perm)
+			fullpath, err := f.diskPath(name, true)
+			if err != nil {
+				return nil, err
+			}
+			file, err = os.OpenFile(fullpath, flag, perm)
 			if err != nil {
 				return nil, err
 			}
 		}
 	} else {
 		if f.caseSensitiveOnDisk(name) {
-			file, err = os.OpenFile(filepath.Join(f.base, name), flag, perm)
+			var fullpath string
+			if fullpath, err = f.diskPath(name, true); err == nil {
+				file, err = os.OpenFile(fullpath, flag, perm)
+			}
 		} else {
 			file, err = f.overrides.OpenFile(name, flag, perm)
 		}
@@ -310,7 +368,11 @@ func (f *dirFS) Stat(name string) (fs.FileInfo, error) {
 		return nil, err
 	}
 	if f.caseSensitiveOnDisk(name) {
-		fi, err = os.Stat(filepath.Join(f.base, name))
+		fullpath, err := f.diskPath(name, true)
+		if err != nil {
+			return nil, err
+		}
+		fi, err = os.Stat(fullpath)
 		if err != nil {
 			return nil, err
 		}
@@ -338,10 +400,20 @@ func (f *dirFS) Create(name string) (File, error) {
 		return nil, err
 	}
 	// do we create it on disk?
-	if f.createOnDisk(name) {
+	onDisk, err := f.createOnDisk(name)
+	if err != nil {
+		_ = file.Close()
+		_ = f.overrides.Remove(name)
+		return nil, err
+	}
+	if onDisk {
 		// close the memory one
 		_ = file.Close()
-		file, err = os.Create(filepath.Join(f.base, name))
+		fullpath, err := f.diskPath(name, true)
+		if err != nil {
+			return nil, err
+		}
+		file, err = os.Create(fullpath)
 		if err != nil {
 			return nil, err
 		}
@@ -355,7 +427,11 @@ func (f *dirFS) Remove(name string) error {
 		return err
 	}
 	if f.removeOnDisk(name) {
-		return os.Remove(filepath.Join(f.base, name))
+		fullpath, err := f.diskPath(name, false)
+		if err != nil {
+			return err
+		}
+		return os.Remove(fullpath)
 	}
 	return nil
 }
@@ -367,7 +443,11 @@ func (f *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
 		err           error
 	)
 	if f.caseSensitiveOnDisk(name) {
-		onDisk, err = os.ReadDir(filepath.Join(f.base, name))
+		var fullpath string
+		if fullpath, err = f.diskPath(name, true); err != nil {
+			return nil, err
+		}
+		onDisk, err = os.ReadDir(fullpath)
 		if err != nil {
 			return nil, err
 		}
@@ -382,7 +462,8 @@ func (f *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
 	// - directory on disk is case-insensitive and the unique one: disk entries and memory entries; all disk must be in mem, but mem may have more
 	// - directory on disk is case-sensitive: disk entries and memory entries; all disk must be in mem, but mem may have more
 	//
-	// either way, memory always should be >= disk
+	// either way, memory always should be >= disk, and is sorted by name, which the
+	// entries keep
 	diskEntries := make(map[string]fs.DirEntry, len(onDisk))
 	for _, d := range onDisk {
 		diskEntries[d.Name()] = d
@@ -400,7 +481,11 @@ func (f *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
 }
 func (f *dirFS) ReadFile(name string) ([]byte, error) {
 	if f.caseSensitiveOnDisk(name) {
-		return os.ReadFile(filepath.Join(f.base, name))
+		fullpath, err := f.diskPath(name, true)
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(fullpath)
 	}
 	return f.overrides.ReadFile(name)
 }
@@ -408,8 +493,16 @@ func (f *dirFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
 	var (
 		memContent []byte
 	)
-	if f.createOnDisk(name) {
-		if err := os.WriteFile(filepath.Join(f.base, name), b, mode); err != nil {
+	onDisk, err := f.createOnDisk(name)
+	if err != nil {
+		return err
+	}
+	if onDisk {
+		fullpath, err := f.diskPath(name, true)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(fullpath, b, mode); err != nil {
 			return err
 		}
 	} else {
@@ -424,7 +517,11 @@ func (f *dirFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
 
 func (f *dirFS) Readnod(name string) (dev int, err error) {
 	if f.caseSensitiveOnDisk(name) {
-		_, err = os.Stat(filepath.Join(f.base, name))
+		var fullpath string
+		if fullpath, err = f.diskPath(name, true); err != nil {
+			return 0, err
+		}
+		_, err = os.Stat(fullpath)
 		if err != nil {
 			return 0, err
 		}
@@ -434,14 +531,24 @@ func (f *dirFS) Readnod(name string) (dev int, err error) {
 
 func (f *dirFS) Link(oldname, newname string) error {
 	// for hardlink, we cannot take target as is, as it might be outside of the base.
-	// So we must sanitize it. It should point to a file that is within the filesystem.
-	target := filepath.Join(f.base, oldname)
-	target = filepath.Clean(target)
-	if !strings.HasPrefix(target, f.base) {
-		return fmt.Errorf("hardlink target %s is outside of the filesystem", target)
+	// So we must resolve it within the filesystem, as the link itself.
+	target, err := f.diskPath(oldname, false)
+	if err != nil {
+		return err
 	}
-	if f.createOnDisk(newname) {
-		_ = os.Link(target, filepath.Join(f.base, newname))
+	onDisk, err := f.createOnDisk(newname)
+	if err != nil {
+		return err
+	}
+	if onDisk {
+		fullpath, err := f.diskPath(newname, false)
+		if err != nil {
+			return err
+		}
+		// report failures, e.g. on filesystems without hardlinks, so the caller can fall back to copying
+		if err := os.Link(target, fullpath); err != nil {
+			return err
+		}
 	}
 	return f.overrides.Link(oldname, newname)
 }
@@ -450,8 +557,14 @@ func (f *dirFS) Symlink(oldname, newname string) error {
 	// For symlink, take target as is.
 	// If it is outside of the base, it will be resolved by Readlink.
 	// This enables proper symlink behaviour.
-	if f.createOnDisk(newname) {
-		_ = os.Symlink(oldname, filepath.Join(f.base, newname))
+	onDisk, err := f.createOnDisk(newname)
+	if err != nil {
+		return err
+	}
+	if onDisk {
+		if fullpath, err := f.diskPath(newname, false); err == nil {
+			_ = os.Symlink(oldname, fullpath)
+		}
 	}
 	return f.overrides.Symlink(oldname, newname)
 }
@@ -459,8 +572,16 @@ func (f *dirFS) Symlink(oldname, newname string) error {
 func (f *dirFS) MkdirAll(name string, perm fs.FileMode) error {
 	// just in case, because some underlying systems miss this
 	fullPerm := os.ModeDir | perm
-	if f.createOnDisk(name) {
-		if err := os.MkdirAll(filepath.Join(f.base, name), fullPerm); err != nil {
+	onDisk, err := f.createOnDisk(name)
+	if err != nil {
+		return err
+	}
+	if onDisk {
+		fullpath, err := f.diskPath(name, true)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(fullpath, fullPerm); err != nil {
 			return err
 		}
 	}
@@ -470,8 +591,16 @@ func (f *dirFS) MkdirAll(name string, perm fs.FileMode) error {
 func (f *dirFS) Mkdir(name string, perm fs.FileMode) error {
 	// just in case, because some underlying systems miss this
 	fullPerm := os.ModeDir | perm
-	if f.createOnDisk(name) {
-		if err := os.Mkdir(filepath.Join(f.base, name), fullPerm); err != nil {
+	onDisk, err := f.createOnDisk(name)
+	if err != nil {
+		return err
+	}
+	if onDisk {
+		fullpath, err := f.diskPath(name, false)
+		if err != nil {
+			return err
+		}
+		if err := os.Mkdir(fullpath, fullPerm); err != nil {
 			return err
 		}
 	}
@@ -481,40 +610,159 @@ func (f *dirFS) Mkdir(name string, perm fs.FileMode) error {
 func (f *dirFS) Chmod(path string, perm fs.FileMode) error {
 	if f.caseSensitiveOnDisk(path) {
 		// ignore error, as we track it in memory anyways, and disk filesystem might not support it
-		_ = os.Chmod(filepath.Join(f.base, path), perm)
+		if fullpath, err := f.diskPath(path, true); err == nil {
+			_ = os.Chmod(fullpath, perm)
+		}
 	}
 	return f.overrides.Chmod(path, perm)
 }
 func (f *dirFS) Chown(path string, uid int, gid int) error {
 	if f.caseSensitiveOnDisk(path) {
 		// ignore error, as we track it in memory anyways, and disk filesystem might not support it
-		_ = os.Chown(filepath.Join(f.base, path), uid, gid)
+		if fullpath, err := f.diskPath(path, true); err == nil {
+			_ = os.Chown(fullpath, hostID(f.uidMap, uid), hostID(f.gidMap, gid))
+		}
 	}
 	return f.overrides.Chown(path, uid, gid)
 }
 
+func (f *dirFS) Lchown(path string, uid int, gid int) error {
+	if f.caseSensitiveOnDisk(path) {
+		// ignore error, as we track it in memory anyways, and disk filesystem might not support it
+		if fullpath, err := f.diskPath(path, false); err == nil {
+			_ = os.Lchown(fullpath, hostID(f.uidMap, uid), hostID(f.gidMap, gid))
+		}
+	}
+	return f.overrides.Lchown(path, uid, gid)
+}
+
+func (f *dirFS) SetModTime(path string, mtime time.Time) error {
+	if f.caseSensitiveOnDisk(path) {
+		// ignore error, as we track it in memory anyways
+		tv := unix.NsecToTimeval(mtime.UnixNano())
+		if fullpath, err := f.diskPath(path, false); err == nil {
+			_ = unix.Lutimes(fullpath, []unix.Timeval{tv, tv})
+		}
+	}
+	return f.overrides.SetModTime(path, mtime)
+}
+
+// hostID returns the id to give files on disk for the one asked for.
+func hostID(ids map[int]int, id int) int {
+	if mapped, ok := ids[id]; ok {
+		return mapped
+	}
+	return id
+}
+
+func (f *dirFS) SetXattr(path string, attr string, data []byte) error {
+	if f.caseSensitiveOnDisk(path) {
+		// ignore error, as we track it in memory anyways, and setting some attributes, such as
+		// security.capability, needs privileges
+		if fullpath, err := f.diskPath(path, true); err == nil {
+			_ = unix.Setxattr(fullpath, attr, data, 0)
+		}
+	}
+	return f.overrides.SetXattr(path, attr, data)
+}
+
+func (f *dirFS) GetXattr(path string, attr string) ([]byte, error) {
+	// the disk might not have all of them, so just use the ones in memory
+	return f.overrides.GetXattr(path, attr)
+}
+
+func (f *dirFS) RemoveXattr(path string, attr string) error {
+	if f.caseSensitiveOnDisk(path) {
+		if fullpath, err := f.diskPath(path, true); err == nil {
+			_ = unix.Removexattr(fullpath, attr)
+		}
+	}
+	return f.overrides.RemoveXattr(path, attr)
+}
+
+func (f *dirFS) ListXattrs(path string) (map[string][]byte, error) {
+	return f.overrides.ListXattrs(path)
+}
+
 func (f *dirFS) Mknod(name string, mode uint32, dev int) error {
 	if f.caseSensitiveOnDisk(name) {
-		err := unix.Mknod(filepath.Join(f.base, name), mode, dev)
-		// what if we could not create it? Just create a regular file there, and memory will override
+		fullpath, err := f.diskPath(name, false)
 		if err != nil {
-			_ = os.WriteFile(filepath.Join(f.base, name), nil, 0)
+			return err
+		}
+		// what if we could not create it? Just create a regular file there, and memory will override
+		if err := unix.Mknod(fullpath, mode, dev); err != nil {
+			writePlaceholder(fullpath)
 		}
 	}
 	return f.overrides.Mknod(name, mode, dev)
 }
 
-// sanitize ensures that we never go beyond the root of the filesystem
-func (f *dirFS) sanitizePath(p string) (v string, err error) {
-	return sanitizePath(f.base, p)
+func (f *dirFS) Mkfifo(name string, perm fs.FileMode) error {
+	if f.caseSensitiveOnDisk(name) {
+		fullpath, err := f.diskPath(name, false)
+		if err != nil {
+			return err
+		}
+		// as with devices, fall back to a regular file which memory overrides
+		if err := unix.Mkfifo(fullpath, uint32(perm.Perm())); err != nil {
+			writePlaceholder(fullpath)
+		}
+	}
+	return f.overrides.Mkfifo(name, perm)
 }
-func sanitizePath(base, p string) (v string, err error) {
-	v = filepath.Join(base, p)
-	if strings.HasPrefix(filepath.Clean(v), base) {
-		return v, nil
+
+// writePlaceholder creates an empty file on disk where a special file could
+// not be, but not through a symlink already there.
+func writePlaceholder(fullpath string) {
+	if file, err := os.OpenFile(fullpath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|unix.O_NOFOLLOW, 0); err == nil {
+		_ = file.Close()
 	}
+}
 
-	return "", fmt.Errorf("%s: %s", "content filepath is tainted", p)
+// diskPath returns where the entry is on disk, with the symlinks on the way
+// resolved as the filesystem does, within its directory, rather than by the
+// operating system, which could follow them out of it: a symlink to /usr/lib
+// is to the one of the filesystem, not of the host. The last one is only
+// resolved if followLast is set.
+func (f *dirFS) diskPath(name string, followLast bool) (string, error) {
+	parts := splitPath(name)
+	resolved := ""
+	for i, links := 0, 0; i < len(parts); i++ {
+		next := path.Join(resolved, parts[i])
+		if i == len(parts)-1 && !followLast {
+			resolved = next
+			break
+		}
+		fi, err := f.overrides.Lstat(next)
+		if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		target, err := f.overrides.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if links++; links > maxSymlinks {
+			return "", &fs.PathError{Op: "resolve", Path: name, Err: unix.ELOOP}
+		}
+		if !path.IsAbs(target) {
+			target = path.Join("/", resolved, target)
+		}
+		parts = append(splitPath(target), parts[i+1:]...)
+		resolved = ""
+		i = -1
+	}
+	return filepath.Join(f.base, filepath.FromSlash(resolved)), nil
+}
+
+// splitPath returns the parts of the path, which cannot go above the root.
+func splitPath(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
 }
 
 func (f *dirFS) caseSensitiveOnDisk(p string) bool {
@@ -536,9 +784,11 @@ func (f *dirFS) caseSensitiveOnDisk(p string) bool {
 // add it to the caseMap. If the file already exists on disk, also returns true.
 // This func is responsible solely for determining if you _should_ created it on disk.
 // If that would cause a conflict, that is up to the calling routing to figure out.
-func (f *dirFS) createOnDisk(p string) bool {
+// A path differing by case from one on disk is a collision, which is recorded, or
+// returned as an error if the filesystem fails on them.
+func (f *dirFS) createOnDisk(p string) (bool, error) {
 	if f.caseMap == nil {
-		return true
+		return true, nil
 	}
 	f.caseMapMutex.Lock()
 	defer f.caseMapMutex.Unlock()
@@ -547,9 +797,16 @@ func (f *dirFS) createOnDisk(p string) bool {
 	result, ok := f.caseMap[key]
 	if !ok {
 		f.caseMap[key] = p
-		return true
+		return true, nil
 	}
-	return result == p
+	if result == p {
+		return true, nil
+	}
+	if f.failOnCollision {
+		return false, &CaseCollision{Path: p, Existing: result}
+	}
+	f.collisions[p] = result
+	return false, nil
 }
 
 // removeOnDisk given a path p, determine if it should be removed from disk, and, if relevant,
@@ -563,6 +820,8 @@ func (f *dirFS) removeOnDisk(p string) (removeOnDisk bool) {
 	} else if v, ok := f.caseMap[key]; ok && v == p {
 		delete(f.caseMap, key)
 		removeOnDisk = true
+	} else {
+		delete(f.collisions, standardizePath(p))
 	}
 	return
 }
@@ -598,7 +857,8 @@ func (f *fileInfo) Mode() fs.FileMode {
 	return f.mem.Mode()
 }
 func (f *fileInfo) ModTime() time.Time {
-	return f.file.ModTime()
+	// writing to the file on disk changes its time there, but not in memory
+	return f.mem.ModTime()
 }
 func (f *fileInfo) IsDir() bool {
 	return f.file.IsDir()
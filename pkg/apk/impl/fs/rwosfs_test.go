@@ -15,11 +15,13 @@
 package fs
 
 import (
+	"archive/tar"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 func TestEmptyDir(t *testing.T) {
@@ -137,3 +139,111 @@ func TestCaseInsensitive(t *testing.T) {
 		}
 	}
 }
+
+func TestCaseCollisions(t *testing.T) {
+	fsys := DirFS(t.TempDir(), DirFSWithCaseSensitive(false))
+	require.NotNil(t, fsys, "fs should be created")
+	require.NoError(t, fsys.MkdirAll("usr/share", 0o755))
+	require.NoError(t, fsys.WriteFile("usr/share/README", []byte("upper"), 0o644))
+	require.NoError(t, fsys.WriteFile("usr/share/readme", []byte("lower"), 0o644))
+	require.NoError(t, fsys.WriteFile("usr/share/README", []byte("upper again"), 0o644), "not a collision with itself")
+
+	cfs, ok := fsys.(CaseCollisionFS)
+	require.True(t, ok)
+	require.Equal(t, []CaseCollision{{Path: "usr/share/readme", Existing: "usr/share/README"}}, cfs.CaseCollisions())
+	require.NoError(t, fsys.Remove("usr/share/readme"))
+	require.Empty(t, cfs.CaseCollisions())
+
+	strict := DirFS(t.TempDir(), DirFSWithCaseSensitive(false), DirFSWithCaseCollisionError(true))
+	require.NotNil(t, strict, "fs should be created")
+	require.NoError(t, strict.WriteFile("Makefile", nil, 0o644))
+	err := strict.WriteFile("makefile", nil, 0o644)
+	var collision *CaseCollision
+	require.ErrorAs(t, err, &collision)
+	require.Equal(t, "Makefile", collision.Existing)
+	_, err = strict.Stat("makefile")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	fsys := DirFS(dir)
+	require.NoError(t, fsys.MkdirAll("dev", 0o755))
+
+	// creating devices needs privileges, so this may be kept in memory only
+	require.NoError(t, fsys.Mknod("dev/null", unix.S_IFCHR|0o666, int(unix.Mkdev(1, 3))))
+	require.NoError(t, fsys.Mkfifo("dev/initctl", 0o600))
+
+	fi, err := fsys.Stat("dev/null")
+	require.NoError(t, err)
+	require.Equal(t, os.ModeDevice|os.ModeCharDevice, fi.Mode().Type())
+	fi, err = fsys.Stat("dev/initctl")
+	require.NoError(t, err)
+	require.Equal(t, os.ModeNamedPipe, fi.Mode().Type())
+
+	// they are picked up again from disk
+	_, err = os.Stat(filepath.Join(dir, "dev", "initctl"))
+	require.NoError(t, err)
+	reloaded := DirFS(dir)
+	fi, err = reloaded.Stat("dev/initctl")
+	require.NoError(t, err)
+	require.Equal(t, os.ModeNamedPipe, fi.Mode().Type())
+}
+
+func TestIDMap(t *testing.T) {
+	dir := t.TempDir()
+	uid, gid := os.Getuid(), os.Getgid()
+	fsys := DirFS(dir, DirFSWithIDMap(map[int]int{0: uid}, map[int]int{0: gid}))
+	require.NotNil(t, fsys, "fs should be created")
+	require.NoError(t, fsys.WriteFile("file", []byte("foo"), 0o644))
+	require.NoError(t, fsys.Symlink("file", "link"))
+	require.NoError(t, fsys.Chown("file", 0, 0))
+	require.NoError(t, fsys.Lchown("link", 0, 0))
+
+	// the files are owned by the mapped ids on disk
+	var st unix.Stat_t
+	require.NoError(t, unix.Stat(filepath.Join(dir, "file"), &st))
+	require.Equal(t, uint32(uid), st.Uid)
+	require.Equal(t, uint32(gid), st.Gid)
+
+	// but by the ones asked for in the filesystem
+	for _, name := range []string{"file", "link"} {
+		fi, err := fsys.Lstat(name)
+		require.NoError(t, err)
+		hdr := fi.Sys().(*tar.Header)
+		require.Equal(t, 0, hdr.Uid, name)
+		require.Equal(t, 0, hdr.Gid, name)
+	}
+}
+
+func TestSymlinksConfined(t *testing.T) {
+	outside := t.TempDir()
+	root := filepath.Join(t.TempDir(), "root")
+	fsys := DirFS(root, WithCreateDir(true))
+	require.NotNil(t, fsys)
+	require.NoError(t, fsys.MkdirAll("usr/lib", 0o755))
+	// to the directory outside, on the host, and above the root
+	require.NoError(t, fsys.Symlink(outside, "host"))
+	require.NoError(t, fsys.Symlink("../../../../../../usr/lib", "up"))
+	require.NoError(t, fsys.Symlink("/usr/lib", "lib"))
+	require.NoError(t, fsys.Symlink(filepath.Join(outside, "passwd"), "passwd"))
+
+	// writing through them stays within the root
+	require.NoError(t, fsys.WriteFile("up/a", []byte("a"), 0o644))
+	require.NoError(t, fsys.WriteFile("lib/b", []byte("b"), 0o644))
+	require.Error(t, fsys.WriteFile("host/c", []byte("c"), 0o644))
+	require.Error(t, fsys.WriteFile("passwd", []byte("root::0:0::/root:/bin/sh"), 0o644))
+	require.Error(t, fsys.Chmod("host", 0o700))
+
+	for _, name := range []string{"a", "b"} {
+		b, err := os.ReadFile(filepath.Join(root, "usr/lib", name))
+		require.NoError(t, err)
+		require.Equal(t, name, string(b))
+	}
+	entries, err := os.ReadDir(outside)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	fi, err := os.Stat(outside)
+	require.NoError(t, err)
+	require.NotEqual(t, os.FileMode(0o700), fi.Mode().Perm())
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+)
+
+// SnapshotEntry is the state of a file when a snapshot was taken.
+type SnapshotEntry struct {
+	Path string      `json:"path"`
+	Mode fs.FileMode `json:"mode"`
+	UID  int         `json:"uid"`
+	GID  int         `json:"gid"`
+	// Size and Checksum, the hex sha256, are those of the content of a
+	// regular file.
+	Size     int64  `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	// Linkname is the target of a symlink, and Dev the device of a device.
+	Linkname string            `json:"linkname,omitempty"`
+	Dev      int               `json:"dev,omitempty"`
+	Xattrs   map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// equal reports whether nothing changed between the entries.
+func (e *SnapshotEntry) equal(other *SnapshotEntry) bool {
+	if e.Mode != other.Mode || e.UID != other.UID || e.GID != other.GID ||
+		e.Size != other.Size || e.Checksum != other.Checksum ||
+		e.Linkname != other.Linkname || e.Dev != other.Dev ||
+		len(e.Xattrs) != len(other.Xattrs) {
+		return false
+	}
+	for attr, data := range e.Xattrs {
+		if otherData, ok := other.Xattrs[attr]; !ok || !bytes.Equal(data, otherData) {
+			return false
+		}
+	}
+	return true
+}
+
+// Snapshot is the state of all the files of a filesystem at some point, to
+// tell what changed since with Diff.
+type Snapshot struct {
+	// Entries are the files, sorted by path.
+	Entries []SnapshotEntry `json:"entries"`
+}
+
+// TakeSnapshot records the state of all the files of the filesystem,
+// reading the content of the regular ones.
+func TakeSnapshot(fsys FullFS) (*Snapshot, error) {
+	s := &Snapshot{}
+	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			return nil
+		}
+		entry, err := snapshotEntry(fsys, path)
+		if err != nil {
+			return fmt.Errorf("taking snapshot of %s: %w", path, err)
+		}
+		s.Entries = append(s.Entries, *entry)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(s.Entries, func(i, j int) bool { return s.Entries[i].Path < s.Entries[j].Path })
+	return s, nil
+}
+
+func snapshotEntry(fsys FullFS, path string) (*SnapshotEntry, error) {
+	fi, err := fsys.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &SnapshotEntry{Path: path, Mode: fi.Mode()}
+	if hdr, ok := fi.Sys().(*tar.Header); ok {
+		entry.UID, entry.GID = hdr.Uid, hdr.Gid
+	}
+	switch {
+	case fi.Mode()&fs.ModeSymlink != 0:
+		if entry.Linkname, err = fsys.Readlink(path); err != nil {
+			return nil, err
+		}
+		return entry, nil
+	case fi.Mode()&fs.ModeDevice != 0:
+		if entry.Dev, err = fsys.Readnod(path); err != nil {
+			return nil, err
+		}
+	case fi.Mode().IsRegular():
+		f, err := fsys.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if entry.Size, err = io.Copy(h, f); err != nil {
+			return nil, err
+		}
+		entry.Checksum = hex.EncodeToString(h.Sum(nil))
+	}
+	xattrs, err := fsys.ListXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(xattrs) > 0 {
+		entry.Xattrs = xattrs
+	}
+	return entry, nil
+}
+
+// ChangeKind is how a file changed between two snapshots.
+type ChangeKind string
+
+const (
+	ChangeAdded    ChangeKind = "added"
+	ChangeModified ChangeKind = "modified"
+	ChangeRemoved  ChangeKind = "removed"
+)
+
+// Change is a file which changed between two snapshots, with its state in
+// each, Before being nil if it was added and After if it was removed.
+type Change struct {
+	Path   string         `json:"path"`
+	Kind   ChangeKind     `json:"kind"`
+	Before *SnapshotEntry `json:"before,omitempty"`
+	After  *SnapshotEntry `json:"after,omitempty"`
+}
+
+// Diff returns the changes from the snapshot to a later one, sorted by path.
+func (s *Snapshot) Diff(later *Snapshot) []Change {
+	var changes []Change
+	i, j := 0, 0
+	for i < len(s.Entries) || j < len(later.Entries) {
+		switch {
+		case j == len(later.Entries) || (i < len(s.Entries) && s.Entries[i].Path < later.Entries[j].Path):
+			changes = append(changes, Change{Path: s.Entries[i].Path, Kind: ChangeRemoved, Before: &s.Entries[i]})
+			i++
+		case i == len(s.Entries) || later.Entries[j].Path < s.Entries[i].Path:
+			changes = append(changes, Change{Path: later.Entries[j].Path, Kind: ChangeAdded, After: &later.Entries[j]})
+			j++
+		default:
+			if !s.Entries[i].equal(&later.Entries[j]) {
+				changes = append(changes, Change{Path: s.Entries[i].Path, Kind: ChangeModified, Before: &s.Entries[i], After: &later.Entries[j]})
+			}
+			i++
+			j++
+		}
+	}
+	return changes
+}
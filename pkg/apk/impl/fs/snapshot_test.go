@@ -0,0 +1,63 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotDiff(t *testing.T) {
+	fsys := NewMemFS()
+	require.NoError(t, fsys.MkdirAll("etc", 0o755))
+	require.NoError(t, fsys.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/os-release", []byte("ID=base"), 0o644))
+	require.NoError(t, fsys.WriteFile("etc/motd", []byte("hello"), 0o644))
+	require.NoError(t, fsys.WriteFile("usr/bin/sh", []byte("sh"), 0o755))
+	require.NoError(t, fsys.Symlink("sh", "usr/bin/ash"))
+
+	before, err := TakeSnapshot(fsys)
+	require.NoError(t, err)
+	require.Len(t, before.Entries, 7)
+	require.Equal(t, "etc", before.Entries[0].Path)
+	require.Equal(t, "sh", before.Entries[5].Linkname)
+
+	require.NoError(t, fsys.WriteFile("etc/os-release", []byte("ID=image"), 0o644))
+	require.NoError(t, fsys.Chown("usr/bin/sh", 0, 10))
+	require.NoError(t, fsys.Remove("etc/motd"))
+	require.NoError(t, fsys.WriteFile("usr/bin/ls", []byte("ls"), 0o755))
+	require.NoError(t, fsys.Chmod("etc", 0o755), "no change")
+
+	after, err := TakeSnapshot(fsys)
+	require.NoError(t, err)
+	changes := before.Diff(after)
+	kinds := map[string]ChangeKind{}
+	for _, c := range changes {
+		kinds[c.Path] = c.Kind
+	}
+	require.Equal(t, map[string]ChangeKind{
+		"etc/motd":       ChangeRemoved,
+		"etc/os-release": ChangeModified,
+		"usr/bin/ls":     ChangeAdded,
+		"usr/bin/sh":     ChangeModified,
+	}, kinds)
+	require.Equal(t, "etc/motd", changes[0].Path)
+	require.Nil(t, changes[0].After)
+	require.NotEqual(t, changes[1].Before.Checksum, changes[1].After.Checksum)
+	require.Equal(t, 10, changes[3].After.GID)
+
+	require.Empty(t, after.Diff(after))
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"time"
+)
+
+// TimestampPolicy is what the modification times of the files, which are
+// those of the packages for their files, become in the layer.
+type TimestampPolicy string
+
+const (
+	// TimestampsEpoch sets every time to SOURCE_DATE_EPOCH, the default.
+	TimestampsEpoch TimestampPolicy = "epoch"
+	// TimestampsPreserve keeps the times of the files, those of the
+	// packages, or when the build created them for the others.
+	TimestampsPreserve TimestampPolicy = "preserve"
+	// TimestampsClamp keeps the times of the files, but none later than
+	// SOURCE_DATE_EPOCH.
+	TimestampsClamp TimestampPolicy = "clamp"
+	// TimestampsZero sets every time to the Unix epoch.
+	TimestampsZero TimestampPolicy = "zero"
+)
+
+// ParseTimestampPolicy returns the policy of the name, the empty one being
+// the default.
+func ParseTimestampPolicy(name string) (TimestampPolicy, error) {
+	switch p := TimestampPolicy(name); p {
+	case "":
+		return TimestampsEpoch, nil
+	case TimestampsEpoch, TimestampsPreserve, TimestampsClamp, TimestampsZero:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid timestamp policy %q, must be one of epoch, preserve, clamp or zero", name)
+	}
+}
+
+// Apply returns what the modification time becomes under the policy, given
+// SOURCE_DATE_EPOCH.
+func (p TimestampPolicy) Apply(mtime, sourceDateEpoch time.Time) time.Time {
+	switch p {
+	case TimestampsPreserve:
+		return mtime
+	case TimestampsClamp:
+		if mtime.After(sourceDateEpoch) {
+			return sourceDateEpoch
+		}
+		return mtime
+	case TimestampsZero:
+		return time.Unix(0, 0)
+	default:
+		return sourceDateEpoch
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestampPolicy(t *testing.T) {
+	epoch := time.Unix(1700000000, 0)
+	before, after := epoch.Add(-time.Hour), epoch.Add(time.Hour)
+	for _, tt := range []struct {
+		policy        TimestampPolicy
+		before, after time.Time
+	}{
+		{TimestampsEpoch, epoch, epoch},
+		{TimestampsPreserve, before, after},
+		{TimestampsClamp, before, epoch},
+		{TimestampsZero, time.Unix(0, 0), time.Unix(0, 0)},
+	} {
+		p, err := ParseTimestampPolicy(string(tt.policy))
+		require.NoError(t, err)
+		require.Equal(t, tt.policy, p)
+		require.Equal(t, tt.before, p.Apply(before, epoch), "%s before", p)
+		require.Equal(t, tt.after, p.Apply(after, epoch), "%s after", p)
+	}
+	p, err := ParseTimestampPolicy("")
+	require.NoError(t, err)
+	require.Equal(t, TimestampsEpoch, p)
+	_, err = ParseTimestampPolicy("now")
+	require.Error(t, err)
+}
+
+func TestSetModTime(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	for _, tt := range []struct {
+		name string
+		fsys FullFS
+	}{
+		{"memfs", NewMemFS()},
+		{"dirfs", DirFS(t.TempDir())},
+		{"overlay", OverlayFS(NewMemFS(), NewMemFS())},
+	} {
+		fsys := tt.fsys
+		require.NoError(t, fsys.MkdirAll("usr/bin", 0o755))
+		require.NoError(t, fsys.WriteFile("usr/bin/tool", []byte("v1"), 0o755))
+		require.NoError(t, fsys.Symlink("tool", "usr/bin/alias"))
+		require.NoError(t, fsys.SetModTime("usr/bin/tool", mtime))
+		require.NoError(t, fsys.SetModTime("usr/bin", mtime))
+		require.NoError(t, fsys.SetModTime("usr/bin/alias", mtime.Add(time.Hour)))
+
+		// writing to the file or the directory keeps the times set
+		f, err := fsys.OpenFile("usr/bin/tool", os.O_WRONLY|os.O_TRUNC, 0o755)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("v2"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		require.NoError(t, fsys.WriteFile("usr/bin/other", nil, 0o755))
+
+		for name, want := range map[string]time.Time{
+			"usr/bin":       mtime,
+			"usr/bin/tool":  mtime,
+			"usr/bin/alias": mtime.Add(time.Hour),
+		} {
+			fi, err := fsys.Lstat(name)
+			require.NoError(t, err)
+			require.True(t, want.Equal(fi.ModTime()), "%s: mtime of %s is %v", tt.name, name, fi.ModTime())
+		}
+		entries, err := fsys.ReadDir("usr/bin")
+		require.NoError(t, err)
+		for _, e := range entries {
+			if e.Name() == "tool" {
+				fi, err := e.Info()
+				require.NoError(t, err)
+				require.True(t, mtime.Equal(fi.ModTime()), "%s: mtime of the entry is %v", tt.name, fi.ModTime())
+			}
+		}
+		require.Error(t, fsys.SetModTime("usr/bin/missing", mtime))
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+)
+
+// tarBlockSize is the size of the blocks of a tarball, which headers and
+// content are padded to.
+const tarBlockSize = 512
+
+// Usage is how much space files take.
+type Usage struct {
+	Files int `json:"files"`
+	// Size is the apparent size of their content, and TarSize how much they
+	// take in an uncompressed tarball, with headers and padding.
+	Size    int64 `json:"size"`
+	TarSize int64 `json:"tarSize"`
+}
+
+// Add adds the usage of other files.
+func (u *Usage) Add(other Usage) {
+	u.Files += other.Files
+	u.Size += other.Size
+	u.TarSize += other.TarSize
+}
+
+// FileUsage returns how much space the file at the path takes, following
+// it if it is a symlink only for its size.
+func FileUsage(fsys FullFS, name string) (Usage, error) {
+	fi, err := fsys.Lstat(name)
+	if err != nil {
+		return Usage{}, err
+	}
+	var size int64
+	if fi.Mode().IsRegular() {
+		// some filesystems only know the size of what is on disk from there
+		if fi, err = fsys.Stat(name); err != nil {
+			return Usage{}, err
+		}
+		size = fi.Size()
+	}
+	// the names which do not fit the header, and extended attributes, take
+	// PAX records, in a header of their own
+	var records int64
+	if len(name) > 100 {
+		records += int64(len(name)) + 16
+	}
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		xattrs, err := fsys.ListXattrs(name)
+		if err != nil {
+			return Usage{}, err
+		}
+		for attr, data := range xattrs {
+			records += int64(len(attr)+len(data)) + 24
+		}
+	}
+	tarSize := tarBlockSize + padded(size)
+	if records > 0 {
+		tarSize += tarBlockSize + padded(records)
+	}
+	return Usage{Files: 1, Size: size, TarSize: tarSize}, nil
+}
+
+// padded returns the size rounded up to whole tar blocks.
+func padded(size int64) int64 {
+	return (size + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+}
+
+// DiskUsage returns how much space each directory of the filesystem takes,
+// including everything under it and itself, by path, "." being the root.
+func DiskUsage(fsys FullFS) (map[string]Usage, error) {
+	usage := map[string]Usage{}
+	if err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == "." {
+			return nil
+		}
+		u, err := FileUsage(fsys, p)
+		if err != nil {
+			return fmt.Errorf("measuring %s: %w", p, err)
+		}
+		if d.IsDir() {
+			if _, ok := usage[p]; !ok {
+				usage[p] = Usage{}
+			}
+		}
+		// add it to every directory up to the root
+		for dir := p; dir != "."; {
+			dir = path.Dir(dir)
+			total := usage[dir]
+			total.Add(u)
+			usage[dir] = total
+		}
+		if d.IsDir() {
+			total := usage[p]
+			total.Add(u)
+			usage[p] = total
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskUsage(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		fsys func(t *testing.T) FullFS
+	}{
+		{"memfs", func(t *testing.T) FullFS { return NewMemFS() }},
+		{"dirfs", func(t *testing.T) FullFS { return DirFS(t.TempDir()) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := tt.fsys(t)
+			require.NoError(t, fsys.MkdirAll("usr/lib", 0o755))
+			require.NoError(t, fsys.MkdirAll("etc", 0o755))
+			require.NoError(t, fsys.WriteFile("usr/lib/libfoo.so", bytes.Repeat([]byte("x"), 1000), 0o755))
+			require.NoError(t, fsys.WriteFile("etc/os-release", []byte("ID=test"), 0o644))
+			require.NoError(t, fsys.Symlink("libfoo.so", "usr/lib/libfoo.so.1"))
+
+			usage, err := DiskUsage(fsys)
+			require.NoError(t, err)
+			require.Equal(t, Usage{Files: 4, Size: 1000, TarSize: 4*512 + 1024}, usage["usr"])
+			require.Equal(t, Usage{Files: 3, Size: 1000, TarSize: 3*512 + 1024}, usage["usr/lib"])
+			require.Equal(t, Usage{Files: 2, Size: 7, TarSize: 2*512 + 512}, usage["etc"])
+			require.Equal(t, Usage{Files: 6, Size: 1007, TarSize: 6*512 + 1536}, usage["."])
+		})
+	}
+}
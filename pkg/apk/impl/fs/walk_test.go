@@ -0,0 +1,73 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkOrder(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		fsys func(t *testing.T) FullFS
+	}{
+		{"memfs", func(t *testing.T) FullFS { return NewMemFS() }},
+		{"hybrid", func(t *testing.T) FullFS { return NewHybridFS(t.TempDir(), 0) }},
+		{"dirfs", func(t *testing.T) FullFS { return DirFS(t.TempDir()) }},
+		{"dirfs case-insensitive", func(t *testing.T) FullFS { return DirFS(t.TempDir(), DirFSWithCaseSensitive(false)) }},
+		{"overlay", func(t *testing.T) FullFS {
+			lower := NewMemFS()
+			require.NoError(t, lower.MkdirAll("usr/lib", 0o755))
+			require.NoError(t, lower.WriteFile("usr/lib/m", nil, 0o644))
+			return OverlayFS(lower, NewMemFS())
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := tt.fsys(t)
+			require.NotNil(t, fsys)
+			require.NoError(t, fsys.MkdirAll("usr/lib", 0o755))
+			require.NoError(t, fsys.MkdirAll("etc", 0o755))
+			// enough entries that a map would not keep them in order by chance
+			for i := 19; i >= 0; i-- {
+				require.NoError(t, fsys.WriteFile(fmt.Sprintf("usr/lib/lib%02d.so", i), nil, 0o644))
+			}
+			require.NoError(t, fsys.WriteFile("usr/lib/Z", nil, 0o644))
+			require.NoError(t, fsys.WriteFile("usr/lib/m", nil, 0o644))
+			require.NoError(t, fsys.WriteFile("etc/os-release", nil, 0o644))
+
+			expected := []string{".", "etc", "etc/os-release", "usr", "usr/lib", "usr/lib/Z"}
+			for i := 0; i < 20; i++ {
+				expected = append(expected, fmt.Sprintf("usr/lib/lib%02d.so", i))
+			}
+			expected = append(expected, "usr/lib/m")
+
+			for run := 0; run < 3; run++ {
+				var walked []string
+				require.NoError(t, fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+					if err != nil {
+						return err
+					}
+					walked = append(walked, path)
+					return nil
+				}))
+				require.Equal(t, expected, walked)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// GenerateIndex returns an unsigned APKINDEX.tar.gz listing the .apk files
+// of the directory, e.g. packages/x86_64, so that it can be used as a
+// repository. Sign it with SignIndexData.
+func GenerateIndex(dir, description string, limits InputLimits) ([]byte, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.apk"))
+	if err != nil {
+		return nil, err
+	}
+	pkgs := make([]*repository.Package, 0, len(paths))
+	for _, p := range paths {
+		pkg, err := ReadLocalPackage(p, limits)
+		if err != nil {
+			return nil, err
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return writeIndexArchive(&repository.ApkIndex{Description: description, Packages: pkgs})
+}
+
+// writeIndexArchive returns the APKINDEX.tar.gz of the index, with the
+// packages sorted by name, then version, so that the same packages always
+// make the same archive.
+func writeIndexArchive(index *repository.ApkIndex) ([]byte, error) {
+	pkgs := append([]*repository.Package{}, index.Packages...)
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		if pkgs[i].Name != pkgs[j].Name {
+			return pkgs[i].Name < pkgs[j].Name
+		}
+		return pkgs[i].Version < pkgs[j].Version
+	})
+	var apkindex strings.Builder
+	for _, pkg := range pkgs {
+		for _, line := range PackageToIndex(pkg) {
+			apkindex.WriteString(line)
+			apkindex.WriteString("\n")
+		}
+		apkindex.WriteString("\n")
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, f := range []struct{ name, content string }{
+		{"DESCRIPTION", index.Description},
+		{"APKINDEX", apkindex.String()},
+	} {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     f.name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(f.content)),
+			ModTime:  time.Unix(0, 0),
+			Uname:    "root",
+			Gname:    "root",
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(tw, f.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateIndex(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []struct{ file, pkgInfo string }{
+		{"world-2.0-r0.apk", "pkgname = world\npkgver = 2.0-r0\narch = x86_64\n"},
+		{"hello-1.0-r0.apk", "pkgname = hello\npkgver = 1.0-r0\narch = x86_64\ndepend = so:libc.musl-x86_64.so.1\n"},
+	} {
+		path := testLocalPackage(t, t.TempDir(), p.pkgInfo)
+		require.NoError(t, os.Rename(path, filepath.Join(dir, p.file)))
+	}
+	// not a package
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("hello\n"), 0o644))
+
+	data, err := GenerateIndex(dir, "v1", InputLimits{})
+	require.NoError(t, err)
+
+	index, err := indexFromArchive(bytes.NewReader(data), InputLimits{})
+	require.NoError(t, err)
+	require.Equal(t, "v1", index.Description)
+	require.Len(t, index.Packages, 2)
+	require.Equal(t, "hello", index.Packages[0].Name)
+	require.Equal(t, "1.0-r0", index.Packages[0].Version)
+	require.Equal(t, []string{"so:libc.musl-x86_64.so.1"}, index.Packages[0].Dependencies)
+	require.Equal(t, "world", index.Packages[1].Name)
+
+	pkg, err := ReadLocalPackage(filepath.Join(dir, "hello-1.0-r0.apk"), InputLimits{})
+	require.NoError(t, err)
+	require.Equal(t, pkg.Checksum, index.Packages[0].Checksum)
+	require.Equal(t, pkg.Size, index.Packages[0].Size)
+
+	again, err := GenerateIndex(dir, "v1", InputLimits{})
+	require.NoError(t, err)
+	require.Equal(t, data, again, "generating the index twice must make the same archive")
+
+	_, err = GenerateIndex(filepath.Join(dir, "missing"), "", InputLimits{})
+	require.Error(t, err)
+}
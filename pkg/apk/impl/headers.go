@@ -0,0 +1,124 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// WithUserAgent sets the User-Agent of the requests for keys, indexes and
+// packages, e.g. for mirrors which route or rate limit by it.
+func WithUserAgent(userAgent string) Option {
+	return func(o *opts) error {
+		o.userAgent = userAgent
+		return nil
+	}
+}
+
+// WithHeaders adds headers to the requests for keys, indexes and packages,
+// replacing those of the same names. They are only sent to the hosts of the
+// repositories, and so not to those the requests are redirected to.
+func WithHeaders(headers http.Header) Option {
+	return func(o *opts) error {
+		o.headers = headers.Clone()
+		return nil
+	}
+}
+
+// httpClient returns the client for requests, which adds the headers and
+// the credentials.
+func (a *APKImplementation) httpClient() *http.Client {
+	client := a.client
+	if client == nil {
+		client = &http.Client{}
+	}
+	if a.userAgent == "" && len(a.headers) == 0 && len(a.credentials) == 0 {
+		return client
+	}
+	c := *client
+	c.Transport = &requestTransport{
+		base:        client.Transport,
+		userAgent:   a.userAgent,
+		headers:     a.headers,
+		headerHosts: a.repositoryHosts(),
+		credentials: a.credentials,
+	}
+	return &c
+}
+
+// repositoryHosts returns the hosts, with their ports, of the repositories
+// fetched over http or https.
+func (a *APKImplementation) repositoryHosts() map[string]bool {
+	hosts := map[string]bool{}
+	if a.fs == nil {
+		return hosts
+	}
+	repos, err := a.GetRepositories()
+	if err != nil {
+		return hosts
+	}
+	for _, repo := range repos {
+		// drop the name of pinned repositories, e.g. "@local https://..."
+		if strings.HasPrefix(repo, "@") {
+			if fields := strings.Fields(repo); len(fields) > 1 {
+				repo = fields[1]
+			}
+		}
+		u, err := url.Parse(strings.TrimSpace(repo))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			continue
+		}
+		hosts[u.Host] = true
+	}
+	return hosts
+}
+
+type requestTransport struct {
+	base      http.RoundTripper
+	userAgent string
+	// headers are only added to the requests to headerHosts.
+	headers     http.Header
+	headerHosts map[string]bool
+	credentials []Credentials
+}
+
+func (t *requestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	// the request is not ours to modify
+	req = req.Clone(req.Context())
+	// like the credentials, the headers are matched for each request, and
+	// so not sent along redirects to other hosts
+	if t.headerHosts[req.URL.Host] {
+		for name, values := range t.headers {
+			req.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	// redirects are matched again, so credentials never follow them to
+	// where they do not belong
+	if req.Header.Get("Authorization") == "" {
+		if c, ok := matchCredentials(t.credentials, req.URL); ok {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+	}
+	return base.RoundTrip(req)
+}
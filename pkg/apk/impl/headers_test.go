@@ -0,0 +1,70 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+func TestHTTPClientHeaders(t *testing.T) {
+	var got, gotRedirected http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRedirected = r.Header.Clone()
+	}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, other.URL+"/APKINDEX.tar.gz", http.StatusFound)
+			return
+		}
+		got = r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	src := apkfs.NewMemFS()
+	require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+	a, err := NewAPKImplementation(
+		WithFS(src),
+		WithUserAgent("apko-test/1.0"),
+		WithHeaders(http.Header{"X-Mirror-Route": {"eu"}, "x-tenant": {"a", "b"}}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, a.SetRepositories([]string{"@mirror " + srv.URL + "/os"}))
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/APKINDEX.tar.gz", nil)
+	require.NoError(t, err)
+	res, err := a.httpClient().Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	require.Equal(t, "apko-test/1.0", got.Get("User-Agent"))
+	require.Equal(t, []string{"eu"}, got.Values("X-Mirror-Route"))
+	require.Equal(t, []string{"a", "b"}, got.Values("X-Tenant"))
+	require.Empty(t, req.Header, "the request of the caller must be left alone")
+
+	// the headers do not follow redirects to other hosts
+	res, err = a.httpClient().Get(srv.URL + "/redirect")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, "apko-test/1.0", gotRedirected.Get("User-Agent"))
+	require.Empty(t, gotRedirected.Values("X-Mirror-Route"))
+	require.Empty(t, gotRedirected.Values("X-Tenant"))
+}
@@ -16,6 +16,8 @@ package impl
 
 import (
 	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -44,6 +46,33 @@ type APKImplementation struct {
 	executor          Executor
 	ignoreMknodErrors bool
 	client            *http.Client
+	credentials       []Credentials
+	userAgent         string
+	headers           http.Header
+	signaturePolicy   SignaturePolicy
+	progress          Progress
+	limits            InputLimits
+	offline           bool
+	strategy          ResolverStrategy
+	extractionCache   string
+	unsafePaths       bool
+	keepInstalled     bool
+	// localPackages are the packages of the world which are .apk files or
+	// URLs, once resolved.
+	localPackages map[*repository.Package]localPackage
+	// checksumPins are the SHA-256 hashes of the .apk files the packages of
+	// the world are pinned to, by package name, once resolved.
+	checksumPins map[string]string
+	// excludeAll and excludePackages are the paths not installed from any
+	// package, and from the packages of each name.
+	excludeAll      pathMatcher
+	excludePackages map[string]pathMatcher
+
+	permissiveFileCollisions bool
+	noarchFallback           bool
+	// fileOwners are the packages owning each installed file, once read
+	// from the installed database.
+	fileOwners map[string][]string
 }
 
 func NewAPKImplementation(options ...Option) (*APKImplementation, error) {
@@ -53,14 +82,27 @@ func NewAPKImplementation(options ...Option) (*APKImplementation, error) {
 			return nil, err
 		}
 	}
-	return &APKImplementation{
+	a := &APKImplementation{
 		fs:                opt.fs,
 		logger:            opt.logger,
 		arch:              opt.arch,
 		executor:          opt.executor,
 		ignoreMknodErrors: opt.ignoreMknodErrors,
 		version:           opt.version,
-	}, nil
+		progress:          opt.progress,
+		limits:            opt.limits,
+		offline:           opt.offline,
+		userAgent:         opt.userAgent,
+		headers:           opt.headers,
+		strategy:          opt.strategy,
+		extractionCache:   opt.extractionCache,
+		unsafePaths:       opt.unsafePaths,
+		keepInstalled:     opt.keepInstalled,
+	}
+	if a.offline {
+		a.client = offlineClient
+	}
+	return a, nil
 }
 
 type directory struct {
@@ -119,6 +161,13 @@ var initFiles = []file{
 	{"/lib/apk/db/installed", 0o644, nil},
 }
 
+// databaseFiles are the files of initFiles recording the installed packages,
+// which are kept when installing on top of them.
+var databaseFiles = map[string]bool{
+	"/lib/apk/db/installed": true,
+	"/lib/apk/db/triggers":  true,
+}
+
 // deviceFiles is a list of files to create relative to the root.
 var initDeviceFiles = []deviceFile{
 	{"/dev/zero", 1, 5, 0o666},
@@ -128,11 +177,25 @@ var initDeviceFiles = []deviceFile{
 	{"/dev/console", 5, 1, 0o620},
 }
 
+// SetSignaturePolicy sets the keys which may sign each repository, and how
+// strictly that is checked. With a policy in place, installed packages are
+// also checked against the checksums in the repository indexes.
+func (a *APKImplementation) SetSignaturePolicy(policy SignaturePolicy) error {
+	if err := policy.Validate(); err != nil {
+		return fmt.Errorf("invalid signature policy: %w", err)
+	}
+	a.signaturePolicy = policy
+	return nil
+}
+
 // SetClient set the http client to use for downloading packages.
 // In general, you can leave this unset, and it will use the default http.Client.
 // It is useful for fine-grained control, for proxying, or for setting alternate
-// paths.
+// paths. In offline mode, the client is kept from reaching the network.
 func (a *APKImplementation) SetClient(client *http.Client) {
+	if a.offline {
+		return
+	}
 	a.client = client
 }
 
@@ -195,6 +258,7 @@ func (a *APKImplementation) InitDB(versions ...string) error {
 		equivalent of: "apk add --initdb --arch arch --root root"
 	*/
 	a.logger.Infof("initializing apk database")
+	a.fileOwners = nil
 
 	// additionalFiles are files we need but can only be resolved in the context of
 	// this func, e.g. we need the architecture
@@ -234,6 +298,11 @@ func (a *APKImplementation) InitDB(versions ...string) error {
 		}
 	}
 	for _, e := range append(initFiles, additionalFiles...) {
+		if a.keepInstalled && databaseFiles[e.path] {
+			if _, err := a.fs.Stat(e.path); err == nil {
+				continue
+			}
+		}
 		if err := a.fs.WriteFile(e.path, e.contents, e.perms); err != nil {
 			return fmt.Errorf("failed to create file %s: %w", e.path, err)
 		}
@@ -259,7 +328,9 @@ func (a *APKImplementation) InitDB(versions ...string) error {
 	// nothing to add to it; scripts.tar should be empty
 
 	// get the alpine-keys base keys for our usage
-	if err := a.fetchAlpineKeys(versions); err != nil {
+	if a.offline {
+		a.logger.Infof("not fetching alpine-keys in offline mode")
+	} else if err := a.fetchAlpineKeys(versions); err != nil {
 		var nokeysErr *NoKeysFoundError
 		if !errors.As(err, &nokeysErr) {
 			return fmt.Errorf("failed to fetch alpine-keys: %w", err)
@@ -324,12 +395,38 @@ func (a *APKImplementation) InitKeyring(keyFiles, extraKeyFiles []string) (err e
 		keyFiles = append(keyFiles, extraKeyFiles...)
 	}
 
+	if a.offline {
+		var missing []string
+		for _, element := range keyFiles {
+			if isRemote(element) {
+				missing = append(missing, element)
+			}
+		}
+		if len(missing) > 0 {
+			return &OfflineError{Missing: missing}
+		}
+	}
+
 	var eg errgroup.Group
 
 	for _, element := range keyFiles {
 		element := element
 		eg.Go(func() error {
+			// inline key material needs neither fetching nor a file name
+			if name, data, ok, err := parseInlineKey(element); ok {
+				if err != nil {
+					return err
+				}
+				a.logger.Debugf("installing inline key %s", name)
+				// #nosec G306 -- apk keyring must be publicly readable
+				if err := a.fs.WriteFile(filepath.Join("etc", "apk", "keys", name), data, 0o644); err != nil {
+					return fmt.Errorf("failed to write apk key: %w", err)
+				}
+				return nil
+			}
+
 			a.logger.Debugf("installing key %v", element)
+			element = strings.TrimPrefix(element, "file://")
 
 			// Normalize the element as a URI, so that local paths
 			// are translated into file:// URLs, allowing them to be parsed
@@ -353,10 +450,7 @@ func (a *APKImplementation) InitKeyring(keyFiles, extraKeyFiles []string) (err e
 					return fmt.Errorf("failed to read apk key: %w", err)
 				}
 			case "https":
-				client := a.client
-				if client == nil {
-					client = &http.Client{}
-				}
+				client := a.httpClient()
 				resp, err := client.Get(asURL.String())
 				if err != nil {
 					return fmt.Errorf("failed to fetch apk key: %w", err)
@@ -395,7 +489,8 @@ func (a *APKImplementation) ResolveWorld() (toInstall []*repository.RepositoryPa
 	// to fix the world, we need to:
 	// 1. Get the apkIndexes for each repository for the target arch
 	indexes, err := a.getRepositoryIndexes(false)
-	if err != nil {
+	var offlineErr *OfflineError
+	if err != nil && !errors.As(err, &offlineErr) {
 		return toInstall, conflicts, fmt.Errorf("error getting repository indexes: %w", err)
 	}
 	// 2. Get the dependency tree for each package from the world file
@@ -403,12 +498,40 @@ func (a *APKImplementation) ResolveWorld() (toInstall []*repository.RepositoryPa
 	if err != nil {
 		return toInstall, conflicts, fmt.Errorf("error getting world packages: %w", err)
 	}
+	directPkgs, a.checksumPins, err = checksumPins(directPkgs)
+	if err != nil {
+		return toInstall, conflicts, err
+	}
+	if a.offline {
+		// list the packages to download along with the indexes
+		var missing []string
+		if offlineErr != nil {
+			missing = offlineErr.Missing
+		}
+		for _, pkg := range directPkgs {
+			if isRemotePackage(pkg) {
+				missing = append(missing, pkg)
+			}
+		}
+		if len(missing) > 0 {
+			return toInstall, conflicts, &OfflineError{Missing: missing}
+		}
+	}
 	indexesInt := make([]NamedIndex, 0, len(indexes))
 	for _, index := range indexes {
 		indexesInt = append(indexesInt, index)
 	}
+	directPkgs, indexesInt, err = a.localIndex(directPkgs, indexesInt)
+	if err != nil {
+		return toInstall, conflicts, err
+	}
 	resolver := NewPkgResolver(indexesInt)
-	return resolver.GetPackagesWithDependencies(directPkgs)
+	resolver.strategy = a.strategy
+	toInstall, conflicts, err = resolver.GetPackagesWithDependencies(directPkgs)
+	if err != nil {
+		return toInstall, conflicts, err
+	}
+	return toInstall, conflicts, checkChecksumPins(a.checksumPins, toInstall)
 }
 
 // FixateWorld force apk's resolver to re-resolve the requested dependencies in /etc/apk/world.
@@ -455,6 +578,7 @@ func (a *APKImplementation) FixateWorld(cache, updateCache, executeScripts bool,
 			return fmt.Errorf("cannot install due to conflict with %s", pkg)
 		}
 	}
+	var toInstall []*repository.RepositoryPackage
 	for _, pkg := range allpkgs {
 		isInstalled, err := a.isInstalledPackage(pkg.Name)
 		if err != nil {
@@ -463,12 +587,25 @@ func (a *APKImplementation) FixateWorld(cache, updateCache, executeScripts bool,
 		if isInstalled {
 			continue
 		}
+		toInstall = append(toInstall, pkg)
+	}
+	if a.offline {
+		if err := a.offlineMissing(toInstall); err != nil {
+			return err
+		}
+	}
+	for i, pkg := range toInstall {
+		a.progress.Start(pkg.Name, i+1, len(toInstall))
 		// get the apk file
 		if err := a.installPackage(pkg, cache, updateCache, executeScripts, sourceDateEpoch); err != nil {
 			return err
 		}
+		a.progress.Done()
 	}
-	return nil
+	if err := a.forgetLocalPackagePaths(); err != nil {
+		return err
+	}
+	return a.forgetChecksumPins()
 }
 
 type NoKeysFoundError struct {
@@ -483,10 +620,7 @@ func (e *NoKeysFoundError) Error() string {
 // fetchAlpineKeys fetches the public keys for the repositories in the APK database.
 func (a *APKImplementation) fetchAlpineKeys(versions []string) error {
 	u := alpineReleasesURL
-	client := a.client
-	if client == nil {
-		client = &http.Client{}
-	}
+	client := a.httpClient()
 	res, err := client.Get(u)
 	if err != nil {
 		return fmt.Errorf("failed to fetch alpine releases: %w", err)
@@ -522,44 +656,53 @@ func (a *APKImplementation) fetchAlpineKeys(versions []string) error {
 	}
 	// get the keys for each URL and save them to a file with that name
 	for _, u := range urls {
-		res, err := client.Get(u)
-		if err != nil {
-			return fmt.Errorf("failed to fetch alpine key %s: %w", u, err)
-		}
-		defer res.Body.Close()
-		basefilenameEscape := filepath.Base(u)
-		basefilename, err := url.PathUnescape(basefilenameEscape)
-		if err != nil {
-			return fmt.Errorf("failed to unescape key filename %s: %w", basefilenameEscape, err)
-		}
-		filename := filepath.Join(keysDirPath, basefilename)
-		f, err := a.fs.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0o644)
-		if err != nil {
-			return fmt.Errorf("failed to open key file %s: %w", filename, err)
-		}
-		defer f.Close()
-		if _, err := io.Copy(f, res.Body); err != nil {
-			return fmt.Errorf("failed to write key file %s: %w", filename, err)
+		if err := a.fetchAlpineKey(client, u); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// installPkg install a single package and update installed db.
-//
-//nolint:unparam // we do not use some params... yet.
-func (a *APKImplementation) installPackage(pkg *repository.RepositoryPackage, cache, updateCache, executeScripts bool, sourceDateEpoch *time.Time) error {
-	a.logger.Debugf("installing %s (%s)", pkg.Name, pkg.Version)
+// fetchAlpineKey saves the key at u, closing the response before the next
+// key is fetched.
+func (a *APKImplementation) fetchAlpineKey(client *http.Client, u string) error {
+	res, err := client.Get(u)
+	if err != nil {
+		return fmt.Errorf("failed to fetch alpine key %s: %w", u, err)
+	}
+	defer res.Body.Close()
+	basefilenameEscape := filepath.Base(u)
+	basefilename, err := url.PathUnescape(basefilenameEscape)
+	if err != nil {
+		return fmt.Errorf("failed to unescape key filename %s: %w", basefilenameEscape, err)
+	}
+	filename := filepath.Join(keysDirPath, basefilename)
+	f, err := a.fs.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open key file %s: %w", filename, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, res.Body); err != nil {
+		return fmt.Errorf("failed to write key file %s: %w", filename, err)
+	}
+	return nil
+}
 
+// fetchPackage opens the .apk file for the given package, wherever its repository lives.
+func (a *APKImplementation) fetchPackage(pkg *repository.RepositoryPackage) (io.ReadCloser, error) {
+	if local, ok := a.localPackages[pkg.Package]; ok {
+		f, err := local.open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read local package apk %s: %w", local.entry, err)
+		}
+		return f, nil
+	}
 	u := pkg.Url()
 
 	// Normalize the repo as a URI, so that local paths
 	// are translated into file:// URLs, allowing them to be parsed
 	// into a url.URL{}.
-	var (
-		r     io.Reader
-		asURI uri.URI
-	)
+	var asURI uri.URI
 	if strings.HasPrefix(u, "https://") {
 		asURI, _ = uri.Parse(u)
 	} else {
@@ -567,63 +710,84 @@ func (a *APKImplementation) installPackage(pkg *repository.RepositoryPackage, ca
 	}
 	asURL, err := url.Parse(string(asURI))
 	if err != nil {
-		return fmt.Errorf("failed to parse package as URI: %w", err)
+		return nil, fmt.Errorf("failed to parse package as URI: %w", err)
 	}
 
 	switch asURL.Scheme {
 	case "file":
 		f, err := os.Open(u)
 		if err != nil {
-			return fmt.Errorf("failed to read repository package apk %s: %w", u, err)
+			return nil, fmt.Errorf("failed to read repository package apk %s: %w", u, err)
 		}
-		defer f.Close()
-		r = f
+		return f, nil
 	case "https":
-		client := a.client
-		if client == nil {
-			client = &http.Client{}
-		}
+		client := a.httpClient()
 		res, err := client.Get(u)
 		if err != nil {
-			return fmt.Errorf("unable to get package apk at %s: %w", u, err)
+			return nil, fmt.Errorf("unable to get package apk at %s: %w", u, err)
 		}
-		defer res.Body.Close()
 		if res.StatusCode != http.StatusOK {
-			return fmt.Errorf("unable to get package apk at %s: %v", u, res.Status)
+			res.Body.Close()
+			return nil, fmt.Errorf("unable to get package apk at %s: %v", u, res.Status)
 		}
-		r = res.Body
+		return res.Body, nil
 	default:
-		return fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
+		return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
 	}
+}
 
-	// install the apk file
-	expanded, err := expandApk(r)
+// installPkg install a single package and update installed db.
+//
+//nolint:unparam // we do not use some params... yet.
+func (a *APKImplementation) installPackage(pkg *repository.RepositoryPackage, cache, updateCache, executeScripts bool, sourceDateEpoch *time.Time) error {
+	a.logger.Debugf("installing %s (%s)", pkg.Name, pkg.Version)
+
+	sections, err := a.cachedSections(pkg)
 	if err != nil {
-		return fmt.Errorf("unable to expand apk for package %s: %w", pkg.Name, err)
+		return err
+	}
+	if sections == nil {
+		if sections, err = a.expandPackage(pkg); err != nil {
+			return err
+		}
 	}
-	gzipIn, err := os.Open(expanded.PackageDataTarGzFilename)
+	dataIn, err := sections.openData()
 	if err != nil {
-		return fmt.Errorf("could not open package data file %s for reading: %w", expanded.PackageDataTarGzFilename, err)
+		return fmt.Errorf("could not open package data file %s for reading: %w", sections.data, err)
 	}
-	installedFiles, err := a.installAPKFiles(gzipIn)
+	defer dataIn.Close()
+	installedFiles, err := a.installAPKTarExcept(dataIn, a.excludedFor(pkg.Name), sections.source())
 	if err != nil {
 		return fmt.Errorf("unable to install files for pkg %s: %w", pkg.Name, err)
 	}
 
-	// update the scripts.tar
-	in, err := os.Open(expanded.ControlDataTarGzFilename)
+	in, err := os.Open(sections.control)
 	if err != nil {
-		return fmt.Errorf("unable to open control tar file %s: %w", expanded.ControlDataTarGzFilename, err)
+		return fmt.Errorf("unable to open control tar file %s: %w", sections.control, err)
 	}
 	defer in.Close()
 
+	// the packages it replaces may own the same files
+	info, err := readControlPkgInfo(in, a.limits)
+	if err != nil {
+		return fmt.Errorf("unable to read .PKGINFO of pkg %s: %w", pkg.Name, err)
+	}
+	if err := a.checkFileCollisions(pkg.Name, info.Replaces, installedFiles); err != nil {
+		return err
+	}
+
+	// update the scripts.tar
+	if _, err := in.Seek(0, 0); err != nil {
+		return fmt.Errorf("unable to seek to beginning of control tar file %s: %w", sections.control, err)
+	}
+
 	if err := a.updateScriptsTar(pkg.Package, in, sourceDateEpoch); err != nil {
 		return fmt.Errorf("unable to update scripts.tar for pkg %s: %w", pkg.Name, err)
 	}
 
 	// update the triggers
 	if _, err := in.Seek(0, 0); err != nil {
-		return fmt.Errorf("unable to seek to beginning of control tar file %s: %w", expanded.ControlDataTarGzFilename, err)
+		return fmt.Errorf("unable to seek to beginning of control tar file %s: %w", sections.control, err)
 	}
 	if err := a.updateTriggers(pkg.Package, in); err != nil {
 		return fmt.Errorf("unable to update triggers for pkg %s: %w", pkg.Name, err)
@@ -635,3 +799,59 @@ func (a *APKImplementation) installPackage(pkg *repository.RepositoryPackage, ca
 	}
 	return nil
 }
+
+// expandPackage fetches and expands the package, checking it against its
+// index and the pins of the world, and keeps it in the extraction cache.
+func (a *APKImplementation) expandPackage(pkg *repository.RepositoryPackage) (*packageSections, error) {
+	fetched, err := a.fetchPackage(pkg)
+	if err != nil {
+		return nil, err
+	}
+	r := &progressReader{ReadCloser: fetched, progress: a.progress, size: int64(pkg.Size)}
+	defer r.Close()
+
+	// hash the whole file if its checksum is pinned, or to cache it
+	var source io.Reader = r
+	pin, pinned := a.checksumPins[pkg.Name]
+	_, caching := a.extractionCacheDir(pkg)
+	h := sha256.New()
+	if pinned || caching {
+		source = io.TeeReader(r, h)
+	}
+
+	// install the apk file
+	expanded, err := expandApk(source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to expand apk for package %s: %w", pkg.Name, err)
+	}
+	if pinned || caching {
+		if _, err := io.Copy(io.Discard, source); err != nil {
+			return nil, fmt.Errorf("unable to read apk for package %s: %w", pkg.Name, err)
+		}
+	}
+	apkHash := hex.EncodeToString(h.Sum(nil))
+	if pinned && apkHash != pin {
+		return nil, &ChecksumMismatchError{
+			Package:  fmt.Sprintf("%s-%s", pkg.Name, pkg.Version),
+			URL:      pkg.Url(),
+			Section:  "apk",
+			Expected: pin,
+			Actual:   apkHash,
+		}
+	}
+
+	if err := a.verifyPackage(pkg, expanded); err != nil {
+		return nil, err
+	}
+	if err := a.cacheSections(pkg, expanded, apkHash); err != nil {
+		a.logger.Warnf("unable to cache the extraction of package %s: %v", pkg.Name, err)
+	} else if cached, err := a.cachedSections(pkg); err == nil && cached != nil {
+		// the files may reference the cache rather than be copied
+		return cached, nil
+	}
+	return &packageSections{
+		control:        expanded.ControlDataTarGzFilename,
+		data:           expanded.PackageDataTarGzFilename,
+		dataCompressed: true,
+	}, nil
+}
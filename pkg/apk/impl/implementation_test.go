@@ -73,6 +73,26 @@ func TestInitDB(t *testing.T) {
 	}
 }
 
+func TestInitDBKeepInstalled(t *testing.T) {
+	installed := []byte("P:busybox\nV:1.36.0-r0\n\n")
+	for _, keep := range []bool{false, true} {
+		src := apkfs.NewMemFS()
+		require.NoError(t, src.MkdirAll("lib/apk/db", 0o755))
+		require.NoError(t, src.WriteFile(installedFilePath, installed, 0o644))
+		apk, err := NewAPKImplementation(WithFS(src), WithIgnoreMknodErrors(true), WithOffline(true), WithKeepInstalled(keep))
+		require.NoError(t, err)
+		require.NoError(t, apk.InitDB())
+
+		b, err := src.ReadFile(installedFilePath)
+		require.NoError(t, err)
+		if keep {
+			require.Equal(t, installed, b)
+		} else {
+			require.Empty(t, b)
+		}
+	}
+}
+
 func TestSetWorld(t *testing.T) {
 	src := apkfs.NewMemFS()
 	apk, err := NewAPKImplementation(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors))
@@ -18,6 +18,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"crypto"
 	"errors"
 	"fmt"
 	"io"
@@ -25,7 +26,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
 	"strings"
 
 	"gitlab.alpinelinux.org/alpine/go/repository"
@@ -36,13 +36,18 @@ import (
 // The signatures for each index are verified unless ignoreSignatures is set to true.
 // The key-value pairs in the map for `keys` are the name of the key and the contents of the key.
 // The name is just indicative. If it finds a match, it will use it. Else, it will try all keys.
+// Signatures may use any of the RSA (SHA1), RSA256 (SHA256) and RSA512 (SHA512) schemes;
+// an index is accepted as soon as one of its signatures verifies.
+// WithSignaturePolicy restricts which of the keys may sign each repository.
+// WithIndexOffline returns the local indexes along with an *OfflineError listing the others.
+// WithIndexNoarch also gets the noarch index of each repository, if there is one.
 func GetRepositoryIndexes(repos []string, keys map[string][]byte, arch string, options ...IndexOption) (indexes []*namedRepositoryWithIndex, err error) {
 	opts := &indexOpts{}
 	for _, opt := range options {
 		opt(opts)
 	}
-	r := regexp.MustCompile(`^\.SIGN\.RSA\.(.*\.rsa\.pub)$`)
 
+	var missing []string
 	for _, repo := range repos {
 		// does it start with a pin?
 		var (
@@ -59,122 +64,89 @@ func GetRepositoryIndexes(repos []string, keys map[string][]byte, arch string, o
 			repoURL = parts[1]
 		}
 
-		repoBase := fmt.Sprintf("%s/%s", repoURL, arch)
-		u := fmt.Sprintf("%s/%s", repoBase, indexFilename)
-
-		// Normalize the repo as a URI, so that local paths
-		// are translated into file:// URLs, allowing them to be parsed
-		// into a url.URL{}.
-		var (
-			b     []byte
-			asURI uri.URI
-		)
-		if strings.HasPrefix(u, "https://") {
-			asURI, _ = uri.Parse(u)
-		} else {
-			asURI = uri.New(u)
-		}
-		asURL, err := url.Parse(string(asURI))
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse repo as URI: %w", err)
+		archs := []string{arch}
+		if opts.noarch && arch != noarchArch {
+			archs = append(archs, noarchArch)
 		}
+		for _, repoArch := range archs {
+			fallback := repoArch != arch
+			repoBase := fmt.Sprintf("%s/%s", repoURL, repoArch)
+			u := fmt.Sprintf("%s/%s", repoBase, indexFilename)
 
-		switch asURL.Scheme {
-		case "file":
-			b, err = os.ReadFile(u)
-			if err != nil {
-				if !errors.Is(err, fs.ErrNotExist) {
-					return nil, fmt.Errorf("failed to read repository %s: %w", u, err)
-				}
-				continue
-			}
-		case "https":
-			client := opts.httpClient
-			if client == nil {
-				client = &http.Client{}
+			// Normalize the repo as a URI, so that local paths
+			// are translated into file:// URLs, allowing them to be parsed
+			// into a url.URL{}.
+			var (
+				b     []byte
+				asURI uri.URI
+			)
+			if strings.HasPrefix(u, "https://") {
+				asURI, _ = uri.Parse(u)
+			} else {
+				asURI = uri.New(u)
 			}
-			res, err := client.Get(asURL.String()) // nolint:gosec // we know what we are doing here
+			asURL, err := url.Parse(string(asURI))
 			if err != nil {
-				return nil, fmt.Errorf("unable to get repository index at %s: %w", u, err)
+				return nil, fmt.Errorf("failed to parse repo as URI: %w", err)
 			}
-			defer res.Body.Close()
-			buf := bytes.NewBuffer(nil)
-			if _, err := io.Copy(buf, res.Body); err != nil {
-				return nil, fmt.Errorf("unable to read repository index at %s: %w", u, err)
-			}
-			b = buf.Bytes()
-		default:
-			return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
-		}
 
-		// validate the signature
-		if !opts.ignoreSignatures {
-			buf := bytes.NewReader(b)
-			gzipReader, err := gzip.NewReader(buf)
-			if err != nil {
-				return nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
+			switch asURL.Scheme {
+			case "file":
+				f, err := os.Open(u)
+				if err != nil {
+					if !errors.Is(err, fs.ErrNotExist) {
+						return nil, fmt.Errorf("failed to read repository %s: %w", u, err)
+					}
+					continue
+				}
+				b, err = io.ReadAll(limitReader(f, opts.limits.MaxIndexSize, "repository index"))
+				f.Close()
+				if err != nil {
+					return nil, fmt.Errorf("failed to read repository %s: %w", u, err)
+				}
+			case "https":
+				if opts.offline {
+					// the noarch index is optional, so not missing
+					if !fallback {
+						missing = append(missing, u)
+					}
+					continue
+				}
+				client := opts.httpClient
+				if client == nil {
+					client = &http.Client{}
+				}
+				var status int
+				b, status, err = fetchIndex(client, asURL.String(), opts.limits)
+				if err != nil {
+					return nil, fmt.Errorf("unable to get repository index at %s: %w", u, err)
+				}
+				if fallback && status == http.StatusNotFound {
+					continue
+				}
+			default:
+				return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
 			}
-			// set multistream to false, so we can read each part separately;
-			// the first part is the signature, the second is the index, which should be
-			// verified.
-			gzipReader.Multistream(false)
-			defer gzipReader.Close()
-
-			tarReader := tar.NewReader(gzipReader)
 
-			// read the signature
-			signatureFile, err := tarReader.Next()
-			if err != nil {
-				return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
-			}
-			matches := r.FindStringSubmatch(signatureFile.Name)
-			if len(matches) != 2 {
-				return nil, fmt.Errorf("failed to find key name in signature file name: %s", signatureFile.Name)
-			}
-			signature, err := io.ReadAll(tarReader)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
-			}
-			// with multistream false, we should read the next one
-			if _, err := tarReader.Next(); err != nil && !errors.Is(err, io.EOF) {
-				return nil, fmt.Errorf("unexpected error reading from tgz: %w", err)
-			}
-			// we now have the signature bytes and name, get the contents of the rest;
-			// this should be everything else in the raw gzip file as is.
-			allBytes := len(b)
-			unreadBytes := buf.Len()
-			readBytes := allBytes - unreadBytes
-			indexData := b[readBytes:]
-
-			indexDigest, err := HashData(indexData)
-			if err != nil {
-				return nil, err
-			}
-			// now we can check the signature
-			if keys == nil {
-				return nil, fmt.Errorf("no keys provided to verify signature")
-			}
-			var verified bool
-			keyData, ok := keys[matches[1]]
-			if ok {
-				if err := RSAVerifySHA1Digest(indexDigest, signature, keyData); err != nil {
-					verified = false
+			// validate the signature against the keys allowed for the repository
+			if !opts.ignoreSignatures {
+				mode, allowed := opts.policy.forRepository(repoURL)
+				repoKeys, err := allowedKeys(keys, allowed)
+				if err == nil {
+					err = verifyIndexSignature(b, repoKeys)
 				}
-			}
-			if !verified {
-				for _, keyData := range keys {
-					if err := RSAVerifySHA1Digest(indexDigest, signature, keyData); err == nil {
-						verified = true
-						break
+				if err != nil {
+					if mode != SignatureModeWarn {
+						return nil, fmt.Errorf("unable to verify repository index at %s: %w", u, err)
+					}
+					if opts.logger != nil {
+						opts.logger.Warnf("unable to verify repository index at %s, continuing as the signature policy only warns: %v", u, err)
 					}
 				}
 			}
-			if !verified {
-				return nil, fmt.Errorf("no key found to verify signature for keyfile %s; tried all other keys as well", matches[1])
-			}
 
 			// with a valid signature, convert it to an ApkIndex
-			index, err := repository.IndexFromArchive(io.NopCloser(bytes.NewReader(b)))
+			index, err := indexFromArchive(bytes.NewReader(b), opts.limits)
 			if err != nil {
 				return nil, fmt.Errorf("unable to read convert repository index bytes to index struct at %s: %w", u, err)
 			}
@@ -182,15 +154,136 @@ func GetRepositoryIndexes(repos []string, keys map[string][]byte, arch string, o
 			indexes = append(indexes, NewNamedRepositoryWithIndex(repoName, repoRef.WithIndex(index)))
 		}
 	}
+	if len(missing) > 0 {
+		return indexes, &OfflineError{Missing: missing}
+	}
 	return indexes, nil
 }
 
+// fetchIndex downloads an index, closing the response body before returning
+// so that a connection limited transport gets the connection back before the
+// next index is fetched.
+func fetchIndex(client *http.Client, u string, limits InputLimits) ([]byte, int, error) {
+	res, err := client.Get(u) // nolint:gosec // we know what we are doing here
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	buf := bytes.NewBuffer(nil)
+	if _, err := io.Copy(buf, limitReader(res.Body, limits.MaxIndexSize, "repository index")); err != nil {
+		return nil, res.StatusCode, fmt.Errorf("reading: %w", err)
+	}
+	return buf.Bytes(), res.StatusCode, nil
+}
+
+// verifyIndexSignature checks the signature segment at the head of a signed
+// APKINDEX against the given keys. The segment may hold several signatures,
+// e.g. a legacy SHA1 one alongside a SHA256 one; any valid signature is
+// enough to accept the index.
+func verifyIndexSignature(b []byte, keys map[string][]byte) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys provided to verify signature")
+	}
+
+	buf := bytes.NewReader(b)
+	gzipReader, err := gzip.NewReader(buf)
+	if err != nil {
+		return fmt.Errorf("unable to create gzip reader for repository index: %w", err)
+	}
+	// set multistream to false, so we can read each part separately;
+	// the first part is the signature, the second is the index, which should be
+	// verified.
+	gzipReader.Multistream(false)
+	defer gzipReader.Close()
+
+	type indexSignature struct {
+		keyName   string
+		hash      crypto.Hash
+		signature []byte
+	}
+	var signatures []indexSignature
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		hdr, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read signature from repository index: %w", err)
+		}
+		keyName, hash, ok := parseSignatureName(hdr.Name)
+		if !ok {
+			return fmt.Errorf("failed to find key name in signature file name: %s", hdr.Name)
+		}
+		signature, err := io.ReadAll(tarReader)
+		if err != nil {
+			return fmt.Errorf("failed to read signature from repository index: %w", err)
+		}
+		signatures = append(signatures, indexSignature{keyName: keyName, hash: hash, signature: signature})
+	}
+	if len(signatures) == 0 {
+		return fmt.Errorf("repository index is not signed")
+	}
+
+	// we now have the signatures, get the contents of the rest;
+	// this should be everything else in the raw gzip file as is.
+	indexData := b[len(b)-buf.Len():]
+
+	digests := map[crypto.Hash][]byte{}
+	for _, sig := range signatures {
+		digest, ok := digests[sig.hash]
+		if !ok {
+			digest, err = HashDataWith(indexData, sig.hash)
+			if err != nil {
+				return err
+			}
+			digests[sig.hash] = digest
+		}
+
+		// try the named key first, then fall back to all the others
+		if keyData, ok := keys[sig.keyName]; ok {
+			if err := RSAVerifyDigest(digest, sig.signature, keyData, sig.hash); err == nil {
+				return nil
+			}
+		}
+		for name, keyData := range keys {
+			if name == sig.keyName {
+				continue
+			}
+			if err := RSAVerifyDigest(digest, sig.signature, keyData, sig.hash); err == nil {
+				return nil
+			}
+		}
+	}
+
+	names := make([]string, 0, len(signatures))
+	for _, sig := range signatures {
+		names = append(names, sig.keyName)
+	}
+	return fmt.Errorf("no key found to verify signature for keyfile %s; tried all other keys as well", strings.Join(names, ", "))
+}
+
 type indexOpts struct {
 	ignoreSignatures bool
 	httpClient       *http.Client
+	policy           SignaturePolicy
+	logger           Logger
+	limits           InputLimits
+	offline          bool
+	noarch           bool
 }
 type IndexOption func(*indexOpts)
 
+// WithIndexNoarch also gets the index of the noarch packages of each
+// repository, e.g. https://example.com/os/noarch/APKINDEX.tar.gz, which is
+// skipped if missing.
+func WithIndexNoarch(noarch bool) IndexOption {
+	return func(o *indexOpts) {
+		o.noarch = noarch
+	}
+}
+
 func WithIgnoreSignatures(ignoreSignatures bool) IndexOption {
 	return func(o *indexOpts) {
 		o.ignoreSignatures = ignoreSignatures
@@ -202,3 +295,13 @@ func WithHTTPClient(c *http.Client) IndexOption {
 		o.httpClient = c
 	}
 }
+
+// WithSignaturePolicy restricts the keys which may sign each repository.
+// Failures for repositories the policy only warns about are logged to
+// logger, if not nil.
+func WithSignaturePolicy(policy SignaturePolicy, logger Logger) IndexOption {
+	return func(o *indexOpts) {
+		o.policy = policy
+		o.logger = logger
+	}
+}
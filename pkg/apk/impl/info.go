@@ -0,0 +1,96 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// PackageInfo is the metadata of a package of a repository.
+type PackageInfo struct {
+	Name          string    `json:"name"`
+	Version       string    `json:"version"`
+	Arch          string    `json:"arch"`
+	Description   string    `json:"description,omitempty"`
+	License       string    `json:"license,omitempty"`
+	URL           string    `json:"url,omitempty"`
+	Origin        string    `json:"origin,omitempty"`
+	Maintainer    string    `json:"maintainer,omitempty"`
+	Commit        string    `json:"commit,omitempty"`
+	BuildTime     time.Time `json:"buildTime"`
+	Size          uint64    `json:"size"`
+	InstalledSize uint64    `json:"installedSize"`
+	Dependencies  []string  `json:"dependencies,omitempty"`
+	Provides      []string  `json:"provides,omitempty"`
+	InstallIf     []string  `json:"installIf,omitempty"`
+	// Checksum is the checksum of the control section of the package, as
+	// the index records it, e.g. Q1eT0rBzSiuDaCoz5aTnhE9ftFnss=.
+	Checksum   string `json:"checksum,omitempty"`
+	Repository string `json:"repository"`
+}
+
+// NewPackageInfo returns the metadata of the package of a repository.
+func NewPackageInfo(pkg *repository.RepositoryPackage) PackageInfo {
+	info := PackageInfo{
+		Name:          pkg.Name,
+		Version:       pkg.Version,
+		Arch:          pkg.Arch,
+		Description:   pkg.Description,
+		License:       pkg.License,
+		URL:           pkg.URL,
+		Origin:        pkg.Origin,
+		Maintainer:    pkg.Maintainer,
+		Commit:        pkg.RepoCommit,
+		BuildTime:     pkg.BuildTime,
+		Size:          pkg.Size,
+		InstalledSize: pkg.InstalledSize,
+		Dependencies:  pkg.Dependencies,
+		Provides:      pkg.Provides,
+		InstallIf:     pkg.InstallIf,
+		Repository:    pkg.Repository().Uri,
+	}
+	if len(pkg.Checksum) > 0 {
+		info.Checksum = "Q1" + base64.StdEncoding.EncodeToString(pkg.Checksum)
+	}
+	return info
+}
+
+// Info returns the metadata of the packages of the repositories matching the
+// name, e.g. "busybox", "busybox=1.36.0-r0" or "cmd:sh", like in the world:
+// every version of the package, or every provider, starting with the one
+// which would be installed.
+func (a *APKImplementation) Info(pkgName string) ([]PackageInfo, error) {
+	indexes, err := a.getRepositoryIndexes(false)
+	if err != nil {
+		return nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	named := make([]NamedIndex, 0, len(indexes))
+	for _, index := range indexes {
+		named = append(named, index)
+	}
+	pkgs, err := NewPkgResolver(named).ResolvePackage(pkgName)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]PackageInfo, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		infos = append(infos, NewPackageInfo(pkg))
+	}
+	return infos, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestNewPackageInfo(t *testing.T) {
+	repo := &repository.RepositoryWithIndex{Repository: &repository.Repository{Uri: "https://example.com/os/x86_64"}}
+	info := NewPackageInfo(repository.NewRepositoryPackage(&repository.Package{
+		Name:         "busybox",
+		Version:      "1.36.0-r0",
+		License:      "GPL-2.0-only",
+		Checksum:     []byte{0x01, 0x02, 0x03},
+		Dependencies: []string{"so:libc.musl-x86_64.so.1"},
+	}, repo))
+
+	require.Equal(t, "busybox", info.Name)
+	require.Equal(t, "1.36.0-r0", info.Version)
+	require.Equal(t, "GPL-2.0-only", info.License)
+	require.Equal(t, "Q1AQID", info.Checksum)
+	require.Equal(t, []string{"so:libc.musl-x86_64.so.1"}, info.Dependencies)
+	require.Equal(t, "https://example.com/os/x86_64", info.Repository)
+
+	info = NewPackageInfo(repository.NewRepositoryPackage(&repository.Package{Name: "unsigned"}, repo))
+	require.Empty(t, info.Checksum)
+}
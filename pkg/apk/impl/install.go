@@ -22,8 +22,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
 )
 
 // writeOneFile writes one file from the APK given the tar header and tar reader.
@@ -34,6 +41,12 @@ func (a *APKImplementation) writeOneFile(header *tar.Header, r io.Reader) error
 	}
 	defer f.Close()
 
+	if isSparse(header) {
+		if err := copySparse(f, r, header.Size); err != nil {
+			return fmt.Errorf("unable to write content for %s: %w", header.Name, err)
+		}
+		return nil
+	}
 	if _, err := io.CopyN(f, r, header.Size); err != nil {
 		return fmt.Errorf("unable to write content for %s: %w", header.Name, err)
 	}
@@ -41,23 +54,157 @@ func (a *APKImplementation) writeOneFile(header *tar.Header, r io.Reader) error
 	return nil
 }
 
+// sparseBlockSize is the granularity at which copySparse looks for holes.
+const sparseBlockSize = 4096
+
+// copySparse copies size bytes of content to the file, seeking over the
+// blocks of zeros rather than writing them, so that the file has holes
+// where the filesystem supports them, rather than being written densely.
+func copySparse(f io.WriteSeeker, r io.Reader, size int64) error {
+	buf := make([]byte, sparseBlockSize)
+	hole := false
+	for remaining := size; remaining > 0; {
+		n := int64(len(buf))
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return err
+		}
+		remaining -= n
+		if isZero(buf[:n]) {
+			if _, err := f.Seek(n, io.SeekCurrent); err != nil {
+				return err
+			}
+			hole = true
+			continue
+		}
+		if _, err := f.Write(buf[:n]); err != nil {
+			return err
+		}
+		hole = false
+	}
+	if hole {
+		// a hole at the end only sizes the file once written past
+		if _, err := f.Seek(-1, io.SeekCurrent); err != nil {
+			return err
+		}
+		if _, err := f.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// copyFile copies the content and mode of the file at src to dst.
+func (a *APKImplementation) copyFile(src, dst string) error {
+	fi, err := a.fs.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", src)
+	}
+	in, err := a.fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := a.fs.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+
+	// OpenFile does not set special bits, such as setuid, and is subject to the umask
+	return a.fs.Chmod(dst, fi.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky))
+}
+
 // installAPKFiles install the files from the APK and return the list of installed files
 // and their permissions. Returns a tar.Header because it is a convenient existing
 // struct that has all of the fields we need.
 func (a *APKImplementation) installAPKFiles(gzipIn io.Reader) ([]tar.Header, error) {
-	var files []tar.Header
+	return a.installAPKFilesExcept(gzipIn, nil)
+}
+
+// installAPKFilesExcept is installAPKFiles, leaving out the excluded paths.
+func (a *APKImplementation) installAPKFilesExcept(gzipIn io.Reader, exclude pathMatcher) ([]tar.Header, error) {
 	gr, err := gzip.NewReader(gzipIn)
 	if err != nil {
 		return nil, err
 	}
+	return a.installAPKTarExcept(gr, exclude, "")
+}
+
+// offsetReader keeps track of how much of the reader was read.
+type offsetReader struct {
+	r      io.Reader
+	offset int64
+}
+
+func (o *offsetReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+// isSparse reports whether the content of the file is not laid out as is in
+// the tar stream, but as a sparse map and the parts which are not holes.
+func isSparse(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range header.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// installAPKTarExcept is installAPKFilesExcept, from the decompressed tar
+// stream, e.g. of the extraction cache. If the stream is the file at source,
+// filesystems which can reference the content of their files there rather
+// than copying it do so.
+func (a *APKImplementation) installAPKTarExcept(tarIn io.Reader, exclude pathMatcher, source string) ([]tar.Header, error) {
+	var (
+		refFS   apkfs.ReferenceFS
+		counter *offsetReader
+	)
+	if fsys, ok := a.fs.(apkfs.ReferenceFS); ok && source != "" {
+		refFS, counter = fsys, &offsetReader{r: tarIn}
+		tarIn = counter
+	}
+	var files []tar.Header
 	// per https://git.alpinelinux.org/apk-tools/tree/src/extract_v2.c?id=337734941831dae9a6aa441e38611c43a5fd72c0#n120
 	//  * APKv1.0 compatibility - first non-hidden file is
 	//  * considered to start the data section of the file.
 	//  * This does not make any sense if the file has v2.0
 	//  * style .PKGINFO
 	var startedDataSection bool
-	tr := tar.NewReader(gr)
+	// records of the PAX global extended headers seen so far, which apply to
+	// all the entries following them
+	globalRecords := map[string]string{}
+	// checksums of the regular files installed so far, for the hardlinks to them
+	checksums := map[string]string{}
+	tr := tar.NewReader(tarIn)
 	for {
+		// PAX extended headers and GNU long names are merged into the header of
+		// the entry they belong to by the reader, and the PAX records kept in
+		// PAXRecords.
 		header, err := tr.Next()
 		if errors.Is(err, io.EOF) {
 			break
@@ -65,6 +212,33 @@ func (a *APKImplementation) installAPKFiles(gzipIn io.Reader) ([]tar.Header, err
 		if err != nil {
 			return nil, err
 		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			for k, v := range header.PAXRecords {
+				// an empty value removes the record
+				if v == "" {
+					delete(globalRecords, k)
+				} else {
+					globalRecords[k] = v
+				}
+			}
+			continue
+		}
+		if err := applyGlobalPAXRecords(header, globalRecords); err != nil {
+			return nil, fmt.Errorf("invalid PAX global header for %s: %w", header.Name, err)
+		}
+		if header.Name == "" {
+			return nil, fmt.Errorf("tar entry of type %v without a name", header.Typeflag)
+		}
+		if !a.unsafePaths {
+			if err := checkPath(header.Name); err != nil {
+				return nil, err
+			}
+			if header.Typeflag == tar.TypeLink {
+				if err := checkPath(header.Linkname); err != nil {
+					return nil, fmt.Errorf("hardlink %s: %w", header.Name, err)
+				}
+			}
+		}
 		// if it was a hidden file and not a directory and we have not yet started the data section,
 		// so skip this file
 		if !startedDataSection && header.Name[0] == '.' && !strings.Contains(header.Name, "/") {
@@ -73,52 +247,228 @@ func (a *APKImplementation) installAPKFiles(gzipIn io.Reader) ([]tar.Header, err
 		// whatever it is now, it is in the data section
 		startedDataSection = true
 
+		if exclude.matches(header.Name) {
+			continue
+		}
+		if header.Typeflag == tar.TypeLink && exclude.matches(header.Linkname) {
+			a.logger.Debugf("not installing %s, a hardlink to the excluded %s", header.Name, header.Linkname)
+			continue
+		}
+
+		// whether the entry is a directory kept as a symlink to one
+		var keptSymlink bool
 		switch header.Typeflag {
 		case tar.TypeDir:
 			// special case, if the target already exists, and it is a symlink to a directory, we can accept it as is
 			// otherwise, we need to create the directory.
-			if fi, err := a.fs.Stat(header.Name); err == nil && fi.Mode()&os.ModeSymlink != 0 {
-				if target, err := a.fs.Readlink(header.Name); err == nil {
-					if fi, err = a.fs.Stat(target); err == nil && fi.IsDir() {
-						// "break" rather than "continue", so that any handling outside of this switch statement is processed
-						break
-					}
+			if fi, err := a.fs.Lstat(header.Name); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				// the target may be relative to the directory of the symlink, which Stat resolves
+				if fi, err = a.fs.Stat(header.Name); err == nil && fi.IsDir() {
+					keptSymlink = true
+					// "break" rather than "continue", so that any handling outside of this switch statement is processed
+					break
 				}
 			}
 			if err := a.fs.MkdirAll(header.Name, header.FileInfo().Mode().Perm()); err != nil {
 				return nil, fmt.Errorf("error creating directory %s: %w", header.Name, err)
 			}
-		case tar.TypeReg:
+		case tar.TypeReg, tar.TypeGNUSparse:
 			// we need to calculate the checksum of the file while reading it
 			w := sha1.New() //nolint:gosec // this is what apk tools is using
-			tee := io.TeeReader(tr, w)
-			if err := a.writeOneFile(header, tee); err != nil {
+			if refFS != nil && !isSparse(header) {
+				// the reader does not read ahead, so the content starts where it is
+				ref := apkfs.FileReference{Path: source, Offset: counter.offset, Size: header.Size}
+				if err := refFS.WriteFileReference(header.Name, ref, header.FileInfo().Mode()); err != nil {
+					return nil, fmt.Errorf("error creating file %s: %w", header.Name, err)
+				}
+				if _, err := io.Copy(w, tr); err != nil {
+					return nil, fmt.Errorf("unable to read content for %s: %w", header.Name, err)
+				}
+			} else if err := a.writeOneFile(header, io.TeeReader(tr, w)); err != nil {
 				return nil, err
 			}
+			// the tar reader expands sparse files, which are regular files once written
+			header.Typeflag = tar.TypeReg
 			// it uses this format
 			checksum := fmt.Sprintf("Q1%s", base64.StdEncoding.EncodeToString(w.Sum(nil)))
 			// we need to save this somewhere. The output expects []tar.Header, so we need to override that.
 			// Reusing a field should be good enough, provided that we know it is not getting in the way of
 			// anything downstream. Since we know it is not, this is good enough.
-			if header.PAXRecords == nil {
-				header.PAXRecords = make(map[string]string)
-			}
-			header.PAXRecords[paxRecordsChecksumKey] = checksum
+			setChecksum(header, checksum)
+			checksums[header.Name] = checksum
 		case tar.TypeSymlink:
 			// some underlying filesystems and some memfs that we use in tests do not support symlinks.
 			// attempt it, and if it fails, just copy it.
 			if err := a.fs.Symlink(header.Linkname, header.Name); err != nil {
 				return nil, err
 			}
+			// apk-tools checksums the target of symlinks
+			sum := sha1.Sum([]byte(header.Linkname)) //nolint:gosec // this is what apk tools is using
+			setChecksum(header, fmt.Sprintf("Q1%s", base64.StdEncoding.EncodeToString(sum[:])))
 		case tar.TypeLink:
+			// some underlying filesystems and some memfs cannot hardlink.
+			// attempt it, and if it fails, copy the original file instead.
 			if err := a.fs.Link(header.Linkname, header.Name); err != nil {
-				return nil, err
+				if errors.Is(err, fs.ErrExist) || errors.Is(err, fs.ErrNotExist) {
+					return nil, err
+				}
+				a.logger.Debugf("unable to hardlink %s to %s, copying it instead: %v", header.Name, header.Linkname, err)
+				if err := a.copyFile(header.Linkname, header.Name); err != nil {
+					return nil, fmt.Errorf("unable to hardlink or copy %s to %s: %w", header.Linkname, header.Name, err)
+				}
+			}
+			// hardlinks have the content, and so the checksum, of their target
+			if checksum, ok := checksums[header.Linkname]; ok {
+				setChecksum(header, checksum)
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			// filesystems which cannot create them, e.g. when not running as root, keep track of them
+			// without a real device or pipe
+			if err := a.installSpecialFile(header); err != nil {
+				if !a.ignoreMknodErrors {
+					return nil, err
+				}
+				a.logger.Warnf("ignoring error creating %s: %v", header.Name, err)
 			}
 		default:
 			return nil, fmt.Errorf("unsupported file type %v", header.Typeflag)
 		}
+		// hardlinks share the attributes of their target, and symlinks have no permissions
+		// or attributes of their own, only an owner
+		uid, gid := header.Uid, header.Gid
+		if header.Typeflag == tar.TypeSymlink {
+			if err := a.fs.Lchown(header.Name, uid, gid); err != nil {
+				return nil, fmt.Errorf("unable to change ownership of %s to %d:%d: %w", header.Name, uid, gid, err)
+			}
+		}
+		// the time from the package, which the layer keeps or not, depending on its policy;
+		// a special file which could not be created, and was ignored, has none
+		if header.Typeflag != tar.TypeLink && !keptSymlink {
+			if err := a.fs.SetModTime(header.Name, header.ModTime); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("unable to set the modification time of %s: %w", header.Name, err)
+			}
+		}
+		if header.Typeflag != tar.TypeLink && header.Typeflag != tar.TypeSymlink && !keptSymlink {
+			if err := a.fs.Chown(header.Name, uid, gid); err != nil {
+				return nil, fmt.Errorf("unable to change ownership of %s to %d:%d: %w", header.Name, uid, gid, err)
+			}
+			if err := a.applyXattrs(header); err != nil {
+				return nil, err
+			}
+		}
 		files = append(files, *header)
+		a.progress.Extract(len(files))
 	}
 
 	return files, nil
 }
+
+// setChecksum records the apk-tools checksum of an installed file in its
+// header, for the installed database.
+func setChecksum(header *tar.Header, checksum string) {
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[paxRecordsChecksumKey] = checksum
+}
+
+// installSpecialFile creates a device node or a named pipe from the APK.
+func (a *APKImplementation) installSpecialFile(header *tar.Header) error {
+	perm := header.FileInfo().Mode().Perm()
+	if header.Typeflag == tar.TypeFifo {
+		if err := a.fs.Mkfifo(header.Name, perm); err != nil {
+			return fmt.Errorf("error creating named pipe %s: %w", header.Name, err)
+		}
+		return nil
+	}
+	mode := uint32(unix.S_IFCHR)
+	if header.Typeflag == tar.TypeBlock {
+		mode = unix.S_IFBLK
+	}
+	dev := int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))
+	if err := a.fs.Mknod(header.Name, mode|uint32(perm), dev); err != nil {
+		return fmt.Errorf("error creating device %s: %w", header.Name, err)
+	}
+	return nil
+}
+
+// applyXattrs sets the extended attributes found in the PAX records of the
+// header, such as file capabilities, on the installed file.
+func (a *APKImplementation) applyXattrs(header *tar.Header) error {
+	for k, v := range header.PAXRecords {
+		attr := strings.TrimPrefix(k, paxRecordsXattrPrefix)
+		if attr == k || attr == "" {
+			continue
+		}
+		if err := a.fs.SetXattr(header.Name, attr, []byte(v)); err != nil {
+			return fmt.Errorf("unable to set extended attribute %s on %s: %w", attr, header.Name, err)
+		}
+	}
+	return nil
+}
+
+// applyGlobalPAXRecords applies the records of PAX global extended headers to
+// a header, unless its own PAX records override them. The records which only
+// make sense for a single entry, such as its path and size, are ignored, and
+// the ones which do not map to a header field are kept in PAXRecords.
+func applyGlobalPAXRecords(header *tar.Header, records map[string]string) error {
+	for k, v := range records {
+		if _, ok := header.PAXRecords[k]; ok {
+			continue
+		}
+		switch k {
+		case "path", "linkpath", "size":
+			continue
+		case "uid", "gid":
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", k, v, err)
+			}
+			if k == "uid" {
+				header.Uid = id
+			} else {
+				header.Gid = id
+			}
+		case "uname":
+			header.Uname = v
+		case "gname":
+			header.Gname = v
+		case "mtime":
+			mtime, err := parsePAXTime(v)
+			if err != nil {
+				return fmt.Errorf("invalid mtime %q: %w", v, err)
+			}
+			header.ModTime = mtime
+		}
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[k] = v
+	}
+	return nil
+}
+
+// parsePAXTime parses a PAX timestamp, seconds since the epoch with an
+// optional fraction, e.g. 1680000000.123456789.
+func parsePAXTime(s string) (time.Time, error) {
+	secs, frac, _ := strings.Cut(s, ".")
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nsec int64
+	if frac != "" {
+		// only nanoseconds are kept
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		frac += strings.Repeat("0", 9-len(frac))
+		if nsec, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return time.Time{}, err
+		}
+		if strings.HasPrefix(secs, "-") {
+			nsec = -nsec
+		}
+	}
+	return time.Unix(sec, nsec), nil
+}
@@ -18,11 +18,18 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"io/fs"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/tarball"
 )
 
 func TestInstallAPKFiles(t *testing.T) {
@@ -128,3 +135,353 @@ func TestInstallAPKFiles(t *testing.T) {
 		require.True(t, bytes.Equal(actual, f.content), "unexpected content for %s: expected %q, got %q", f.name, f.content, actual)
 	}
 }
+
+// noLinkFS is a filesystem which cannot hardlink.
+type noLinkFS struct {
+	apkfs.FullFS
+}
+
+func (noLinkFS) Link(oldname, newname string) error {
+	return errors.New("hardlinks not supported")
+}
+
+func TestInstallAPKFilesHardlinkFallback(t *testing.T) {
+	src := noLinkFS{apkfs.NewMemFS()}
+	apk, err := NewAPKImplementation(WithFS(src))
+	require.NoError(t, err)
+
+	content := []byte("busybox binary")
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "bin", Typeflag: tar.TypeDir, Mode: 0o755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0o4755, Size: int64(len(content))}))
+	_, err = tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	headers, err := apk.installAPKFiles(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, headers, 3)
+
+	actual, err := src.ReadFile("bin/sh")
+	require.NoError(t, err)
+	require.Equal(t, content, actual)
+	fi, err := src.Stat("bin/sh")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSetuid|0o755, fi.Mode())
+}
+
+func TestInstallAPKFilesLongNames(t *testing.T) {
+	apk, src, err := testGetTestAPK()
+	require.NoError(t, err)
+
+	dir := "usr/lib/" + strings.Repeat("very-long-directory-name/", 5)
+	paxName := dir + "pax-file"
+	gnuName := dir + "gnu-file"
+	content := []byte("hello")
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		Name:       "pax_global_header",
+		PAXRecords: map[string]string{"uid": "1000", "APKO.test.origin": "global"},
+	}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0o755, Format: tar.FormatPAX}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Name:       paxName,
+		Typeflag:   tar.TypeReg,
+		Mode:       0o644,
+		Uid:        2000,
+		Size:       int64(len(content)),
+		PAXRecords: map[string]string{"APKO.test.extra": "kept", "uid": "2000"},
+		Format:     tar.FormatPAX,
+	}))
+	_, err = tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Name:     gnuName,
+		Typeflag: tar.TypeSymlink,
+		Linkname: paxName,
+		Format:   tar.FormatGNU,
+	}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	headers, err := apk.installAPKFiles(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, headers, 3)
+
+	require.Equal(t, strings.TrimSuffix(dir, "/"), strings.TrimSuffix(headers[0].Name, "/"))
+	require.Equal(t, 1000, headers[0].Uid)
+	require.Equal(t, "global", headers[0].PAXRecords["APKO.test.origin"])
+
+	require.Equal(t, paxName, headers[1].Name)
+	require.Equal(t, 2000, headers[1].Uid)
+	require.Equal(t, "kept", headers[1].PAXRecords["APKO.test.extra"])
+	require.Equal(t, "global", headers[1].PAXRecords["APKO.test.origin"])
+	require.NotEmpty(t, headers[1].PAXRecords[paxRecordsChecksumKey])
+
+	require.Equal(t, gnuName, headers[2].Name)
+	require.Equal(t, paxName, headers[2].Linkname)
+
+	actual, err := src.ReadFile(paxName)
+	require.NoError(t, err)
+	require.Equal(t, content, actual)
+	target, err := src.Readlink(gnuName)
+	require.NoError(t, err)
+	require.Equal(t, paxName, target)
+}
+
+func TestParsePAXTime(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want time.Time
+	}{
+		{"1680000000", time.Unix(1680000000, 0)},
+		{"1680000000.5", time.Unix(1680000000, 500000000)},
+		{"1680000000.1234567891", time.Unix(1680000000, 123456789)},
+	} {
+		got, err := parsePAXTime(tt.in)
+		require.NoError(t, err)
+		require.True(t, tt.want.Equal(got), "%s: got %v", tt.in, got)
+	}
+	_, err := parsePAXTime("yesterday")
+	require.Error(t, err)
+}
+
+func TestInstallAPKFilesXattrs(t *testing.T) {
+	apk, src, err := testGetTestAPK()
+	require.NoError(t, err)
+
+	capability := string([]byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x20, 0x00, 0x00})
+	content := []byte("ping binary")
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "bin", Typeflag: tar.TypeDir, Mode: 0o755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Name:     "bin/ping",
+		Typeflag: tar.TypeReg,
+		Mode:     0o755,
+		Size:     int64(len(content)),
+		PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": capability,
+			"SCHILY.xattr.user.origin":         "wolfi",
+		},
+	}))
+	_, err = tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	_, err = apk.installAPKFiles(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	xattrs, err := src.ListXattrs("bin/ping")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{
+		"security.capability": []byte(capability),
+		"user.origin":         []byte("wolfi"),
+	}, xattrs)
+}
+
+func TestInstallAPKFilesOwnership(t *testing.T) {
+	src := apkfs.NewMemFS()
+	apk, err := NewAPKImplementation(WithFS(src))
+	require.NoError(t, err)
+
+	content := []byte("data")
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "var/lib/postgresql", Typeflag: tar.TypeDir, Mode: 0o700, Uid: 70, Gid: 70}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "var/lib/postgresql/data", Typeflag: tar.TypeReg, Mode: 0o600, Uid: 70, Gid: 70, Size: int64(len(content))}))
+	_, err = tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "var/lib/postgresql/current", Typeflag: tar.TypeSymlink, Linkname: "data", Mode: 0o777, Uid: 70, Gid: 70}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	headers, err := apk.installAPKFiles(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	// the image and the installed database both have the owners of the package
+	require.Equal(t, 70, headers[0].Uid)
+
+	for _, name := range []string{"var/lib/postgresql", "var/lib/postgresql/data", "var/lib/postgresql/current"} {
+		fi, err := src.Lstat(name)
+		require.NoError(t, err)
+		sys, ok := fi.Sys().(*tar.Header)
+		require.True(t, ok)
+		require.Equal(t, 70, sys.Uid, "uid of %s", name)
+		require.Equal(t, 70, sys.Gid, "gid of %s", name)
+	}
+}
+
+func TestInstallAPKFilesSpecialFiles(t *testing.T) {
+	apk, src, err := testGetTestAPK()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "dev", Typeflag: tar.TypeDir, Mode: 0o755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "dev/console", Typeflag: tar.TypeChar, Mode: 0o600, Devmajor: 5, Devminor: 1}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "dev/loop0", Typeflag: tar.TypeBlock, Mode: 0o660, Devmajor: 7, Devminor: 0}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "dev/initctl", Typeflag: tar.TypeFifo, Mode: 0o600}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	headers, err := apk.installAPKFiles(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, headers, 4)
+
+	for _, tt := range []struct {
+		name string
+		mode fs.FileMode
+	}{
+		{"dev/console", fs.ModeDevice | fs.ModeCharDevice | 0o600},
+		{"dev/loop0", fs.ModeDevice | 0o660},
+		{"dev/initctl", fs.ModeNamedPipe | 0o600},
+	} {
+		fi, err := src.Stat(tt.name)
+		require.NoError(t, err)
+		require.Equal(t, tt.mode, fi.Mode(), "mode of %s", tt.name)
+	}
+	dev, err := src.Readnod("dev/loop0")
+	require.NoError(t, err)
+	require.Equal(t, int(unix.Mkdev(7, 0)), dev)
+}
+
+func TestInstallAPKFilesExclusions(t *testing.T) {
+	apk, err := NewAPKImplementation(WithFS(apkfs.NewMemFS()))
+	require.NoError(t, err)
+	require.NoError(t, apk.SetPathExclusions(PathExclusions{
+		All:      []string{"/usr/share/man", "/usr/share/locale/*"},
+		Packages: map[string][]string{"busybox": {"/bin/busybox"}},
+	}))
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, dir := range []string{"bin", "usr", "usr/share", "usr/share/man", "usr/share/man/man1", "usr/share/locale", "usr/share/locale/de"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0o755}))
+	}
+	for _, name := range []string{"bin/busybox", "usr/share/man/man1/busybox.1", "usr/share/locale/de/busybox.mo"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: 5}))
+		_, err = tw.Write([]byte("hello"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	headers, err := apk.installAPKFilesExcept(bytes.NewReader(buf.Bytes()), apk.excludedFor("busybox"))
+	require.NoError(t, err)
+	var names []string
+	for _, h := range headers {
+		names = append(names, strings.TrimSuffix(h.Name, "/"))
+	}
+	require.Equal(t, []string{"bin", "usr", "usr/share", "usr/share/locale"}, names)
+
+	// the exclusions of busybox do not apply to other packages
+	headers, err = apk.installAPKFilesExcept(bytes.NewReader(buf.Bytes()), apk.excludedFor("toybox"))
+	require.NoError(t, err)
+	require.Len(t, headers, 6)
+
+	require.Error(t, apk.SetPathExclusions(PathExclusions{All: []string{"/usr/share/[man"}}))
+	require.Error(t, apk.SetPathExclusions(PathExclusions{All: []string{"/"}}))
+}
+
+func TestInstallAPKFilesSparse(t *testing.T) {
+	content := make([]byte, 1<<20)
+	copy(content, "header")
+	copy(content[512<<10:], "middle")
+	layout := apkfs.NewMemFS()
+	require.NoError(t, layout.MkdirAll("var/lib", 0o755))
+	require.NoError(t, layout.WriteFile("var/lib/sparse", content, 0o644))
+	ctx, err := tarball.NewContext(tarball.WithSparse(true), tarball.WithSourceDateEpoch(time.Unix(0, 0)))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, ctx.WriteArchive(&buf, layout))
+	require.Less(t, buf.Len(), 64<<10)
+
+	for _, tt := range []struct {
+		name string
+		fsys apkfs.FullFS
+	}{
+		{"memfs", apkfs.NewMemFS()},
+		{"dirfs", apkfs.DirFS(t.TempDir())},
+	} {
+		apk, err := NewAPKImplementation(WithFS(tt.fsys))
+		require.NoError(t, err)
+		headers, err := apk.installAPKFiles(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err, tt.name)
+		require.Len(t, headers, 3, tt.name)
+		require.Equal(t, byte(tar.TypeReg), headers[2].Typeflag, tt.name)
+
+		got, err := tt.fsys.ReadFile("var/lib/sparse")
+		require.NoError(t, err, tt.name)
+		require.Equal(t, content, got, tt.name)
+	}
+}
+
+func TestInstallAPKFilesModTime(t *testing.T) {
+	apk, src, err := testGetTestAPK()
+	require.NoError(t, err)
+
+	mtime := time.Unix(1600000000, 0)
+	content := []byte("#!/bin/sh\n")
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "opt/tool", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "opt/tool/run", Typeflag: tar.TypeReg, Mode: 0o755, Size: int64(len(content)), ModTime: mtime.Add(time.Hour)}))
+	_, err = tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "opt/tool/start", Typeflag: tar.TypeSymlink, Linkname: "run", Mode: 0o777, ModTime: mtime.Add(2 * time.Hour)}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	_, err = apk.installAPKFiles(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	// the filesystem keeps the times of the package, whatever the layer makes of them
+	for name, want := range map[string]time.Time{
+		"opt/tool":       mtime,
+		"opt/tool/run":   mtime.Add(time.Hour),
+		"opt/tool/start": mtime.Add(2 * time.Hour),
+	} {
+		fi, err := src.Lstat(name)
+		require.NoError(t, err)
+		require.True(t, want.Equal(fi.ModTime()), "mtime of %s is %v", name, fi.ModTime())
+	}
+}
+
+func TestInstallAPKFilesUnsafePaths(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header tar.Header
+	}{
+		{"parent", tar.Header{Name: "../etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644}},
+		{"nested", tar.Header{Name: "usr/../../etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644}},
+		{"hardlink", tar.Header{Name: "usr/shadow", Typeflag: tar.TypeLink, Linkname: "../etc/shadow"}},
+	} {
+		apk, err := NewAPKImplementation(WithFS(apkfs.NewMemFS()))
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		require.NoError(t, tw.WriteHeader(&tt.header))
+		require.NoError(t, tw.Close())
+		require.NoError(t, gw.Close())
+
+		_, err = apk.installAPKFiles(bytes.NewReader(buf.Bytes()))
+		require.ErrorIs(t, err, ErrUnsafePath, tt.name)
+	}
+}
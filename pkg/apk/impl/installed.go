@@ -23,7 +23,7 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -56,31 +56,51 @@ func (a *APKImplementation) addInstalledPackage(pkg *repository.Package, files [
 	}
 	defer installedFile.Close()
 
-	// sort the files by directory
-	sort.Slice(files, func(i, j int) bool {
+	// apk-tools expects the files of a directory right after it, so sort them
+	// by directory, with the directory itself first
+	sort.SliceStable(files, func(i, j int) bool {
+		di, dj := installedDir(&files[i]), installedDir(&files[j])
+		if di != dj {
+			return di < dj
+		}
+		isDirI, isDirJ := files[i].Typeflag == tar.TypeDir, files[j].Typeflag == tar.TypeDir
+		if isDirI != isDirJ {
+			return isDirI
+		}
 		return files[i].Name < files[j].Name
 	})
 	// package lines
 	pkgLines := PackageToIndex(pkg)
 	// file lines
-	for _, f := range files {
-		perm := f.Mode & 0777
+	var (
+		currentDir string
+		inDir      bool
+	)
+	for i := range files {
+		f := &files[i]
+		perm := f.Mode & 0o7777
 		user := f.Uid
 		group := f.Gid
+		dir := installedDir(f)
 		if f.Typeflag == tar.TypeDir {
-			dirName := strings.TrimSuffix(f.Name, fmt.Sprintf("%c", filepath.Separator))
-			pkgLines = append(pkgLines, fmt.Sprintf("F:%s", dirName))
+			pkgLines = append(pkgLines, fmt.Sprintf("F:%s", dir))
 			if perm != 0o755 || user != 0 || group != 0 {
-				pkgLines = append(pkgLines, fmt.Sprintf("M:%d:%d:%04o", user, group, perm))
-			}
-		} else {
-			pkgLines = append(pkgLines, fmt.Sprintf("R:%s", filepath.Base(f.Name)))
-			if perm != 0o644 || user != 0 || group != 0 {
-				pkgLines = append(pkgLines, fmt.Sprintf("a:%d:%d:%04o", user, group, perm))
-			}
-			if f.PAXRecords != nil && f.PAXRecords[paxRecordsChecksumKey] != "" {
-				pkgLines = append(pkgLines, fmt.Sprintf("Z:%s", f.PAXRecords[paxRecordsChecksumKey]))
+				pkgLines = append(pkgLines, fmt.Sprintf("M:%d:%d:%o", user, group, perm))
 			}
+			currentDir, inDir = dir, true
+			continue
+		}
+		// directories which are not in the package itself, e.g. the root
+		if !inDir || dir != currentDir {
+			pkgLines = append(pkgLines, fmt.Sprintf("F:%s", dir))
+			currentDir, inDir = dir, true
+		}
+		pkgLines = append(pkgLines, fmt.Sprintf("R:%s", path.Base(f.Name)))
+		if perm != 0o644 || user != 0 || group != 0 {
+			pkgLines = append(pkgLines, fmt.Sprintf("a:%d:%d:%o", user, group, perm))
+		}
+		if f.PAXRecords != nil && f.PAXRecords[paxRecordsChecksumKey] != "" {
+			pkgLines = append(pkgLines, fmt.Sprintf("Z:%s", f.PAXRecords[paxRecordsChecksumKey]))
 		}
 	}
 	// write to installed file
@@ -91,6 +111,20 @@ func (a *APKImplementation) addInstalledPackage(pkg *repository.Package, files [
 	return nil
 }
 
+// installedDir returns the directory an entry is listed under in the
+// installed database: a directory itself, or the one containing a file. The
+// root directory is empty.
+func installedDir(f *tar.Header) string {
+	name := path.Clean(f.Name)
+	if f.Typeflag != tar.TypeDir {
+		name = path.Dir(name)
+	}
+	if name == "." || name == "/" {
+		return ""
+	}
+	return strings.TrimPrefix(name, "/")
+}
+
 // isInstalledPackage check if a specific package is installed
 func (a *APKImplementation) isInstalledPackage(pkg string) (bool, error) {
 	installedPackages, err := a.GetInstalled()
@@ -175,52 +209,22 @@ func (a *APKImplementation) readScriptsTar() (io.ReadCloser, error) {
 
 // updateTriggers insert the triggers into the triggers file
 func (a *APKImplementation) updateTriggers(pkg *repository.Package, controlTarGz io.Reader) error {
-	gz, err := gzip.NewReader(controlTarGz)
+	info, err := readControlPkgInfo(controlTarGz, a.limits)
 	if err != nil {
-		return fmt.Errorf("unable to gunzip control tar file: %w", err)
+		return fmt.Errorf("unable to read .PKGINFO from control tar.gz file: %w", err)
+	}
+	if len(info.Triggers) == 0 {
+		return nil
 	}
-	defer gz.Close()
-	tr := tar.NewReader(gz)
 
 	triggers, err := a.fs.OpenFile(triggersFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0)
 	if err != nil {
 		return fmt.Errorf("unable to open triggers file %s: %w", triggersFilePath, err)
 	}
 	defer triggers.Close()
-	for {
-		header, err := tr.Next()
-		if errors.Is(err, io.EOF) {
-			break
-		}
-		if err != nil {
-			return err
-		}
-
-		// ignore .PKGINFO as it is not a script
-		if header.Name != ".PKGINFO" {
-			continue
-		}
-
-		b, err := io.ReadAll(tr)
-		if err != nil {
-			return fmt.Errorf("unable to read .PKGINFO from control tar.gz file: %w", err)
-		}
-		lines := strings.Split(string(b), "\n")
-		for _, line := range lines {
-			parts := strings.Split(line, "=")
-			if len(parts) != 2 {
-				continue
-			}
-			key := strings.TrimSpace(parts[0])
-			value := strings.TrimSpace(parts[1])
-			if key != "triggers" {
-				continue
-			}
-			if _, err := triggers.Write([]byte(fmt.Sprintf("%s %s", base64.StdEncoding.EncodeToString(pkg.Checksum), value))); err != nil {
-				return fmt.Errorf("unable to write triggers file %s: %w", triggersFilePath, err)
-			}
-			break
-		}
+	// one line per package, as apk-tools writes it
+	if _, err := triggers.Write([]byte(fmt.Sprintf("Q1%s %s\n", base64.StdEncoding.EncodeToString(pkg.Checksum), strings.Join(info.Triggers, " ")))); err != nil {
+		return fmt.Errorf("unable to write triggers file %s: %w", triggersFilePath, err)
 	}
 	return nil
 }
@@ -254,7 +258,7 @@ func parseInstalled(installed io.Reader) (packages []*InstalledPackage, err erro
 			continue
 		}
 
-		if len(line) > 1 && line[1:2] != ":" {
+		if len(line) < 2 || line[1] != ':' {
 			return nil, fmt.Errorf("cannot parse line %d: expected \":\" in not found", linenr)
 		}
 
@@ -262,69 +266,13 @@ func parseInstalled(installed io.Reader) (packages []*InstalledPackage, err erro
 		val := line[2:]
 
 		switch token {
-		case "P":
-			pkg.Name = val
-		case "V":
-			pkg.Version = val
-		case "A":
-			pkg.Arch = val
-		case "L":
-			pkg.License = val
-		case "T":
-			pkg.Description = val
-		case "o":
-			pkg.Origin = val
-		case "m":
-			pkg.Maintainer = val
-		case "U":
-			pkg.URL = val
-		case "D":
-			pkg.Dependencies = strings.Split(val, " ")
-		case "p":
-			pkg.Provides = strings.Split(val, " ")
-		case "c":
-			pkg.RepoCommit = val
-		case "t":
-			i, err := strconv.ParseInt(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse build time %s: %w", val, err)
-			}
-			pkg.BuildTime = time.Unix(i, 0)
-		case "i":
-			pkg.InstallIf = strings.Split(val, " ")
-		case "S":
-			size, err := strconv.ParseUint(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse size field %s: %w", val, err)
-			}
-			pkg.Size = size
-		case "I":
-			installedSize, err := strconv.ParseUint(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse installed size field %s: %w", val, err)
-			}
-			pkg.InstalledSize = installedSize
-		case "k":
-			priority, err := strconv.ParseUint(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse provider priority field %s: %w", val, err)
-			}
-			pkg.ProviderPriority = priority
-		case "C":
-			// Handle SHA1 checksums:
-			if strings.HasPrefix(val, "Q1") {
-				checksum, err := base64.StdEncoding.DecodeString(val[2:])
-				if err != nil {
-					return nil, err
-				}
-				pkg.Checksum = checksum
-			}
 		case "F":
 			lastDir = &tar.Header{
-				Name: val,
-				Mode: 0o755,
-				Uid:  0,
-				Gid:  0,
+				Name:     val,
+				Typeflag: tar.TypeDir,
+				Mode:     0o755,
+				Uid:      0,
+				Gid:      0,
 			}
 			pkg.Files = append(pkg.Files, lastDir)
 			lastFile = nil
@@ -342,14 +290,16 @@ func parseInstalled(installed io.Reader) (packages []*InstalledPackage, err erro
 			lastDir.Mode = perms
 		case "R":
 			fullpath := val
-			if lastDir != nil {
+			// files in the root directory have an empty directory
+			if lastDir != nil && lastDir.Name != "" {
 				fullpath, _ = sanitizeArchivePath(lastDir.Name, val)
 			}
 			lastFile = &tar.Header{
-				Name: fullpath,
-				Mode: 0o644,
-				Uid:  0,
-				Gid:  0,
+				Name:     fullpath,
+				Typeflag: tar.TypeReg,
+				Mode:     0o644,
+				Uid:      0,
+				Gid:      0,
 			}
 			pkg.Files = append(pkg.Files, lastFile)
 		case "a":
@@ -364,10 +314,23 @@ func parseInstalled(installed io.Reader) (packages []*InstalledPackage, err erro
 			lastFile.Uid = uid
 			lastFile.Gid = gid
 			lastFile.Mode = perms
+		case "Z":
+			// checksum of the file, or of the target of a symlink
+			if lastFile == nil {
+				return nil, fmt.Errorf("cannot parse line %d: no file specified for checksum", linenr)
+			}
+			setChecksum(lastFile, val)
+		default:
+			if err := parsePackageField(&pkg.Package, token, val); err != nil {
+				return nil, fmt.Errorf("cannot parse line %d: %w", linenr, err)
+			}
 		}
 
 		linenr++
 	}
+	if err := indexScanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot parse line %d: %w", linenr, err)
+	}
 
 	return
 }
@@ -91,6 +91,71 @@ func TestAddInstalledPackage(t *testing.T) {
 	require.Equal(t, newPkg.Version, lastPkg.Version, "expected package version %s, got %s", newPkg.Version, lastPkg.Version)
 }
 
+func TestAddInstalledPackageFormat(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoError(t, err, "unable to initialize APK implementation")
+	newPkg := &repository.Package{
+		Name:         "testpkg",
+		Version:      "1.0.0-r0",
+		Arch:         "x86_64",
+		Size:         100,
+		Description:  "test package",
+		License:      "MIT",
+		Dependencies: []string{"so:libc.musl-x86_64.so.1"},
+		InstallIf:    []string{"foo", "bar"},
+		Checksum:     []byte{1, 2, 3},
+	}
+	newFiles := []tar.Header{
+		{Name: "usr/bin/testpkg", Typeflag: tar.TypeReg, Mode: 0o4755, PAXRecords: map[string]string{paxRecordsChecksumKey: "Q1abc="}},
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "rootfile", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "usr/lib/", Typeflag: tar.TypeDir, Mode: 0o700},
+		{Name: "usr/lib/libtest.so", Typeflag: tar.TypeSymlink, Linkname: "libtest.so.1", Mode: 0o777},
+	}
+	require.NoError(t, a.addInstalledPackage(newPkg, newFiles))
+
+	f, err := a.fs.Open(installedFilePath)
+	require.NoError(t, err)
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	require.NoError(t, err)
+	entries := strings.Split(strings.TrimSpace(string(b)), "\n\n")
+	require.Equal(t, strings.Join([]string{
+		"C:Q1AQID",
+		"P:testpkg",
+		"V:1.0.0-r0",
+		"A:x86_64",
+		"S:100",
+		"I:0",
+		"T:test package",
+		"U:",
+		"L:MIT",
+		"D:so:libc.musl-x86_64.so.1",
+		"i:foo bar",
+		"F:",
+		"R:rootfile",
+		"F:usr",
+		"F:usr/bin",
+		"R:testpkg",
+		"a:0:0:4755",
+		"Z:Q1abc=",
+		"F:usr/lib",
+		"M:0:0:700",
+		"R:libtest.so",
+		"a:0:0:777",
+	}, "\n"), entries[len(entries)-1])
+
+	// and it reads back
+	pkgs, err := a.GetInstalled()
+	require.NoError(t, err)
+	var names []string
+	for _, file := range pkgs[len(pkgs)-1].Files {
+		names = append(names, file.Name)
+	}
+	require.Equal(t, []string{"", "rootfile", "usr", "usr/bin", "usr/bin/testpkg", "usr/lib", "usr/lib/libtest.so"}, names)
+	require.Equal(t, "Q1abc=", pkgs[len(pkgs)-1].Files[4].PAXRecords[paxRecordsChecksumKey])
+}
+
 func TestIsInstalledPackage(t *testing.T) {
 	a, _, err := testGetTestAPK()
 	require.NoErrorf(t, err, "unable to initialize APK implementation: %v", err)
@@ -243,7 +308,7 @@ func TestUpdateTriggers(t *testing.T) {
 	readTriggers, err := a.readTriggers()
 	require.NoError(t, err, "unable to read triggers: %v", err)
 	defer readTriggers.Close()
-	cksum := base64.StdEncoding.EncodeToString(pkg.Checksum)
+	cksum := "Q1" + base64.StdEncoding.EncodeToString(pkg.Checksum)
 	// read every line in triggers, looking for one with our comment
 	scanner := bufio.NewScanner(readTriggers)
 	for scanner.Scan() {
@@ -260,3 +325,47 @@ func TestUpdateTriggers(t *testing.T) {
 	// nolint:forbidigo // this is a valid use case
 	t.Errorf("could not find entry for commit: %s", cksum)
 }
+
+func TestCheckFileCollisions(t *testing.T) {
+	files := []tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0o755},
+		{Name: "usr/bin/testpkg", Typeflag: tar.TypeReg, Mode: 0o755},
+	}
+
+	t.Run("error", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err, "unable to initialize APK implementation")
+		err = a.checkFileCollisions("testpkg", nil, files)
+		var collisionErr *FileCollisionError
+		require.ErrorAs(t, err, &collisionErr)
+		require.Equal(t, "testpkg", collisionErr.Package)
+		require.Equal(t, []FileCollision{{Path: "bin/busybox", Packages: []string{"busybox"}}}, collisionErr.Collisions)
+	})
+
+	t.Run("permissive", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err, "unable to initialize APK implementation")
+		a.SetPermissiveFileCollisions(true)
+		require.NoError(t, a.checkFileCollisions("testpkg", nil, files))
+	})
+
+	t.Run("same package", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err, "unable to initialize APK implementation")
+		require.NoError(t, a.checkFileCollisions("busybox", nil, files))
+	})
+
+	t.Run("replaces", func(t *testing.T) {
+		a, _, err := testGetTestAPK()
+		require.NoError(t, err, "unable to initialize APK implementation")
+		require.NoError(t, a.checkFileCollisions("testpkg", []string{"busybox<2"}, files))
+
+		// the files are now owned by the package, without reading the
+		// installed database again
+		err = a.checkFileCollisions("otherpkg", nil, files[2:])
+		var collisionErr *FileCollisionError
+		require.ErrorAs(t, err, &collisionErr)
+		require.Equal(t, []FileCollision{{Path: "usr/bin/testpkg", Packages: []string{"testpkg"}}}, collisionErr.Collisions)
+	})
+}
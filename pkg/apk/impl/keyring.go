@@ -0,0 +1,335 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// BootstrapKeyring installs the public keys shipped in the named keys package,
+// e.g. alpine-keys or wolfi-keys, into the keyring, the same way apk itself is
+// bootstrapped. As the package comes from the repositories its keys are to
+// verify, it is only trusted through something rooted outside of them:
+//
+//   - keys already in the keyring verify the repositories, so that the index
+//     vouches for the checksum of the package, or
+//   - fingerprints pin the keys accepted from the package, as the hex encoded
+//     SHA-256 digests of their DER encoding, and the others are ignored.
+//
+// The repositories are then verified once with the new keys. If that
+// verification fails, no key is left in the keyring.
+func (a *APKImplementation) BootstrapKeyring(packageName string, fingerprints []string) error {
+	a.logger.Infof("bootstrapping apk keyring from package %s", packageName)
+
+	pins, err := parseKeyFingerprints(fingerprints)
+	if err != nil {
+		return err
+	}
+	trusted, err := a.hasKeys()
+	if err != nil {
+		return err
+	}
+	if !trusted && len(pins) == 0 {
+		return fmt.Errorf("keys package %s is not trusted: add a key verifying the repositories to the keyring, or pin the fingerprints of its keys", packageName)
+	}
+
+	// without keys to check the index, the pins are what is trusted
+	indexes, err := a.getRepositoryIndexes(!trusted)
+	if err != nil {
+		return fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	indexesInt := make([]NamedIndex, 0, len(indexes))
+	for _, index := range indexes {
+		indexesInt = append(indexesInt, index)
+	}
+	pkgs, err := NewPkgResolver(indexesInt).ResolvePackage(packageName)
+	if err != nil {
+		return err
+	}
+	if len(pkgs) == 0 {
+		return fmt.Errorf("could not find keys package %s", packageName)
+	}
+	pkg := pkgs[0]
+
+	r, err := a.fetchPackage(pkg)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	expanded, err := expandApk(r)
+	if err != nil {
+		return fmt.Errorf("unable to expand apk for package %s: %w", pkg.Name, err)
+	}
+	defer os.RemoveAll(expanded.TempDir)
+
+	if err := verifyPackageChecksum(pkg, expanded); err != nil {
+		return err
+	}
+
+	f, err := os.Open(expanded.PackageDataTarGzFilename)
+	if err != nil {
+		return fmt.Errorf("could not open package data file %s for reading: %w", expanded.PackageDataTarGzFilename, err)
+	}
+	defer f.Close()
+	keys, err := keysFromPackageData(f, a.arch)
+	if err != nil {
+		return fmt.Errorf("unable to read keys from package %s: %w", pkg.Name, err)
+	}
+	if len(pins) > 0 {
+		keys = pinnedKeys(keys, pins)
+		if len(keys) == 0 {
+			return fmt.Errorf("package %s does not contain any key with a pinned fingerprint", pkg.Name)
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("package %s does not contain any keys", pkg.Name)
+	}
+
+	if err := a.fs.MkdirAll(keysDirPath, 0o755); err != nil {
+		return fmt.Errorf("failed to make keys dir: %w", err)
+	}
+	var written []string
+	for name, data := range keys {
+		filename := filepath.Join(keysDirPath, name)
+		if _, err := a.fs.Stat(filename); err == nil {
+			// keys configured explicitly take precedence
+			continue
+		}
+		// #nosec G306 -- apk keyring must be publicly readable
+		if err := a.fs.WriteFile(filename, data, 0o644); err != nil {
+			return fmt.Errorf("failed to write key file %s: %w", filename, err)
+		}
+		written = append(written, filename)
+	}
+
+	if _, err := a.getRepositoryIndexes(false); err != nil {
+		for _, filename := range written {
+			_ = a.fs.Remove(filename)
+		}
+		return fmt.Errorf("keys from package %s do not verify the repositories: %w", pkg.Name, err)
+	}
+
+	a.logger.Infof("installed %d keys from package %s (%s)", len(written), pkg.Name, pkg.Version)
+	return nil
+}
+
+// hasKeys reports whether the keyring holds any key yet.
+func (a *APKImplementation) hasKeys() (bool, error) {
+	entries, err := a.fs.ReadDir(keysDirPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not read keys directory %s: %w", keysDirPath, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseKeyFingerprints returns the set of the fingerprints, lower case and
+// without their optional "sha256:" prefix.
+func parseKeyFingerprints(fingerprints []string) (map[string]bool, error) {
+	pins := make(map[string]bool, len(fingerprints))
+	for _, fp := range fingerprints {
+		hexDigest := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(fp), "sha256:"))
+		if b, err := hex.DecodeString(hexDigest); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid key fingerprint %q: expected a hex encoded SHA-256 digest", fp)
+		}
+		pins[hexDigest] = true
+	}
+	return pins, nil
+}
+
+// keyFingerprint returns the hex encoded SHA-256 digest of the DER encoding
+// of a PEM public key, as given by
+//
+//	openssl pkey -pubin -in key.rsa.pub -outform DER | sha256sum
+func keyFingerprint(data []byte) (string, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", errors.New("no PEM block")
+	}
+	if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// pinnedKeys returns the keys whose fingerprint is pinned.
+func pinnedKeys(keys map[string][]byte, pins map[string]bool) map[string][]byte {
+	pinned := map[string][]byte{}
+	for name, data := range keys {
+		if fp, err := keyFingerprint(data); err == nil && pins[fp] {
+			pinned[name] = data
+		}
+	}
+	return pinned
+}
+
+// keysFromPackageData returns the public keys found in the data section of a
+// keys package, by file name. Keys linked into etc/apk/keys are preferred, as
+// that is what apk itself would trust once the package is installed. Otherwise
+// the keys for the given architecture under usr/share/apk/keys are used.
+func keysFromPackageData(r io.Reader, arch string) (map[string][]byte, error) {
+	gzipIn, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipIn.Close()
+
+	// how many symlinks to follow before giving up on a key
+	const maxLinks = 8
+
+	var (
+		files = map[string][]byte{}
+		links = map[string]string{}
+		tr    = tar.NewReader(gzipIn)
+	)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if path.Ext(name) != ".pub" {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			files[name] = data
+		case tar.TypeSymlink:
+			target := hdr.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(name), target)
+			}
+			links[name] = path.Clean(strings.TrimPrefix(target, "/"))
+		}
+	}
+
+	resolve := func(name string) ([]byte, bool) {
+		for i := 0; i < maxLinks; i++ {
+			if data, ok := files[name]; ok {
+				return data, true
+			}
+			target, ok := links[name]
+			if !ok {
+				return nil, false
+			}
+			name = target
+		}
+		return nil, false
+	}
+
+	collect := func(dir string) map[string][]byte {
+		keys := map[string][]byte{}
+		for name := range files {
+			if path.Dir(name) == dir {
+				keys[path.Base(name)] = files[name]
+			}
+		}
+		for name := range links {
+			if path.Dir(name) != dir {
+				continue
+			}
+			if data, ok := resolve(name); ok {
+				keys[path.Base(name)] = data
+			}
+		}
+		return keys
+	}
+
+	if keys := collect(keysDirPath); len(keys) > 0 {
+		return keys, nil
+	}
+	return collect(path.Join(strings.Trim(DefaultSystemKeyRingPath, "/"), arch)), nil
+}
+
+// inlineKeyBase64Prefix marks a keyring entry holding base64 encoded key material.
+const inlineKeyBase64Prefix = "base64:"
+
+// parseInlineKey recognizes keyring entries which carry the key itself rather
+// than its location, either as a PEM block or as base64 encoded PEM or DER
+// data after a "base64:" prefix. Either form may be preceded by the file name
+// to use in the keyring, e.g.
+//
+//	wolfi-signing.rsa.pub=base64:LS0tLS1CRUdJTi...
+//
+// which matters to apk, as it looks up keys by the name in the signature. If
+// no name is given, one is derived from the digest of the key. ok is false if
+// the entry is not an inline key.
+func parseInlineKey(element string) (name string, data []byte, ok bool, err error) {
+	material := element
+	if k, v, found := strings.Cut(element, "="); found && strings.HasSuffix(k, ".pub") && !strings.ContainsAny(k, "/\\\n") {
+		name, material = k, v
+	}
+
+	switch {
+	case strings.HasPrefix(strings.TrimSpace(material), "-----BEGIN "):
+		data = []byte(strings.TrimSpace(material) + "\n")
+	case strings.HasPrefix(material, inlineKeyBase64Prefix):
+		encoded := strings.Join(strings.Fields(strings.TrimPrefix(material, inlineKeyBase64Prefix)), "")
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", nil, true, fmt.Errorf("failed to decode inline key: %w", err)
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(decoded), []byte("-----BEGIN ")) {
+			data = decoded
+		} else {
+			if _, err := x509.ParsePKIXPublicKey(decoded); err != nil {
+				return "", nil, true, fmt.Errorf("inline key is neither PEM nor a DER encoded public key: %w", err)
+			}
+			data = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: decoded})
+		}
+	default:
+		return "", nil, false, nil
+	}
+
+	if block, _ := pem.Decode(data); block == nil {
+		return "", nil, true, errors.New("inline key does not hold a valid PEM block")
+	}
+
+	if name == "" {
+		sum := sha256.Sum256(data)
+		name = fmt.Sprintf("inline-%s.rsa.pub", hex.EncodeToString(sum[:])[:16])
+	}
+	return name, data, true, nil
+}
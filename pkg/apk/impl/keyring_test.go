@@ -0,0 +1,228 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+func testKeysPackageData(t *testing.T, headers []tar.Header, contents map[string]string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, hdr := range headers {
+		hdr := hdr
+		data := contents[hdr.Name]
+		hdr.Size = int64(len(data))
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write([]byte(data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return &buf
+}
+
+func TestKeysFromPackageData(t *testing.T) {
+	t.Run("linked into etc/apk/keys", func(t *testing.T) {
+		// the layout of alpine-keys
+		data := testKeysPackageData(t, []tar.Header{
+			{Name: "usr/share/apk/keys/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "usr/share/apk/keys/a.rsa.pub", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "usr/share/apk/keys/b.rsa.pub", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "usr/share/apk/keys/x86_64/a.rsa.pub", Typeflag: tar.TypeSymlink, Linkname: "../a.rsa.pub"},
+			{Name: "etc/apk/keys/a.rsa.pub", Typeflag: tar.TypeSymlink, Linkname: "../../../usr/share/apk/keys/a.rsa.pub"},
+		}, map[string]string{
+			"usr/share/apk/keys/a.rsa.pub": "key a",
+			"usr/share/apk/keys/b.rsa.pub": "key b",
+		})
+		keys, err := keysFromPackageData(data, "x86_64")
+		require.NoError(t, err)
+		require.Equal(t, map[string][]byte{"a.rsa.pub": []byte("key a")}, keys)
+	})
+	t.Run("regular files in etc/apk/keys", func(t *testing.T) {
+		// the layout of wolfi-keys
+		data := testKeysPackageData(t, []tar.Header{
+			{Name: "etc/apk/keys/wolfi-signing.rsa.pub", Typeflag: tar.TypeReg, Mode: 0o644},
+		}, map[string]string{
+			"etc/apk/keys/wolfi-signing.rsa.pub": "wolfi key",
+		})
+		keys, err := keysFromPackageData(data, "aarch64")
+		require.NoError(t, err)
+		require.Equal(t, map[string][]byte{"wolfi-signing.rsa.pub": []byte("wolfi key")}, keys)
+	})
+	t.Run("per-arch keys only", func(t *testing.T) {
+		data := testKeysPackageData(t, []tar.Header{
+			{Name: "usr/share/apk/keys/a.rsa.pub", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "usr/share/apk/keys/b.rsa.pub", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "usr/share/apk/keys/aarch64/b.rsa.pub", Typeflag: tar.TypeSymlink, Linkname: "../b.rsa.pub"},
+		}, map[string]string{
+			"usr/share/apk/keys/a.rsa.pub": "key a",
+			"usr/share/apk/keys/b.rsa.pub": "key b",
+		})
+		keys, err := keysFromPackageData(data, "aarch64")
+		require.NoError(t, err)
+		require.Equal(t, map[string][]byte{"b.rsa.pub": []byte("key b")}, keys)
+
+		data = testKeysPackageData(t, nil, nil)
+		keys, err = keysFromPackageData(data, "s390x")
+		require.NoError(t, err)
+		require.Empty(t, keys)
+	})
+}
+
+func TestParseInlineKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	for _, tt := range []struct {
+		desc    string
+		element string
+		name    string
+		ok      bool
+		wantErr bool
+	}{
+		{desc: "url", element: "https://example.com/keys/key.rsa.pub"},
+		{desc: "path", element: "/etc/apk/keys/key.rsa.pub"},
+		{desc: "relative path", element: "keys/key.rsa.pub"},
+		{desc: "pem", element: string(pemData), ok: true},
+		{desc: "named pem", element: "key.rsa.pub=" + string(pemData), name: "key.rsa.pub", ok: true},
+		{desc: "base64 pem", element: "base64:" + base64.StdEncoding.EncodeToString(pemData), ok: true},
+		{desc: "named base64 der", element: "key.rsa.pub=base64:" + base64.StdEncoding.EncodeToString(der), name: "key.rsa.pub", ok: true},
+		{desc: "bad base64", element: "base64:!!!", ok: true, wantErr: true},
+		{desc: "not a key", element: "base64:" + base64.StdEncoding.EncodeToString([]byte("hello")), ok: true, wantErr: true},
+		{desc: "bad pem", element: "-----BEGIN PUBLIC KEY-----\nnope", ok: true, wantErr: true},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			name, data, ok, err := parseInlineKey(tt.element)
+			require.Equal(t, tt.ok, ok)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if !tt.ok {
+				return
+			}
+			if tt.name != "" {
+				require.Equal(t, tt.name, name)
+			} else {
+				require.True(t, strings.HasPrefix(name, "inline-"), name)
+			}
+			block, _ := pem.Decode(data)
+			require.NotNil(t, block)
+			require.Equal(t, der, block.Bytes)
+		})
+	}
+}
+
+func TestBootstrapKeyring(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	const (
+		arch    = "x86_64"
+		keyName = "repo.rsa.pub"
+	)
+	pubKey := testPublicKeyPEM(t, key, false)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	sum := sha256.Sum256(der)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	// a repository signed with the key shipped in its keys package
+	repo := t.TempDir()
+	dir := filepath.Join(repo, arch)
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	control := testKeysPackageData(t, []tar.Header{
+		{Name: ".PKGINFO", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{".PKGINFO": "pkgname = test-keys\npkgver = 1.0-r0\narch = x86_64\n"})
+	data := testKeysPackageData(t, []tar.Header{
+		{Name: "etc/apk/keys/" + keyName, Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"etc/apk/keys/" + keyName: string(pubKey)})
+	apkPath := filepath.Join(dir, "test-keys-1.0-r0.apk")
+	require.NoError(t, os.WriteFile(apkPath, append(control.Bytes(), data.Bytes()...), 0o644))
+	pkg, err := ReadLocalPackage(apkPath, InputLimits{})
+	require.NoError(t, err)
+	index, err := writeIndexArchive(&repository.ApkIndex{Packages: []*repository.Package{pkg}})
+	require.NoError(t, err)
+	index, err = SignIndexData(index, key, keyName, crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, indexFilename), index, 0o644))
+
+	setup := func(t *testing.T) (*APKImplementation, apkfs.FullFS) {
+		src := apkfs.NewMemFS()
+		// as left by InitKeyring without any key
+		require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+		require.NoError(t, src.WriteFile(archFilePath, []byte(arch+"\n"), 0o644))
+		a, err := NewAPKImplementation(WithFS(src), WithArch(arch))
+		require.NoError(t, err)
+		require.NoError(t, a.SetRepositories([]string{repo}))
+		return a, src
+	}
+
+	t.Run("not trusted", func(t *testing.T) {
+		a, src := setup(t)
+		require.ErrorContains(t, a.BootstrapKeyring("test-keys", nil), "not trusted")
+		_, err := src.Stat(filepath.Join(keysDirPath, keyName))
+		require.Error(t, err)
+	})
+	t.Run("other fingerprint", func(t *testing.T) {
+		a, src := setup(t)
+		require.ErrorContains(t, a.BootstrapKeyring("test-keys", []string{strings.Repeat("0", 64)}), "pinned fingerprint")
+		_, err := src.Stat(filepath.Join(keysDirPath, keyName))
+		require.Error(t, err)
+	})
+	t.Run("bad fingerprint", func(t *testing.T) {
+		a, _ := setup(t)
+		require.Error(t, a.BootstrapKeyring("test-keys", []string{"sha256:nothex"}))
+	})
+	t.Run("pinned", func(t *testing.T) {
+		a, src := setup(t)
+		require.NoError(t, a.BootstrapKeyring("test-keys", []string{"sha256:" + strings.ToUpper(fingerprint)}))
+		got, err := src.ReadFile(filepath.Join(keysDirPath, keyName))
+		require.NoError(t, err)
+		require.Equal(t, pubKey, got)
+
+		// the keys in the keyring now verify the repository and the package
+		require.NoError(t, src.Remove(filepath.Join(keysDirPath, keyName)))
+		require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, "trusted.rsa.pub"), pubKey, 0o644))
+		require.NoError(t, a.BootstrapKeyring("test-keys", nil))
+		_, err = src.Stat(filepath.Join(keysDirPath, keyName))
+		require.NoError(t, err)
+	})
+}
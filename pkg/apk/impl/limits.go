@@ -0,0 +1,118 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// InputLimits bound how much of the inputs coming from repositories and
+// packages is read, so that malformed or hostile ones cannot exhaust the
+// memory of the build. A zero field means no limit.
+type InputLimits struct {
+	// MaxIndexSize is the size of an APKINDEX, both compressed and
+	// uncompressed.
+	MaxIndexSize int64
+	// MaxIndexPackages is the number of packages of an APKINDEX.
+	MaxIndexPackages int
+	// MaxControlSize is the size of the .PKGINFO of a package.
+	MaxControlSize int64
+	// MaxLineSize is the size of a line of an APKINDEX or .PKGINFO. Lines are
+	// limited to bufio.MaxScanTokenSize if it is not set.
+	MaxLineSize int
+	// MaxPackageSize is the size of a package downloaded from a URL of the
+	// world, which is kept in memory until it is installed.
+	MaxPackageSize int64
+}
+
+// HardenedInputLimits returns limits well above what the largest
+// repositories and packages need, to be used when the inputs of the build
+// cannot be trusted, e.g. by a server building images for others.
+func HardenedInputLimits() InputLimits {
+	return InputLimits{
+		MaxIndexSize:     256 << 20,
+		MaxIndexPackages: 200_000,
+		MaxControlSize:   1 << 20,
+		MaxLineSize:      256 << 10,
+		MaxPackageSize:   512 << 20,
+	}
+}
+
+// WithInputLimits bounds how much of the indexes and packages is read.
+func WithInputLimits(limits InputLimits) Option {
+	return func(o *opts) error {
+		o.limits = limits
+		return nil
+	}
+}
+
+// WithIndexLimits bounds how much of the indexes is read.
+func WithIndexLimits(limits InputLimits) IndexOption {
+	return func(o *indexOpts) {
+		o.limits = limits
+	}
+}
+
+// limitReader returns a reader failing once more than n bytes of what are
+// read, or r itself if n is not positive.
+func limitReader(r io.Reader, n int64, what string) io.Reader {
+	if n <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, n: n, max: n, what: what}
+}
+
+type limitedReader struct {
+	r    io.Reader
+	n    int64
+	max  int64
+	what string
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, fmt.Errorf("%s is larger than the limit of %d bytes", l.what, l.max)
+	}
+	// read one byte past the limit, to tell input of exactly the limit from
+	// larger input
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), fmt.Errorf("%s is larger than the limit of %d bytes", l.what, l.max)
+	}
+	return n, err
+}
+
+// newLineScanner returns a scanner of the lines of r, failing on lines
+// larger than the limit.
+func newLineScanner(r io.Reader, limits InputLimits) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	if limits.MaxLineSize > 0 {
+		scanner.Buffer(make([]byte, 0, min(limits.MaxLineSize, 4096)), limits.MaxLineSize)
+	}
+	return scanner
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,269 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// isLocalPackage reports whether a world entry is the path to an .apk file
+// rather than the name of a package of the repositories.
+func isLocalPackage(entry string) bool {
+	return !isRemotePackage(entry) && strings.HasSuffix(entry, ".apk")
+}
+
+// isRemotePackage reports whether a world entry is the https URL of an .apk
+// file, optionally pinned with the SHA-256 hash of the file, e.g.
+// https://example.com/hello-1.0-r0.apk#sha256=<hex>.
+func isRemotePackage(entry string) bool {
+	u, _, _ := strings.Cut(entry, "#")
+	return strings.HasPrefix(u, "https://") && strings.HasSuffix(u, ".apk")
+}
+
+// localPackage is a package of the world given as an .apk file or URL.
+type localPackage struct {
+	// entry is the path or the URL of the package in the world.
+	entry string
+	// data is the content of the package, if downloaded.
+	data []byte
+}
+
+func (l localPackage) open() (io.ReadCloser, error) {
+	if l.data != nil {
+		return io.NopCloser(bytes.NewReader(l.data)), nil
+	}
+	return os.Open(l.entry)
+}
+
+// ReadLocalPackage returns the metadata of the .apk file at the path, as an
+// index would list it.
+func ReadLocalPackage(path string, limits InputLimits) (*repository.Package, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readPackage(f, path, limits)
+}
+
+// readPackage returns the metadata of the .apk read from r, as an index
+// would list it.
+func readPackage(r io.Reader, name string, limits InputLimits) (*repository.Package, error) {
+	expanded, err := expandApk(r)
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", name, err)
+	}
+	defer os.RemoveAll(expanded.TempDir)
+
+	control, err := os.ReadFile(expanded.ControlDataTarGzFilename)
+	if err != nil {
+		return nil, fmt.Errorf("reading control data of %s: %w", name, err)
+	}
+	checksum, err := HashData(control)
+	if err != nil {
+		return nil, err
+	}
+	info, err := readControlPkgInfo(bytes.NewReader(control), limits)
+	if err != nil {
+		return nil, fmt.Errorf("reading .PKGINFO of %s: %w", name, err)
+	}
+	if info.Name == "" || info.Version == "" {
+		return nil, fmt.Errorf("%s has no package name or version", name)
+	}
+
+	pkg := info.Package
+	pkg.Checksum = checksum
+	pkg.Size = uint64(expanded.Size)
+	return &pkg, nil
+}
+
+// downloadPackage downloads the .apk at the URL of a world entry, checking
+// it against the hash the entry pins, if any. With a signature policy in
+// place, a package without a pin must be signed by a key of the keyring.
+func (a *APKImplementation) downloadPackage(entry string) ([]byte, error) {
+	u, pin, _ := strings.Cut(entry, "#")
+	var want string
+	if pin != "" {
+		if !strings.HasPrefix(pin, "sha256=") || len(pin) != len("sha256=")+sha256.Size*2 {
+			return nil, fmt.Errorf("invalid pin %q of %s, must be sha256=<hex>", pin, u)
+		}
+		want = strings.TrimPrefix(pin, "sha256=")
+	}
+
+	client := a.httpClient()
+	res, err := client.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get package apk at %s: %w", u, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to get package apk at %s: %v", u, res.Status)
+	}
+	// the package is kept in memory until it is installed
+	data, err := io.ReadAll(limitReader(res.Body, a.limits.MaxPackageSize, "package "+u))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read package apk at %s: %w", u, err)
+	}
+
+	switch {
+	case want != "":
+		sum := sha256.Sum256(data)
+		if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, want) {
+			return nil, &ChecksumMismatchError{Package: path.Base(u), URL: u, Section: "apk", Expected: want, Actual: actual}
+		}
+	case !a.signaturePolicy.IsZero():
+		if err := a.verifyPackageSignature(data); err != nil {
+			return nil, fmt.Errorf("package apk at %s is not pinned, and its signature cannot be verified: %w", u, err)
+		}
+	}
+	return data, nil
+}
+
+// verifyPackageSignature checks the signature of the .apk, which covers its
+// control section, against the keys of the keyring.
+func (a *APKImplementation) verifyPackageSignature(data []byte) error {
+	keys, err := a.keyring()
+	if err != nil {
+		return err
+	}
+	expanded, err := expandApk(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(expanded.TempDir)
+	if !expanded.Signed {
+		return fmt.Errorf("the package is not signed")
+	}
+	signature, err := os.ReadFile(expanded.SignatureTarGzFilename)
+	if err != nil {
+		return err
+	}
+	control, err := os.ReadFile(expanded.ControlDataTarGzFilename)
+	if err != nil {
+		return err
+	}
+	// the signature segment is followed by what it signs, as for indexes
+	return verifyIndexSignature(append(signature, control...), keys)
+}
+
+// localIndex reads the packages of the world which are .apk files or URLs,
+// into indexes of their own. It returns the world with the packages by name
+// and exact version instead, so that those files are installed, and the
+// indexes. Packages of the repositories with the same names are left out of
+// the other indexes, so that they cannot be picked for dependencies either.
+func (a *APKImplementation) localIndex(world []string, indexes []NamedIndex) ([]string, []NamedIndex, error) {
+	locals := map[*repository.Package]localPackage{}
+	var pkgs []*repository.Package
+	resolved := make([]string, 0, len(world))
+	for _, entry := range world {
+		local := localPackage{entry: entry}
+		switch {
+		case isRemotePackage(entry):
+			data, err := a.downloadPackage(entry)
+			if err != nil {
+				return nil, nil, err
+			}
+			local.data = data
+		case isLocalPackage(entry):
+		default:
+			resolved = append(resolved, entry)
+			continue
+		}
+		r, err := local.open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading local package: %w", err)
+		}
+		pkg, err := readPackage(r, entry, a.limits)
+		r.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading local package: %w", err)
+		}
+		locals[pkg] = local
+		pkgs = append(pkgs, pkg)
+		resolved = append(resolved, fmt.Sprintf("%s=%s", pkg.Name, pkg.Version))
+	}
+	a.localPackages = locals
+	if len(pkgs) == 0 {
+		return world, indexes, nil
+	}
+
+	overridden := make([]NamedIndex, 0, len(indexes)+len(pkgs))
+	names := make(map[string]bool, len(pkgs))
+	for _, pkg := range pkgs {
+		names[pkg.Name] = true
+		// each package is in a repository of its directory
+		entry := locals[pkg].entry
+		repo := repository.Repository{Uri: filepath.Dir(entry)}
+		if isRemotePackage(entry) {
+			u, _, _ := strings.Cut(entry, "#")
+			repo.Uri = u[:strings.LastIndex(u, "/")]
+		}
+		overridden = append(overridden, NewNamedRepositoryWithIndex("", repo.WithIndex(&repository.ApkIndex{Packages: []*repository.Package{pkg}})))
+	}
+	for _, index := range indexes {
+		overridden = append(overridden, &overriddenIndex{NamedIndex: index, names: names})
+	}
+	return resolved, overridden, nil
+}
+
+// forgetLocalPackagePaths replaces the .apk files and URLs of the world with
+// the names of their packages, as they mean nothing in the image.
+func (a *APKImplementation) forgetLocalPackagePaths() error {
+	if len(a.localPackages) == 0 {
+		return nil
+	}
+	names := make(map[string]string, len(a.localPackages))
+	for pkg, local := range a.localPackages {
+		names[local.entry] = pkg.Name
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return err
+	}
+	for i, entry := range world {
+		if name, ok := names[entry]; ok {
+			world[i] = name
+		}
+	}
+	return a.SetWorld(world)
+}
+
+// overriddenIndex is an index without the packages of some names.
+type overriddenIndex struct {
+	NamedIndex
+	names map[string]bool
+}
+
+func (o *overriddenIndex) Packages() []*repository.RepositoryPackage {
+	all := o.NamedIndex.Packages()
+	pkgs := make([]*repository.RepositoryPackage, 0, len(all))
+	for _, pkg := range all {
+		if !o.names[pkg.Name] {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
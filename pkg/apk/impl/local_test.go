@@ -0,0 +1,188 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+// testLocalPackage writes an unsigned .apk file with the .PKGINFO into the
+// directory, returning its path.
+func testLocalPackage(t *testing.T, dir, pkgInfo string) string {
+	t.Helper()
+	control := testKeysPackageData(t, []tar.Header{
+		{Name: ".PKGINFO", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{".PKGINFO": pkgInfo})
+	data := testKeysPackageData(t, []tar.Header{
+		{Name: "usr/bin/hello", Typeflag: tar.TypeReg, Mode: 0o755},
+	}, map[string]string{"usr/bin/hello": "hello world\n"})
+
+	path := filepath.Join(dir, "hello.apk")
+	require.NoError(t, os.WriteFile(path, append(control.Bytes(), data.Bytes()...), 0o644))
+	return path
+}
+
+func TestReadLocalPackage(t *testing.T) {
+	path := testLocalPackage(t, t.TempDir(), "pkgname = hello\npkgver = 1.0-r0\narch = x86_64\ndepend = so:libc.musl-x86_64.so.1\n")
+
+	pkg, err := ReadLocalPackage(path, InputLimits{})
+	require.NoError(t, err)
+	require.Equal(t, "hello", pkg.Name)
+	require.Equal(t, "1.0-r0", pkg.Version)
+	require.Equal(t, []string{"so:libc.musl-x86_64.so.1"}, pkg.Dependencies)
+	require.Len(t, pkg.Checksum, 20)
+	require.NotZero(t, pkg.Size)
+
+	path = testLocalPackage(t, t.TempDir(), "pkgdesc = nameless\n")
+	_, err = ReadLocalPackage(path, InputLimits{})
+	require.Error(t, err)
+}
+
+func TestLocalIndex(t *testing.T) {
+	dir := t.TempDir()
+	path := testLocalPackage(t, dir, "pkgname = hello\npkgver = 1.0-r0\n")
+
+	repo := repository.Repository{Uri: "https://example.com/os/x86_64"}
+	remote := NewNamedRepositoryWithIndex("", repo.WithIndex(&repository.ApkIndex{Packages: []*repository.Package{
+		{Name: "hello", Version: "2.0-r0"},
+		{Name: "busybox", Version: "1.36.0-r0"},
+	}}))
+
+	a := &APKImplementation{}
+	world, indexes, err := a.localIndex([]string{"busybox", path}, []NamedIndex{remote})
+	require.NoError(t, err)
+	require.Equal(t, []string{"busybox", "hello=1.0-r0"}, world)
+	require.Len(t, indexes, 2)
+
+	local := indexes[0].Packages()
+	require.Len(t, local, 1)
+	require.Equal(t, "1.0-r0", local[0].Version)
+	require.Equal(t, dir, local[0].Repository().Uri)
+	require.Equal(t, path, a.localPackages[local[0].Package].entry)
+
+	// the remote hello cannot be picked anymore
+	var names []string
+	for _, pkg := range indexes[1].Packages() {
+		names = append(names, pkg.Name)
+	}
+	require.Equal(t, []string{"busybox"}, names)
+
+	// a world without local packages is kept as is
+	world, indexes, err = a.localIndex([]string{"busybox"}, []NamedIndex{remote})
+	require.NoError(t, err)
+	require.Equal(t, []string{"busybox"}, world)
+	require.Equal(t, []NamedIndex{remote}, indexes)
+	require.Empty(t, a.localPackages)
+}
+
+func TestRemotePackage(t *testing.T) {
+	dir := t.TempDir()
+	path := testLocalPackage(t, dir, "pkgname = hello\npkgver = 1.0-r0\n")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+
+	require.True(t, isRemotePackage("https://example.com/hello.apk#sha256=00"))
+	require.False(t, isRemotePackage("http://example.com/hello.apk"))
+	require.False(t, isLocalPackage("https://example.com/hello.apk"))
+
+	a := &APKImplementation{client: &http.Client{Transport: &testLocalTransport{root: dir, basenameOnly: true}}}
+	entry := "https://example.com/pkgs/hello.apk#sha256=" + hex.EncodeToString(sum[:])
+	world, indexes, err := a.localIndex([]string{entry}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"hello=1.0-r0"}, world)
+	local := indexes[0].Packages()
+	require.Len(t, local, 1)
+	require.Equal(t, "https://example.com/pkgs", local[0].Repository().Uri)
+	require.Equal(t, data, a.localPackages[local[0].Package].data)
+
+	// a download not matching the pin is rejected
+	_, err = a.downloadPackage("https://example.com/pkgs/hello.apk#sha256=" + hex.EncodeToString(make([]byte, sha256.Size)))
+	var mismatch *ChecksumMismatchError
+	require.True(t, errors.As(err, &mismatch), "unexpected error %v", err)
+	require.Equal(t, "apk", mismatch.Section)
+
+	_, err = a.downloadPackage("https://example.com/pkgs/hello.apk#md5=00")
+	require.Error(t, err)
+	_, err = a.downloadPackage("https://example.com/pkgs/missing.apk")
+	require.Error(t, err)
+}
+
+func TestRemotePackageUnpinned(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	const keyName = "test.rsa.pub"
+
+	dir := t.TempDir()
+	path := testLocalPackage(t, dir, "pkgname = hello\npkgver = 1.0-r0\n")
+	unsigned, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	control := testKeysPackageData(t, []tar.Header{
+		{Name: ".PKGINFO", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{".PKGINFO": "pkgname = hello\npkgver = 1.0-r0\n"})
+	data := testKeysPackageData(t, []tar.Header{
+		{Name: "usr/bin/hello", Typeflag: tar.TypeReg, Mode: 0o755},
+	}, map[string]string{"usr/bin/hello": "hello world\n"})
+	signedControl, err := SignIndexData(control.Bytes(), key, keyName, crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "signed.apk"), append(signedControl, data.Bytes()...), 0o644))
+
+	src := apkfs.NewMemFS()
+	require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+	require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, keyName), testPublicKeyPEM(t, key, false), 0o644))
+	a, err := NewAPKImplementation(WithFS(src))
+	require.NoError(t, err)
+	a.SetClient(&http.Client{Transport: &testLocalTransport{root: dir, basenameOnly: true}})
+
+	// without a policy, as apk does, any package is installed
+	_, err = a.downloadPackage("https://example.com/pkgs/hello.apk")
+	require.NoError(t, err)
+
+	// with a policy, an unpinned package must be signed by the keyring
+	require.NoError(t, a.SetSignaturePolicy(SignaturePolicy{Default: SignatureModeEnforce}))
+	_, err = a.downloadPackage("https://example.com/pkgs/hello.apk")
+	require.ErrorContains(t, err, "not signed")
+	sum := sha256.Sum256(unsigned)
+	_, err = a.downloadPackage("https://example.com/pkgs/hello.apk#sha256=" + hex.EncodeToString(sum[:]))
+	require.NoError(t, err, "a pinned package needs no signature")
+	got, err := a.downloadPackage("https://example.com/pkgs/signed.apk")
+	require.NoError(t, err)
+	require.Equal(t, append(signedControl, data.Bytes()...), got)
+
+	require.NoError(t, src.Remove(filepath.Join(keysDirPath, keyName)))
+	_, err = a.downloadPackage("https://example.com/pkgs/signed.apk")
+	require.Error(t, err, "the key of the signature is not in the keyring")
+
+	// the download is bounded
+	a.limits = InputLimits{MaxPackageSize: 64}
+	_, err = a.downloadPackage("https://example.com/pkgs/hello.apk#sha256=" + hex.EncodeToString(sum[:]))
+	require.ErrorContains(t, err, "larger than the limit")
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// SetNoarchFallback sets whether packages are also resolved from the noarch
+// index of each repository, e.g. https://example.com/os/noarch/APKINDEX.tar.gz,
+// which is skipped if missing. Its packages are only used where no package
+// of the indexes of the architecture matches.
+func (a *APKImplementation) SetNoarchFallback(fallback bool) {
+	a.noarchFallback = fallback
+}
+
+// isNoarchFallback reports whether the package comes from the noarch index
+// of a repository, rather than the one of the architecture.
+func isNoarchFallback(pkg *repository.RepositoryPackage) bool {
+	repo := pkg.Repository()
+	return repo != nil && repo.Repository != nil && strings.HasSuffix(repo.Uri, "/"+noarchArch)
+}
+
+// repositoryURL returns the URL of the repository of the package, as found
+// in /etc/apk/repositories, i.e. without the architecture.
+func (a *APKImplementation) repositoryURL(pkg *repository.RepositoryPackage) string {
+	if isNoarchFallback(pkg) {
+		return strings.TrimSuffix(pkg.Repository().Uri, "/"+noarchArch)
+	}
+	return strings.TrimSuffix(pkg.Repository().Uri, "/"+a.arch)
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func testWriteIndex(t *testing.T, dir string, pkgs ...*repository.Package) []byte {
+	t.Helper()
+	data, err := writeIndexArchive(&repository.ApkIndex{Packages: pkgs})
+	require.NoError(t, err)
+	if dir != "" {
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, indexFilename), data, 0o644))
+	}
+	return data
+}
+
+func TestNoarchIndexes(t *testing.T) {
+	local := t.TempDir()
+	testWriteIndex(t, filepath.Join(local, "x86_64"), &repository.Package{Name: "hello", Version: "1.0-r0", Arch: "x86_64"})
+	testWriteIndex(t, filepath.Join(local, noarchArch),
+		&repository.Package{Name: "hello", Version: "2.0-r0", Arch: noarchArch},
+		&repository.Package{Name: "hello-doc", Version: "2.0-r0", Arch: noarchArch},
+	)
+
+	remoteIndex := testWriteIndex(t, "", &repository.Package{Name: "busybox", Version: "1.36.0-r0", Arch: "x86_64"})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/os/x86_64/"+indexFilename {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(remoteIndex)
+	}))
+	defer srv.Close()
+
+	repos := []string{local, srv.URL + "/os"}
+	indexes, err := GetRepositoryIndexes(repos, nil, "x86_64", WithIgnoreSignatures(true), WithHTTPClient(srv.Client()))
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+
+	indexes, err = GetRepositoryIndexes(repos, nil, "x86_64", WithIgnoreSignatures(true), WithHTTPClient(srv.Client()), WithIndexNoarch(true))
+	require.NoError(t, err)
+	require.Len(t, indexes, 3, "the missing remote noarch index is skipped")
+	require.Equal(t, filepath.Join(local, noarchArch), indexes[1].repo.Uri)
+
+	named := make([]NamedIndex, 0, len(indexes))
+	for _, index := range indexes {
+		named = append(named, index)
+	}
+	resolver := NewPkgResolver(named)
+
+	pkgs, err := resolver.ResolvePackage("hello")
+	require.NoError(t, err)
+	require.Equal(t, "1.0-r0", pkgs[0].Version, "the package built for the architecture wins")
+	require.True(t, isNoarchFallback(pkgs[1]))
+
+	pkgs, err = resolver.ResolvePackage("hello>1.0-r0")
+	require.NoError(t, err)
+	require.Equal(t, "2.0-r0", pkgs[0].Version)
+
+	pkgs, err = resolver.ResolvePackage("hello-doc")
+	require.NoError(t, err)
+	require.Equal(t, "2.0-r0", pkgs[0].Version)
+
+	a := &APKImplementation{arch: "x86_64"}
+	require.Equal(t, local, a.repositoryURL(pkgs[0]))
+}
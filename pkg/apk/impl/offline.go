@@ -0,0 +1,86 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// OfflineError is returned in offline mode when keys, indexes or packages
+// can only be had from the network. It lists all of those found, so that
+// they can be made available locally at once.
+type OfflineError struct {
+	// Missing are the URLs of the artifacts which would be downloaded.
+	Missing []string
+}
+
+func (e *OfflineError) Error() string {
+	return fmt.Sprintf("offline mode forbids downloading %d artifacts:\n  %s", len(e.Missing), strings.Join(e.Missing, "\n  "))
+}
+
+// WithOffline forbids any network access: keys, indexes and packages must
+// come from local paths, and anything else fails with an *OfflineError.
+func WithOffline(offline bool) Option {
+	return func(o *opts) error {
+		o.offline = offline
+		return nil
+	}
+}
+
+// WithIndexOffline fails, with an *OfflineError, to get the indexes of
+// repositories which are not local.
+func WithIndexOffline(offline bool) IndexOption {
+	return func(o *indexOpts) {
+		o.offline = offline
+	}
+}
+
+// offlineClient is the http client of offline mode, which fails all
+// requests, so that nothing missed by the checks reaches the network.
+var offlineClient = &http.Client{Transport: offlineTransport{}}
+
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("network access to %s is disabled in offline mode", req.URL)
+}
+
+// isRemote reports whether a key, repository or package location needs the
+// network.
+func isRemote(location string) bool {
+	return strings.HasPrefix(location, "https://") || strings.HasPrefix(location, "http://")
+}
+
+// offlineMissing returns an *OfflineError for the packages which would be
+// downloaded, if any. Packages given as .apk files or URLs were read already.
+func (a *APKImplementation) offlineMissing(pkgs []*repository.RepositoryPackage) error {
+	var missing []string
+	for _, pkg := range pkgs {
+		if _, ok := a.localPackages[pkg.Package]; ok {
+			continue
+		}
+		if u := pkg.Url(); isRemote(u) {
+			missing = append(missing, u)
+		}
+	}
+	if len(missing) > 0 {
+		return &OfflineError{Missing: missing}
+	}
+	return nil
+}
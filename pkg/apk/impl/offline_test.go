@@ -0,0 +1,89 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+func TestOfflineKeyring(t *testing.T) {
+	a, err := NewAPKImplementation(WithFS(apkfs.NewMemFS()), WithOffline(true))
+	require.NoError(t, err)
+
+	// the client cannot be swapped for one reaching the network
+	a.SetClient(&http.Client{Transport: &testLocalTransport{root: "testdata", basenameOnly: true}})
+	require.Equal(t, offlineClient, a.client)
+
+	keyPath := filepath.Join(t.TempDir(), "alpine-devel@lists.alpinelinux.org-5e69ca50.rsa.pub")
+	require.NoError(t, os.WriteFile(keyPath, []byte(testDemoKey), 0o644))
+	remote := "https://alpinelinux.org/keys/alpine-devel%40lists.alpinelinux.org-4a6a0840.rsa.pub"
+
+	err = a.InitKeyring([]string{keyPath, remote}, nil)
+	var offlineErr *OfflineError
+	require.True(t, errors.As(err, &offlineErr), "unexpected error %v", err)
+	require.Equal(t, []string{remote}, offlineErr.Missing)
+
+	require.NoError(t, a.InitKeyring([]string{keyPath}, nil))
+}
+
+func TestOfflineRepositoryIndexes(t *testing.T) {
+	local := t.TempDir()
+	index, err := os.ReadFile("testdata/APKINDEX.tar.gz")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(local, "x86_64"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(local, "x86_64", indexFilename), index, 0o644))
+
+	repos := []string{"https://example.com/os", local, "@other https://example.com/other"}
+	indexes, err := GetRepositoryIndexes(repos, nil, "x86_64", WithIgnoreSignatures(true), WithIndexOffline(true))
+	var offlineErr *OfflineError
+	require.True(t, errors.As(err, &offlineErr), "unexpected error %v", err)
+	require.Equal(t, []string{
+		"https://example.com/os/x86_64/" + indexFilename,
+		"https://example.com/other/x86_64/" + indexFilename,
+	}, offlineErr.Missing)
+	require.Len(t, indexes, 1)
+
+	_, err = GetRepositoryIndexes(repos[1:2], nil, "x86_64", WithIgnoreSignatures(true), WithIndexOffline(true))
+	require.NoError(t, err)
+}
+
+func TestOfflineMissing(t *testing.T) {
+	remote := &repository.RepositoryWithIndex{Repository: &repository.Repository{Uri: "https://example.com/os/x86_64"}}
+	local := &repository.RepositoryWithIndex{Repository: &repository.Repository{Uri: "/srv/packages/x86_64"}}
+	pkgs := []*repository.RepositoryPackage{
+		repository.NewRepositoryPackage(&repository.Package{Name: "busybox", Version: "1.36.0-r0"}, remote),
+		repository.NewRepositoryPackage(&repository.Package{Name: "hello", Version: "1.0-r0"}, local),
+		repository.NewRepositoryPackage(&repository.Package{Name: "app", Version: "1.0-r0"}, remote),
+	}
+
+	a := &APKImplementation{offline: true, localPackages: map[*repository.Package]localPackage{
+		pkgs[2].Package: {entry: "https://example.com/app-1.0-r0.apk"},
+	}}
+	err := a.offlineMissing(pkgs)
+	var offlineErr *OfflineError
+	require.True(t, errors.As(err, &offlineErr), "unexpected error %v", err)
+	require.Equal(t, []string{pkgs[0].Url()}, offlineErr.Missing)
+
+	require.NoError(t, a.offlineMissing(pkgs[1:]))
+}
@@ -16,6 +16,7 @@ package impl
 
 import (
 	"io"
+	"net/http"
 	"runtime"
 
 	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
@@ -29,6 +30,15 @@ type opts struct {
 	ignoreMknodErrors bool
 	fs                apkfs.FullFS
 	version           string
+	progress          Progress
+	limits            InputLimits
+	offline           bool
+	userAgent         string
+	headers           http.Header
+	strategy          ResolverStrategy
+	extractionCache   string
+	unsafePaths       bool
+	keepInstalled     bool
 }
 
 type Option func(*opts) error
@@ -74,6 +84,27 @@ func WithIgnoreMknodErrors(ignore bool) Option {
 	}
 }
 
+// WithUnsafePaths installs the entries of packages whose paths go through
+// "..", rather than failing on them, which is only safe for trusted packages.
+// Symlinks are resolved within the filesystem either way.
+func WithUnsafePaths(allow bool) Option {
+	return func(o *opts) error {
+		o.unsafePaths = allow
+		return nil
+	}
+}
+
+// WithKeepInstalled keeps the database of the packages installed in the
+// filesystem already when initializing it, rather than starting empty, so
+// that only the packages missing from it are installed, e.g. on top of an
+// image built before. Default is false.
+func WithKeepInstalled(keep bool) Option {
+	return func(o *opts) error {
+		o.keepInstalled = keep
+		return nil
+	}
+}
+
 // WithFS sets the filesystem to use. If not provided, will use the OS filesystem based at root /.
 func WithFS(fs apkfs.FullFS) Option {
 	return func(o *opts) error {
@@ -92,5 +123,6 @@ func defaultOpts() *opts {
 		arch:              ArchToAPK(runtime.GOARCH),
 		ignoreMknodErrors: false,
 		fs:                fs,
+		progress:          noProgress{},
 	}
 }
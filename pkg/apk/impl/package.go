@@ -23,25 +23,42 @@ import (
 )
 
 // PackageToIndex takes a Package and returns it as the string representation of lines in an index file.
+// The fields are in the order apk-tools writes them, and the empty ones are left out as it does.
 func PackageToIndex(pkg *repository.Package) (out []string) {
+	if len(pkg.Checksum) > 0 {
+		out = append(out, fmt.Sprintf("C:Q1%s", base64.StdEncoding.EncodeToString(pkg.Checksum)))
+	}
 	out = append(out, fmt.Sprintf("P:%s", pkg.Name))
 	out = append(out, fmt.Sprintf("V:%s", pkg.Version))
 	out = append(out, fmt.Sprintf("A:%s", pkg.Arch))
-	out = append(out, fmt.Sprintf("L:%s", pkg.License))
-	out = append(out, fmt.Sprintf("T:%s", pkg.Description))
-	out = append(out, fmt.Sprintf("o:%s", pkg.Origin))
-	out = append(out, fmt.Sprintf("m:%s", pkg.Maintainer))
-	out = append(out, fmt.Sprintf("U:%s", pkg.URL))
-	out = append(out, fmt.Sprintf("D:%s", strings.Join(pkg.Dependencies, " ")))
-	out = append(out, fmt.Sprintf("p:%s", strings.Join(pkg.Provides, " ")))
-	out = append(out, fmt.Sprintf("c:%s", pkg.RepoCommit))
-	out = append(out, fmt.Sprintf("i:%s", pkg.InstallIf))
-	out = append(out, fmt.Sprintf("t:%d", pkg.BuildTime.Unix()))
 	out = append(out, fmt.Sprintf("S:%d", pkg.Size))
 	out = append(out, fmt.Sprintf("I:%d", pkg.InstalledSize))
-	out = append(out, fmt.Sprintf("k:%d", pkg.ProviderPriority))
-	if len(pkg.Checksum) > 0 {
-		out = append(out, fmt.Sprintf("C:Q1%s", base64.StdEncoding.EncodeToString(pkg.Checksum)))
+	out = append(out, fmt.Sprintf("T:%s", pkg.Description))
+	out = append(out, fmt.Sprintf("U:%s", pkg.URL))
+	out = append(out, fmt.Sprintf("L:%s", pkg.License))
+	if pkg.Origin != "" {
+		out = append(out, fmt.Sprintf("o:%s", pkg.Origin))
+	}
+	if pkg.Maintainer != "" {
+		out = append(out, fmt.Sprintf("m:%s", pkg.Maintainer))
+	}
+	if !pkg.BuildTime.IsZero() && pkg.BuildTime.Unix() != 0 {
+		out = append(out, fmt.Sprintf("t:%d", pkg.BuildTime.Unix()))
+	}
+	if pkg.RepoCommit != "" {
+		out = append(out, fmt.Sprintf("c:%s", pkg.RepoCommit))
+	}
+	if pkg.ProviderPriority != 0 {
+		out = append(out, fmt.Sprintf("k:%d", pkg.ProviderPriority))
+	}
+	if len(pkg.Dependencies) > 0 {
+		out = append(out, fmt.Sprintf("D:%s", strings.Join(pkg.Dependencies, " ")))
+	}
+	if len(pkg.Provides) > 0 {
+		out = append(out, fmt.Sprintf("p:%s", strings.Join(pkg.Provides, " ")))
+	}
+	if len(pkg.InstallIf) > 0 {
+		out = append(out, fmt.Sprintf("i:%s", strings.Join(pkg.InstallIf, " ")))
 	}
 
 	return
@@ -0,0 +1,97 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// checksumPinSeparator introduces the SHA-256 hash of the .apk file a
+// package of the world is pinned to, e.g. busybox=1.36.0-r0@sha256:<hex>.
+const checksumPinSeparator = "@sha256:"
+
+// splitChecksumPin returns the world entry without its checksum pin, and
+// the hash it pins, if any.
+func splitChecksumPin(entry string) (string, string, error) {
+	i := strings.LastIndex(entry, checksumPinSeparator)
+	if i < 0 {
+		return entry, "", nil
+	}
+	sum := strings.ToLower(entry[i+len(checksumPinSeparator):])
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return "", "", fmt.Errorf("invalid checksum pin of %s, must be %s<hex>", entry, checksumPinSeparator)
+	}
+	return entry[:i], sum, nil
+}
+
+// checksumPins returns the world without checksum pins, and the hashes
+// pinned by package name.
+func checksumPins(world []string) ([]string, map[string]string, error) {
+	pins := map[string]string{}
+	stripped := make([]string, 0, len(world))
+	for _, entry := range world {
+		pkg, sum, err := splitChecksumPin(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sum != "" {
+			name, _, _, _ := resolvePackageNameVersionPin(pkg)
+			pins[name] = sum
+		}
+		stripped = append(stripped, pkg)
+	}
+	return stripped, pins, nil
+}
+
+// checkChecksumPins checks that each pinned package is installed under its
+// name, rather than provided by another package, which the pin cannot be
+// about.
+func checkChecksumPins(pins map[string]string, pkgs []*repository.RepositoryPackage) error {
+	for name := range pins {
+		found := false
+		for _, pkg := range pkgs {
+			if pkg.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("package %s has a checksum pin but no package of that name is installed", name)
+		}
+	}
+	return nil
+}
+
+// forgetChecksumPins removes the checksum pins from the world, which apk
+// inside the image would not understand.
+func (a *APKImplementation) forgetChecksumPins() error {
+	if len(a.checksumPins) == 0 {
+		return nil
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return err
+	}
+	world, _, err = checksumPins(world)
+	if err != nil {
+		return err
+	}
+	return a.SetWorld(world)
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestChecksumPins(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+
+	world, pins, err := checksumPins([]string{
+		"busybox=1.36.0-r0@sha256:" + strings.ToUpper(sum),
+		"alpine-baselayout@local",
+		"zlib@edge@sha256:" + sum,
+		"https://example.com/hello-1.0-r0.apk#sha256=" + sum,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"busybox=1.36.0-r0",
+		"alpine-baselayout@local",
+		"zlib@edge",
+		"https://example.com/hello-1.0-r0.apk#sha256=" + sum,
+	}, world)
+	require.Equal(t, map[string]string{"busybox": sum, "zlib": sum}, pins)
+
+	for _, invalid := range []string{"busybox@sha256:", "busybox@sha256:abc", "busybox@sha256:" + strings.Repeat("zz", 32)} {
+		_, _, err := checksumPins([]string{invalid})
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestCheckChecksumPins(t *testing.T) {
+	repo := &repository.RepositoryWithIndex{Repository: &repository.Repository{Uri: "https://example.com/os/x86_64"}}
+	pkgs := []*repository.RepositoryPackage{
+		repository.NewRepositoryPackage(&repository.Package{Name: "busybox", Version: "1.36.0-r0"}, repo),
+	}
+	require.NoError(t, checkChecksumPins(map[string]string{"busybox": "00"}, pkgs))
+	// a pin on a name only provided by a package cannot hold
+	require.Error(t, checkChecksumPins(map[string]string{"/bin/sh": "00"}, pkgs))
+}
@@ -0,0 +1,135 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// pkgInfo is what the .PKGINFO of a package says about it.
+type pkgInfo struct {
+	repository.Package
+	// Triggers are the paths whose changes trigger the trigger script of the
+	// package.
+	Triggers []string
+	// DataHash is the hex encoded SHA-256 hash of the data section of the
+	// package, if recorded.
+	DataHash string
+	// Replaces are the packages whose files the package may overwrite.
+	Replaces []string
+}
+
+// readControlPkgInfo parses the .PKGINFO of the control section of a
+// package, a tar.gz stream. A control section without one has no info.
+func readControlPkgInfo(controlTarGz io.Reader, limits InputLimits) (*pkgInfo, error) {
+	gz, err := gzip.NewReader(controlTarGz)
+	if err != nil {
+		return nil, fmt.Errorf("unable to gunzip control tar file: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return &pkgInfo{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == ".PKGINFO" {
+			return parsePkgInfo(tr, limits)
+		}
+	}
+}
+
+// parsePkgInfo parses a .PKGINFO, made of "<key> = <value>" lines, where
+// the keys listing things, e.g. depend, may be repeated. Comments and
+// unknown keys are ignored.
+func parsePkgInfo(r io.Reader, limits InputLimits) (*pkgInfo, error) {
+	info := &pkgInfo{}
+	scanner := newLineScanner(limitReader(r, limits.MaxControlSize, ".PKGINFO"), limits)
+	linenr := 0
+	for scanner.Scan() {
+		linenr++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("cannot parse line %d: expected \"=\" not found", linenr)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "pkgname":
+			info.Name = value
+		case "pkgver":
+			info.Version = value
+		case "pkgdesc":
+			info.Description = value
+		case "url":
+			info.URL = value
+		case "arch":
+			info.Arch = value
+		case "license":
+			info.License = value
+		case "origin":
+			info.Origin = value
+		case "maintainer":
+			info.Maintainer = value
+		case "commit":
+			info.RepoCommit = value
+		case "builddate":
+			var i int64
+			if i, err = strconv.ParseInt(value, 10, 64); err == nil {
+				info.BuildTime = time.Unix(i, 0)
+			}
+		case "size":
+			info.InstalledSize, err = strconv.ParseUint(value, 10, 64)
+		case "provider_priority":
+			info.ProviderPriority, err = strconv.ParseUint(value, 10, 64)
+		case "depend":
+			info.Dependencies = append(info.Dependencies, value)
+		case "provides":
+			info.Provides = append(info.Provides, value)
+		case "install_if":
+			info.InstallIf = append(info.InstallIf, strings.Fields(value)...)
+		case "datahash":
+			info.DataHash = value
+		case "triggers":
+			info.Triggers = append(info.Triggers, strings.Fields(value)...)
+		case "replaces":
+			info.Replaces = append(info.Replaces, strings.Fields(value)...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse line %d: invalid %s: %w", linenr, key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot parse line %d: %w", linenr+1, err)
+	}
+	return info, nil
+}
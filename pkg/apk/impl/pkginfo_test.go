@@ -0,0 +1,71 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testPkgInfo = `# Generated by abuild 3.10.0-r0
+# using fakeroot version 1.29
+# Thu Jan  1 00:00:00 UTC 2023
+pkgname = busybox
+pkgver = 1.36.0-r0
+pkgdesc = Size optimized toolbox of many common UNIX utilities
+url = https://busybox.net/
+builddate = 1673000000
+size = 958464
+arch = x86_64
+origin = busybox
+license = GPL-2.0-only
+depend = so:libc.musl-x86_64.so.1
+depend = /bin/sh
+provides = cmd:busybox=1.36.0-r0
+replaces = busybox-initscripts
+triggers = /bin /usr/bin /sbin /usr/sbin /lib/modules/*
+`
+
+func TestParsePkgInfo(t *testing.T) {
+	info, err := parsePkgInfo(strings.NewReader(testPkgInfo), InputLimits{})
+	require.NoError(t, err)
+	require.Equal(t, "busybox", info.Name)
+	require.Equal(t, "1.36.0-r0", info.Version)
+	require.Equal(t, "x86_64", info.Arch)
+	require.Equal(t, uint64(958464), info.InstalledSize)
+	require.Equal(t, []string{"so:libc.musl-x86_64.so.1", "/bin/sh"}, info.Dependencies)
+	require.Equal(t, []string{"cmd:busybox=1.36.0-r0"}, info.Provides)
+	require.Equal(t, []string{"/bin", "/usr/bin", "/sbin", "/usr/sbin", "/lib/modules/*"}, info.Triggers)
+	require.Equal(t, []string{"busybox-initscripts"}, info.Replaces)
+
+	_, err = parsePkgInfo(strings.NewReader(testPkgInfo), InputLimits{MaxControlSize: 64})
+	require.ErrorContains(t, err, "larger than the limit")
+
+	_, err = parsePkgInfo(strings.NewReader("pkgname busybox\n"), InputLimits{})
+	require.Error(t, err)
+
+	_, err = parsePkgInfo(strings.NewReader("size = big\n"), InputLimits{})
+	require.Error(t, err)
+}
+
+func FuzzParsePkgInfo(f *testing.F) {
+	f.Add([]byte(testPkgInfo))
+	f.Add([]byte("pkgname busybox\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = parsePkgInfo(strings.NewReader(string(data)), HardenedInputLimits())
+	})
+}
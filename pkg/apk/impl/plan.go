@@ -0,0 +1,103 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"fmt"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// What installing the world does with a package.
+const (
+	// PlanInstall downloads and installs the package.
+	PlanInstall = "install"
+	// PlanKeep leaves the package as it is, since it is already installed.
+	PlanKeep = "keep"
+)
+
+// PlannedPackage is a package of the world, and what installing the world does
+// with it.
+type PlannedPackage struct {
+	Action     string `json:"action"`
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Arch       string `json:"arch"`
+	Repository string `json:"repository,omitempty"`
+	// Size is what downloading the package takes, and InstalledSize what
+	// its files take once installed.
+	Size          uint64 `json:"size"`
+	InstalledSize uint64 `json:"installed-size"`
+}
+
+// Plan lists what installing the world does, in order.
+type Plan struct {
+	Packages []PlannedPackage `json:"packages"`
+	// DownloadSize and InstalledSize are the totals of the packages to
+	// install.
+	DownloadSize  uint64 `json:"download-size"`
+	InstalledSize uint64 `json:"installed-size"`
+}
+
+// NewPlan returns the plan for installing the resolved packages, in order, on
+// top of the installed ones.
+func NewPlan(pkgs []*repository.RepositoryPackage, installed []*InstalledPackage) *Plan {
+	isInstalled := map[string]bool{}
+	for _, pkg := range installed {
+		isInstalled[pkg.Name] = true
+	}
+
+	plan := &Plan{Packages: make([]PlannedPackage, 0, len(pkgs))}
+	for _, pkg := range pkgs {
+		planned := PlannedPackage{
+			Action:        PlanInstall,
+			Name:          pkg.Name,
+			Version:       pkg.Version,
+			Arch:          pkg.Arch,
+			Repository:    pkg.Repository().Uri,
+			Size:          pkg.Size,
+			InstalledSize: pkg.InstalledSize,
+		}
+		if isInstalled[pkg.Name] {
+			planned.Action = PlanKeep
+		} else {
+			plan.DownloadSize += pkg.Size
+			plan.InstalledSize += pkg.InstalledSize
+		}
+		plan.Packages = append(plan.Packages, planned)
+	}
+	return plan
+}
+
+// PlanWorld resolves the world like FixateWorld does, and returns what it would
+// do, without downloading any package or changing anything.
+func (a *APKImplementation) PlanWorld() (*Plan, error) {
+	allpkgs, conflicts, err := a.ResolveWorld()
+	if err != nil {
+		return nil, fmt.Errorf("error getting package dependencies: %w", err)
+	}
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range conflicts {
+		for _, i := range installed {
+			if i.Name == pkg {
+				return nil, fmt.Errorf("cannot install due to conflict with %s", pkg)
+			}
+		}
+	}
+	return NewPlan(allpkgs, installed), nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestNewPlan(t *testing.T) {
+	repo := &repository.RepositoryWithIndex{Repository: &repository.Repository{Uri: "https://example.com/os/x86_64"}}
+	pkgs := []*repository.RepositoryPackage{
+		repository.NewRepositoryPackage(&repository.Package{Name: "libc", Version: "1.0-r0", Arch: "x86_64", Size: 100, InstalledSize: 300}, repo),
+		repository.NewRepositoryPackage(&repository.Package{Name: "busybox", Version: "1.36-r1", Arch: "x86_64", Size: 500, InstalledSize: 900}, repo),
+		repository.NewRepositoryPackage(&repository.Package{Name: "tzdata", Version: "2023c-r0", Arch: "noarch", Size: 50, InstalledSize: 70}, repo),
+	}
+	installed := []*InstalledPackage{{Package: repository.Package{Name: "libc", Version: "1.0-r0"}}}
+
+	plan := NewPlan(pkgs, installed)
+	require.Equal(t, []PlannedPackage{
+		{Action: PlanKeep, Name: "libc", Version: "1.0-r0", Arch: "x86_64", Repository: "https://example.com/os/x86_64", Size: 100, InstalledSize: 300},
+		{Action: PlanInstall, Name: "busybox", Version: "1.36-r1", Arch: "x86_64", Repository: "https://example.com/os/x86_64", Size: 500, InstalledSize: 900},
+		{Action: PlanInstall, Name: "tzdata", Version: "2023c-r0", Arch: "noarch", Repository: "https://example.com/os/x86_64", Size: 50, InstalledSize: 70},
+	}, plan.Packages)
+	require.Equal(t, uint64(550), plan.DownloadSize)
+	require.Equal(t, uint64(970), plan.InstalledSize)
+}
@@ -0,0 +1,141 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// SignatureMode is how strictly the signatures of a repository are checked.
+type SignatureMode string
+
+const (
+	// SignatureModeEnforce fails if a repository index cannot be verified
+	// with one of the keys allowed for it.
+	SignatureModeEnforce SignatureMode = "enforce"
+	// SignatureModeWarn logs a warning and carries on if a repository index
+	// cannot be verified with one of the keys allowed for it.
+	SignatureModeWarn SignatureMode = "warn"
+)
+
+// RepositorySignaturePolicy restricts which keys may sign a repository,
+// and how strictly that is checked.
+type RepositorySignaturePolicy struct {
+	// Repository is the repository as found in /etc/apk/repositories,
+	// without any pin.
+	Repository string
+	// Keys are the names of the keys in the keyring which may sign the
+	// repository. If empty, any key in the keyring may sign it.
+	Keys []string
+	// Mode overrides the default mode of the policy for the repository.
+	Mode SignatureMode
+}
+
+// SignaturePolicy describes the keys which may sign each repository. With
+// a policy in place, each installed package must also match the checksum
+// in the index it was resolved from, so it is attributed to the key which
+// signed that index.
+// The zero value enforces that every repository is signed by any key in
+// the keyring and does not check packages, which is what apk does.
+type SignaturePolicy struct {
+	// Default is the mode for repositories without a mode of their own,
+	// enforce if empty.
+	Default SignatureMode
+	// Repositories are the policies for specific repositories.
+	Repositories []RepositorySignaturePolicy
+}
+
+// IsZero reports whether the policy is the zero value.
+func (p SignaturePolicy) IsZero() bool {
+	return p.Default == "" && len(p.Repositories) == 0
+}
+
+// Validate checks that all the modes are known, and that each repository
+// has a single policy.
+func (p SignaturePolicy) Validate() error {
+	if err := p.Default.validate(); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, rp := range p.Repositories {
+		if rp.Repository == "" {
+			return fmt.Errorf("signature policy without a repository")
+		}
+		repo := normalizeRepository(rp.Repository)
+		if seen[repo] {
+			return fmt.Errorf("repository %s has more than one signature policy", rp.Repository)
+		}
+		seen[repo] = true
+		if err := rp.Mode.validate(); err != nil {
+			return fmt.Errorf("repository %s: %w", rp.Repository, err)
+		}
+	}
+	return nil
+}
+
+func (m SignatureMode) validate() error {
+	switch m {
+	case "", SignatureModeEnforce, SignatureModeWarn:
+		return nil
+	default:
+		return fmt.Errorf("unknown signature mode %q, must be %q or %q", m, SignatureModeEnforce, SignatureModeWarn)
+	}
+}
+
+// forRepository returns the mode and the allowed key names for the given
+// repository URL.
+func (p SignaturePolicy) forRepository(repoURL string) (SignatureMode, []string) {
+	mode := p.Default
+	if mode == "" {
+		mode = SignatureModeEnforce
+	}
+	repoURL = normalizeRepository(repoURL)
+	for _, rp := range p.Repositories {
+		if normalizeRepository(rp.Repository) != repoURL {
+			continue
+		}
+		if rp.Mode != "" {
+			mode = rp.Mode
+		}
+		return mode, rp.Keys
+	}
+	return mode, nil
+}
+
+func normalizeRepository(repo string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(repo, "file://"), "/")
+}
+
+// allowedKeys returns the keys from the keyring which are in the allowed
+// list, or all of them if the list is empty. Allowed keys may be given
+// the same way as in the keyring, e.g. as a URL, only their file name is
+// compared.
+func allowedKeys(keys map[string][]byte, allowed []string) (map[string][]byte, error) {
+	if len(allowed) == 0 {
+		return keys, nil
+	}
+	filtered := make(map[string][]byte, len(allowed))
+	for _, name := range allowed {
+		name = path.Base(name)
+		data, ok := keys[name]
+		if !ok {
+			return nil, fmt.Errorf("allowed key %s is not in the keyring", name)
+		}
+		filtered[name] = data
+	}
+	return filtered, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignaturePolicyValidate(t *testing.T) {
+	require.NoError(t, SignaturePolicy{}.Validate())
+	require.NoError(t, SignaturePolicy{
+		Default: SignatureModeWarn,
+		Repositories: []RepositorySignaturePolicy{
+			{Repository: "https://packages.wolfi.dev/os", Keys: []string{"wolfi-signing.rsa.pub"}, Mode: SignatureModeEnforce},
+		},
+	}.Validate())
+	require.Error(t, SignaturePolicy{Default: "maybe"}.Validate())
+	require.Error(t, SignaturePolicy{
+		Repositories: []RepositorySignaturePolicy{{Keys: []string{"a.rsa.pub"}}},
+	}.Validate())
+	require.Error(t, SignaturePolicy{
+		Repositories: []RepositorySignaturePolicy{
+			{Repository: "https://packages.wolfi.dev/os"},
+			{Repository: "https://packages.wolfi.dev/os/"},
+		},
+	}.Validate())
+}
+
+func TestSignaturePolicyForRepository(t *testing.T) {
+	policy := SignaturePolicy{
+		Default: SignatureModeWarn,
+		Repositories: []RepositorySignaturePolicy{
+			{Repository: "https://packages.wolfi.dev/os/", Keys: []string{"wolfi-signing.rsa.pub"}, Mode: SignatureModeEnforce},
+			{Repository: "/work/packages", Keys: []string{"local.rsa.pub"}},
+		},
+	}
+
+	mode, keys := policy.forRepository("https://packages.wolfi.dev/os")
+	require.Equal(t, SignatureModeEnforce, mode)
+	require.Equal(t, []string{"wolfi-signing.rsa.pub"}, keys)
+
+	mode, keys = policy.forRepository("file:///work/packages")
+	require.Equal(t, SignatureModeWarn, mode)
+	require.Equal(t, []string{"local.rsa.pub"}, keys)
+
+	mode, keys = policy.forRepository("https://dl-cdn.alpinelinux.org/alpine/edge/main")
+	require.Equal(t, SignatureModeWarn, mode)
+	require.Empty(t, keys)
+
+	mode, _ = SignaturePolicy{}.forRepository("https://dl-cdn.alpinelinux.org/alpine/edge/main")
+	require.Equal(t, SignatureModeEnforce, mode)
+}
+
+func TestGetRepositoryIndexesSignaturePolicy(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	const (
+		arch      = "x86_64"
+		keyName   = "repo.rsa.pub"
+		otherName = "other.rsa.pub"
+	)
+
+	repo := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, arch), 0o755))
+	index := testSignedIndex(t, key, keyName, ".SIGN.RSA256.")
+	require.NoError(t, os.WriteFile(filepath.Join(repo, arch, indexFilename), index, 0o644))
+
+	keys := map[string][]byte{
+		keyName:   testPublicKeyPEM(t, key, false),
+		otherName: testPublicKeyPEM(t, other, false),
+	}
+	policy := func(mode SignatureMode, allowed ...string) IndexOption {
+		return WithSignaturePolicy(SignaturePolicy{
+			Repositories: []RepositorySignaturePolicy{{Repository: repo, Keys: allowed, Mode: mode}},
+		}, nil)
+	}
+
+	t.Run("allowed key", func(t *testing.T) {
+		indexes, err := GetRepositoryIndexes([]string{repo}, keys, arch, policy("", keyName))
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+	})
+	t.Run("any key", func(t *testing.T) {
+		indexes, err := GetRepositoryIndexes([]string{repo}, keys, arch, policy(""))
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+	})
+	t.Run("key not allowed", func(t *testing.T) {
+		_, err := GetRepositoryIndexes([]string{repo}, keys, arch, policy(SignatureModeEnforce, otherName))
+		require.Error(t, err)
+	})
+	t.Run("key not allowed, warn only", func(t *testing.T) {
+		indexes, err := GetRepositoryIndexes([]string{repo}, keys, arch, policy(SignatureModeWarn, otherName))
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+	})
+	t.Run("allowed key not in keyring", func(t *testing.T) {
+		_, err := GetRepositoryIndexes([]string{repo}, keys, arch, policy("", "missing.rsa.pub"))
+		require.Error(t, err)
+	})
+}
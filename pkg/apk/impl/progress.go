@@ -0,0 +1,70 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import "io"
+
+// Progress is told how installing the world goes, e.g. to show a progress
+// bar. Packages are installed one after the other, and the calls about a
+// package come between its Start and Done.
+type Progress interface {
+	// Start is called before installing a package, the nth of total to
+	// install, counting from 1.
+	Start(pkg string, n, total int)
+	// Download is called as the package is downloaded, with the bytes read
+	// so far and the size of the package, or 0 if it is not known.
+	Download(read, size int64)
+	// Extract is called as the files of the package are installed, with the
+	// number of files installed so far.
+	Extract(files int)
+	// Done is called once the package is installed.
+	Done()
+}
+
+// WithProgress reports how installing the world goes to the progress, or to
+// nothing if it is nil.
+func WithProgress(progress Progress) Option {
+	return func(o *opts) error {
+		if progress == nil {
+			progress = noProgress{}
+		}
+		o.progress = progress
+		return nil
+	}
+}
+
+type noProgress struct{}
+
+func (noProgress) Start(string, int, int) {}
+func (noProgress) Download(int64, int64)  {}
+func (noProgress) Extract(int)            {}
+func (noProgress) Done()                  {}
+
+// progressReader reports the bytes read from a package as it is downloaded.
+type progressReader struct {
+	io.ReadCloser
+	progress Progress
+	read     int64
+	size     int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.read += int64(n)
+		r.progress.Download(r.read, r.size)
+	}
+	return n, err
+}
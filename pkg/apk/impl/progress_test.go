@@ -0,0 +1,72 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingProgress struct {
+	noProgress
+	read    []int64
+	extract []int
+}
+
+func (p *recordingProgress) Download(read, size int64) {
+	p.read = append(p.read, read)
+}
+
+func (p *recordingProgress) Extract(files int) {
+	p.extract = append(p.extract, files)
+}
+
+func TestProgress(t *testing.T) {
+	apk, _, err := testGetTestAPK()
+	require.NoError(t, err)
+	progress := &recordingProgress{}
+	apk.progress = progress
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc", Typeflag: tar.TypeDir, Mode: 0o755}))
+	for _, name := range []string{"etc/a", "etc/b"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: 5}))
+		_, err := tw.Write([]byte("hello"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	_, err = apk.installAPKFiles(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3}, progress.extract)
+
+	r := &progressReader{ReadCloser: io.NopCloser(bytes.NewReader(make([]byte, 10))), progress: progress, size: 10}
+	p := make([]byte, 4)
+	for {
+		if _, err := r.Read(p); err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			break
+		}
+	}
+	require.Equal(t, []int64{4, 8, 10}, progress.read)
+}
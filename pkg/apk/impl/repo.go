@@ -121,7 +121,16 @@ func (a *APKImplementation) getRepositoryIndexes(ignoreSignatures bool) ([]*name
 	// trim the newline
 	arch := strings.TrimSuffix(string(archB), "\n")
 
-	// create the list of keys
+	keys, err := a.keyring()
+	if err != nil {
+		return nil, err
+	}
+
+	return GetRepositoryIndexes(repos, keys, arch, WithIgnoreSignatures(ignoreSignatures), WithHTTPClient(a.httpClient()), WithSignaturePolicy(a.signaturePolicy, a.logger), WithIndexLimits(a.limits), WithIndexOffline(a.offline), WithIndexNoarch(a.noarchFallback))
+}
+
+// keyring returns the keys of the keyring, by file name.
+func (a *APKImplementation) keyring() (map[string][]byte, error) {
 	keys := make(map[string][]byte)
 	dir, err := a.fs.ReadDir(keysDirPath)
 	if err != nil {
@@ -138,8 +147,7 @@ func (a *APKImplementation) getRepositoryIndexes(ignoreSignatures bool) ([]*name
 		}
 		keys[d.Name()] = b
 	}
-
-	return GetRepositoryIndexes(repos, keys, arch, WithIgnoreSignatures(ignoreSignatures), WithHTTPClient(a.client))
+	return keys, nil
 }
 
 // PkgResolver resolves packages from a list of indexes.
@@ -156,6 +164,7 @@ type PkgResolver struct {
 	nameMap      map[string][]*repositoryPackage
 	providesMap  map[string][]*repositoryPackage
 	installIfMap map[string][]*repositoryPackage // contains any package that should be installed if the named package is installed
+	strategy     ResolverStrategy
 }
 
 // NewPkgResolver creates a new pkgResolver from a list of indexes.
@@ -212,7 +221,20 @@ func NewPkgResolver(indexes []NamedIndex) *PkgResolver {
 
 // GetPackagesWithDependencies get all of the dependencies for the given packages based on the
 // indexes. Does not filter for installed already or not.
+// The preferred package for each dependency is picked first; if those cannot be installed
+// together, other providers and versions are tried, failing with a *ResolutionError if
+// none work.
 func (p *PkgResolver) GetPackagesWithDependencies(packages []string) (toInstall []*repository.RepositoryPackage, conflicts []string, err error) {
+	toInstall, conflicts, err = p.getPreferredPackagesWithDependencies(packages)
+	if err == nil && consistent(packages, toInstall) {
+		return toInstall, conflicts, nil
+	}
+	return p.solve(packages)
+}
+
+// getPreferredPackagesWithDependencies picks the preferred package for each dependency,
+// regardless of the others.
+func (p *PkgResolver) getPreferredPackagesWithDependencies(packages []string) (toInstall []*repository.RepositoryPackage, conflicts []string, err error) {
 	var (
 		dependenciesMap = map[string]*repository.RepositoryPackage{}
 		installTracked  = map[string]*repository.RepositoryPackage{}
@@ -345,14 +367,14 @@ func (p *PkgResolver) ResolvePackage(pkgName string) (pkgs []*repository.Reposit
 		if len(packages) == 0 {
 			return nil, fmt.Errorf("could not find package %s in indexes: %w", pkgName, err)
 		}
-		sortPackages(packages, nil, name, nil, pin)
+		sortPackages(packages, nil, name, nil, pin, p.strategy)
 	} else {
 		providers, ok := p.providesMap[name]
 		if !ok || len(providers) == 0 {
 			return nil, fmt.Errorf("could not find package, alias or a package that provides %s in indexes", pkgName)
 		}
 		// we are going to do this in reverse order
-		sortPackages(providers, nil, name, nil, "")
+		sortPackages(providers, nil, name, nil, "", p.strategy)
 		packages = providers
 	}
 	for _, pkg := range packages {
@@ -450,7 +472,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *repository.RepositoryPackage,
 			if len(pkgs) == 0 {
 				return nil, nil, fmt.Errorf("could not find package %s in indexes", dep)
 			}
-			sortPackages(pkgs, nil, name, existing, "")
+			sortPackages(pkgs, nil, name, existing, "", p.strategy)
 			depPkg = pkgs[0].RepositoryPackage
 		} else {
 			// it was not the name of a package, see if some package provides this
@@ -481,7 +503,7 @@ func (p *PkgResolver) getPackageDependencies(pkg *repository.RepositoryPackage,
 				continue
 			}
 			// we are going to do this in reverse order
-			sortPackages(providers, pkg, name, existing, "")
+			sortPackages(providers, pkg, name, existing, "", p.strategy)
 			depPkg = providers[0].RepositoryPackage
 		}
 		// and then recurse to its children
@@ -516,7 +538,12 @@ func (p *PkgResolver) getPackageDependencies(pkg *repository.RepositoryPackage,
 // For example, if the original search was for package "a", then pkgs may contain some that
 // are named "a", but others that provided "a". In that case, we should look not at the
 // version of the package, but the version of "a" that the package provides.
-func sortPackages(pkgs []*repositoryPackage, compare *repository.RepositoryPackage, name string, existing map[string]*repository.RepositoryPackage, pin string) {
+// The strategy is whether higher or lower versions are preferred.
+func sortPackages(pkgs []*repositoryPackage, compare *repository.RepositoryPackage, name string, existing map[string]*repository.RepositoryPackage, pin string, strategy ResolverStrategy) {
+	preferred := greater
+	if strategy == PreferLowest {
+		preferred = less
+	}
 	// get existing origins
 	existingOrigins := map[string]bool{}
 	for _, pkg := range existing {
@@ -578,8 +605,14 @@ func sortPackages(pkgs []*repositoryPackage, compare *repository.RepositoryPacka
 		if pkgs[i].ProviderPriority != pkgs[j].ProviderPriority {
 			return pkgs[i].ProviderPriority > pkgs[j].ProviderPriority
 		}
+		// the noarch indexes are only a fallback
+		iFallback := isNoarchFallback(pkgs[i].RepositoryPackage)
+		jFallback := isNoarchFallback(pkgs[j].RepositoryPackage)
+		if iFallback != jFallback {
+			return jFallback
+		}
 		// both matched or both did not, so just compare versions
-		// version priority
+		// version priority, by the strategy
 		iVersion, err := parseVersion(iVersionStr)
 		if err != nil {
 			return false
@@ -590,7 +623,7 @@ func sortPackages(pkgs []*repositoryPackage, compare *repository.RepositoryPacka
 		}
 		versions := compareVersions(iVersion, jVersion)
 		if versions != equal {
-			return versions == greater
+			return versions == preferred
 		}
 		// if versions are equal, they might not be the same as the package versions
 		if iVersionStr != pkgs[i].Version || jVersionStr != pkgs[j].Version {
@@ -604,7 +637,7 @@ func sortPackages(pkgs []*repositoryPackage, compare *repository.RepositoryPacka
 			}
 			versions := compareVersions(iVersion, jVersion)
 			if versions != equal {
-				return versions == greater
+				return versions == preferred
 			}
 		}
 		// if versions are equal, compare names
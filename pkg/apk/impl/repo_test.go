@@ -369,6 +369,10 @@ func TestSortPackages(t *testing.T) {
 			{&repository.Package{Name: "package1", Version: "1.2.0", Origin: "a"}, "http://example.com", 3},
 			{&repository.Package{Name: "package1", Version: "1.2.0", Origin: "a"}, "http://a.b.com", 0},
 		}, &repoPkgBase{&repository.Package{Origin: "a"}, "http://a.b.com", 0}, nil},
+		{"noarch fallback", []repoPkgBase{
+			{&repository.Package{Name: "package1", Version: "2.0.1"}, "http://a.b.com/noarch", 1},
+			{&repository.Package{Name: "package1", Version: "1.0.0"}, "http://a.b.com/x86_64", 0},
+		}, nil, nil},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -391,7 +395,7 @@ func TestSortPackages(t *testing.T) {
 				existing[pkg.pkg.Name] = repository.NewRepositoryPackage(pkg.pkg, &repository.RepositoryWithIndex{Repository: &repository.Repository{Uri: pkg.repo}})
 			}
 			namedPkgs := testNamedPackageFromPackages(pkgs)
-			sortPackages(namedPkgs, pkg, "", existing, "")
+			sortPackages(namedPkgs, pkg, "", existing, "", PreferHighest)
 			for i, pkg := range namedPkgs {
 				require.Equal(t, int(pkg.InstalledSize), i, "position matches")
 			}
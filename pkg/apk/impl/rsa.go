@@ -29,13 +29,39 @@ func RSASignSHA1Digest(sha1Digest []byte, keyFile, passphrase string) ([]byte, e
 	if len(sha1Digest) != sha1.Size {
 		return nil, errDigestNotSHA1
 	}
+	return RSASignDigest(sha1Digest, crypto.SHA1, keyFile, passphrase)
+}
+
+// RSASignDigest signs the provided message digest, which must have been
+// computed with the given hash. The key file must be in the PEM format and
+// can either be encrypted or not.
+func RSASignDigest(digest []byte, hash crypto.Hash, keyFile, passphrase string) ([]byte, error) {
+	if len(digest) != hash.Size() {
+		return nil, fmt.Errorf("digest is not a %s hash", hash)
+	}
 
 	keyFileContent, err := os.ReadFile(keyFile)
 	if err != nil {
 		return nil, fmt.Errorf("reading key file: %w", err)
 	}
 
-	block, _ := pem.Decode(keyFileContent)
+	priv, err := ParseRSAPrivateKey(keyFileContent, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := priv.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	return signature, nil
+}
+
+// ParseRSAPrivateKey parses an RSA private key in the PEM format, as PKCS1
+// or PKCS8, which can either be encrypted or not.
+func ParseRSAPrivateKey(privateKey []byte, passphrase string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(privateKey)
 	if block == nil {
 		return nil, errNoPemBlock
 	}
@@ -46,9 +72,7 @@ func RSASignSHA1Digest(sha1Digest []byte, keyFile, passphrase string) ([]byte, e
 			return nil, errNoPassphrase
 		}
 
-		var decryptedBlockData []byte
-
-		decryptedBlockData, err = x509.DecryptPEMBlock(block, []byte(passphrase)) //nolint:staticcheck
+		decryptedBlockData, err := x509.DecryptPEMBlock(block, []byte(passphrase)) //nolint:staticcheck
 		if err != nil {
 			return nil, fmt.Errorf("decrypt private key PEM block: %w", err)
 		}
@@ -56,17 +80,23 @@ func RSASignSHA1Digest(sha1Digest []byte, keyFile, passphrase string) ([]byte, e
 		blockData = decryptedBlockData
 	}
 
-	priv, err := x509.ParsePKCS1PrivateKey(blockData)
-	if err != nil {
-		return nil, fmt.Errorf("parse PKCS1 private key: %w", err)
+	if block.Type == "PRIVATE KEY" {
+		key, err := x509.ParsePKCS8PrivateKey(blockData)
+		if err != nil {
+			return nil, fmt.Errorf("parse PKCS8 private key: %w", err)
+		}
+		priv, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errNoRSAKey
+		}
+		return priv, nil
 	}
 
-	signature, err := priv.Sign(rand.Reader, sha1Digest, crypto.SHA1)
+	priv, err := x509.ParsePKCS1PrivateKey(blockData)
 	if err != nil {
-		return nil, fmt.Errorf("signing: %w", err)
+		return nil, fmt.Errorf("parse PKCS1 private key: %w", err)
 	}
-
-	return signature, nil
+	return priv, nil
 }
 
 // RSAVerifySHA1Digest is exported for use in tests and verifies a signature over the
@@ -75,26 +105,53 @@ func RSAVerifySHA1Digest(sha1Digest, signature []byte, publicKey []byte) error {
 	if len(sha1Digest) != sha1.Size {
 		return errDigestNotSHA1
 	}
+	return RSAVerifyDigest(sha1Digest, signature, publicKey, crypto.SHA1)
+}
+
+// RSAVerifyDigest verifies a signature over the provided digest, which must have
+// been computed with the given hash. The key must be in the PEM format, either
+// as a PKIX "PUBLIC KEY" or a PKCS1 "RSA PUBLIC KEY".
+func RSAVerifyDigest(digest, signature []byte, publicKey []byte, hash crypto.Hash) error {
+	if len(digest) != hash.Size() {
+		return fmt.Errorf("digest is not a %s hash", hash)
+	}
+
+	rsaPub, err := parseRSAPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	err = rsa.VerifyPKCS1v15(rsaPub, hash, digest, signature)
+	if err != nil {
+		return fmt.Errorf("verify PKCS1v15 signature: %w", err)
+	}
+
+	return nil
+}
 
+func parseRSAPublicKey(publicKey []byte) (*rsa.PublicKey, error) {
 	block, _ := pem.Decode(publicKey)
 	if block == nil {
-		return errNoPemBlock
+		return nil, errNoPemBlock
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse PKCS1 public key: %w", err)
+		}
+		return pub, nil
 	}
 
 	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		return fmt.Errorf("parse PKIX public key: %w", err)
+		return nil, fmt.Errorf("parse PKIX public key: %w", err)
 	}
 
 	rsaPub, ok := pub.(*rsa.PublicKey)
 	if !ok {
-		return errNoRSAKey
-	}
-
-	err = rsa.VerifyPKCS1v15(rsaPub, crypto.SHA1, sha1Digest, signature)
-	if err != nil {
-		return fmt.Errorf("verify PKCS1v15 signature: %w", err)
+		return nil, errNoRSAKey
 	}
 
-	return nil
+	return rsaPub, nil
 }
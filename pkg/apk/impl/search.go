@@ -0,0 +1,197 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// SearchQuery selects packages of the repositories. Packages must match all
+// the fields which are set.
+type SearchQuery struct {
+	// Name is a glob matching the name of the package, e.g. "py3-*".
+	Name string
+	// Provides is a glob matching the name of something the package
+	// provides, e.g. "cmd:bash", "so:libc.musl-*" or "cmd:*". Unlike in
+	// path globs, "*" and "?" also match "/".
+	Provides string
+	// Description is a substring of the description of the package, matched
+	// ignoring case.
+	Description string
+}
+
+// Validate returns an error if the globs of the query are malformed.
+func (q SearchQuery) Validate() error {
+	_, err := q.matcher()
+	return err
+}
+
+// Matches reports whether the package matches the query. A malformed query
+// matches nothing.
+func (q SearchQuery) Matches(pkg *repository.Package) bool {
+	m, err := q.matcher()
+	if err != nil {
+		return false
+	}
+	return m.matches(pkg)
+}
+
+// searchMatcher is a query with its globs compiled, so that they are parsed
+// once for all the packages.
+type searchMatcher struct {
+	name, provides *regexp.Regexp
+	description    string
+}
+
+func (q SearchQuery) matcher() (*searchMatcher, error) {
+	m := &searchMatcher{description: strings.ToLower(q.Description)}
+	for _, g := range []struct {
+		glob string
+		re   **regexp.Regexp
+	}{{q.Name, &m.name}, {q.Provides, &m.provides}} {
+		if g.glob == "" {
+			continue
+		}
+		re, err := compileGlob(g.glob)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", g.glob, err)
+		}
+		*g.re = re
+	}
+	return m, nil
+}
+
+func (m *searchMatcher) matches(pkg *repository.Package) bool {
+	if m.name != nil && !m.name.MatchString(pkg.Name) {
+		return false
+	}
+	if m.description != "" && !strings.Contains(strings.ToLower(pkg.Description), m.description) {
+		return false
+	}
+	if m.provides != nil {
+		found := false
+		for _, provides := range pkg.Provides {
+			// drop the version, e.g. so:libc.musl-x86_64.so.1=1
+			name, _, _ := strings.Cut(provides, "=")
+			if m.provides.MatchString(name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// compileGlob turns a glob with the syntax of path.Match into a regular
+// expression matching whole strings. Unlike with path.Match, "*" and "?"
+// also match "/", as provides such as cmd:/bin/foo are not paths.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i++; i == len(glob) {
+				return nil, path.ErrBadPattern
+			}
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case '[':
+			i++
+			b.WriteString("[")
+			if i < len(glob) && (glob[i] == '^' || glob[i] == '!') {
+				b.WriteString("^")
+				i++
+			}
+			start := i
+			for ; i < len(glob) && glob[i] != ']'; i++ {
+				switch glob[i] {
+				case '-':
+					b.WriteString("-")
+				case '\\':
+					if i++; i == len(glob) {
+						return nil, path.ErrBadPattern
+					}
+					b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+				default:
+					b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+				}
+			}
+			if i == len(glob) || i == start {
+				return nil, path.ErrBadPattern
+			}
+			b.WriteString("]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, path.ErrBadPattern
+	}
+	return re, nil
+}
+
+// Search returns the packages of the repositories matching the query, by
+// name, and from the highest version to the lowest.
+func (a *APKImplementation) Search(query SearchQuery) ([]*repository.RepositoryPackage, error) {
+	m, err := query.matcher()
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := a.getRepositoryIndexes(false)
+	if err != nil {
+		return nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	var found []*repository.RepositoryPackage
+	for _, index := range indexes {
+		for _, pkg := range index.Packages() {
+			if m.matches(pkg.Package) {
+				found = append(found, pkg)
+			}
+		}
+	}
+	sortSearchResults(found)
+	return found, nil
+}
+
+// sortSearchResults sorts packages by name, and from the highest version to
+// the lowest. Versions which cannot be parsed come last.
+func sortSearchResults(pkgs []*repository.RepositoryPackage) {
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		if pkgs[i].Name != pkgs[j].Name {
+			return pkgs[i].Name < pkgs[j].Name
+		}
+		vi, erri := parseVersion(pkgs[i].Version)
+		vj, errj := parseVersion(pkgs[j].Version)
+		if erri != nil || errj != nil {
+			return erri == nil
+		}
+		return compareVersions(vi, vj) == greater
+	})
+}
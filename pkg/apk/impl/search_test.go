@@ -0,0 +1,57 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestSearchQuery(t *testing.T) {
+	pkgs, _ := testGetPackagesAndIndex()
+	search := func(q SearchQuery) []string {
+		require.NoError(t, q.Validate())
+		var found []*repository.RepositoryPackage
+		for _, pkg := range pkgs {
+			if q.Matches(pkg.Package) {
+				found = append(found, pkg)
+			}
+		}
+		sortSearchResults(found)
+		names := make([]string, 0, len(found))
+		for _, pkg := range found {
+			names = append(names, pkg.Name+"-"+pkg.Version)
+		}
+		return names
+	}
+
+	require.Equal(t, []string{"package5-2.0.0", "package5-1.5.1", "package5-1.5.0", "package5-1.0.0", "package6-2.0.0", "package6-1.5.1"},
+		search(SearchQuery{Name: "package[56]"}))
+	require.Equal(t, []string{"foo-1.0.0"}, search(SearchQuery{Provides: "cmd:*"}))
+	require.Equal(t, []string{"foo-1.0.0"}, search(SearchQuery{Provides: "cmd:?bin?foo"}))
+	require.Equal(t, []string{"libq-1.0.0"}, search(SearchQuery{Provides: "so:lib[a-q].so.*"}))
+	require.Equal(t, []string{"package8-2"}, search(SearchQuery{Provides: "package7"}))
+	require.Empty(t, search(SearchQuery{Name: "dep*", Provides: "cmd:*"}))
+
+	pkgs = append(pkgs, &repository.RepositoryPackage{Package: &repository.Package{Name: "zsh", Version: "5.9-r0", Description: "Very advanced and programmable command interpreter (shell)"}})
+	require.Equal(t, []string{"zsh-5.9-r0"}, search(SearchQuery{Description: "COMMAND interpreter"}))
+
+	require.Error(t, SearchQuery{Name: "[unclosed"}.Validate())
+	require.Error(t, SearchQuery{Provides: "trailing\\"}.Validate())
+	require.Error(t, SearchQuery{Name: "[]"}.Validate())
+	require.False(t, SearchQuery{Name: "[unclosed"}.Matches(&repository.Package{Name: "[unclosed"}))
+}
@@ -18,7 +18,12 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha1" // nolint:gosec
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"errors"
 	"fmt"
 	"io"
@@ -26,17 +31,19 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-
-	"github.com/psanford/memfs"
-
-	"chainguard.dev/apko/pkg/tarball"
 )
 
-// TODO: solidify this API and move into pkg/
+// SignIndex signs the APKINDEX.tar.gz in place with the RSA private key in
+// signingKey, whose public key is expected to be named after it with .pub
+// appended. An index which is already signed is left as is.
 func SignIndex(logger *log.Logger, signingKey string, indexFile string) error {
-	is, err := indexIsAlreadySigned(indexFile)
+	indexData, err := os.ReadFile(indexFile)
+	if err != nil {
+		return fmt.Errorf("unable to read index for signing: %w", err)
+	}
+	is, err := isSignedIndex(indexData)
 	if err != nil {
-		return err
+		return fmt.Errorf("index file %s: %w", indexFile, err)
 	}
 	if is {
 		logger.Printf("index %s is already signed, doing nothing", indexFile)
@@ -44,51 +51,25 @@ func SignIndex(logger *log.Logger, signingKey string, indexFile string) error {
 	}
 
 	logger.Printf("signing index %s with key %s", indexFile, signingKey)
-
-	indexData, indexDigest, err := ReadAndHashIndexFile(indexFile)
+	keyData, err := os.ReadFile(signingKey)
 	if err != nil {
-		return err
+		return fmt.Errorf("reading key file: %w", err)
 	}
-
-	sigData, err := RSASignSHA1Digest(indexDigest, signingKey, "")
+	key, err := ParseRSAPrivateKey(keyData, "")
 	if err != nil {
 		return fmt.Errorf("unable to sign index: %w", err)
 	}
 
-	logger.Printf("appending signature to index %s", indexFile)
-
-	sigFS := memfs.New()
-	if err := sigFS.WriteFile(fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(signingKey)), sigData, 0644); err != nil {
-		return fmt.Errorf("unable to append signature: %w", err)
-	}
-
-	// prepare control.tar.gz
-	multitarctx, err := tarball.NewContext(
-		tarball.WithSkipClose(true),
-	)
+	signed, err := SignIndexData(indexData, key, filepath.Base(signingKey)+".pub")
 	if err != nil {
-		return fmt.Errorf("unable to build tarball context: %w", err)
+		return fmt.Errorf("unable to sign index: %w", err)
 	}
 
 	logger.Printf("writing signed index to %s", indexFile)
 
-	var sigBuffer bytes.Buffer
-	if err := multitarctx.WriteArchive(&sigBuffer, sigFS); err != nil {
-		return fmt.Errorf("unable to write signature tarball: %w", err)
-	}
-
-	idx, err := os.Create(indexFile)
-	if err != nil {
-		return fmt.Errorf("unable to open index for writing: %w", err)
-	}
-	defer idx.Close()
-
-	if _, err := io.Copy(idx, &sigBuffer); err != nil {
-		return fmt.Errorf("unable to write index signature: %w", err)
-	}
-
-	if _, err := idx.Write(indexData); err != nil {
-		return fmt.Errorf("unable to write index data: %w", err)
+	// #nosec G306 -- repository indexes are public
+	if err := os.WriteFile(indexFile, signed, 0o644); err != nil {
+		return fmt.Errorf("unable to write signed index: %w", err)
 	}
 
 	logger.Printf("signed index %s with key %s", indexFile, signingKey)
@@ -96,35 +77,91 @@ func SignIndex(logger *log.Logger, signingKey string, indexFile string) error {
 	return nil
 }
 
-func indexIsAlreadySigned(indexFile string) (bool, error) {
-	index, err := os.Open(indexFile)
-	if err != nil {
-		return false, fmt.Errorf("cannot open index file %s: %w", indexFile, err)
+// SignIndexData returns the unsigned APKINDEX.tar.gz prefixed with the
+// signature segment apk expects: a gzip stream of a tar archive, without its
+// end-of-archive marker, holding the signature of the index by the key, in a
+// file named after the public key, e.g. .SIGN.RSA.packager-1234.rsa.pub.
+//
+// The index is signed over SHA1, as .SIGN.RSA., unless hashes are given, in
+// which case there is one signature per hash, each under its own scheme.
+func SignIndexData(index []byte, key *rsa.PrivateKey, keyName string, hashes ...crypto.Hash) ([]byte, error) {
+	if keyName == "" || strings.Contains(keyName, "/") {
+		return nil, fmt.Errorf("invalid key name %q", keyName)
 	}
-	defer index.Close()
-
-	gzi, err := gzip.NewReader(index)
-	if err != nil {
-		return false, fmt.Errorf("cannot open index file %s as gzip: %w", indexFile, err)
+	if signed, err := isSignedIndex(index); err != nil {
+		return nil, err
+	} else if signed {
+		return nil, fmt.Errorf("index is already signed")
+	}
+	if len(hashes) == 0 {
+		hashes = []crypto.Hash{crypto.SHA1}
 	}
-	defer gzi.Close()
 
-	tari := tar.NewReader(gzi)
-	for {
-		hdr, err := tari.Next()
-		if errors.Is(err, io.EOF) {
-			break
+	var sig bytes.Buffer
+	gw := gzip.NewWriter(&sig)
+	tw := tar.NewWriter(gw)
+	for _, hash := range hashes {
+		prefix := ""
+		for _, scheme := range signatureSchemes {
+			if scheme.hash == hash {
+				prefix = scheme.prefix
+			}
 		}
+		if prefix == "" {
+			return nil, fmt.Errorf("cannot sign an index over %s", hash)
+		}
+		digest, err := HashDataWith(index, hash)
 		if err != nil {
-			return false, fmt.Errorf("cannot read tar index %s: %w", indexFile, err)
+			return nil, err
 		}
-
-		if strings.HasPrefix(hdr.Name, ".SIGN.RSA") {
-			return true, nil
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		if err != nil {
+			return nil, fmt.Errorf("signing: %w", err)
 		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     prefix + keyName,
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(signature)),
+			Uname:    "root",
+			Gname:    "root",
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(signature); err != nil {
+			return nil, err
+		}
+	}
+	// the index follows the segment in the same tar stream, so the segment
+	// must not end it
+	if err := tw.Flush(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
 	}
 
-	return false, nil
+	return append(sig.Bytes(), index...), nil
+}
+
+// isSignedIndex reports whether the APKINDEX.tar.gz starts with a signature.
+func isSignedIndex(index []byte) (bool, error) {
+	gzi, err := gzip.NewReader(bytes.NewReader(index))
+	if err != nil {
+		return false, fmt.Errorf("cannot open index as gzip: %w", err)
+	}
+	defer gzi.Close()
+	gzi.Multistream(false)
+
+	hdr, err := tar.NewReader(gzi).Next()
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot read tar index: %w", err)
+	}
+	_, _, ok := parseSignatureName(hdr.Name)
+	return ok, nil
 }
 
 func ReadAndHashIndexFile(indexFile string) ([]byte, []byte, error) {
@@ -145,3 +182,38 @@ func HashData(data []byte) ([]byte, error) {
 	}
 	return digest.Sum(nil), nil
 }
+
+// HashDataWith hashes data with the given hash function.
+func HashDataWith(data []byte, hash crypto.Hash) ([]byte, error) {
+	if !hash.Available() {
+		return nil, fmt.Errorf("hash function %s is not available", hash)
+	}
+	digest := hash.New()
+	if n, err := digest.Write(data); err != nil || n != len(data) {
+		return nil, fmt.Errorf("unable to hash data: %w", err)
+	}
+	return digest.Sum(nil), nil
+}
+
+// signatureSchemes lists the signature file prefixes used in APKs and
+// APKINDEXes, along with the hash function the signature was computed over.
+var signatureSchemes = []struct {
+	prefix string
+	hash   crypto.Hash
+}{
+	{".SIGN.RSA512.", crypto.SHA512},
+	{".SIGN.RSA256.", crypto.SHA256},
+	{".SIGN.RSA.", crypto.SHA1},
+}
+
+// parseSignatureName splits a signature file name such as
+// .SIGN.RSA256.alpine-devel@lists.alpinelinux.org-6165ee59.rsa.pub
+// into the name of the key and the hash used for the signature.
+func parseSignatureName(name string) (keyName string, hash crypto.Hash, ok bool) {
+	for _, scheme := range signatureSchemes {
+		if strings.HasPrefix(name, scheme.prefix) && len(name) > len(scheme.prefix) {
+			return strings.TrimPrefix(name, scheme.prefix), scheme.hash, true
+		}
+	}
+	return "", 0, false
+}
@@ -0,0 +1,190 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// testSignedIndex returns a fake index prefixed with a signature segment
+// holding one signature per scheme in schemes, all made with key.
+func testSignedIndex(t *testing.T, key *rsa.PrivateKey, keyName string, schemes ...string) []byte {
+	t.Helper()
+
+	var index bytes.Buffer
+	gw := gzip.NewWriter(&index)
+	tw := tar.NewWriter(gw)
+	content := []byte("P:hello\nV:1.0-r0\n\n")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "APKINDEX", Mode: 0o644, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	var sig bytes.Buffer
+	gw = gzip.NewWriter(&sig)
+	tw = tar.NewWriter(gw)
+	for _, scheme := range schemes {
+		name := scheme + keyName
+		_, hash, ok := parseSignatureName(name)
+		require.True(t, ok)
+		digest, err := HashDataWith(index.Bytes(), hash)
+		require.NoError(t, err)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		require.NoError(t, err)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(signature))}))
+		_, err = tw.Write(signature)
+		require.NoError(t, err)
+	}
+	// like abuild, do not write the end-of-archive marker
+	require.NoError(t, tw.Flush())
+	require.NoError(t, gw.Close())
+
+	return append(sig.Bytes(), index.Bytes()...)
+}
+
+func testPublicKeyPEM(t *testing.T, key *rsa.PrivateKey, pkcs1 bool) []byte {
+	t.Helper()
+	if pkcs1 {
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestParseSignatureName(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		keyName string
+		hash    crypto.Hash
+		ok      bool
+	}{
+		{".SIGN.RSA.key.rsa.pub", "key.rsa.pub", crypto.SHA1, true},
+		{".SIGN.RSA256.key.rsa.pub", "key.rsa.pub", crypto.SHA256, true},
+		{".SIGN.RSA512.key.rsa.pub", "key.rsa.pub", crypto.SHA512, true},
+		{".SIGN.RSA.", "", 0, false},
+		{".SIGN.DSA.key.pub", "", 0, false},
+		{"APKINDEX", "", 0, false},
+	} {
+		keyName, hash, ok := parseSignatureName(tt.name)
+		require.Equal(t, tt.ok, ok, tt.name)
+		require.Equal(t, tt.keyName, keyName, tt.name)
+		require.Equal(t, tt.hash, hash, tt.name)
+	}
+}
+
+func TestVerifyIndexSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	const keyName = "test@example.com-1234.rsa.pub"
+
+	t.Run("schemes", func(t *testing.T) {
+		for _, schemes := range [][]string{
+			{".SIGN.RSA."},
+			{".SIGN.RSA256."},
+			{".SIGN.RSA512."},
+			{".SIGN.RSA.", ".SIGN.RSA256."},
+		} {
+			b := testSignedIndex(t, key, keyName, schemes...)
+			keys := map[string][]byte{keyName: testPublicKeyPEM(t, key, false)}
+			require.NoError(t, verifyIndexSignature(b, keys), "%v", schemes)
+		}
+	})
+	t.Run("pkcs1 key", func(t *testing.T) {
+		b := testSignedIndex(t, key, keyName, ".SIGN.RSA256.")
+		keys := map[string][]byte{keyName: testPublicKeyPEM(t, key, true)}
+		require.NoError(t, verifyIndexSignature(b, keys))
+	})
+	t.Run("key under other name", func(t *testing.T) {
+		b := testSignedIndex(t, key, keyName, ".SIGN.RSA512.")
+		keys := map[string][]byte{
+			keyName:           testPublicKeyPEM(t, other, false),
+			"renamed.rsa.pub": testPublicKeyPEM(t, key, false),
+		}
+		require.NoError(t, verifyIndexSignature(b, keys))
+	})
+	t.Run("wrong key", func(t *testing.T) {
+		b := testSignedIndex(t, key, keyName, ".SIGN.RSA.", ".SIGN.RSA256.")
+		keys := map[string][]byte{keyName: testPublicKeyPEM(t, other, false)}
+		require.Error(t, verifyIndexSignature(b, keys))
+	})
+	t.Run("no keys", func(t *testing.T) {
+		b := testSignedIndex(t, key, keyName, ".SIGN.RSA256.")
+		require.Error(t, verifyIndexSignature(b, nil))
+	})
+}
+
+func TestSignIndexData(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	const keyName = "test@example.com-1234.rsa.pub"
+	keys := map[string][]byte{keyName: testPublicKeyPEM(t, key, false)}
+
+	index, err := writeIndexArchive(&repository.ApkIndex{Packages: []*repository.Package{{Name: "hello", Version: "1.0-r0"}}})
+	require.NoError(t, err)
+
+	for _, hashes := range [][]crypto.Hash{nil, {crypto.SHA256, crypto.SHA512}} {
+		signed, err := SignIndexData(index, key, keyName, hashes...)
+		require.NoError(t, err)
+		require.NoError(t, verifyIndexSignature(signed, keys))
+
+		parsed, err := indexFromArchive(bytes.NewReader(signed), InputLimits{})
+		require.NoError(t, err)
+		require.Len(t, parsed.Packages, 1)
+
+		_, err = SignIndexData(signed, key, keyName)
+		require.Error(t, err, "signing a signed index")
+	}
+
+	_, err = SignIndexData(index, key, keyName, crypto.MD5)
+	require.Error(t, err)
+	_, err = SignIndexData(index, key, "")
+	require.Error(t, err)
+}
+
+func TestParseRSAPrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	parsed, err := ParseRSAPrivateKey(pkcs1, "")
+	require.NoError(t, err)
+	require.True(t, key.Equal(parsed))
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	parsed, err = ParseRSAPrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), "")
+	require.NoError(t, err)
+	require.True(t, key.Equal(parsed))
+
+	_, err = ParseRSAPrivateKey([]byte("not a key"), "")
+	require.Error(t, err)
+}
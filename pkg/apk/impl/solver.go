@@ -0,0 +1,380 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"fmt"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// maxSolverSteps bounds how many candidates the solver tries, as the search
+// is exponential in the worst case.
+const maxSolverSteps = 100000
+
+// maxInstallIfRounds bounds how many times the solver goes again for the
+// packages installed because of others, which may trigger more of them.
+const maxInstallIfRounds = 10
+
+// ResolutionError explains why packages cannot be installed together: a
+// requirement which none of its candidates can meet alongside the others.
+type ResolutionError struct {
+	// Requirement is the dependency which cannot be met, e.g. so:libfoo.so.1,
+	// and Path the packages requiring it, from the world down.
+	Requirement string
+	Path        []string
+	// Reasons are why each candidate for the requirement was rejected.
+	Reasons []string
+	// Exhausted is set if the solver gave up before trying everything.
+	Exhausted bool
+}
+
+func (e *ResolutionError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "cannot resolve %s", e.Requirement)
+	if len(e.Path) > 0 {
+		fmt.Fprintf(&b, " (required by %s)", strings.Join(e.Path, " -> "))
+	}
+	if len(e.Reasons) == 0 {
+		b.WriteString(": no package provides it")
+	} else {
+		fmt.Fprintf(&b, ": %s", strings.Join(e.Reasons, "; "))
+	}
+	if e.Exhausted {
+		fmt.Fprintf(&b, " (gave up after trying %d candidates)", maxSolverSteps)
+	}
+	return b.String()
+}
+
+// requirement is a dependency to meet, e.g. busybox>1.36 or
+// so:libc.musl-x86_64.so.1, with the packages which lead to it.
+type requirement struct {
+	dep string
+	// pin is the repository the packages which meet it may come from.
+	pin  string
+	path []string
+	// world is set for the requirements of the world, which prefer their pin
+	// rather than being restricted to it.
+	world bool
+}
+
+// solver finds packages meeting all the requirements of the world, trying
+// other providers and versions of the packages when the preferred ones
+// cannot be installed together.
+type solver struct {
+	p        *PkgResolver
+	selected []*repositoryPackage
+	byName   map[string]*repositoryPackage
+	queue    []requirement
+	steps    int
+	failure  *ResolutionError
+}
+
+// solve returns the packages for the world, in the order to install them.
+func (p *PkgResolver) solve(packages []string) (toInstall []*repository.RepositoryPackage, conflicts []string, err error) {
+	world := make([]requirement, 0, len(packages))
+	for _, pkgName := range packages {
+		_, _, _, pin := resolvePackageNameVersionPin(pkgName)
+		world = append(world, requirement{dep: pkgName, pin: pin, world: true})
+	}
+
+	var s *solver
+	for round := 0; ; round++ {
+		s = &solver{p: p, byName: map[string]*repositoryPackage{}, queue: append([]requirement{}, world...)}
+		if !s.solve(0) {
+			if s.steps > maxSolverSteps {
+				s.failure.Exhausted = true
+			}
+			return nil, nil, s.failure
+		}
+		triggered := s.installIf()
+		if len(triggered) == 0 || round == maxInstallIfRounds {
+			break
+		}
+		for _, pkg := range triggered {
+			world = append(world, requirement{dep: fmt.Sprintf("%s=%s", pkg.Name, pkg.Version), pin: pkg.pinnedName, world: true})
+		}
+	}
+
+	for _, pkg := range s.selected {
+		for _, dep := range pkg.Dependencies {
+			if strings.HasPrefix(dep, "!") {
+				conflicts = append(conflicts, dep[1:])
+			}
+		}
+	}
+	return s.order(world), uniqify(conflicts), nil
+}
+
+// solve meets the requirements of the queue from pos on, backtracking over
+// the candidates of each until all of them are met.
+func (s *solver) solve(pos int) bool {
+	for pos < len(s.queue) && s.satisfied(s.queue[pos]) {
+		pos++
+	}
+	if pos == len(s.queue) {
+		return true
+	}
+	req := s.queue[pos]
+
+	var reasons []string
+	for _, c := range s.candidates(req) {
+		if s.steps++; s.steps > maxSolverSteps {
+			break
+		}
+		if reason := s.conflict(c); reason != "" {
+			reasons = append(reasons, fmt.Sprintf("%s-%s %s", c.Name, c.Version, reason))
+			continue
+		}
+		queued := len(s.queue)
+		s.add(c, req)
+		if s.solve(pos + 1) {
+			return true
+		}
+		s.remove(c)
+		s.queue = s.queue[:queued]
+		if s.steps > maxSolverSteps {
+			break
+		}
+		reasons = append(reasons, fmt.Sprintf("%s-%s has dependencies which cannot be met", c.Name, c.Version))
+	}
+
+	// explain the deepest failure, which is the most specific
+	if s.failure == nil || len(req.path) > len(s.failure.Path) {
+		s.failure = &ResolutionError{Requirement: req.dep, Path: req.path, Reasons: reasons}
+	}
+	return false
+}
+
+// candidates returns the packages which may meet the requirement, from the
+// most preferred on.
+func (s *solver) candidates(req requirement) []*repositoryPackage {
+	name, version, compare, _ := resolvePackageNameVersionPin(req.dep)
+	pkgs, ok := s.p.nameMap[name]
+	if !ok {
+		pkgs = s.p.providesMap[name]
+	}
+	pinOption := withAllowPin(req.pin)
+	if req.world {
+		pinOption = withPreferPin(req.pin)
+	}
+	var candidates []*repositoryPackage
+	for _, pkg := range filterPackages(pkgs, withVersion(version, compare), pinOption) {
+		if satisfies(pkg, name, version, compare) {
+			candidates = append(candidates, pkg)
+		}
+	}
+	var compareTo *repository.RepositoryPackage
+	if len(req.path) > 0 {
+		if parent, ok := s.byName[req.path[len(req.path)-1]]; ok {
+			compareTo = parent.RepositoryPackage
+		}
+	}
+	existing := make(map[string]*repository.RepositoryPackage, len(s.byName))
+	for n, pkg := range s.byName {
+		existing[n] = pkg.RepositoryPackage
+	}
+	pin := ""
+	if req.world {
+		pin = req.pin
+	}
+	sortPackages(candidates, compareTo, name, existing, pin, s.p.strategy)
+	return candidates
+}
+
+// satisfied reports whether a selected package meets the requirement.
+func (s *solver) satisfied(req requirement) bool {
+	name, version, compare, _ := resolvePackageNameVersionPin(req.dep)
+	for _, pkg := range s.selected {
+		if satisfies(pkg, name, version, compare) {
+			return true
+		}
+	}
+	return false
+}
+
+// conflict returns why the package cannot be installed along with those
+// selected, if it cannot.
+func (s *solver) conflict(c *repositoryPackage) string {
+	if other, ok := s.byName[c.Name]; ok && other != c {
+		return fmt.Sprintf("conflicts with %s-%s, already selected", other.Name, other.Version)
+	}
+	for _, dep := range c.Dependencies {
+		if !strings.HasPrefix(dep, "!") {
+			continue
+		}
+		name, version, compare, _ := resolvePackageNameVersionPin(dep[1:])
+		for _, pkg := range s.selected {
+			if pkg.Name != c.Name && satisfies(pkg, name, version, compare) {
+				return fmt.Sprintf("conflicts with %s-%s (%s)", pkg.Name, pkg.Version, dep)
+			}
+		}
+	}
+	for _, pkg := range s.selected {
+		for _, dep := range pkg.Dependencies {
+			if !strings.HasPrefix(dep, "!") {
+				continue
+			}
+			name, version, compare, _ := resolvePackageNameVersionPin(dep[1:])
+			if pkg.Name != c.Name && satisfies(c, name, version, compare) {
+				return fmt.Sprintf("is in conflict with %s-%s (%s)", pkg.Name, pkg.Version, dep)
+			}
+		}
+	}
+	return ""
+}
+
+// add selects the package to meet the requirement, and queues its own.
+func (s *solver) add(c *repositoryPackage, req requirement) {
+	s.selected = append(s.selected, c)
+	s.byName[c.Name] = c
+	path := append(append([]string{}, req.path...), c.Name)
+	for _, dep := range c.Dependencies {
+		if strings.HasPrefix(dep, "!") {
+			continue
+		}
+		s.queue = append(s.queue, requirement{dep: dep, pin: req.pin, path: path})
+	}
+}
+
+// remove undoes the selection of the package, which was the last one.
+func (s *solver) remove(c *repositoryPackage) {
+	s.selected = s.selected[:len(s.selected)-1]
+	delete(s.byName, c.Name)
+}
+
+// installIf returns the packages to install because of those selected,
+// which are not selected yet.
+func (s *solver) installIf() []*repositoryPackage {
+	var triggered []*repositoryPackage
+	seen := map[*repositoryPackage]bool{}
+	for _, pkg := range s.selected {
+		for _, key := range []string{pkg.Name, fmt.Sprintf("%s=%s", pkg.Name, pkg.Version)} {
+			for _, candidate := range s.p.installIfMap[key] {
+				if seen[candidate] {
+					continue
+				}
+				seen[candidate] = true
+				if _, ok := s.byName[candidate.Name]; ok {
+					continue
+				}
+				met := true
+				for _, cond := range candidate.InstallIf {
+					if !s.satisfied(requirement{dep: cond}) {
+						met = false
+						break
+					}
+				}
+				if met {
+					triggered = append(triggered, candidate)
+				}
+			}
+		}
+	}
+	return triggered
+}
+
+// order returns the selected packages with the dependencies of each before
+// it, starting from the world, as the greedy resolution does.
+func (s *solver) order(world []requirement) []*repository.RepositoryPackage {
+	var (
+		ordered []*repository.RepositoryPackage
+		visited = map[*repositoryPackage]bool{}
+		visit   func(req requirement)
+	)
+	visit = func(req requirement) {
+		name, version, compare, _ := resolvePackageNameVersionPin(req.dep)
+		for _, pkg := range s.selected {
+			if !satisfies(pkg, name, version, compare) {
+				continue
+			}
+			if visited[pkg] {
+				return
+			}
+			visited[pkg] = true
+			for _, dep := range pkg.Dependencies {
+				if !strings.HasPrefix(dep, "!") {
+					visit(requirement{dep: dep})
+				}
+			}
+			ordered = append(ordered, pkg.RepositoryPackage)
+			return
+		}
+	}
+	for _, req := range world {
+		visit(req)
+	}
+	for _, pkg := range s.selected {
+		if !visited[pkg] {
+			ordered = append(ordered, pkg.RepositoryPackage)
+		}
+	}
+	return ordered
+}
+
+// consistent reports whether the packages meet all the requirements of the
+// world and of each other, without conflicts.
+func consistent(packages []string, toInstall []*repository.RepositoryPackage) bool {
+	s := &solver{byName: map[string]*repositoryPackage{}}
+	for _, pkg := range toInstall {
+		c := &repositoryPackage{RepositoryPackage: pkg}
+		if other, ok := s.byName[pkg.Name]; ok {
+			if other.Version != pkg.Version {
+				return false
+			}
+			continue
+		}
+		if s.conflict(c) != "" {
+			return false
+		}
+		s.selected = append(s.selected, c)
+		s.byName[pkg.Name] = c
+	}
+	for _, pkgName := range packages {
+		if !s.satisfied(requirement{dep: pkgName}) {
+			return false
+		}
+	}
+	for _, pkg := range s.selected {
+		for _, dep := range pkg.Dependencies {
+			if !strings.HasPrefix(dep, "!") && !s.satisfied(requirement{dep: dep}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// satisfies reports whether the package is, or provides, the name at the
+// version.
+func satisfies(pkg *repositoryPackage, name, version string, compare versionDependency) bool {
+	actual := getDepVersionForName(pkg, name)
+	if pkg.Name != name && actual == "" {
+		return false
+	}
+	if compare == versionNone {
+		return true
+	}
+	actualVersion, err := parseVersion(actual)
+	if err != nil {
+		return false
+	}
+	requiredVersion, err := parseVersion(version)
+	if err != nil {
+		return false
+	}
+	return compare.satisfies(actualVersion, requiredVersion)
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func testResolverFromPackages(packages ...*repository.Package) *PkgResolver {
+	repo := repository.Repository{}
+	index := repo.WithIndex(&repository.ApkIndex{Packages: packages})
+	return NewPkgResolver(testNamedRepositoryFromIndexes([]*repository.RepositoryWithIndex{index}))
+}
+
+func TestGetPackagesWithDependenciesBacktracking(t *testing.T) {
+	names := func(pkgs []*repository.RepositoryPackage) []string {
+		var names []string
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Name+"-"+pkg.Version)
+		}
+		return names
+	}
+
+	t.Run("other provider", func(t *testing.T) {
+		resolver := testResolverFromPackages(
+			&repository.Package{Name: "a", Version: "1", Dependencies: []string{"so:libx.so.1"}},
+			&repository.Package{Name: "b", Version: "1", Dependencies: []string{"!p1"}},
+			&repository.Package{Name: "p1", Version: "2", Provides: []string{"so:libx.so.1=1"}},
+			&repository.Package{Name: "p2", Version: "1", Provides: []string{"so:libx.so.1=1"}},
+		)
+		pkgs, conflicts, err := resolver.GetPackagesWithDependencies([]string{"a", "b"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"p2-1", "a-1", "b-1"}, names(pkgs))
+		require.Equal(t, []string{"p1"}, conflicts)
+	})
+	t.Run("older version", func(t *testing.T) {
+		resolver := testResolverFromPackages(
+			&repository.Package{Name: "a", Version: "2", Dependencies: []string{"d<2"}},
+			&repository.Package{Name: "a", Version: "1", Dependencies: []string{"d"}},
+			&repository.Package{Name: "c", Version: "1", Dependencies: []string{"d>=2"}},
+			&repository.Package{Name: "d", Version: "1"},
+			&repository.Package{Name: "d", Version: "2"},
+		)
+		pkgs, _, err := resolver.GetPackagesWithDependencies([]string{"a", "c"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"d-2", "a-1", "c-1"}, names(pkgs))
+	})
+	t.Run("unsolvable", func(t *testing.T) {
+		resolver := testResolverFromPackages(
+			&repository.Package{Name: "a", Version: "1", Dependencies: []string{"x=1"}},
+			&repository.Package{Name: "b", Version: "1", Dependencies: []string{"x=2"}},
+			&repository.Package{Name: "x", Version: "1"},
+			&repository.Package{Name: "x", Version: "2"},
+		)
+		_, _, err := resolver.GetPackagesWithDependencies([]string{"a", "b"})
+		var resolutionErr *ResolutionError
+		require.True(t, errors.As(err, &resolutionErr), "unexpected error %v", err)
+		require.Equal(t, "x=2", resolutionErr.Requirement)
+		require.Equal(t, []string{"b"}, resolutionErr.Path)
+		require.Contains(t, err.Error(), "x-2 conflicts with x-1")
+	})
+}
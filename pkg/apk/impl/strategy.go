@@ -0,0 +1,58 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"fmt"
+)
+
+// ResolverStrategy is which of the versions meeting the constraints the
+// resolver prefers.
+type ResolverStrategy string
+
+const (
+	// PreferHighest prefers the highest versions, as apk does. It is the
+	// default.
+	PreferHighest ResolverStrategy = "highest"
+	// PreferLowest prefers the lowest versions, e.g. to check that the
+	// constraints of the packages are not looser than what they work with.
+	PreferLowest ResolverStrategy = "lowest"
+)
+
+// ParseResolverStrategy returns the strategy of the name, the default one if
+// empty.
+func ParseResolverStrategy(name string) (ResolverStrategy, error) {
+	switch strategy := ResolverStrategy(name); strategy {
+	case "":
+		return PreferHighest, nil
+	case PreferHighest, PreferLowest:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("invalid resolver strategy %q, must be %s or %s", name, PreferHighest, PreferLowest)
+	}
+}
+
+// WithResolverStrategy sets which of the versions meeting the constraints
+// are installed. If not provided, the highest ones are.
+func WithResolverStrategy(strategy ResolverStrategy) Option {
+	return func(o *opts) error {
+		s, err := ParseResolverStrategy(string(strategy))
+		if err != nil {
+			return err
+		}
+		o.strategy = s
+		return nil
+	}
+}
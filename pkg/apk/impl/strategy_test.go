@@ -0,0 +1,62 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestResolverStrategy(t *testing.T) {
+	packages := []*repository.Package{
+		{Name: "a", Version: "1.0.0", Dependencies: []string{"b>=1.1"}},
+		{Name: "a", Version: "2.0.0", Dependencies: []string{"b>=1.1"}},
+		{Name: "b", Version: "1.0.0"},
+		{Name: "b", Version: "1.1.0"},
+		{Name: "b", Version: "1.2.0"},
+	}
+	tests := []struct {
+		strategy ResolverStrategy
+		want     []string
+	}{
+		{PreferHighest, []string{"b-1.2.0", "a-2.0.0"}},
+		{PreferLowest, []string{"b-1.1.0", "a-1.0.0"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.strategy), func(t *testing.T) {
+			resolver := testResolverFromPackages(packages...)
+			resolver.strategy = tt.strategy
+			pkgs, _, err := resolver.GetPackagesWithDependencies([]string{"a"})
+			require.NoError(t, err)
+			var got []string
+			for _, pkg := range pkgs {
+				got = append(got, pkg.Name+"-"+pkg.Version)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseResolverStrategy(t *testing.T) {
+	for name, want := range map[string]ResolverStrategy{"": PreferHighest, "highest": PreferHighest, "lowest": PreferLowest} {
+		strategy, err := ParseResolverStrategy(name)
+		require.NoError(t, err)
+		require.Equal(t, want, strategy)
+	}
+	_, err := ParseResolverStrategy("newest")
+	require.Error(t, err)
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// errNoPackageChecksum is returned for packages which the index lists
+// without a checksum, as unsigned local repositories may.
+var errNoPackageChecksum = errors.New("package has no checksum in the repository index")
+
+// ChecksumMismatchError is returned when a downloaded package is not the one
+// the index lists, e.g. because a mirror or a proxy served a corrupted or
+// different file.
+type ChecksumMismatchError struct {
+	// Package is the name and version of the package.
+	Package string
+	// URL is where the package was downloaded from.
+	URL string
+	// Section is the section of the package which does not match, control
+	// for the checksum of the index, data for the hash in the .PKGINFO, or
+	// apk for the hash of the whole file pinned in the world.
+	Section  string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for package %s downloaded from %s: %s section is %s, expected %s",
+		e.Package, e.URL, e.Section, e.Actual, e.Expected)
+}
+
+// verifyPackage checks that the package downloaded is the one listed by the
+// index it was resolved from, which its signature covers: the control
+// section must match the checksum of the index, and the data section the
+// hash the control section records, if any.
+func (a *APKImplementation) verifyPackage(pkg *repository.RepositoryPackage, expanded *apkExpanded) error {
+	err := verifyPackageChecksum(pkg, expanded)
+	switch {
+	case err == nil:
+	case a.signaturePolicy.IsZero():
+		if !errors.Is(err, errNoPackageChecksum) {
+			return err
+		}
+		a.logger.Debugf("not verifying package %s: %v", pkg.Name, err)
+	default:
+		// attribute the package to the key which signed its index
+		repoURL := a.repositoryURL(pkg)
+		if mode, _ := a.signaturePolicy.forRepository(repoURL); mode != SignatureModeWarn {
+			return err
+		}
+		a.logger.Warnf("unable to attribute package %s to a signed index, continuing as the signature policy only warns: %v", pkg.Name, err)
+	}
+	return verifyPackageDataHash(pkg, expanded, a.limits)
+}
+
+// verifyPackageChecksum checks that the control section of an expanded
+// package matches the checksum in the index it was resolved from.
+func verifyPackageChecksum(pkg *repository.RepositoryPackage, expanded *apkExpanded) error {
+	if len(pkg.Checksum) == 0 {
+		return fmt.Errorf("package %s: %w", pkg.Name, errNoPackageChecksum)
+	}
+	control, err := os.ReadFile(expanded.ControlDataTarGzFilename)
+	if err != nil {
+		return fmt.Errorf("unable to read control data for package %s: %w", pkg.Name, err)
+	}
+	checksum, err := HashData(control)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(checksum, pkg.Checksum) {
+		return &ChecksumMismatchError{
+			Package:  fmt.Sprintf("%s-%s", pkg.Name, pkg.Version),
+			URL:      pkg.Url(),
+			Section:  "control",
+			Expected: "Q1" + base64.StdEncoding.EncodeToString(pkg.Checksum),
+			Actual:   "Q1" + base64.StdEncoding.EncodeToString(checksum),
+		}
+	}
+	return nil
+}
+
+// verifyPackageDataHash checks that the data section of an expanded package
+// matches the SHA-256 hash its .PKGINFO records. Packages built by older
+// tools do not record it.
+func verifyPackageDataHash(pkg *repository.RepositoryPackage, expanded *apkExpanded, limits InputLimits) error {
+	control, err := os.Open(expanded.ControlDataTarGzFilename)
+	if err != nil {
+		return fmt.Errorf("unable to read control data for package %s: %w", pkg.Name, err)
+	}
+	defer control.Close()
+	info, err := readControlPkgInfo(control, limits)
+	if err != nil {
+		return fmt.Errorf("unable to read .PKGINFO of package %s: %w", pkg.Name, err)
+	}
+	if info.DataHash == "" {
+		return nil
+	}
+
+	data, err := os.Open(expanded.PackageDataTarGzFilename)
+	if err != nil {
+		return fmt.Errorf("unable to read package data for package %s: %w", pkg.Name, err)
+	}
+	defer data.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, data); err != nil {
+		return fmt.Errorf("unable to read package data for package %s: %w", pkg.Name, err)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, info.DataHash) {
+		return &ChecksumMismatchError{
+			Package:  fmt.Sprintf("%s-%s", pkg.Name, pkg.Version),
+			URL:      pkg.Url(),
+			Section:  "data",
+			Expected: info.DataHash,
+			Actual:   actual,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// testExpandedPackage writes the sections of a package whose .PKGINFO has
+// the content, returning them and the checksum of the control section.
+func testExpandedPackage(t *testing.T, pkgInfo string, data []byte) (*apkExpanded, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+
+	var control bytes.Buffer
+	gw := gzip.NewWriter(&control)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: ".PKGINFO", Mode: 0o644, Size: int64(len(pkgInfo)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte(pkgInfo))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	expanded := &apkExpanded{
+		TempDir:                  dir,
+		ControlDataTarGzFilename: filepath.Join(dir, "control.tar.gz"),
+		PackageDataTarGzFilename: filepath.Join(dir, "data.tar.gz"),
+	}
+	require.NoError(t, os.WriteFile(expanded.ControlDataTarGzFilename, control.Bytes(), 0o644))
+	require.NoError(t, os.WriteFile(expanded.PackageDataTarGzFilename, data, 0o644))
+
+	checksum, err := HashData(control.Bytes())
+	require.NoError(t, err)
+	return expanded, checksum
+}
+
+func TestVerifyPackageChecksum(t *testing.T) {
+	repo := &repository.RepositoryWithIndex{Repository: &repository.Repository{Uri: "https://example.com/os/x86_64"}}
+	expanded, checksum := testExpandedPackage(t, "pkgname = busybox\n", []byte("data"))
+
+	pkg := repository.NewRepositoryPackage(&repository.Package{Name: "busybox", Version: "1.36.0-r0", Checksum: checksum}, repo)
+	require.NoError(t, verifyPackageChecksum(pkg, expanded))
+
+	pkg = repository.NewRepositoryPackage(&repository.Package{Name: "busybox", Version: "1.36.0-r0", Checksum: []byte("corrupted")}, repo)
+	err := verifyPackageChecksum(pkg, expanded)
+	var mismatch *ChecksumMismatchError
+	require.True(t, errors.As(err, &mismatch), "unexpected error %v", err)
+	require.Equal(t, "control", mismatch.Section)
+	require.Equal(t, "busybox-1.36.0-r0", mismatch.Package)
+
+	pkg = repository.NewRepositoryPackage(&repository.Package{Name: "busybox", Version: "1.36.0-r0"}, repo)
+	require.ErrorIs(t, verifyPackageChecksum(pkg, expanded), errNoPackageChecksum)
+}
+
+func TestVerifyPackageDataHash(t *testing.T) {
+	repo := &repository.RepositoryWithIndex{Repository: &repository.Repository{Uri: "https://example.com/os/x86_64"}}
+	pkg := repository.NewRepositoryPackage(&repository.Package{Name: "busybox", Version: "1.36.0-r0"}, repo)
+	data := []byte("data")
+	sum := sha256.Sum256(data)
+
+	expanded, _ := testExpandedPackage(t, "pkgname = busybox\ndatahash = "+hex.EncodeToString(sum[:])+"\n", data)
+	require.NoError(t, verifyPackageDataHash(pkg, expanded, InputLimits{}))
+
+	expanded, _ = testExpandedPackage(t, "pkgname = busybox\ndatahash = "+hex.EncodeToString(sum[:])+"\n", []byte("corrupted"))
+	var mismatch *ChecksumMismatchError
+	err := verifyPackageDataHash(pkg, expanded, InputLimits{})
+	require.True(t, errors.As(err, &mismatch), "unexpected error %v", err)
+	require.Equal(t, "data", mismatch.Section)
+
+	// packages of older tools have no data hash
+	expanded, _ = testExpandedPackage(t, "pkgname = busybox\n", []byte("anything"))
+	require.NoError(t, verifyPackageDataHash(pkg, expanded, InputLimits{}))
+}
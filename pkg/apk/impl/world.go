@@ -36,14 +36,33 @@ func (a *APKImplementation) GetWorld() ([]string, error) {
 	return strings.Fields(string(worldData)), nil
 }
 
-// SetWorld sets the list of world packages intended to be installed.
+// SetWorld sets the list of world packages intended to be installed, which may be paths
+// to .apk files, resolved relative to the working directory, or https URLs of .apk files,
+// installed without looking them up in the repositories.
 // The base directory of /etc/apk must already exist, i.e. this only works on an initialized APK database.
+// Only the packages requested at the top level belong in the world, not their dependencies, so that
+// apk inside the image can tell which packages it may remove or upgrade.
 func (a *APKImplementation) SetWorld(packages []string) error {
 	a.logger.Infof("setting apk world")
 
-	// sort them before writing
-	copied := make([]string, len(packages))
-	copy(copied, packages)
+	// sort them before writing, without duplicates
+	seen := map[string]bool{}
+	copied := make([]string, 0, len(packages))
+	for _, pkg := range packages {
+		pkg = strings.TrimSpace(pkg)
+		if isLocalPackage(pkg) {
+			abs, err := filepath.Abs(pkg)
+			if err != nil {
+				return fmt.Errorf("invalid local package %s: %w", pkg, err)
+			}
+			pkg = abs
+		}
+		if pkg == "" || seen[pkg] {
+			continue
+		}
+		seen[pkg] = true
+		copied = append(copied, pkg)
+	}
 	sort.Strings(copied)
 
 	data := strings.Join(copied, "\n") + "\n"
@@ -56,3 +75,55 @@ func (a *APKImplementation) SetWorld(packages []string) error {
 
 	return nil
 }
+
+// AddWorld adds packages to the world, like "apk add" does. A package already in the world is
+// replaced, so that its version constraint or pinned repository can be changed.
+func (a *APKImplementation) AddWorld(packages ...string) error {
+	world, err := a.GetWorld()
+	if err != nil {
+		return err
+	}
+	added := map[string]bool{}
+	for _, pkg := range packages {
+		added[worldPackageName(pkg)] = true
+	}
+	kept := make([]string, 0, len(world)+len(packages))
+	for _, pkg := range world {
+		if !added[worldPackageName(pkg)] {
+			kept = append(kept, pkg)
+		}
+	}
+	return a.SetWorld(append(kept, packages...))
+}
+
+// DelWorld removes packages from the world by name, like "apk del" does, whatever their version
+// constraint or pinned repository. Their dependencies are not in the world, so they go as well
+// the next time the world is fixated, unless something else depends on them.
+func (a *APKImplementation) DelWorld(names ...string) error {
+	world, err := a.GetWorld()
+	if err != nil {
+		return err
+	}
+	removed := map[string]bool{}
+	for _, name := range names {
+		removed[worldPackageName(name)] = true
+	}
+	kept := make([]string, 0, len(world))
+	for _, pkg := range world {
+		if !removed[worldPackageName(pkg)] {
+			kept = append(kept, pkg)
+		}
+	}
+	return a.SetWorld(kept)
+}
+
+// worldPackageName returns the name of the package of a world entry, such as
+// "busybox>=1.36@edge", or "!busybox" for a conflict.
+func worldPackageName(entry string) string {
+	conflict := strings.HasPrefix(entry, "!")
+	name, _, _, _ := resolvePackageNameVersionPin(strings.TrimPrefix(entry, "!"))
+	if conflict {
+		return "!" + name
+	}
+	return name
+}
@@ -36,3 +36,33 @@ func TestGetWorld(t *testing.T) {
 	require.NoError(t, err, "unable to get world packages")
 	require.Equal(t, strings.Join(packages, " "), strings.Join(pkgs, " "), "expected packages %v, got %v", packages, pkgs)
 }
+
+func TestSetWorldDedup(t *testing.T) {
+	src := apkfs.NewMemFS()
+	require.NoError(t, src.MkdirAll("etc/apk", 0755))
+	a, err := NewAPKImplementation(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors))
+	require.NoError(t, err, "unable to create APKImplementation")
+
+	require.NoError(t, a.SetWorld([]string{"package2", "package1", "package2", ""}))
+	data, err := src.ReadFile(worldFilePath)
+	require.NoError(t, err)
+	require.Equal(t, "package1\npackage2\n", string(data))
+}
+
+func TestAddDelWorld(t *testing.T) {
+	src := apkfs.NewMemFS()
+	require.NoError(t, src.MkdirAll("etc/apk", 0755))
+	a, err := NewAPKImplementation(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors))
+	require.NoError(t, err, "unable to create APKImplementation")
+	require.NoError(t, a.SetWorld([]string{"busybox", "ca-certificates-bundle", "!openssl"}))
+
+	require.NoError(t, a.AddWorld("busybox>=1.36", "curl@edge"))
+	pkgs, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"!openssl", "busybox>=1.36", "ca-certificates-bundle", "curl@edge"}, pkgs)
+
+	require.NoError(t, a.DelWorld("busybox", "curl", "notinworld"))
+	pkgs, err = a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"!openssl", "ca-certificates-bundle"}, pkgs)
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package arch maps the names architectures go by in OCI platforms, in apk
+// and elsewhere, e.g. amd64 and x86_64, onto each other.
+package arch
+
+import "strings"
+
+// Arch is a supported architecture.
+type Arch struct {
+	// OCI is the name of the architecture in OCI platforms, including the
+	// variant if any, e.g. arm/v7.
+	OCI string
+	// APK is the name of the architecture in apk repositories, e.g. armv7.
+	APK string
+	// aliases are the other names of the architecture, e.g. those of
+	// uname -m.
+	aliases []string
+}
+
+var known = []Arch{
+	{OCI: "386", APK: "x86", aliases: []string{"i386", "i486", "i586", "i686"}},
+	{OCI: "amd64", APK: "x86_64"},
+	{OCI: "arm64", APK: "aarch64", aliases: []string{"arm64/v8"}},
+	{OCI: "arm/v6", APK: "armhf", aliases: []string{"armv6", "armv6l"}},
+	{OCI: "arm/v7", APK: "armv7", aliases: []string{"arm", "armv7l"}},
+	{OCI: "ppc64le", APK: "ppc64le"},
+	{OCI: "riscv64", APK: "riscv64"},
+	{OCI: "s390x", APK: "s390x"},
+	{OCI: "loong64", APK: "loongarch64"},
+}
+
+// All returns the supported architectures.
+func All() []Arch {
+	return append([]Arch{}, known...)
+}
+
+// Lookup returns the architecture which s names, in any of the forms it
+// goes by, e.g. amd64, x86_64 or linux/amd64.
+func Lookup(s string) (Arch, bool) {
+	s = strings.TrimPrefix(s, "linux/")
+	for _, a := range known {
+		if s == a.OCI || s == a.APK {
+			return a, true
+		}
+		for _, alias := range a.aliases {
+			if s == alias {
+				return a, true
+			}
+		}
+	}
+	return Arch{}, false
+}
+
+// ToAPK returns the apk name of the architecture s names, or s if it is
+// not supported.
+func ToAPK(s string) string {
+	if a, ok := Lookup(s); ok {
+		return a.APK
+	}
+	return s
+}
+
+// ToOCI returns the OCI name of the architecture s names, or s if it is
+// not supported.
+func ToOCI(s string) string {
+	if a, ok := Lookup(s); ok {
+		return a.OCI
+	}
+	return s
+}
+
+// Platform returns the architecture and variant of the OCI platform of the
+// architecture.
+func (a Arch) Platform() (architecture, variant string) {
+	architecture, variant, _ = strings.Cut(a.OCI, "/")
+	return architecture, variant
+}
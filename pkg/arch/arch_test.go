@@ -0,0 +1,72 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package arch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestToAPKAndOCI(t *testing.T) {
+	for _, c := range []struct {
+		in, apk, oci string
+	}{
+		{"amd64", "x86_64", "amd64"},
+		{"x86_64", "x86_64", "amd64"},
+		{"linux/amd64", "x86_64", "amd64"},
+		{"i686", "x86", "386"},
+		{"arm64", "aarch64", "arm64"},
+		{"arm64/v8", "aarch64", "arm64"},
+		{"arm/v6", "armhf", "arm/v6"},
+		{"armv7l", "armv7", "arm/v7"},
+		{"riscv64", "riscv64", "riscv64"},
+		{"loong64", "loongarch64", "loong64"},
+		{"loongarch64", "loongarch64", "loong64"},
+		// unknown architectures are kept as they are
+		{"mips64", "mips64", "mips64"},
+	} {
+		require.Equal(t, c.apk, ToAPK(c.in), c.in)
+		require.Equal(t, c.oci, ToOCI(c.in), c.in)
+	}
+}
+
+func TestNamesAreUnique(t *testing.T) {
+	seen := map[string]string{}
+	for _, a := range All() {
+		names := map[string]bool{a.OCI: true, a.APK: true}
+		for _, alias := range a.aliases {
+			names[alias] = true
+		}
+		for name := range names {
+			require.Empty(t, seen[name], "%s names both %s and %s", name, seen[name], a.OCI)
+			seen[name] = a.OCI
+		}
+	}
+}
+
+func TestPlatform(t *testing.T) {
+	a, ok := Lookup("armv7")
+	require.True(t, ok)
+	architecture, variant := a.Platform()
+	require.Equal(t, "arm", architecture)
+	require.Equal(t, "v7", variant)
+
+	a, ok = Lookup("loongarch64")
+	require.True(t, ok)
+	architecture, variant = a.Platform()
+	require.Equal(t, "loong64", architecture)
+	require.Empty(t, variant)
+}
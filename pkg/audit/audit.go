@@ -0,0 +1,235 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit records the builds and publishes apko does into an
+// append-only log, for environments which must keep track of them.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the log.
+const (
+	ActionBuild   = "build"
+	ActionPublish = "publish"
+)
+
+// Entry is a record of the audit log.
+type Entry struct {
+	Action string `json:"action"`
+	// Principal is who asked for the action.
+	Principal string    `json:"principal,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	// Inputs is the digest of what the action was asked to do, such as the
+	// image configuration.
+	Inputs string `json:"inputs"`
+	// Outputs are what the action produced, such as image references.
+	Outputs []string `json:"outputs,omitempty"`
+	// Error is why the action failed, if it did.
+	Error string `json:"error,omitempty"`
+	// Signature is the base64 encoded ed25519 signature of the entry without
+	// its signature, if the log signs its entries.
+	Signature string `json:"signature,omitempty"`
+}
+
+// Sink stores the lines of an audit log.
+type Sink interface {
+	Append(ctx context.Context, line []byte) error
+}
+
+// Log records entries into a sink.
+type Log struct {
+	sink      Sink
+	key       ed25519.PrivateKey
+	principal string
+}
+
+// Option configures a Log.
+type Option func(*Log) error
+
+// WithSigningKey signs every entry with the key.
+func WithSigningKey(key ed25519.PrivateKey) Option {
+	return func(l *Log) error {
+		if len(key) != ed25519.PrivateKeySize {
+			return fmt.Errorf("invalid ed25519 private key size %d", len(key))
+		}
+		l.key = key
+		return nil
+	}
+}
+
+// WithPrincipal sets the principal of the entries which do not have one.
+func WithPrincipal(principal string) Option {
+	return func(l *Log) error {
+		l.principal = principal
+		return nil
+	}
+}
+
+// New returns a log recording entries into the sink.
+func New(sink Sink, opts ...Option) (*Log, error) {
+	l := &Log{sink: sink}
+	for _, opt := range opts {
+		if err := opt(l); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Record signs the entry if the log has a key, and appends it to the sink as
+// a line of JSON.
+func (l *Log) Record(ctx context.Context, e Entry) error {
+	if e.Principal == "" {
+		e.Principal = l.principal
+	}
+	e.Signature = ""
+	if l.key != nil {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		e.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(l.key, payload))
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := l.sink.Append(ctx, append(line, '\n')); err != nil {
+		return fmt.Errorf("recording %s audit entry: %w", e.Action, err)
+	}
+	return nil
+}
+
+// Verify parses a line of an audit log, and checks that it is signed by the
+// key.
+func Verify(line []byte, key ed25519.PublicKey) (Entry, error) {
+	var e Entry
+	if err := json.Unmarshal(line, &e); err != nil {
+		return Entry{}, fmt.Errorf("parsing audit entry: %w", err)
+	}
+	if e.Signature == "" {
+		return Entry{}, errors.New("audit entry is not signed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(e.Signature)
+	if err != nil {
+		return Entry{}, fmt.Errorf("decoding signature: %w", err)
+	}
+	unsigned := e
+	unsigned.Signature = ""
+	payload, err := json.Marshal(unsigned)
+	if err != nil {
+		return Entry{}, err
+	}
+	if !ed25519.Verify(key, payload, sig) {
+		return Entry{}, errors.New("audit entry signature does not verify")
+	}
+	return e, nil
+}
+
+// LoadSigningKey reads a PEM encoded PKCS #8 ed25519 private key, such as the
+// ones made by "openssl genpkey -algorithm ed25519".
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %T key, not an ed25519 one", path, key)
+	}
+	return edKey, nil
+}
+
+// NewSink returns a sink posting the lines to an http(s) URL, or appending
+// them to a file otherwise.
+func NewSink(target string) Sink {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return &HTTPSink{URL: target}
+	}
+	return &FileSink{Path: target}
+}
+
+// FileSink appends the lines to a file, which is created if needed.
+type FileSink struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (s *FileSink) Append(_ context.Context, line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// HTTPSink posts each line to a URL, which is expected to store it.
+type HTTPSink struct {
+	URL string
+	// Client is the client to post with, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+func (s *HTTPSink) Append(ctx context.Context, line []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("posting to %s: %s", s.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLog(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := New(NewSink(path), WithSigningKey(key), WithPrincipal("ci"))
+	require.NoError(t, err)
+
+	started := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	for _, e := range []Entry{
+		{Action: ActionBuild, Started: started, Finished: started.Add(time.Minute), Inputs: "sha256:abc", Outputs: []string{"image.tar"}},
+		{Action: ActionPublish, Principal: "alice", Started: started, Finished: started.Add(time.Minute), Inputs: "sha256:abc", Error: "denied"},
+	} {
+		require.NoError(t, l.Record(context.Background(), e))
+	}
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	e, err := Verify(lines[0], pub)
+	require.NoError(t, err)
+	require.Equal(t, ActionBuild, e.Action)
+	require.Equal(t, "ci", e.Principal)
+	require.Equal(t, []string{"image.tar"}, e.Outputs)
+
+	e, err = Verify(lines[1], pub)
+	require.NoError(t, err)
+	require.Equal(t, "alice", e.Principal)
+	require.Equal(t, "denied", e.Error)
+
+	tampered := bytes.Replace(lines[1], []byte("alice"), []byte("mallory"), 1)
+	_, err = Verify(tampered, pub)
+	require.Error(t, err)
+
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	_, err = Verify(lines[0], otherPub)
+	require.Error(t, err)
+}
+
+func TestHTTPLog(t *testing.T) {
+	var received [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		received = append(received, body)
+	}))
+	defer srv.Close()
+
+	l, err := New(NewSink(srv.URL))
+	require.NoError(t, err)
+	require.NoError(t, l.Record(context.Background(), Entry{Action: ActionPublish, Inputs: "sha256:abc"}))
+	require.Len(t, received, 1)
+	require.Contains(t, string(received[0]), `"action":"publish"`)
+	require.NotContains(t, string(received[0]), "signature")
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer failing.Close()
+	l, err = New(NewSink(failing.URL))
+	require.NoError(t, err)
+	require.Error(t, l.Record(context.Background(), Entry{Action: ActionBuild}))
+}
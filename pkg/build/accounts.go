@@ -16,8 +16,10 @@ package build
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"golang.org/x/sync/errgroup"
 
@@ -42,19 +44,145 @@ func (di *defaultBuildImplementation) appendGroup(
 	return append(groups, ge)
 }
 
+// groupIndex returns the index of the named group in the entries, or -1.
+func groupIndex(groups []passwd.GroupEntry, name string) int {
+	for i, ge := range groups {
+		if ge.GroupName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// addGroupMember adds the user to the members of the group, unless it is one
+// already.
+func addGroupMember(ge *passwd.GroupEntry, user string) {
+	members := make([]string, 0, len(ge.Members)+1)
+	for _, m := range ge.Members {
+		if m == user {
+			return
+		}
+		// a group without members is parsed as a single empty one
+		if m != "" {
+			members = append(members, m)
+		}
+	}
+	ge.Members = append(members, user)
+}
+
 func userToUserEntry(user types.User) passwd.UserEntry {
 	if user.GID == 0 {
 		user.GID = user.UID
 	}
+	if user.HomeDir == "" {
+		user.HomeDir = "/home/" + user.UserName
+	}
+	if user.Shell == "" {
+		user.Shell = "/bin/sh"
+	}
 	return passwd.UserEntry{
 		UserName: user.UserName,
 		UID:      user.UID,
 		GID:      user.GID,
-		HomeDir:  "/home/" + user.UserName,
+		HomeDir:  user.HomeDir,
 		Password: "x",
 		Info:     "Account created by apko",
-		Shell:    "/bin/sh",
+		Shell:    user.Shell,
+	}
+}
+
+// mergeUser adds the user to the entries of /etc/passwd. A user the packages
+// already have is replaced, keeping the home directory, shell and info which
+// are not configured, and a user with the uid of another one is an error.
+func mergeUser(o *options.Options, entries []passwd.UserEntry, user types.User) ([]passwd.UserEntry, error) {
+	ue := userToUserEntry(user)
+	idx := -1
+	for i, existing := range entries {
+		switch {
+		case existing.UserName == ue.UserName:
+			idx = i
+		case existing.UID == ue.UID:
+			return nil, fmt.Errorf("user %s has uid %d, which is already the uid of user %s", ue.UserName, ue.UID, existing.UserName)
+		}
+	}
+	if idx < 0 {
+		return append(entries, ue), nil
+	}
+
+	existing := entries[idx]
+	if existing.UID != ue.UID || existing.GID != ue.GID {
+		o.Logger().Warnf("user %s has uid %d and gid %d in the packages, which become %d and %d",
+			ue.UserName, existing.UID, existing.GID, ue.UID, ue.GID)
+	}
+	if user.HomeDir == "" {
+		ue.HomeDir = existing.HomeDir
+	}
+	if user.Shell == "" {
+		ue.Shell = existing.Shell
 	}
+	ue.Info = existing.Info
+	entries[idx] = ue
+	return entries, nil
+}
+
+// userToShadowEntry returns the /etc/shadow entry of the user, whose password
+// is locked unless it has one. The password has no age, so that the entry is
+// the same whenever the image is built.
+func userToShadowEntry(user types.User) passwd.ShadowEntry {
+	password := "!"
+	if user.Password != "" {
+		password = user.Password
+		if user.Locked {
+			password = "!" + password
+		}
+	}
+	return passwd.ShadowEntry{
+		UserName: user.UserName,
+		Password: password,
+	}
+}
+
+// copySkel copies the contents of the skeleton directory into the home
+// directory, owned by the user.
+func copySkel(fsys apkfs.FullFS, skel, home string, uid, gid int) error {
+	return fs.WalkDir(fsys, skel, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == skel {
+			return nil
+		}
+		target := filepath.Join(home, strings.TrimPrefix(name, skel+"/"))
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			if err := fsys.Mkdir(target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := fsys.Readlink(name)
+			if err != nil {
+				return err
+			}
+			if err := fsys.Symlink(link, target); err != nil {
+				return err
+			}
+		case d.Type().IsRegular():
+			data, err := fsys.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			if err := fsys.WriteFile(target, data, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s is not a directory, file or symlink", name)
+		}
+		return fsys.Lchown(target, uid, gid)
+	})
 }
 
 func (di *defaultBuildImplementation) MutateAccounts(
@@ -62,7 +190,12 @@ func (di *defaultBuildImplementation) MutateAccounts(
 ) error {
 	var eg errgroup.Group
 
-	if len(ic.Accounts.Groups) != 0 {
+	supplementary := false
+	for _, u := range ic.Accounts.Users {
+		supplementary = supplementary || len(u.Groups) != 0
+	}
+
+	if len(ic.Accounts.Groups) != 0 || supplementary {
 		// Mutate the /etc/groups file
 		eg.Go(func() error {
 			path := filepath.Join("etc", "group")
@@ -73,9 +206,34 @@ func (di *defaultBuildImplementation) MutateAccounts(
 			}
 
 			for _, g := range ic.Accounts.Groups {
+				for _, ge := range gf.Entries {
+					if ge.GID == g.GID && ge.GroupName != g.GroupName {
+						return fmt.Errorf("group %s has gid %d, which is already the gid of group %s", g.GroupName, g.GID, ge.GroupName)
+					}
+				}
+				// a group the packages have keeps its members, with the
+				// gid asked for
+				if i := groupIndex(gf.Entries, g.GroupName); i >= 0 {
+					o.Logger().Printf("setting the gid of group %s to %d", g.GroupName, g.GID)
+					gf.Entries[i].GID = g.GID
+					for _, m := range g.Members {
+						addGroupMember(&gf.Entries[i], m)
+					}
+					continue
+				}
 				gf.Entries = di.appendGroup(o, gf.Entries, g)
 			}
 
+			for _, u := range ic.Accounts.Users {
+				for _, name := range u.Groups {
+					i := groupIndex(gf.Entries, name)
+					if i < 0 {
+						return fmt.Errorf("user %s is in group %s, which does not exist", u.UserName, name)
+					}
+					addGroupMember(&gf.Entries[i], u.UserName)
+				}
+			}
+
 			if err := gf.WriteFile(fsys, path); err != nil {
 				return err
 			}
@@ -93,9 +251,16 @@ func (di *defaultBuildImplementation) MutateAccounts(
 			return err
 		}
 
+		skels := map[string]string{}
 		for _, u := range ic.Accounts.Users {
-			ue := userToUserEntry(u)
-			uf.Entries = append(uf.Entries, ue)
+			entries, err := mergeUser(o, uf.Entries, u)
+			if err != nil {
+				return err
+			}
+			uf.Entries = entries
+			if u.Skel != "" {
+				skels[u.UserName] = filepath.Clean(u.Skel)
+			}
 		}
 		for _, ue := range uf.Entries {
 			// This is what the home directory is set to for our homeless users.
@@ -130,12 +295,21 @@ func (di *defaultBuildImplementation) MutateAccounts(
 			if err := fsys.Chown(targetHomedir, int(ue.UID), int(ue.GID)); err != nil {
 				return fmt.Errorf("chowning homedir: %w", err)
 			}
+			if skel, ok := skels[ue.UserName]; ok {
+				if err := copySkel(fsys, skel, targetHomedir, int(ue.UID), int(ue.GID)); err != nil {
+					return fmt.Errorf("copying %s into the homedir of %s: %w", skel, ue.UserName, err)
+				}
+			}
 		}
 
 		if err := uf.WriteFile(path); err != nil {
 			return err
 		}
 
+		if err := mutateShadow(fsys, ic.Accounts.Users); err != nil {
+			return err
+		}
+
 		// Resolve run-as user if requested.
 		if ic.Accounts.RunAs != "" {
 			for _, ue := range uf.Entries {
@@ -155,3 +329,41 @@ func (di *defaultBuildImplementation) MutateAccounts(
 
 	return nil
 }
+
+// mutateShadow adds the users to /etc/shadow, if the image has one or some
+// user has a password or a locked one.
+func mutateShadow(fsys apkfs.FullFS, users []types.User) error {
+	path := filepath.Join("etc", "shadow")
+
+	needed := false
+	for _, u := range users {
+		needed = needed || u.Password != "" || u.Locked
+	}
+	if _, err := fsys.Stat(path); err == nil {
+		needed = len(users) != 0
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("checking %s exists: %w", path, err)
+	}
+	if !needed {
+		return nil
+	}
+
+	sf, err := passwd.ReadOrCreateShadowFile(fsys, path)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		se := userToShadowEntry(u)
+		replaced := false
+		for i := range sf.Entries {
+			if sf.Entries[i].UserName == se.UserName {
+				sf.Entries[i] = se
+				replaced = true
+			}
+		}
+		if !replaced {
+			sf.Entries = append(sf.Entries, se)
+		}
+	}
+	return sf.WriteFile(fsys, path)
+}
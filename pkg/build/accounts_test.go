@@ -0,0 +1,174 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+)
+
+func TestMutateAccounts(t *testing.T) {
+	di := &defaultBuildImplementation{}
+	o := options.Default
+
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("etc/skel/.config", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/skel/.profile", []byte("export PS1='$ '\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("etc/skel/.config/app", []byte("color=auto\n"), 0o600))
+
+	ic := types.ImageConfiguration{Accounts: types.ImageAccounts{
+		Users: []types.User{{
+			UserName: "nonroot",
+			UID:      65532,
+		}, {
+			UserName: "app",
+			UID:      1000,
+			GID:      1000,
+			HomeDir:  "/var/lib/app",
+			Shell:    "/bin/bash",
+			Password: "$6$salt$hash",
+			Locked:   true,
+			Skel:     "/etc/skel",
+		}},
+	}}
+	require.NoError(t, di.MutateAccounts(fsys, &o, &ic))
+
+	passwd, err := fsys.ReadFile("etc/passwd")
+	require.NoError(t, err)
+	require.Equal(t, `nonroot:x:65532:65532:Account created by apko:/home/nonroot:/bin/sh
+app:x:1000:1000:Account created by apko:/var/lib/app:/bin/bash
+`, string(passwd))
+
+	shadow, err := fsys.ReadFile("etc/shadow")
+	require.NoError(t, err)
+	require.Equal(t, `nonroot:!:::::::
+app:!$6$salt$hash:::::::
+`, string(shadow))
+
+	profile, err := fsys.ReadFile("var/lib/app/.profile")
+	require.NoError(t, err)
+	require.Equal(t, "export PS1='$ '\n", string(profile))
+	fi, err := fsys.Stat("var/lib/app/.config/app")
+	require.NoError(t, err)
+	require.Equal(t, "-rw-------", fi.Mode().String())
+
+	entries, err := fsys.ReadDir("home/nonroot")
+	require.NoError(t, err)
+	require.Empty(t, entries, "no skeleton")
+}
+
+func TestMutateAccountsWithoutShadow(t *testing.T) {
+	di := &defaultBuildImplementation{}
+	o := options.Default
+
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("etc", 0o755))
+	ic := types.ImageConfiguration{Accounts: types.ImageAccounts{
+		Users: []types.User{{UserName: "nonroot", UID: 65532}},
+	}}
+	require.NoError(t, di.MutateAccounts(fsys, &o, &ic))
+
+	_, err := fsys.Stat("etc/shadow")
+	require.Error(t, err, "no shadow unless some user has a password")
+}
+
+func TestMutateAccountsGroups(t *testing.T) {
+	di := &defaultBuildImplementation{}
+	o := options.Default
+
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("etc", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/group", []byte("root:x:0:root\ntty:x:5:\nvideo:x:27:root\n"), 0o644))
+
+	ic := types.ImageConfiguration{Accounts: types.ImageAccounts{
+		Users: []types.User{{
+			UserName: "app",
+			UID:      1000,
+			Groups:   []string{"tty", "video", "app-data"},
+		}},
+		Groups: []types.Group{{
+			GroupName: "app-data",
+			GID:       2000,
+		}, {
+			GroupName: "video",
+			GID:       44,
+			Members:   []string{"root", "nonroot"},
+		}},
+	}}
+	require.NoError(t, di.MutateAccounts(fsys, &o, &ic))
+
+	group, err := fsys.ReadFile("etc/group")
+	require.NoError(t, err)
+	require.Equal(t, `root:x:0:root
+tty:x:5:app
+video:x:44:root,nonroot,app
+app-data:x:2000:app
+`, string(group))
+
+	ic.Accounts.Users[0].Groups = []string{"audio"}
+	require.ErrorContains(t, di.MutateAccounts(fsys, &o, &ic), "user app is in group audio, which does not exist")
+}
+
+func TestMutateAccountsMerge(t *testing.T) {
+	di := &defaultBuildImplementation{}
+	o := options.Default
+
+	newFS := func() apkfs.FullFS {
+		fsys := apkfs.NewMemFS()
+		require.NoError(t, fsys.MkdirAll("etc", 0o755))
+		require.NoError(t, fsys.MkdirAll("var/lib/nginx", 0o755))
+		require.NoError(t, fsys.WriteFile("etc/passwd", []byte("root:x:0:0:root:/root:/bin/sh\nnginx:x:100:101:nginx:/var/lib/nginx:/sbin/nologin\n"), 0o644))
+		require.NoError(t, fsys.WriteFile("etc/group", []byte("root:x:0:root\nnginx:x:101:nginx\n"), 0o644))
+		return fsys
+	}
+
+	t.Run("union", func(t *testing.T) {
+		fsys := newFS()
+		ic := types.ImageConfiguration{Accounts: types.ImageAccounts{
+			Users:  []types.User{{UserName: "nginx", UID: 10000, GID: 10000}, {UserName: "app", UID: 1000}},
+			Groups: []types.Group{{GroupName: "nginx", GID: 10000}},
+		}}
+		require.NoError(t, di.MutateAccounts(fsys, &o, &ic))
+
+		passwd, err := fsys.ReadFile("etc/passwd")
+		require.NoError(t, err)
+		require.Equal(t, `root:x:0:0:root:/root:/bin/sh
+nginx:x:10000:10000:nginx:/var/lib/nginx:/sbin/nologin
+app:x:1000:1000:Account created by apko:/home/app:/bin/sh
+`, string(passwd))
+		group, err := fsys.ReadFile("etc/group")
+		require.NoError(t, err)
+		require.Equal(t, "root:x:0:root\nnginx:x:10000:nginx\n", string(group))
+	})
+
+	t.Run("uid conflict", func(t *testing.T) {
+		ic := types.ImageConfiguration{Accounts: types.ImageAccounts{
+			Users: []types.User{{UserName: "app", UID: 100}},
+		}}
+		require.ErrorContains(t, di.MutateAccounts(newFS(), &o, &ic), "user app has uid 100, which is already the uid of user nginx")
+	})
+
+	t.Run("gid conflict", func(t *testing.T) {
+		ic := types.ImageConfiguration{Accounts: types.ImageAccounts{
+			Groups: []types.Group{{GroupName: "app", GID: 101}},
+		}}
+		require.ErrorContains(t, di.MutateAccounts(newFS(), &o, &ic), "group app has gid 101, which is already the gid of group nginx")
+	})
+}
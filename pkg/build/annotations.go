@@ -0,0 +1,93 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// DefaultAnnotationEnvPrefix is the prefix of environment variables which
+// are turned into image annotations when no other prefix is configured.
+const DefaultAnnotationEnvPrefix = "APKO_ANNOTATION_"
+
+// maxAnnotationValueLength caps the size of values taken from the
+// environment, so a stray variable cannot bloat the manifest.
+const maxAnnotationValueLength = 4096
+
+var (
+	invalidAnnotationKeyChars = regexp.MustCompile(`[^a-z0-9.-]`)
+	repeatedAnnotationKeySeps = regexp.MustCompile(`[.-]{2,}`)
+)
+
+// annotationsFromEnviron maps environment variables beginning with prefix
+// into annotations. The remainder of the variable name is sanitized into an
+// annotation key: it is lowercased, a double underscore becomes a dot and a
+// single underscore becomes a dash, so that
+//
+//	APKO_ANNOTATION_ORG__EXAMPLE__CI_RUN_ID=1234
+//
+// becomes the annotation org.example.ci-run-id=1234. Variables which do not
+// produce a usable key or which have an empty value are reported in skipped.
+func annotationsFromEnviron(prefix string, environ []string) (annotations map[string]string, skipped []string) {
+	annotations = map[string]string{}
+	if prefix == "" {
+		return annotations, nil
+	}
+
+	for _, kv := range environ {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(k, prefix) {
+			continue
+		}
+
+		key := sanitizeAnnotationKey(strings.TrimPrefix(k, prefix))
+		value := sanitizeAnnotationValue(v)
+		if key == "" || value == "" {
+			skipped = append(skipped, k)
+			continue
+		}
+
+		annotations[key] = value
+	}
+
+	return annotations, skipped
+}
+
+func sanitizeAnnotationKey(s string) string {
+	s = strings.ToLower(s)
+	s = strings.ReplaceAll(s, "__", ".")
+	s = strings.ReplaceAll(s, "_", "-")
+	s = invalidAnnotationKeyChars.ReplaceAllString(s, "")
+	s = repeatedAnnotationKeySeps.ReplaceAllStringFunc(s, func(m string) string {
+		return m[:1]
+	})
+	return strings.Trim(s, ".-")
+}
+
+func sanitizeAnnotationValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.TrimSpace(s)
+	if len(s) > maxAnnotationValueLength {
+		s = strings.ToValidUTF8(s[:maxAnnotationValueLength], "")
+	}
+	return s
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnotationsFromEnviron(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin:/bin",
+		"APKO_ANNOTATION_CI_RUN_ID=1234",
+		"APKO_ANNOTATION_ORG__OPENCONTAINERS__IMAGE__REVISION=abcdef",
+		"APKO_ANNOTATION_TICKET=  JIRA-42\n",
+		"APKO_ANNOTATION_EMPTY=",
+		"APKO_ANNOTATION_$$$=value",
+		"APKO_ANNOTATION_WEIRD___KEY__=x",
+	}
+
+	annotations, skipped := annotationsFromEnviron(DefaultAnnotationEnvPrefix, environ)
+	require.Equal(t, map[string]string{
+		"ci-run-id":                         "1234",
+		"org.opencontainers.image.revision": "abcdef",
+		"ticket":                            "JIRA-42",
+		"weird.key":                         "x",
+	}, annotations)
+	require.ElementsMatch(t, []string{"APKO_ANNOTATION_EMPTY", "APKO_ANNOTATION_$$$"}, skipped)
+
+	annotations, skipped = annotationsFromEnviron("", environ)
+	require.Empty(t, annotations)
+	require.Empty(t, skipped)
+}
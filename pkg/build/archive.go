@@ -0,0 +1,253 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+)
+
+// openArchive returns the archive of the mutation, downloaded to a temporary
+// file if it is a URL, once its checksum is verified, if it has one.
+func openArchive(o *options.Options, mut types.PathMutation) (*os.File, error) {
+	var f *os.File
+	if types.IsArchiveURL(mut.Source) {
+		if o.Offline {
+			return nil, fmt.Errorf("unable to download %s offline", mut.Source)
+		}
+		var err error
+		if f, err = downloadArchive(o, mut.Source); err != nil {
+			return nil, fmt.Errorf("downloading %s: %w", mut.Source, err)
+		}
+	} else {
+		var err error
+		if f, err = os.Open(mut.Source); err != nil {
+			return nil, err
+		}
+	}
+
+	if mut.Checksum != "" {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reading %s: %w", mut.Source, err)
+		}
+		if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != mut.Checksum {
+			f.Close()
+			return nil, fmt.Errorf("%s has checksum %s, not %s", mut.Source, got, mut.Checksum)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// downloadArchive downloads the URL to a temporary file, which is removed
+// once closed, with the transport and headers of the package downloads.
+func downloadArchive(o *options.Options, url string) (*os.File, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range o.Headers {
+		req.Header[k] = v
+	}
+	if o.UserAgent != "" {
+		req.Header.Set("User-Agent", o.UserAgent)
+	}
+	client := &http.Client{Transport: o.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	f, err := os.CreateTemp(o.TempDir(), "archive-")
+	if err != nil {
+		return nil, err
+	}
+	// the file is only reachable through its descriptor from then on
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// mutateArchive extracts the tar archive at the source, gzipped or not, into
+// the directory at the path, overwriting the files which are there already.
+// Like copies, the entries are owned by the uid and gid of the mutation and
+// have the source date epoch as their modification time. Permissions, if set,
+// are those of the directory, and the entries otherwise keep their own.
+func mutateArchive(fsys apkfs.FullFS, o *options.Options, mut types.PathMutation) error {
+	f, err := openArchive(o, mut)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if magic, _ := r.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", mut.Source, err)
+		}
+		defer gzr.Close()
+		r = gzr
+	}
+
+	mode := fs.FileMode(0o755)
+	if mut.Permissions != 0 {
+		mode = fs.FileMode(mut.Permissions)
+	}
+	if err := fsys.MkdirAll(mut.Path, mode); err != nil {
+		return err
+	}
+	if err := fsys.Chmod(mut.Path, mode); err != nil {
+		return err
+	}
+	if err := chownArchiveEntry(fsys, o, mut, mut.Path); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading %s: %w", mut.Source, err)
+		}
+		target, err := archiveTarget(mut.Path, hdr.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", mut.Source, err)
+		}
+		if target == path.Clean(mut.Path) {
+			continue
+		}
+		if err := fsys.MkdirAll(path.Dir(target), 0o755); err != nil {
+			return err
+		}
+
+		perm := fs.FileMode(hdr.Mode) & fs.ModePerm
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := fsys.MkdirAll(target, perm); err != nil {
+				return err
+			}
+			if err := fsys.Chmod(target, perm); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			out, err := fsys.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return fmt.Errorf("writing %s: %w", target, err)
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+			// the file may have been there with other permissions
+			if err := fsys.Chmod(target, perm); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if _, err := fsys.Lstat(target); err == nil {
+				if err := fsys.Remove(target); err != nil {
+					return fmt.Errorf("unable to remove old link: %w", err)
+				}
+			}
+			if err := fsys.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linked, err := archiveTarget(mut.Path, hdr.Linkname)
+			if err != nil {
+				return fmt.Errorf("%s: %w", mut.Source, err)
+			}
+			if _, err := fsys.Lstat(target); err == nil {
+				if err := fsys.Remove(target); err != nil {
+					return fmt.Errorf("unable to remove old link: %w", err)
+				}
+			}
+			if err := fsys.Link(linked, target); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unable to extract %s from %s, which is not a directory, file or link", hdr.Name, mut.Source)
+		}
+
+		if err := chownArchiveEntry(fsys, o, mut, target); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveTarget returns the path an entry of the archive is extracted to,
+// within the directory, which it may not escape.
+func archiveTarget(dir, name string) (string, error) {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("entry %s escapes the archive", name)
+		}
+	}
+	return path.Join(dir, path.Clean("/"+name)), nil
+}
+
+// chownArchiveEntry gives the extracted path the owner of the mutation, and
+// the source date epoch as its modification time.
+func chownArchiveEntry(fsys apkfs.FullFS, o *options.Options, mut types.PathMutation, target string) error {
+	if err := fsys.Lchown(target, int(mut.UID), int(mut.GID)); err != nil {
+		return err
+	}
+	if !o.SourceDateEpoch.IsZero() {
+		if err := fsys.SetModTime(target, o.SourceDateEpoch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+)
+
+// testArchive returns a gzipped tar archive of the entries.
+func testArchive(t *testing.T, entries ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, hdr := range entries {
+		body := []byte(hdr.Linkname)
+		if hdr.Typeflag == tar.TypeReg {
+			body = []byte("content of " + hdr.Name)
+			hdr.Size = int64(len(body))
+			hdr.Linkname = ""
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write(body)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+	return buf.Bytes()
+}
+
+func TestMutateArchive(t *testing.T) {
+	archive := testArchive(t,
+		&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0o700},
+		&tar.Header{Name: "./bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+		&tar.Header{Name: "./bin/tool", Typeflag: tar.TypeReg, Mode: 0o755, Uid: 1001},
+		&tar.Header{Name: "./bin/tool-alias", Typeflag: tar.TypeSymlink, Linkname: "tool"},
+		&tar.Header{Name: "./bin/tool-link", Typeflag: tar.TypeLink, Linkname: "./bin/tool"},
+		&tar.Header{Name: "share/doc/README", Typeflag: tar.TypeReg, Mode: 0o644},
+	)
+	src := filepath.Join(t.TempDir(), "tool.tar.gz")
+	require.NoError(t, os.WriteFile(src, archive, 0o644))
+
+	o := options.Default
+	o.SourceDateEpoch = time.Unix(1700000000, 0)
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("opt/tool/bin", 0o755))
+	require.NoError(t, fsys.WriteFile("opt/tool/bin/tool", []byte("old"), 0o600))
+	require.NoError(t, mutateArchive(fsys, &o, types.PathMutation{
+		Path:     "opt/tool",
+		Type:     types.PathArchive,
+		Source:   src,
+		Checksum: fmt.Sprintf("sha256:%x", sha256.Sum256(archive)),
+		UID:      1000,
+		GID:      1000,
+	}))
+
+	fi, err := fsys.Stat("opt/tool")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), fi.Mode().Perm(), "the permissions of the directory are not those of the archive")
+
+	data, err := fsys.ReadFile("opt/tool/bin/tool")
+	require.NoError(t, err)
+	require.Equal(t, "content of ./bin/tool", string(data), "overwritten")
+	fi, err = fsys.Stat("opt/tool/bin/tool")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+	require.True(t, fi.ModTime().Equal(o.SourceDateEpoch))
+
+	link, err := fsys.Readlink("opt/tool/bin/tool-alias")
+	require.NoError(t, err)
+	require.Equal(t, "tool", link)
+
+	data, err = fsys.ReadFile("opt/tool/bin/tool-link")
+	require.NoError(t, err)
+	require.Equal(t, "content of ./bin/tool", string(data))
+
+	data, err = fsys.ReadFile("opt/tool/share/doc/README")
+	require.NoError(t, err)
+	require.Equal(t, "content of share/doc/README", string(data))
+
+	// the checksum must match
+	err = mutateArchive(apkfs.NewMemFS(), &o, types.PathMutation{
+		Path:     "opt/tool",
+		Type:     types.PathArchive,
+		Source:   src,
+		Checksum: fmt.Sprintf("sha256:%x", sha256.Sum256(nil)),
+	})
+	require.ErrorContains(t, err, "has checksum")
+
+	// entries may not escape the directory
+	escaping := filepath.Join(t.TempDir(), "escaping.tar.gz")
+	require.NoError(t, os.WriteFile(escaping, testArchive(t,
+		&tar.Header{Name: "../../etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644},
+	), 0o644))
+	err = mutateArchive(apkfs.NewMemFS(), &o, types.PathMutation{Path: "opt/tool", Type: types.PathArchive, Source: escaping})
+	require.ErrorContains(t, err, "escapes the archive")
+}
+
+func TestMutateArchiveURL(t *testing.T) {
+	archive := testArchive(t, &tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0o755})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "apko-test/1.0", r.Header.Get("User-Agent"))
+		_, _ = w.Write(archive)
+	}))
+	defer srv.Close()
+
+	o := options.Default
+	o.TempDirPath = t.TempDir()
+	o.UserAgent = "apko-test/1.0"
+	mut := types.PathMutation{
+		Path:     "opt/tool",
+		Type:     types.PathArchive,
+		Source:   srv.URL + "/tool.tar.gz",
+		Checksum: fmt.Sprintf("sha256:%x", sha256.Sum256(archive)),
+	}
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, mutateArchive(fsys, &o, mut))
+	data, err := fsys.ReadFile("opt/tool/bin/tool")
+	require.NoError(t, err)
+	require.Equal(t, "content of bin/tool", string(data))
+
+	o.Offline = true
+	require.ErrorContains(t, mutateArchive(apkfs.NewMemFS(), &o, mut), "offline")
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"chainguard.dev/apko/pkg/audit"
+)
+
+// WithAuditLog records the builds and publishes of the context into the
+// audit log.
+func WithAuditLog(log *audit.Log) Option {
+	return func(bc *Context) error {
+		bc.Options.AuditLog = log
+		return nil
+	}
+}
+
+// InputsDigest returns the digest of what the context builds: the image
+// configuration, along with the options changing its contents.
+func (bc *Context) InputsDigest() (string, error) {
+	inputs := struct {
+		Configuration   interface{} `yaml:"configuration"`
+		ExtraKeys       []string    `yaml:"extra-keys,omitempty"`
+		ExtraRepos      []string    `yaml:"extra-repos,omitempty"`
+		SourceDateEpoch time.Time   `yaml:"source-date-epoch"`
+		Tags            []string    `yaml:"tags,omitempty"`
+	}{
+		Configuration:   bc.ImageConfiguration,
+		ExtraKeys:       bc.Options.ExtraKeyFiles,
+		ExtraRepos:      bc.Options.ExtraRepos,
+		SourceDateEpoch: bc.Options.SourceDateEpoch,
+		Tags:            bc.Options.Tags,
+	}
+	data, err := yaml.Marshal(inputs)
+	if err != nil {
+		return "", fmt.Errorf("marshaling build inputs: %w", err)
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data)), nil
+}
+
+// RecordAudit records an action which started at the given time, and its
+// outputs or error, in the audit log of the context, if it has one.
+func (bc *Context) RecordAudit(ctx context.Context, action string, started time.Time, outputs []string, actionErr error) error {
+	if bc.Options.AuditLog == nil {
+		return nil
+	}
+	inputs, err := bc.InputsDigest()
+	if err != nil {
+		return err
+	}
+	entry := audit.Entry{
+		Action:   action,
+		Started:  started.UTC(),
+		Finished: time.Now().UTC(),
+		Inputs:   inputs,
+		Outputs:  outputs,
+	}
+	if actionErr != nil {
+		entry.Error = actionErr.Error()
+	}
+	return bc.Options.AuditLog.Record(ctx, entry)
+}
@@ -0,0 +1,197 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/oci"
+)
+
+// whiteoutPrefix marks the files of a layer removing a path of the layers
+// below, by the name of the path.
+const whiteoutPrefix = ".wh."
+
+// resolveBase resolves the base image of the architecture, if the image has
+// one. A base pulled by tag is pinned to the digest of the image, so that
+// assembling the image later uses the layers the filesystem was built on.
+func (bc *Context) resolveBase() error {
+	if bc.base != nil || !bc.ImageConfiguration.Base.Set() {
+		return nil
+	}
+	img, err := oci.BaseImage(bc.ImageConfiguration.Base, bc.Options.Arch)
+	if err != nil {
+		return err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return fmt.Errorf("computing the digest of the base image: %w", err)
+	}
+	if ref := bc.ImageConfiguration.Base.Ref; ref != "" {
+		parsed, err := name.ParseReference(ref)
+		if err != nil {
+			return fmt.Errorf("parsing base image ref %q: %w", ref, err)
+		}
+		bc.ImageConfiguration.Base.Ref = parsed.Context().Digest(digest.String()).String()
+	}
+	bc.Logger().Infof("building on top of base image %s", digest)
+	bc.base = img
+	return nil
+}
+
+// unpackBase lays out the filesystem of the base image, if any, in the
+// working directory, and records what it has there.
+func (bc *Context) unpackBase() error {
+	if err := bc.resolveBase(); err != nil {
+		return err
+	}
+	if bc.base == nil {
+		return nil
+	}
+	if err := bc.ExtractImage(bc.base); err != nil {
+		return fmt.Errorf("unpacking base image: %w", err)
+	}
+	files, err := snapshotFS(bc.fs)
+	if err != nil {
+		return fmt.Errorf("recording the files of the base image: %w", err)
+	}
+	bc.baseFiles = files
+	return nil
+}
+
+// fsEntry is what a path of the filesystem is, regardless of its timestamps,
+// to tell whether the build changed it.
+type fsEntry struct {
+	typeflag byte
+	mode     int64
+	uid, gid int
+	size     int64
+	link     string
+	digest   [sha256.Size]byte
+}
+
+// snapshotFS records each path of the filesystem.
+func snapshotFS(fsys apkfs.FullFS) (map[string]fsEntry, error) {
+	entries := map[string]fsEntry{}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		e, err := entryOf(fsys, name, d)
+		if err != nil {
+			return err
+		}
+		entries[name] = e
+		return nil
+	})
+	return entries, err
+}
+
+func entryOf(fsys apkfs.FullFS, name string, d fs.DirEntry) (fsEntry, error) {
+	fi, err := d.Info()
+	if err != nil {
+		return fsEntry{}, err
+	}
+	var link string
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		if link, err = fsys.Readlink(name); err != nil {
+			return fsEntry{}, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return fsEntry{}, err
+	}
+	e := fsEntry{
+		typeflag: hdr.Typeflag,
+		mode:     hdr.Mode,
+		uid:      hdr.Uid,
+		gid:      hdr.Gid,
+		size:     hdr.Size,
+		link:     link,
+	}
+	if fi.Mode().IsRegular() {
+		f, err := fsys.Open(name)
+		if err != nil {
+			return fsEntry{}, err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return fsEntry{}, fmt.Errorf("reading %s: %w", name, err)
+		}
+		copy(e.digest[:], h.Sum(nil))
+	}
+	return e, nil
+}
+
+// unchanged returns whether the path is as the base image has it.
+func unchanged(fsys apkfs.FullFS, base map[string]fsEntry, name string, d fs.DirEntry) (bool, error) {
+	want, ok := base[name]
+	if !ok {
+		return false, nil
+	}
+	got, err := entryOf(fsys, name, d)
+	if err != nil {
+		return false, err
+	}
+	return got == want, nil
+}
+
+// writeWhiteouts marks the paths of the base image which the build removed,
+// with whiteout files in the filesystem, and returns them for them to be
+// removed once the layers are written. Within a removed directory, only the
+// directory is marked.
+func writeWhiteouts(fsys apkfs.FullFS, base map[string]fsEntry) ([]string, error) {
+	names := make([]string, 0, len(base))
+	for name := range base {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	removed := map[string]bool{}
+	var whiteouts []string
+	for _, name := range names {
+		if removed[path.Dir(name)] {
+			removed[name] = true
+			continue
+		}
+		if _, err := fsys.Lstat(name); err == nil {
+			continue
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return whiteouts, err
+		}
+		removed[name] = true
+		whiteout := path.Join(path.Dir(name), whiteoutPrefix+path.Base(name))
+		if err := fsys.WriteFile(whiteout, nil, 0o644); err != nil {
+			return whiteouts, fmt.Errorf("marking %s as removed: %w", name, err)
+		}
+		whiteouts = append(whiteouts, whiteout)
+	}
+	return whiteouts, nil
+}
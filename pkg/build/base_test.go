@@ -0,0 +1,69 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+func TestBaseChanges(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("etc/ssl", 0o755))
+	require.NoError(t, fsys.MkdirAll("var/cache/base", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/passwd", []byte("root:x:0:0:root:/root:/bin/sh\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("etc/motd", []byte("base\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("etc/ssl/cert.pem", []byte("cert"), 0o644))
+	require.NoError(t, fsys.WriteFile("var/cache/base/index", []byte("index"), 0o644))
+	require.NoError(t, fsys.Symlink("/etc/ssl/cert.pem", "etc/ssl/ca.pem"))
+
+	base, err := snapshotFS(fsys)
+	require.NoError(t, err)
+	require.Len(t, base, 10)
+
+	// the build adds a user, changes the permissions of a file, removes a
+	// file and a directory, and adds a file
+	require.NoError(t, fsys.WriteFile("etc/passwd", []byte("root:x:0:0:root:/root:/bin/sh\nnonroot:x:65532:65532::/home/nonroot:/bin/sh\n"), 0o644))
+	require.NoError(t, fsys.Chmod("etc/ssl/cert.pem", 0o600))
+	require.NoError(t, fsys.Remove("etc/motd"))
+	require.NoError(t, fsys.Remove("var/cache/base/index"))
+	require.NoError(t, fsys.Remove("var/cache/base"))
+	require.NoError(t, fsys.WriteFile("etc/app.conf", []byte("app"), 0o644))
+
+	whiteouts, err := writeWhiteouts(fsys, base)
+	require.NoError(t, err)
+	require.Equal(t, []string{"etc/.wh.motd", "var/cache/.wh.base"}, whiteouts, "only the removed directory")
+
+	var changed []string
+	require.NoError(t, fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		if name == "." {
+			return nil
+		}
+		same, err := unchanged(fsys, base, name, d)
+		require.NoError(t, err)
+		if !same {
+			changed = append(changed, name)
+		}
+		return nil
+	}))
+	require.ElementsMatch(t, []string{
+		"etc/.wh.motd", "etc/app.conf", "etc/passwd", "etc/ssl/cert.pem", "var/cache/.wh.base",
+	}, changed)
+}
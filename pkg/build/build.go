@@ -18,17 +18,21 @@ package build
 
 import (
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/hashicorp/go-multierror"
 	coci "github.com/sigstore/cosign/v2/pkg/oci"
 	"gitlab.alpinelinux.org/alpine/go/repository"
 
+	apkimpl "chainguard.dev/apko/pkg/apk/impl"
 	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
 	"chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/apko/pkg/exec"
@@ -53,6 +57,16 @@ type Context struct {
 	Assertions      []Assertion
 	Options         options.Options
 	fs              apkfs.FullFS
+	// base is the base image of the architecture, once resolved, and
+	// baseFiles the paths it has, once laid out.
+	base      v1.Image
+	baseFiles map[string]fsEntry
+	// checks are run by New once the variables are substituted, for the
+	// options depending on the whole configuration.
+	checks []func(*Context) error
+	// variantBase is the OCI image layout of the images the variant is
+	// built on top of, if any.
+	variantBase string
 }
 
 func (bc *Context) Summarize() {
@@ -83,6 +97,9 @@ func (bc *Context) GenerateSBOM() error {
 }
 
 func (bc *Context) BuildImage() (fs.FS, error) {
+	if err := bc.unpackBase(); err != nil {
+		return nil, err
+	}
 	// TODO(puerco): Point to final interface (see comment on buildImage fn)
 	if err := buildImage(bc.fs, bc.impl, &bc.Options, &bc.ImageConfiguration, bc.s6); err != nil {
 		return nil, err
@@ -95,10 +112,45 @@ func (bc *Context) BuildPackageList() (toInstall []*repository.RepositoryPackage
 	return buildPackageList(bc.fs, bc.impl, &bc.Options, &bc.ImageConfiguration)
 }
 
+// Plan returns what building the image would install, in order, along with
+// the download and installed sizes, without downloading any package.
+func (bc *Context) Plan() (*apkimpl.Plan, error) {
+	toInstall, _, err := bc.BuildPackageList()
+	if err != nil {
+		return nil, err
+	}
+	// the image starts empty, so nothing is installed yet
+	return apkimpl.NewPlan(toInstall, nil), nil
+}
+
+// Search returns the packages of the repositories of the image matching the
+// query, by name and from the highest version to the lowest.
+func (bc *Context) Search(query apkimpl.SearchQuery) ([]*repository.RepositoryPackage, error) {
+	if err := bc.impl.InitializeApk(bc.fs, &bc.Options, &bc.ImageConfiguration); err != nil {
+		return nil, fmt.Errorf("initializing apk: %w", err)
+	}
+	return bc.impl.SearchPackages(bc.fs, &bc.Options, query)
+}
+
+// Info returns the metadata of the packages of the repositories of the image
+// matching the name, starting with the one which would be installed.
+func (bc *Context) Info(pkgName string) ([]apkimpl.PackageInfo, error) {
+	if err := bc.impl.InitializeApk(bc.fs, &bc.Options, &bc.ImageConfiguration); err != nil {
+		return nil, fmt.Errorf("initializing apk: %w", err)
+	}
+	return bc.impl.PackageInfo(bc.fs, &bc.Options, pkgName)
+}
+
 func (bc *Context) Logger() log.Logger {
 	return bc.Options.Logger()
 }
 
+// FS returns the filesystem the image is laid out in, which is not
+// necessarily the working directory, e.g. with a memory budget.
+func (bc *Context) FS() apkfs.FullFS {
+	return bc.fs
+}
+
 // BuildLayer given the context set up, including
 // build configuration and working directory,
 // lays out all of the packages in the working directory,
@@ -117,6 +169,118 @@ func (bc *Context) BuildLayer() (string, error) {
 	return bc.ImageLayoutToLayer()
 }
 
+// BuildLayers is like BuildLayer, but splits the image into the layers of
+// the layering of the image configuration, returning their tarballs in order.
+// Unless the image is layered, that is the single layer of BuildLayer. With a
+// layer cache, the layers of the same resolved inputs are reused rather than
+// built again.
+func (bc *Context) BuildLayers() ([]string, error) {
+	// the layers are cached by the digest of the base
+	if err := bc.resolveBase(); err != nil {
+		return nil, err
+	}
+	if bc.Options.LayerCache == "" || bc.Options.StreamingFS {
+		return bc.buildLayers()
+	}
+	if len(bc.Options.FileMutators) != 0 {
+		bc.Logger().Warnf("not caching layers changed by file mutators")
+		return bc.buildLayers()
+	}
+
+	key, err := bc.LayersKey()
+	if err != nil {
+		return nil, err
+	}
+	layers, ok, err := bc.cachedLayers(key)
+	if err != nil {
+		return nil, fmt.Errorf("reading the layer cache: %w", err)
+	}
+	if !ok {
+		if layers, err = bc.buildLayers(); err != nil {
+			return nil, err
+		}
+		if err := bc.cacheLayers(key, layers); err != nil {
+			return nil, fmt.Errorf("caching layers: %w", err)
+		}
+		return layers, nil
+	}
+
+	bc.Logger().Infof("reusing the layers of inputs %s from the layer cache", key)
+	if err := bc.restoreLayers(layers); err != nil {
+		return nil, err
+	}
+	if err := bc.runAssertions(); err != nil {
+		return nil, err
+	}
+	bc.Options.TarballPath = layers[len(layers)-1]
+	if err := bc.generateLayerSBOM(); err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
+// buildLayers builds the image, and writes its layers.
+func (bc *Context) buildLayers() ([]string, error) {
+	// the layer on top of a base has only the changes, which writeLayers
+	// tells apart
+	if !bc.ImageConfiguration.Layering.Layered() && !bc.ImageConfiguration.Base.Set() {
+		layer, err := bc.BuildLayer()
+		if err != nil {
+			return nil, err
+		}
+		return []string{layer}, nil
+	}
+
+	bc.Summarize()
+
+	// build image filesystem
+	if _, err := bc.BuildImage(); err != nil {
+		return nil, err
+	}
+
+	// run any assertions defined
+	if err := bc.runAssertions(); err != nil {
+		return nil, err
+	}
+
+	layers, err := writeLayers(&bc.Options, &bc.ImageConfiguration, bc.fs, bc.baseFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bc.generateLayerSBOM(); err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
+// BuildLayerStream is like BuildLayer, but instead of writing
+// a layer tar.gz file it returns the uncompressed layer tarball
+// as a stream, which is produced while it is being read.
+// SBOMs are not generated, as there is no layer file to describe.
+func (bc *Context) BuildLayerStream() (io.ReadCloser, error) {
+	if bc.ImageConfiguration.Layering.Layered() {
+		return nil, fmt.Errorf("a layered image cannot be streamed as a single layer")
+	}
+	if bc.ImageConfiguration.Base.Set() {
+		return nil, fmt.Errorf("an image on top of a base image cannot be streamed as a single layer")
+	}
+
+	bc.Summarize()
+
+	// build image filesystem
+	if _, err := bc.BuildImage(); err != nil {
+		return nil, err
+	}
+
+	// run any assertions defined
+	if err := bc.runAssertions(); err != nil {
+		return nil, err
+	}
+
+	return bc.impl.StreamTarball(&bc.Options, bc.fs)
+}
+
 // ImageLayoutToLayer given an already built-out
 // image in an fs from BuildImage(), create
 // an OCI image layer tgz.
@@ -132,17 +296,25 @@ func (bc *Context) ImageLayoutToLayer() (string, error) {
 		return "", err
 	}
 
-	// generate SBOM
-	if bc.Options.WantSBOM {
-		if err := bc.GenerateSBOM(); err != nil {
-			return "", fmt.Errorf("generating SBOMs: %w", err)
-		}
-	} else {
-		bc.Logger().Debugf("Not generating SBOMs (WantSBOM = false)")
+	if err := bc.generateLayerSBOM(); err != nil {
+		return "", err
 	}
 
 	return layerTarGZ, nil
 }
+
+// generateLayerSBOM generates the SBOMs of the layer at the tarball path of
+// the options, if they are wanted.
+func (bc *Context) generateLayerSBOM() error {
+	if !bc.Options.WantSBOM {
+		bc.Logger().Debugf("Not generating SBOMs (WantSBOM = false)")
+		return nil
+	}
+	if err := bc.GenerateSBOM(); err != nil {
+		return fmt.Errorf("generating SBOMs: %w", err)
+	}
+	return nil
+}
 func (bc *Context) runAssertions() error {
 	var eg multierror.Group
 
@@ -158,13 +330,8 @@ func (bc *Context) runAssertions() error {
 // The SOURCE_DATE_EPOCH env variable is supported and will
 // overwrite the provided timestamp if present.
 func New(workDir string, opts ...Option) (*Context, error) {
-	fs := apkfs.DirFS(workDir, apkfs.WithCreateDir(true))
 	bc := Context{
 		Options: options.Default,
-		impl: &defaultBuildImplementation{
-			workdirFS: fs,
-		},
-		fs: fs,
 	}
 	bc.Options.WorkDir = workDir
 
@@ -174,6 +341,52 @@ func New(workDir string, opts ...Option) (*Context, error) {
 		}
 	}
 
+	// the variables may be set by any option, so they are substituted once
+	// all of them are applied, before the configuration is checked
+	unresolved, err := bc.ImageConfiguration.Substitute(bc.Options.Vars, os.LookupEnv)
+	if err != nil {
+		return nil, fmt.Errorf("substituting variables: %w", err)
+	}
+	if len(unresolved) > 0 {
+		bc.Logger().Warnf("variables %s are neither declared nor set, so they are left unexpanded", strings.Join(unresolved, ", "))
+	}
+	for _, check := range bc.checks {
+		if err := check(&bc); err != nil {
+			return nil, err
+		}
+	}
+	// the images of the variant are apko's own, so they are not among the
+	// bases the configuration is checked for
+	if bc.variantBase != "" {
+		bc.ImageConfiguration.Base = types.BaseImage{Layout: bc.variantBase}
+		bc.Options.KeepInstalled = true
+	}
+
+	var fs apkfs.FullFS
+	if bc.Options.MemoryBudget > 0 {
+		// the files in memory have the owners and the paths asked for, so
+		// only the fakeroot database, which is for the files on disk, is
+		// not for such a filesystem
+		if bc.Options.FakerootDB != "" {
+			return nil, fmt.Errorf("a fakeroot database cannot be kept for a filesystem built in memory")
+		}
+		if err := os.MkdirAll(workDir, 0o700); err != nil {
+			return nil, fmt.Errorf("unable to use %s as the working directory: %w", workDir, err)
+		}
+		fs = apkfs.NewHybridFS(workDir, bc.Options.MemoryBudget)
+	} else {
+		// the owners on disk may differ from the ones of the image, which
+		// the filesystem keeps track of
+		fs = apkfs.DirFS(workDir, apkfs.WithCreateDir(true), apkfs.DirFSWithIDMap(bc.Options.HostUIDMap, bc.Options.HostGIDMap), apkfs.DirFSWithFakerootDB(bc.Options.FakerootDB), apkfs.DirFSWithCaseCollisionError(bc.Options.FailOnCaseCollision))
+		if fs == nil {
+			return nil, fmt.Errorf("unable to use %s as the working directory", workDir)
+		}
+	}
+	bc.impl = &defaultBuildImplementation{
+		workdirFS: fs,
+	}
+	bc.fs = fs
+
 	// SOURCE_DATE_EPOCH will always overwrite the build flag
 	if v, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
 		// The value MUST be an ASCII representation of an integer
@@ -195,6 +408,29 @@ func New(workDir string, opts ...Option) (*Context, error) {
 		bc.Options.Arch = types.ParseArchitecture(runtime.GOARCH)
 	}
 
+	// the packages go straight to the layer, which must be set up once the
+	// timestamp is known
+	if bc.Options.StreamingFS {
+		doc := bc.ImageConfiguration.Documentation
+		if (doc.ManPages != "" && doc.ManPages != types.DocumentationKeep) || (doc.Completions != "" && doc.Completions != types.DocumentationKeep) {
+			return nil, fmt.Errorf("documentation cannot be stripped from a streamed layer")
+		}
+		if bc.ImageConfiguration.Layering.Layered() {
+			return nil, fmt.Errorf("a streamed layer cannot be split into layers")
+		}
+		if bc.ImageConfiguration.Base.Set() {
+			return nil, fmt.Errorf("a streamed layer cannot be built on top of a base image")
+		}
+		layer, err := newStreamedLayer(&bc.Options)
+		if err != nil {
+			return nil, err
+		}
+		bc.impl = &defaultBuildImplementation{
+			workdirFS: layer,
+		}
+		bc.fs = layer
+	}
+
 	if bc.Options.WithVCS && bc.ImageConfiguration.VCSUrl == "" {
 		bc.ImageConfiguration.ProbeVCSUrl(bc.ImageConfigFile, bc.Logger())
 	}
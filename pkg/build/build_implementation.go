@@ -17,6 +17,7 @@ package build
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -30,6 +31,7 @@ import (
 	"sigs.k8s.io/release-utils/hash"
 
 	chainguardAPK "chainguard.dev/apko/pkg/apk"
+	apkimpl "chainguard.dev/apko/pkg/apk/impl"
 	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
 	"chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/apko/pkg/exec"
@@ -47,6 +49,8 @@ type buildImplementation interface {
 	Refresh(*options.Options) (*s6.Context, *exec.Executor, error)
 	// BuildTarball build from the layout in a working directory to an OCI image layer tarball
 	BuildTarball(*options.Options, fs.FS) (string, error)
+	// StreamTarball stream the layout in a working directory as an uncompressed layer tarball
+	StreamTarball(*options.Options, fs.FS) (io.ReadCloser, error)
 	// GenerateSBOM generate a software-bill-of-materials for the image
 	GenerateSBOM(*options.Options, *types.ImageConfiguration) error
 	// InitializeApk do all of the steps to set up apk for installing packages in the working directory
@@ -55,12 +59,22 @@ type buildImplementation interface {
 	InstallPackages(apkfs.FullFS, *options.Options, *types.ImageConfiguration) error
 	// ResolvePackages resolve the names and versions of packages to be installed
 	ResolvePackages(apkfs.FullFS, *options.Options, *types.ImageConfiguration) ([]*repository.RepositoryPackage, []string, error)
+	// SearchPackages search the repositories for packages matching the query
+	SearchPackages(apkfs.FullFS, *options.Options, apkimpl.SearchQuery) ([]*repository.RepositoryPackage, error)
+	// PackageInfo get the metadata of the packages of the repositories matching the name
+	PackageInfo(apkfs.FullFS, *options.Options, string) ([]apkimpl.PackageInfo, error)
 	// MutateAccounts set up the user accounts and groups in the working directory
 	MutateAccounts(apkfs.FullFS, *options.Options, *types.ImageConfiguration) error
 	// MutatePaths set permissions and ownership on files based on the ImageConfiguration
 	MutatePaths(apkfs.FullFS, *options.Options, *types.ImageConfiguration) error
 	// GenerateOSRelase generate /etc/os-release in the working directory
 	GenerateOSRelease(apkfs.FullFS, *options.Options, *types.ImageConfiguration) error
+	// GenerateNSSwitch generate /etc/nsswitch.conf in the working directory, if configured
+	GenerateNSSwitch(apkfs.FullFS, *options.Options, *types.ImageConfiguration) error
+	// StripDocumentation remove the man pages and shell completions from the working directory, if configured
+	StripDocumentation(apkfs.FullFS, *options.Options, *types.ImageConfiguration) error
+	// GenerateEnvironment derive PATH from the executables in the working directory, if configured
+	GenerateEnvironment(apkfs.FullFS, *options.Options, *types.ImageConfiguration) error
 	// ValidateImageConfiguration check that the supplied ImageConfiguration is valid
 	ValidateImageConfiguration(*types.ImageConfiguration) error
 	// BuildImage based on the ImageConfiguration, run all of the steps to generate the laid out paths in the working directory
@@ -75,7 +89,7 @@ type buildImplementation interface {
 	AdditionalTags(apkfs.FullFS, *options.Options) error
 	// InstallBusyboxLinks install busybox symlinks, if busybox is installed
 	InstallBusyboxLinks(apkfs.FullFS, *options.Options) error
-	// InstallLdconfigLinks install ldconfig symlinks
+	// InstallLdconfigLinks install ldconfig symlinks and, for glibc, /etc/ld.so.cache
 	InstallLdconfigLinks(apkfs.FullFS) error
 	// InstallCharDevices install character devices
 	InstallCharDevices(apkfs.FullFS) error
@@ -103,6 +117,20 @@ func (di *defaultBuildImplementation) Refresh(o *options.Options) (*s6.Context,
 }
 
 func (di *defaultBuildImplementation) BuildTarball(o *options.Options, fsys fs.FS) (string, error) {
+	// the layer is mostly written already, as the packages were installed
+	if layer, ok := fsys.(*streamedLayer); ok {
+		path := o.TarballPath
+		if path == "" {
+			path = filepath.Join(o.TempDir(), o.TarballFileName())
+		}
+		if err := layer.finish(path); err != nil {
+			return "", err
+		}
+		o.TarballPath = path
+		o.Logger().Infof("built image layer tarball as %s", path)
+		return path, nil
+	}
+
 	var outfile *os.File
 	var err error
 
@@ -117,9 +145,18 @@ func (di *defaultBuildImplementation) BuildTarball(o *options.Options, fsys fs.F
 	o.TarballPath = outfile.Name()
 	defer outfile.Close()
 
+	// the image is done by then, so writing the tarball must not change it
+	if full, ok := fsys.(apkfs.FullFS); ok {
+		fsys = apkfs.ReadOnlyFS(full)
+	}
+
 	// we use a general override of 0,0 for all files, but the specific overrides, that come from the installed package DB, come later
 	tw, err := tarball.NewContext(
 		tarball.WithSourceDateEpoch(o.SourceDateEpoch),
+		tarball.WithFileMutators(o.FileMutators...),
+		tarball.WithDeduplication(o.DeduplicateFiles),
+		tarball.WithSparse(o.SparseFiles),
+		tarball.WithTimestampPolicy(o.Timestamps),
 	)
 	if err != nil {
 		return "", fmt.Errorf("failed to construct tarball build context: %w", err)
@@ -133,6 +170,65 @@ func (di *defaultBuildImplementation) BuildTarball(o *options.Options, fsys fs.F
 	return outfile.Name(), nil
 }
 
+// StreamTarball writes the layout to a pipe as an uncompressed tarball
+// without touching the disk. Errors writing the tarball are surfaced
+// when reading from the returned stream, and closing it stops the writing.
+func (di *defaultBuildImplementation) StreamTarball(o *options.Options, fsys fs.FS) (io.ReadCloser, error) {
+	if _, ok := fsys.(*streamedLayer); ok {
+		return nil, fmt.Errorf("the layer of a streamed build is already written as a compressed tarball")
+	}
+	if full, ok := fsys.(apkfs.FullFS); ok {
+		fsys = apkfs.ReadOnlyFS(full)
+	}
+
+	tw, err := tarball.NewContext(
+		tarball.WithSourceDateEpoch(o.SourceDateEpoch),
+		tarball.WithFileMutators(o.FileMutators...),
+		tarball.WithDeduplication(o.DeduplicateFiles),
+		tarball.WithSparse(o.SparseFiles),
+		tarball.WithTimestampPolicy(o.Timestamps),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct tarball build context: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+	stream := &tarStream{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(stream.done)
+		err := tw.WriteTar(pw, fsys)
+		if err != nil {
+			err = fmt.Errorf("failed to generate tarball for image: %w", err)
+		}
+		// a nil error makes the stream end as usual
+		pw.CloseWithError(err)
+	}()
+
+	o.Logger().Infof("streaming image layer tarball")
+	return stream, nil
+}
+
+// errTarStreamClosed is what writing a tarball stream fails with once it is
+// closed before it is read to the end.
+var errTarStreamClosed = errors.New("tarball stream closed before it was read")
+
+// tarStream is the reading end of the pipe a tarball is written to by
+// another goroutine.
+type tarStream struct {
+	*io.PipeReader
+	// done is closed once the goroutine writing the tarball returns
+	done chan struct{}
+}
+
+// Close stops the writing of the tarball, if it is not done yet, and waits
+// for the goroutine writing it to return, so that it never outlives the
+// stream.
+func (s *tarStream) Close() error {
+	err := s.PipeReader.CloseWithError(errTarStreamClosed)
+	<-s.done
+	return err
+}
+
 // GenerateImageSBOM generates an sbom for an image
 func (di *defaultBuildImplementation) GenerateImageSBOM(o *options.Options, ic *types.ImageConfiguration, img coci.SignedImage) error {
 	if len(o.SBOMFormats) == 0 {
@@ -142,7 +238,21 @@ func (di *defaultBuildImplementation) GenerateImageSBOM(o *options.Options, ic *
 
 	s := newSBOM(di.workdirFS, o, ic)
 
-	if err := s.ReadLayerTarball(o.TarballPath); err != nil {
+	if o.StreamLayers {
+		// the layer was never written to disk, so take its digest from the image
+		layers, err := img.Layers()
+		if err != nil {
+			return fmt.Errorf("getting %s image layers: %w", o.Arch, err)
+		}
+		if len(layers) != 1 {
+			return fmt.Errorf("expected a single layer in %s image, got %d", o.Arch, len(layers))
+		}
+		digest, err := layers[0].Digest()
+		if err != nil {
+			return fmt.Errorf("getting %s layer digest: %w", o.Arch, err)
+		}
+		s.Options.ImageInfo.LayerDigest = digest.String()
+	} else if err := s.ReadLayerTarball(o.TarballPath); err != nil {
 		return fmt.Errorf("reading layer tar: %w", err)
 	}
 
@@ -224,6 +334,22 @@ func (di *defaultBuildImplementation) ResolvePackages(fsys apkfs.FullFS, o *opti
 	return apk.ResolvePackages()
 }
 
+func (di *defaultBuildImplementation) SearchPackages(fsys apkfs.FullFS, o *options.Options, query apkimpl.SearchQuery) ([]*repository.RepositoryPackage, error) {
+	apk, err := chainguardAPK.NewWithOptions(fsys, *o)
+	if err != nil {
+		return nil, err
+	}
+	return apk.Search(query)
+}
+
+func (di *defaultBuildImplementation) PackageInfo(fsys apkfs.FullFS, o *options.Options, pkgName string) ([]apkimpl.PackageInfo, error) {
+	apk, err := chainguardAPK.NewWithOptions(fsys, *o)
+	if err != nil {
+		return nil, err
+	}
+	return apk.Info(pkgName)
+}
+
 func (di *defaultBuildImplementation) AdditionalTags(fsys apkfs.FullFS, o *options.Options) error {
 	at, err := chainguardAPK.AdditionalTags(fsys, *o)
 	if err != nil {
@@ -272,10 +398,21 @@ func buildImage(
 		return fmt.Errorf("installing apk packages: %w", err)
 	}
 
+	// the image has them all, but the working directory cannot
+	if cfs, ok := fsys.(apkfs.CaseCollisionFS); ok {
+		for _, c := range cfs.CaseCollisions() {
+			o.Logger().Warnf("%s collides with %s in the case-insensitive working directory, and is only kept in memory", c.Path, c.Existing)
+		}
+	}
+
 	if err := di.AdditionalTags(fsys, o); err != nil {
 		return fmt.Errorf("adding additional tags: %w", err)
 	}
 
+	if err := di.StripDocumentation(fsys, o, ic); err != nil {
+		return fmt.Errorf("failed to strip documentation: %w", err)
+	}
+
 	if err := di.MutateAccounts(fsys, o, ic); err != nil {
 		return fmt.Errorf("failed to mutate accounts: %w", err)
 	}
@@ -292,6 +429,10 @@ func buildImage(
 		}
 	}
 
+	if err := di.GenerateNSSwitch(fsys, o, ic); err != nil {
+		return fmt.Errorf("failed to generate /etc/nsswitch.conf: %w", err)
+	}
+
 	if err := di.WriteSupervisionTree(s6context, ic); err != nil {
 		return fmt.Errorf("failed to write supervision tree: %w", err)
 	}
@@ -311,6 +452,26 @@ func buildImage(
 		return err
 	}
 
+	// the commands of services may be busybox links, which are installed now
+	if err := s6context.CheckExecutables(ic.Entrypoint.Services, ic.Environment["PATH"]); err != nil {
+		return fmt.Errorf("failed to validate supervision tree: %w", err)
+	}
+
+	if err := di.GenerateEnvironment(fsys, o, ic); err != nil {
+		return fmt.Errorf("failed to generate environment: %w", err)
+	}
+
+	if err := reportUsage(fsys, o); err != nil {
+		return err
+	}
+
+	// keep what could not be set on disk, e.g. for a fakeroot database
+	if s, ok := fsys.(apkfs.SyncFS); ok {
+		if err := s.Sync(); err != nil {
+			return fmt.Errorf("failed to sync filesystem: %w", err)
+		}
+	}
+
 	o.Logger().Infof("finished building filesystem in %s", o.WorkDir)
 
 	return nil
@@ -339,7 +500,8 @@ func buildPackageList(
 }
 
 func newSBOM(fsys apkfs.FullFS, o *options.Options, ic *types.ImageConfiguration) *sbom.SBOM {
-	s := sbom.NewWithFS(fsys, o.Arch)
+	// the image is done by then, so generating the SBOM must not change it
+	s := sbom.NewWithFS(apkfs.ReadOnlyFS(fsys), o.Arch)
 	// Parse the image reference
 	if len(o.Tags) > 0 {
 		tag, err := name.NewTag(o.Tags[0])
@@ -0,0 +1,60 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/options"
+)
+
+func TestStreamTarball(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.WriteFile("big", make([]byte, 1<<20), 0o644))
+	di := &defaultBuildImplementation{}
+	o := options.Default
+
+	rc, err := di.StreamTarball(&o, fsys)
+	require.NoError(t, err)
+	tr := tar.NewReader(rc)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, "big", hdr.Name)
+	require.Equal(t, int64(1<<20), hdr.Size)
+	_, err = io.Copy(io.Discard, tr)
+	require.NoError(t, err)
+	_, err = tr.Next()
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, rc.Close())
+
+	// the writer is blocked on the pipe until the stream is closed early
+	rc, err = di.StreamTarball(&o, fsys)
+	require.NoError(t, err)
+	_, err = io.ReadFull(rc, make([]byte, 512))
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	select {
+	case <-rc.(*tarStream).done:
+	default:
+		t.Fatal("the tarball is still being written once the stream is closed")
+	}
+	_, err = rc.Read(make([]byte, 1))
+	require.Error(t, err)
+}
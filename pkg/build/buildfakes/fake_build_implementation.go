@@ -2,9 +2,11 @@
 package buildfakes
 
 import (
+	"io"
 	fsa "io/fs"
 	"sync"
 
+	"chainguard.dev/apko/pkg/apk/impl"
 	"chainguard.dev/apko/pkg/apk/impl/fs"
 	"chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/apko/pkg/exec"
@@ -58,6 +60,19 @@ type FakeBuildImplementation struct {
 		result1 string
 		result2 error
 	}
+	GenerateEnvironmentStub        func(fs.FullFS, *options.Options, *types.ImageConfiguration) error
+	generateEnvironmentMutex       sync.RWMutex
+	generateEnvironmentArgsForCall []struct {
+		arg1 fs.FullFS
+		arg2 *options.Options
+		arg3 *types.ImageConfiguration
+	}
+	generateEnvironmentReturns struct {
+		result1 error
+	}
+	generateEnvironmentReturnsOnCall map[int]struct {
+		result1 error
+	}
 	GenerateImageSBOMStub        func(*options.Options, *types.ImageConfiguration, oci.SignedImage) error
 	generateImageSBOMMutex       sync.RWMutex
 	generateImageSBOMArgsForCall []struct {
@@ -85,6 +100,19 @@ type FakeBuildImplementation struct {
 	generateIndexSBOMReturnsOnCall map[int]struct {
 		result1 error
 	}
+	GenerateNSSwitchStub        func(fs.FullFS, *options.Options, *types.ImageConfiguration) error
+	generateNSSwitchMutex       sync.RWMutex
+	generateNSSwitchArgsForCall []struct {
+		arg1 fs.FullFS
+		arg2 *options.Options
+		arg3 *types.ImageConfiguration
+	}
+	generateNSSwitchReturns struct {
+		result1 error
+	}
+	generateNSSwitchReturnsOnCall map[int]struct {
+		result1 error
+	}
 	GenerateOSReleaseStub        func(fs.FullFS, *options.Options, *types.ImageConfiguration) error
 	generateOSReleaseMutex       sync.RWMutex
 	generateOSReleaseArgsForCall []struct {
@@ -196,6 +224,21 @@ type FakeBuildImplementation struct {
 	mutatePathsReturnsOnCall map[int]struct {
 		result1 error
 	}
+	PackageInfoStub        func(fs.FullFS, *options.Options, string) ([]impl.PackageInfo, error)
+	packageInfoMutex       sync.RWMutex
+	packageInfoArgsForCall []struct {
+		arg1 fs.FullFS
+		arg2 *options.Options
+		arg3 string
+	}
+	packageInfoReturns struct {
+		result1 []impl.PackageInfo
+		result2 error
+	}
+	packageInfoReturnsOnCall map[int]struct {
+		result1 []impl.PackageInfo
+		result2 error
+	}
 	RefreshStub        func(*options.Options) (*s6.Context, *exec.Executor, error)
 	refreshMutex       sync.RWMutex
 	refreshArgsForCall []struct {
@@ -228,6 +271,48 @@ type FakeBuildImplementation struct {
 		result2 []string
 		result3 error
 	}
+	SearchPackagesStub        func(fs.FullFS, *options.Options, impl.SearchQuery) ([]*repository.RepositoryPackage, error)
+	searchPackagesMutex       sync.RWMutex
+	searchPackagesArgsForCall []struct {
+		arg1 fs.FullFS
+		arg2 *options.Options
+		arg3 impl.SearchQuery
+	}
+	searchPackagesReturns struct {
+		result1 []*repository.RepositoryPackage
+		result2 error
+	}
+	searchPackagesReturnsOnCall map[int]struct {
+		result1 []*repository.RepositoryPackage
+		result2 error
+	}
+	StreamTarballStub        func(*options.Options, fsa.FS) (io.ReadCloser, error)
+	streamTarballMutex       sync.RWMutex
+	streamTarballArgsForCall []struct {
+		arg1 *options.Options
+		arg2 fsa.FS
+	}
+	streamTarballReturns struct {
+		result1 io.ReadCloser
+		result2 error
+	}
+	streamTarballReturnsOnCall map[int]struct {
+		result1 io.ReadCloser
+		result2 error
+	}
+	StripDocumentationStub        func(fs.FullFS, *options.Options, *types.ImageConfiguration) error
+	stripDocumentationMutex       sync.RWMutex
+	stripDocumentationArgsForCall []struct {
+		arg1 fs.FullFS
+		arg2 *options.Options
+		arg3 *types.ImageConfiguration
+	}
+	stripDocumentationReturns struct {
+		result1 error
+	}
+	stripDocumentationReturnsOnCall map[int]struct {
+		result1 error
+	}
 	ValidateImageConfigurationStub        func(*types.ImageConfiguration) error
 	validateImageConfigurationMutex       sync.RWMutex
 	validateImageConfigurationArgsForCall []struct {
@@ -449,6 +534,69 @@ func (fake *FakeBuildImplementation) BuildTarballReturnsOnCall(i int, result1 st
 	}{result1, result2}
 }
 
+func (fake *FakeBuildImplementation) GenerateEnvironment(arg1 fs.FullFS, arg2 *options.Options, arg3 *types.ImageConfiguration) error {
+	fake.generateEnvironmentMutex.Lock()
+	ret, specificReturn := fake.generateEnvironmentReturnsOnCall[len(fake.generateEnvironmentArgsForCall)]
+	fake.generateEnvironmentArgsForCall = append(fake.generateEnvironmentArgsForCall, struct {
+		arg1 fs.FullFS
+		arg2 *options.Options
+		arg3 *types.ImageConfiguration
+	}{arg1, arg2, arg3})
+	stub := fake.GenerateEnvironmentStub
+	fakeReturns := fake.generateEnvironmentReturns
+	fake.recordInvocation("GenerateEnvironment", []interface{}{arg1, arg2, arg3})
+	fake.generateEnvironmentMutex.Unlock()
+	if stub != nil {
+		return stub(arg1, arg2, arg3)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeBuildImplementation) GenerateEnvironmentCallCount() int {
+	fake.generateEnvironmentMutex.RLock()
+	defer fake.generateEnvironmentMutex.RUnlock()
+	return len(fake.generateEnvironmentArgsForCall)
+}
+
+func (fake *FakeBuildImplementation) GenerateEnvironmentCalls(stub func(fs.FullFS, *options.Options, *types.ImageConfiguration) error) {
+	fake.generateEnvironmentMutex.Lock()
+	defer fake.generateEnvironmentMutex.Unlock()
+	fake.GenerateEnvironmentStub = stub
+}
+
+func (fake *FakeBuildImplementation) GenerateEnvironmentArgsForCall(i int) (fs.FullFS, *options.Options, *types.ImageConfiguration) {
+	fake.generateEnvironmentMutex.RLock()
+	defer fake.generateEnvironmentMutex.RUnlock()
+	argsForCall := fake.generateEnvironmentArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2, argsForCall.arg3
+}
+
+func (fake *FakeBuildImplementation) GenerateEnvironmentReturns(result1 error) {
+	fake.generateEnvironmentMutex.Lock()
+	defer fake.generateEnvironmentMutex.Unlock()
+	fake.GenerateEnvironmentStub = nil
+	fake.generateEnvironmentReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeBuildImplementation) GenerateEnvironmentReturnsOnCall(i int, result1 error) {
+	fake.generateEnvironmentMutex.Lock()
+	defer fake.generateEnvironmentMutex.Unlock()
+	fake.GenerateEnvironmentStub = nil
+	if fake.generateEnvironmentReturnsOnCall == nil {
+		fake.generateEnvironmentReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.generateEnvironmentReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeBuildImplementation) GenerateImageSBOM(arg1 *options.Options, arg2 *types.ImageConfiguration, arg3 oci.SignedImage) error {
 	fake.generateImageSBOMMutex.Lock()
 	ret, specificReturn := fake.generateImageSBOMReturnsOnCall[len(fake.generateImageSBOMArgsForCall)]
@@ -576,6 +724,69 @@ func (fake *FakeBuildImplementation) GenerateIndexSBOMReturnsOnCall(i int, resul
 	}{result1}
 }
 
+func (fake *FakeBuildImplementation) GenerateNSSwitch(arg1 fs.FullFS, arg2 *options.Options, arg3 *types.ImageConfiguration) error {
+	fake.generateNSSwitchMutex.Lock()
+	ret, specificReturn := fake.generateNSSwitchReturnsOnCall[len(fake.generateNSSwitchArgsForCall)]
+	fake.generateNSSwitchArgsForCall = append(fake.generateNSSwitchArgsForCall, struct {
+		arg1 fs.FullFS
+		arg2 *options.Options
+		arg3 *types.ImageConfiguration
+	}{arg1, arg2, arg3})
+	stub := fake.GenerateNSSwitchStub
+	fakeReturns := fake.generateNSSwitchReturns
+	fake.recordInvocation("GenerateNSSwitch", []interface{}{arg1, arg2, arg3})
+	fake.generateNSSwitchMutex.Unlock()
+	if stub != nil {
+		return stub(arg1, arg2, arg3)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeBuildImplementation) GenerateNSSwitchCallCount() int {
+	fake.generateNSSwitchMutex.RLock()
+	defer fake.generateNSSwitchMutex.RUnlock()
+	return len(fake.generateNSSwitchArgsForCall)
+}
+
+func (fake *FakeBuildImplementation) GenerateNSSwitchCalls(stub func(fs.FullFS, *options.Options, *types.ImageConfiguration) error) {
+	fake.generateNSSwitchMutex.Lock()
+	defer fake.generateNSSwitchMutex.Unlock()
+	fake.GenerateNSSwitchStub = stub
+}
+
+func (fake *FakeBuildImplementation) GenerateNSSwitchArgsForCall(i int) (fs.FullFS, *options.Options, *types.ImageConfiguration) {
+	fake.generateNSSwitchMutex.RLock()
+	defer fake.generateNSSwitchMutex.RUnlock()
+	argsForCall := fake.generateNSSwitchArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2, argsForCall.arg3
+}
+
+func (fake *FakeBuildImplementation) GenerateNSSwitchReturns(result1 error) {
+	fake.generateNSSwitchMutex.Lock()
+	defer fake.generateNSSwitchMutex.Unlock()
+	fake.GenerateNSSwitchStub = nil
+	fake.generateNSSwitchReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeBuildImplementation) GenerateNSSwitchReturnsOnCall(i int, result1 error) {
+	fake.generateNSSwitchMutex.Lock()
+	defer fake.generateNSSwitchMutex.Unlock()
+	fake.GenerateNSSwitchStub = nil
+	if fake.generateNSSwitchReturnsOnCall == nil {
+		fake.generateNSSwitchReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.generateNSSwitchReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeBuildImplementation) GenerateOSRelease(arg1 fs.FullFS, arg2 *options.Options, arg3 *types.ImageConfiguration) error {
 	fake.generateOSReleaseMutex.Lock()
 	ret, specificReturn := fake.generateOSReleaseReturnsOnCall[len(fake.generateOSReleaseArgsForCall)]
@@ -1137,6 +1348,72 @@ func (fake *FakeBuildImplementation) MutatePathsReturnsOnCall(i int, result1 err
 	}{result1}
 }
 
+func (fake *FakeBuildImplementation) PackageInfo(arg1 fs.FullFS, arg2 *options.Options, arg3 string) ([]impl.PackageInfo, error) {
+	fake.packageInfoMutex.Lock()
+	ret, specificReturn := fake.packageInfoReturnsOnCall[len(fake.packageInfoArgsForCall)]
+	fake.packageInfoArgsForCall = append(fake.packageInfoArgsForCall, struct {
+		arg1 fs.FullFS
+		arg2 *options.Options
+		arg3 string
+	}{arg1, arg2, arg3})
+	stub := fake.PackageInfoStub
+	fakeReturns := fake.packageInfoReturns
+	fake.recordInvocation("PackageInfo", []interface{}{arg1, arg2, arg3})
+	fake.packageInfoMutex.Unlock()
+	if stub != nil {
+		return stub(arg1, arg2, arg3)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fakeReturns.result1, fakeReturns.result2
+}
+
+func (fake *FakeBuildImplementation) PackageInfoCallCount() int {
+	fake.packageInfoMutex.RLock()
+	defer fake.packageInfoMutex.RUnlock()
+	return len(fake.packageInfoArgsForCall)
+}
+
+func (fake *FakeBuildImplementation) PackageInfoCalls(stub func(fs.FullFS, *options.Options, string) ([]impl.PackageInfo, error)) {
+	fake.packageInfoMutex.Lock()
+	defer fake.packageInfoMutex.Unlock()
+	fake.PackageInfoStub = stub
+}
+
+func (fake *FakeBuildImplementation) PackageInfoArgsForCall(i int) (fs.FullFS, *options.Options, string) {
+	fake.packageInfoMutex.RLock()
+	defer fake.packageInfoMutex.RUnlock()
+	argsForCall := fake.packageInfoArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2, argsForCall.arg3
+}
+
+func (fake *FakeBuildImplementation) PackageInfoReturns(result1 []impl.PackageInfo, result2 error) {
+	fake.packageInfoMutex.Lock()
+	defer fake.packageInfoMutex.Unlock()
+	fake.PackageInfoStub = nil
+	fake.packageInfoReturns = struct {
+		result1 []impl.PackageInfo
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeBuildImplementation) PackageInfoReturnsOnCall(i int, result1 []impl.PackageInfo, result2 error) {
+	fake.packageInfoMutex.Lock()
+	defer fake.packageInfoMutex.Unlock()
+	fake.PackageInfoStub = nil
+	if fake.packageInfoReturnsOnCall == nil {
+		fake.packageInfoReturnsOnCall = make(map[int]struct {
+			result1 []impl.PackageInfo
+			result2 error
+		})
+	}
+	fake.packageInfoReturnsOnCall[i] = struct {
+		result1 []impl.PackageInfo
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeBuildImplementation) Refresh(arg1 *options.Options) (*s6.Context, *exec.Executor, error) {
 	fake.refreshMutex.Lock()
 	ret, specificReturn := fake.refreshReturnsOnCall[len(fake.refreshArgsForCall)]
@@ -1273,6 +1550,200 @@ func (fake *FakeBuildImplementation) ResolvePackagesReturnsOnCall(i int, result1
 	}{result1, result2, result3}
 }
 
+func (fake *FakeBuildImplementation) SearchPackages(arg1 fs.FullFS, arg2 *options.Options, arg3 impl.SearchQuery) ([]*repository.RepositoryPackage, error) {
+	fake.searchPackagesMutex.Lock()
+	ret, specificReturn := fake.searchPackagesReturnsOnCall[len(fake.searchPackagesArgsForCall)]
+	fake.searchPackagesArgsForCall = append(fake.searchPackagesArgsForCall, struct {
+		arg1 fs.FullFS
+		arg2 *options.Options
+		arg3 impl.SearchQuery
+	}{arg1, arg2, arg3})
+	stub := fake.SearchPackagesStub
+	fakeReturns := fake.searchPackagesReturns
+	fake.recordInvocation("SearchPackages", []interface{}{arg1, arg2, arg3})
+	fake.searchPackagesMutex.Unlock()
+	if stub != nil {
+		return stub(arg1, arg2, arg3)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fakeReturns.result1, fakeReturns.result2
+}
+
+func (fake *FakeBuildImplementation) SearchPackagesCallCount() int {
+	fake.searchPackagesMutex.RLock()
+	defer fake.searchPackagesMutex.RUnlock()
+	return len(fake.searchPackagesArgsForCall)
+}
+
+func (fake *FakeBuildImplementation) SearchPackagesCalls(stub func(fs.FullFS, *options.Options, impl.SearchQuery) ([]*repository.RepositoryPackage, error)) {
+	fake.searchPackagesMutex.Lock()
+	defer fake.searchPackagesMutex.Unlock()
+	fake.SearchPackagesStub = stub
+}
+
+func (fake *FakeBuildImplementation) SearchPackagesArgsForCall(i int) (fs.FullFS, *options.Options, impl.SearchQuery) {
+	fake.searchPackagesMutex.RLock()
+	defer fake.searchPackagesMutex.RUnlock()
+	argsForCall := fake.searchPackagesArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2, argsForCall.arg3
+}
+
+func (fake *FakeBuildImplementation) SearchPackagesReturns(result1 []*repository.RepositoryPackage, result2 error) {
+	fake.searchPackagesMutex.Lock()
+	defer fake.searchPackagesMutex.Unlock()
+	fake.SearchPackagesStub = nil
+	fake.searchPackagesReturns = struct {
+		result1 []*repository.RepositoryPackage
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeBuildImplementation) SearchPackagesReturnsOnCall(i int, result1 []*repository.RepositoryPackage, result2 error) {
+	fake.searchPackagesMutex.Lock()
+	defer fake.searchPackagesMutex.Unlock()
+	fake.SearchPackagesStub = nil
+	if fake.searchPackagesReturnsOnCall == nil {
+		fake.searchPackagesReturnsOnCall = make(map[int]struct {
+			result1 []*repository.RepositoryPackage
+			result2 error
+		})
+	}
+	fake.searchPackagesReturnsOnCall[i] = struct {
+		result1 []*repository.RepositoryPackage
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeBuildImplementation) StreamTarball(arg1 *options.Options, arg2 fsa.FS) (io.ReadCloser, error) {
+	fake.streamTarballMutex.Lock()
+	ret, specificReturn := fake.streamTarballReturnsOnCall[len(fake.streamTarballArgsForCall)]
+	fake.streamTarballArgsForCall = append(fake.streamTarballArgsForCall, struct {
+		arg1 *options.Options
+		arg2 fsa.FS
+	}{arg1, arg2})
+	stub := fake.StreamTarballStub
+	fakeReturns := fake.streamTarballReturns
+	fake.recordInvocation("StreamTarball", []interface{}{arg1, arg2})
+	fake.streamTarballMutex.Unlock()
+	if stub != nil {
+		return stub(arg1, arg2)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fakeReturns.result1, fakeReturns.result2
+}
+
+func (fake *FakeBuildImplementation) StreamTarballCallCount() int {
+	fake.streamTarballMutex.RLock()
+	defer fake.streamTarballMutex.RUnlock()
+	return len(fake.streamTarballArgsForCall)
+}
+
+func (fake *FakeBuildImplementation) StreamTarballCalls(stub func(*options.Options, fsa.FS) (io.ReadCloser, error)) {
+	fake.streamTarballMutex.Lock()
+	defer fake.streamTarballMutex.Unlock()
+	fake.StreamTarballStub = stub
+}
+
+func (fake *FakeBuildImplementation) StreamTarballArgsForCall(i int) (*options.Options, fsa.FS) {
+	fake.streamTarballMutex.RLock()
+	defer fake.streamTarballMutex.RUnlock()
+	argsForCall := fake.streamTarballArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *FakeBuildImplementation) StreamTarballReturns(result1 io.ReadCloser, result2 error) {
+	fake.streamTarballMutex.Lock()
+	defer fake.streamTarballMutex.Unlock()
+	fake.StreamTarballStub = nil
+	fake.streamTarballReturns = struct {
+		result1 io.ReadCloser
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeBuildImplementation) StreamTarballReturnsOnCall(i int, result1 io.ReadCloser, result2 error) {
+	fake.streamTarballMutex.Lock()
+	defer fake.streamTarballMutex.Unlock()
+	fake.StreamTarballStub = nil
+	if fake.streamTarballReturnsOnCall == nil {
+		fake.streamTarballReturnsOnCall = make(map[int]struct {
+			result1 io.ReadCloser
+			result2 error
+		})
+	}
+	fake.streamTarballReturnsOnCall[i] = struct {
+		result1 io.ReadCloser
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeBuildImplementation) StripDocumentation(arg1 fs.FullFS, arg2 *options.Options, arg3 *types.ImageConfiguration) error {
+	fake.stripDocumentationMutex.Lock()
+	ret, specificReturn := fake.stripDocumentationReturnsOnCall[len(fake.stripDocumentationArgsForCall)]
+	fake.stripDocumentationArgsForCall = append(fake.stripDocumentationArgsForCall, struct {
+		arg1 fs.FullFS
+		arg2 *options.Options
+		arg3 *types.ImageConfiguration
+	}{arg1, arg2, arg3})
+	stub := fake.StripDocumentationStub
+	fakeReturns := fake.stripDocumentationReturns
+	fake.recordInvocation("StripDocumentation", []interface{}{arg1, arg2, arg3})
+	fake.stripDocumentationMutex.Unlock()
+	if stub != nil {
+		return stub(arg1, arg2, arg3)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeBuildImplementation) StripDocumentationCallCount() int {
+	fake.stripDocumentationMutex.RLock()
+	defer fake.stripDocumentationMutex.RUnlock()
+	return len(fake.stripDocumentationArgsForCall)
+}
+
+func (fake *FakeBuildImplementation) StripDocumentationCalls(stub func(fs.FullFS, *options.Options, *types.ImageConfiguration) error) {
+	fake.stripDocumentationMutex.Lock()
+	defer fake.stripDocumentationMutex.Unlock()
+	fake.StripDocumentationStub = stub
+}
+
+func (fake *FakeBuildImplementation) StripDocumentationArgsForCall(i int) (fs.FullFS, *options.Options, *types.ImageConfiguration) {
+	fake.stripDocumentationMutex.RLock()
+	defer fake.stripDocumentationMutex.RUnlock()
+	argsForCall := fake.stripDocumentationArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2, argsForCall.arg3
+}
+
+func (fake *FakeBuildImplementation) StripDocumentationReturns(result1 error) {
+	fake.stripDocumentationMutex.Lock()
+	defer fake.stripDocumentationMutex.Unlock()
+	fake.StripDocumentationStub = nil
+	fake.stripDocumentationReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeBuildImplementation) StripDocumentationReturnsOnCall(i int, result1 error) {
+	fake.stripDocumentationMutex.Lock()
+	defer fake.stripDocumentationMutex.Unlock()
+	fake.StripDocumentationStub = nil
+	if fake.stripDocumentationReturnsOnCall == nil {
+		fake.stripDocumentationReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.stripDocumentationReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeBuildImplementation) ValidateImageConfiguration(arg1 *types.ImageConfiguration) error {
 	fake.validateImageConfigurationMutex.Lock()
 	ret, specificReturn := fake.validateImageConfigurationReturnsOnCall[len(fake.validateImageConfigurationArgsForCall)]
@@ -1405,10 +1876,14 @@ func (fake *FakeBuildImplementation) Invocations() map[string][][]interface{} {
 	defer fake.buildImageMutex.RUnlock()
 	fake.buildTarballMutex.RLock()
 	defer fake.buildTarballMutex.RUnlock()
+	fake.generateEnvironmentMutex.RLock()
+	defer fake.generateEnvironmentMutex.RUnlock()
 	fake.generateImageSBOMMutex.RLock()
 	defer fake.generateImageSBOMMutex.RUnlock()
 	fake.generateIndexSBOMMutex.RLock()
 	defer fake.generateIndexSBOMMutex.RUnlock()
+	fake.generateNSSwitchMutex.RLock()
+	defer fake.generateNSSwitchMutex.RUnlock()
 	fake.generateOSReleaseMutex.RLock()
 	defer fake.generateOSReleaseMutex.RUnlock()
 	fake.generateSBOMMutex.RLock()
@@ -1427,10 +1902,18 @@ func (fake *FakeBuildImplementation) Invocations() map[string][][]interface{} {
 	defer fake.mutateAccountsMutex.RUnlock()
 	fake.mutatePathsMutex.RLock()
 	defer fake.mutatePathsMutex.RUnlock()
+	fake.packageInfoMutex.RLock()
+	defer fake.packageInfoMutex.RUnlock()
 	fake.refreshMutex.RLock()
 	defer fake.refreshMutex.RUnlock()
 	fake.resolvePackagesMutex.RLock()
 	defer fake.resolvePackagesMutex.RUnlock()
+	fake.searchPackagesMutex.RLock()
+	defer fake.searchPackagesMutex.RUnlock()
+	fake.streamTarballMutex.RLock()
+	defer fake.streamTarballMutex.RUnlock()
+	fake.stripDocumentationMutex.RLock()
+	defer fake.stripDocumentationMutex.RUnlock()
 	fake.validateImageConfigurationMutex.RLock()
 	defer fake.validateImageConfigurationMutex.RUnlock()
 	fake.writeSupervisionTreeMutex.RLock()
@@ -0,0 +1,161 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+)
+
+// mutateCopy copies the file or directory at the source, on the host, to the
+// path, owned by the uid and gid of the mutation. The copies have the source
+// date epoch as their modification time, rather than the time of the copy.
+func mutateCopy(fsys apkfs.FullFS, o *options.Options, mut types.PathMutation) error {
+	if err := ensureParentDirectory(fsys, mut); err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(mut.Source, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(mut.Source, name)
+		if err != nil {
+			return err
+		}
+		target := mut.Path
+		if rel != "." {
+			target = path.Join(mut.Path, filepath.ToSlash(rel))
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := fi.Mode().Perm()
+		if rel == "." && mut.Permissions != 0 {
+			mode = fs.FileMode(mut.Permissions)
+		}
+
+		switch {
+		case d.IsDir():
+			if err := fsys.MkdirAll(target, mode); err != nil {
+				return err
+			}
+			if err := fsys.Chmod(target, mode); err != nil {
+				return err
+			}
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			if _, err := fsys.Lstat(target); err == nil {
+				if err := fsys.Remove(target); err != nil {
+					return fmt.Errorf("unable to remove old link: %w", err)
+				}
+			}
+			if err := fsys.Symlink(link, target); err != nil {
+				return err
+			}
+		case d.Type().IsRegular():
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			if err := fsys.WriteFile(target, data, mode); err != nil {
+				return err
+			}
+			// the file may have been there with other permissions
+			if err := fsys.Chmod(target, mode); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unable to copy %s, which is not a directory, file or symlink", name)
+		}
+
+		if err := fsys.Lchown(target, int(mut.UID), int(mut.GID)); err != nil {
+			return err
+		}
+		if !o.SourceDateEpoch.IsZero() {
+			if err := fsys.SetModTime(target, o.SourceDateEpoch); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// copySourcesDigest returns the digest of the names, modes and contents of
+// the files the paths copy into the image, and of the archives they extract,
+// which the layers depend on as much as on the configuration. The archives
+// downloaded are known by their checksums.
+func copySourcesDigest(ic *types.ImageConfiguration) (string, error) {
+	h := sha256.New()
+	for _, mut := range ic.Paths {
+		if mut.Type == types.PathArchive {
+			if types.IsArchiveURL(mut.Source) {
+				fmt.Fprintf(h, "%s %s\n", mut.Source, mut.Checksum)
+				continue
+			}
+		} else if mut.Type != types.PathCopy {
+			continue
+		}
+		fmt.Fprintf(h, "%s\n", mut.Source)
+		if err := filepath.WalkDir(mut.Source, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s %o", name, fi.Mode())
+			switch {
+			case d.Type()&fs.ModeSymlink != 0:
+				link, err := os.Readlink(name)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(h, " -> %s", link)
+			case d.Type().IsRegular():
+				f, err := os.Open(name)
+				if err != nil {
+					return err
+				}
+				fh := sha256.New()
+				_, err = io.Copy(fh, f)
+				f.Close()
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(h, " %x", fh.Sum(nil))
+			}
+			fmt.Fprintln(h)
+			return nil
+		}); err != nil {
+			return "", fmt.Errorf("reading the files copied to %s: %w", mut.Path, err)
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
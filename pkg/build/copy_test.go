@@ -0,0 +1,75 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+)
+
+func TestMutateCopy(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "conf.d"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "app.conf"), []byte("listen 8080\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "conf.d", "run.sh"), []byte("#!/bin/sh\n"), 0o755))
+	require.NoError(t, os.Symlink("app.conf", filepath.Join(src, "default.conf")))
+
+	o := options.Default
+	o.SourceDateEpoch = time.Unix(1700000000, 0)
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, mutateCopy(fsys, &o, types.PathMutation{
+		Path:        "etc/app",
+		Type:        types.PathCopy,
+		Source:      src,
+		UID:         1000,
+		GID:         1000,
+		Permissions: 0o750,
+	}))
+
+	fi, err := fsys.Stat("etc/app")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	require.Equal(t, os.FileMode(0o750), fi.Mode().Perm())
+
+	data, err := fsys.ReadFile("etc/app/app.conf")
+	require.NoError(t, err)
+	require.Equal(t, "listen 8080\n", string(data))
+
+	fi, err = fsys.Stat("etc/app/conf.d/run.sh")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+	require.True(t, fi.ModTime().Equal(o.SourceDateEpoch))
+
+	link, err := fsys.Readlink("etc/app/default.conf")
+	require.NoError(t, err)
+	require.Equal(t, "app.conf", link)
+
+	// the layers are built again when a copied file changes
+	ic := &types.ImageConfiguration{Paths: []types.PathMutation{{Path: "etc/app", Type: types.PathCopy, Source: src}}}
+	before, err := copySourcesDigest(ic)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(src, "app.conf"), []byte("listen 8081\n"), 0o644))
+	after, err := copySourcesDigest(ic)
+	require.NoError(t, err)
+	require.NotEqual(t, before, after)
+}
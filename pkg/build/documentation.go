@@ -0,0 +1,155 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+)
+
+// manPageDirs are the directories packages install man pages into.
+var manPageDirs = []string{
+	"usr/share/man", "usr/man", "usr/local/share/man", "usr/local/man",
+}
+
+// completionDirs are the directories packages install shell completions
+// into.
+var completionDirs = []string{
+	"usr/share/bash-completion", "etc/bash_completion.d",
+	"usr/share/zsh/site-functions", "usr/share/zsh/vendor-completions",
+	"usr/share/fish/completions", "usr/share/fish/vendor_completions.d",
+}
+
+// StripDocumentation removes the man pages and shell completions from the
+// image, if the configuration asks for it, and reports how much space they
+// take either way.
+func (di *defaultBuildImplementation) StripDocumentation(
+	fsys apkfs.FullFS, o *options.Options, ic *types.ImageConfiguration,
+) error {
+	for _, doc := range []struct {
+		what string
+		mode string
+		dirs []string
+	}{
+		{"man pages", ic.Documentation.ManPages, manPageDirs},
+		{"shell completions", ic.Documentation.Completions, completionDirs},
+	} {
+		if doc.mode == "" {
+			continue
+		}
+
+		files, size, err := documentationUsage(fsys, doc.dirs)
+		if err != nil {
+			return fmt.Errorf("measuring %s: %w", doc.what, err)
+		}
+
+		switch doc.mode {
+		case types.DocumentationKeep:
+			o.Logger().Infof("keeping %s: %d files, %s", doc.what, files, formatSize(size))
+			continue
+		case types.DocumentationStrip:
+			o.Logger().Infof("stripping %s: %d files, %s saved", doc.what, files, formatSize(size))
+		case types.DocumentationRelocate:
+			o.Logger().Infof("relocating %s to the %s variant: %d files, %s saved", doc.what, types.DevVariant, files, formatSize(size))
+		default:
+			return fmt.Errorf("unknown documentation mode %q for %s", doc.mode, doc.what)
+		}
+
+		for _, dir := range doc.dirs {
+			if err := removeTree(fsys, dir); err != nil {
+				return fmt.Errorf("removing %s: %w", dir, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// documentationUsage counts the files in the given directories, and the
+// bytes the regular ones take. Missing directories are skipped.
+func documentationUsage(fsys fs.FS, dirs []string) (int, int64, error) {
+	var (
+		files int
+		size  int64
+	)
+	for _, dir := range dirs {
+		err := fs.WalkDir(fsys, dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files++
+			if info.Mode().IsRegular() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return 0, 0, err
+		}
+	}
+	return files, size, nil
+}
+
+// removeTree removes a directory and everything under it, if it exists.
+func removeTree(fsys apkfs.FullFS, dir string) error {
+	var paths []string
+	err := fs.WalkDir(fsys, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, p)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// children are walked after their parent, so remove them first
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := fsys.Remove(paths[i]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatSize formats a number of bytes for humans.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
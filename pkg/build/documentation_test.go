@@ -0,0 +1,64 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+)
+
+func TestStripDocumentation(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("usr/share/man/man1", 0o755))
+	require.NoError(t, fsys.WriteFile("usr/share/man/man1/git.1.gz", make([]byte, 2048), 0o644))
+	require.NoError(t, fsys.Symlink("git.1.gz", "usr/share/man/man1/git-scm.1.gz"))
+	require.NoError(t, fsys.MkdirAll("usr/share/bash-completion/completions", 0o755))
+	require.NoError(t, fsys.WriteFile("usr/share/bash-completion/completions/git", []byte("complete"), 0o644))
+	require.NoError(t, fsys.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, fsys.WriteFile("usr/bin/git", []byte("git"), 0o755))
+
+	files, size, err := documentationUsage(fsys, manPageDirs)
+	require.NoError(t, err)
+	require.Equal(t, 2, files)
+	require.Equal(t, int64(2048), size)
+
+	di := &defaultBuildImplementation{}
+	o := options.Default
+	ic := types.ImageConfiguration{
+		Documentation: types.Documentation{
+			ManPages:    types.DocumentationRelocate,
+			Completions: types.DocumentationKeep,
+		},
+	}
+	require.NoError(t, di.StripDocumentation(fsys, &o, &ic))
+
+	_, err = fsys.Stat("usr/share/man")
+	require.Error(t, err)
+	_, err = fsys.Stat("usr/share/bash-completion/completions/git")
+	require.NoError(t, err)
+	_, err = fsys.Stat("usr/bin/git")
+	require.NoError(t, err)
+}
+
+func TestFormatSize(t *testing.T) {
+	require.Equal(t, "512 B", formatSize(512))
+	require.Equal(t, "1.5 KiB", formatSize(1536))
+	require.Equal(t, "3.0 MiB", formatSize(3<<20))
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+)
+
+// pathSearchSkip are the trees which are not searched for executables, as
+// the bin directories found there are data, tests or not part of the image.
+var pathSearchSkip = []string{
+	"dev", "etc", "home", "proc", "root", "run", "sys", "tmp", "var",
+	"usr/include", "usr/share", "usr/src",
+}
+
+// maxPathSearchDepth is how deep the filesystem is searched for executables.
+const maxPathSearchDepth = 6
+
+// GenerateEnvironment derives the PATH of the image from the directories the
+// installed packages put executables into, if the configuration asks for it,
+// and applies the configured PATH additions.
+// A PATH set in the environment is always used as is.
+func (di *defaultBuildImplementation) GenerateEnvironment(
+	fsys apkfs.FullFS, o *options.Options, ic *types.ImageConfiguration,
+) error {
+	ps := ic.PathSynthesis
+	if !ps.Enabled && len(ps.Prepend) == 0 && len(ps.Append) == 0 {
+		return nil
+	}
+	if _, ok := ic.Environment["PATH"]; ok {
+		o.Logger().Warnf("PATH is set in the environment, not synthesizing it")
+		return nil
+	}
+
+	env := map[string]string{}
+	if len(ic.Environment) == 0 {
+		// keep what an image without environment would have had
+		for k, v := range types.DefaultEnvironment {
+			env[k] = v
+		}
+	}
+	for k, v := range ic.Environment {
+		env[k] = v
+	}
+
+	dirs := append([]string{}, types.DefaultPath...)
+	if ps.Enabled {
+		found, err := findExecutableDirs(fsys)
+		if err != nil {
+			return fmt.Errorf("searching for executables: %w", err)
+		}
+		dirs = append(dirs, found...)
+
+		if _, ok := env["SSL_CERT_FILE"]; !ok {
+			if _, err := fsys.Stat(strings.TrimPrefix(types.DefaultSSLCertFile, "/")); err == nil {
+				env["SSL_CERT_FILE"] = types.DefaultSSLCertFile
+			}
+		}
+	}
+	dirs = append(append(append([]string{}, ps.Prepend...), dirs...), ps.Append...)
+	env["PATH"] = strings.Join(filterPath(dirs, ps.Exclude), ":")
+
+	o.Logger().Infof("using PATH %s", env["PATH"])
+	ic.Environment = env
+
+	return nil
+}
+
+// findExecutableDirs returns the bin and sbin directories, as well as the
+// directories under /usr/libexec, which hold executables. Directories on
+// the default PATH are left out.
+func findExecutableDirs(fsys fs.FS) ([]string, error) {
+	dirs := map[string]bool{}
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrPermission) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			for _, skip := range pathSearchSkip {
+				if p == skip {
+					return fs.SkipDir
+				}
+			}
+			if strings.Count(p, "/") >= maxPathSearchDepth {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		dir := path.Dir(p)
+		if dirs[dir] || !isExecutableDir(dir) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// symlinks are kept, as most of them point to executables
+		if info.Mode()&fs.ModeSymlink != 0 || (info.Mode().IsRegular() && info.Mode().Perm()&0o111 != 0) {
+			dirs[dir] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		found = append(found, "/"+dir)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		// bin directories come before libexec ones
+		li, lj := strings.HasPrefix(found[i], "/usr/libexec/"), strings.HasPrefix(found[j], "/usr/libexec/")
+		if li != lj {
+			return lj
+		}
+		return found[i] < found[j]
+	})
+	return filterPath(found, types.DefaultPath), nil
+}
+
+func isExecutableDir(dir string) bool {
+	if strings.HasPrefix(dir, "usr/libexec/") && strings.Count(dir, "/") == 2 {
+		return true
+	}
+	base := path.Base(dir)
+	return base == "bin" || base == "sbin"
+}
+
+// filterPath removes the excluded and duplicate directories from dirs,
+// keeping the first occurrence of each.
+func filterPath(dirs, exclude []string) []string {
+	seen := map[string]bool{}
+	for _, dir := range exclude {
+		seen[path.Clean(dir)] = true
+	}
+	filtered := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		clean := path.Clean(dir)
+		if seen[clean] {
+			continue
+		}
+		seen[clean] = true
+		filtered = append(filtered, clean)
+	}
+	return filtered
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+)
+
+func TestFindExecutableDirs(t *testing.T) {
+	fsys := fstest.MapFS{
+		"usr/bin/busybox":                          {Mode: 0o755},
+		"usr/lib/jvm/java-17-openjdk/bin/java":     {Mode: 0o755},
+		"usr/lib/go/bin/go":                        {Mode: 0o755},
+		"usr/lib/go/pkg/tool/linux_amd64/bin/tool": {Mode: 0o755}, // too deep
+		"usr/libexec/git-core/git-upload-pack":     {Mode: 0o755},
+		"usr/libexec/helper":                       {Mode: 0o755},
+		"usr/share/doc/example/bin/demo":           {Mode: 0o755},
+		"opt/app/bin/README":                       {Mode: 0o644},
+		"opt/app/sbin/appd":                        {Mode: 0o700},
+	}
+
+	dirs, err := findExecutableDirs(fsys)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"/opt/app/sbin",
+		"/usr/lib/go/bin",
+		"/usr/lib/jvm/java-17-openjdk/bin",
+		"/usr/libexec/git-core",
+	}, dirs)
+}
+
+func TestGenerateEnvironment(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("usr/lib/jvm/java-17-openjdk/bin", 0o755))
+	require.NoError(t, fsys.WriteFile("usr/lib/jvm/java-17-openjdk/bin/java", []byte("java"), 0o755))
+	require.NoError(t, fsys.MkdirAll("etc/ssl/certs", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/ssl/certs/ca-certificates.crt", []byte("certs"), 0o644))
+
+	di := &defaultBuildImplementation{}
+	o := options.Default
+
+	t.Run("disabled", func(t *testing.T) {
+		ic := types.ImageConfiguration{}
+		require.NoError(t, di.GenerateEnvironment(fsys, &o, &ic))
+		require.Nil(t, ic.Environment)
+	})
+	t.Run("enabled", func(t *testing.T) {
+		ic := types.ImageConfiguration{
+			Environment: map[string]string{"JAVA_HOME": "/usr/lib/jvm/java-17-openjdk"},
+			PathSynthesis: types.PathSynthesis{
+				Enabled: true,
+				Prepend: []string{"/opt/app/bin"},
+				Exclude: []string{"/sbin"},
+			},
+		}
+		require.NoError(t, di.GenerateEnvironment(fsys, &o, &ic))
+		require.Equal(t, map[string]string{
+			"JAVA_HOME":     "/usr/lib/jvm/java-17-openjdk",
+			"PATH":          "/opt/app/bin:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/bin:/usr/lib/jvm/java-17-openjdk/bin",
+			"SSL_CERT_FILE": "/etc/ssl/certs/ca-certificates.crt",
+		}, ic.Environment)
+	})
+	t.Run("explicit PATH", func(t *testing.T) {
+		ic := types.ImageConfiguration{
+			Environment:   map[string]string{"PATH": "/bin"},
+			PathSynthesis: types.PathSynthesis{Enabled: true},
+		}
+		require.NoError(t, di.GenerateEnvironment(fsys, &o, &ic))
+		require.Equal(t, map[string]string{"PATH": "/bin"}, ic.Environment)
+	})
+}
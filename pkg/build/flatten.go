@@ -0,0 +1,151 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"golang.org/x/sys/unix"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+// ExtractImage lays out the filesystem of img, with all of its layers squashed
+// and whiteouts applied, in the working directory of the build context. The
+// result can then be turned into a single layer with ImageLayoutToLayer.
+func (bc *Context) ExtractImage(img v1.Image) error {
+	rc := mutate.Extract(img)
+	defer rc.Close()
+
+	if err := extractTar(bc.fs, rc); err != nil {
+		return fmt.Errorf("extracting image filesystem: %w", err)
+	}
+	return nil
+}
+
+// extractTar writes the contents of an uncompressed tar stream into fsys,
+// keeping modes and ownership.
+func extractTar(fsys apkfs.FullFS, r io.Reader) error {
+	// hardlinks may come before their target, so they are created last,
+	// and directories only get their final permissions once filled in
+	var links, dirs []*tar.Header
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(strings.TrimPrefix(header.Name, "/"))
+		if name == "." {
+			continue
+		}
+		if !fs.ValidPath(name) {
+			return fmt.Errorf("invalid path in image: %s", header.Name)
+		}
+		header.Name = name
+		perm := fs.FileMode(header.Mode) & fs.ModePerm
+
+		if err := fsys.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return fmt.Errorf("creating parent of %s: %w", name, err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := fsys.MkdirAll(name, 0o755); err != nil {
+				return fmt.Errorf("creating directory %s: %w", name, err)
+			}
+			dirs = append(dirs, header)
+			continue
+		case tar.TypeReg:
+			f, err := fsys.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+			if err != nil {
+				return fmt.Errorf("creating file %s: %w", name, err)
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return fmt.Errorf("writing file %s: %w", name, err)
+			}
+			if err := f.Close(); err != nil {
+				return fmt.Errorf("closing file %s: %w", name, err)
+			}
+		case tar.TypeSymlink:
+			if err := fsys.Symlink(header.Linkname, name); err != nil {
+				return fmt.Errorf("creating symlink %s: %w", name, err)
+			}
+			if err := fsys.Lchown(name, header.Uid, header.Gid); err != nil {
+				return fmt.Errorf("setting ownership of %s: %w", name, err)
+			}
+			continue
+		case tar.TypeLink:
+			links = append(links, header)
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			var mode uint32
+			switch header.Typeflag {
+			case tar.TypeChar:
+				mode = unix.S_IFCHR
+			case tar.TypeBlock:
+				mode = unix.S_IFBLK
+			default:
+				mode = unix.S_IFIFO
+			}
+			dev := int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))
+			if err := fsys.Mknod(name, mode|uint32(perm), dev); err != nil {
+				return fmt.Errorf("creating device %s: %w", name, err)
+			}
+		default:
+			return fmt.Errorf("unsupported file type %v for %s", header.Typeflag, name)
+		}
+
+		if err := fsys.Chmod(name, perm); err != nil {
+			return fmt.Errorf("setting permissions of %s: %w", name, err)
+		}
+		if err := fsys.Chown(name, header.Uid, header.Gid); err != nil {
+			return fmt.Errorf("setting ownership of %s: %w", name, err)
+		}
+	}
+
+	for _, header := range links {
+		target := filepath.Clean(strings.TrimPrefix(header.Linkname, "/"))
+		if err := fsys.Link(target, header.Name); err != nil {
+			return fmt.Errorf("creating hardlink %s: %w", header.Name, err)
+		}
+	}
+
+	for _, header := range dirs {
+		if err := fsys.Chmod(header.Name, fs.FileMode(header.Mode)&fs.ModePerm); err != nil {
+			return fmt.Errorf("setting permissions of %s: %w", header.Name, err)
+		}
+		if err := fsys.Chown(header.Name, header.Uid, header.Gid); err != nil {
+			return fmt.Errorf("setting ownership of %s: %w", header.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+func TestExtractTar(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range []struct {
+		hdr  tar.Header
+		data string
+	}{
+		// hardlink before its target, as in a squashed stream
+		{hdr: tar.Header{Name: "usr/bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}},
+		{hdr: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o555}},
+		{hdr: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0o4755, Uid: 0, Gid: 0}, data: "#!busybox"},
+		{hdr: tar.Header{Name: "home/nonroot/.profile", Typeflag: tar.TypeReg, Mode: 0o600, Uid: 65532, Gid: 65532}, data: "export A=1"},
+		{hdr: tar.Header{Name: "bin/ash", Typeflag: tar.TypeSymlink, Linkname: "busybox"}},
+	} {
+		entry.hdr.Size = int64(len(entry.data))
+		require.NoError(t, tw.WriteHeader(&entry.hdr))
+		_, err := tw.Write([]byte(entry.data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, extractTar(fsys, &buf))
+
+	data, err := fsys.ReadFile("usr/bin/sh")
+	require.NoError(t, err)
+	require.Equal(t, "#!busybox", string(data))
+
+	target, err := fsys.Readlink("bin/ash")
+	require.NoError(t, err)
+	require.Equal(t, "busybox", target)
+
+	fi, err := fsys.Stat("bin")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	require.Equal(t, fs.FileMode(0o555), fi.Mode().Perm())
+
+	fi, err = fsys.Stat("home/nonroot/.profile")
+	require.NoError(t, err)
+	require.Equal(t, fs.FileMode(0o600), fi.Mode().Perm())
+	hdr, ok := fi.Sys().(*tar.Header)
+	require.True(t, ok)
+	require.Equal(t, 65532, hdr.Uid)
+	require.Equal(t, 65532, hdr.Gid)
+}
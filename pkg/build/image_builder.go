@@ -31,6 +31,15 @@ func (di *defaultBuildImplementation) ValidateImageConfiguration(ic *types.Image
 func (di *defaultBuildImplementation) WriteSupervisionTree(
 	s6context *s6.Context, imageConfig *types.ImageConfiguration,
 ) error {
+	s6context.SetScanDirectory(imageConfig.Entrypoint.ScanDirectory)
+
+	if imageConfig.Entrypoint.Supervisor == "s6-rc" {
+		if err := s6context.WriteServiceDatabase(imageConfig.Entrypoint.Services, imageConfig.Entrypoint.Bundles); err != nil {
+			return fmt.Errorf("failed to write s6-rc database: %w", err)
+		}
+		return nil
+	}
+
 	// write service supervision tree
 	if err := s6context.WriteSupervisionTree(imageConfig.Entrypoint.Services); err != nil {
 		return fmt.Errorf("failed to write supervision tree: %w", err)
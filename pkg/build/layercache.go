@@ -0,0 +1,224 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+// layerCacheVersion changes whenever the same inputs build different layers,
+// so that the layers of older versions are not reused.
+const layerCacheVersion = "1"
+
+// LayersKey returns the key of the layers of the image in the layer cache: the
+// digest of the image configuration and of the options changing the layers,
+// along with the packages it resolves to, by version and checksum, the keys
+// their repositories are signed with, the files copied into the image and the
+// base image it is built on.
+func (bc *Context) LayersKey() (string, error) {
+	toInstall, _, err := bc.BuildPackageList()
+	if err != nil {
+		return "", fmt.Errorf("resolving packages: %w", err)
+	}
+	pkgs := make([]string, 0, len(toInstall))
+	for _, pkg := range toInstall {
+		pkgs = append(pkgs, fmt.Sprintf("%s-%s %x", pkg.Name, pkg.Version, pkg.Checksum))
+	}
+
+	// the keyring is fetched by then
+	keys := map[string]string{}
+	entries, err := bc.fs.ReadDir("etc/apk/keys")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("reading the keyring: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		data, err := bc.fs.ReadFile(path.Join("etc/apk/keys", e.Name()))
+		if err != nil {
+			return "", fmt.Errorf("reading key %s: %w", e.Name(), err)
+		}
+		keys[e.Name()] = fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+
+	copied, err := copySourcesDigest(&bc.ImageConfiguration)
+	if err != nil {
+		return "", err
+	}
+
+	var base string
+	if bc.base != nil {
+		digest, err := bc.base.Digest()
+		if err != nil {
+			return "", fmt.Errorf("computing the digest of the base image: %w", err)
+		}
+		base = digest.String()
+	}
+
+	inputs := struct {
+		Version          string                `yaml:"version"`
+		Configuration    interface{}           `yaml:"configuration"`
+		Arch             string                `yaml:"arch"`
+		SourceDateEpoch  time.Time             `yaml:"source-date-epoch"`
+		Packages         []string              `yaml:"packages"`
+		Keys             map[string]string     `yaml:"keys"`
+		CopiedFiles      string                `yaml:"copied-files"`
+		BaseImage        string                `yaml:"base-image"`
+		DeduplicateFiles bool                  `yaml:"deduplicate-files"`
+		SparseFiles      bool                  `yaml:"sparse-files"`
+		Timestamps       apkfs.TimestampPolicy `yaml:"timestamps"`
+		UnsafePaths      bool                  `yaml:"unsafe-paths"`
+	}{
+		Version:          layerCacheVersion,
+		Configuration:    bc.ImageConfiguration,
+		Arch:             bc.Options.Arch.String(),
+		SourceDateEpoch:  bc.Options.SourceDateEpoch,
+		Packages:         pkgs,
+		Keys:             keys,
+		CopiedFiles:      copied,
+		BaseImage:        base,
+		DeduplicateFiles: bc.Options.DeduplicateFiles,
+		SparseFiles:      bc.Options.SparseFiles,
+		Timestamps:       bc.Options.Timestamps,
+		UnsafePaths:      bc.Options.UnsafePaths,
+	}
+	data, err := yaml.Marshal(inputs)
+	if err != nil {
+		return "", fmt.Errorf("marshaling layer inputs: %w", err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+// copyFile copies the file at src to dst, or links it if they are on the same
+// filesystem. Whatever was at dst is replaced rather than written to, since it
+// may be a link to a cached layer.
+func copyFile(src, dst string) error {
+	if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// cachedLayer returns the path of the i-th layer of the entry in the cache.
+func cachedLayer(entry string, i int) string {
+	return filepath.Join(entry, fmt.Sprintf("%d.tar.gz", i))
+}
+
+// cachedLayers copies the layers of the key from the layer cache to the
+// temporary directory, and returns their paths, if it has them.
+func (bc *Context) cachedLayers(key string) ([]string, bool, error) {
+	entry := filepath.Join(bc.Options.LayerCache, key)
+	if _, err := os.Stat(entry); errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	var layers []string
+	for i := 0; ; i++ {
+		src := cachedLayer(entry, i)
+		if _, err := os.Stat(src); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		dst := filepath.Join(bc.Options.TempDir(), fmt.Sprintf("layer-%d-%s", i, bc.Options.TarballFileName()))
+		if err := copyFile(src, dst); err != nil {
+			return nil, false, fmt.Errorf("copying cached layer: %w", err)
+		}
+		layers = append(layers, dst)
+	}
+	if len(layers) == 0 {
+		return nil, false, nil
+	}
+	return layers, true, nil
+}
+
+// cacheLayers keeps the layers of the key in the layer cache. The entry is
+// written aside and renamed into place, so that builds running at the same
+// time never see a partial one.
+func (bc *Context) cacheLayers(key string, layers []string) error {
+	if err := os.MkdirAll(bc.Options.LayerCache, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(bc.Options.LayerCache, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	for i, layer := range layers {
+		if err := copyFile(layer, cachedLayer(tmp, i)); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, filepath.Join(bc.Options.LayerCache, key)); err != nil {
+		if _, serr := os.Stat(filepath.Join(bc.Options.LayerCache, key)); serr == nil {
+			// another build cached them first
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// restoreLayers lays out the filesystem of the layers in the working
+// directory, for the SBOMs and assertions to read it.
+func (bc *Context) restoreLayers(layers []string) error {
+	for _, layer := range layers {
+		f, err := os.Open(layer)
+		if err != nil {
+			return err
+		}
+		gzr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		err = extractTar(bc.fs, gzr)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("extracting cached layer: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/apko/pkg/options"
+)
+
+func TestLayerCache(t *testing.T) {
+	bc := &Context{Options: options.Default}
+	bc.Options.LayerCache = filepath.Join(t.TempDir(), "cache")
+	bc.Options.TempDirPath = t.TempDir()
+
+	_, ok, err := bc.cachedLayers("key")
+	require.NoError(t, err)
+	require.False(t, ok, "nothing cached yet")
+
+	built := t.TempDir()
+	var layers []string
+	for _, content := range []string{"base", "app"} {
+		layer := filepath.Join(built, content+".tar.gz")
+		require.NoError(t, os.WriteFile(layer, []byte(content), 0o644))
+		layers = append(layers, layer)
+	}
+	require.NoError(t, bc.cacheLayers("key", layers))
+	require.NoError(t, bc.cacheLayers("key", layers), "cached already")
+
+	cached, ok, err := bc.cachedLayers("key")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, cached, 2)
+	for i, content := range []string{"base", "app"} {
+		b, err := os.ReadFile(cached[i])
+		require.NoError(t, err)
+		require.Equal(t, content, string(b))
+	}
+
+	entries, err := os.ReadDir(bc.Options.LayerCache)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "no leftover temporary entries")
+}
@@ -0,0 +1,259 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	chainguardAPK "chainguard.dev/apko/pkg/apk"
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+	"chainguard.dev/apko/pkg/tarball"
+)
+
+// defaultLayerBudget is the most layers of the packages strategy, unless the
+// layering sets a budget.
+const defaultLayerBudget = 20
+
+// imageLayer is a set of files of the image written as a layer, along with the
+// directories leading to them.
+type imageLayer struct {
+	name  string
+	paths map[string]bool
+	files int
+}
+
+func newImageLayer(name string) *imageLayer {
+	return &imageLayer{name: name, paths: map[string]bool{}}
+}
+
+// add adds the file at the path, and its parent directories, to the layer.
+func (l *imageLayer) add(name string) {
+	l.paths[name] = true
+	l.files++
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		l.paths[dir] = true
+	}
+}
+
+// packageLayers returns the layers of the packages of the layering, in order,
+// and the layer of each package, by name. The packages without a layer are in
+// the last layer of the image.
+func packageLayers(fsys apkfs.FullFS, o *options.Options, l types.Layering, installed []string) ([]*imageLayer, map[string]*imageLayer, error) {
+	var layers []*imageLayer
+	byPackage := map[string]*imageLayer{}
+
+	switch l.Strategy {
+	case types.LayeringPackages:
+		budget := l.Budget
+		if budget == 0 {
+			budget = defaultLayerBudget
+		}
+		usage, err := packageUsage(fsys, o)
+		if err != nil {
+			return nil, nil, fmt.Errorf("measuring the packages: %w", err)
+		}
+		// the largest packages have layers of their own, and the others
+		// share one, before the last layer
+		own := largest(usage, budget-2)
+		sort.Slice(own, func(i, j int) bool { return own[i].name < own[j].name })
+		for _, c := range own {
+			layer := newImageLayer(c.name)
+			layers = append(layers, layer)
+			byPackage[c.name] = layer
+		}
+		shared := newImageLayer("packages")
+		layers = append(layers, shared)
+		for _, name := range installed {
+			if _, ok := byPackage[name]; !ok {
+				byPackage[name] = shared
+			}
+		}
+	case types.LayeringGroups:
+		for _, g := range l.Groups {
+			layers = append(layers, newImageLayer(g.Name))
+		}
+		for _, name := range installed {
+		groups:
+			for i, g := range l.Groups {
+				for _, pattern := range g.Packages {
+					if ok, _ := path.Match(pattern, name); ok {
+						byPackage[name] = layers[i]
+						break groups
+					}
+				}
+			}
+		}
+	}
+	return layers, byPackage, nil
+}
+
+// partitionLayers splits the files of the image into the layers of the
+// layering, in order. The files of packages are in the layers of their
+// packages, and the rest, such as the package database and the accounts, in
+// the last layer, which also has every directory. On top of a base image,
+// the paths the build left as the base has them are in none.
+func partitionLayers(fsys apkfs.FullFS, o *options.Options, l types.Layering, base map[string]fsEntry) ([]*imageLayer, error) {
+	apk, err := chainguardAPK.NewWithOptions(fsys, *o)
+	if err != nil {
+		return nil, err
+	}
+	installed, err := apk.GetInstalled()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	names := make([]string, 0, len(installed))
+	for _, pkg := range installed {
+		names = append(names, pkg.Name)
+	}
+	layers, byPackage, err := packageLayers(fsys, o, l, names)
+	if err != nil {
+		return nil, err
+	}
+
+	// a file replaced by a later package is the one of that package
+	owners := map[string]*imageLayer{}
+	for _, pkg := range installed {
+		layer, ok := byPackage[pkg.Name]
+		if !ok {
+			continue
+		}
+		for _, f := range pkg.Files {
+			if f.Typeflag != tar.TypeDir {
+				owners[strings.TrimPrefix(path.Clean(f.Name), "/")] = layer
+			}
+		}
+	}
+
+	last := newImageLayer("apko")
+	if err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if base != nil {
+			if same, err := unchanged(fsys, base, name, d); err != nil {
+				return err
+			} else if same {
+				return nil
+			}
+		}
+		if d.IsDir() {
+			last.paths[name] = true
+			return nil
+		}
+		layer, ok := owners[name]
+		if !ok {
+			layer = last
+		}
+		layer.add(name)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("splitting the filesystem into layers: %w", err)
+	}
+
+	// the layers of packages which left no files are not written
+	var written []*imageLayer
+	for _, layer := range layers {
+		if layer.files != 0 {
+			written = append(written, layer)
+		}
+	}
+	return append(written, last), nil
+}
+
+// layerFS is a filesystem with only the paths of a layer.
+type layerFS struct {
+	apkfs.FullFS
+	paths map[string]bool
+}
+
+func (l *layerFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := l.FullFS.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	kept := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		if l.paths[path.Join(name, e.Name())] {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
+
+// writeLayers writes the tarballs of the layers of the image, in order, and
+// returns their paths. The last one, with the package database, is the layer
+// the SBOMs describe. On top of a base image, the layers have the changes to
+// the files of the base only, the last one marking those which were removed.
+func writeLayers(o *options.Options, ic *types.ImageConfiguration, fsys apkfs.FullFS, base map[string]fsEntry) ([]string, error) {
+	if base != nil {
+		whiteouts, err := writeWhiteouts(fsys, base)
+		defer func() {
+			for _, w := range whiteouts {
+				_ = fsys.Remove(w)
+			}
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	layers, err := partitionLayers(fsys, o, ic.Layering, base)
+	if err != nil {
+		return nil, err
+	}
+
+	// the image is done by then, so writing the tarballs must not change it
+	ro := apkfs.ReadOnlyFS(fsys)
+	paths := make([]string, 0, len(layers))
+	for i, layer := range layers {
+		tw, err := tarball.NewContext(
+			tarball.WithSourceDateEpoch(o.SourceDateEpoch),
+			tarball.WithFileMutators(o.FileMutators...),
+			tarball.WithDeduplication(o.DeduplicateFiles),
+			tarball.WithSparse(o.SparseFiles),
+			tarball.WithTimestampPolicy(o.Timestamps),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct tarball build context: %w", err)
+		}
+		name := filepath.Join(o.TempDir(), fmt.Sprintf("layer-%d-%s", i, o.TarballFileName()))
+		outfile, err := os.Create(name)
+		if err != nil {
+			return nil, fmt.Errorf("opening the layer tarball path failed: %w", err)
+		}
+		err = tw.WriteArchive(outfile, &layerFS{FullFS: ro, paths: layer.paths})
+		outfile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate tarball for layer %s: %w", layer.name, err)
+		}
+		o.Logger().Infof("built image layer tarball %s of %s, with %d files", name, layer.name, layer.files)
+		paths = append(paths, name)
+	}
+	o.TarballPath = paths[len(paths)-1]
+	return paths, nil
+}
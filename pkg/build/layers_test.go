@@ -0,0 +1,70 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+)
+
+func TestPartitionLayers(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("lib/apk/db", 0o755))
+	require.NoError(t, fsys.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, fsys.MkdirAll("etc", 0o755))
+	require.NoError(t, fsys.WriteFile("usr/bin/big", make([]byte, 10000), 0o755))
+	require.NoError(t, fsys.WriteFile("usr/bin/small", []byte("small"), 0o755))
+	require.NoError(t, fsys.WriteFile("etc/passwd", []byte("root:x:0:0:root:/root:/bin/sh\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("lib/apk/db/installed", []byte(
+		"P:big\nV:1.0-r0\nF:usr/bin\nR:big\n\nP:small\nV:1.0-r0\nF:usr/bin\nR:small\n\n"), 0o644))
+	o := options.Default
+
+	layers, err := partitionLayers(fsys, &o, types.Layering{Strategy: types.LayeringPackages, Budget: 3}, nil)
+	require.NoError(t, err)
+	require.Len(t, layers, 3)
+	require.Equal(t, "big", layers[0].name)
+	require.Equal(t, map[string]bool{"usr": true, "usr/bin": true, "usr/bin/big": true}, layers[0].paths)
+	require.Equal(t, "packages", layers[1].name)
+	require.Equal(t, map[string]bool{"usr": true, "usr/bin": true, "usr/bin/small": true}, layers[1].paths)
+	require.Equal(t, "apko", layers[2].name)
+	require.Equal(t, map[string]bool{
+		"etc": true, "etc/passwd": true, "lib": true, "lib/apk": true, "lib/apk/db": true,
+		"lib/apk/db/installed": true, "usr": true, "usr/bin": true,
+	}, layers[2].paths)
+
+	layers, err = partitionLayers(fsys, &o, types.Layering{Strategy: types.LayeringGroups, Groups: []types.LayerGroup{
+		{Name: "tools", Packages: []string{"sm*"}},
+		{Name: "empty", Packages: []string{"missing"}},
+	}}, nil)
+	require.NoError(t, err)
+	require.Len(t, layers, 2, "no layer without files")
+	require.Equal(t, "tools", layers[0].name)
+	require.True(t, layers[0].paths["usr/bin/small"])
+	require.True(t, layers[1].paths["usr/bin/big"], "in no group")
+
+	// the layer only has its files
+	var walked []string
+	require.NoError(t, fs.WalkDir(&layerFS{FullFS: fsys, paths: layers[0].paths}, ".", func(name string, _ fs.DirEntry, err error) error {
+		walked = append(walked, name)
+		return err
+	}))
+	require.Equal(t, []string{".", "usr", "usr/bin", "usr/bin/small"}, walked)
+}
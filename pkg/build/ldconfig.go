@@ -115,5 +115,5 @@ func (di *defaultBuildImplementation) InstallLdconfigLinks(fsys apkfs.FullFS) er
 			return fmt.Errorf("creating link %s -> %s: %w", link, target, err)
 		}
 	}
-	return nil
+	return generateLdSoCache(fsys)
 }
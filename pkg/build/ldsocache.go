@@ -0,0 +1,461 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+// The glibc ldconfig trigger never runs when apko installs packages, so the
+// cache it would write is generated here instead. The layout is the one of
+// glibc's "new" format, see sysdeps/generic/dl-cache.h and elf/cache.c.
+
+const (
+	ldSoCache = "etc/ld.so.cache"
+	ldSoConf  = "etc/ld.so.conf"
+
+	ldCacheMagic     = "glibc-ld.so.cache1.1"
+	ldCacheHeader    = 48
+	ldCacheEntrySize = 24
+	ldCacheLittle    = 2
+	ldCacheBig       = 3
+	flagELFLibc6     = 0x0003
+	flagX8664Lib64   = 0x0300
+	flagS390Lib64    = 0x0400
+	flagPPCLib64     = 0x0500
+	flagX8664X32     = 0x0800
+	flagARMHF        = 0x0900
+	flagARM64Lib64   = 0x0a00
+	flagARMSF        = 0x0b00
+	flagRISCVSoft    = 0x0f00
+	flagRISCVDbl     = 0x1000
+	flagLArchSoft    = 0x1100
+	flagLArchDbl     = 0x1200
+)
+
+// ldCacheDirs are the trusted directories ldconfig always scans, after the
+// ones configured in /etc/ld.so.conf.
+var ldCacheDirs = []string{"lib64", "usr/lib64", "lib", "usr/lib"}
+
+type ldCacheEntry struct {
+	soname string
+	path   string
+	flags  int32
+}
+
+// generateLdSoCache scans the library directories of a glibc based image the
+// way ldconfig does, creates the missing soname links and writes
+// /etc/ld.so.cache. Images without glibc are left untouched.
+func generateLdSoCache(fsys apkfs.FullFS) error {
+	dirs, err := ldCacheSearchDirs(fsys)
+	if err != nil {
+		return err
+	}
+
+	var (
+		entries []ldCacheEntry
+		order   binary.ByteOrder
+		glibc   bool
+	)
+	for _, dir := range dirs {
+		libs, err := scanLibDir(fsys, dir)
+		if err != nil {
+			return err
+		}
+		for _, lib := range libs {
+			if lib.soname != lib.file {
+				if err := updateSonameLink(fsys, dir, lib.soname, lib.file); err != nil {
+					return err
+				}
+			}
+			if lib.soname == "libc.so.6" {
+				glibc = true
+				order = lib.order
+			}
+			entries = append(entries, ldCacheEntry{
+				soname: lib.soname,
+				path:   "/" + path.Join(dir, lib.soname),
+				flags:  lib.flags,
+			})
+		}
+	}
+	if !glibc {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := writeLdSoCache(&buf, order, entries); err != nil {
+		return err
+	}
+	if err := fsys.MkdirAll(path.Dir(ldSoCache), 0o755); err != nil {
+		return fmt.Errorf("creating directory %s: %w", path.Dir(ldSoCache), err)
+	}
+	if err := fsys.WriteFile(ldSoCache, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", ldSoCache, err)
+	}
+	return nil
+}
+
+// ldCacheSearchDirs returns the existing library directories, those listed in
+// /etc/ld.so.conf first, without duplicates.
+func ldCacheSearchDirs(fsys apkfs.FullFS) ([]string, error) {
+	conf, err := parseLdSoConf(fsys, ldSoConf, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	seen := map[string]bool{}
+	for _, dir := range append(conf, ldCacheDirs...) {
+		dir = strings.TrimPrefix(path.Clean("/"+dir), "/")
+		if dir == "" || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		if fi, err := fsys.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// parseLdSoConf reads the directories of an ld.so.conf file, following its
+// include directives. A missing file has no directories.
+func parseLdSoConf(fsys apkfs.FullFS, name string, depth int) ([]string, error) {
+	if depth > 8 {
+		return nil, fmt.Errorf("%s: too many nested includes", name)
+	}
+	b, err := fsys.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+
+	var dirs []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "include":
+			for _, pattern := range fields[1:] {
+				if !path.IsAbs(pattern) {
+					pattern = path.Join("/", path.Dir(name), pattern)
+				}
+				matches, err := fs.Glob(fsys, strings.TrimPrefix(pattern, "/"))
+				if err != nil {
+					return nil, fmt.Errorf("%s: bad include %q: %w", name, pattern, err)
+				}
+				sort.Strings(matches)
+				for _, match := range matches {
+					included, err := parseLdSoConf(fsys, match, depth+1)
+					if err != nil {
+						return nil, err
+					}
+					dirs = append(dirs, included...)
+				}
+			}
+		case "hwcap":
+			// obsolete, ignored by ldconfig as well
+		default:
+			for _, field := range fields {
+				dirs = append(dirs, strings.Split(field, ",")...)
+			}
+		}
+	}
+	return dirs, scanner.Err()
+}
+
+type sharedLib struct {
+	file   string
+	soname string
+	flags  int32
+	order  binary.ByteOrder
+}
+
+// scanLibDir returns one library per soname found in dir, the highest
+// version winning when several files provide the same soname.
+func scanLibDir(fsys apkfs.FullFS, dir string) ([]sharedLib, error) {
+	des, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read directory %s: %w", dir, err)
+	}
+	bySoname := map[string]sharedLib{}
+	for _, de := range des {
+		if !de.Type().IsRegular() || !isDSOName(de.Name()) {
+			continue
+		}
+		lib, ok, err := readSharedLib(fsys, path.Join(dir, de.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if prev, ok := bySoname[lib.soname]; ok && prev.file == lib.soname {
+			continue
+		} else if ok && lib.file != lib.soname && ldCacheLibcmp(lib.file, prev.file) < 0 {
+			continue
+		}
+		bySoname[lib.soname] = lib
+	}
+
+	libs := make([]sharedLib, 0, len(bySoname))
+	for _, lib := range bySoname {
+		libs = append(libs, lib)
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].soname < libs[j].soname })
+	return libs, nil
+}
+
+// isDSOName mirrors the file name filter of ldconfig.
+func isDSOName(name string) bool {
+	if !strings.Contains(name, ".so") {
+		return false
+	}
+	return strings.HasPrefix(name, "lib") || strings.HasPrefix(name, "ld-") ||
+		strings.HasPrefix(name, "ld.so") || strings.HasPrefix(name, "ld64.so")
+}
+
+// readSharedLib reads the soname and the cache flags of an ELF shared object.
+// Files that are not ELF shared objects for a known machine are skipped.
+func readSharedLib(fsys apkfs.FullFS, name string) (sharedLib, bool, error) {
+	f, err := fsys.OpenReaderAt(name)
+	if err != nil {
+		return sharedLib{}, false, fmt.Errorf("unable to open file %s: %w", name, err)
+	}
+	defer f.Close()
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return sharedLib{}, false, nil
+	}
+	defer ef.Close()
+	if ef.Type != elf.ET_DYN {
+		return sharedLib{}, false, nil
+	}
+	flags, ok, err := ldCacheFlags(ef, f)
+	if err != nil {
+		return sharedLib{}, false, fmt.Errorf("unable to read elf headers %s: %w", name, err)
+	}
+	if !ok {
+		return sharedLib{}, false, nil
+	}
+	sonames, err := ef.DynString(elf.DT_SONAME)
+	if err != nil {
+		return sharedLib{}, false, fmt.Errorf("unable to read elf headers %s: %w", name, err)
+	}
+	lib := sharedLib{file: path.Base(name), flags: flags, order: ef.ByteOrder}
+	// like ldconfig, a library without a soname is known by its file name
+	lib.soname = lib.file
+	if len(sonames) > 0 && sonames[0] != "" && !strings.Contains(sonames[0], "/") {
+		lib.soname = sonames[0]
+	}
+	return lib, true, nil
+}
+
+// ldCacheFlags returns the flags glibc's dynamic loader expects in the cache
+// entries of libraries it can load, as set by ldconfig's readelflib.
+func ldCacheFlags(ef *elf.File, r io.ReaderAt) (int32, bool, error) {
+	// e_flags is not exposed by debug/elf
+	off := int64(36)
+	if ef.Class == elf.ELFCLASS64 {
+		off = 48
+	}
+	var b [4]byte
+	if _, err := r.ReadAt(b[:], off); err != nil {
+		return 0, false, err
+	}
+	eflags := ef.ByteOrder.Uint32(b[:])
+
+	var abi int32
+	switch {
+	case ef.Machine == elf.EM_X86_64 && ef.Class == elf.ELFCLASS64:
+		abi = flagX8664Lib64
+	case ef.Machine == elf.EM_X86_64:
+		abi = flagX8664X32
+	case ef.Machine == elf.EM_386:
+	case ef.Machine == elf.EM_AARCH64 && ef.Class == elf.ELFCLASS64:
+		abi = flagARM64Lib64
+	case ef.Machine == elf.EM_ARM && eflags&0x400 != 0:
+		abi = flagARMHF
+	case ef.Machine == elf.EM_ARM && eflags&0x200 != 0:
+		abi = flagARMSF
+	case ef.Machine == elf.EM_ARM:
+	case ef.Machine == elf.EM_PPC64:
+		abi = flagPPCLib64
+	case ef.Machine == elf.EM_S390 && ef.Class == elf.ELFCLASS64:
+		abi = flagS390Lib64
+	case ef.Machine == elf.EM_RISCV && ef.Class == elf.ELFCLASS64 && eflags&0x6 == 0x4:
+		abi = flagRISCVDbl
+	case ef.Machine == elf.EM_RISCV && ef.Class == elf.ELFCLASS64 && eflags&0x6 == 0:
+		abi = flagRISCVSoft
+	case ef.Machine == elf.EM_LOONGARCH && eflags&0x7 == 0x3:
+		abi = flagLArchDbl
+	case ef.Machine == elf.EM_LOONGARCH && eflags&0x7 == 0x1:
+		abi = flagLArchSoft
+	default:
+		return 0, false, nil
+	}
+	return flagELFLibc6 | abi, true, nil
+}
+
+// updateSonameLink points dir/soname to file, as ldconfig does, unless a
+// regular file already has that name.
+func updateSonameLink(fsys apkfs.FullFS, dir, soname, file string) error {
+	link := path.Join(dir, soname)
+	fi, err := fsys.Lstat(link)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("unable to stat link file %s: %w", link, err)
+	case fi.Mode()&fs.ModeSymlink == 0:
+		return nil
+	default:
+		if target, err := fsys.Readlink(link); err == nil && target == file {
+			return nil
+		}
+		if err := fsys.Remove(link); err != nil {
+			return fmt.Errorf("removing stale link %s: %w", link, err)
+		}
+	}
+	if err := fsys.Symlink(file, link); err != nil {
+		return fmt.Errorf("creating link %s -> %s: %w", link, file, err)
+	}
+	return nil
+}
+
+// writeLdSoCache writes the entries in glibc's new cache format. The
+// entries are sorted the way the dynamic loader's binary search expects,
+// keeping the scan order of libraries sharing a soname.
+func writeLdSoCache(w io.Writer, order binary.ByteOrder, entries []ldCacheEntry) error {
+	sorted := make([]ldCacheEntry, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if c := ldCacheLibcmp(sorted[i].soname, sorted[j].soname); c != 0 {
+			return c > 0
+		}
+		return sorted[i].flags > sorted[j].flags
+	})
+
+	var strs bytes.Buffer
+	offsets := map[string]uint32{}
+	base := uint32(ldCacheHeader + ldCacheEntrySize*len(sorted))
+	intern := func(s string) uint32 {
+		if off, ok := offsets[s]; ok {
+			return off
+		}
+		off := base + uint32(strs.Len())
+		offsets[s] = off
+		strs.WriteString(s)
+		strs.WriteByte(0)
+		return off
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(ldCacheMagic)
+	endian := uint8(ldCacheLittle)
+	if order == binary.BigEndian {
+		endian = ldCacheBig
+	}
+	header := struct {
+		NLibs           uint32
+		LenStrings      uint32
+		Flags           uint8
+		Padding         [3]uint8
+		ExtensionOffset uint32
+		Unused          [3]uint32
+	}{NLibs: uint32(len(sorted)), Flags: endian}
+
+	type fileEntry struct {
+		Flags     int32
+		Key       uint32
+		Value     uint32
+		OSVersion uint32
+		HWCap     uint64
+	}
+	fileEntries := make([]fileEntry, 0, len(sorted))
+	for _, e := range sorted {
+		fileEntries = append(fileEntries, fileEntry{
+			Flags: e.flags,
+			Key:   intern(e.soname),
+			Value: intern(e.path),
+		})
+	}
+	header.LenStrings = uint32(strs.Len())
+
+	if err := binary.Write(&buf, order, header); err != nil {
+		return err
+	}
+	if err := binary.Write(&buf, order, fileEntries); err != nil {
+		return err
+	}
+	buf.Write(strs.Bytes())
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ldCacheLibcmp is glibc's _dl_cache_libcmp: strings compare bytewise except
+// for runs of digits, which compare numerically.
+func ldCacheLibcmp(a, b string) int {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	i, j := 0, 0
+	for i < len(a) {
+		switch {
+		case isDigit(a[i]) && j < len(b) && isDigit(b[j]):
+			var va, vb int
+			for ; i < len(a) && isDigit(a[i]); i++ {
+				va = va*10 + int(a[i]-'0')
+			}
+			for ; j < len(b) && isDigit(b[j]); j++ {
+				vb = vb*10 + int(b[j]-'0')
+			}
+			if va != vb {
+				return va - vb
+			}
+		case isDigit(a[i]):
+			return 1
+		case j < len(b) && isDigit(b[j]):
+			return -1
+		case j >= len(b):
+			return int(a[i])
+		case a[i] != b[j]:
+			return int(a[i]) - int(b[j])
+		default:
+			i++
+			j++
+		}
+	}
+	if j < len(b) {
+		return -int(b[j])
+	}
+	return 0
+}
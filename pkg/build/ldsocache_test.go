@@ -0,0 +1,155 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+// testSharedObject returns a minimal x86_64 ELF shared object with a soname.
+func testSharedObject(soname string) []byte {
+	dynstr := append(append([]byte{0}, soname...), 0)
+	shstrtab := []byte("\x00.dynstr\x00.dynamic\x00.shstrtab\x00")
+	dynstrOff := uint64(64)
+	dynamicOff := (dynstrOff + uint64(len(dynstr)) + 7) &^ 7
+	shstrtabOff := dynamicOff + 32
+	shOff := (shstrtabOff + uint64(len(shstrtab)) + 7) &^ 7
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.Write([]byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), 1, 0})
+	buf.Write(make([]byte, 8))
+	_ = binary.Write(&buf, le, struct {
+		Type, Machine                       uint16
+		Version                             uint32
+		Entry, Phoff, Shoff                 uint64
+		Flags                               uint32
+		Ehsize, Phentsize, Phnum, Shentsize uint16
+		Shnum, Shstrndx                     uint16
+	}{uint16(elf.ET_DYN), uint16(elf.EM_X86_64), 1, 0, 0, shOff, 0, 64, 56, 0, 64, 4, 3})
+	buf.Write(dynstr)
+	buf.Write(make([]byte, dynamicOff-uint64(buf.Len())))
+	_ = binary.Write(&buf, le, []int64{int64(elf.DT_SONAME), 1, int64(elf.DT_NULL), 0})
+	buf.Write(shstrtab)
+	buf.Write(make([]byte, shOff-uint64(buf.Len())))
+
+	type section struct {
+		Name, Type                uint32
+		Flags, Addr, Offset, Size uint64
+		Link, Info                uint32
+		Addralign, Entsize        uint64
+	}
+	_ = binary.Write(&buf, le, []section{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_STRTAB), Offset: dynstrOff, Size: uint64(len(dynstr)), Addralign: 1},
+		{Name: 9, Type: uint32(elf.SHT_DYNAMIC), Offset: dynamicOff, Size: 32, Link: 1, Addralign: 8, Entsize: 16},
+		{Name: 18, Type: uint32(elf.SHT_STRTAB), Offset: shstrtabOff, Size: uint64(len(shstrtab)), Addralign: 1},
+	})
+	return buf.Bytes()
+}
+
+// readLdSoCache returns the key and value of each entry of a little endian
+// cache.
+func readLdSoCache(t *testing.T, b []byte) [][2]string {
+	t.Helper()
+	require.Equal(t, ldCacheMagic, string(b[:20]))
+	le := binary.LittleEndian
+	nlibs := le.Uint32(b[20:])
+	require.Equal(t, byte(ldCacheLittle), b[28])
+	require.Equal(t, ldCacheHeader+ldCacheEntrySize*int(nlibs)+int(le.Uint32(b[24:])), len(b))
+	str := func(off uint32) string {
+		end := bytes.IndexByte(b[off:], 0)
+		return string(b[off : int(off)+end])
+	}
+	var entries [][2]string
+	for i := 0; i < int(nlibs); i++ {
+		e := b[ldCacheHeader+ldCacheEntrySize*i:]
+		require.Equal(t, uint32(flagELFLibc6|flagX8664Lib64), le.Uint32(e))
+		entries = append(entries, [2]string{str(le.Uint32(e[4:])), str(le.Uint32(e[8:]))})
+	}
+	return entries
+}
+
+func TestGenerateLdSoCache(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("lib", 0o755))
+	require.NoError(t, fsys.MkdirAll("usr/lib", 0o755))
+	require.NoError(t, fsys.MkdirAll("opt/app/lib", 0o755))
+	require.NoError(t, fsys.MkdirAll("etc/ld.so.conf.d", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/ld.so.conf", []byte("# comment\ninclude ld.so.conf.d/*.conf\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("etc/ld.so.conf.d/app.conf", []byte("/opt/app/lib\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("lib/libc.so.6", testSharedObject("libc.so.6"), 0o755))
+	require.NoError(t, fsys.WriteFile("usr/lib/libz.so.1.2.13", testSharedObject("libz.so.1"), 0o755))
+	require.NoError(t, fsys.WriteFile("usr/lib/libz.so.1.2.9", testSharedObject("libz.so.1"), 0o755))
+	require.NoError(t, fsys.Symlink("libz.so.1.2.9", "usr/lib/libz.so.1"))
+	require.NoError(t, fsys.WriteFile("usr/lib/libapp.so.10", testSharedObject("libapp.so.10"), 0o755))
+	require.NoError(t, fsys.WriteFile("opt/app/lib/libapp.so.10", testSharedObject("libapp.so.10"), 0o755))
+	require.NoError(t, fsys.WriteFile("usr/lib/README.so.txt", []byte("not a library"), 0o644))
+
+	require.NoError(t, generateLdSoCache(fsys))
+
+	target, err := fsys.Readlink("usr/lib/libz.so.1")
+	require.NoError(t, err)
+	require.Equal(t, "libz.so.1.2.13", target, "the link points to the newest version")
+
+	b, err := fsys.ReadFile(ldSoCache)
+	require.NoError(t, err)
+	require.Equal(t, [][2]string{
+		{"libz.so.1", "/usr/lib/libz.so.1"},
+		{"libc.so.6", "/lib/libc.so.6"},
+		{"libapp.so.10", "/opt/app/lib/libapp.so.10"},
+		{"libapp.so.10", "/usr/lib/libapp.so.10"},
+	}, readLdSoCache(t, b))
+}
+
+func TestGenerateLdSoCacheNoGlibc(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("lib", 0o755))
+	require.NoError(t, fsys.WriteFile("lib/libc.musl-x86_64.so.1", testSharedObject("libc.musl-x86_64.so.1"), 0o755))
+
+	require.NoError(t, generateLdSoCache(fsys))
+	_, err := fsys.Stat(ldSoCache)
+	require.Error(t, err)
+}
+
+func TestLdCacheLibcmp(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		cmp  int
+	}{
+		{"libc.so.6", "libc.so.6", 0},
+		{"libz.so.10", "libz.so.9", 1},
+		{"libz.so.1", "libz.so.1.2", -1},
+		{"lib2", "libc", 1},
+		{"liba", "libb", -1},
+	} {
+		got := ldCacheLibcmp(tt.a, tt.b)
+		switch {
+		case tt.cmp == 0:
+			require.Zero(t, got, "%s %s", tt.a, tt.b)
+		case tt.cmp > 0:
+			require.Positive(t, got, "%s %s", tt.a, tt.b)
+		default:
+			require.Negative(t, got, "%s %s", tt.a, tt.b)
+		}
+	}
+}
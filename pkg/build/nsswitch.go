@@ -0,0 +1,208 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+)
+
+const nsswitchPath = "etc/nsswitch.conf"
+
+// defaultNSSwitchDatabases are the databases of a generated nsswitch.conf,
+// in order. Without nsswitch.conf, glibc looks hosts up with DNS before
+// /etc/hosts, and gives up on the files if DNS is unavailable.
+var defaultNSSwitchDatabases = []struct {
+	name    string
+	sources []string
+}{
+	{"passwd", []string{"files"}},
+	{"group", []string{"files"}},
+	{"shadow", []string{"files"}},
+	{"hosts", []string{"files", "dns"}},
+	{"networks", []string{"files"}},
+	{"protocols", []string{"files"}},
+	{"services", []string{"files"}},
+	{"ethers", []string{"files"}},
+	{"rpc", []string{"files"}},
+	{"netgroup", []string{"files"}},
+}
+
+// builtinNSSSources are the sources glibc provides without a separate
+// libnss module, and the only ones musl knows about.
+var builtinNSSSources = map[string]bool{"files": true, "dns": true}
+
+// libDirPatterns are where the C library and NSS modules are looked for.
+var libDirPatterns = []string{"lib", "lib64", "usr/lib", "usr/lib64", "lib/*-linux-gnu", "usr/lib/*-linux-gnu"}
+
+const (
+	libcGlibc = "glibc"
+	libcMusl  = "musl"
+)
+
+// GenerateNSSwitch writes /etc/nsswitch.conf for the C library of the
+// image, if the configuration asks for it, so that users and hosts are
+// looked up in the files before anything else.
+func (di *defaultBuildImplementation) GenerateNSSwitch(
+	fsys apkfs.FullFS, o *options.Options, ic *types.ImageConfiguration,
+) error {
+	nr := ic.NameResolution
+	if nr.NSSwitch == "" {
+		return nil
+	}
+
+	libc, err := detectLibc(fsys)
+	if err != nil {
+		return fmt.Errorf("detecting the C library: %w", err)
+	}
+
+	if nr.NSSwitch == types.NSSwitchAuto {
+		if libc != libcGlibc {
+			o.Logger().Infof("not generating /%s, the image does not use glibc", nsswitchPath)
+			return nil
+		}
+		if _, err := fsys.Stat(nsswitchPath); err == nil {
+			o.Logger().Infof("not generating /%s, it is installed by a package", nsswitchPath)
+			return nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	content := nsswitchConf(nr.Databases)
+
+	for _, source := range nsswitchSources(nr.Databases) {
+		switch {
+		case builtinNSSSources[source]:
+		case libc == libcMusl:
+			o.Logger().Warnf("musl does not support NSS modules, the %s source is ignored", source)
+		default:
+			found, err := findLibrary(fsys, fmt.Sprintf("libnss_%s.so.2", source))
+			if err != nil {
+				return err
+			}
+			if !found {
+				o.Logger().Warnf("the NSS module for the %s source is not installed, lookups using it will fail", source)
+			}
+		}
+	}
+
+	if err := fsys.MkdirAll("etc", 0o755); err != nil {
+		return err
+	}
+	o.Logger().Infof("generating /%s", nsswitchPath)
+	return fsys.WriteFile(nsswitchPath, []byte(content), 0o644)
+}
+
+// nsswitchConf returns the content of nsswitch.conf, with the sources of the
+// default databases replaced or complemented by the given ones.
+func nsswitchConf(databases map[string][]string) string {
+	var sb strings.Builder
+	sb.WriteString("# generated by apko\n")
+	seen := map[string]bool{}
+	for _, db := range defaultNSSwitchDatabases {
+		sources := db.sources
+		if override, ok := databases[db.name]; ok {
+			sources = override
+		}
+		fmt.Fprintf(&sb, "%-10s %s\n", db.name+":", strings.Join(sources, " "))
+		seen[db.name] = true
+	}
+
+	extra := make([]string, 0, len(databases))
+	for name := range databases {
+		if !seen[name] {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		fmt.Fprintf(&sb, "%-10s %s\n", name+":", strings.Join(databases[name], " "))
+	}
+
+	return sb.String()
+}
+
+// nsswitchSources returns the sources used by the databases, sorted and
+// without the actions in brackets, such as [NOTFOUND=return].
+func nsswitchSources(databases map[string][]string) []string {
+	seen := map[string]bool{}
+	for _, db := range defaultNSSwitchDatabases {
+		if _, ok := databases[db.name]; ok {
+			continue
+		}
+		for _, source := range db.sources {
+			seen[source] = true
+		}
+	}
+	for _, sources := range databases {
+		for _, source := range sources {
+			if !strings.HasPrefix(source, "[") {
+				seen[source] = true
+			}
+		}
+	}
+
+	sources := make([]string, 0, len(seen))
+	for source := range seen {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// detectLibc returns which C library the image uses, or an empty string if
+// it has none.
+func detectLibc(fsys fs.FS) (string, error) {
+	for _, libc := range []struct {
+		name    string
+		pattern string
+	}{
+		{libcGlibc, "libc.so.6"},
+		{libcMusl, "ld-musl-*.so.1"},
+	} {
+		found, err := findLibrary(fsys, libc.pattern)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			return libc.name, nil
+		}
+	}
+	return "", nil
+}
+
+// findLibrary reports whether a library matching the pattern is in one of
+// the library directories.
+func findLibrary(fsys fs.FS, pattern string) (bool, error) {
+	for _, dir := range libDirPatterns {
+		matches, err := fs.Glob(fsys, dir+"/"+pattern)
+		if err != nil {
+			return false, err
+		}
+		if len(matches) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
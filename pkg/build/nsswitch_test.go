@@ -0,0 +1,100 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+)
+
+func TestNSSwitchConf(t *testing.T) {
+	databases := map[string][]string{
+		"hosts":      {"files", "myhostname", "dns"},
+		"automount":  {"files"},
+		"initgroups": {"files", "[NOTFOUND=return]", "ldap"},
+	}
+	require.Equal(t, `# generated by apko
+passwd:    files
+group:     files
+shadow:    files
+hosts:     files myhostname dns
+networks:  files
+protocols: files
+services:  files
+ethers:    files
+rpc:       files
+netgroup:  files
+automount: files
+initgroups: files [NOTFOUND=return] ldap
+`, nsswitchConf(databases))
+	require.Equal(t, []string{"dns", "files", "ldap", "myhostname"}, nsswitchSources(databases))
+}
+
+func TestGenerateNSSwitch(t *testing.T) {
+	di := &defaultBuildImplementation{}
+	o := options.Default
+	ic := types.ImageConfiguration{
+		NameResolution: types.NameResolution{NSSwitch: types.NSSwitchAuto},
+	}
+
+	t.Run("musl", func(t *testing.T) {
+		fsys := apkfs.NewMemFS()
+		require.NoError(t, fsys.MkdirAll("lib", 0o755))
+		require.NoError(t, fsys.WriteFile("lib/ld-musl-x86_64.so.1", []byte("musl"), 0o755))
+
+		libc, err := detectLibc(fsys)
+		require.NoError(t, err)
+		require.Equal(t, libcMusl, libc)
+
+		require.NoError(t, di.GenerateNSSwitch(fsys, &o, &ic))
+		_, err = fsys.Stat(nsswitchPath)
+		require.Error(t, err)
+	})
+	t.Run("glibc", func(t *testing.T) {
+		fsys := apkfs.NewMemFS()
+		require.NoError(t, fsys.MkdirAll("usr/lib", 0o755))
+		require.NoError(t, fsys.WriteFile("usr/lib/libc.so.6", []byte("glibc"), 0o755))
+
+		require.NoError(t, di.GenerateNSSwitch(fsys, &o, &ic))
+		content, err := fsys.ReadFile(nsswitchPath)
+		require.NoError(t, err)
+		require.Contains(t, string(content), "hosts:     files dns\n")
+	})
+	t.Run("installed by a package", func(t *testing.T) {
+		fsys := apkfs.NewMemFS()
+		require.NoError(t, fsys.MkdirAll("lib", 0o755))
+		require.NoError(t, fsys.WriteFile("lib/libc.so.6", []byte("glibc"), 0o755))
+		require.NoError(t, fsys.MkdirAll("etc", 0o755))
+		require.NoError(t, fsys.WriteFile(nsswitchPath, []byte("hosts: dns\n"), 0o644))
+
+		require.NoError(t, di.GenerateNSSwitch(fsys, &o, &ic))
+		content, err := fsys.ReadFile(nsswitchPath)
+		require.NoError(t, err)
+		require.Equal(t, "hosts: dns\n", string(content))
+
+		always := types.ImageConfiguration{
+			NameResolution: types.NameResolution{NSSwitch: types.NSSwitchAlways},
+		}
+		require.NoError(t, di.GenerateNSSwitch(fsys, &o, &always))
+		content, err = fsys.ReadFile(nsswitchPath)
+		require.NoError(t, err)
+		require.Contains(t, string(content), "# generated by apko\n")
+	})
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sigstore/cosign/v2/pkg/oci"
+
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+// BaseImage returns the image of the architecture of the base, pulled from
+// its reference or read from its OCI image layout.
+func BaseImage(base types.BaseImage, arch types.Architecture) (v1.Image, error) {
+	platform := arch.ToOCIPlatform()
+	if base.Ref != "" {
+		ref, err := name.ParseReference(base.Ref)
+		if err != nil {
+			return nil, fmt.Errorf("parsing base image ref %q: %w", base.Ref, err)
+		}
+		img, err := remote.Image(ref, remote.WithAuthFromKeychain(keychain), remote.WithPlatform(*platform))
+		if err != nil {
+			return nil, fmt.Errorf("pulling base image %s for %s: %w", ref, arch, err)
+		}
+		return img, nil
+	}
+
+	idx, err := layout.ImageIndexFromPath(base.Layout)
+	if err != nil {
+		return nil, fmt.Errorf("reading base image layout %s: %w", base.Layout, err)
+	}
+	img, err := indexImage(idx, *platform)
+	if err != nil {
+		return nil, fmt.Errorf("base image layout %s: %w", base.Layout, err)
+	}
+	return img, nil
+}
+
+// WriteLayout writes the images of the architectures to an OCI image layout,
+// which BaseImage reads the image of each architecture from, e.g. for the
+// variants built on top of them.
+func WriteLayout(path string, imgs map[types.Architecture]oci.SignedImage) error {
+	p, err := layout.Write(path, empty.Index)
+	if err != nil {
+		return fmt.Errorf("writing image layout %s: %w", path, err)
+	}
+	archs := make([]types.Architecture, 0, len(imgs))
+	for arch := range imgs {
+		archs = append(archs, arch)
+	}
+	sort.Slice(archs, func(i, j int) bool {
+		return archs[i].String() < archs[j].String()
+	})
+	for _, arch := range archs {
+		if err := p.AppendImage(imgs[arch], layout.WithPlatform(*arch.ToOCIPlatform())); err != nil {
+			return fmt.Errorf("writing %s image to layout %s: %w", arch, path, err)
+		}
+	}
+	return nil
+}
+
+// indexImage returns the image of the platform in the index, looking into
+// the indexes it holds. An image without a platform is the one of any
+// platform, as layouts of a single image often have none.
+func indexImage(idx v1.ImageIndex, platform v1.Platform) (v1.Image, error) {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range manifest.Manifests {
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if img, err := indexImage(child, platform); err == nil {
+				return img, nil
+			}
+		case desc.MediaType.IsImage():
+			if desc.Platform != nil && !desc.Platform.Satisfies(platform) {
+				continue
+			}
+			return idx.Image(desc.Digest)
+		}
+	}
+	return nil, fmt.Errorf("no image for %s", platform)
+}
@@ -0,0 +1,51 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/sigstore/cosign/v2/pkg/oci"
+	"github.com/sigstore/cosign/v2/pkg/oci/signed"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+func TestWriteLayout(t *testing.T) {
+	imgs := map[types.Architecture]oci.SignedImage{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := random.Image(1024, 2)
+		require.NoError(t, err)
+		imgs[types.ParseArchitecture(arch)] = signed.Image(img)
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, WriteLayout(dir, imgs))
+
+	for arch, img := range imgs {
+		got, err := BaseImage(types.BaseImage{Layout: dir}, arch)
+		require.NoError(t, err)
+		want, err := img.Digest()
+		require.NoError(t, err)
+		digest, err := got.Digest()
+		require.NoError(t, err)
+		require.Equal(t, want, digest, "image of %s", arch)
+	}
+
+	_, err := BaseImage(types.BaseImage{Layout: dir}, types.ParseArchitecture("riscv64"))
+	require.Error(t, err)
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	ociremote "github.com/sigstore/cosign/v2/pkg/oci/remote"
+
+	"chainguard.dev/apko/pkg/log"
+)
+
+// CopyWithReferrers copies an image or index to another reference, along
+// with what is attached to it and to its images: the signatures, attestations
+// and SBOMs cosign attaches with tags, and the referrers of the OCI
+// distribution spec. The manifests are copied as they are, so the copy has the
+// same digest as the source, which is returned.
+func CopyWithReferrers(ctx context.Context, src, dst string, logger log.Logger) (name.Digest, error) {
+	srcRef, err := name.ParseReference(src)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("parsing %s: %w", src, err)
+	}
+	dstRef, err := name.ParseReference(dst)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("parsing %s: %w", dst, err)
+	}
+	ropts := []remote.Option{remote.WithAuthFromKeychain(keychain), remote.WithContext(ctx)}
+	copts := []crane.Option{crane.WithAuthFromKeychain(keychain), crane.WithContext(ctx)}
+
+	desc, err := remote.Get(srcRef, ropts...)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("getting %s: %w", src, err)
+	}
+	digests, err := manifestDigests(desc)
+	if err != nil {
+		return name.Digest{}, err
+	}
+
+	logger.Infof("Copying %s to %s", src, dst)
+	if err := crane.Copy(src, dst, copts...); err != nil {
+		return name.Digest{}, fmt.Errorf("copying %s to %s: %w", src, dst, err)
+	}
+	copied, err := remote.Head(dstRef, ropts...)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("getting %s: %w", dst, err)
+	}
+	if copied.Digest != desc.Digest {
+		return name.Digest{}, fmt.Errorf("%s has digest %s, not %s like %s", dst, copied.Digest, desc.Digest, src)
+	}
+
+	// the attached artifacts may themselves have attachments, such as the
+	// signatures of an attestation
+	seen := map[v1.Hash]bool{}
+	for len(digests) > 0 {
+		h := digests[0]
+		digests = digests[1:]
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+
+		srcDigest := srcRef.Context().Digest(h.String())
+		for _, attachedTag := range []func(name.Reference, ...ociremote.Option) (name.Tag, error){
+			ociremote.SignatureTag, ociremote.AttestationTag, ociremote.SBOMTag,
+		} {
+			tag, err := attachedTag(srcDigest)
+			if err != nil {
+				return name.Digest{}, err
+			}
+			if err := copyIfExists(tag, dstRef.Context().Tag(tag.TagStr()), ropts, copts, logger); err != nil {
+				return name.Digest{}, err
+			}
+		}
+
+		referrers, err := remote.Referrers(srcDigest, ropts...)
+		if err != nil {
+			return name.Digest{}, fmt.Errorf("getting referrers of %s: %w", srcDigest, err)
+		}
+		for _, m := range referrers.Manifests {
+			from := srcRef.Context().Digest(m.Digest.String())
+			to := dstRef.Context().Digest(m.Digest.String())
+			logger.Debugf("copying referrer %s of %s", m.Digest, h)
+			if err := crane.Copy(from.String(), to.String(), copts...); err != nil {
+				return name.Digest{}, fmt.Errorf("copying referrer %s: %w", from, err)
+			}
+			digests = append(digests, m.Digest)
+		}
+		// registries without the referrers API list the referrers in a tag
+		fallback := srcRef.Context().Tag(strings.Replace(h.String(), ":", "-", 1))
+		if err := copyIfExists(fallback, dstRef.Context().Tag(fallback.TagStr()), ropts, copts, logger); err != nil {
+			return name.Digest{}, err
+		}
+	}
+
+	return dstRef.Context().Digest(desc.Digest.String()), nil
+}
+
+// manifestDigests returns the digest of the manifest, and of all those under
+// it if it is an index.
+func manifestDigests(desc *remote.Descriptor) ([]v1.Hash, error) {
+	digests := []v1.Hash{desc.Digest}
+	if !desc.MediaType.IsIndex() {
+		return digests, nil
+	}
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	return indexDigests(idx, digests)
+}
+
+func indexDigests(idx v1.ImageIndex, digests []v1.Hash) ([]v1.Hash, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range im.Manifests {
+		digests = append(digests, m.Digest)
+		if !m.MediaType.IsIndex() {
+			continue
+		}
+		child, err := idx.ImageIndex(m.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if digests, err = indexDigests(child, digests); err != nil {
+			return nil, err
+		}
+	}
+	return digests, nil
+}
+
+// copyIfExists copies the tag to another one, if the tag exists.
+func copyIfExists(src, dst name.Tag, ropts []remote.Option, copts []crane.Option, logger log.Logger) error {
+	if _, err := remote.Head(src, ropts...); err != nil {
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return fmt.Errorf("getting %s: %w", src, err)
+	}
+	logger.Debugf("copying %s to %s", src, dst)
+	if err := crane.Copy(src.String(), dst.String(), copts...); err != nil {
+		return fmt.Errorf("copying %s to %s: %w", src, dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"context"
+	"errors"
+	"io"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/apko/pkg/log"
+)
+
+func TestCopyWithReferrers(t *testing.T) {
+	s := httptest.NewServer(registry.New(
+		registry.Logger(stdlog.New(io.Discard, "", 0)),
+		registry.WithReferrersSupport(true),
+	))
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "http://")
+	src, err := name.NewRepository(host + "/src")
+	require.NoError(t, err)
+	dst, err := name.NewRepository(host + "/dst")
+	require.NoError(t, err)
+
+	idx, err := random.Index(1024, 1, 2)
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteIndex(src.Tag("latest"), idx))
+	idxDigest, err := idx.Digest()
+	require.NoError(t, err)
+	im, err := idx.IndexManifest()
+	require.NoError(t, err)
+	child := im.Manifests[0].Digest
+
+	// tag pushes a random image to a tag of the source repository
+	tag := func(tag string) {
+		img, err := random.Image(256, 1)
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(src.Tag(tag), img))
+	}
+	// the signature of an image of the index, and the fallback tag of the
+	// referrers of that image
+	tag(attachedTag(child, ".sig"))
+	tag(attachedTag(child, ""))
+
+	// a referrer of the index, which is signed itself
+	desc, err := partial.Descriptor(idx)
+	require.NoError(t, err)
+	ri, err := random.Image(256, 1)
+	require.NoError(t, err)
+	referrer := mutate.Subject(ri, *desc).(v1.Image)
+	referrerDigest, err := referrer.Digest()
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(src.Digest(referrerDigest.String()), referrer))
+	tag(attachedTag(referrerDigest, ".sig"))
+
+	got, err := CopyWithReferrers(context.Background(), src.Tag("latest").String(), dst.Tag("latest").String(), log.NewLogger(io.Discard))
+	require.NoError(t, err)
+	require.Equal(t, dst.Digest(idxDigest.String()), got)
+
+	copied, err := remote.Head(dst.Tag("latest"))
+	require.NoError(t, err)
+	require.Equal(t, idxDigest, copied.Digest)
+	for _, ref := range []name.Reference{
+		dst.Tag(attachedTag(child, ".sig")),
+		dst.Tag(attachedTag(child, "")),
+		dst.Digest(referrerDigest.String()),
+		dst.Tag(attachedTag(referrerDigest, ".sig")),
+	} {
+		_, err := remote.Head(ref)
+		require.NoError(t, err, "%s is copied", ref)
+	}
+
+	// what is not attached to the source is not attached to the copy
+	_, err = remote.Head(dst.Tag(attachedTag(child, ".att")))
+	var terr *transport.Error
+	require.True(t, errors.As(err, &terr), "%s is not copied", attachedTag(child, ".att"))
+	require.Equal(t, http.StatusNotFound, terr.StatusCode)
+}
+
+// attachedTag returns the tag cosign attaches artifacts to the digest with,
+// with the suffix of the kind of artifact.
+func attachedTag(h v1.Hash, suffix string) string {
+	return h.Algorithm + "-" + h.Hex + suffix
+}
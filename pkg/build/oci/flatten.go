@@ -0,0 +1,165 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	v1tar "github.com/google/go-containerregistry/pkg/v1/tarball"
+	ggcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/sigstore/cosign/v2/pkg/oci"
+	"github.com/sigstore/cosign/v2/pkg/oci/signed"
+
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/log"
+)
+
+// FetchImages returns the image for each platform of the image or index at ref,
+// along with the media type of ref itself.
+func FetchImages(ref string, logger log.Logger) (imgs map[types.Architecture]v1.Image, mediaType ggcrtypes.MediaType, err error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing reference %s: %w", ref, err)
+	}
+	logger.Printf("fetching %s", r)
+	desc, err := remote.Get(r, remote.WithAuthFromKeychain(keychain))
+	if err != nil {
+		return nil, "", fmt.Errorf("fetching %s: %w", ref, err)
+	}
+
+	imgs = map[types.Architecture]v1.Image{}
+	if !desc.MediaType.IsIndex() {
+		img, err := desc.Image()
+		if err != nil {
+			return nil, "", fmt.Errorf("reading image %s: %w", ref, err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, "", fmt.Errorf("reading config of %s: %w", ref, err)
+		}
+		arch := platformArchitecture(&v1.Platform{Architecture: cfg.Architecture, Variant: cfg.Variant})
+		imgs[arch] = img
+		return imgs, desc.MediaType, nil
+	}
+
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, "", fmt.Errorf("reading index %s: %w", ref, err)
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, "", fmt.Errorf("reading index manifest of %s: %w", ref, err)
+	}
+	for _, m := range im.Manifests {
+		// skip anything which is not a runnable image, e.g. attestations
+		if m.Platform == nil || m.Platform.OS != "linux" || !m.MediaType.IsImage() {
+			continue
+		}
+		img, err := idx.Image(m.Digest)
+		if err != nil {
+			return nil, "", fmt.Errorf("reading image %s from index: %w", m.Digest, err)
+		}
+		imgs[platformArchitecture(m.Platform)] = img
+	}
+	if len(imgs) == 0 {
+		return nil, "", fmt.Errorf("no linux images found in %s", ref)
+	}
+	return imgs, desc.MediaType, nil
+}
+
+func platformArchitecture(p *v1.Platform) types.Architecture {
+	if p.Architecture == "arm" && p.Variant != "" {
+		return types.ParseArchitecture(fmt.Sprintf("%s/%s", p.Architecture, p.Variant))
+	}
+	return types.ParseArchitecture(p.Architecture)
+}
+
+// BuildFlattenedImage builds a single-layer image out of layerTarGZ, which holds
+// the squashed filesystem of orig. The runtime configuration and the annotations
+// of orig are kept, while its history is replaced by a single entry.
+func BuildFlattenedImage(orig v1.Image, layerTarGZ string, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string) (oci.SignedImage, error) {
+	manifest, err := orig.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	mediaType := ggcrtypes.OCILayer
+	if manifest.MediaType == ggcrtypes.DockerManifestSchema2 {
+		mediaType = ggcrtypes.DockerLayer
+	}
+	imageType := humanReadableImageType(mediaType)
+	logger.Printf("building flattened %s image from layer '%s'", imageType, layerTarGZ)
+
+	v1Layer, err := v1tar.LayerFromFile(layerTarGZ, v1tar.WithMediaType(mediaType))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s layer from tar.gz: %w", imageType, err)
+	}
+
+	cfg, err := orig.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Created = v1.Time{Time: created}
+	cfg.History = nil
+	cfg.RootFS = v1.RootFS{Type: "layers"}
+
+	v1Image := empty.Image
+	if mediaType == ggcrtypes.OCILayer {
+		v1Image = mutate.MediaType(v1Image, ggcrtypes.OCIManifestSchema1)
+		v1Image = mutate.ConfigMediaType(v1Image, ggcrtypes.OCIConfigJSON)
+	}
+	v1Image, err = mutate.ConfigFile(v1Image, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set %s config file: %w", imageType, err)
+	}
+	v1Image, err = mutate.Append(v1Image, mutate.Addendum{
+		Layer: v1Layer,
+		History: v1.History{
+			Author:    "apko",
+			Comment:   "This is an apko flattened single-layer image",
+			CreatedBy: "apko flatten",
+			Created:   v1.Time{Time: created},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to append %s layer to empty image: %w", imageType, err)
+	}
+
+	if mediaType != ggcrtypes.DockerLayer && len(manifest.Annotations) > 0 {
+		v1Image = mutate.Annotations(v1Image, manifest.Annotations).(v1.Image)
+	}
+
+	ent, err := attachSBOM(signed.Image(v1Image), sbomPath, sbomFormats, arch, logger)
+	if err != nil {
+		return nil, fmt.Errorf("attaching SBOM to image: %w", err)
+	}
+	return ent.(oci.SignedImage), nil
+}
+
+// PublishFlattenedImage builds a flattened image with BuildFlattenedImage and
+// publishes it.
+func PublishFlattenedImage(orig v1.Image, layerTarGZ string, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string, local bool, shouldPushTags bool, tags ...string) (name.Digest, oci.SignedImage, error) {
+	v1Image, err := BuildFlattenedImage(orig, layerTarGZ, created, arch, logger, sbomPath, sbomFormats)
+	if err != nil {
+		return name.Digest{}, nil, err
+	}
+	return publishImage(v1Image, logger, local, shouldPushTags, tags...)
+}
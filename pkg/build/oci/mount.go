@@ -0,0 +1,90 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sigstore/cosign/v2/pkg/oci"
+
+	"chainguard.dev/apko/pkg/log"
+)
+
+// mountSources remembers the first repository of each registry an image was
+// pushed to, so that pushing it to other repositories of the same registry
+// mounts its layers from there rather than uploading them again.
+type mountSources map[string]name.Repository
+
+// image returns the image to push to the repository of ref: the image itself
+// if it was not pushed to the registry yet, or else the image with its layers
+// mounted from where it was.
+func (m mountSources) image(img oci.SignedImage, ref name.Reference, logger log.Logger) oci.SignedImage {
+	from, ok := m[ref.Context().RegistryStr()]
+	if !ok || from.Name() == ref.Context().Name() {
+		return img
+	}
+	logger.Debugf("mounting the layers of %s from %s", ref, from)
+	return &mountedImage{SignedImage: img, from: from}
+}
+
+// pushed records that the image was pushed to the repository of ref.
+func (m mountSources) pushed(ref name.Reference) {
+	if _, ok := m[ref.Context().RegistryStr()]; !ok {
+		m[ref.Context().RegistryStr()] = ref.Context()
+	}
+}
+
+// mountedImage is an image whose layers are in another repository of the
+// registry it is pushed to, which remote.Write mounts instead of uploading.
+type mountedImage struct {
+	oci.SignedImage
+	from name.Repository
+}
+
+func (i *mountedImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.SignedImage.Layers()
+	if err != nil {
+		return nil, err
+	}
+	mounted := make([]v1.Layer, 0, len(layers))
+	for _, l := range layers {
+		ml, err := i.mount(l)
+		if err != nil {
+			return nil, err
+		}
+		mounted = append(mounted, ml)
+	}
+	return mounted, nil
+}
+
+func (i *mountedImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := i.SignedImage.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.mount(l)
+}
+
+func (i *mountedImage) mount(l v1.Layer) (v1.Layer, error) {
+	if _, ok := l.(*remote.MountableLayer); ok {
+		return l, nil
+	}
+	h, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	return &remote.MountableLayer{Layer: l, Reference: i.from.Digest(h.String())}, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"io"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sigstore/cosign/v2/pkg/oci/signed"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/apko/pkg/log"
+)
+
+// countingRegistry is a registry counting the blobs mounted into each
+// repository, and the blob uploads each repository gets otherwise. Unlike
+// the registry it wraps, it has the blobs in the repositories they were
+// pushed or mounted to only, as registries do.
+type countingRegistry struct {
+	handler http.Handler
+
+	mu      sync.Mutex
+	blobs   map[string]map[string]bool
+	mounts  map[string]int
+	uploads map[string]int
+}
+
+func newCountingRegistry() *countingRegistry {
+	return &countingRegistry{
+		handler: registry.New(registry.Logger(stdlog.New(io.Discard, "", 0))),
+		blobs:   map[string]map[string]bool{},
+		mounts:  map[string]int{},
+		uploads: map[string]int{},
+	}
+}
+
+func (r *countingRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if repo, digest, ok := strings.Cut(path, "/blobs/"); ok && req.Method == http.MethodHead && !r.blobs[repo][digest] {
+		http.NotFound(w, req)
+		return
+	}
+	if repo, _, ok := strings.Cut(path, "/blobs/uploads/"); ok {
+		q := req.URL.Query()
+		switch {
+		case req.Method == http.MethodPost && q.Get("mount") != "":
+			r.mounts[repo]++
+			r.add(repo, q.Get("mount"))
+		case req.Method == http.MethodPost:
+			r.uploads[repo]++
+		case req.Method == http.MethodPut:
+			r.add(repo, q.Get("digest"))
+		}
+	}
+	r.handler.ServeHTTP(w, req)
+}
+
+func (r *countingRegistry) add(repo, digest string) {
+	if r.blobs[repo] == nil {
+		r.blobs[repo] = map[string]bool{}
+	}
+	r.blobs[repo][digest] = true
+}
+
+func TestMountSources(t *testing.T) {
+	reg := newCountingRegistry()
+	s := httptest.NewServer(reg)
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "http://")
+	logger := log.NewLogger(io.Discard)
+
+	ri, err := random.Image(1024, 3)
+	require.NoError(t, err)
+	img := signed.Image(ri)
+	m := mountSources{}
+
+	first, err := name.ParseReference(host + "/first:latest")
+	require.NoError(t, err)
+	pushed := m.image(img, first, logger)
+	_, mounted := pushed.(*mountedImage)
+	require.False(t, mounted, "nothing to mount from yet")
+	require.NoError(t, remote.Write(first, pushed))
+	m.pushed(first)
+	require.Zero(t, reg.mounts["first"])
+	require.Equal(t, 4, reg.uploads["first"], "the layers and the config are uploaded")
+
+	// the repository the layers are in needs no mounts
+	again, err := name.ParseReference(host + "/first:again")
+	require.NoError(t, err)
+	_, mounted = m.image(img, again, logger).(*mountedImage)
+	require.False(t, mounted)
+
+	// another repository of the registry mounts the layers from the first
+	second, err := name.ParseReference(host + "/second:latest")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(second, m.image(img, second, logger)))
+	m.pushed(second)
+	require.Equal(t, 3, reg.mounts["second"])
+	require.Equal(t, 1, reg.uploads["second"], "only the config is uploaded")
+
+	want, err := img.Digest()
+	require.NoError(t, err)
+	got, err := remote.Image(second)
+	require.NoError(t, err)
+	digest, err := got.Digest()
+	require.NoError(t, err)
+	require.Equal(t, want, digest)
+	layers, err := got.Layers()
+	require.NoError(t, err)
+	for _, l := range layers {
+		rc, err := l.Compressed()
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, rc)
+		require.NoError(t, err, "the mounted layers are in the repository")
+		rc.Close()
+	}
+
+	// the layers are mounted from the first repository still
+	m.pushed(second)
+	require.Equal(t, first.Context(), m[first.Context().RegistryStr()])
+
+	// another registry has nothing to mount from
+	other, err := name.ParseReference("registry.example.com/third:latest")
+	require.NoError(t, err)
+	_, mounted = m.image(img, other, logger).(*mountedImage)
+	require.False(t, mounted)
+}
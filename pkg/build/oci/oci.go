@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -69,44 +70,71 @@ var keychain = authn.NewMultiKeychain(
 )
 
 func BuildImageFromLayer(layerTarGZ string, ic types.ImageConfiguration, logger log.Logger, opts options.Options) (oci.SignedImage, error) {
-	return buildImageFromLayerWithMediaType(ggcrtypes.OCILayer, layerTarGZ, ic, opts.SourceDateEpoch, opts.Arch, logger, opts.SBOMPath, opts.SBOMFormats)
+	return BuildImageFromLayers([]string{layerTarGZ}, ic, logger, opts)
 }
 func BuildDockerImageFromLayer(layerTarGZ string, ic types.ImageConfiguration, logger log.Logger, opts options.Options) (oci.SignedImage, error) {
-	return buildImageFromLayerWithMediaType(ggcrtypes.DockerLayer, layerTarGZ, ic, opts.SourceDateEpoch, opts.Arch, logger, opts.SBOMPath, opts.SBOMFormats)
+	return BuildDockerImageFromLayers([]string{layerTarGZ}, ic, logger, opts)
 }
 
-func buildImageFromLayerWithMediaType(mediaType ggcrtypes.MediaType, layerTarGZ string, ic types.ImageConfiguration, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string) (oci.SignedImage, error) {
+// BuildImageFromLayers is like BuildImageFromLayer, but builds an image with
+// each of the layers, in order.
+func BuildImageFromLayers(layerTarGZs []string, ic types.ImageConfiguration, logger log.Logger, opts options.Options) (oci.SignedImage, error) {
+	return buildImageFromLayersWithMediaType(ggcrtypes.OCILayer, layerTarGZs, ic, opts.SourceDateEpoch, opts.Arch, logger, opts.SBOMPath, opts.SBOMFormats)
+}
+func BuildDockerImageFromLayers(layerTarGZs []string, ic types.ImageConfiguration, logger log.Logger, opts options.Options) (oci.SignedImage, error) {
+	return buildImageFromLayersWithMediaType(ggcrtypes.DockerLayer, layerTarGZs, ic, opts.SourceDateEpoch, opts.Arch, logger, opts.SBOMPath, opts.SBOMFormats)
+}
+
+func buildImageFromLayersWithMediaType(mediaType ggcrtypes.MediaType, layerTarGZs []string, ic types.ImageConfiguration, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string) (oci.SignedImage, error) {
 	imageType := humanReadableImageType(mediaType)
-	logger.Printf("building %s image from layer '%s'", imageType, layerTarGZ)
 
-	v1Layer, err := v1tar.LayerFromFile(layerTarGZ, v1tar.WithMediaType(mediaType))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create %s layer from tar.gz: %w", imageType, err)
-	}
+	v1Layers := make([]v1.Layer, 0, len(layerTarGZs))
+	for _, layerTarGZ := range layerTarGZs {
+		logger.Printf("building %s image from layer '%s'", imageType, layerTarGZ)
 
-	digest, err := v1Layer.Digest()
-	if err != nil {
-		return nil, fmt.Errorf("could not calculate layer digest: %w", err)
-	}
+		v1Layer, err := v1tar.LayerFromFile(layerTarGZ, v1tar.WithMediaType(mediaType))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s layer from tar.gz: %w", imageType, err)
+		}
 
-	diffid, err := v1Layer.DiffID()
-	if err != nil {
-		return nil, fmt.Errorf("could not calculate layer diff id: %w", err)
+		digest, err := v1Layer.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("could not calculate layer digest: %w", err)
+		}
+
+		diffid, err := v1Layer.DiffID()
+		if err != nil {
+			return nil, fmt.Errorf("could not calculate layer diff id: %w", err)
+		}
+
+		logger.Printf("%s layer digest: %v", imageType, digest)
+		logger.Printf("%s layer diffID: %v", imageType, diffid)
+		v1Layers = append(v1Layers, v1Layer)
 	}
 
-	logger.Printf("%s layer digest: %v", imageType, digest)
-	logger.Printf("%s layer diffID: %v", imageType, diffid)
+	return buildImageFromV1Layers(mediaType, v1Layers, ic, created, arch, logger, sbomPath, sbomFormats)
+}
 
-	adds := make([]mutate.Addendum, 0, 1)
-	adds = append(adds, mutate.Addendum{
-		Layer: v1Layer,
-		History: v1.History{
-			Author:    "apko",
-			Comment:   "This is an apko single-layer image",
-			CreatedBy: "apko",
-			Created:   v1.Time{Time: created},
-		},
-	})
+// buildImageFromV1Layers assembles an image around existing layers, in order.
+func buildImageFromV1Layers(mediaType ggcrtypes.MediaType, v1Layers []v1.Layer, ic types.ImageConfiguration, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string) (oci.SignedImage, error) {
+	imageType := humanReadableImageType(mediaType)
+
+	adds := make([]mutate.Addendum, 0, len(v1Layers))
+	for i, v1Layer := range v1Layers {
+		comment := "This is an apko single-layer image"
+		if len(v1Layers) > 1 {
+			comment = fmt.Sprintf("This is layer %d of %d of an apko image", i+1, len(v1Layers))
+		}
+		adds = append(adds, mutate.Addendum{
+			Layer: v1Layer,
+			History: v1.History{
+				Author:    "apko",
+				Comment:   comment,
+				CreatedBy: "apko",
+				Created:   v1.Time{Time: created},
+			},
+		})
+	}
 
 	emptyImage := empty.Image
 	if mediaType == ggcrtypes.OCILayer {
@@ -114,6 +142,15 @@ func buildImageFromLayerWithMediaType(mediaType ggcrtypes.MediaType, layerTarGZ
 		emptyImage = mutate.MediaType(emptyImage, ggcrtypes.OCIManifestSchema1)
 		emptyImage = mutate.ConfigMediaType(emptyImage, ggcrtypes.OCIConfigJSON)
 	}
+	// the layers of a base image come first, and its configuration is kept
+	// unless the image configuration overrides it
+	if ic.Base.Set() {
+		base, err := BaseImage(ic.Base, arch)
+		if err != nil {
+			return nil, err
+		}
+		emptyImage = base
+	}
 	v1Image, err := mutate.Append(emptyImage, adds...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to append %s layer to empty image: %w", imageType, err)
@@ -129,6 +166,11 @@ func buildImageFromLayerWithMediaType(mediaType ggcrtypes.MediaType, layerTarGZ
 			annotations["org.opencontainers.image.revision"] = hash
 		}
 	}
+	// registries read these as annotations or labels, so set both
+	expiry := ic.Expiry.Annotations()
+	for k, v := range expiry {
+		annotations[k] = v
+	}
 
 	if mediaType != ggcrtypes.DockerLayer && len(annotations) > 0 {
 		v1Image = mutate.Annotations(v1Image, annotations).(v1.Image)
@@ -145,7 +187,12 @@ func buildImageFromLayerWithMediaType(mediaType ggcrtypes.MediaType, layerTarGZ
 	cfg.Architecture = platform.Architecture
 	cfg.Variant = platform.Variant
 	cfg.Created = v1.Time{Time: created}
-	cfg.Config.Labels = make(map[string]string)
+	if cfg.Config.Labels == nil {
+		cfg.Config.Labels = make(map[string]string)
+	}
+	for k, v := range expiry {
+		cfg.Config.Labels[k] = v
+	}
 	cfg.OS = "linux"
 
 	// NOTE: Need to allow empty Entrypoints. The runtime will override to `/bin/sh -c` and handle quoting
@@ -172,7 +219,9 @@ func buildImageFromLayerWithMediaType(mediaType ggcrtypes.MediaType, layerTarGZ
 		cfg.Config.WorkingDir = ic.WorkDir
 	}
 
-	if len(ic.Environment) > 0 {
+	if ic.Base.Set() {
+		cfg.Config.Env = overrideEnv(cfg.Config.Env, ic.Environment)
+	} else if len(ic.Environment) > 0 {
 		envs := []string{}
 
 		for k, v := range ic.Environment {
@@ -182,10 +231,7 @@ func buildImageFromLayerWithMediaType(mediaType ggcrtypes.MediaType, layerTarGZ
 
 		cfg.Config.Env = envs
 	} else {
-		cfg.Config.Env = []string{
-			"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-			"SSL_CERT_FILE=/etc/ssl/certs/ca-certificates.crt",
-		}
+		cfg.Config.Env = overrideEnv(nil, types.DefaultEnvironment)
 	}
 
 	if ic.Accounts.RunAs != "" {
@@ -193,7 +239,44 @@ func buildImageFromLayerWithMediaType(mediaType ggcrtypes.MediaType, layerTarGZ
 	}
 
 	if ic.StopSignal != "" {
-		cfg.Config.StopSignal = ic.StopSignal
+		sig, err := types.StopSignalName(ic.StopSignal)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Config.StopSignal = sig
+	}
+
+	ports, err := ic.ExposedPortSet()
+	if err != nil {
+		return nil, err
+	}
+	if len(ports) != 0 {
+		cfg.Config.ExposedPorts = ports
+	}
+
+	if h := ic.Healthcheck; h != nil {
+		test := []string{"CMD-SHELL", h.ShellFragment}
+		if h.Command != "" {
+			splitcmd, err := shlex.Split(h.Command)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse healthcheck command: %w", err)
+			}
+			test = append([]string{"CMD"}, splitcmd...)
+		}
+		cfg.Config.Healthcheck = &v1.HealthConfig{
+			Test:        test,
+			Interval:    h.Interval,
+			Timeout:     h.Timeout,
+			StartPeriod: h.StartPeriod,
+			Retries:     h.Retries,
+		}
+	}
+
+	if len(ic.Volumes) != 0 {
+		cfg.Config.Volumes = make(map[string]struct{}, len(ic.Volumes))
+		for _, v := range ic.Volumes {
+			cfg.Config.Volumes[path.Clean(v.Path)] = struct{}{}
+		}
 	}
 
 	v1Image, err = mutate.ConfigFile(v1Image, cfg)
@@ -211,6 +294,26 @@ func buildImageFromLayerWithMediaType(mediaType ggcrtypes.MediaType, layerTarGZ
 	return ent.(oci.SignedImage), nil
 }
 
+// overrideEnv returns the environment of a base image, with the variables of
+// the image configuration set on top of it.
+func overrideEnv(base []string, env map[string]string) []string {
+	envs := make([]string, 0, len(base)+len(env))
+	for _, e := range base {
+		k, _, _ := strings.Cut(e, "=")
+		if _, ok := env[k]; !ok {
+			envs = append(envs, e)
+		}
+	}
+	added := make([]string, 0, len(env))
+	for k, v := range env {
+		added = append(added, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(added)
+	return append(envs, added...)
+}
+
+// Copy copies an image or index to another reference. Within a registry, the
+// blobs are mounted from the source repository rather than uploaded again.
 func Copy(src, dst string) error {
 	log.DefaultLogger().Infof("Copying %s to %s", src, dst)
 	if err := crane.Copy(src, dst, crane.WithAuthFromKeychain(keychain)); err != nil {
@@ -219,6 +322,15 @@ func Copy(src, dst string) error {
 	return nil
 }
 
+// FetchImage fetches a published image.
+func FetchImage(digest name.Digest) (oci.SignedImage, error) {
+	img, err := remote.Image(digest, remote.WithAuthFromKeychain(keychain))
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", digest, err)
+	}
+	return signed.Image(img), nil
+}
+
 // PostAttachSBOM attaches the sboms to an already published image
 func PostAttachSBOM(si oci.SignedEntity, sbomPath string, sbomFormats []string,
 	arch types.Architecture, logger log.Logger, tags ...string,
@@ -309,7 +421,7 @@ func BuildImageTarballFromLayer(imageRef string, layerTarGZ string, outputTarGZ
 
 func buildImageTarballFromLayerWithMediaType(mediaType ggcrtypes.MediaType, imageRef string, layerTarGZ string, outputTarGZ string, ic types.ImageConfiguration, logger log.Logger, opts options.Options) error {
 	imageType := humanReadableImageType(mediaType)
-	v1Image, err := buildImageFromLayerWithMediaType(mediaType, layerTarGZ, ic, opts.SourceDateEpoch, opts.Arch, logger, opts.SBOMPath, opts.SBOMFormats)
+	v1Image, err := buildImageFromLayersWithMediaType(mediaType, []string{layerTarGZ}, ic, opts.SourceDateEpoch, opts.Arch, logger, opts.SBOMPath, opts.SBOMFormats)
 	if err != nil {
 		return err
 	}
@@ -379,19 +491,35 @@ func publishTagFromImage(image oci.SignedImage, imageRef string, hash v1.Hash, l
 }
 
 func PublishImageFromLayer(layerTarGZ string, ic types.ImageConfiguration, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string, local bool, shouldPushTags bool, tags ...string) (name.Digest, oci.SignedImage, error) {
-	return publishImageFromLayerWithMediaType(ggcrtypes.OCILayer, layerTarGZ, ic, created, arch, logger, sbomPath, sbomFormats, local, shouldPushTags, tags...)
+	return publishImageFromLayersWithMediaType(ggcrtypes.OCILayer, []string{layerTarGZ}, ic, created, arch, logger, sbomPath, sbomFormats, local, shouldPushTags, tags...)
 }
 
 func PublishDockerImageFromLayer(layerTarGZ string, ic types.ImageConfiguration, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string, local bool, shouldPushTags bool, tags ...string) (name.Digest, oci.SignedImage, error) {
-	return publishImageFromLayerWithMediaType(ggcrtypes.DockerLayer, layerTarGZ, ic, created, arch, logger, sbomPath, sbomFormats, local, shouldPushTags, tags...)
+	return publishImageFromLayersWithMediaType(ggcrtypes.DockerLayer, []string{layerTarGZ}, ic, created, arch, logger, sbomPath, sbomFormats, local, shouldPushTags, tags...)
 }
 
-func publishImageFromLayerWithMediaType(mediaType ggcrtypes.MediaType, layerTarGZ string, ic types.ImageConfiguration, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string, local bool, shouldPushTags bool, tags ...string) (name.Digest, oci.SignedImage, error) {
-	v1Image, err := buildImageFromLayerWithMediaType(mediaType, layerTarGZ, ic, created, arch, logger, sbomPath, sbomFormats)
+// PublishImageFromLayers is like PublishImageFromLayer, but publishes an
+// image with each of the layers, in order.
+func PublishImageFromLayers(layerTarGZs []string, ic types.ImageConfiguration, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string, local bool, shouldPushTags bool, tags ...string) (name.Digest, oci.SignedImage, error) {
+	return publishImageFromLayersWithMediaType(ggcrtypes.OCILayer, layerTarGZs, ic, created, arch, logger, sbomPath, sbomFormats, local, shouldPushTags, tags...)
+}
+
+func PublishDockerImageFromLayers(layerTarGZs []string, ic types.ImageConfiguration, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string, local bool, shouldPushTags bool, tags ...string) (name.Digest, oci.SignedImage, error) {
+	return publishImageFromLayersWithMediaType(ggcrtypes.DockerLayer, layerTarGZs, ic, created, arch, logger, sbomPath, sbomFormats, local, shouldPushTags, tags...)
+}
+
+func publishImageFromLayersWithMediaType(mediaType ggcrtypes.MediaType, layerTarGZs []string, ic types.ImageConfiguration, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string, local bool, shouldPushTags bool, tags ...string) (name.Digest, oci.SignedImage, error) {
+	v1Image, err := buildImageFromLayersWithMediaType(mediaType, layerTarGZs, ic, created, arch, logger, sbomPath, sbomFormats)
 	if err != nil {
 		return name.Digest{}, nil, err
 	}
 
+	return publishImage(v1Image, logger, local, shouldPushTags, tags...)
+}
+
+// publishImage pushes an already built image to each of the tags, or by digest
+// only to the repository of the first tag if shouldPushTags is false.
+func publishImage(v1Image oci.SignedImage, logger log.Logger, local bool, shouldPushTags bool, tags ...string) (name.Digest, oci.SignedImage, error) {
 	h, err := v1Image.Digest()
 	if err != nil {
 		return name.Digest{}, nil, fmt.Errorf("failed to compute digest: %w", err)
@@ -399,12 +527,22 @@ func publishImageFromLayerWithMediaType(mediaType ggcrtypes.MediaType, layerTarG
 
 	digest := name.Digest{}
 	if shouldPushTags {
+		mounts := mountSources{}
 		for _, tag := range tags {
 			logger.Printf("publishing image tag %v", tag)
-			digest, err = publishTagFromImage(v1Image, tag, h, local, logger)
+			img := v1Image
+			if !local {
+				ref, err := name.ParseReference(tag)
+				if err != nil {
+					return name.Digest{}, nil, fmt.Errorf("unable to parse reference: %w", err)
+				}
+				img = mounts.image(v1Image, ref, logger)
+			}
+			digest, err = publishTagFromImage(img, tag, h, local, logger)
 			if err != nil {
 				return name.Digest{}, nil, err
 			}
+			mounts.pushed(digest)
 		}
 	} else {
 		logger.Printf("publishing image without tag (digest only)")
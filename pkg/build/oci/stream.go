@@ -0,0 +1,128 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/stream"
+	ggcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/sigstore/cosign/v2/pkg/oci"
+
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/log"
+)
+
+// PublishImageFromLayerStream is like PublishImageFromLayer, but takes an
+// uncompressed layer tarball as a stream. The layer is compressed and pushed
+// to the repository of the first tag while it is being read, and the manifest
+// is pushed once the layer is complete.
+func PublishImageFromLayerStream(layerTar io.ReadCloser, ic types.ImageConfiguration, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string, shouldPushTags bool, tags ...string) (name.Digest, oci.SignedImage, error) {
+	return publishImageFromLayerStreamWithMediaType(ggcrtypes.OCILayer, layerTar, ic, created, arch, logger, sbomPath, sbomFormats, shouldPushTags, tags...)
+}
+
+func PublishDockerImageFromLayerStream(layerTar io.ReadCloser, ic types.ImageConfiguration, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string, shouldPushTags bool, tags ...string) (name.Digest, oci.SignedImage, error) {
+	return publishImageFromLayerStreamWithMediaType(ggcrtypes.DockerLayer, layerTar, ic, created, arch, logger, sbomPath, sbomFormats, shouldPushTags, tags...)
+}
+
+func publishImageFromLayerStreamWithMediaType(mediaType ggcrtypes.MediaType, layerTar io.ReadCloser, ic types.ImageConfiguration, created time.Time, arch types.Architecture, logger log.Logger, sbomPath string, sbomFormats []string, shouldPushTags bool, tags ...string) (name.Digest, oci.SignedImage, error) {
+	defer layerTar.Close()
+
+	if len(tags) == 0 {
+		return name.Digest{}, nil, errors.New("no tags to publish the image to")
+	}
+	ref, err := name.ParseReference(tags[0])
+	if err != nil {
+		return name.Digest{}, nil, fmt.Errorf("unable to parse reference: %w", err)
+	}
+	repo := ref.Context()
+
+	imageType := humanReadableImageType(mediaType)
+	logger.Printf("streaming %s layer to %s", imageType, repo)
+
+	// The digest and diffID of a streamed layer are computed as it is
+	// uploaded, and are only available once it has been consumed.
+	sl := stream.NewLayer(layerTar)
+	if err := remote.WriteLayer(repo, sl, remote.WithAuthFromKeychain(keychain)); err != nil {
+		return name.Digest{}, nil, fmt.Errorf("failed to stream %s layer: %w", imageType, err)
+	}
+
+	digest, err := sl.Digest()
+	if err != nil {
+		return name.Digest{}, nil, fmt.Errorf("could not calculate layer digest: %w", err)
+	}
+	diffid, err := sl.DiffID()
+	if err != nil {
+		return name.Digest{}, nil, fmt.Errorf("could not calculate layer diff id: %w", err)
+	}
+	size, err := sl.Size()
+	if err != nil {
+		return name.Digest{}, nil, fmt.Errorf("could not calculate layer size: %w", err)
+	}
+
+	logger.Printf("%s layer digest: %v", imageType, digest)
+	logger.Printf("%s layer diffID: %v", imageType, diffid)
+
+	// The stream cannot be read twice, so refer to the uploaded blob from
+	// here on. Tags in other repositories mount it from there, which only
+	// falls back to downloading it again across registries.
+	blobRef := repo.Digest(digest.String())
+	rl, err := remote.Layer(blobRef, remote.WithAuthFromKeychain(keychain))
+	if err != nil {
+		return name.Digest{}, nil, fmt.Errorf("failed to reference streamed %s layer: %w", imageType, err)
+	}
+	v1Layer := &remote.MountableLayer{
+		Layer: &streamedLayer{
+			Layer:     rl,
+			digest:    digest,
+			diffID:    diffid,
+			size:      size,
+			mediaType: mediaType,
+		},
+		Reference: blobRef,
+	}
+
+	v1Image, err := buildImageFromV1Layers(mediaType, []v1.Layer{v1Layer}, ic, created, arch, logger, sbomPath, sbomFormats)
+	if err != nil {
+		return name.Digest{}, nil, err
+	}
+
+	return publishImage(v1Image, logger, false, shouldPushTags, tags...)
+}
+
+// streamedLayer is a layer which has already been uploaded, whose
+// metadata was recorded while streaming so it needn't be fetched back.
+type streamedLayer struct {
+	v1.Layer
+
+	digest    v1.Hash
+	diffID    v1.Hash
+	size      int64
+	mediaType ggcrtypes.MediaType
+}
+
+func (l *streamedLayer) Digest() (v1.Hash, error) { return l.digest, nil }
+
+func (l *streamedLayer) DiffID() (v1.Hash, error) { return l.diffID, nil }
+
+func (l *streamedLayer) Size() (int64, error) { return l.size, nil }
+
+func (l *streamedLayer) MediaType() (ggcrtypes.MediaType, error) { return l.mediaType, nil }
@@ -16,10 +16,17 @@ package build
 
 import (
 	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	apkimpl "chainguard.dev/apko/pkg/apk/impl"
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
 	"chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/apko/pkg/log"
+	"chainguard.dev/apko/pkg/tarball"
 )
 
 // Option is an option for the build context.
@@ -204,6 +211,52 @@ func WithAnnotations(annotations map[string]string) Option {
 	}
 }
 
+// WithAnnotationsFromEnvironment adds annotations taken from environment
+// variables starting with prefix, e.g. APKO_ANNOTATION_CI_RUN_ID=1234 becomes
+// ci-run-id=1234. Annotations which are already set take precedence over
+// those coming from the environment. An empty prefix disables the lookup.
+func WithAnnotationsFromEnvironment(prefix string) Option {
+	return func(bc *Context) error {
+		annotations, skipped := annotationsFromEnviron(prefix, os.Environ())
+		for _, k := range skipped {
+			bc.Logger().Warnf("ignoring environment variable %s: no valid annotation key or value", k)
+		}
+		if len(annotations) == 0 {
+			return nil
+		}
+
+		if bc.ImageConfiguration.Annotations == nil {
+			bc.ImageConfiguration.Annotations = map[string]string{}
+		}
+		for k, v := range annotations {
+			if _, ok := bc.ImageConfiguration.Annotations[k]; ok {
+				bc.Logger().Debugf("annotation %s already set, not overriding from environment", k)
+				continue
+			}
+			bc.ImageConfiguration.Annotations[k] = v
+		}
+		return nil
+	}
+}
+
+// WithExpiry stamps the images for registries to clean them up after the
+// given time, e.g. 2w, or by the policy of the given tier, overriding the
+// configuration. Empty values keep the ones of the configuration.
+func WithExpiry(expiresAfter, tier string) Option {
+	return func(bc *Context) error {
+		if expiresAfter != "" {
+			bc.ImageConfiguration.Expiry.ExpiresAfter = expiresAfter
+		}
+		if tier != "" {
+			bc.ImageConfiguration.Expiry.Tier = tier
+		}
+		bc.checks = append(bc.checks, func(bc *Context) error {
+			return bc.ImageConfiguration.Expiry.Validate()
+		})
+		return nil
+	}
+}
+
 // WithTagSuffix sets a tag suffix to use, e.g. `-glibc`.
 func WithTagSuffix(tagSuffix string) Option {
 	return func(bc *Context) error {
@@ -228,6 +281,322 @@ func WithStageTags(stageTags string) Option {
 	}
 }
 
+// WithStreamLayers sets whether to stream image layers straight to the
+// registry as they are built, instead of writing them to disk first.
+func WithStreamLayers(stream bool) Option {
+	return func(bc *Context) error {
+		bc.Options.StreamLayers = stream
+		return nil
+	}
+}
+
+// WithSkipVariants sets whether to skip building the variants
+// declared in the image configuration.
+func WithSkipVariants(skip bool) Option {
+	return func(bc *Context) error {
+		bc.Options.SkipVariants = skip
+		return nil
+	}
+}
+
+// WithFileMutators adds mutators which are called with the header and
+// content of each file of the image layer as it is written, for embedders
+// to transform or inspect files without another pass over the image.
+func WithFileMutators(mutators ...tarball.FileMutator) Option {
+	return func(bc *Context) error {
+		bc.Options.FileMutators = append(bc.Options.FileMutators, mutators...)
+		return nil
+	}
+}
+
+// WithJobs sets how many architectures are built at once, or all of them if
+// jobs is not positive.
+func WithJobs(jobs int) Option {
+	return func(bc *Context) error {
+		bc.Options.Jobs = jobs
+		return nil
+	}
+}
+
+// WithProgress reports how installing the packages of the image goes to
+// the progress, e.g. to show a progress bar.
+func WithProgress(progress apkimpl.Progress) Option {
+	return func(bc *Context) error {
+		bc.Options.Progress = progress
+		return nil
+	}
+}
+
+// WithHardened enables all the limits on how much of the indexes and
+// packages is read, for builds whose inputs cannot be trusted, e.g. on a
+// server building images for others.
+func WithHardened(hardened bool) Option {
+	return func(bc *Context) error {
+		if hardened {
+			bc.Options.InputLimits = apkimpl.HardenedInputLimits()
+		}
+		return nil
+	}
+}
+
+// WithOffline forbids any network access while building, e.g. for hermetic
+// builds: the build fails, listing what it would download, unless keys,
+// indexes and packages are all local.
+func WithOffline(offline bool) Option {
+	return func(bc *Context) error {
+		bc.Options.Offline = offline
+		return nil
+	}
+}
+
+// WithFetchLimits caps the concurrent connections and the bandwidth used to
+// download keys, indexes and packages. The limits are shared by all the
+// builds given the option, e.g. those of the architectures of an image.
+func WithFetchLimits(limits apkimpl.FetchLimits) Option {
+	var transport http.RoundTripper
+	if !limits.IsZero() {
+		transport = apkimpl.NewLimitedTransport(nil, limits)
+	}
+	return func(bc *Context) error {
+		if transport != nil {
+			bc.Options.Transport = transport
+		}
+		return nil
+	}
+}
+
+// WithUserAgent sets the User-Agent of the requests for keys, indexes and
+// packages.
+func WithUserAgent(userAgent string) Option {
+	return func(bc *Context) error {
+		bc.Options.UserAgent = userAgent
+		return nil
+	}
+}
+
+// WithHeaders adds headers, each as "Name: value", to the requests for keys,
+// indexes and packages to the hosts of the repositories, e.g. for mirrors
+// which route or rate limit by them.
+func WithHeaders(headers []string) Option {
+	return func(bc *Context) error {
+		for _, h := range headers {
+			name, value, ok := strings.Cut(h, ":")
+			name = strings.TrimSpace(name)
+			if !ok || name == "" || strings.ContainsAny(name, " \t") {
+				return fmt.Errorf("invalid header %q, must be \"Name: value\"", h)
+			}
+			if bc.Options.Headers == nil {
+				bc.Options.Headers = http.Header{}
+			}
+			bc.Options.Headers.Add(name, strings.TrimSpace(value))
+		}
+		return nil
+	}
+}
+
+// WithVars sets variables of the configuration, each as "NAME=value", which
+// take precedence over the environment and the defaults of the configuration.
+func WithVars(vars []string) Option {
+	return func(bc *Context) error {
+		for _, v := range vars {
+			name, value, ok := strings.Cut(v, "=")
+			if !ok || name == "" {
+				return fmt.Errorf("invalid variable %q, must be \"NAME=value\"", v)
+			}
+			if bc.Options.Vars == nil {
+				bc.Options.Vars = map[string]string{}
+			}
+			bc.Options.Vars[name] = value
+		}
+		return nil
+	}
+}
+
+// WithResolverStrategy sets which of the versions meeting the constraints
+// are installed: the highest, by default, or the lowest, e.g. to test that
+// the constraints are not looser than what the packages work with.
+func WithResolverStrategy(strategy string) Option {
+	return func(bc *Context) error {
+		s, err := apkimpl.ParseResolverStrategy(strategy)
+		if err != nil {
+			return err
+		}
+		bc.Options.ResolverStrategy = s
+		return nil
+	}
+}
+
+// WithExtractionCache keeps the expanded packages in a directory, by their
+// checksum, so that later builds installing the same packages neither
+// download nor decompress them again.
+func WithExtractionCache(dir string) Option {
+	return func(bc *Context) error {
+		bc.Options.ExtractionCache = dir
+		return nil
+	}
+}
+
+// WithLayerCache keeps the layers of the images in a directory, by the digest
+// of their resolved inputs, so that later builds with the same inputs reuse
+// them rather than building the image again.
+func WithLayerCache(dir string) Option {
+	return func(bc *Context) error {
+		bc.Options.LayerCache = dir
+		return nil
+	}
+}
+
+// WithCheckReproducibility builds the layers of each image a second time,
+// from scratch, and fails unless they are the same as the first ones.
+func WithCheckReproducibility(check bool) Option {
+	return func(bc *Context) error {
+		bc.Options.CheckReproducibility = check
+		return nil
+	}
+}
+
+// WithHostIDMap sets the owners to give the files of the working directory
+// for the ones of the image, as entries of <id>:<host id>, e.g. 0:100000,
+// so that builds not running as root can still chown them. The image has the
+// owners of the packages whatever the map.
+func WithHostIDMap(uids, gids []string) Option {
+	return func(bc *Context) error {
+		var err error
+		if bc.Options.HostUIDMap, err = parseIDMap(uids); err != nil {
+			return fmt.Errorf("uid map: %w", err)
+		}
+		if bc.Options.HostGIDMap, err = parseIDMap(gids); err != nil {
+			return fmt.Errorf("gid map: %w", err)
+		}
+		return nil
+	}
+}
+
+func parseIDMap(entries []string) (map[int]int, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	ids := make(map[int]int, len(entries))
+	for _, entry := range entries {
+		id, hostID, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q, must be <id>:<host id>", entry)
+		}
+		from, err := strconv.Atoi(id)
+		if err != nil || from < 0 {
+			return nil, fmt.Errorf("invalid id in %q", entry)
+		}
+		to, err := strconv.Atoi(hostID)
+		if err != nil || to < 0 {
+			return nil, fmt.Errorf("invalid host id in %q", entry)
+		}
+		ids[from] = to
+	}
+	return ids, nil
+}
+
+// WithFakerootDB keeps what cannot be set on the files of the working
+// directory, e.g. their owners, devices and extended attributes when not
+// running as root, in a database at the path, as fakeroot does. Building the
+// image writes it, and it is read when the working directory is used again.
+func WithFakerootDB(path string) Option {
+	return func(bc *Context) error {
+		bc.Options.FakerootDB = path
+		return nil
+	}
+}
+
+// WithMemoryBudget builds the filesystem in memory rather than in the working
+// directory, writing the content of large files there once more than budget
+// bytes are held, so that large images do not run out of memory. 0 builds it
+// in the working directory. It cannot be used with WithFakerootDB.
+func WithMemoryBudget(budget int64) Option {
+	return func(bc *Context) error {
+		if budget < 0 {
+			return fmt.Errorf("invalid memory budget %d", budget)
+		}
+		bc.Options.MemoryBudget = budget
+		return nil
+	}
+}
+
+// WithFailOnCaseCollision fails the build when two paths differ only by case,
+// if the working directory is case-insensitive, e.g. on macOS or Windows,
+// rather than warning about them.
+func WithFailOnCaseCollision(fail bool) Option {
+	return func(bc *Context) error {
+		bc.Options.FailOnCaseCollision = fail
+		return nil
+	}
+}
+
+// WithDeduplication writes the files of the layer with the same content and
+// attributes once, e.g. licenses or binaries shipped by several packages, the
+// others being hardlinks to it.
+func WithDeduplication(dedup bool) Option {
+	return func(bc *Context) error {
+		bc.Options.DeduplicateFiles = dedup
+		return nil
+	}
+}
+
+// WithSizeBudget fails the build if the layer takes more than budget bytes,
+// uncompressed, reporting the largest packages. 0 sets no budget.
+func WithSizeBudget(budget int64) Option {
+	return func(bc *Context) error {
+		if budget < 0 {
+			return fmt.Errorf("invalid size budget %d", budget)
+		}
+		bc.Options.SizeBudget = budget
+		return nil
+	}
+}
+
+// WithSparseFiles writes the files of the layer with large runs of zeros,
+// e.g. preallocated databases, as sparse entries, which leave them out and
+// which extract as files with holes.
+func WithSparseFiles(sparse bool) Option {
+	return func(bc *Context) error {
+		bc.Options.SparseFiles = sparse
+		return nil
+	}
+}
+
+// WithTimestampPolicy sets what the modification times of the files become in
+// the layer: epoch, the default, sets them all to SOURCE_DATE_EPOCH, preserve
+// keeps those of the packages, clamp keeps them but none later than
+// SOURCE_DATE_EPOCH, and zero sets them all to the Unix epoch.
+func WithTimestampPolicy(policy string) Option {
+	return func(bc *Context) error {
+		p, err := apkfs.ParseTimestampPolicy(policy)
+		if err != nil {
+			return err
+		}
+		bc.Options.Timestamps = p
+		return nil
+	}
+}
+
+// WithUnsafePaths installs the entries of packages whose paths go through
+// "..", rather than failing on them. Only use it with trusted packages.
+func WithUnsafePaths(allow bool) Option {
+	return func(bc *Context) error {
+		bc.Options.UnsafePaths = allow
+		return nil
+	}
+}
+
+// WithStreamingFS writes the files of the packages straight to the layer as
+// they are installed, rather than laying them out in the working directory.
+// The files outside of etc, lib, run, tmp and var can no longer be changed
+// after that, so this does not go along with stripping documentation.
+func WithStreamingFS(enable bool) Option {
+	return func(bc *Context) error {
+		bc.Options.StreamingFS = enable
+		return nil
+	}
+}
+
 // WithBuildOptions applies configured patches which have been requested to the ImageConfiguration.
 func WithBuildOptions(buildOptions []string) Option {
 	return func(bc *Context) error {
@@ -17,7 +17,10 @@ package build
 import (
 	"fmt"
 	"io/fs"
+	"path"
 	"path/filepath"
+	"strings"
+	"text/template"
 
 	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
 	"chainguard.dev/apko/pkg/build/types"
@@ -32,6 +35,9 @@ var pathMutators = map[string]PathMutator{
 	"hardlink":    mutateHardLink,
 	"symlink":     mutateSymLink,
 	"permissions": mutatePermissions,
+	"copy":        mutateCopy,
+	"file":        mutateFile,
+	"archive":     mutateArchive,
 }
 
 func mutatePermissions(fsys apkfs.FullFS, o *options.Options, mut types.PathMutation) error {
@@ -74,6 +80,50 @@ func mutateDirectory(fsys apkfs.FullFS, o *options.Options, mut types.PathMutati
 	return nil
 }
 
+func mutateFile(fsys apkfs.FullFS, o *options.Options, mut types.PathMutation) error {
+	if err := ensureParentDirectory(fsys, mut); err != nil {
+		return err
+	}
+
+	return fsys.WriteFile(mut.Path, []byte(mut.Contents), fs.FileMode(mut.Permissions))
+}
+
+// fileTemplateData is what the templates of files are expanded with.
+type fileTemplateData struct {
+	// Arch is the architecture of the image, by its OCI name, e.g. amd64.
+	Arch string
+	// APKArch is the architecture of the image, by its package name, e.g.
+	// x86_64.
+	APKArch string
+	// Environment is the environment of the image.
+	Environment map[string]string
+}
+
+// prepareFile sets the default permissions of a file, and expands its
+// template.
+func prepareFile(o *options.Options, ic *types.ImageConfiguration, mut types.PathMutation) (types.PathMutation, error) {
+	if mut.Permissions == 0 {
+		mut.Permissions = 0o644
+	}
+	if !mut.Template {
+		return mut, nil
+	}
+	tmpl, err := template.New(mut.Path).Option("missingkey=error").Parse(mut.Contents)
+	if err != nil {
+		return mut, fmt.Errorf("parsing the template of %s: %w", mut.Path, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, fileTemplateData{
+		Arch:        o.Arch.String(),
+		APKArch:     o.Arch.ToAPK(),
+		Environment: ic.Environment,
+	}); err != nil {
+		return mut, fmt.Errorf("expanding the template of %s: %w", mut.Path, err)
+	}
+	mut.Contents = b.String()
+	return mut, nil
+}
+
 func ensureParentDirectory(fsys apkfs.FullFS, mut types.PathMutation) error {
 	target := mut.Path
 	parent := filepath.Dir(target)
@@ -141,6 +191,13 @@ func (di *defaultBuildImplementation) MutatePaths(
 	fsys apkfs.FullFS, o *options.Options, ic *types.ImageConfiguration,
 ) error {
 	for _, mut := range ic.Paths {
+		if mut.Type == types.PathFile {
+			var err error
+			if mut, err = prepareFile(o, ic, mut); err != nil {
+				return err
+			}
+		}
+
 		pm, ok := pathMutators[mut.Type]
 		if !ok {
 			return fmt.Errorf("unsupported path mutation type %q", mut.Type)
@@ -150,12 +207,49 @@ func (di *defaultBuildImplementation) MutatePaths(
 			return err
 		}
 
-		if mut.Type != "permissions" {
+		// copies and archives have the permissions of their sources, unless
+		// set
+		if mut.Type != "permissions" && mut.Type != types.PathCopy && mut.Type != types.PathArchive {
 			if err := mutatePermissions(fsys, o, mut); err != nil {
 				return err
 			}
 		}
 	}
 
+	// the directories of the volumes are there for the runtimes to mount
+	// them, with the owner the containers expect
+	for _, v := range ic.Volumes {
+		mut := volumeMutation(v)
+		if err := mutateDirectory(fsys, o, mut); err != nil {
+			return fmt.Errorf("creating volume %s: %w", v.Path, err)
+		}
+		if err := mutatePermissions(fsys, o, mut); err != nil {
+			return fmt.Errorf("setting the owner of volume %s: %w", v.Path, err)
+		}
+	}
+
+	// runtimes run the containers there, so it must be a directory
+	if ic.WorkDir != "" {
+		if err := fsys.MkdirAll(path.Clean(ic.WorkDir), 0o755); err != nil {
+			return fmt.Errorf("creating work-dir %s: %w", ic.WorkDir, err)
+		}
+	}
+
 	return nil
 }
+
+// volumeMutation returns the path mutation creating the directory of the
+// volume.
+func volumeMutation(v types.Volume) types.PathMutation {
+	perms := v.Permissions
+	if perms == 0 {
+		perms = 0o755
+	}
+	return types.PathMutation{
+		Path:        path.Clean(v.Path),
+		Type:        "directory",
+		UID:         v.UID,
+		GID:         v.GID,
+		Permissions: perms,
+	}
+}
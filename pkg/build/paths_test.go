@@ -0,0 +1,68 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/options"
+)
+
+func TestMutatePathsFile(t *testing.T) {
+	di := &defaultBuildImplementation{}
+	o := options.Default
+	o.Arch = types.ParseArchitecture("arm64")
+
+	fsys := apkfs.NewMemFS()
+	ic := types.ImageConfiguration{
+		Environment: map[string]string{"APP_PORT": "8080"},
+		Paths: []types.PathMutation{{
+			Path:     "etc/sysctl.d/10-app.conf",
+			Type:     types.PathFile,
+			Contents: "net.core.somaxconn = 1024\n",
+		}, {
+			Path:        "etc/app/config.yaml",
+			Type:        types.PathFile,
+			Contents:    "arch: {{ .APKArch }}\nport: {{ .Environment.APP_PORT }}\n",
+			Template:    true,
+			UID:         1000,
+			GID:         1000,
+			Permissions: 0o600,
+		}},
+	}
+	require.NoError(t, di.MutatePaths(fsys, &o, &ic))
+
+	data, err := fsys.ReadFile("etc/sysctl.d/10-app.conf")
+	require.NoError(t, err)
+	require.Equal(t, "net.core.somaxconn = 1024\n", string(data))
+	fi, err := fsys.Stat("etc/sysctl.d/10-app.conf")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o644), fi.Mode().Perm())
+
+	data, err = fsys.ReadFile("etc/app/config.yaml")
+	require.NoError(t, err)
+	require.Equal(t, "arch: aarch64\nport: 8080\n", string(data))
+	fi, err = fsys.Stat("etc/app/config.yaml")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	ic.Paths[1].Contents = "{{ .Environment.MISSING }}"
+	require.ErrorContains(t, di.MutatePaths(fsys, &o, &ic), "expanding the template of etc/app/config.yaml")
+}
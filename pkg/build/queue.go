@@ -0,0 +1,239 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Queue schedules the builds of a shared build service, running at most a
+// number of them at once overall, and per tenant. Builds which cannot run
+// yet wait in the queue, higher priorities first, then in the order they
+// were submitted.
+type Queue struct {
+	maxConcurrent int
+
+	mu      sync.Mutex
+	seq     int
+	pending []*QueuedBuild
+	running map[string]*QueuedBuild
+	// running builds by tenant
+	tenants map[string]int
+}
+
+// QueuedBuild is a build submitted to a Queue.
+type QueuedBuild struct {
+	// ID identifies the build in the queue.
+	ID       string
+	Tenant   string
+	Priority int
+
+	q       *Queue
+	limit   int
+	seq     int
+	started bool
+	run     func(context.Context) error
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	err     error
+}
+
+// QueuedBuildState is whether a build of a Queue is waiting, running or
+// finished.
+type QueuedBuildState string
+
+const (
+	BuildQueued  QueuedBuildState = "queued"
+	BuildRunning QueuedBuildState = "running"
+	BuildDone    QueuedBuildState = "done"
+)
+
+// QueueStats are the number of builds waiting and running, overall and by
+// tenant.
+type QueueStats struct {
+	Queued   int
+	Running  int
+	ByTenant map[string]TenantQueueStats
+}
+
+// TenantQueueStats are the number of builds of a tenant waiting and
+// running.
+type TenantQueueStats struct {
+	Queued  int
+	Running int
+}
+
+// NewQueue returns a queue running at most maxConcurrent builds at once, or
+// any number of them if it is not positive.
+func NewQueue(maxConcurrent int) *Queue {
+	return &Queue{
+		maxConcurrent: maxConcurrent,
+		running:       map[string]*QueuedBuild{},
+		tenants:       map[string]int{},
+	}
+}
+
+// Submit queues a build for the tenant, which runs at most
+// MaxConcurrentBuilds of them at once, if set. The build is passed a
+// context which is cancelled when ctx is, or the build is cancelled.
+func (q *Queue) Submit(ctx context.Context, t Tenant, priority int, build func(context.Context) error) *QueuedBuild {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	bctx, cancel := context.WithCancel(ctx)
+	b := &QueuedBuild{
+		ID:       fmt.Sprintf("%s-%d", t.Name, q.seq),
+		Tenant:   t.Name,
+		Priority: priority,
+		q:        q,
+		limit:    t.MaxConcurrentBuilds,
+		seq:      q.seq,
+		run:      build,
+		ctx:      bctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	q.pending = append(q.pending, b)
+	sort.SliceStable(q.pending, func(i, j int) bool {
+		if q.pending[i].Priority != q.pending[j].Priority {
+			return q.pending[i].Priority > q.pending[j].Priority
+		}
+		return q.pending[i].seq < q.pending[j].seq
+	})
+
+	// builds cancelled while queued leave the queue right away
+	go func() {
+		select {
+		case <-bctx.Done():
+			q.Cancel(b.ID)
+		case <-b.done:
+		}
+	}()
+
+	q.schedule()
+	return b
+}
+
+// Cancel cancels a queued or running build, and reports whether it was
+// found.
+func (q *Queue) Cancel(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if b, ok := q.running[id]; ok {
+		b.cancel()
+		return true
+	}
+	for i, b := range q.pending {
+		if b.ID != id {
+			continue
+		}
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		b.cancel()
+		b.err = context.Canceled
+		close(b.done)
+		return true
+	}
+	return false
+}
+
+// Stats returns the number of builds waiting and running.
+func (q *Queue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := QueueStats{
+		Queued:   len(q.pending),
+		Running:  len(q.running),
+		ByTenant: map[string]TenantQueueStats{},
+	}
+	for _, b := range q.pending {
+		ts := stats.ByTenant[b.Tenant]
+		ts.Queued++
+		stats.ByTenant[b.Tenant] = ts
+	}
+	for _, b := range q.running {
+		ts := stats.ByTenant[b.Tenant]
+		ts.Running++
+		stats.ByTenant[b.Tenant] = ts
+	}
+	return stats
+}
+
+// schedule starts the queued builds which fit in the limits. It must be
+// called with the lock held.
+func (q *Queue) schedule() {
+	for i := 0; i < len(q.pending); {
+		if q.maxConcurrent > 0 && len(q.running) >= q.maxConcurrent {
+			return
+		}
+		b := q.pending[i]
+		if b.limit > 0 && q.tenants[b.Tenant] >= b.limit {
+			i++
+			continue
+		}
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		q.running[b.ID] = b
+		q.tenants[b.Tenant]++
+		b.started = true
+		go q.execute(b)
+	}
+}
+
+func (q *Queue) execute(b *QueuedBuild) {
+	err := b.run(b.ctx)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.running, b.ID)
+	q.tenants[b.Tenant]--
+	b.cancel()
+	b.err = err
+	close(b.done)
+	q.schedule()
+}
+
+// Done returns a channel which is closed once the build is finished or
+// cancelled.
+func (b *QueuedBuild) Done() <-chan struct{} {
+	return b.done
+}
+
+// State returns whether the build is waiting, running or finished, cancelled
+// builds included.
+func (b *QueuedBuild) State() QueuedBuildState {
+	select {
+	case <-b.done:
+		return BuildDone
+	default:
+	}
+	b.q.mu.Lock()
+	defer b.q.mu.Unlock()
+	if b.started {
+		return BuildRunning
+	}
+	return BuildQueued
+}
+
+// Wait waits for the build to finish, and returns its error.
+func (b *QueuedBuild) Wait() error {
+	<-b.done
+	return b.err
+}
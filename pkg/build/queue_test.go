@@ -0,0 +1,91 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueue(t *testing.T) {
+	q := NewQueue(2)
+	teamA := Tenant{Name: "team-a", MaxConcurrentBuilds: 1}
+	teamB := Tenant{Name: "team-b"}
+
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	release := map[string]chan struct{}{}
+	started := make(chan string, 10)
+	build := func(name string) func(context.Context) error {
+		done := make(chan struct{})
+		release[name] = done
+		return func(ctx context.Context) error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			started <- name
+			select {
+			case <-done:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	ctx := context.Background()
+	a1 := q.Submit(ctx, teamA, 0, build("a1"))
+	require.Equal(t, "a1", <-started)
+	// team-a may only run one build at once
+	a2 := q.Submit(ctx, teamA, 0, build("a2"))
+	b1 := q.Submit(ctx, teamB, 0, build("b1"))
+	require.Equal(t, "b1", <-started)
+	// the queue is full, so these wait, the higher priority first
+	b2 := q.Submit(ctx, teamB, 0, build("b2"))
+	b3 := q.Submit(ctx, teamB, 10, build("b3"))
+
+	require.Equal(t, BuildRunning, a1.State())
+	require.Equal(t, BuildQueued, a2.State())
+
+	stats := q.Stats()
+	require.Equal(t, 3, stats.Queued)
+	require.Equal(t, 2, stats.Running)
+	require.Equal(t, TenantQueueStats{Queued: 1, Running: 1}, stats.ByTenant["team-a"])
+
+	require.True(t, q.Cancel(b2.ID))
+	require.True(t, errors.Is(b2.Wait(), context.Canceled))
+	require.Equal(t, BuildDone, b2.State())
+
+	close(release["b1"])
+	require.NoError(t, b1.Wait())
+	require.Equal(t, "b3", <-started)
+
+	require.True(t, q.Cancel(b3.ID))
+	require.True(t, errors.Is(b3.Wait(), context.Canceled))
+	close(release["a1"])
+	require.NoError(t, a1.Wait())
+	require.Equal(t, "a2", <-started)
+	close(release["a2"])
+	require.NoError(t, a2.Wait())
+
+	require.Equal(t, []string{"a1", "b1", "b3", "a2"}, order)
+	require.False(t, q.Cancel("unknown"))
+}
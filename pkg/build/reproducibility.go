@@ -0,0 +1,176 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+)
+
+// CompareLayers returns an error naming the first file which differs between
+// two builds of the layers of an image, unless their tarballs are the same.
+func CompareLayers(want, got []string) error {
+	if len(want) != len(got) {
+		return fmt.Errorf("built %d layers, then %d", len(want), len(got))
+	}
+	for i := range want {
+		a, err := fileDigest(want[i])
+		if err != nil {
+			return err
+		}
+		b, err := fileDigest(got[i])
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(a, b) {
+			continue
+		}
+		if err := compareLayer(want[i], got[i]); err != nil {
+			return fmt.Errorf("layer %d (sha256:%x, then sha256:%x): %w", i, a, b, err)
+		}
+		return fmt.Errorf("layer %d (sha256:%x, then sha256:%x): the files are the same, but not their compression", i, a, b)
+	}
+	return nil
+}
+
+func fileDigest(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+	return h.Sum(nil), nil
+}
+
+// layerReader reads the entries of a gzipped layer tarball.
+type layerReader struct {
+	f   *os.File
+	gzr *gzip.Reader
+	*tar.Reader
+}
+
+func openLayer(name string) (*layerReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+	return &layerReader{f: f, gzr: gzr, Reader: tar.NewReader(gzr)}, nil
+}
+
+func (l *layerReader) Close() error {
+	l.gzr.Close()
+	return l.f.Close()
+}
+
+// next returns the next entry, and the digest of its content, or nil at the
+// end of the layer.
+func (l *layerReader) next() (*tar.Header, []byte, error) {
+	hdr, err := l.Next()
+	if errors.Is(err, io.EOF) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, l); err != nil {
+		return nil, nil, fmt.Errorf("reading %s: %w", hdr.Name, err)
+	}
+	return hdr, h.Sum(nil), nil
+}
+
+// compareLayer walks the two layers in step, returning an error naming the
+// first entry which differs, if any.
+func compareLayer(want, got string) error {
+	a, err := openLayer(want)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	b, err := openLayer(got)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	for {
+		ha, da, err := a.next()
+		if err != nil {
+			return err
+		}
+		hb, db, err := b.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case ha == nil && hb == nil:
+			return nil
+		case hb == nil:
+			return fmt.Errorf("%s is missing from the second build", ha.Name)
+		case ha == nil:
+			return fmt.Errorf("%s is missing from the first build", hb.Name)
+		case ha.Name != hb.Name:
+			return fmt.Errorf("%s is where the first build has %s", hb.Name, ha.Name)
+		}
+		if field := headerDiff(ha, hb); field != "" {
+			return fmt.Errorf("%s differs in its %s", ha.Name, field)
+		}
+		if !bytes.Equal(da, db) {
+			return fmt.Errorf("%s differs in its content (sha256:%x, then sha256:%x)", ha.Name, da, db)
+		}
+	}
+}
+
+// headerDiff returns the first field of the headers which differs, or "".
+func headerDiff(a, b *tar.Header) string {
+	switch {
+	case a.Typeflag != b.Typeflag:
+		return "type"
+	case a.Linkname != b.Linkname:
+		return fmt.Sprintf("link target (%s, then %s)", a.Linkname, b.Linkname)
+	case a.Size != b.Size:
+		return fmt.Sprintf("size (%d, then %d)", a.Size, b.Size)
+	case a.Mode != b.Mode:
+		return fmt.Sprintf("mode (%o, then %o)", a.Mode, b.Mode)
+	case a.Uid != b.Uid || a.Gid != b.Gid:
+		return fmt.Sprintf("owner (%d:%d, then %d:%d)", a.Uid, a.Gid, b.Uid, b.Gid)
+	case a.Uname != b.Uname || a.Gname != b.Gname:
+		return fmt.Sprintf("owner names (%s:%s, then %s:%s)", a.Uname, a.Gname, b.Uname, b.Gname)
+	case !a.ModTime.Equal(b.ModTime):
+		return fmt.Sprintf("modification time (%s, then %s)", a.ModTime, b.ModTime)
+	case !a.AccessTime.Equal(b.AccessTime) || !a.ChangeTime.Equal(b.ChangeTime):
+		return "access or change time"
+	case a.Devmajor != b.Devmajor || a.Devminor != b.Devminor:
+		return "device numbers"
+	case !reflect.DeepEqual(a.PAXRecords, b.PAXRecords):
+		return "extended attributes"
+	}
+	return ""
+}
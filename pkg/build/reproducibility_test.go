@@ -0,0 +1,101 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type layerFile struct {
+	name    string
+	mode    int64
+	content string
+}
+
+func writeTestLayer(t *testing.T, files ...layerFile) string {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "layer-*.tar.gz")
+	require.NoError(t, err)
+	defer f.Close()
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+	for _, file := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.name,
+			Mode:     file.mode,
+			Size:     int64(len(file.content)),
+			ModTime:  time.Unix(0, 0),
+		}))
+		_, err := tw.Write([]byte(file.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+	return filepath.Clean(f.Name())
+}
+
+func TestCompareLayers(t *testing.T) {
+	base := []layerFile{{"etc/os-release", 0o644, "ID=wolfi\n"}, {"usr/bin/app", 0o755, "v1"}}
+	layer := writeTestLayer(t, base...)
+
+	for _, tt := range []struct {
+		name  string
+		files []layerFile
+		err   string
+	}{{
+		name:  "same",
+		files: base,
+	}, {
+		name:  "content",
+		files: []layerFile{base[0], {"usr/bin/app", 0o755, "v2"}},
+		err:   "usr/bin/app differs in its content",
+	}, {
+		name:  "mode",
+		files: []layerFile{base[0], {"usr/bin/app", 0o700, "v1"}},
+		err:   "usr/bin/app differs in its mode (755, then 700)",
+	}, {
+		name:  "missing",
+		files: base[:1],
+		err:   "usr/bin/app is missing from the second build",
+	}, {
+		name:  "extra",
+		files: append(base[:2:2], layerFile{"usr/bin/extra", 0o755, ""}),
+		err:   "usr/bin/extra is missing from the first build",
+	}, {
+		name:  "renamed",
+		files: []layerFile{base[0], {"usr/bin/other", 0o755, "v1"}},
+		err:   "usr/bin/other is where the first build has usr/bin/app",
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CompareLayers([]string{layer}, []string{writeTestLayer(t, tt.files...)})
+			if tt.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, "layer 0 ")
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+
+	require.ErrorContains(t, CompareLayers([]string{layer}, []string{layer, layer}), "built 1 layers, then 2")
+}
@@ -0,0 +1,209 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"golang.org/x/sys/unix"
+
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+// WithPublishState records the images of each architecture into the file as
+// they are published, so that a publish failing for some architectures can
+// be resumed, publishing only the images missing and the index. If resume is
+// not set, what a previous publish of the same inputs recorded is dropped.
+// The file may be shared by several publishes, even running at once, as it is
+// locked while it is updated.
+func WithPublishState(path string, resume bool) Option {
+	return func(bc *Context) error {
+		bc.Options.PublishState = path
+		bc.Options.Resume = resume
+		return nil
+	}
+}
+
+// PublishState is the images of a publish published so far. The file holds
+// the state of the publishes of any number of inputs, keyed by their digest,
+// so that the variants of an image can be resumed as well.
+type PublishState struct {
+	path   string
+	inputs string
+}
+
+// PublishState returns the publish state of the context, or nil if it has
+// none, in which case the methods of the state do nothing. The image
+// configuration must be complete, as it is part of the inputs of the
+// publish.
+func (bc *Context) PublishState() (*PublishState, error) {
+	if bc.Options.PublishState == "" || bc.Options.Local {
+		return nil, nil
+	}
+	inputs, err := bc.InputsDigest()
+	if err != nil {
+		return nil, err
+	}
+	s := &PublishState{path: bc.Options.PublishState, inputs: inputs}
+	if !bc.Options.Resume {
+		if err := s.Done(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Image returns the image of the architecture published already, if any.
+func (s *PublishState) Image(arch types.Architecture) (name.Digest, bool, error) {
+	if s == nil {
+		return name.Digest{}, false, nil
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return name.Digest{}, false, err
+	}
+	defer unlock()
+
+	states, err := s.read()
+	if err != nil {
+		return name.Digest{}, false, err
+	}
+	ref, ok := states[s.inputs][arch.ToAPK()]
+	if !ok {
+		return name.Digest{}, false, nil
+	}
+	digest, err := name.NewDigest(ref)
+	if err != nil {
+		return name.Digest{}, false, fmt.Errorf("invalid %s image in %s: %w", arch, s.path, err)
+	}
+	return digest, true, nil
+}
+
+// Record records that the image of the architecture is published.
+func (s *PublishState) Record(arch types.Architecture, digest name.Digest) error {
+	if s == nil {
+		return nil
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	states, err := s.read()
+	if err != nil {
+		return err
+	}
+	if states[s.inputs] == nil {
+		states[s.inputs] = map[string]string{}
+	}
+	states[s.inputs][arch.ToAPK()] = digest.String()
+	return s.write(states)
+}
+
+// Done drops the state of the publish, once it is complete. The file is
+// removed if it has no other state.
+func (s *PublishState) Done() error {
+	if s == nil {
+		return nil
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	states, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := states[s.inputs]; !ok {
+		return nil
+	}
+	delete(states, s.inputs)
+	return s.write(states)
+}
+
+// lock locks the state against the updates of other build contexts and
+// processes, until the returned function is called. The lock is held on a
+// file of its own, as the state file is replaced when it is written.
+func (s *PublishState) lock() (func(), error) {
+	f, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("locking publish state: %w", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking publish state: %w", err)
+	}
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// read returns the images of each publish by the digest of its inputs, and
+// by architecture.
+func (s *PublishState) read() (map[string]map[string]string, error) {
+	states := map[string]map[string]string{}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading publish state: %w", err)
+	}
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("parsing publish state %s: %w", s.path, err)
+	}
+	return states, nil
+}
+
+func (s *PublishState) write(states map[string]map[string]string) error {
+	if len(states) == 0 {
+		if err := os.Remove(s.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removing publish state: %w", err)
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	// replace the file at once, so that a publish interrupted while writing
+	// it keeps the previous state
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("writing publish state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing publish state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing publish state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("writing publish state: %w", err)
+	}
+	return nil
+}
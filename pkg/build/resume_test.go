@@ -0,0 +1,114 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+func TestPublishState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	amd64 := types.ParseArchitecture("amd64")
+	arm64 := types.ParseArchitecture("arm64")
+	digest, err := name.NewDigest("cgr.dev/team/app@sha256:4c32e1a43a5d2a8a5e0e0a1d5bbd2b8e2f4e2c7b0c9d5a3e8d2b1c4a7f6e5d3c")
+	require.NoError(t, err)
+
+	bc := &Context{ImageConfiguration: types.ImageConfiguration{
+		Contents: types.ImageContents{Packages: []string{"wolfi-base"}},
+	}}
+	bc.Options.Tags = []string{"cgr.dev/team/app:latest"}
+	bc.Options.PublishState = path
+
+	state, err := bc.PublishState()
+	require.NoError(t, err)
+	require.NoError(t, state.Record(amd64, digest))
+
+	// resuming the same inputs skips the published image
+	bc.Options.Resume = true
+	state, err = bc.PublishState()
+	require.NoError(t, err)
+	got, ok, err := state.Image(amd64)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, digest, got)
+	_, ok, err = state.Image(arm64)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// other inputs have a state of their own
+	other := *bc
+	other.Options.Tags = []string{"cgr.dev/team/app:other"}
+	otherState, err := other.PublishState()
+	require.NoError(t, err)
+	_, ok, err = otherState.Image(amd64)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// publishing again without resuming drops the state
+	bc.Options.Resume = false
+	state, err = bc.PublishState()
+	require.NoError(t, err)
+	_, ok, err = state.Image(amd64)
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	// no state at all
+	bc.Options.PublishState = ""
+	state, err = bc.PublishState()
+	require.NoError(t, err)
+	require.Nil(t, state)
+	require.NoError(t, state.Record(amd64, digest))
+	require.NoError(t, state.Done())
+}
+
+func TestPublishStateConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	digest, err := name.NewDigest("cgr.dev/team/app@sha256:4c32e1a43a5d2a8a5e0e0a1d5bbd2b8e2f4e2c7b0c9d5a3e8d2b1c4a7f6e5d3c")
+	require.NoError(t, err)
+
+	// the publishes of other inputs update the same file at once
+	var wg sync.WaitGroup
+	errs := make([]error, len(types.AllArchs))
+	for i, arch := range types.AllArchs {
+		i, arch := i, arch
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := &PublishState{path: path, inputs: arch.String()}
+			errs[i] = s.Record(arch, digest)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	for _, arch := range types.AllArchs {
+		s := &PublishState{path: path, inputs: arch.String()}
+		_, ok, err := s.Image(arch)
+		require.NoError(t, err)
+		require.True(t, ok, "%s", arch)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"os"
+
+	gzip "golang.org/x/build/pargzip"
+
+	"chainguard.dev/apko/pkg/options"
+	"chainguard.dev/apko/pkg/tarball"
+)
+
+// streamedLayer is the filesystem of a build which writes the layer as the
+// packages are installed, rather than laying them out in the working
+// directory first.
+type streamedLayer struct {
+	*tarball.StreamFS
+	file *os.File
+	gzw  *gzip.Writer
+}
+
+// newStreamedLayer returns a filesystem writing the layer to a file in the
+// working directory, which finish moves where the layer goes.
+func newStreamedLayer(o *options.Options) (*streamedLayer, error) {
+	ctx, err := tarball.NewContext(
+		tarball.WithSourceDateEpoch(o.SourceDateEpoch),
+		tarball.WithFileMutators(o.FileMutators...),
+		tarball.WithDeduplication(o.DeduplicateFiles),
+		tarball.WithSparse(o.SparseFiles),
+		tarball.WithTimestampPolicy(o.Timestamps),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct tarball build context: %w", err)
+	}
+	file, err := os.CreateTemp(o.WorkDir, "layer-*.tar.gz")
+	if err != nil {
+		return nil, fmt.Errorf("creating the layer tarball: %w", err)
+	}
+	gzw := gzip.NewWriter(file)
+	return &streamedLayer{
+		StreamFS: tarball.NewStreamFS(ctx, gzw, tarball.DefaultMutablePaths),
+		file:     file,
+		gzw:      gzw,
+	}, nil
+}
+
+// finish writes the rest of the layer, and moves it to the path.
+func (l *streamedLayer) finish(path string) error {
+	if err := l.Finish(); err != nil {
+		return fmt.Errorf("failed to generate tarball for image: %w", err)
+	}
+	if err := l.gzw.Close(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(l.file.Name(), path)
+}
@@ -0,0 +1,256 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+// Tenant restricts what a team sharing a build service may build, so that
+// apko serve, or services embedding apko, can keep the builds of several
+// teams apart. Empty lists allow anything.
+type Tenant struct {
+	// Name identifies the tenant in errors.
+	Name string `yaml:"name"`
+	// Repositories are the package repositories the tenant may use,
+	// including any under them, e.g. https://packages.wolfi.dev/os.
+	Repositories []string `yaml:"repositories,omitempty"`
+	// Keyring are the keys the tenant may trust.
+	Keyring []string `yaml:"keyring,omitempty"`
+	// Registries are the registries or repositories the tenant may push
+	// to, including any under them, e.g. cgr.dev/team.
+	Registries []string `yaml:"registries,omitempty"`
+	// Bases are the registries, repositories or layout directories the
+	// tenant may build on top of, including any under them.
+	Bases []string `yaml:"bases,omitempty"`
+	// Sources are the host directories or URLs the tenant may copy or
+	// unpack into its images, including any under them.
+	Sources []string `yaml:"sources,omitempty"`
+	// MaxPackages and MaxArchs limit the size of a build, if not zero.
+	MaxPackages int `yaml:"max-packages,omitempty"`
+	MaxArchs    int `yaml:"max-archs,omitempty"`
+	// MaxConcurrentBuilds limits how many builds of the tenant a Queue runs
+	// at once, if not zero.
+	MaxConcurrentBuilds int `yaml:"max-concurrent-builds,omitempty"`
+	// TempDir is where the layers of the tenant are written, each build in
+	// a directory of its own, kept apart from the ones of other tenants.
+	TempDir string `yaml:"temp-dir,omitempty"`
+	// CacheDir is where the packages and layers of the tenant are cached,
+	// kept apart from the ones of other tenants. The builds of the tenant
+	// cache nothing unless it is set.
+	CacheDir string `yaml:"cache-dir,omitempty"`
+}
+
+// WithTenant checks that the build context only uses what the tenant is
+// allowed to, and writes and caches its layers and packages in the
+// directories of the tenant. The checks run once all the options are
+// applied and the variables are substituted.
+func WithTenant(t Tenant) Option {
+	return func(bc *Context) error {
+		bc.checks = append(bc.checks, func(bc *Context) error {
+			if err := t.Check(bc); err != nil {
+				return fmt.Errorf("tenant %s: %w", t.Name, err)
+			}
+			t.isolateCaches(bc)
+			return nil
+		})
+		// the temporary directory of a build is removed once it is done, so
+		// the builds of the tenant running at once each have their own
+		if t.TempDir != "" {
+			if err := os.MkdirAll(t.TempDir, 0o700); err != nil {
+				return fmt.Errorf("tenant %s: creating temporary directory: %w", t.Name, err)
+			}
+			dir, err := os.MkdirTemp(t.TempDir, "apko-temp-*")
+			if err != nil {
+				return fmt.Errorf("tenant %s: creating temporary directory: %w", t.Name, err)
+			}
+			bc.Options.TempDirPath = dir
+		}
+		return nil
+	}
+}
+
+// isolateCaches moves the caches the build uses to the cache directory of
+// the tenant, or turns them off if it has none.
+func (t Tenant) isolateCaches(bc *Context) {
+	if bc.Options.ExtractionCache != "" {
+		bc.Options.ExtractionCache = ""
+		if t.CacheDir != "" {
+			bc.Options.ExtractionCache = filepath.Join(t.CacheDir, "packages")
+		}
+	}
+	if bc.Options.LayerCache != "" {
+		bc.Options.LayerCache = ""
+		if t.CacheDir != "" {
+			bc.Options.LayerCache = filepath.Join(t.CacheDir, "layers")
+		}
+	}
+}
+
+// Check returns an error if the build context uses anything the tenant is
+// not allowed to, with any of its architectures or variants.
+func (t Tenant) Check(bc *Context) error {
+	ic := bc.ImageConfiguration
+
+	repos := append(append([]string{}, ic.Contents.Repositories...), bc.Options.ExtraRepos...)
+	for _, repo := range repos {
+		// drop the tag of pinned repositories, e.g. "@local /path"
+		if strings.HasPrefix(repo, "@") {
+			if _, after, ok := strings.Cut(repo, " "); ok {
+				repo = strings.TrimSpace(after)
+			}
+		}
+		loc, err := cleanLocation(repo)
+		if err != nil {
+			return fmt.Errorf("parsing repository %s: %w", repo, err)
+		}
+		if !allowedUnder(loc, t.Repositories) {
+			return fmt.Errorf("repository %s is not allowed", repo)
+		}
+	}
+
+	// the architectures and variants add packages to those of the image
+	pkgs := append([]string{}, ic.Contents.Packages...)
+	maxArchAdded, maxVariantAdded := 0, 0
+	for _, bo := range ic.ArchOverrides {
+		pkgs = append(pkgs, bo.Contents.Packages.Add...)
+		if n := len(bo.Contents.Packages.Add); n > maxArchAdded {
+			maxArchAdded = n
+		}
+	}
+	for _, bo := range ic.Variants {
+		pkgs = append(pkgs, bo.Contents.Packages.Add...)
+		if n := len(bo.Contents.Packages.Add); n > maxVariantAdded {
+			maxVariantAdded = n
+		}
+	}
+
+	// packages given as .apk files or URLs are read like repositories
+	for _, pkg := range pkgs {
+		loc, _, _ := strings.Cut(pkg, "#")
+		if !strings.HasSuffix(loc, ".apk") {
+			continue
+		}
+		loc, err := cleanLocation(loc)
+		if err != nil {
+			return fmt.Errorf("parsing package URL %s: %w", pkg, err)
+		}
+		if !allowedUnder(loc, t.Repositories) {
+			return fmt.Errorf("local package %s is not allowed", pkg)
+		}
+	}
+
+	keys := append(append([]string{}, ic.Contents.Keyring...), bc.Options.ExtraKeyFiles...)
+	for _, key := range keys {
+		loc, err := cleanLocation(key)
+		if err != nil {
+			return fmt.Errorf("parsing key %s: %w", key, err)
+		}
+		if !allowedUnder(loc, t.Keyring) {
+			return fmt.Errorf("key %s is not allowed", key)
+		}
+	}
+
+	for _, mut := range ic.Paths {
+		if mut.Type != types.PathCopy && mut.Type != types.PathArchive {
+			continue
+		}
+		loc, err := cleanLocation(mut.Source)
+		if err != nil {
+			return fmt.Errorf("parsing source %s of path %s: %w", mut.Source, mut.Path, err)
+		}
+		if !allowedUnder(loc, t.Sources) {
+			return fmt.Errorf("source %s of path %s is not allowed", mut.Source, mut.Path)
+		}
+	}
+
+	if ic.Base.Ref != "" {
+		ref, err := name.ParseReference(ic.Base.Ref)
+		if err != nil {
+			return fmt.Errorf("parsing base image %s: %w", ic.Base.Ref, err)
+		}
+		if !allowedUnder(ref.Context().Name(), t.Bases) {
+			return fmt.Errorf("base image %s is not allowed", ic.Base.Ref)
+		}
+	}
+	if ic.Base.Layout != "" && !allowedUnder(filepath.Clean(ic.Base.Layout), t.Bases) {
+		return fmt.Errorf("base layout %s is not allowed", ic.Base.Layout)
+	}
+
+	for _, tag := range bc.Options.Tags {
+		ref, err := name.ParseReference(tag)
+		if err != nil {
+			return fmt.Errorf("parsing tag %s: %w", tag, err)
+		}
+		if !allowedUnder(ref.Context().Name(), t.Registries) {
+			return fmt.Errorf("publishing to %s is not allowed", ref.Context().Name())
+		}
+	}
+
+	// an architecture of a variant gets the packages of both
+	if n := len(ic.Contents.Packages) + maxArchAdded + maxVariantAdded; t.MaxPackages > 0 && n > t.MaxPackages {
+		return fmt.Errorf("%d packages requested, at most %d allowed", n, t.MaxPackages)
+	}
+	// no architectures means all of them
+	archs := len(ic.Archs)
+	if archs == 0 {
+		archs = len(types.AllArchs)
+	}
+	if t.MaxArchs > 0 && archs > t.MaxArchs {
+		return fmt.Errorf("%d architectures requested, at most %d allowed", archs, t.MaxArchs)
+	}
+
+	return nil
+}
+
+// cleanLocation returns the URL or the path with its path cleaned, so that
+// it cannot get out of an allowed directory with "..".
+func cleanLocation(loc string) (string, error) {
+	if strings.Contains(loc, "://") {
+		u, err := url.Parse(loc)
+		if err != nil {
+			return "", err
+		}
+		u.Path = path.Clean("/" + u.Path)
+		u.RawPath = ""
+		return u.String(), nil
+	}
+	return filepath.Clean(loc), nil
+}
+
+// allowedUnder reports whether s is one of the allowed entries, or under
+// one of them as a path, or whether anything is allowed.
+func allowedUnder(s string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	s = strings.TrimSuffix(s, "/")
+	for _, a := range allowed {
+		a = strings.TrimSuffix(a, "/")
+		if s == a || strings.HasPrefix(s, a+"/") {
+			return true
+		}
+	}
+	return false
+}
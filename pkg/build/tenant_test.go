@@ -0,0 +1,170 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+func TestTenantCheck(t *testing.T) {
+	tenant := Tenant{
+		Name:         "team-a",
+		Repositories: []string{"https://packages.wolfi.dev/os", "/srv/team-a/packages"},
+		Registries:   []string{"cgr.dev/team-a"},
+		MaxPackages:  2,
+	}
+
+	bc := &Context{
+		ImageConfiguration: types.ImageConfiguration{
+			Contents: types.ImageContents{
+				Repositories: []string{"https://packages.wolfi.dev/os", "@local /srv/team-a/packages/x86_64"},
+				Packages:     []string{"wolfi-base"},
+			},
+		},
+	}
+	bc.Options.Tags = []string{"cgr.dev/team-a/app:latest"}
+	require.NoError(t, tenant.Check(bc))
+
+	bc.Options.Tags = []string{"cgr.dev/team-ab/app:latest"}
+	require.Error(t, tenant.Check(bc))
+
+	bc.Options.Tags = nil
+	bc.Options.ExtraRepos = []string{"https://dl-cdn.alpinelinux.org/alpine/edge/main"}
+	require.Error(t, tenant.Check(bc))
+
+	bc.Options.ExtraRepos = nil
+	bc.ImageConfiguration.Contents.Packages = []string{"/srv/team-a/packages/x86_64/app-1.0-r0.apk"}
+	require.NoError(t, tenant.Check(bc))
+
+	bc.ImageConfiguration.Contents.Packages = []string{"/srv/team-a/packages/../../team-b/app-1.0-r0.apk"}
+	require.Error(t, tenant.Check(bc))
+
+	bc.ImageConfiguration.Contents.Packages = []string{"https://packages.wolfi.dev/os/x86_64/app-1.0-r0.apk#sha256=00"}
+	require.NoError(t, tenant.Check(bc))
+
+	bc.ImageConfiguration.Contents.Packages = []string{"https://packages.wolfi.dev/os/../team-b/app-1.0-r0.apk"}
+	require.Error(t, tenant.Check(bc))
+
+	bc.ImageConfiguration.Contents.Packages = []string{"a", "b", "c"}
+	require.Error(t, tenant.Check(bc))
+
+	bc.ImageConfiguration.Contents.Packages = []string{"a"}
+	bc.ImageConfiguration.Variants = map[string]types.BuildOption{
+		"dev": {Contents: types.ContentsOption{Packages: types.ListOption{Add: []string{"b"}}}},
+	}
+	bc.ImageConfiguration.ArchOverrides = map[string]types.BuildOption{
+		"x86_64": {Contents: types.ContentsOption{Packages: types.ListOption{Add: []string{"c"}}}},
+	}
+	require.Error(t, tenant.Check(bc), "the variants and architectures count")
+
+	bc.ImageConfiguration.Variants = nil
+	bc.ImageConfiguration.ArchOverrides = map[string]types.BuildOption{
+		"x86_64": {Contents: types.ContentsOption{Packages: types.ListOption{Add: []string{"/srv/team-b/app-1.0-r0.apk"}}}},
+	}
+	require.Error(t, tenant.Check(bc), "the packages of the architectures are checked")
+	bc.ImageConfiguration.ArchOverrides = nil
+
+	bc.ImageConfiguration.Contents.Repositories = []string{"https://packages.wolfi.dev/os/../../team-b"}
+	require.Error(t, tenant.Check(bc))
+	bc.ImageConfiguration.Contents.Repositories = []string{"/srv/team-a/packages/../team-b"}
+	require.Error(t, tenant.Check(bc))
+	bc.ImageConfiguration.Contents.Repositories = nil
+	require.NoError(t, tenant.Check(bc))
+
+	tenant.MaxArchs = 2
+	require.Error(t, tenant.Check(bc), "no architectures means all of them")
+	bc.ImageConfiguration.Archs = []types.Architecture{types.ParseArchitecture("x86_64")}
+	require.NoError(t, tenant.Check(bc))
+}
+
+func TestTenantCheckSourcesAndBases(t *testing.T) {
+	tenant := Tenant{
+		Name:    "team-a",
+		Bases:   []string{"cgr.dev/team-a", "/srv/team-a/bases"},
+		Sources: []string{"/srv/team-a/files", "https://files.example.com/team-a"},
+	}
+
+	for _, tt := range []struct {
+		ic      types.ImageConfiguration
+		allowed bool
+	}{
+		{types.ImageConfiguration{Base: types.BaseImage{Ref: "cgr.dev/team-a/base:latest"}}, true},
+		{types.ImageConfiguration{Base: types.BaseImage{Ref: "cgr.dev/team-b/base:latest"}}, false},
+		{types.ImageConfiguration{Base: types.BaseImage{Layout: "/srv/team-a/bases/base"}}, true},
+		{types.ImageConfiguration{Base: types.BaseImage{Layout: "/srv/team-a/bases/../../team-b/base"}}, false},
+		{types.ImageConfiguration{Paths: []types.PathMutation{{Path: "/etc/app", Type: types.PathCopy, Source: "/srv/team-a/files/app"}}}, true},
+		{types.ImageConfiguration{Paths: []types.PathMutation{{Path: "/etc/app", Type: types.PathCopy, Source: "/etc/shadow"}}}, false},
+		{types.ImageConfiguration{Paths: []types.PathMutation{{Path: "/opt", Type: types.PathArchive, Source: "/srv/team-a/files/../../team-b/app.tar"}}}, false},
+		{types.ImageConfiguration{Paths: []types.PathMutation{{Path: "/opt", Type: types.PathArchive, Source: "https://files.example.com/team-a/app.tar"}}}, true},
+		{types.ImageConfiguration{Paths: []types.PathMutation{{Path: "/opt", Type: types.PathArchive, Source: "https://files.example.com/team-a/../team-b/app.tar"}}}, false},
+	} {
+		err := tenant.Check(&Context{ImageConfiguration: tt.ic})
+		if tt.allowed {
+			require.NoError(t, err, "%+v", tt.ic)
+		} else {
+			require.Error(t, err, "%+v", tt.ic)
+		}
+	}
+}
+
+func TestWithTenantCaches(t *testing.T) {
+	cacheDir := t.TempDir()
+	bc, err := New(t.TempDir(), WithExtractionCache("/var/cache/apko"), WithTenant(Tenant{Name: "team-a", CacheDir: cacheDir}))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(cacheDir, "packages"), bc.Options.ExtractionCache)
+	require.Empty(t, bc.Options.LayerCache)
+
+	bc, err = New(t.TempDir(), WithTenant(Tenant{Name: "team-a"}), WithLayerCache("/var/cache/apko"))
+	require.NoError(t, err)
+	require.Empty(t, bc.Options.LayerCache, "nothing is cached without a directory of the tenant")
+}
+
+func TestWithTenantTempDir(t *testing.T) {
+	tempDir := t.TempDir()
+	first, err := New(t.TempDir(), WithTenant(Tenant{Name: "team-a", TempDir: tempDir}))
+	require.NoError(t, err)
+	second, err := New(t.TempDir(), WithTenant(Tenant{Name: "team-a", TempDir: tempDir}))
+	require.NoError(t, err)
+
+	require.Equal(t, tempDir, filepath.Dir(first.Options.TempDir()))
+	require.Equal(t, tempDir, filepath.Dir(second.Options.TempDir()))
+	require.NotEqual(t, first.Options.TempDir(), second.Options.TempDir(), "the builds of a tenant each have their own")
+}
+
+func TestWithTenantSubstituted(t *testing.T) {
+	tenant := Tenant{
+		Name:         "team-a",
+		Repositories: []string{"/srv/team-a/packages"},
+	}
+	config := func() types.ImageConfiguration {
+		return types.ImageConfiguration{
+			Vars: map[string]string{"PACKAGES": "/srv/team-a/packages"},
+			Contents: types.ImageContents{
+				Packages: []string{"${PACKAGES}/app-1.0-r0.apk"},
+			},
+		}
+	}
+
+	_, err := New(t.TempDir(), WithImageConfiguration(config()), WithTenant(tenant))
+	require.NoError(t, err)
+
+	_, err = New(t.TempDir(), WithImageConfiguration(config()), WithTenant(tenant), WithVars([]string{"PACKAGES=/srv/team-b/packages"}))
+	require.Error(t, err, "the tenant checks the packages once the variables are set")
+}
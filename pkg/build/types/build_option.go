@@ -28,9 +28,11 @@ type ContentsOption struct {
 }
 
 // AccountsOption describes an optional deviation to an apko environment's
-// run-as setting.
+// run-as setting and its users and groups.
 type AccountsOption struct {
-	RunAs string `yaml:"run-as,omitempty"`
+	RunAs  string  `yaml:"run-as,omitempty"`
+	Users  []User  `yaml:"users,omitempty"`
+	Groups []Group `yaml:"groups,omitempty"`
 }
 
 // BuildOption describes an optional deviation to an apko environment.
@@ -64,7 +66,12 @@ func (bo BuildOption) Apply(ic *ImageConfiguration) error {
 	if bo.Accounts.RunAs != "" {
 		ic.Accounts.RunAs = bo.Accounts.RunAs
 	}
+	ic.Accounts.Users = append(ic.Accounts.Users, bo.Accounts.Users...)
+	ic.Accounts.Groups = append(ic.Accounts.Groups, bo.Accounts.Groups...)
 
+	if len(bo.Environment) > 0 && ic.Environment == nil {
+		ic.Environment = map[string]string{}
+	}
 	for k, v := range bo.Environment {
 		ic.Environment[k] = v
 	}
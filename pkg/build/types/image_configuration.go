@@ -16,16 +16,59 @@ package types
 
 import (
 	"fmt"
+	"io"
 	"os"
-
-	"github.com/jinzhu/copier"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/google/go-containerregistry/pkg/name"
 	"gopkg.in/yaml.v3"
 
 	"chainguard.dev/apko/pkg/fetch"
 	"chainguard.dev/apko/pkg/log"
+	"chainguard.dev/apko/pkg/s6"
 	"chainguard.dev/apko/pkg/vcs"
 )
 
+// validVariantName matches names which can be appended to an image tag.
+var validVariantName = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,63}$`)
+
+// validChecksum matches the checksums of archives.
+var validChecksum = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// validKeyFingerprint matches the fingerprints pinning the keys of a keys
+// package.
+var validKeyFingerprint = regexp.MustCompile(`^(sha256:)?[0-9a-fA-F]{64}$`)
+
+// validExpiresAfter matches the durations of the quay.expires-after label.
+var validExpiresAfter = regexp.MustCompile(`^[1-9][0-9]*[smhdw]$`)
+
+// signals are the numbers of the Linux signals a container may be stopped
+// with, by name without the SIG prefix. The real-time ones are RTMIN+n and
+// RTMAX-n.
+var signals = map[string]int{
+	"HUP": 1, "INT": 2, "QUIT": 3, "ILL": 4, "TRAP": 5, "ABRT": 6, "BUS": 7,
+	"FPE": 8, "KILL": 9, "USR1": 10, "SEGV": 11, "USR2": 12, "PIPE": 13,
+	"ALRM": 14, "TERM": 15, "STKFLT": 16, "CHLD": 17, "CONT": 18, "STOP": 19,
+	"TSTP": 20, "TTIN": 21, "TTOU": 22, "URG": 23, "XCPU": 24, "XFSZ": 25,
+	"VTALRM": 26, "PROF": 27, "WINCH": 28, "IO": 29, "PWR": 30, "SYS": 31,
+}
+
+const sigrtmin, sigrtmax = 34, 64
+
+// maxConfigSize bounds the size of image configurations, all of which are
+// far smaller.
+const maxConfigSize = 16 << 20
+
+// maxIncludeDepth bounds the chains of includes, which would not end for a
+// configuration including itself.
+const maxIncludeDepth = 16
+
 // Attempt to probe an upstream VCS URL if known.
 func (ic *ImageConfiguration) ProbeVCSUrl(imageConfigPath string, logger log.Logger) {
 	url, err := vcs.ProbeDirFromPath(imageConfigPath)
@@ -40,60 +83,64 @@ func (ic *ImageConfiguration) ProbeVCSUrl(imageConfigPath string, logger log.Log
 	}
 }
 
-// Parse a configuration blob into an ImageConfiguration struct.
-func (ic *ImageConfiguration) parse(configData []byte, logger log.Logger) error {
+// Parse a configuration blob into an ImageConfiguration struct, with at most
+// includes nested includes.
+func (ic *ImageConfiguration) parse(configData []byte, logger log.Logger, includes int) error {
+	if len(configData) > maxConfigSize {
+		return fmt.Errorf("image configuration is larger than the limit of %d bytes", maxConfigSize)
+	}
 	if err := yaml.Unmarshal(configData, ic); err != nil {
 		return fmt.Errorf("failed to parse image configuration: %w", err)
 	}
 
+	var bases []string
 	if ic.Include != "" {
-		logger.Printf("including %s for configuration", ic.Include)
+		bases = append(bases, ic.Include)
+	}
+	bases = append(bases, ic.Extends...)
+	if len(bases) == 0 {
+		return nil
+	}
+	if includes <= 0 {
+		return fmt.Errorf("failed to read include file %s: more than %d nested includes", bases[0], maxIncludeDepth)
+	}
 
-		baseIc := ImageConfiguration{}
+	// the bases are merged in order, each overriding the previous ones, and
+	// the configuration itself overrides them all
+	var merged *ImageConfiguration
+	for _, base := range bases {
+		logger.Printf("including %s for configuration", base)
 
-		if err := baseIc.Load(ic.Include, logger); err != nil {
+		baseIc := ImageConfiguration{}
+		if err := baseIc.load(base, logger, includes-1); err != nil {
 			return fmt.Errorf("failed to read include file: %w", err)
 		}
-
-		mergedIc := ImageConfiguration{}
-
-		// Copy the base configuration...
-		if err := copier.Copy(&mergedIc, &baseIc); err != nil {
-			return fmt.Errorf("failed to copy base configuration: %w", err)
+		if merged != nil {
+			baseIc = mergeConfigurations(merged, &baseIc)
 		}
-
-		// ... and then overlay the local configuration on top.
-		if err := copier.CopyWithOption(&mergedIc, ic, copier.Option{IgnoreEmpty: true}); err != nil {
-			return fmt.Errorf("failed to overlay specific configuration: %w", err)
-		}
-
-		// Now copy the merged configuration back to ic.
-		if err := copier.Copy(ic, &mergedIc); err != nil {
-			return fmt.Errorf("failed to copy merged configuration: %w", err)
-		}
-
-		// Merge packages, repositories and keyrings.
-		keyring := append([]string{}, baseIc.Contents.Keyring...)
-		keyring = append(keyring, mergedIc.Contents.Keyring...)
-		ic.Contents.Keyring = keyring
-
-		repos := append([]string{}, baseIc.Contents.Repositories...)
-		repos = append(repos, mergedIc.Contents.Repositories...)
-		ic.Contents.Repositories = repos
-
-		pkgs := append([]string{}, baseIc.Contents.Packages...)
-		pkgs = append(pkgs, mergedIc.Contents.Packages...)
-		ic.Contents.Packages = pkgs
+		merged = &baseIc
 	}
+	*ic = mergeConfigurations(merged, ic)
 
 	return nil
 }
 
 // Loads an image configuration given a configuration file path.
 func (ic *ImageConfiguration) Load(imageConfigPath string, logger log.Logger) error {
-	data, err := os.ReadFile(imageConfigPath)
+	return ic.load(imageConfigPath, logger, maxIncludeDepth)
+}
+
+func (ic *ImageConfiguration) load(imageConfigPath string, logger log.Logger, includes int) error {
+	data, err := readConfig(imageConfigPath)
 	if err == nil {
-		return ic.parse(data, logger)
+		if err := ic.parse(data, logger, includes); err != nil {
+			return err
+		}
+		ic.resolveCopySources(filepath.Dir(imageConfigPath))
+		if ic.Base.Layout != "" && !filepath.IsAbs(ic.Base.Layout) {
+			ic.Base.Layout = filepath.Join(filepath.Dir(imageConfigPath), ic.Base.Layout)
+		}
+		return nil
 	}
 
 	// At this point, we're doing a remote config file.
@@ -104,7 +151,45 @@ func (ic *ImageConfiguration) Load(imageConfigPath string, logger log.Logger) er
 		return fmt.Errorf("unable to fetch remote include from git: %w", err)
 	}
 
-	return ic.parse(data, logger)
+	if err := ic.parse(data, logger, includes); err != nil {
+		return err
+	}
+	for _, mut := range ic.Paths {
+		if mut.Type == PathCopy && !filepath.IsAbs(mut.Source) {
+			return fmt.Errorf("path %s of remote configuration %s copies the relative path %s", mut.Path, imageConfigPath, mut.Source)
+		}
+		if mut.Type == PathArchive && !filepath.IsAbs(mut.Source) && !IsArchiveURL(mut.Source) {
+			return fmt.Errorf("path %s of remote configuration %s extracts the relative path %s", mut.Path, imageConfigPath, mut.Source)
+		}
+	}
+	if ic.Base.Layout != "" && !filepath.IsAbs(ic.Base.Layout) {
+		return fmt.Errorf("remote configuration %s has the base layout at the relative path %s", imageConfigPath, ic.Base.Layout)
+	}
+	return nil
+}
+
+// resolveCopySources makes the relative sources of the copied paths and of
+// the archives relative to the directory of the configuration, rather than to
+// the current one. The sources of an included configuration are resolved
+// when it is loaded, so relative to its own directory.
+func (ic *ImageConfiguration) resolveCopySources(dir string) {
+	for i, mut := range ic.Paths {
+		local := mut.Type == PathCopy || (mut.Type == PathArchive && !IsArchiveURL(mut.Source))
+		if local && mut.Source != "" && !filepath.IsAbs(mut.Source) {
+			ic.Paths[i].Source = filepath.Join(dir, mut.Source)
+		}
+	}
+}
+
+// readConfig reads a configuration file, reading no more than one byte past
+// the limit on its size.
+func readConfig(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, maxConfigSize+1))
 }
 
 // Do preflight checks and mutations on an image configuration.
@@ -123,8 +208,22 @@ func (ic *ImageConfiguration) Validate() error {
 		if u.UID == 0 {
 			return fmt.Errorf("configured user %v has UID 0", u)
 		}
+
+		for _, p := range []string{u.HomeDir, u.Shell, u.Skel} {
+			if p != "" && !path.IsAbs(p) {
+				return fmt.Errorf("configured user %s has a relative path %q", u.UserName, p)
+			}
+		}
+		if strings.ContainsAny(u.HomeDir+u.Shell, ":\n") {
+			return fmt.Errorf("configured user %s has a home directory or shell with a colon or newline", u.UserName)
+		}
+		if u.Password != "" && (!strings.HasPrefix(u.Password, "$") || strings.ContainsAny(u.Password, ":\n")) {
+			return fmt.Errorf("configured user %s has a password which is not a crypt(3) hash", u.UserName)
+		}
 	}
 
+	groupNames := map[string]bool{}
+	gids := map[uint32]string{}
 	for _, g := range ic.Accounts.Groups {
 		if g.GroupName == "" {
 			return fmt.Errorf("configured group %v has no configured group name", g)
@@ -133,6 +232,151 @@ func (ic *ImageConfiguration) Validate() error {
 		if g.GID == 0 {
 			return fmt.Errorf("configured group %v has GID 0", g)
 		}
+
+		if groupNames[g.GroupName] {
+			return fmt.Errorf("configured group %s is configured more than once", g.GroupName)
+		}
+		groupNames[g.GroupName] = true
+		if other, ok := gids[g.GID]; ok {
+			return fmt.Errorf("configured groups %s and %s have the same GID %d", other, g.GroupName, g.GID)
+		}
+		gids[g.GID] = g.GroupName
+	}
+
+	for _, u := range ic.Accounts.Users {
+		for _, g := range u.Groups {
+			if g == "" || strings.ContainsAny(g, ":,\n") {
+				return fmt.Errorf("configured user %s has an invalid group name %q", u.UserName, g)
+			}
+		}
+	}
+
+	for _, c := range ic.Contents.Credentials {
+		if c.Repository == "" {
+			return fmt.Errorf("configured credentials have no repository")
+		}
+		if c.Password != "" && c.PasswordEnv != "" {
+			return fmt.Errorf("credentials of %s have both a password and a password-env", c.Repository)
+		}
+	}
+
+	if len(ic.Contents.KeyringFingerprints) > 0 && ic.Contents.KeyringPackage == "" {
+		return fmt.Errorf("keyring fingerprints are only used with a keyring package")
+	}
+	for _, fp := range ic.Contents.KeyringFingerprints {
+		if !validKeyFingerprint.MatchString(fp) {
+			return fmt.Errorf("keyring fingerprint %q is not a hex encoded SHA-256 digest", fp)
+		}
+	}
+
+	for name := range ic.Variants {
+		if !validVariantName.MatchString(name) {
+			return fmt.Errorf("variant name %q is not usable as a tag suffix", name)
+		}
+	}
+
+	for _, mode := range []string{ic.Documentation.ManPages, ic.Documentation.Completions} {
+		switch mode {
+		case "", DocumentationKeep, DocumentationStrip, DocumentationRelocate:
+		default:
+			return fmt.Errorf("unknown documentation mode %q, must be %q, %q or %q",
+				mode, DocumentationKeep, DocumentationStrip, DocumentationRelocate)
+		}
+	}
+
+	switch ic.Contents.FileCollisions {
+	case "", FileCollisionsError, FileCollisionsWarn:
+	default:
+		return fmt.Errorf("unknown file collisions mode %q, must be %q or %q",
+			ic.Contents.FileCollisions, FileCollisionsError, FileCollisionsWarn)
+	}
+
+	if ic.StopSignal != "" {
+		if _, err := StopSignalName(ic.StopSignal); err != nil {
+			return err
+		}
+	}
+
+	if ic.WorkDir != "" && !path.IsAbs(ic.WorkDir) {
+		return fmt.Errorf("work-dir %q must be an absolute path", ic.WorkDir)
+	}
+
+	if _, err := ic.ExposedPortSet(); err != nil {
+		return err
+	}
+
+	for _, mut := range ic.Paths {
+		if mut.Type == PathCopy && mut.Source == "" {
+			return fmt.Errorf("path %s copies no source", mut.Path)
+		}
+		if mut.Type == PathArchive && mut.Source == "" {
+			return fmt.Errorf("path %s extracts no archive", mut.Path)
+		}
+		if mut.Type == PathArchive && IsArchiveURL(mut.Source) && mut.Checksum == "" {
+			return fmt.Errorf("path %s extracts the archive at %s, which has no checksum", mut.Path, mut.Source)
+		}
+		if mut.Checksum != "" {
+			if mut.Type != PathArchive {
+				return fmt.Errorf("path %s has a checksum, but is not an %s", mut.Path, PathArchive)
+			}
+			if !validChecksum.MatchString(mut.Checksum) {
+				return fmt.Errorf("path %s has checksum %q, which is not sha256:<hex>", mut.Path, mut.Checksum)
+			}
+		}
+		if mut.Type != PathFile && (mut.Contents != "" || mut.Template) {
+			return fmt.Errorf("path %s has contents, but is not a %s", mut.Path, PathFile)
+		}
+		if mut.Template {
+			if _, err := template.New(mut.Path).Parse(mut.Contents); err != nil {
+				return fmt.Errorf("path %s has an invalid template: %w", mut.Path, err)
+			}
+		}
+	}
+
+	if ic.Base.Ref != "" && ic.Base.Layout != "" {
+		return fmt.Errorf("base image has both a ref and a layout")
+	}
+	if ic.Base.Ref != "" {
+		if _, err := name.ParseReference(ic.Base.Ref); err != nil {
+			return fmt.Errorf("base image ref %q: %w", ic.Base.Ref, err)
+		}
+	}
+
+	volumes := map[string]bool{}
+	for _, v := range ic.Volumes {
+		if !path.IsAbs(v.Path) || path.Clean(v.Path) == "/" {
+			return fmt.Errorf("volume %q must be an absolute path other than /", v.Path)
+		}
+		if volumes[path.Clean(v.Path)] {
+			return fmt.Errorf("volume %s is declared more than once", v.Path)
+		}
+		volumes[path.Clean(v.Path)] = true
+	}
+
+	if ic.Healthcheck != nil {
+		if err := ic.Healthcheck.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := ic.Expiry.Validate(); err != nil {
+		return err
+	}
+
+	if err := ic.Layering.Validate(); err != nil {
+		return err
+	}
+
+	switch ic.NameResolution.NSSwitch {
+	case "", NSSwitchAuto, NSSwitchAlways:
+	default:
+		return fmt.Errorf("unknown nsswitch mode %q, must be %q or %q",
+			ic.NameResolution.NSSwitch, NSSwitchAuto, NSSwitchAlways)
+	}
+	for db, sources := range ic.NameResolution.Databases {
+		if len(sources) == 0 {
+			return fmt.Errorf("name service database %s has no sources", db)
+		}
 	}
 
 	if ic.OSRelease.ID == "" {
@@ -155,15 +399,192 @@ func (ic *ImageConfiguration) Validate() error {
 	return nil
 }
 
+// Validate checks that the expiry is understood by registries.
+func (e Expiry) Validate() error {
+	if e.ExpiresAfter != "" && !validExpiresAfter.MatchString(e.ExpiresAfter) {
+		return fmt.Errorf("invalid expiry %q, must be a number followed by s, m, h, d or w, e.g. 2w", e.ExpiresAfter)
+	}
+	if e.Tier != "" && strings.ContainsAny(e.Tier, " \t\n") {
+		return fmt.Errorf("invalid tier %q, must not contain whitespace", e.Tier)
+	}
+	return nil
+}
+
+// Validate checks the layering strategy is known, along with its budget and
+// groups.
+func (l Layering) Validate() error {
+	switch l.Strategy {
+	case "", LayeringSquash:
+	case LayeringPackages:
+		if l.Budget != 0 && l.Budget < 3 {
+			return fmt.Errorf("layering budget %d must be at least 3", l.Budget)
+		}
+	case LayeringGroups:
+		if len(l.Groups) == 0 {
+			return fmt.Errorf("layering strategy %q has no groups", l.Strategy)
+		}
+	default:
+		return fmt.Errorf("unknown layering strategy %q, must be %q, %q or %q",
+			l.Strategy, LayeringSquash, LayeringPackages, LayeringGroups)
+	}
+	names := map[string]bool{}
+	for _, g := range l.Groups {
+		if g.Name == "" || names[g.Name] {
+			return fmt.Errorf("layer groups must have distinct names, got %q", g.Name)
+		}
+		names[g.Name] = true
+		for _, pattern := range g.Packages {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("layer group %s has an invalid pattern %q: %w", g.Name, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Layered returns whether the image is split into several layers.
+func (l Layering) Layered() bool {
+	return l.Strategy != "" && l.Strategy != LayeringSquash
+}
+
+// StopSignalName returns the name of a signal, given by name, with or without
+// the SIG prefix, or by number, e.g. SIGQUIT for QUIT or 3, which is how
+// runtimes read the stop signal of images. Real-time signals, which have no
+// names of their own, are returned by number, e.g. 36 for RTMIN+2.
+func StopSignalName(sig string) (string, error) {
+	name := strings.TrimPrefix(strings.ToUpper(sig), "SIG")
+	if _, ok := signals[name]; ok {
+		return "SIG" + name, nil
+	}
+	if n, err := strconv.Atoi(sig); err == nil {
+		for name, m := range signals {
+			if n == m {
+				return "SIG" + name, nil
+			}
+		}
+		if n >= sigrtmin && n <= sigrtmax {
+			return strconv.Itoa(n), nil
+		}
+	}
+	switch {
+	case name == "RTMIN":
+		return strconv.Itoa(sigrtmin), nil
+	case name == "RTMAX":
+		return strconv.Itoa(sigrtmax), nil
+	case strings.HasPrefix(name, "RTMIN+"):
+		n, err := strconv.Atoi(strings.TrimPrefix(name, "RTMIN+"))
+		if err == nil && n >= 0 && sigrtmin+n <= sigrtmax {
+			return strconv.Itoa(sigrtmin + n), nil
+		}
+	case strings.HasPrefix(name, "RTMAX-"):
+		n, err := strconv.Atoi(strings.TrimPrefix(name, "RTMAX-"))
+		if err == nil && n >= 0 && sigrtmax-n >= sigrtmin {
+			return strconv.Itoa(sigrtmax - n), nil
+		}
+	}
+	return "", fmt.Errorf("unknown stop signal %q", sig)
+}
+
+// Validate checks the healthcheck has either a command or a shell fragment,
+// and no negative durations or retries.
+func (h Healthcheck) Validate() error {
+	if (h.Command == "") == (h.ShellFragment == "") {
+		return fmt.Errorf("healthcheck must have either a command or a shell fragment")
+	}
+	if h.Interval < 0 || h.Timeout < 0 || h.StartPeriod < 0 || h.Retries < 0 {
+		return fmt.Errorf("healthcheck durations and retries must not be negative")
+	}
+	return nil
+}
+
+// ExposedPortSet returns the exposed ports as the keys of the ExposedPorts of
+// an OCI image config, e.g. 8080/tcp.
+func (ic *ImageConfiguration) ExposedPortSet() (map[string]struct{}, error) {
+	if len(ic.ExposedPorts) == 0 {
+		return nil, nil
+	}
+	ports := make(map[string]struct{}, len(ic.ExposedPorts))
+	for _, p := range ic.ExposedPorts {
+		port, proto, ok := strings.Cut(p, "/")
+		if !ok {
+			proto = "tcp"
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 || strconv.Itoa(n) != port {
+			return nil, fmt.Errorf("invalid exposed port %q, must be a port from 1 to 65535, e.g. 8080 or 53/udp", p)
+		}
+		switch proto {
+		case "tcp", "udp", "sctp":
+		default:
+			return nil, fmt.Errorf("invalid exposed port %q, the protocol must be tcp, udp or sctp", p)
+		}
+		ports[port+"/"+proto] = struct{}{}
+	}
+	return ports, nil
+}
+
+// Annotations returns the annotations marking the image for expiry, which
+// are also set as labels for the registries reading those.
+func (e Expiry) Annotations() map[string]string {
+	annotations := map[string]string{}
+	if e.ExpiresAfter != "" {
+		annotations[ExpiresAfterAnnotation] = e.ExpiresAfter
+	}
+	if e.Tier != "" {
+		annotations[TierAnnotation] = e.Tier
+	}
+	return annotations
+}
+
 // Do preflight checks and mutations on an image configured to manage
 // a service bundle.
 func (ic *ImageConfiguration) ValidateServiceBundle() error {
-	ic.Entrypoint.Command = "/bin/s6-svscan /sv"
+	services, err := s6.ParseServices(ic.Entrypoint.Services)
+	if err != nil {
+		return fmt.Errorf("invalid services: %w", err)
+	}
+
+	scandir := ic.Entrypoint.ScanDirectory
+	if scandir == "" {
+		scandir = "/sv"
+	}
+	if !path.IsAbs(scandir) || path.Clean(scandir) == "/" {
+		return fmt.Errorf("scan directory %q must be an absolute path other than /", scandir)
+	}
+	for _, arg := range ic.Entrypoint.ScanArgs {
+		if !strings.HasPrefix(arg, "-") {
+			return fmt.Errorf("scan argument %q is not a flag of s6-svscan", arg)
+		}
+	}
+	program := ic.Entrypoint.Init
+	if program == "" {
+		program = "/bin/s6-svscan"
+	}
+	ic.Entrypoint.Command = strings.Join(append(append([]string{program}, ic.Entrypoint.ScanArgs...), path.Clean(scandir)), " ")
 
 	// It's harmless to have a duplicate entry in /etc/apk/world,
 	// apk will fix it up when the fixate op happens.
 	ic.Contents.Packages = append(ic.Contents.Packages, "s6")
 
+	switch ic.Entrypoint.Supervisor {
+	case "", "s6":
+		if len(ic.Entrypoint.Bundles) != 0 {
+			return fmt.Errorf("bundles are only supported with the s6-rc supervisor")
+		}
+	case "s6-rc":
+		ic.Contents.Packages = append(ic.Contents.Packages, "s6-rc")
+	default:
+		return fmt.Errorf("unknown supervisor %q", ic.Entrypoint.Supervisor)
+	}
+
+	// Scheduled services wait with snooze.
+	for _, svc := range services {
+		if svc.Schedule != "" {
+			ic.Contents.Packages = append(ic.Contents.Packages, "snooze")
+			break
+		}
+	}
+
 	return nil
 }
 
@@ -186,12 +607,36 @@ func (ic *ImageConfiguration) Summarize(logger log.Logger) {
 	if ic.StopSignal != "" {
 		logger.Printf("  stop signal: %s", ic.StopSignal)
 	}
+	if ic.WorkDir != "" {
+		logger.Printf("  work dir: %s", ic.WorkDir)
+	}
+	if len(ic.ExposedPorts) != 0 {
+		logger.Printf("  exposed ports: %v", ic.ExposedPorts)
+	}
+	if ic.Base.Set() {
+		logger.Printf("  base: %s%s", ic.Base.Ref, ic.Base.Layout)
+	}
+	if ic.Healthcheck != nil {
+		logger.Printf("  healthcheck:")
+		logger.Printf("    command:        %s", ic.Healthcheck.Command)
+		logger.Printf("    shell fragment: %s", ic.Healthcheck.ShellFragment)
+	}
+	if len(ic.Volumes) != 0 {
+		logger.Printf("  volumes:")
+		for _, v := range ic.Volumes {
+			logger.Printf("    - %s uid=%d gid=%d", v.Path, v.UID, v.GID)
+		}
+	}
 
 	if ic.Accounts.RunAs != "" || len(ic.Accounts.Users) != 0 || len(ic.Accounts.Groups) != 0 {
 		logger.Printf("  accounts:")
 		logger.Printf("    runas:  %s", ic.Accounts.RunAs)
 		logger.Printf("    users:")
 		for _, u := range ic.Accounts.Users {
+			if len(u.Groups) != 0 {
+				logger.Printf("      - uid=%d(%s) gid=%d groups=%v", u.UID, u.UserName, u.GID, u.Groups)
+				continue
+			}
 			logger.Printf("      - uid=%d(%s) gid=%d", u.UID, u.UserName, u.GID)
 		}
 		logger.Printf("    groups:")
@@ -199,6 +644,17 @@ func (ic *ImageConfiguration) Summarize(logger log.Logger) {
 			logger.Printf("      - gid=%d(%s) members=%v", g.GID, g.GroupName, g.Members)
 		}
 	}
+	if variants := ic.VariantNames(); len(variants) > 0 {
+		logger.Printf("  variants: %v", variants)
+	}
+	if ic.Expiry.ExpiresAfter != "" || ic.Expiry.Tier != "" {
+		logger.Printf("  expiry:")
+		logger.Printf("    expires after: %s", ic.Expiry.ExpiresAfter)
+		logger.Printf("    tier:          %s", ic.Expiry.Tier)
+	}
+	if ic.Layering.Layered() {
+		logger.Printf("  layering: %s", ic.Layering.Strategy)
+	}
 	if len(ic.Annotations) > 0 {
 		logger.Printf("    annotations:")
 		for k, v := range ic.Annotations {
@@ -206,3 +662,129 @@ func (ic *ImageConfiguration) Summarize(logger log.Logger) {
 		}
 	}
 }
+
+// VariantNames returns the names of the variants declared in the
+// configuration, sorted for reproducibility. The dev variant is included
+// if documentation is relocated to it.
+func (ic *ImageConfiguration) VariantNames() []string {
+	names := make([]string, 0, len(ic.Variants)+1)
+	for name := range ic.Variants {
+		names = append(names, name)
+	}
+	if _, ok := ic.Variants[DevVariant]; !ok && ic.Documentation.Relocates() {
+		names = append(names, DevVariant)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// VariantAddsOnly returns whether the named variant only adds to the image,
+// so that it can be built on top of it rather than from scratch: it removes
+// no package, and keeps no documentation stripped from the image.
+func (ic *ImageConfiguration) VariantAddsOnly(name string) bool {
+	if len(ic.Variants[name].Contents.Packages.Remove) != 0 {
+		return false
+	}
+	return name != DevVariant || !ic.Documentation.Relocates()
+}
+
+// Redacted returns the configuration without the passwords of its
+// credentials, e.g. to be shown.
+func (ic ImageConfiguration) Redacted() ImageConfiguration {
+	if len(ic.Contents.Credentials) == 0 {
+		return ic
+	}
+	credentials := make([]RepositoryCredentials, len(ic.Contents.Credentials))
+	for i, c := range ic.Contents.Credentials {
+		if c.Password != "" {
+			c.Password = "REDACTED"
+		}
+		credentials[i] = c
+	}
+	ic.Contents.Credentials = credentials
+	return ic
+}
+
+// ApplyArchOverride applies the override of the architecture, if any, to
+// the configuration, which then has no overrides left, so that applying it
+// again does nothing. Like for variants, the lists and the environment it
+// changes are copied first.
+func (ic *ImageConfiguration) ApplyArchOverride(arch Architecture) error {
+	overridden := map[Architecture]string{}
+	for name := range ic.ArchOverrides {
+		a := ParseArchitecture(name)
+		known := false
+		for _, k := range AllArchs {
+			known = known || a == k
+		}
+		if !known {
+			return fmt.Errorf("arch override %q is not for a known architecture", name)
+		}
+		if other, ok := overridden[a]; ok {
+			return fmt.Errorf("arch overrides %q and %q are for the same architecture", other, name)
+		}
+		overridden[a] = name
+	}
+
+	overrides := ic.ArchOverrides
+	ic.ArchOverrides = nil
+	for name, bo := range overrides {
+		if ParseArchitecture(name) != arch {
+			continue
+		}
+
+		ic.unshare()
+		if err := bo.Apply(ic); err != nil {
+			return fmt.Errorf("applying arch override %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// unshare copies the lists and the environment a BuildOption changes, so
+// that configurations which were copied from one another do not share the
+// change.
+func (ic *ImageConfiguration) unshare() {
+	ic.Contents.Packages = append([]string{}, ic.Contents.Packages...)
+	ic.Accounts.Users = append([]User{}, ic.Accounts.Users...)
+	ic.Accounts.Groups = append([]Group{}, ic.Accounts.Groups...)
+	if ic.Environment != nil {
+		env := make(map[string]string, len(ic.Environment))
+		for k, v := range ic.Environment {
+			env[k] = v
+		}
+		ic.Environment = env
+	}
+}
+
+// ApplyVariant turns the configuration into the named variant, by applying
+// its deviations on top of the base configuration. The lists and maps the
+// variant changes are copied first, see unshare.
+func (ic *ImageConfiguration) ApplyVariant(name string) error {
+	bo, ok := ic.Variants[name]
+	if !ok && !(name == DevVariant && ic.Documentation.Relocates()) {
+		return fmt.Errorf("variant %q is not defined", name)
+	}
+
+	ic.unshare()
+
+	if err := bo.Apply(ic); err != nil {
+		return fmt.Errorf("applying variant %q: %w", name, err)
+	}
+
+	// documentation relocated to the dev variant is kept there, and
+	// stripped from the other variants like from the image
+	if name == DevVariant {
+		if ic.Documentation.ManPages == DocumentationRelocate {
+			ic.Documentation.ManPages = DocumentationKeep
+		}
+		if ic.Documentation.Completions == DocumentationRelocate {
+			ic.Documentation.Completions = DocumentationKeep
+		}
+	}
+
+	// a variant does not have variants of its own
+	ic.Variants = nil
+
+	return nil
+}
@@ -0,0 +1,305 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/apko/pkg/log"
+)
+
+func TestLoadIncludeLoop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apko.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("include: "+path+"\n"), 0o644))
+
+	var ic ImageConfiguration
+	err := ic.Load(path, &log.Adapter{Out: io.Discard})
+	require.ErrorContains(t, err, "nested includes")
+}
+
+func TestLoadCopySources(t *testing.T) {
+	base, top := t.TempDir(), t.TempDir()
+	basePath := filepath.Join(base, "base.yaml")
+	require.NoError(t, os.WriteFile(basePath, []byte(`
+paths:
+  - path: /etc/app/app.conf
+    type: copy
+    source: files/app.conf
+  - path: /etc/motd
+    type: copy
+    source: /srv/motd
+`), 0o644))
+
+	var ic ImageConfiguration
+	path := filepath.Join(top, "apko.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("include: "+basePath+"\n"), 0o644))
+	require.NoError(t, ic.Load(path, &log.Adapter{Out: io.Discard}))
+	require.Equal(t, filepath.Join(base, "files/app.conf"), ic.Paths[0].Source, "relative to the included configuration")
+	require.Equal(t, "/srv/motd", ic.Paths[1].Source)
+
+	ic = ImageConfiguration{}
+	require.NoError(t, os.WriteFile(path, []byte(`
+paths:
+  - path: /usr/bin/entrypoint.sh
+    type: copy
+    source: entrypoint.sh
+`), 0o644))
+	require.NoError(t, ic.Load(path, &log.Adapter{Out: io.Discard}))
+	require.Equal(t, filepath.Join(top, "entrypoint.sh"), ic.Paths[0].Source)
+
+	require.Error(t, (&ImageConfiguration{Paths: []PathMutation{{Path: "/etc/app", Type: PathCopy}}}).Validate())
+}
+
+func TestLoadExtends(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(data), 0o644))
+		return path
+	}
+	write("base.yaml", `
+contents:
+  repositories: [https://packages.wolfi.dev/os]
+  packages: [wolfi-baselayout, ca-certificates-bundle]
+entrypoint:
+  command: /usr/bin/app
+cmd: --serve
+environment:
+  PATH: /usr/bin
+  APP_MODE: dev
+accounts:
+  run-as: "65532"
+  users:
+    - username: nonroot
+      uid: 65532
+paths:
+  - path: /data
+    type: directory
+    permissions: 0o755
+archs: [x86_64, aarch64]
+`)
+	write("nonroot.yaml", `
+accounts:
+  groups:
+    - groupname: nonroot
+      gid: 65532
+`)
+	path := write("apko.yaml", `
+include: `+filepath.Join(dir, "base.yaml")+`
+extends: [`+filepath.Join(dir, "nonroot.yaml")+`]
+contents:
+  packages: [app, ca-certificates-bundle]
+entrypoint:
+  shell-fragment: /usr/bin/app --verbose
+environment:
+  APP_MODE: prod
+accounts:
+  users:
+    - username: nonroot
+      uid: 65532
+      shell: /bin/false
+paths:
+  - path: /data
+    type: directory
+    permissions: 0o700
+  - path: /cache
+    type: directory
+    permissions: 0o700
+`)
+	var ic ImageConfiguration
+	require.NoError(t, ic.Load(path, &log.Adapter{Out: io.Discard}))
+	require.Equal(t, []string{"https://packages.wolfi.dev/os"}, ic.Contents.Repositories)
+	require.Equal(t, []string{"wolfi-baselayout", "ca-certificates-bundle", "app"}, ic.Contents.Packages, "base first, once each")
+	require.Equal(t, "/usr/bin/app", ic.Entrypoint.Command, "merged field by field")
+	require.Equal(t, "/usr/bin/app --verbose", ic.Entrypoint.ShellFragment)
+	require.Equal(t, "--serve", ic.Cmd)
+	require.Equal(t, map[string]string{"PATH": "/usr/bin", "APP_MODE": "prod"}, ic.Environment, "merged key by key")
+	require.Equal(t, "65532", ic.Accounts.RunAs)
+	require.Equal(t, []User{{UserName: "nonroot", UID: 65532, Shell: "/bin/false"}}, ic.Accounts.Users, "replaced by name")
+	require.Equal(t, []Group{{GroupName: "nonroot", GID: 65532}}, ic.Accounts.Groups)
+	require.Len(t, ic.Paths, 2)
+	require.Equal(t, uint32(0o700), ic.Paths[0].Permissions, "replaced by path")
+	require.Equal(t, "/cache", ic.Paths[1].Path)
+	require.Equal(t, []Architecture{amd64, arm64}, ic.Archs)
+}
+
+func TestMergeConfigurations(t *testing.T) {
+	base := ImageConfiguration{
+		Environment: map[string]string{"PATH": "/usr/bin"},
+		Healthcheck: &Healthcheck{Command: "/usr/bin/check", Retries: 3},
+		Archs:       []Architecture{amd64, arm64},
+		Contents:    ImageContents{Credentials: []RepositoryCredentials{{Repository: "https://base"}}},
+		Base:        BaseImage{Layout: "/srv/base"},
+	}
+	local := ImageConfiguration{
+		Environment: map[string]string{"APP_MODE": "prod"},
+		Healthcheck: &Healthcheck{Retries: 5},
+		Archs:       []Architecture{arm64},
+		Contents:    ImageContents{Credentials: []RepositoryCredentials{{Repository: "https://local"}}},
+		Base:        BaseImage{Ref: "cgr.dev/chainguard/static"},
+	}
+
+	merged := mergeConfigurations(&base, &local)
+	require.Equal(t, map[string]string{"PATH": "/usr/bin", "APP_MODE": "prod"}, merged.Environment)
+	require.Equal(t, &Healthcheck{Command: "/usr/bin/check", Retries: 5}, merged.Healthcheck)
+	require.Equal(t, []Architecture{arm64}, merged.Archs, "replaced")
+	require.Equal(t, []RepositoryCredentials{{Repository: "https://local"}, {Repository: "https://base"}}, merged.Contents.Credentials, "local first")
+
+	require.Equal(t, BaseImage{Ref: "cgr.dev/chainguard/static"}, merged.Base, "replaced as a whole")
+
+	require.Equal(t, map[string]string{"PATH": "/usr/bin"}, base.Environment, "the base is unchanged")
+	require.Equal(t, 3, base.Healthcheck.Retries)
+}
+
+func TestValidateBase(t *testing.T) {
+	require.NoError(t, (&ImageConfiguration{Base: BaseImage{Ref: "cgr.dev/chainguard/static:latest"}}).Validate())
+	require.NoError(t, (&ImageConfiguration{Base: BaseImage{Layout: "/srv/base"}}).Validate())
+	require.Error(t, (&ImageConfiguration{Base: BaseImage{Ref: "cgr.dev/chainguard/static", Layout: "/srv/base"}}).Validate())
+	require.Error(t, (&ImageConfiguration{Base: BaseImage{Ref: "cgr.dev/Chainguard/static"}}).Validate())
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "apko.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("base:\n  layout: base\n"), 0o644))
+	var ic ImageConfiguration
+	require.NoError(t, ic.Load(path, &log.Adapter{Out: io.Discard}))
+	require.Equal(t, filepath.Join(dir, "base"), ic.Base.Layout, "relative to the configuration")
+}
+
+func TestValidateKeyringFingerprints(t *testing.T) {
+	fp := strings.Repeat("ab", 32)
+	contents := func(pkg string, fps ...string) *ImageConfiguration {
+		return &ImageConfiguration{Contents: ImageContents{KeyringPackage: pkg, KeyringFingerprints: fps}}
+	}
+	require.NoError(t, contents("wolfi-keys", fp, "sha256:"+strings.ToUpper(fp)).Validate())
+	require.Error(t, contents("", fp).Validate(), "no keys package")
+	require.Error(t, contents("wolfi-keys", "sha256:abc").Validate())
+	require.Error(t, contents("wolfi-keys", "sha1:"+fp).Validate())
+}
+
+func TestValidateServiceBundle(t *testing.T) {
+	ic := ImageConfiguration{Entrypoint: ImageEntrypoint{
+		Type:     "service-bundle",
+		Services: map[interface{}]interface{}{"app": "/usr/bin/app"},
+	}}
+	require.NoError(t, ic.ValidateServiceBundle())
+	require.Equal(t, "/bin/s6-svscan /sv", ic.Entrypoint.Command)
+
+	ic.Entrypoint.ScanDirectory = "/run/service/"
+	ic.Entrypoint.ScanArgs = []string{"-d", "3"}
+	require.Error(t, ic.ValidateServiceBundle(), "only flags")
+	ic.Entrypoint.ScanArgs = []string{"-d3", "-t0"}
+	ic.Entrypoint.Init = "/usr/bin/s6-svscan"
+	require.NoError(t, ic.ValidateServiceBundle())
+	require.Equal(t, "/usr/bin/s6-svscan -d3 -t0 /run/service", ic.Entrypoint.Command)
+
+	ic.Entrypoint.ScanDirectory = "sv"
+	require.Error(t, ic.ValidateServiceBundle(), "relative scan directory")
+}
+
+func FuzzImageConfigurationParse(f *testing.F) {
+	f.Add([]byte(`
+contents:
+  repositories:
+    - https://dl-cdn.alpinelinux.org/alpine/edge/main
+  packages:
+    - alpine-base
+entrypoint:
+  command: /bin/sh -l
+accounts:
+  users:
+    - username: nonroot
+      uid: 65532
+archs:
+  - x86_64
+`))
+	f.Add([]byte("archs: [[]]\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var ic ImageConfiguration
+		// no includes, which would read files
+		if err := ic.parse(data, &log.Adapter{Out: io.Discard}, 0); err != nil {
+			return
+		}
+		_ = ic.Validate()
+	})
+}
+
+func TestValidateFilePaths(t *testing.T) {
+	for _, mut := range []PathMutation{
+		{Path: "/etc/motd", Type: "empty-file", Contents: "hello"},
+		{Path: "/etc/motd", Type: "directory", Template: true},
+		{Path: "/etc/motd", Type: PathFile, Template: true, Contents: "{{ .Arch "},
+	} {
+		ic := ImageConfiguration{Paths: []PathMutation{mut}}
+		require.Error(t, ic.Validate(), "%+v", mut)
+	}
+
+	ic := ImageConfiguration{Paths: []PathMutation{{Path: "/etc/motd", Type: PathFile, Template: true, Contents: "{{ .Arch }}"}}}
+	require.NoError(t, ic.Validate())
+}
+
+func TestValidateArchivePaths(t *testing.T) {
+	checksum := "sha256:" + strings.Repeat("ab", 32)
+	for _, mut := range []PathMutation{
+		{Path: "/opt/tool", Type: PathArchive},
+		{Path: "/opt/tool", Type: PathArchive, Source: "https://example.com/tool.tar.gz"},
+		{Path: "/opt/tool", Type: PathArchive, Source: "tool.tar.gz", Checksum: "md5:abc"},
+		{Path: "/opt/tool", Type: PathCopy, Source: "tool", Checksum: checksum},
+	} {
+		ic := ImageConfiguration{Paths: []PathMutation{mut}}
+		require.Error(t, ic.Validate(), "%+v", mut)
+	}
+
+	ic := ImageConfiguration{Paths: []PathMutation{
+		{Path: "/opt/tool", Type: PathArchive, Source: "https://example.com/tool.tar.gz", Checksum: checksum},
+		{Path: "/opt/bundle", Type: PathArchive, Source: "/srv/bundle.tar"},
+	}}
+	require.NoError(t, ic.Validate())
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "apko.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+paths:
+  - path: /opt/bundle
+    type: archive
+    source: vendor/bundle.tar.gz
+  - path: /opt/tool
+    type: archive
+    source: https://example.com/tool.tar.gz
+    checksum: `+checksum+`
+`), 0o644))
+	ic = ImageConfiguration{}
+	require.NoError(t, ic.Load(path, &log.Adapter{Out: io.Discard}))
+	require.Equal(t, filepath.Join(dir, "vendor/bundle.tar.gz"), ic.Paths[0].Source, "relative to the configuration")
+	require.Equal(t, "https://example.com/tool.tar.gz", ic.Paths[1].Source)
+	require.Equal(t, checksum, ic.Paths[1].Checksum)
+}
+
+func TestRedacted(t *testing.T) {
+	ic := ImageConfiguration{Contents: ImageContents{Credentials: []RepositoryCredentials{
+		{Repository: "https://apk.example.com/os", Username: "ci", Password: "secret"},
+		{Repository: "apk.example.com", Username: "ci", PasswordEnv: "APK_TOKEN"},
+	}}}
+	redacted := ic.Redacted()
+	require.Equal(t, "REDACTED", redacted.Contents.Credentials[0].Password)
+	require.Equal(t, "APK_TOKEN", redacted.Contents.Credentials[1].PasswordEnv)
+	require.Empty(t, redacted.Contents.Credentials[1].Password)
+	require.Equal(t, "secret", ic.Contents.Credentials[0].Password, "the configuration is left alone")
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"reflect"
+)
+
+// mergeConfigurations overlays the local configuration on top of the base
+// one it includes or extends:
+//
+//   - scalars, e.g. cmd or work-dir, are the local ones unless they are
+//     empty, so a local false does not unset a base true,
+//   - structs, e.g. entrypoint or accounts, are merged field by field,
+//   - maps, e.g. environment, annotations or vars, are merged key by key,
+//     the local values replacing the base ones,
+//   - the repositories, keyring, packages, excluded packages and exposed
+//     ports are the base ones followed by the local ones, once each,
+//   - the credentials are the local ones followed by the base ones, since
+//     the first ones win,
+//   - users, groups, paths and volumes are merged by name or path, the
+//     local ones replacing the base ones,
+//   - other lists, e.g. archs, are the local ones unless they are empty,
+//   - the base image is the local one, if set.
+func mergeConfigurations(base, local *ImageConfiguration) ImageConfiguration {
+	merged := *base
+	overlay(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(local).Elem())
+
+	merged.Contents.Repositories = appendNew(base.Contents.Repositories, local.Contents.Repositories)
+	merged.Contents.Keyring = appendNew(base.Contents.Keyring, local.Contents.Keyring)
+	merged.Contents.Packages = appendNew(base.Contents.Packages, local.Contents.Packages)
+	merged.Contents.Exclude = appendNew(base.Contents.Exclude, local.Contents.Exclude)
+	merged.ExposedPorts = appendNew(base.ExposedPorts, local.ExposedPorts)
+
+	merged.Contents.Credentials = append(append([]RepositoryCredentials{}, local.Contents.Credentials...), base.Contents.Credentials...)
+
+	merged.Accounts.Users = mergeBy(base.Accounts.Users, local.Accounts.Users, func(u User) string { return u.UserName })
+	merged.Accounts.Groups = mergeBy(base.Accounts.Groups, local.Accounts.Groups, func(g Group) string { return g.GroupName })
+	merged.Paths = mergeBy(base.Paths, local.Paths, func(p PathMutation) string { return p.Path })
+	merged.Volumes = mergeBy(base.Volumes, local.Volumes, func(v Volume) string { return v.Path })
+
+	// a ref and a layout do not go together
+	if local.Base.Set() {
+		merged.Base = local.Base
+	}
+
+	return merged
+}
+
+// overlay sets the values of dst which are not empty in src, merging structs
+// and maps. The maps and pointers of dst are replaced rather than changed, as
+// they are shared with the base configuration.
+func overlay(dst, src reflect.Value) {
+	switch src.Kind() {
+	case reflect.Struct:
+		if !exportedFields(src.Type()) {
+			// e.g. an Architecture, which is a value as a whole
+			if !src.IsZero() {
+				dst.Set(src)
+			}
+			return
+		}
+		for i := 0; i < src.NumField(); i++ {
+			overlay(dst.Field(i), src.Field(i))
+		}
+	case reflect.Map:
+		if src.Len() == 0 {
+			return
+		}
+		merged := reflect.MakeMapWithSize(src.Type(), dst.Len()+src.Len())
+		for _, m := range []reflect.Value{dst, src} {
+			iter := m.MapRange()
+			for iter.Next() {
+				merged.SetMapIndex(iter.Key(), iter.Value())
+			}
+		}
+		dst.Set(merged)
+	case reflect.Pointer:
+		if src.IsNil() {
+			return
+		}
+		if dst.IsNil() {
+			dst.Set(src)
+			return
+		}
+		merged := reflect.New(dst.Elem().Type())
+		merged.Elem().Set(dst.Elem())
+		overlay(merged.Elem(), src.Elem())
+		dst.Set(merged)
+	case reflect.Slice:
+		if src.Len() != 0 {
+			dst.Set(src)
+		}
+	default:
+		if !src.IsZero() {
+			dst.Set(src)
+		}
+	}
+}
+
+// exportedFields returns whether every field of the struct type is exported.
+func exportedFields(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if !t.Field(i).IsExported() {
+			return false
+		}
+	}
+	return true
+}
+
+// appendNew returns the base items followed by the local ones, each once.
+func appendNew[T comparable](base, local []T) []T {
+	if len(base) == 0 && len(local) == 0 {
+		return nil
+	}
+	seen := map[T]bool{}
+	merged := make([]T, 0, len(base)+len(local))
+	for _, s := range [][]T{base, local} {
+		for _, item := range s {
+			if !seen[item] {
+				seen[item] = true
+				merged = append(merged, item)
+			}
+		}
+	}
+	return merged
+}
+
+// mergeBy returns the base items, replaced by the local items with the same
+// key, followed by the other local ones.
+func mergeBy[T any](base, local []T, key func(T) string) []T {
+	if len(base) == 0 && len(local) == 0 {
+		return nil
+	}
+	byKey := map[string]int{}
+	merged := make([]T, 0, len(base)+len(local))
+	for _, item := range base {
+		byKey[key(item)] = len(merged)
+		merged = append(merged, item)
+	}
+	for _, item := range local {
+		if i, ok := byKey[key(item)]; ok {
+			merged[i] = item
+			continue
+		}
+		byKey[key(item)] = len(merged)
+		merged = append(merged, item)
+	}
+	return merged
+}
@@ -18,22 +18,61 @@ import (
 	"fmt"
 	"runtime"
 	"sort"
+	"strings"
+	"time"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"chainguard.dev/apko/pkg/arch"
 )
 
 type User struct {
 	UserName string
 	UID      uint32
 	GID      uint32
+	// HomeDir is the home directory of the user, /home/<username> unless
+	// set. Unless it exists, it is created, owned by the user.
+	HomeDir string `yaml:"homedir,omitempty"`
+	// Shell is the login shell of the user, /bin/sh unless set.
+	Shell string `yaml:"shell,omitempty"`
+	// Password is the crypt(3) hash of the password of the user, which is
+	// written to /etc/shadow. Users without one have a locked password.
+	Password string `yaml:"password,omitempty"`
+	// Locked locks the password of the user, keeping its hash.
+	Locked bool `yaml:"locked,omitempty"`
+	// Skel is a directory of the image whose contents are copied into the
+	// home directory when it is created, e.g. /etc/skel.
+	Skel string `yaml:"skel,omitempty"`
+	// Groups are the supplementary groups of the user, by name, e.g. tty or
+	// video. They are either groups of the packages or configured ones.
+	Groups []string `yaml:"groups,omitempty"`
 }
 
+// Group is a group of the image. A group the packages already have gets the
+// GID, and the members are added to its own.
 type Group struct {
 	GroupName string
 	GID       uint32
 	Members   []string
 }
 
+// PathCopy is the type of the paths copied into the image, from Source on
+// the host, relative to the configuration file. Directories are copied with
+// their contents, all owned by UID and GID. Permissions, if set, are those
+// of the path itself, and the copied entries otherwise keep their own.
+const PathCopy = "copy"
+
+// PathFile is the type of the files written with the Contents of the path,
+// with permissions 0o644 unless set.
+const PathFile = "file"
+
+// PathArchive is the type of the directories a tar archive, gzipped or not,
+// is extracted into, from Source, either on the host, relative to the
+// configuration file, or at an http(s) URL, in which case it must have a
+// Checksum. The entries are owned by UID and GID, and Permissions, if set,
+// are those of the directory.
+const PathArchive = "archive"
+
 type PathMutation struct {
 	Path        string
 	Type        string
@@ -42,6 +81,63 @@ type PathMutation struct {
 	Permissions uint32
 	Source      string
 	Recursive   bool
+	// Contents are the contents of a PathFile.
+	Contents string
+	// Template expands the Contents as a text/template, with the
+	// architecture and the environment of the image.
+	Template bool
+	// Checksum is the sha256:<hex> digest of the Source of a PathArchive,
+	// which it must match.
+	Checksum string
+}
+
+// IsArchiveURL returns whether the source of an archive is downloaded,
+// rather than read from the host.
+func IsArchiveURL(source string) bool {
+	return strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://")
+}
+
+// Volume is a directory of the image which is a volume of the containers
+// running it, created with the given owner and permissions.
+type Volume struct {
+	Path string `yaml:"path"`
+	UID  uint32 `yaml:"uid,omitempty"`
+	GID  uint32 `yaml:"gid,omitempty"`
+	// Permissions are those of the directory, 0o755 unless set.
+	Permissions uint32 `yaml:"permissions,omitempty"`
+}
+
+// BaseImage is an existing image the image is built on top of, rather than
+// from scratch, pulled by reference or read from an OCI image layout. Either
+// may be an index, in which case the image of each architecture is picked
+// from it.
+type BaseImage struct {
+	Ref    string `yaml:"ref,omitempty"`
+	Layout string `yaml:"layout,omitempty"`
+}
+
+// Set returns whether the image is built on top of a base image.
+func (b BaseImage) Set() bool {
+	return b.Ref != "" || b.Layout != ""
+}
+
+// Healthcheck is the check container runtimes run to tell whether the
+// containers of the image are healthy, as the HEALTHCHECK of a Dockerfile.
+type Healthcheck struct {
+	// Command is the check, run without a shell.
+	Command string `yaml:"command,omitempty"`
+	// ShellFragment is the check, run with /bin/sh -c.
+	ShellFragment string `yaml:"shell-fragment,omitempty"`
+	// Interval is the time between checks.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Timeout is the time after which a check which did not end fails.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// StartPeriod is the time after the container starts during which
+	// failed checks are not counted.
+	StartPeriod time.Duration `yaml:"start-period,omitempty"`
+	// Retries is the number of checks in a row which fail before the
+	// container is unhealthy.
+	Retries int `yaml:"retries,omitempty"`
 }
 
 type OSRelease struct {
@@ -56,7 +152,68 @@ type OSRelease struct {
 type ImageContents struct {
 	Repositories []string `yaml:"repositories,omitempty"`
 	Keyring      []string `yaml:"keyring,omitempty"`
-	Packages     []string `yaml:"packages,omitempty"`
+	// KeyringPackage names a keys package, e.g. alpine-keys or wolfi-keys,
+	// whose keys are added to the keyring before installing anything else.
+	KeyringPackage string `yaml:"keyring-package,omitempty"`
+	// KeyringFingerprints pin the keys accepted from KeyringPackage, as the
+	// hex encoded SHA-256 digests of their DER encoding.
+	KeyringFingerprints []string `yaml:"keyring-fingerprints,omitempty"`
+	Packages            []string `yaml:"packages,omitempty"`
+	// SignaturePolicy restricts which keys may sign each repository.
+	SignaturePolicy SignaturePolicy `yaml:"signature-policy,omitempty"`
+	// FileCollisions is what happens when a package installs a file
+	// another package installed already.
+	FileCollisions string `yaml:"file-collisions,omitempty"`
+	// Exclude are the paths not installed from any package, with everything
+	// under them, e.g. /usr/share/man. Patterns, e.g. /usr/share/locale/*,
+	// are allowed.
+	Exclude []string `yaml:"exclude,omitempty"`
+	// PackageExclude are the paths not installed from the packages of each
+	// name.
+	PackageExclude map[string][]string `yaml:"package-exclude,omitempty"`
+	// NoarchFallback also resolves packages from the noarch index of each
+	// repository, if any, where no package built for the architecture
+	// matches.
+	NoarchFallback bool `yaml:"noarch-fallback,omitempty"`
+	// Credentials authenticate to private repositories with HTTP basic
+	// auth, ahead of those in HTTP_AUTH and ~/.netrc.
+	Credentials []RepositoryCredentials `yaml:"credentials,omitempty"`
+}
+
+// What to do when packages install the same file.
+const (
+	// FileCollisionsError fails the build, the default.
+	FileCollisionsError = "error"
+	// FileCollisionsWarn logs a warning, and keeps the file of the package
+	// installed last.
+	FileCollisionsWarn = "warn"
+)
+
+// RepositorySignaturePolicy lists the keys which may sign a repository.
+type RepositorySignaturePolicy struct {
+	Repository string   `yaml:"repository"`
+	Keys       []string `yaml:"keys,omitempty"`
+	// Mode is either "enforce" or "warn", defaulting to the policy default.
+	Mode string `yaml:"mode,omitempty"`
+}
+
+// RepositoryCredentials authenticate to a repository with HTTP basic auth.
+type RepositoryCredentials struct {
+	// Repository is either a URL prefix, e.g. https://apk.example.com/os,
+	// or a host, e.g. apk.example.com.
+	Repository string `yaml:"repository"`
+	Username   string `yaml:"username,omitempty"`
+	// Password is better left out of the configuration, in favor of the
+	// environment variable named by PasswordEnv.
+	Password    string `yaml:"password,omitempty"`
+	PasswordEnv string `yaml:"password-env,omitempty"`
+}
+
+type SignaturePolicy struct {
+	// Default is the mode of repositories without a policy of their own,
+	// either "enforce" (the default) or "warn".
+	Default      string                      `yaml:"default,omitempty"`
+	Repositories []RepositorySignaturePolicy `yaml:"repositories,omitempty"`
 }
 
 type ImageEntrypoint struct {
@@ -66,6 +223,20 @@ type ImageEntrypoint struct {
 
 	// TBD: presently a map of service names and the command to run
 	Services map[interface{}]interface{}
+	// Supervisor supervises the services, either "s6" (the default) with a
+	// scan directory, or "s6-rc" with a database compiled at startup.
+	Supervisor string `yaml:"supervisor,omitempty"`
+	// Bundles are the s6-rc bundles, by name, and the services or bundles
+	// they contain.
+	Bundles map[string][]string `yaml:"bundles,omitempty"`
+	// ScanDirectory is the absolute path of the scan directory of
+	// s6-svscan, /sv unless set.
+	ScanDirectory string `yaml:"scan-directory,omitempty"`
+	// ScanArgs are the flags of s6-svscan, before the scan directory.
+	ScanArgs []string `yaml:"scan-args,omitempty"`
+	// Init is the command the container runs with the scan arguments and
+	// the scan directory, /bin/s6-svscan unless set.
+	Init string `yaml:"init,omitempty"`
 }
 
 type ImageAccounts struct {
@@ -74,6 +245,124 @@ type ImageAccounts struct {
 	Groups []Group
 }
 
+// DefaultPath is the PATH of images which do not configure one.
+var DefaultPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// DefaultSSLCertFile is the SSL_CERT_FILE of images which do not configure
+// one.
+const DefaultSSLCertFile = "/etc/ssl/certs/ca-certificates.crt"
+
+// DefaultEnvironment is the environment of images which do not configure one.
+var DefaultEnvironment = map[string]string{
+	"PATH":          strings.Join(DefaultPath, ":"),
+	"SSL_CERT_FILE": DefaultSSLCertFile,
+}
+
+// PathSynthesis configures how the PATH of the image is put together.
+type PathSynthesis struct {
+	// Enabled adds the directories installed packages put executables
+	// into, e.g. /usr/lib/jvm/default-jvm/bin, to the default PATH.
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Prepend and Append are directories to add in front and at the end.
+	Prepend []string `yaml:"prepend,omitempty"`
+	Append  []string `yaml:"append,omitempty"`
+	// Exclude are directories never to add.
+	Exclude []string `yaml:"exclude,omitempty"`
+}
+
+// What to do with a kind of documentation installed by packages.
+const (
+	// DocumentationKeep leaves it in the image, the default.
+	DocumentationKeep = "keep"
+	// DocumentationStrip removes it from the image.
+	DocumentationStrip = "strip"
+	// DocumentationRelocate removes it from the image, and keeps it in the
+	// dev variant.
+	DocumentationRelocate = "relocate"
+)
+
+// DevVariant is the variant documentation is relocated to. It is built
+// even if the configuration does not declare it.
+const DevVariant = "dev"
+
+// Documentation configures what happens to the man pages and shell
+// completions installed by packages.
+type Documentation struct {
+	ManPages    string `yaml:"man-pages,omitempty"`
+	Completions string `yaml:"completions,omitempty"`
+}
+
+// Relocates reports whether any documentation is relocated to the dev
+// variant.
+func (d Documentation) Relocates() bool {
+	return d.ManPages == DocumentationRelocate || d.Completions == DocumentationRelocate
+}
+
+// When to generate /etc/nsswitch.conf.
+const (
+	// NSSwitchAuto generates it for glibc images without one.
+	NSSwitchAuto = "auto"
+	// NSSwitchAlways generates it, replacing the one installed by packages.
+	NSSwitchAlways = "always"
+)
+
+// NameResolution configures the name service switch, which glibc uses to
+// look up users, groups and hosts.
+type NameResolution struct {
+	// NSSwitch is when to generate /etc/nsswitch.conf, never if empty.
+	NSSwitch string `yaml:"nsswitch,omitempty"`
+	// Databases override the sources of the default databases, e.g.
+	// `hosts: [files, dns]`, or add more.
+	Databases map[string][]string `yaml:"databases,omitempty"`
+}
+
+// Annotations and labels read by registry garbage collection policies.
+const (
+	// ExpiresAfterAnnotation is how long Quay, and registries following it,
+	// keep the image, e.g. 2w.
+	ExpiresAfterAnnotation = "quay.expires-after"
+	// TierAnnotation is the retention tier of the image, e.g. ephemeral.
+	TierAnnotation = "dev.chainguard.apko.tier"
+)
+
+// Expiry marks images for registries to clean up, e.g. ephemeral CI images.
+type Expiry struct {
+	// ExpiresAfter is how long the image is kept, as a number followed by
+	// s, m, h, d or w.
+	ExpiresAfter string `yaml:"expires-after,omitempty"`
+	// Tier is the retention tier, for policies keyed on it.
+	Tier string `yaml:"tier,omitempty"`
+}
+
+const (
+	// LayeringSquash writes the whole image as a single layer, the default.
+	LayeringSquash = "squash"
+	// LayeringPackages writes a layer per package, up to the budget.
+	LayeringPackages = "packages"
+	// LayeringGroups writes a layer per group of packages.
+	LayeringGroups = "groups"
+)
+
+// Layering is how the files of the image are split into layers, so that
+// changing a package only changes the layers it is in.
+type Layering struct {
+	// Strategy is LayeringSquash, LayeringPackages or LayeringGroups.
+	Strategy string `yaml:"strategy,omitempty"`
+	// Budget is the most layers of LayeringPackages, 20 unless set. The
+	// largest packages get layers of their own, the others share one.
+	Budget int `yaml:"budget,omitempty"`
+	// Groups are the groups of LayeringGroups, in the order of the layers.
+	Groups []LayerGroup `yaml:"groups,omitempty"`
+}
+
+// LayerGroup is a group of packages sharing a layer.
+type LayerGroup struct {
+	Name string `yaml:"name"`
+	// Packages are the names of the packages in the group, as patterns of
+	// path.Match. A package is in the first group it matches.
+	Packages []string `yaml:"packages"`
+}
+
 type ImageConfiguration struct {
 	Contents    ImageContents     `yaml:"contents,omitempty"`
 	Entrypoint  ImageEntrypoint   `yaml:"entrypoint,omitempty"`
@@ -83,17 +372,58 @@ type ImageConfiguration struct {
 	Accounts    ImageAccounts     `yaml:"accounts,omitempty"`
 	Archs       []Architecture    `yaml:"archs,omitempty"`
 	Environment map[string]string `yaml:"environment,omitempty"`
-	Paths       []PathMutation    `yaml:"paths,omitempty"`
-	OSRelease   OSRelease         `yaml:"os-release,omitempty"`
-	VCSUrl      string            `yaml:"vcs-url,omitempty"`
-	Annotations map[string]string `yaml:"annotations,omitempty"`
-	Include     string            `yaml:"include,omitempty"`
+	// PathSynthesis derives PATH from the installed packages, unless it
+	// is set in Environment.
+	PathSynthesis PathSynthesis `yaml:"path-synthesis,omitempty"`
+	// Documentation controls whether man pages and shell completions are
+	// kept in the image.
+	Documentation Documentation     `yaml:"documentation,omitempty"`
+	Paths         []PathMutation    `yaml:"paths,omitempty"`
+	OSRelease     OSRelease         `yaml:"os-release,omitempty"`
+	VCSUrl        string            `yaml:"vcs-url,omitempty"`
+	Annotations   map[string]string `yaml:"annotations,omitempty"`
+	Include       string            `yaml:"include,omitempty"`
+	Extends       []string          `yaml:"extends,omitempty"`
+
+	// NameResolution controls the generation of /etc/nsswitch.conf.
+	NameResolution NameResolution `yaml:"name-resolution,omitempty"`
+	// Expiry stamps the published images for registries to clean up.
+	Expiry Expiry `yaml:"expiry,omitempty"`
+
+	// Layering splits the image into several layers, for registries and
+	// clients to reuse those which did not change.
+	Layering Layering `yaml:"layering,omitempty"`
+
+	// ExposedPorts are the ports the image listens on, as <port> or
+	// <port>/<protocol>, the protocol being tcp unless set.
+	ExposedPorts []string `yaml:"exposed-ports,omitempty"`
+	// Volumes are the directories of the image which are volumes of its
+	// containers.
+	Volumes []Volume `yaml:"volumes,omitempty"`
+	// Healthcheck is the check of the health of the containers of the
+	// image, if set. The runtimes use their defaults for the intervals and
+	// retries which are not set.
+	Healthcheck *Healthcheck `yaml:"healthcheck,omitempty"`
+
+	// Base is the image the layers of the image are appended to, whose
+	// filesystem the packages are installed into, if set.
+	Base BaseImage `yaml:"base,omitempty"`
+
+	// Vars are the variables the configuration refers to as ${NAME}, with
+	// their defaults. See Substitute.
+	Vars map[string]string `yaml:"vars,omitempty"`
 
 	Options map[string]BuildOption `yaml:"options,omitempty"`
+	// ArchOverrides are changes to the image of some architectures, by
+	// name, e.g. packages only available on x86_64. See ApplyArchOverride.
+	ArchOverrides map[string]BuildOption `yaml:"arch-overrides,omitempty"`
+	// Variants are additional images, e.g. "dev" or "debug", which are
+	// built alongside the image and tagged with the variant name as suffix.
+	Variants map[string]BuildOption `yaml:"variants,omitempty"`
 }
 
-// Architecture represents a CPU architecture for the container image.
-// TODO(kaniini): Maybe this should be its own package at this point?
+// Architecture represents a CPU architecture for the container image, by
+// its OCI name. The names of the architectures are mapped by package arch.
 type Architecture struct{ s string }
 
 func (a Architecture) String() string { return a.s }
@@ -117,6 +447,7 @@ var (
 	ppc64le = Architecture{"ppc64le"}
 	riscv64 = Architecture{"riscv64"}
 	s390x   = Architecture{"s390x"}
+	loong64 = Architecture{"loong64"}
 )
 
 // AllArchs contains the standard set of supported architectures, which are
@@ -130,37 +461,18 @@ var AllArchs = []Architecture{
 	ppc64le,
 	riscv64,
 	s390x,
+	loong64,
 }
 
 // ToAPK returns the apk-style equivalent string for the Architecture.
 func (a Architecture) ToAPK() string {
-	switch a {
-	case _386:
-		return "x86"
-	case amd64:
-		return "x86_64"
-	case arm64:
-		return "aarch64"
-	case armv6:
-		return "armhf"
-	case armv7:
-		return "armv7"
-	default:
-		return a.s
-	}
+	return arch.ToAPK(a.s)
 }
 
 func (a Architecture) ToOCIPlatform() *v1.Platform {
-	plat := v1.Platform{OS: "linux"}
-	switch a {
-	case armv6:
-		plat.Architecture = "arm"
-		plat.Variant = "v6"
-	case armv7:
-		plat.Architecture = "arm"
-		plat.Variant = "v7"
-	default:
-		plat.Architecture = a.s
+	plat := v1.Platform{OS: "linux", Architecture: a.s}
+	if known, ok := arch.Lookup(a.s); ok {
+		plat.Architecture, plat.Variant = known.Platform()
 	}
 	return &plat
 }
@@ -177,6 +489,8 @@ func (a Architecture) ToQEmu() string {
 		return "arm"
 	case armv7:
 		return "arm"
+	case loong64:
+		return "loongarch64"
 	default:
 		return a.s
 	}
@@ -237,29 +551,17 @@ func (a Architecture) Compatible(b Architecture) bool {
 	case armv7:
 		return a == armv6 || a == b
 	default:
-		return false
+		return a == b
 	}
 }
 
 // ParseArchitecture parses a single architecture in string form, and returns
 // the equivalent Architecture value.
 //
-// Any apk-style arch string (e.g., "x86_64") is converted to the OCI-style
-// equivalent ("amd64").
+// Any apk-style arch string (e.g., "x86_64") or alias (e.g., "armv7l") is
+// converted to the OCI-style equivalent ("amd64").
 func ParseArchitecture(s string) Architecture {
-	switch s {
-	case "x86":
-		return _386
-	case "x86_64", "amd64":
-		return amd64
-	case "aarch64", "arm64":
-		return arm64
-	case "armhf":
-		return armv6
-	case "armv7":
-		return armv7
-	}
-	return Architecture{s}
+	return Architecture{arch.ToOCI(s)}
 }
 
 // ParseArchitectures parses architecture values in string form, and returns
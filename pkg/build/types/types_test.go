@@ -16,8 +16,10 @@ package types
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 func TestParseArchitectures(t *testing.T) {
@@ -41,6 +43,10 @@ func TestParseArchitectures(t *testing.T) {
 		desc: "dedupe w/ apk style",
 		in:   []string{"x86_64", "amd64", "arm64", "arm/v6", "armhf"},
 		want: []Architecture{amd64, armv6, arm64},
+	}, {
+		desc: "aliases",
+		in:   []string{"loongarch64", "armv7l", "i686", "riscv64"},
+		want: []Architecture{_386, armv7, loong64, riscv64},
 	}, {
 		// Unknown arch strings are accepted.
 		desc: "unknown arch",
@@ -62,3 +68,388 @@ func TestParseArchitectures(t *testing.T) {
 		})
 	}
 }
+
+func TestApplyVariant(t *testing.T) {
+	ic := ImageConfiguration{
+		Contents: ImageContents{
+			Packages: []string{"go", "ca-certificates"},
+		},
+		Accounts: ImageAccounts{
+			RunAs: "nonroot",
+			Users: []User{{UserName: "nonroot", UID: 65532}},
+		},
+		Environment: map[string]string{"GOPATH": "/go"},
+		Variants: map[string]BuildOption{
+			"dev": {
+				Contents: ContentsOption{
+					Packages: ListOption{Add: []string{"busybox", "git"}},
+				},
+				Accounts: AccountsOption{
+					RunAs: "root",
+					Users: []User{{UserName: "dev", UID: 1000}},
+				},
+				Environment: map[string]string{"DEV": "1"},
+			},
+			"debug": {},
+		},
+	}
+
+	require.Equal(t, []string{"debug", "dev"}, ic.VariantNames())
+
+	dev := ic
+	require.NoError(t, dev.ApplyVariant("dev"))
+	require.Equal(t, []string{"go", "ca-certificates", "busybox", "git"}, dev.Contents.Packages)
+	require.Equal(t, "root", dev.Accounts.RunAs)
+	require.Len(t, dev.Accounts.Users, 2)
+	require.Equal(t, map[string]string{"GOPATH": "/go", "DEV": "1"}, dev.Environment)
+	require.Nil(t, dev.Variants)
+
+	// the base configuration is left alone
+	require.Equal(t, []string{"go", "ca-certificates"}, ic.Contents.Packages)
+	require.Equal(t, "nonroot", ic.Accounts.RunAs)
+	require.Len(t, ic.Accounts.Users, 1)
+	require.Equal(t, map[string]string{"GOPATH": "/go"}, ic.Environment)
+
+	missing := ic
+	require.Error(t, missing.ApplyVariant("nope"))
+}
+
+func TestVariantAddsOnly(t *testing.T) {
+	ic := ImageConfiguration{
+		Variants: map[string]BuildOption{
+			"debug": {
+				Contents: ContentsOption{
+					Packages: ListOption{Add: []string{"busybox"}},
+				},
+			},
+			"slim": {
+				Contents: ContentsOption{
+					Packages: ListOption{Remove: []string{"ca-certificates"}},
+				},
+			},
+		},
+	}
+	require.True(t, ic.VariantAddsOnly("debug"))
+	require.False(t, ic.VariantAddsOnly("slim"))
+	require.True(t, ic.VariantAddsOnly(DevVariant))
+
+	ic.Documentation.ManPages = DocumentationRelocate
+	require.False(t, ic.VariantAddsOnly(DevVariant), "the dev variant keeps the relocated man pages")
+	require.True(t, ic.VariantAddsOnly("debug"))
+}
+
+func TestApplyArchOverride(t *testing.T) {
+	ic := ImageConfiguration{
+		Contents: ImageContents{
+			Packages: []string{"wolfi-baselayout", "app"},
+		},
+		Entrypoint:  ImageEntrypoint{Command: "/usr/bin/app"},
+		Environment: map[string]string{"APP_MODE": "prod"},
+		ArchOverrides: map[string]BuildOption{
+			"x86_64": {
+				Contents: ContentsOption{
+					Packages: ListOption{Add: []string{"intel-microcode"}},
+				},
+				Environment: map[string]string{"APP_SIMD": "avx2"},
+			},
+			"arm64": {
+				Contents: ContentsOption{
+					Packages: ListOption{Remove: []string{"app"}, Add: []string{"app-arm64"}},
+				},
+				Entrypoint: ImageEntrypoint{Type: "command", Command: "/usr/bin/app-arm64"},
+			},
+		},
+	}
+
+	x86 := ic
+	require.NoError(t, x86.ApplyArchOverride(amd64))
+	require.Equal(t, []string{"wolfi-baselayout", "app", "intel-microcode"}, x86.Contents.Packages)
+	require.Equal(t, map[string]string{"APP_MODE": "prod", "APP_SIMD": "avx2"}, x86.Environment)
+	require.Equal(t, "/usr/bin/app", x86.Entrypoint.Command)
+	require.Nil(t, x86.ArchOverrides)
+	require.NoError(t, x86.ApplyArchOverride(amd64), "applied once")
+	require.Len(t, x86.Contents.Packages, 3)
+
+	arm := ic
+	require.NoError(t, arm.ApplyArchOverride(arm64))
+	require.Equal(t, []string{"wolfi-baselayout", "app-arm64"}, arm.Contents.Packages)
+	require.Equal(t, "/usr/bin/app-arm64", arm.Entrypoint.Command)
+
+	other := ic
+	require.NoError(t, other.ApplyArchOverride(riscv64))
+	require.Equal(t, ic.Contents, other.Contents)
+
+	// the base configuration is left alone
+	require.Equal(t, []string{"wolfi-baselayout", "app"}, ic.Contents.Packages)
+	require.Equal(t, map[string]string{"APP_MODE": "prod"}, ic.Environment)
+
+	unknown := ImageConfiguration{ArchOverrides: map[string]BuildOption{"pdp11": {}}}
+	require.ErrorContains(t, unknown.ApplyArchOverride(amd64), "known architecture")
+	twice := ImageConfiguration{ArchOverrides: map[string]BuildOption{"x86_64": {}, "amd64": {}}}
+	require.ErrorContains(t, twice.ApplyArchOverride(amd64), "same architecture")
+}
+
+func TestDocumentationRelocation(t *testing.T) {
+	ic := ImageConfiguration{
+		Documentation: Documentation{
+			ManPages:    DocumentationRelocate,
+			Completions: DocumentationStrip,
+		},
+		Variants: map[string]BuildOption{
+			"debug": {},
+		},
+	}
+
+	// the dev variant is implied by the relocation
+	require.Equal(t, []string{"debug", "dev"}, ic.VariantNames())
+
+	dev := ic
+	require.NoError(t, dev.ApplyVariant(DevVariant))
+	require.Equal(t, DocumentationKeep, dev.Documentation.ManPages)
+	require.Equal(t, DocumentationStrip, dev.Documentation.Completions)
+
+	debug := ic
+	require.NoError(t, debug.ApplyVariant("debug"))
+	require.Equal(t, DocumentationRelocate, debug.Documentation.ManPages)
+
+	ic.Documentation.ManPages = "delete"
+	require.Error(t, ic.Validate())
+}
+
+func TestExpiry(t *testing.T) {
+	for _, tc := range []struct {
+		expiry Expiry
+		valid  bool
+	}{
+		{Expiry{}, true},
+		{Expiry{ExpiresAfter: "2w"}, true},
+		{Expiry{ExpiresAfter: "36h", Tier: "ephemeral"}, true},
+		{Expiry{ExpiresAfter: "2 weeks"}, false},
+		{Expiry{ExpiresAfter: "0d"}, false},
+		{Expiry{ExpiresAfter: "12"}, false},
+		{Expiry{Tier: "short lived"}, false},
+	} {
+		ic := ImageConfiguration{Expiry: tc.expiry}
+		if tc.valid {
+			require.NoError(t, ic.Validate(), "%+v", tc.expiry)
+		} else {
+			require.Error(t, ic.Validate(), "%+v", tc.expiry)
+		}
+	}
+
+	require.Empty(t, Expiry{}.Annotations())
+	require.Equal(t, map[string]string{
+		ExpiresAfterAnnotation: "2w",
+		TierAnnotation:         "ephemeral",
+	}, Expiry{ExpiresAfter: "2w", Tier: "ephemeral"}.Annotations())
+}
+
+func TestExposedPorts(t *testing.T) {
+	ic := ImageConfiguration{ExposedPorts: []string{"8080", "8080/tcp", "53/udp", "9000/sctp"}}
+	require.NoError(t, ic.Validate())
+	ports, err := ic.ExposedPortSet()
+	require.NoError(t, err)
+	require.Equal(t, map[string]struct{}{
+		"8080/tcp":  {},
+		"53/udp":    {},
+		"9000/sctp": {},
+	}, ports)
+
+	for _, port := range []string{"", "0", "65536", "http", "080", "80/icmp", "80/", "8000-8010"} {
+		ic := ImageConfiguration{ExposedPorts: []string{port}}
+		require.Error(t, ic.Validate(), port)
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	ic := ImageConfiguration{Volumes: []Volume{{Path: "/data", UID: 65532, GID: 65532}, {Path: "/var/cache/app/"}}}
+	require.NoError(t, ic.Validate())
+
+	for _, volumes := range [][]Volume{
+		{{Path: "data"}},
+		{{Path: "/"}},
+		{{Path: "/data"}, {Path: "/data/"}},
+	} {
+		ic := ImageConfiguration{Volumes: volumes}
+		require.Error(t, ic.Validate(), "%+v", volumes)
+	}
+}
+
+func TestHealthcheck(t *testing.T) {
+	var ic ImageConfiguration
+	require.NoError(t, yaml.Unmarshal([]byte(`
+healthcheck:
+  command: /usr/bin/app check
+  interval: 10s
+  timeout: 2s
+  start-period: 1m
+  retries: 5
+`), &ic))
+	require.NoError(t, ic.Validate())
+	require.Equal(t, &Healthcheck{
+		Command:     "/usr/bin/app check",
+		Interval:    10 * time.Second,
+		Timeout:     2 * time.Second,
+		StartPeriod: time.Minute,
+		Retries:     5,
+	}, ic.Healthcheck)
+
+	for _, h := range []Healthcheck{
+		{},
+		{Command: "check", ShellFragment: "check || exit 1"},
+		{ShellFragment: "check", Interval: -time.Second},
+		{Command: "check", Retries: -1},
+	} {
+		h := h
+		ic := ImageConfiguration{Healthcheck: &h}
+		require.Error(t, ic.Validate(), "%+v", h)
+	}
+}
+
+func TestStopSignalName(t *testing.T) {
+	for sig, want := range map[string]string{
+		"SIGQUIT":    "SIGQUIT",
+		"QUIT":       "SIGQUIT",
+		"sigusr1":    "SIGUSR1",
+		"3":          "SIGQUIT",
+		"15":         "SIGTERM",
+		"RTMIN":      "34",
+		"RTMIN+2":    "36",
+		"SIGRTMAX-1": "63",
+		"40":         "40",
+	} {
+		got, err := StopSignalName(sig)
+		require.NoError(t, err, sig)
+		require.Equal(t, want, got, sig)
+	}
+
+	for _, sig := range []string{"", "SIGFOO", "0", "32", "65", "RTMIN+31", "RTMAX-", "SIG"} {
+		_, err := StopSignalName(sig)
+		require.Error(t, err, sig)
+	}
+
+	require.Error(t, (&ImageConfiguration{WorkDir: "app"}).Validate())
+	require.NoError(t, (&ImageConfiguration{WorkDir: "/app", StopSignal: "SIGQUIT"}).Validate())
+}
+
+func TestUsers(t *testing.T) {
+	ic := ImageConfiguration{Accounts: ImageAccounts{Users: []User{{
+		UserName: "app",
+		UID:      1000,
+		HomeDir:  "/var/lib/app",
+		Shell:    "/bin/bash",
+		Password: "$6$salt$hash",
+		Skel:     "/etc/skel",
+	}}}}
+	require.NoError(t, ic.Validate())
+
+	for _, u := range []User{
+		{UserName: "app", UID: 1000, HomeDir: "app"},
+		{UserName: "app", UID: 1000, Shell: "bash"},
+		{UserName: "app", UID: 1000, Skel: "etc/skel"},
+		{UserName: "app", UID: 1000, Shell: "/bin/sh:x"},
+		{UserName: "app", UID: 1000, Password: "hunter2"},
+		{UserName: "app", UID: 1000, Password: "$6$salt:hash"},
+	} {
+		ic := ImageConfiguration{Accounts: ImageAccounts{Users: []User{u}}}
+		require.Error(t, ic.Validate(), "%+v", u)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	for _, accounts := range []ImageAccounts{{
+		Groups: []Group{{GroupName: "app", GID: 1000}, {GroupName: "app", GID: 1001}},
+	}, {
+		Groups: []Group{{GroupName: "app", GID: 1000}, {GroupName: "data", GID: 1000}},
+	}, {
+		Users: []User{{UserName: "app", UID: 1000, Groups: []string{""}}},
+	}, {
+		Users: []User{{UserName: "app", UID: 1000, Groups: []string{"tty,video"}}},
+	}} {
+		ic := ImageConfiguration{Accounts: accounts}
+		require.Error(t, ic.Validate(), "%+v", accounts)
+	}
+
+	ic := ImageConfiguration{Accounts: ImageAccounts{
+		Users:  []User{{UserName: "app", UID: 1000, Groups: []string{"tty", "data"}}},
+		Groups: []Group{{GroupName: "data", GID: 2000}},
+	}}
+	require.NoError(t, ic.Validate())
+}
+
+func TestSubstitute(t *testing.T) {
+	env := map[string]string{"TIER": "prod", "HOME": "/root"}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	ic := ImageConfiguration{
+		Vars: map[string]string{"VERSION": "1.0", "TIER": "dev", "PORT": "8080"},
+		Contents: ImageContents{
+			Packages: []string{"app=${VERSION}", "app-config-${TIER}"},
+		},
+		Environment: map[string]string{"PORT": "${PORT}", "HOME_DIR": "${HOME}"},
+		Entrypoint: ImageEntrypoint{
+			ShellFragment: "exec app --port ${PORT} --cache $${HOME}/.cache ${HOME}",
+			Services: map[interface{}]interface{}{
+				"app":    "/usr/bin/app --port ${PORT}",
+				"worker": map[string]interface{}{"command": []interface{}{"/usr/bin/worker", "--tier", "${TIER}", "${attempt}"}},
+			},
+		},
+		Paths: []PathMutation{
+			{Path: "/etc/app-${VERSION}", Type: "symlink", Source: "/usr/share/app-${TIER}"},
+			{Path: "/opt/app", Type: PathArchive, Source: "https://example.com/app-${VERSION}.tar.gz"},
+			{Path: "/etc/app.conf", Type: PathCopy, Source: "/src/${VERSION}/app.conf"},
+		},
+		Annotations: map[string]string{"org.opencontainers.image.version": "${VERSION}"},
+		Expiry:      Expiry{Tier: "${TIER}"},
+	}
+	unresolved, err := ic.Substitute(map[string]string{"VERSION": "1.2"}, lookupEnv)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"app=1.2", "app-config-prod"}, ic.Contents.Packages, "set, then environment, then defaults")
+	require.Equal(t, map[string]string{"PORT": "8080", "HOME_DIR": "${HOME}"}, ic.Environment, "undeclared variables are kept")
+	require.Equal(t, "exec app --port 8080 --cache ${HOME}/.cache ${HOME}", ic.Entrypoint.ShellFragment)
+	require.Equal(t, map[interface{}]interface{}{
+		"app":    "/usr/bin/app --port 8080",
+		"worker": map[string]interface{}{"command": []interface{}{"/usr/bin/worker", "--tier", "prod", "${attempt}"}},
+	}, ic.Entrypoint.Services)
+	require.Equal(t, []PathMutation{
+		{Path: "/etc/app-1.2", Type: "symlink", Source: "/usr/share/app-prod"},
+		{Path: "/opt/app", Type: PathArchive, Source: "https://example.com/app-1.2.tar.gz"},
+		{Path: "/etc/app.conf", Type: PathCopy, Source: "/src/${VERSION}/app.conf"},
+	}, ic.Paths, "the sources of the host are resolved when loaded")
+	require.Equal(t, "1.2", ic.Annotations["org.opencontainers.image.version"])
+	require.Equal(t, "prod", ic.Expiry.Tier)
+	require.Equal(t, []string{"HOME"}, unresolved, "only those the container does not expand")
+
+	ic = ImageConfiguration{Vars: map[string]string{"NOT-A-NAME": ""}}
+	_, err = ic.Substitute(nil, lookupEnv)
+	require.Error(t, err)
+}
+
+func TestSubstituteArchOverride(t *testing.T) {
+	ic := ImageConfiguration{
+		Vars: map[string]string{"VERSION": "1.0", "SIMD": "sse4"},
+		ArchOverrides: map[string]BuildOption{
+			"x86_64": {
+				Contents: ContentsOption{
+					Packages: ListOption{Add: []string{"app-simd=${VERSION}"}, Remove: []string{"app=${VERSION}"}},
+				},
+				Environment: map[string]string{"APP_SIMD": "${SIMD}"},
+				Entrypoint:  ImageEntrypoint{Type: "command", Command: "/usr/bin/app --simd ${SIMD}"},
+			},
+		},
+		Contents: ImageContents{Packages: []string{"app=${VERSION}"}},
+	}
+	// as --set does
+	unresolved, err := ic.Substitute(map[string]string{"VERSION": "1.2", "SIMD": "avx2"}, func(string) (string, bool) { return "", false })
+	require.NoError(t, err)
+	require.Empty(t, unresolved)
+	require.NoError(t, ic.ApplyArchOverride(amd64))
+
+	require.Equal(t, []string{"app-simd=1.2"}, ic.Contents.Packages)
+	require.Equal(t, map[string]string{"APP_SIMD": "avx2"}, ic.Environment)
+	require.Equal(t, "/usr/bin/app --simd avx2", ic.Entrypoint.Command)
+}
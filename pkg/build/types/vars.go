@@ -0,0 +1,160 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// varReference matches the references to variables, as ${NAME}, and the
+// escaped ones, as $${NAME}.
+var varReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// validVarName matches the names of variables.
+var validVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Substitute replaces the references to variables, as ${NAME}, in these
+// fields of the configuration, and in the same ones of the arch overrides,
+// which are applied later on:
+//
+//   - the packages, and those the arch overrides add or remove
+//   - the values of the environment
+//   - the command and the shell fragment of the entrypoint, and every string
+//     of the descriptors of its services
+//   - the cmd
+//   - the path of the paths, and their source, unless it is a file or an
+//     archive of the host, which is resolved when the configuration is loaded
+//   - the values of the annotations
+//   - the expiry
+//
+// The variables are the ones declared in Vars, with their defaults, and the
+// ones set, whose values come first, then those of the environment, looked
+// up with lookupEnv, then the defaults. References to other names are kept,
+// e.g. for shell fragments to expand, and $${NAME} is kept as ${NAME}.
+// Substitute returns the sorted names of those kept outside of the shell
+// fragments and the services, which the container does not expand, so that
+// they can be reported.
+func (ic *ImageConfiguration) Substitute(set map[string]string, lookupEnv func(string) (string, bool)) ([]string, error) {
+	vars := map[string]string{}
+	for name, value := range ic.Vars {
+		if !validVarName.MatchString(name) {
+			return nil, fmt.Errorf("invalid variable name %q", name)
+		}
+		if env, ok := lookupEnv(name); ok {
+			value = env
+		}
+		vars[name] = value
+	}
+	for name, value := range set {
+		if !validVarName.MatchString(name) {
+			return nil, fmt.Errorf("invalid variable name %q", name)
+		}
+		vars[name] = value
+	}
+
+	unresolved := map[string]bool{}
+	expander := func(shell bool) func(string) string {
+		return func(s string) string {
+			return varReference.ReplaceAllStringFunc(s, func(ref string) string {
+				if ref[1] == '$' {
+					return ref[1:]
+				}
+				name := ref[2 : len(ref)-1]
+				if value, ok := vars[name]; ok {
+					return value
+				}
+				if !shell {
+					unresolved[name] = true
+				}
+				return ref
+			})
+		}
+	}
+	expand, expandShell := expander(false), expander(true)
+
+	for i, pkg := range ic.Contents.Packages {
+		ic.Contents.Packages[i] = expand(pkg)
+	}
+	for k, v := range ic.Environment {
+		ic.Environment[k] = expand(v)
+	}
+	substituteEntrypoint(&ic.Entrypoint, expand, expandShell)
+	for name, bo := range ic.ArchOverrides {
+		for i, pkg := range bo.Contents.Packages.Add {
+			bo.Contents.Packages.Add[i] = expand(pkg)
+		}
+		for i, pkg := range bo.Contents.Packages.Remove {
+			bo.Contents.Packages.Remove[i] = expand(pkg)
+		}
+		for k, v := range bo.Environment {
+			bo.Environment[k] = expand(v)
+		}
+		substituteEntrypoint(&bo.Entrypoint, expand, expandShell)
+		ic.ArchOverrides[name] = bo
+	}
+	ic.Cmd = expand(ic.Cmd)
+	for i, mut := range ic.Paths {
+		ic.Paths[i].Path = expand(mut.Path)
+		if mut.Type != PathCopy && (mut.Type != PathArchive || IsArchiveURL(mut.Source)) {
+			ic.Paths[i].Source = expand(mut.Source)
+		}
+	}
+	for k, v := range ic.Annotations {
+		ic.Annotations[k] = expand(v)
+	}
+	ic.Expiry.ExpiresAfter = expand(ic.Expiry.ExpiresAfter)
+	ic.Expiry.Tier = expand(ic.Expiry.Tier)
+
+	names := make([]string, 0, len(unresolved))
+	for name := range unresolved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// substituteEntrypoint replaces the references to variables in the command,
+// the shell fragment and the services of an entrypoint.
+func substituteEntrypoint(ep *ImageEntrypoint, expand, expandShell func(string) string) {
+	ep.Command = expand(ep.Command)
+	ep.ShellFragment = expandShell(ep.ShellFragment)
+	for name, svc := range ep.Services {
+		ep.Services[name] = expandStrings(svc, expandShell)
+	}
+}
+
+// expandStrings expands every string of a value decoded from YAML, such as
+// the descriptor of a service.
+func expandStrings(v interface{}, expand func(string) string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return expand(v)
+	case []interface{}:
+		for i, e := range v {
+			v[i] = expandStrings(e, expand)
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = expandStrings(e, expand)
+		}
+	case map[interface{}]interface{}:
+		for k, e := range v {
+			v[k] = expandStrings(e, expand)
+		}
+	}
+	return v
+}
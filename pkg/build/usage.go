@@ -0,0 +1,134 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	chainguardAPK "chainguard.dev/apko/pkg/apk"
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/options"
+)
+
+// largestContributors is how many of the largest packages and directories
+// are reported.
+const largestContributors = 5
+
+// contributor is a package or directory, with how much space it takes.
+type contributor struct {
+	name  string
+	usage apkfs.Usage
+}
+
+// largest returns the largest of the usages, by their size in the layer.
+func largest(usage map[string]apkfs.Usage, n int) []contributor {
+	contributors := make([]contributor, 0, len(usage))
+	for name, u := range usage {
+		contributors = append(contributors, contributor{name: name, usage: u})
+	}
+	sort.Slice(contributors, func(i, j int) bool {
+		if contributors[i].usage.TarSize != contributors[j].usage.TarSize {
+			return contributors[i].usage.TarSize > contributors[j].usage.TarSize
+		}
+		return contributors[i].name < contributors[j].name
+	})
+	if len(contributors) > n {
+		contributors = contributors[:n]
+	}
+	return contributors
+}
+
+func formatContributors(contributors []contributor) string {
+	parts := make([]string, 0, len(contributors))
+	for _, c := range contributors {
+		parts = append(parts, fmt.Sprintf("%s (%s)", c.name, formatSize(c.usage.TarSize)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// packageUsage returns how much space the files of each installed package
+// take, by package name.
+func packageUsage(fsys apkfs.FullFS, o *options.Options) (map[string]apkfs.Usage, error) {
+	apk, err := chainguardAPK.NewWithOptions(fsys, *o)
+	if err != nil {
+		return nil, err
+	}
+	installed, err := apk.GetInstalled()
+	if errors.Is(err, fs.ErrNotExist) {
+		// nothing was installed
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]apkfs.Usage, len(installed))
+	for _, pkg := range installed {
+		var total apkfs.Usage
+		for _, f := range pkg.Files {
+			// directories are shared between packages
+			if f.Typeflag == tar.TypeDir {
+				continue
+			}
+			u, err := apkfs.FileUsage(fsys, f.Name)
+			if errors.Is(err, fs.ErrNotExist) {
+				// removed since, e.g. documentation
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("measuring %s of %s: %w", f.Name, pkg.Name, err)
+			}
+			total.Add(u)
+		}
+		usage[pkg.Name] = total
+	}
+	return usage, nil
+}
+
+// reportUsage logs the largest packages and top-level directories of the
+// image, and fails if it is over the size budget, if any.
+func reportUsage(fsys apkfs.FullFS, o *options.Options) error {
+	dirs, err := apkfs.DiskUsage(fsys)
+	if err != nil {
+		return fmt.Errorf("measuring the filesystem: %w", err)
+	}
+	total := dirs["."]
+	topLevel := map[string]apkfs.Usage{}
+	for dir, u := range dirs {
+		if dir != "." && path.Dir(dir) == "." {
+			topLevel["/"+dir] = u
+		}
+	}
+	pkgs, err := packageUsage(fsys, o)
+	if err != nil {
+		return fmt.Errorf("measuring the packages: %w", err)
+	}
+	largestPkgs := largest(pkgs, largestContributors)
+
+	o.Logger().Infof("image filesystem has %d files, %s (%s as a layer)", total.Files, formatSize(total.Size), formatSize(total.TarSize))
+	o.Logger().Infof("largest packages: %s", formatContributors(largestPkgs))
+	o.Logger().Infof("largest directories: %s", formatContributors(largest(topLevel, largestContributors)))
+
+	if o.SizeBudget > 0 && total.TarSize > o.SizeBudget {
+		return fmt.Errorf("image layer is %s, over the budget of %s; largest packages: %s",
+			formatSize(total.TarSize), formatSize(o.SizeBudget), formatContributors(largestPkgs))
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/options"
+)
+
+func TestReportUsage(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("lib/apk/db", 0o755))
+	require.NoError(t, fsys.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, fsys.WriteFile("usr/bin/big", make([]byte, 10000), 0o755))
+	require.NoError(t, fsys.WriteFile("usr/bin/small", []byte("small"), 0o755))
+	require.NoError(t, fsys.WriteFile("lib/apk/db/installed", []byte(
+		"P:big\nV:1.0-r0\nF:usr/bin\nR:big\n\nP:small\nV:1.0-r0\nF:usr/bin\nR:small\nR:removed\n\n"), 0o644))
+
+	o := options.Default
+	usage, err := packageUsage(fsys, &o)
+	require.NoError(t, err)
+	require.Equal(t, apkfs.Usage{Files: 1, Size: 10000, TarSize: 512 + 10240}, usage["big"])
+	require.Equal(t, apkfs.Usage{Files: 1, Size: 5, TarSize: 1024}, usage["small"])
+	require.Equal(t, []contributor{{"big", usage["big"]}}, largest(usage, 1))
+
+	require.NoError(t, reportUsage(fsys, &o))
+	o.SizeBudget = 4096
+	err = reportUsage(fsys, &o)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "largest packages: big")
+}
@@ -0,0 +1,63 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"strings"
+)
+
+// WithVariant turns the build context into one for the named variant of
+// the image configuration. Every tag, including the ones generated from
+// package versions, gets the variant name as suffix, e.g. `:latest`
+// becomes `:latest-dev`.
+// It must come after the options setting the configuration and tags.
+func WithVariant(variant string) Option {
+	return func(bc *Context) error {
+		if err := bc.ImageConfiguration.ApplyVariant(variant); err != nil {
+			return err
+		}
+
+		tags := make([]string, 0, len(bc.Options.Tags))
+		for _, tag := range bc.Options.Tags {
+			tags = append(tags, variantTag(tag, variant))
+		}
+		bc.Options.Tags = tags
+		bc.Options.TagSuffix += "-" + variant
+
+		return nil
+	}
+}
+
+// WithVariantBase builds the variant on top of the images of the
+// configuration in the OCI image layout, keeping the packages installed in
+// them, so that only the ones the variant adds are installed, in the layer
+// on top. The variant must only add to the image, see
+// types.ImageConfiguration.VariantAddsOnly.
+func WithVariantBase(layout string) Option {
+	return func(bc *Context) error {
+		bc.variantBase = layout
+		return nil
+	}
+}
+
+// variantTag appends the variant name to the tag of an image reference,
+// defaulting to the latest tag like an untagged reference does.
+func variantTag(ref, variant string) string {
+	// a colon before the last slash is a registry port, not a tag
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref + "-" + variant
+	}
+	return ref + ":latest-" + variant
+}
@@ -0,0 +1,35 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVariantTag(t *testing.T) {
+	for _, c := range []struct {
+		ref  string
+		want string
+	}{
+		{"cgr.dev/chainguard/go", "cgr.dev/chainguard/go:latest-dev"},
+		{"cgr.dev/chainguard/go:1.20", "cgr.dev/chainguard/go:1.20-dev"},
+		{"localhost:5000/go", "localhost:5000/go:latest-dev"},
+		{"localhost:5000/go:latest", "localhost:5000/go:latest-dev"},
+	} {
+		require.Equal(t, c.want, variantTag(c.ref, "dev"), c.ref)
+	}
+}
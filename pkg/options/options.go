@@ -17,12 +17,17 @@ package options
 import (
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"runtime"
 	"time"
 
+	apkimpl "chainguard.dev/apko/pkg/apk/impl"
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/audit"
 	"chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/apko/pkg/log"
+	"chainguard.dev/apko/pkg/tarball"
 )
 
 type Options struct {
@@ -46,6 +51,90 @@ type Options struct {
 	TagSuffix               string
 	Local                   bool
 	StageTags               string
+	StreamLayers            bool
+	SkipVariants            bool
+	// Jobs is how many architectures are built at once, or all of them if
+	// not positive.
+	Jobs int
+	// PublishState is the file recording the images published so far, and
+	// Resume whether to skip the images it records.
+	PublishState string
+	Resume       bool
+	// FileMutators are called on each file of the image layer as it is written.
+	FileMutators []tarball.FileMutator
+	// AuditLog records the builds and publishes, if set.
+	AuditLog *audit.Log
+	// Progress is told how installing the packages goes, if set.
+	Progress apkimpl.Progress
+	// InputLimits bound how much of the indexes and packages is read.
+	InputLimits apkimpl.InputLimits
+	// Offline forbids any network access, so that keys, indexes and
+	// packages must come from local paths.
+	Offline bool
+	// Transport does the requests for keys, indexes and packages, if set,
+	// e.g. within fetch limits shared by the architectures of a build.
+	Transport http.RoundTripper
+	// UserAgent and Headers are set on the requests for keys, indexes and
+	// packages, if set.
+	UserAgent string
+	Headers   http.Header
+	// ResolverStrategy is which of the versions meeting the constraints
+	// are installed, the highest if unset.
+	ResolverStrategy apkimpl.ResolverStrategy
+	// ExtractionCache is a directory to keep the expanded packages in, so
+	// that later builds neither download nor decompress them again, if set.
+	ExtractionCache string
+	// Vars are the values of the variables of the configuration, which
+	// take precedence over the environment and their defaults.
+	Vars map[string]string
+	// LayerCache is a directory to keep the layers of the images in, by the
+	// digest of their resolved inputs, so that later builds with the same
+	// inputs reuse them, if set.
+	LayerCache string
+	// CheckReproducibility builds the layers of each image twice, failing
+	// with the first file which differs unless they are the same.
+	CheckReproducibility bool
+	// HostUIDMap and HostGIDMap are the owners to give the files of the
+	// working directory for the ones of the image, e.g. the subordinate ids
+	// of the user running an unprivileged build. The image keeps the ones
+	// asked for either way.
+	HostUIDMap, HostGIDMap map[int]int
+	// FakerootDB is where to keep what cannot be set on the files of the
+	// working directory, e.g. their owners when not running as root, so
+	// that it can be picked up again later, if set.
+	FakerootDB string
+	// StreamingFS writes the files of the packages straight to the layer
+	// as they are installed, keeping only those under the paths the build
+	// changes later, e.g. etc, rather than laying them all out in the
+	// working directory first.
+	StreamingFS bool
+	// MemoryBudget builds the filesystem in memory rather than in the
+	// working directory, if set, writing the content of large files there
+	// once more than that many bytes are held.
+	MemoryBudget int64
+	// FailOnCaseCollision fails the build when a path differs only by case
+	// from another, if the working directory is case-insensitive, rather
+	// than keeping it in memory only.
+	FailOnCaseCollision bool
+	// DeduplicateFiles writes the files of the layer with the same content
+	// and attributes once, the others being hardlinks to it.
+	DeduplicateFiles bool
+	// SizeBudget fails the build if the layer takes more than that many
+	// bytes, uncompressed, if set.
+	SizeBudget int64
+	// SparseFiles writes the files of the layer with large runs of zeros as
+	// sparse entries, which leave them out.
+	SparseFiles bool
+	// Timestamps is what the modification times of the files become in
+	// the layer, SOURCE_DATE_EPOCH by default.
+	Timestamps apkfs.TimestampPolicy
+	// UnsafePaths installs the entries of packages whose paths go through
+	// "..", rather than failing on them, for trusted packages only.
+	UnsafePaths bool
+	// KeepInstalled keeps the packages installed in the base image, so
+	// that only the missing ones are installed on top of it, rather than
+	// all of them, as for the variants built on top of their image.
+	KeepInstalled bool
 }
 
 var Default = Options{
@@ -0,0 +1,63 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package passwd
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+func TestShadowParser(t *testing.T) {
+	fsys := apkfs.DirFS("testdata")
+	sf, err := ReadShadowFile(fsys, "shadow")
+	require.NoError(t, err)
+
+	require.Len(t, sf.Entries, 5)
+	require.Equal(t, "root", sf.Entries[0].UserName)
+	require.Equal(t, "*", sf.Entries[0].Password)
+	require.Equal(t, "99999", sf.Entries[0].MaxAge)
+	require.Equal(t, "!", sf.Entries[1].Password)
+	require.Equal(t, "", sf.Entries[1].LastChange)
+}
+
+func TestShadowWriter(t *testing.T) {
+	fsys := apkfs.DirFS("testdata")
+	sf, err := ReadShadowFile(fsys, "shadow")
+	require.NoError(t, err)
+
+	w := &bytes.Buffer{}
+	require.NoError(t, sf.Write(w))
+
+	want, err := os.ReadFile("testdata/shadow")
+	require.NoError(t, err)
+	require.Equal(t, want, w.Bytes(), "written as read")
+}
+
+func TestShadowCreate(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("etc", 0o755))
+	sf, err := ReadOrCreateShadowFile(fsys, "etc/shadow")
+	require.NoError(t, err)
+	require.Empty(t, sf.Entries)
+
+	fi, err := fsys.Stat("etc/shadow")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+}
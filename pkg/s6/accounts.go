@@ -0,0 +1,104 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s6
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"chainguard.dev/apko/pkg/passwd"
+)
+
+// lookupUser returns the account of the user, by name or uid.
+func lookupUser(users passwd.UserFile, user string) (passwd.UserEntry, bool) {
+	for _, ue := range users.Entries {
+		if ue.UserName == user || strconv.FormatUint(uint64(ue.UID), 10) == user {
+			return ue, true
+		}
+	}
+	return passwd.UserEntry{}, false
+}
+
+// lookupGroup returns the group, by name or gid.
+func lookupGroup(groups passwd.GroupFile, group string) (passwd.GroupEntry, bool) {
+	for _, ge := range groups.Entries {
+		if ge.GroupName == group || strconv.FormatUint(uint64(ge.GID), 10) == group {
+			return ge, true
+		}
+	}
+	return passwd.GroupEntry{}, false
+}
+
+// applyUIDGID returns the execline command dropping the privileges of the
+// service to its user and group, which must be accounts of the image, or an
+// empty string if it runs as s6-svscan does.
+func (sc *Context) applyUIDGID(svc Service) (string, error) {
+	if svc.User == "" && svc.Group == "" {
+		return "", nil
+	}
+
+	groups, err := passwd.ReadGroupFile(sc.fs, filepath.Join("etc", "group"))
+	if err != nil && (svc.Group != "" || !errors.Is(err, fs.ErrNotExist)) {
+		return "", fmt.Errorf("service %s: %w", svc.Name, err)
+	}
+
+	var gid uint32
+	if svc.Group != "" {
+		ge, ok := lookupGroup(groups, svc.Group)
+		if !ok {
+			return "", fmt.Errorf("service %s: group %s does not exist in the image", svc.Name, svc.Group)
+		}
+		gid = ge.GID
+	}
+
+	if svc.User == "" {
+		return fmt.Sprintf("s6-applyuidgid -g %d -G %d", gid, gid), nil
+	}
+
+	users, err := passwd.ReadUserFile(sc.fs, filepath.Join("etc", "passwd"))
+	if err != nil {
+		return "", fmt.Errorf("service %s: %w", svc.Name, err)
+	}
+	ue, ok := lookupUser(users, svc.User)
+	if !ok {
+		return "", fmt.Errorf("service %s: user %s does not exist in the image", svc.Name, svc.User)
+	}
+	if svc.Group == "" {
+		gid = ue.GID
+	}
+
+	// the supplementary groups are those the user is a member of, as set by
+	// login
+	gids := []string{strconv.FormatUint(uint64(gid), 10)}
+	seen := map[uint32]bool{gid: true}
+	for _, ge := range groups.Entries {
+		if seen[ge.GID] {
+			continue
+		}
+		for _, member := range ge.Members {
+			if member == ue.UserName {
+				seen[ge.GID] = true
+				gids = append(gids, strconv.FormatUint(uint64(ge.GID), 10))
+				break
+			}
+		}
+	}
+
+	return fmt.Sprintf("s6-applyuidgid -u %d -g %d -G %s", ue.UID, gid, strings.Join(gids, ",")), nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s6
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+)
+
+// defaultPath is the PATH execline searches when the environment sets none.
+const defaultPath = "/usr/bin:/bin"
+
+// maxSymlinks is the number of symlinks followed when resolving a path, as
+// Linux does.
+const maxSymlinks = 40
+
+// firstWord returns the first word of the execline command line, unquoted.
+func firstWord(line string) string {
+	line = strings.TrimLeft(line, " \t\n")
+	if !strings.HasPrefix(line, `"`) {
+		if i := strings.IndexAny(line, " \t\n"); i >= 0 {
+			return line[:i]
+		}
+		return line
+	}
+	var b strings.Builder
+	escaped := false
+	for _, r := range line[1:] {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+			continue
+		case r == '"':
+			return b.String()
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// resolve returns the path of the file within the filesystem, relative to
+// its root, with the symlinks of every component resolved within the
+// filesystem rather than on the host.
+func resolve(fsys apkfs.FullFS, name string) (string, error) {
+	resolved := ""
+	rest := strings.Split(name, "/")
+	links := 0
+	for len(rest) != 0 {
+		part := rest[0]
+		rest = rest[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved = path.Dir(resolved); resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		fi, err := fsys.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+		}
+		target, err := fsys.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = ""
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return resolved, nil
+}
+
+// isExecutable returns whether the path is an executable file of the
+// filesystem.
+func isExecutable(fsys apkfs.FullFS, name string) bool {
+	resolved, err := resolve(fsys, name)
+	if err != nil {
+		return false
+	}
+	fi, err := fsys.Lstat(resolved)
+	if err != nil {
+		return false
+	}
+	return fi.Mode().IsRegular() && fi.Mode().Perm()&0111 != 0
+}
+
+// lookPath returns whether the command is an executable of the filesystem,
+// searched in the directories of the PATH unless it is a path, as execvp does.
+// Relative paths are relative to the supervision directory the run script
+// runs in.
+func lookPath(fsys apkfs.FullFS, svcdir string, command string, pathEnv string) bool {
+	if path.IsAbs(command) {
+		return isExecutable(fsys, command)
+	}
+	if strings.Contains(command, "/") {
+		return isExecutable(fsys, path.Join("/", svcdir, command))
+	}
+	for _, dir := range strings.Split(pathEnv, ":") {
+		if dir == "" {
+			dir = path.Join("/", svcdir)
+		}
+		if isExecutable(fsys, path.Join(dir, command)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckExecutables checks the commands of every service are executables of
+// the image, searched in the PATH of the service, which is pathEnv unless
+// it sets one, rather than letting the service fail at runtime.
+func (sc *Context) CheckExecutables(services Services, pathEnv string) error {
+	ordered, err := ParseServices(services)
+	if err != nil {
+		return err
+	}
+	if pathEnv == "" {
+		pathEnv = defaultPath
+	}
+
+	var missing []string
+	for _, svc := range ordered {
+		svcPath := pathEnv
+		if p, ok := svc.Environment["PATH"]; ok {
+			// an empty value unsets it
+			svcPath = p
+			if p == "" {
+				svcPath = defaultPath
+			}
+		}
+		for _, line := range []Command{svc.Command, svc.Finish} {
+			if line == "" {
+				continue
+			}
+			command := firstWord(string(line))
+			if !lookPath(sc.fs, sc.serviceDir(svc.Name), command, svcPath) {
+				missing = append(missing, fmt.Sprintf("%s runs %s", svc.Name, command))
+			}
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("services run commands which are not executables of the image: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
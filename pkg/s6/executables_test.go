@@ -0,0 +1,84 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s6
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/log"
+)
+
+func TestFirstWord(t *testing.T) {
+	for line, want := range map[string]string{
+		"/usr/bin/app --flag":         "/usr/bin/app",
+		"  nginx":                     "nginx",
+		`"/opt/my app/run" --flag`:    "/opt/my app/run",
+		`"/opt/\"quoted\"\\name" arg`: `/opt/"quoted"\name`,
+		"":                            "",
+	} {
+		require.Equal(t, want, firstWord(line), line)
+	}
+}
+
+func TestCheckExecutables(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, fsys.MkdirAll("usr/sbin", 0o755))
+	require.NoError(t, fsys.MkdirAll("opt/app", 0o755))
+	require.NoError(t, fsys.WriteFile("usr/bin/busybox", []byte("busybox"), 0o755))
+	require.NoError(t, fsys.WriteFile("usr/sbin/nginx", []byte("nginx"), 0o755))
+	require.NoError(t, fsys.WriteFile("opt/app/app.conf", []byte("conf"), 0o644))
+	require.NoError(t, fsys.WriteFile("opt/app/run", []byte("run"), 0o755))
+	// merged /usr, busybox links, and symlinked directories
+	require.NoError(t, fsys.Symlink("usr/bin", "bin"))
+	require.NoError(t, fsys.Symlink("/usr/bin/busybox", "usr/bin/crond"))
+	require.NoError(t, fsys.Symlink("../opt/app", "usr/app"))
+	require.NoError(t, fsys.Symlink("missing", "usr/bin/dangling"))
+	require.NoError(t, fsys.Symlink("loop", "usr/bin/loop"))
+	sc := New(fsys, &log.Adapter{Out: io.Discard})
+
+	require.NoError(t, sc.CheckExecutables(Services{
+		"nginx": `/usr/sbin/nginx -g "daemon off;"`,
+		"cron":  "crond -f",
+		"bin":   "/bin/busybox sh",
+		"app":   []interface{}{"/usr/app/run"},
+		"path": map[string]interface{}{
+			"command":     "nginx",
+			"environment": map[string]interface{}{"PATH": "/usr/sbin"},
+		},
+	}, "/usr/local/bin:/usr/bin"))
+
+	err := sc.CheckExecutables(Services{
+		"finish": map[string]interface{}{"command": "nginx", "finish": "/usr/bin/cleanup"},
+	}, "/usr/sbin")
+	require.ErrorContains(t, err, "finish runs /usr/bin/cleanup")
+
+	for name, command := range map[string]string{
+		"missing":     "/usr/bin/missing",
+		"config":      "/opt/app/app.conf",
+		"directory":   "/usr/app",
+		"dangling":    "dangling",
+		"loop":        "/usr/bin/loop",
+		"not in path": "nginx",
+	} {
+		err := sc.CheckExecutables(Services{name: command}, "")
+		require.Error(t, err, name)
+		require.Contains(t, err.Error(), name+" runs", name)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s6
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// watchdogName returns the name of the service checking the health of the
+// service.
+func watchdogName(name string) string {
+	return name + "-health"
+}
+
+// watchdogScript returns the run script of the watchdog of the service, whose
+// supervision directory is svcdir at runtime, which runs the healthcheck after
+// the identity chain. Once the service is up, it
+// checks it up to the retries, restarting it if they all fail, and exits to be
+// started again by the supervisor.
+func watchdogScript(svc Service, svcdir string, identity []string) string {
+	h := svc.Healthcheck
+
+	up := "-u"
+	if svc.notifies() {
+		up = "-U"
+	}
+	attempts := make([]string, 0, h.Retries)
+	for i := 1; i <= h.Retries; i++ {
+		attempts = append(attempts, strconv.Itoa(i))
+	}
+	check := strings.Join(append(identity, string(h.Command)), " ")
+
+	return runScript(fmt.Sprintf("s6-svc -r %s", svcdir), []string{
+		fmt.Sprintf("if { s6-svwait %s %s }", up, svcdir),
+		fmt.Sprintf("forx -x 0 attempt { %s }", strings.Join(attempts, " ")),
+		// waits for the interval, or until the service goes down
+		fmt.Sprintf("foreground { s6-svwait -t %d -d %s }", h.Interval.Milliseconds(), svcdir),
+		fmt.Sprintf("ifelse { %s } { exit 0 }", check),
+		fmt.Sprintf("ifelse { eltest ${attempt} -lt %d } { exit 1 }", h.Retries),
+	})
+}
+
+// writeWatchdog writes the run script of the watchdog of the service, whose
+// supervision directory is svcdir, in dir.
+func (sc *Context) writeWatchdog(svc Service, svcdir string, dir string) error {
+	if err := sc.fs.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not make watchdog directory: %w", err)
+	}
+	// the check runs in the environment of the service, as its user
+	rundir := "/" + sc.serviceDir(svc.Name)
+	identity, err := sc.writeIdentity(svc, svcdir, rundir)
+	if err != nil {
+		return err
+	}
+	return sc.writeScript(dir, "run", watchdogScript(svc, rundir, identity))
+}
@@ -0,0 +1,240 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s6
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// rcSource is the source directory of the s6-rc database, relative to
+	// the root.
+	rcSource = "etc/s6-rc/source"
+	// rcCompiled is where the s6-rc database is compiled when the container
+	// starts, as the s6-rc of the image compiles it.
+	rcCompiled = "/run/s6-rc-compiled"
+	// rcInit is the service of the scan directory which compiles the s6-rc
+	// database, and brings the default bundle up.
+	rcInit = "s6-rc-init"
+	// rcDefault is the bundle brought up when the container starts.
+	rcDefault = "default"
+)
+
+// loggerName returns the name of the s6-rc service logging the output of the
+// service.
+func loggerName(name string) string {
+	return name + "-log"
+}
+
+// checkRC checks the services and bundles can be compiled into an s6-rc
+// database.
+func checkRC(ordered []Service, bundles map[string][]string) error {
+	names := make(map[string]bool, len(ordered))
+	for _, svc := range ordered {
+		if svc.Name == rcInit || svc.Name == rcDefault {
+			return fmt.Errorf("service %s is reserved for s6-rc", svc.Name)
+		}
+		names[svc.Name] = true
+	}
+	for _, svc := range ordered {
+		if svc.Log != nil {
+			if names[loggerName(svc.Name)] {
+				return fmt.Errorf("service %s is the logger of %s", loggerName(svc.Name), svc.Name)
+			}
+			names[loggerName(svc.Name)] = true
+		}
+		if svc.Healthcheck != nil {
+			names[watchdogName(svc.Name)] = true
+		}
+		if svc.Type == ServiceTypeOneshot && (svc.Log != nil || svc.Finish != "" || svc.EnableEnv != "" || svc.TimeoutKill != 0 || svc.TimeoutFinish != 0) {
+			return fmt.Errorf("service %s is a oneshot of s6-rc, which has neither log, finish, enable-env nor timeouts", svc.Name)
+		}
+	}
+	for name := range bundles {
+		if name == "" || strings.Contains(name, "/") || name == "." || name == ".." {
+			return fmt.Errorf("invalid bundle name %q", name)
+		}
+		if names[name] {
+			return fmt.Errorf("bundle %s is also a service", name)
+		}
+	}
+	for name, contents := range bundles {
+		for _, member := range contents {
+			if _, ok := bundles[member]; !ok && !names[member] {
+				return fmt.Errorf("bundle %s contains %s, which is neither a service nor a bundle", name, member)
+			}
+		}
+	}
+	return nil
+}
+
+// writeRCSet writes the directory of the s6-rc source definition, e.g.
+// dependencies.d, which has an empty file per member of the set.
+func (sc *Context) writeRCSet(dir string, name string, members []string) error {
+	setdir := filepath.Join(dir, name)
+	if err := sc.fs.MkdirAll(setdir, 0755); err != nil {
+		return fmt.Errorf("could not make %s: %w", name, err)
+	}
+	for _, member := range members {
+		if err := sc.fs.WriteFile(filepath.Join(setdir, member), nil, 0644); err != nil {
+			return fmt.Errorf("could not write %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// writeRCService writes the s6-rc source definition of the service, and of its
+// logger and watchdog, depending on the services it needs, or comes after.
+func (sc *Context) writeRCService(svc Service, byName map[string]Service) error {
+	sc.Log.Debugf("service: %s => %s", svc.Name, svc.Command)
+
+	dir := filepath.Join(rcSource, svc.Name)
+	if err := sc.fs.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not make s6-rc source directory: %w", err)
+	}
+	if err := sc.writeControlFile(dir, "type", string(svc.Type)); err != nil {
+		return err
+	}
+	deps, err := svc.dependencies(byName)
+	if err != nil {
+		return err
+	}
+	if err := sc.writeRCSet(dir, "dependencies.d", deps); err != nil {
+		return err
+	}
+
+	if svc.Type == ServiceTypeOneshot {
+		// it only has its source definition at runtime
+		identity, err := sc.writeIdentity(svc, dir, "/"+dir)
+		if err != nil {
+			return err
+		}
+		// a command line, which s6-rc runs with execlineb
+		up := strings.Join(append(identity, string(svc.Command)), "\n") + "\n"
+		if err := sc.fs.WriteFile(filepath.Join(dir, "up"), []byte(up), 0644); err != nil {
+			return fmt.Errorf("could not write up file: %w", err)
+		}
+		return nil
+	}
+
+	if svc.Log != nil {
+		logger := loggerName(svc.Name)
+		logdir := filepath.Join(rcSource, logger)
+		if err := sc.writeLogger(logdir, *svc.Log); err != nil {
+			return err
+		}
+		if err := sc.writeControlFile(logdir, "type", string(ServiceTypeLongrun)); err != nil {
+			return err
+		}
+		if err := sc.writeControlFile(logdir, "consumer-for", svc.Name); err != nil {
+			return err
+		}
+		if err := sc.writeControlFile(dir, "producer-for", logger); err != nil {
+			return err
+		}
+	}
+
+	// s6-rc starts it once its dependencies are ready
+	if err := sc.writeService(svc, dir, nil); err != nil {
+		return err
+	}
+
+	if svc.Healthcheck != nil {
+		watchdog := filepath.Join(rcSource, watchdogName(svc.Name))
+		if err := sc.writeWatchdog(svc, dir, watchdog); err != nil {
+			return err
+		}
+		if err := sc.writeControlFile(watchdog, "type", string(ServiceTypeLongrun)); err != nil {
+			return err
+		}
+		if err := sc.writeRCSet(watchdog, "dependencies.d", []string{svc.Name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteServiceDatabase writes the services as the source of an s6-rc database,
+// along with the bundles, and the service of the scan directory compiling it
+// and bringing the default bundle up when the container starts. Unless the
+// bundles set it, the default bundle has every service which is not down.
+func (sc *Context) WriteServiceDatabase(services Services, bundles map[string][]string) error {
+	sc.Log.Infof("generating s6-rc database")
+
+	ordered, err := ParseServices(services)
+	if err != nil {
+		return err
+	}
+	if err := checkRC(ordered, bundles); err != nil {
+		return err
+	}
+	byName := make(map[string]Service, len(ordered))
+	for _, svc := range ordered {
+		byName[svc.Name] = svc
+	}
+
+	var up []string
+	for _, svc := range ordered {
+		if err := sc.writeRCService(svc, byName); err != nil {
+			return err
+		}
+		if !svc.Down {
+			up = append(up, svc.Name)
+			if svc.Log != nil {
+				up = append(up, loggerName(svc.Name))
+			}
+			if svc.Healthcheck != nil {
+				up = append(up, watchdogName(svc.Name))
+			}
+		}
+	}
+
+	all := make(map[string][]string, len(bundles)+1)
+	all[rcDefault] = up
+	for name, contents := range bundles {
+		all[name] = contents
+	}
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dir := filepath.Join(rcSource, name)
+		if err := sc.fs.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("could not make s6-rc source directory: %w", err)
+		}
+		if err := sc.writeControlFile(dir, "type", "bundle"); err != nil {
+			return err
+		}
+		if err := sc.writeRCSet(dir, "contents.d", all[name]); err != nil {
+			return err
+		}
+	}
+
+	svcdir, err := sc.CreateSupervisionDirectory(rcInit)
+	if err != nil {
+		return err
+	}
+	// s6-rc-init links the longruns into the scan directory
+	return sc.writeScript(svcdir, "run", runScript(fmt.Sprintf("s6-rc -u change %s", rcDefault), []string{
+		"if { s6-svc -O . }",
+		fmt.Sprintf("if { s6-rc-compile %s /%s }", rcCompiled, rcSource),
+		fmt.Sprintf("if { s6-rc-init -c %s /%s }", rcCompiled, sc.scandir),
+	}))
+}
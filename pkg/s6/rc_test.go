@@ -0,0 +1,109 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s6
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/log"
+)
+
+func TestWriteServiceDatabase(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	sc := New(fsys, &log.Adapter{Out: io.Discard})
+	require.NoError(t, sc.WriteServiceDatabase(Services{
+		"db": map[string]interface{}{
+			"command":   "/usr/bin/db",
+			"readiness": map[string]interface{}{"notification-fd": 3},
+			"log":       map[string]interface{}{"directory": "/var/log/db"},
+		},
+		"migrate": map[string]interface{}{
+			"type":        "oneshot",
+			"command":     "/usr/bin/migrate",
+			"needs":       []interface{}{"db"},
+			"environment": map[string]interface{}{"DB": "db"},
+		},
+		"app": map[string]interface{}{
+			"command":     "/usr/bin/app",
+			"needs":       []interface{}{"migrate"},
+			"after":       []interface{}{"db"},
+			"healthcheck": map[string]interface{}{"command": "/usr/bin/app-ping"},
+		},
+		"debug": map[string]interface{}{
+			"command": "/usr/bin/debugd",
+			"down":    true,
+		},
+	}, map[string][]string{
+		"tools": {"debug"},
+	}))
+
+	for name, want := range map[string]string{
+		"db/type":                       "longrun\n",
+		"db/run":                        "#!/bin/execlineb\nfdmove -c 2 1\n/usr/bin/db\n",
+		"db/notification-fd":            "3\n",
+		"db/producer-for":               "db-log\n",
+		"db-log/type":                   "longrun\n",
+		"db-log/consumer-for":           "db\n",
+		"db-log/run":                    "#!/bin/execlineb\ns6-log T /var/log/db\n",
+		"migrate/type":                  "oneshot\n",
+		"migrate/up":                    "s6-envdir -fn /etc/s6-rc/source/migrate/env\n/usr/bin/migrate\n",
+		"migrate/env/DB":                "db",
+		"migrate/dependencies.d/db":     "",
+		"app/run":                       "#!/bin/execlineb\n/usr/bin/app\n",
+		"app/dependencies.d/migrate":    "",
+		"app/dependencies.d/db":         "",
+		"app-health/type":               "longrun\n",
+		"app-health/run":                "#!/bin/execlineb\nif { s6-svwait -u /sv/app }\nforx -x 0 attempt { 1 2 3 }\nforeground { s6-svwait -t 30000 -d /sv/app }\nifelse { /usr/bin/app-ping } { exit 0 }\nifelse { eltest ${attempt} -lt 3 } { exit 1 }\ns6-svc -r /sv/app\n",
+		"app-health/dependencies.d/app": "",
+		"default/type":                  "bundle\n",
+		"default/contents.d/app":        "",
+		"default/contents.d/app-health": "",
+		"default/contents.d/db":         "",
+		"default/contents.d/db-log":     "",
+		"default/contents.d/migrate":    "",
+		"tools/type":                    "bundle\n",
+		"tools/contents.d/debug":        "",
+	} {
+		b, err := fsys.ReadFile("etc/s6-rc/source/" + name)
+		require.NoError(t, err, name)
+		require.Equal(t, want, string(b), name)
+	}
+	_, err := fsys.Stat("etc/s6-rc/source/default/contents.d/debug")
+	require.Error(t, err, "down services are not in the default bundle")
+
+	b, err := fsys.ReadFile("sv/s6-rc-init/run")
+	require.NoError(t, err)
+	require.Equal(t, "#!/bin/execlineb\nif { s6-svc -O . }\nif { s6-rc-compile /run/s6-rc-compiled /etc/s6-rc/source }\nif { s6-rc-init -c /run/s6-rc-compiled /sv }\ns6-rc -u change default\n", string(b))
+	entries, err := fsys.ReadDir("sv")
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "s6-rc-init links the longruns")
+
+	for name, tt := range map[string]struct {
+		services Services
+		bundles  map[string][]string
+	}{
+		"reserved":       {Services{"default": "/usr/bin/app"}, nil},
+		"logger":         {Services{"app": map[string]interface{}{"command": "app", "log": map[string]interface{}{"directory": "/log"}}, "app-log": "app"}, nil},
+		"oneshot":        {Services{"app": map[string]interface{}{"command": "app", "type": "oneshot", "finish": "cleanup"}}, nil},
+		"bundle":         {Services{"app": "app"}, map[string][]string{"app": {"app"}}},
+		"missing member": {Services{"app": "app"}, map[string][]string{"all": {"app", "web"}}},
+	} {
+		require.Error(t, New(apkfs.NewMemFS(), &log.Adapter{Out: io.Discard}).WriteServiceDatabase(tt.services, tt.bundles), name)
+	}
+}
@@ -22,13 +22,15 @@ import (
 type Services map[interface{}]interface{}
 
 type Context struct {
-	fs  apkfs.FullFS
-	Log log.Logger
+	fs      apkfs.FullFS
+	scandir string
+	Log     log.Logger
 }
 
 func New(fs apkfs.FullFS, logger log.Logger) *Context {
 	return &Context{
-		fs:  fs,
-		Log: logger,
+		fs:      fs,
+		scandir: svbase,
+		Log:     logger,
 	}
 }
@@ -0,0 +1,80 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s6
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronShorthands are the schedules of cron which have a name.
+var cronShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronField matches the fields of cron expressions which snooze supports:
+// lists of values, ranges, and steps of them.
+var cronField = regexp.MustCompile(`^(\*|[0-9]+(-[0-9]+)?)(/[0-9]+)?(,(\*|[0-9]+(-[0-9]+)?)(/[0-9]+)?)*$`)
+
+// snoozeFlags are the flags of snooze for the minute, hour, day of month,
+// month and day of week fields of cron expressions.
+var snoozeFlags = []string{"-M", "-H", "-d", "-m", "-w"}
+
+// snooze returns the snooze command waiting for the next time of the
+// schedule, which is either a cron expression, or "@every" and a duration.
+// It only runs again once timefile is older than the schedule allows, which
+// the run script touches when it runs the service.
+func snooze(schedule string, timefile string) (string, error) {
+	args := []string{"snooze", "-t", timefile}
+
+	if every := strings.TrimPrefix(schedule, "@every "); every != schedule {
+		interval, err := time.ParseDuration(strings.TrimSpace(every))
+		if err != nil {
+			return "", fmt.Errorf("invalid schedule %q: %w", schedule, err)
+		}
+		if interval < time.Second || interval%time.Second != 0 {
+			return "", fmt.Errorf("invalid schedule %q: the interval is not a whole number of seconds", schedule)
+		}
+		// any second, once the interval passed
+		args = append(args, "-T", strconv.FormatInt(int64(interval/time.Second), 10), "-H", "*", "-M", "*", "-S", "*")
+		return strings.Join(args, " "), nil
+	}
+
+	if expr, ok := cronShorthands[schedule]; ok {
+		schedule = expr
+	}
+	fields := strings.Fields(schedule)
+	if len(fields) != len(snoozeFlags) {
+		return "", fmt.Errorf("invalid schedule %q: cron expressions have %d fields", schedule, len(snoozeFlags))
+	}
+	// cron runs at most once a minute
+	args = append(args, "-T", "60")
+	for i, field := range fields {
+		if !cronField.MatchString(field) {
+			return "", fmt.Errorf("invalid schedule %q: unsupported field %q", schedule, field)
+		}
+		args = append(args, snoozeFlags[i], field)
+	}
+	return strings.Join(args, " "), nil
+}
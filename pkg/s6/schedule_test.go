@@ -0,0 +1,49 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s6
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnooze(t *testing.T) {
+	for _, tt := range []struct {
+		schedule string
+		want     string
+	}{
+		{"*/5 * * * *", "snooze -t /last -T 60 -M */5 -H * -d * -m * -w *"},
+		{"30 2 1,15 * 1-5", "snooze -t /last -T 60 -M 30 -H 2 -d 1,15 -m * -w 1-5"},
+		{"@daily", "snooze -t /last -T 60 -M 0 -H 0 -d * -m * -w *"},
+		{"@every 90s", "snooze -t /last -T 90 -H * -M * -S *"},
+		{"@every 1h", "snooze -t /last -T 3600 -H * -M * -S *"},
+		{"* * * *", ""},
+		{"*/5 * * * mon", ""},
+		{"@every 1.5s", ""},
+		{"@every 0s", ""},
+		{"@sometimes", ""},
+	} {
+		t.Run(tt.schedule, func(t *testing.T) {
+			got, err := snooze(tt.schedule, "/last")
+			if tt.want == "" {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
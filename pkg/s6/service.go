@@ -0,0 +1,454 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s6
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ServiceType is how a service is run by the supervisor.
+type ServiceType string
+
+const (
+	// ServiceTypeLongrun services are daemons, restarted when they exit.
+	ServiceTypeLongrun ServiceType = "longrun"
+	// ServiceTypeOneshot services run once when the container starts, and are
+	// not restarted. Services depending on them start once they succeeded.
+	ServiceTypeOneshot ServiceType = "oneshot"
+)
+
+// Log is where s6-log keeps the output of a service, rotating the files.
+type Log struct {
+	// Directory is the absolute path of the log directory.
+	Directory string `yaml:"directory"`
+	// Size is the size in bytes of the current file before it is rotated.
+	Size int `yaml:"size,omitempty"`
+	// Count is the number of rotated files kept.
+	Count int `yaml:"count,omitempty"`
+}
+
+// validate checks the log can be kept by s6-log, cleaning its directory.
+func (l *Log) validate() error {
+	if !path.IsAbs(l.Directory) || path.Clean(l.Directory) == "/" {
+		return fmt.Errorf("log directory %q is not an absolute path", l.Directory)
+	}
+	l.Directory = path.Clean(l.Directory)
+	// the bounds of s6-log
+	if l.Size != 0 && (l.Size < 4096 || l.Size > 268435455) {
+		return fmt.Errorf("log size %d is not between 4096 and 268435455", l.Size)
+	}
+	if l.Count < 0 {
+		return fmt.Errorf("log count %d is negative", l.Count)
+	}
+	return nil
+}
+
+// Readiness is how a service tells it is ready, rather than only started,
+// either by itself or by a command polled until it succeeds.
+type Readiness struct {
+	// NotificationFD is the file descriptor the service writes a newline to
+	// once ready.
+	NotificationFD int `yaml:"notification-fd,omitempty"`
+	// Check is the command polled until it succeeds, as an execline command
+	// line.
+	Check string `yaml:"check,omitempty"`
+	// Interval is the time between two checks.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Timeout is the time after which checking stops, if the service is not
+	// ready.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// validate checks the readiness is notified in exactly one way.
+func (r *Readiness) validate() error {
+	switch {
+	case r.NotificationFD != 0 && r.Check != "":
+		return fmt.Errorf("readiness has both a notification-fd and a check")
+	case r.NotificationFD != 0:
+		// 0, 1 and 2 are the standard file descriptors
+		if r.NotificationFD < 3 {
+			return fmt.Errorf("readiness notification-fd %d is not at least 3", r.NotificationFD)
+		}
+		if r.Interval != 0 || r.Timeout != 0 {
+			return fmt.Errorf("readiness interval and timeout are only for checks")
+		}
+	case r.Check != "":
+		if r.Interval < 0 || r.Timeout < 0 {
+			return fmt.Errorf("readiness interval and timeout must not be negative")
+		}
+	default:
+		return fmt.Errorf("readiness has neither a notification-fd nor a check")
+	}
+	return nil
+}
+
+// Command is the command of a service, as an execline command line. In the
+// configuration, it is either the command line, or the arguments of the
+// command, which are quoted so they are passed as they are.
+type Command string
+
+// UnmarshalYAML reads either the command line or the arguments.
+func (c *Command) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		return value.Decode((*string)(c))
+	case yaml.SequenceNode:
+		var argv []string
+		if err := value.Decode(&argv); err != nil {
+			return err
+		}
+		words := make([]string, 0, len(argv))
+		for _, arg := range argv {
+			words = append(words, quote(arg))
+		}
+		*c = Command(strings.Join(words, " "))
+		return nil
+	default:
+		return fmt.Errorf("command is neither a command line nor a list of arguments")
+	}
+}
+
+// bareWord matches the words execlineb reads as they are, without quotes.
+var bareWord = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// quote returns the word quoted for execlineb, which reads it as a single
+// argument.
+func quote(word string) string {
+	if bareWord.MatchString(word) {
+		return word
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range word {
+		if r == '"' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Healthcheck is how a watchdog checks a service is healthy, restarting it
+// once the check failed a number of times in a row.
+type Healthcheck struct {
+	// Command is the check, which runs as the service does.
+	Command Command `yaml:"command"`
+	// Interval is the time before each check. Unless set, it is 30 seconds.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Retries is the number of checks in a row which fail before the service
+	// is restarted. Unless set, it is 3.
+	Retries int `yaml:"retries,omitempty"`
+}
+
+// validate checks the healthcheck has a command, and sets its defaults.
+func (h *Healthcheck) validate() error {
+	if h.Command == "" {
+		return fmt.Errorf("healthcheck has no command")
+	}
+	if h.Interval < 0 || h.Retries < 0 {
+		return fmt.Errorf("healthcheck interval and retries must not be negative")
+	}
+	if h.Interval == 0 {
+		h.Interval = 30 * time.Second
+	}
+	if h.Retries == 0 {
+		h.Retries = 3
+	}
+	return nil
+}
+
+// Service is a service of the supervision tree. In the configuration, it is
+// either the command to run, or a map of its fields.
+type Service struct {
+	Name string `yaml:"-"`
+	// Type is how the service is run, as a longrun unless set.
+	Type ServiceType `yaml:"type,omitempty"`
+	// Command is the command to run.
+	Command Command `yaml:"command"`
+	// Finish is the command run when the service exits, with the exit code
+	// and the signal which stopped it as its last arguments.
+	Finish Command `yaml:"finish,omitempty"`
+	// Needs are the services which must be up before this one starts.
+	Needs []string `yaml:"needs,omitempty"`
+	// After are the services which must be up before this one starts, if
+	// they are part of the supervision tree.
+	After []string `yaml:"after,omitempty"`
+	// Environment are the environment variables of the service, in addition
+	// to those of the image.
+	Environment map[string]string `yaml:"environment,omitempty"`
+	// User is the user the service runs as, by name or uid.
+	User string `yaml:"user,omitempty"`
+	// Group is the group the service runs as, by name or gid, instead of the
+	// primary group of its user.
+	Group string `yaml:"group,omitempty"`
+	// Log is where the output of the service is kept, if anywhere.
+	Log *Log `yaml:"log,omitempty"`
+	// Readiness is how the service tells it is ready. Unless set, it is ready
+	// as soon as it is up.
+	Readiness *Readiness `yaml:"readiness,omitempty"`
+	// Down is whether the service is down until it is brought up, rather
+	// than started with the container.
+	Down bool `yaml:"down,omitempty"`
+	// EnableEnv is the environment variable of the container which enables
+	// the service, which is down unless it is set to a non-empty value.
+	EnableEnv string `yaml:"enable-env,omitempty"`
+	// Schedule is when the service runs, as a cron expression, or "@every"
+	// and a duration. Unless set, it runs continuously.
+	Schedule string `yaml:"schedule,omitempty"`
+	// Healthcheck is how a watchdog checks the service is healthy, if it
+	// does.
+	Healthcheck *Healthcheck `yaml:"healthcheck,omitempty"`
+	// TimeoutKill is the time the service has to stop when brought down,
+	// after which it is killed. Unless set, it is never killed.
+	TimeoutKill time.Duration `yaml:"timeout-kill,omitempty"`
+	// TimeoutFinish is the time the finish script of the service has to run,
+	// after which it is killed. Unless set, it is 5 seconds.
+	TimeoutFinish time.Duration `yaml:"timeout-finish,omitempty"`
+}
+
+// notifies returns whether the service notifies its readiness, and services
+// depending on it wait for it to be ready rather than up.
+func (svc Service) notifies() bool {
+	return svc.Type == ServiceTypeOneshot || svc.Readiness != nil
+}
+
+// decode decodes the configuration into out, as if it were read from YAML.
+func decode(in interface{}, out interface{}) error {
+	b, err := yaml.Marshal(in)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	return dec.Decode(out)
+}
+
+// parseService returns the service of the name, as configured.
+func parseService(name string, descriptor interface{}) (Service, error) {
+	svc := Service{Name: name}
+	switch d := descriptor.(type) {
+	case string, []interface{}:
+		if err := decode(d, &svc.Command); err != nil {
+			return svc, fmt.Errorf("service %s: %w", name, err)
+		}
+	case map[string]interface{}, map[interface{}]interface{}:
+		if err := decode(d, &svc); err != nil {
+			return svc, fmt.Errorf("service %s: %w", name, err)
+		}
+		svc.Name = name
+	default:
+		return svc, fmt.Errorf("service %s is neither a command nor a map", name)
+	}
+	if svc.Command == "" {
+		return svc, fmt.Errorf("service %s has no command", name)
+	}
+	switch svc.Type {
+	case "":
+		svc.Type = ServiceTypeLongrun
+	case ServiceTypeLongrun, ServiceTypeOneshot:
+	default:
+		return svc, fmt.Errorf("service %s has unknown type %s", name, svc.Type)
+	}
+	if svc.EnableEnv != "" {
+		if svc.Down {
+			return svc, fmt.Errorf("service %s is either down or enabled by %s", name, svc.EnableEnv)
+		}
+		if strings.ContainsAny(svc.EnableEnv, "=\x00") {
+			return svc, fmt.Errorf("service %s: invalid environment variable name %q", name, svc.EnableEnv)
+		}
+	}
+	if svc.Schedule != "" {
+		if svc.Type == ServiceTypeOneshot || svc.Readiness != nil {
+			return svc, fmt.Errorf("service %s has a schedule, so it is neither a oneshot nor notifies readiness", name)
+		}
+		if _, err := snooze(svc.Schedule, ""); err != nil {
+			return svc, fmt.Errorf("service %s: %w", name, err)
+		}
+	}
+	if svc.Healthcheck != nil {
+		if svc.Type == ServiceTypeOneshot || svc.Schedule != "" {
+			return svc, fmt.Errorf("service %s has a healthcheck, so it is neither a oneshot nor scheduled", name)
+		}
+		if err := svc.Healthcheck.validate(); err != nil {
+			return svc, fmt.Errorf("service %s: %w", name, err)
+		}
+	}
+	if svc.TimeoutKill < 0 || svc.TimeoutFinish < 0 {
+		return svc, fmt.Errorf("service %s has a negative timeout", name)
+	}
+	if svc.Readiness != nil {
+		if svc.Type == ServiceTypeOneshot {
+			return svc, fmt.Errorf("service %s is a oneshot, which is ready once it succeeded", name)
+		}
+		if err := svc.Readiness.validate(); err != nil {
+			return svc, fmt.Errorf("service %s: %w", name, err)
+		}
+	}
+	if svc.Log != nil {
+		if err := svc.Log.validate(); err != nil {
+			return svc, fmt.Errorf("service %s: %w", name, err)
+		}
+	}
+	for key, value := range svc.Environment {
+		if err := validateVariable(key, value); err != nil {
+			return svc, fmt.Errorf("service %s: %w", name, err)
+		}
+	}
+	return svc, nil
+}
+
+// validateVariable checks the environment variable can be stored in an
+// envdir, where it is a file named after the variable.
+func validateVariable(key, value string) error {
+	if key == "" || strings.HasPrefix(key, ".") || strings.ContainsAny(key, "=/\x00") {
+		return fmt.Errorf("invalid environment variable name %q", key)
+	}
+	if strings.Contains(value, "\x00") {
+		return fmt.Errorf("environment variable %s contains a null byte", key)
+	}
+	return nil
+}
+
+// ParseServices returns the services of the configuration, in the order they
+// start: each after those it needs, or comes after, and by name otherwise.
+func ParseServices(services Services) ([]Service, error) {
+	byName := make(map[string]Service, len(services))
+	for name, descriptor := range services {
+		name, ok := name.(string)
+		if !ok {
+			return nil, fmt.Errorf("service name is not string")
+		}
+		if name == "" || strings.Contains(name, "/") || name == "." || name == ".." {
+			return nil, fmt.Errorf("invalid service name %q", name)
+		}
+		svc, err := parseService(name, descriptor)
+		if err != nil {
+			return nil, err
+		}
+		byName[name] = svc
+	}
+	for name, svc := range byName {
+		if _, ok := byName[watchdogName(name)]; ok && svc.Healthcheck != nil {
+			return nil, fmt.Errorf("service %s is the watchdog of %s", watchdogName(name), name)
+		}
+	}
+	return order(byName)
+}
+
+// dependencies returns the services the service starts after, which are part
+// of the supervision tree.
+func (svc Service) dependencies(byName map[string]Service) ([]string, error) {
+	deps := make([]string, 0, len(svc.Needs)+len(svc.After))
+	for _, dep := range svc.Needs {
+		if _, ok := byName[dep]; !ok {
+			return nil, fmt.Errorf("service %s needs %s, which is not a service", svc.Name, dep)
+		}
+		deps = append(deps, dep)
+	}
+	for _, dep := range svc.After {
+		if _, ok := byName[dep]; ok {
+			deps = append(deps, dep)
+		}
+	}
+	for _, dep := range deps {
+		if dep == svc.Name {
+			return nil, fmt.Errorf("service %s depends on itself", svc.Name)
+		}
+	}
+	return deps, nil
+}
+
+// order sorts the services topologically, failing on cycles.
+func order(byName map[string]Service) ([]Service, error) {
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(byName))
+	ordered := make([]Service, 0, len(byName))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("services depend on each other: %s", strings.Join(append(path, name), " -> "))
+		}
+		state[name] = visiting
+		deps, err := byName[name].dependencies(byName)
+		if err != nil {
+			return err
+		}
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		ordered = append(ordered, byName[name])
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// waitFor returns all the services the service waits for before starting,
+// including those its dependencies wait for, as being up only means they
+// were started unless they notify their readiness.
+func waitFor(svc Service, byName map[string]Service) []Service {
+	seen := map[string]bool{}
+	var walk func(s Service)
+	walk = func(s Service) {
+		deps, _ := s.dependencies(byName)
+		for _, dep := range deps {
+			if !seen[dep] {
+				seen[dep] = true
+				walk(byName[dep])
+			}
+		}
+	}
+	walk(svc)
+	names := make([]string, 0, len(seen))
+	for dep := range seen {
+		names = append(names, dep)
+	}
+	sort.Strings(names)
+	all := make([]Service, 0, len(names))
+	for _, name := range names {
+		all = append(all, byName[name])
+	}
+	return all
+}
@@ -15,15 +15,34 @@
 package s6
 
 import (
-	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// svbase is the default scan directory of s6-svscan, relative to the root.
+const svbase = "sv"
+
+// SetScanDirectory sets the scan directory of s6-svscan, an absolute path,
+// where the supervision directories are written.
+func (sc *Context) SetScanDirectory(dir string) {
+	if dir == "" {
+		dir = svbase
+	}
+	sc.scandir = strings.TrimPrefix(filepath.Clean("/"+dir), "/")
+}
+
+// serviceDir returns the supervision directory of the service, relative to
+// the root.
+func (sc *Context) serviceDir(name string) string {
+	return filepath.Join(sc.scandir, name)
+}
+
 func (sc *Context) CreateSupervisionDirectory(name string) (string, error) {
-	svbase := "sv"
-	svcdir := filepath.Join(svbase, name)
+	svcdir := sc.serviceDir(name)
 	sc.Log.Debugf("  supervision dir: %s", svcdir)
 
 	if err := sc.fs.MkdirAll(svcdir, 0777); err != nil {
@@ -33,49 +52,317 @@ func (sc *Context) CreateSupervisionDirectory(name string) (string, error) {
 }
 
 func (sc *Context) WriteSupervisionTemplate(svcdir string, command string) error {
-	filename := filepath.Join(svcdir, "run")
-	file, err := sc.fs.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0755)
+	return sc.writeScript(svcdir, "run", runScript(command, nil))
+}
+
+// writeScript writes the script of the service, run or finish, in its
+// supervision directory.
+func (sc *Context) writeScript(svcdir string, name string, script string) error {
+	filename := filepath.Join(svcdir, name)
+	file, err := sc.fs.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
 	if err != nil {
-		return fmt.Errorf("could not create runfile: %w", err)
+		return fmt.Errorf("could not create %sfile: %w", name, err)
 	}
 	defer file.Close()
 
-	fmt.Fprintf(file, "#!/bin/execlineb\n%s\n", command)
+	if _, err := file.Write([]byte(script)); err != nil {
+		return fmt.Errorf("could not write %sfile: %w", name, err)
+	}
+	return nil
+}
 
+// writeEnvDir writes the environment of the service as an envdir of its
+// directory, with a file per variable holding its value. An empty value unsets
+// the variable.
+func (sc *Context) writeEnvDir(svc Service, svcdir string) error {
+	dir := filepath.Join(svcdir, "env")
+	if err := sc.fs.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not make envdir: %w", err)
+	}
+	for key, value := range svc.Environment {
+		if err := sc.fs.WriteFile(filepath.Join(dir, key), []byte(value), 0644); err != nil {
+			return fmt.Errorf("could not write environment variable %s: %w", key, err)
+		}
+	}
 	return nil
 }
 
+// writeControlFile writes the file of the supervision directory, which
+// configures how s6-supervise handles the service.
+func (sc *Context) writeControlFile(svcdir string, name string, value string) error {
+	if err := sc.fs.WriteFile(filepath.Join(svcdir, name), []byte(value+"\n"), 0644); err != nil {
+		return fmt.Errorf("could not write %s: %w", name, err)
+	}
+	return nil
+}
+
+// writeNotificationFD makes the supervisor read the readiness of the service
+// from the file descriptor.
+func (sc *Context) writeNotificationFD(svcdir string, fd int) error {
+	return sc.writeControlFile(svcdir, "notification-fd", strconv.Itoa(fd))
+}
+
+// writeTimeouts writes the timeouts of the service, in milliseconds as
+// s6-supervise counts them.
+func (sc *Context) writeTimeouts(svc Service, svcdir string) error {
+	for name, timeout := range map[string]time.Duration{
+		"timeout-kill":   svc.TimeoutKill,
+		"timeout-finish": svc.TimeoutFinish,
+	} {
+		if timeout == 0 {
+			continue
+		}
+		if err := sc.writeControlFile(svcdir, name, strconv.FormatInt(timeout.Milliseconds(), 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCheck writes the readiness check of the service, where
+// s6-notifyoncheck looks for it.
+func (sc *Context) writeCheck(svcdir string, check string) error {
+	datadir := filepath.Join(svcdir, "data")
+	if err := sc.fs.MkdirAll(datadir, 0755); err != nil {
+		return fmt.Errorf("could not make data directory: %w", err)
+	}
+	script := fmt.Sprintf("#!/bin/execlineb -P\n%s\n", check)
+	if err := sc.fs.WriteFile(filepath.Join(datadir, "check"), []byte(script), 0755); err != nil {
+		return fmt.Errorf("could not write readiness check: %w", err)
+	}
+	return nil
+}
+
+// notifyOnCheck returns the execline command polling the readiness check
+// while the command runs, in milliseconds as s6-notifyoncheck counts them,
+// until the timeout rather than a number of tries.
+func notifyOnCheck(r Readiness) string {
+	args := []string{"s6-notifyoncheck", "-n 0"}
+	if r.Interval != 0 {
+		args = append(args, fmt.Sprintf("-w %d", r.Interval.Milliseconds()))
+	}
+	if r.Timeout != 0 {
+		args = append(args, fmt.Sprintf("-T %d", r.Timeout.Milliseconds()))
+	}
+	return strings.Join(args, " ")
+}
+
+// writeLogger writes the run script of the logger of the service in logdir,
+// making the log directory in the image.
+func (sc *Context) writeLogger(logdir string, l Log) error {
+	if err := sc.fs.MkdirAll(strings.TrimPrefix(l.Directory, "/"), 0755); err != nil {
+		return fmt.Errorf("could not make log directory: %w", err)
+	}
+
+	if err := sc.fs.MkdirAll(logdir, 0755); err != nil {
+		return fmt.Errorf("could not make logger directory: %w", err)
+	}
+
+	script := []string{"s6-log"}
+	if l.Count != 0 {
+		script = append(script, fmt.Sprintf("n%d", l.Count))
+	}
+	if l.Size != 0 {
+		script = append(script, fmt.Sprintf("s%d", l.Size))
+	}
+	script = append(script, "T", l.Directory)
+	return sc.writeScript(logdir, "run", runScript(strings.Join(script, " "), nil))
+}
+
+// execlineScript returns the script running the command after the chain of
+// execline commands, each of which execs into the next.
+func execlineScript(shebang string, command string, chain []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", shebang)
+	for _, link := range chain {
+		fmt.Fprintf(&b, "%s\n", link)
+	}
+	fmt.Fprintf(&b, "%s\n", command)
+	return b.String()
+}
+
+// runScript returns the run script running the command after the chain.
+func runScript(command string, chain []string) string {
+	return execlineScript("#!/bin/execlineb", command, chain)
+}
+
+// finishScript returns the finish script running the command after the chain,
+// with the exit code and the signal which stopped the service as its last
+// arguments, as s6-supervise passes them.
+func finishScript(command string, chain []string) string {
+	return execlineScript("#!/bin/execlineb -S2", command+" $1 $2", chain)
+}
+
 func (sc *Context) WriteSupervisionServiceSimple(name string, command string) error {
-	sc.Log.Debugf("simple service: %s => %s", name, command)
+	return sc.WriteSupervisionService(Service{Name: name, Type: ServiceTypeLongrun, Command: Command(command)}, nil)
+}
+
+// WriteSupervisionService writes the supervision directory of the service,
+// which waits for the services of wait to be up, or ready for those notifying
+// their readiness, before starting, and the one of its watchdog if it has a
+// healthcheck.
+func (sc *Context) WriteSupervisionService(svc Service, wait []Service) error {
+	sc.Log.Debugf("service: %s => %s", svc.Name, svc.Command)
 
-	svcdir, err := sc.CreateSupervisionDirectory(name)
+	svcdir, err := sc.CreateSupervisionDirectory(svc.Name)
 	if err != nil {
 		return err
 	}
 
-	if err := sc.WriteSupervisionTemplate(svcdir, command); err != nil {
-		return err
+	if svc.Down {
+		if err := sc.fs.WriteFile(filepath.Join(svcdir, "down"), nil, 0644); err != nil {
+			return fmt.Errorf("could not write down file: %w", err)
+		}
+	}
+	if svc.Log != nil {
+		// s6-svscan pipes the output of the service to it
+		if err := sc.writeLogger(filepath.Join(svcdir, "log"), *svc.Log); err != nil {
+			return err
+		}
+	}
+
+	var up, ready []string
+	for _, dep := range wait {
+		if dep.notifies() {
+			ready = append(ready, "/"+sc.serviceDir(dep.Name))
+		} else {
+			up = append(up, "/"+sc.serviceDir(dep.Name))
+		}
+	}
+	var waits []string
+	if len(up) != 0 {
+		waits = append(waits, fmt.Sprintf("if { s6-svwait -u %s }", strings.Join(up, " ")))
+	}
+	if len(ready) != 0 {
+		waits = append(waits, fmt.Sprintf("if { s6-svwait -U %s }", strings.Join(ready, " ")))
 	}
 
+	if err := sc.writeService(svc, svcdir, waits); err != nil {
+		return err
+	}
+	if svc.Healthcheck != nil {
+		return sc.writeWatchdog(svc, svcdir, sc.serviceDir(watchdogName(svc.Name)))
+	}
 	return nil
 }
 
-func (sc *Context) WriteSupervisionTree(services Services) error {
-	sc.Log.Infof("generating supervision tree")
-
-	// generate the leaves
-	for service, descriptor := range services {
-		service, ok := service.(string)
-		if !ok {
-			return errors.New("service name is not string")
+// writeIdentity writes the envdir of the service in svcdir, and returns the
+// execline commands running the rest of the chain in its environment, as its
+// user, with svcdir at rundir at runtime.
+func (sc *Context) writeIdentity(svc Service, svcdir string, rundir string) ([]string, error) {
+	var identity []string
+	if len(svc.Environment) != 0 {
+		if err := sc.writeEnvDir(svc, svcdir); err != nil {
+			return nil, err
 		}
+		// the values are read whole, as written
+		identity = append(identity, fmt.Sprintf("s6-envdir -fn %s", filepath.Join(rundir, "env")))
+	}
+	// privileges are dropped last, once the envdir is read
+	applyuidgid, err := sc.applyUIDGID(svc)
+	if err != nil {
+		return nil, err
+	}
+	if applyuidgid != "" {
+		identity = append(identity, applyuidgid)
+	}
+	return identity, nil
+}
 
-		if svccmd, ok := descriptor.(string); ok {
-			if err := sc.WriteSupervisionServiceSimple(service, svccmd); err != nil {
+// writeService writes the scripts and control files of the service in svcdir,
+// running the waits before anything else. Its paths at runtime are those of
+// its supervision directory.
+func (sc *Context) writeService(svc Service, svcdir string, waits []string) error {
+	if err := sc.writeTimeouts(svc, svcdir); err != nil {
+		return err
+	}
+
+	var chain []string
+	command := string(svc.Command)
+	if svc.Type == ServiceTypeOneshot {
+		// it is not restarted, and is ready once the command succeeded
+		if err := sc.writeNotificationFD(svcdir, 3); err != nil {
+			return err
+		}
+		chain = append(chain, "if { s6-svc -O . }")
+		command = fmt.Sprintf("if { %s }\ns6-notifyoncheck -c \"exit 0\" s6-pause", command)
+	}
+	chain = append(chain, waits...)
+	if svc.EnableEnv != "" {
+		// it stays down once the run script exits, unless enabled
+		chain = append(chain,
+			fmt.Sprintf("importas -D \"\" enable %s", quote(svc.EnableEnv)),
+			"ifelse { eltest -z ${enable} } { s6-svc -O . }")
+	}
+	if svc.Log != nil {
+		// the logger reads stdout
+		chain = append(chain, "fdmove -c 2 1")
+	}
+	if svc.Schedule != "" {
+		// it runs again once the supervisor restarts it, at the next time
+		// of the schedule
+		if err := sc.fs.MkdirAll(filepath.Join(svcdir, "data"), 0755); err != nil {
+			return fmt.Errorf("could not make data directory: %w", err)
+		}
+		timefile := "/" + filepath.Join(sc.serviceDir(svc.Name), "data", "last-run")
+		wait, err := snooze(svc.Schedule, timefile)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, fmt.Sprintf("if { %s }", wait), fmt.Sprintf("if { redirfd -w 1 %s exit 0 }", timefile))
+	}
+	// the finish script runs in the same environment, as the same user
+	identity, err := sc.writeIdentity(svc, svcdir, "/"+sc.serviceDir(svc.Name))
+	if err != nil {
+		return err
+	}
+	chain = append(chain, identity...)
+	if r := svc.Readiness; r != nil {
+		fd := r.NotificationFD
+		if r.Check != "" {
+			fd = 3
+		}
+		if err := sc.writeNotificationFD(svcdir, fd); err != nil {
+			return err
+		}
+		if r.Check != "" {
+			if err := sc.writeCheck(svcdir, r.Check); err != nil {
 				return err
 			}
-		} else {
-			return errors.New("complex services are not yet supported")
+			chain = append(chain, notifyOnCheck(*r))
+		}
+	}
+
+	if svc.Finish != "" {
+		var finish []string
+		if svc.Log != nil {
+			finish = append(finish, "fdmove -c 2 1")
+		}
+		finish = append(finish, identity...)
+		if err := sc.writeScript(svcdir, "finish", finishScript(string(svc.Finish), finish)); err != nil {
+			return err
+		}
+	}
+
+	return sc.writeScript(svcdir, "run", runScript(command, chain))
+}
+
+func (sc *Context) WriteSupervisionTree(services Services) error {
+	sc.Log.Infof("generating supervision tree")
+
+	ordered, err := ParseServices(services)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]Service, len(ordered))
+	for _, svc := range ordered {
+		byName[svc.Name] = svc
+	}
+
+	// generate the leaves, dependencies first
+	for _, svc := range ordered {
+		if err := sc.WriteSupervisionService(svc, waitFor(svc, byName)); err != nil {
+			return err
 		}
 	}
 
@@ -0,0 +1,227 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s6
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/log"
+)
+
+func TestParseServices(t *testing.T) {
+	ordered, err := ParseServices(Services{
+		"app": map[string]interface{}{
+			"command": "/usr/bin/app",
+			"needs":   []interface{}{"db"},
+			"after":   []interface{}{"cache", "missing"},
+		},
+		"cache": "/usr/bin/cache",
+		"db": map[string]interface{}{
+			"command": "/usr/bin/db",
+			"after":   []interface{}{"cache"},
+		},
+		"web": []interface{}{"/usr/bin/web", "--title", `say "hello"`},
+	})
+	require.NoError(t, err)
+	names := make([]string, 0, len(ordered))
+	for _, svc := range ordered {
+		names = append(names, svc.Name)
+	}
+	require.Equal(t, []string{"cache", "db", "app", "web"}, names)
+	require.Equal(t, Command(`/usr/bin/web --title "say \"hello\""`), ordered[3].Command)
+
+	for _, tt := range []struct {
+		name     string
+		services Services
+	}{
+		{"missing need", Services{"app": map[string]interface{}{"command": "app", "needs": []interface{}{"db"}}}},
+		{"itself", Services{"app": map[string]interface{}{"command": "app", "after": []interface{}{"app"}}}},
+		{"cycle", Services{
+			"a": map[string]interface{}{"command": "a", "needs": []interface{}{"b"}},
+			"b": map[string]interface{}{"command": "b", "after": []interface{}{"a"}},
+		}},
+		{"unknown field", Services{"app": map[string]interface{}{"command": "app", "requires": "db"}}},
+		{"empty command", Services{"app": []interface{}{}}},
+		{"no command", Services{"app": map[string]interface{}{"needs": []interface{}{}}}},
+		{"name", Services{"../app": "app"}},
+		{"log", Services{"app": map[string]interface{}{"command": "app", "log": map[string]interface{}{"directory": "log"}}}},
+		{"readiness", Services{"app": map[string]interface{}{"command": "app", "readiness": map[string]interface{}{"notification-fd": 1}}}},
+		{"oneshot readiness", Services{"app": map[string]interface{}{"command": "app", "type": "oneshot", "readiness": map[string]interface{}{"check": "true"}}}},
+		{"timeout", Services{"app": map[string]interface{}{"command": "app", "timeout-kill": "-1s"}}},
+		{"schedule", Services{"app": map[string]interface{}{"command": "app", "schedule": "@every 1m", "type": "oneshot"}}},
+		{"down", Services{"app": map[string]interface{}{"command": "app", "down": true, "enable-env": "APP"}}},
+		{"type", Services{"app": map[string]interface{}{"command": "app", "type": "bundle"}}},
+		{"oneshot healthcheck", Services{"app": map[string]interface{}{"command": "app", "type": "oneshot", "healthcheck": map[string]interface{}{"command": "true"}}}},
+		{"healthcheck", Services{"app": map[string]interface{}{"command": "app", "healthcheck": map[string]interface{}{"retries": 2}}}},
+		{"watchdog", Services{"app": map[string]interface{}{"command": "app", "healthcheck": map[string]interface{}{"command": "true"}}, "app-health": "app"}},
+		{"variable", Services{"app": map[string]interface{}{"command": "app", "environment": map[string]interface{}{"A=B": "c"}}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseServices(tt.services)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for word, want := range map[string]string{
+		"/usr/sbin/nginx": "/usr/sbin/nginx",
+		"--port=8080":     "--port=8080",
+		"":                `""`,
+		"daemon off;":     `"daemon off;"`,
+		"{":               `"{"`,
+		"#comment":        `"#comment"`,
+		`C:\dir "quoted"`: `"C:\\dir \"quoted\""`,
+		"${HOME}":         `"${HOME}"`,
+	} {
+		require.Equal(t, want, quote(word), word)
+	}
+}
+
+func TestWriteSupervisionTree(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("etc", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/passwd", []byte("root:x:0:0:root:/root:/bin/sh\npostgres:x:70:70::/var/lib/postgresql:/bin/sh\napp:x:10000:10000::/home/app:/bin/sh\n"), 0o644))
+	require.NoError(t, fsys.WriteFile("etc/group", []byte("root:x:0:root\nwheel:x:10:root,app\npostgres:x:70:\napp:x:10000:\n"), 0o644))
+	sc := New(fsys, &log.Adapter{Out: io.Discard})
+	require.NoError(t, sc.WriteSupervisionTree(Services{
+		"app": map[string]interface{}{
+			"command":        "/usr/bin/app",
+			"needs":          []interface{}{"db", "migrate"},
+			"user":           "app",
+			"finish":         []interface{}{"/usr/bin/notify", "app stopped"},
+			"timeout-kill":   "10s",
+			"timeout-finish": "2500ms",
+		},
+		"debug": map[string]interface{}{
+			"command": "/usr/bin/debugd",
+			"down":    true,
+		},
+		"metrics": map[string]interface{}{
+			"command":    "/usr/bin/exporter",
+			"enable-env": "ENABLE_METRICS",
+		},
+		"vacuum": map[string]interface{}{
+			"command":  "/usr/bin/vacuumdb",
+			"needs":    []interface{}{"db"},
+			"schedule": "@every 1h",
+		},
+		"migrate": map[string]interface{}{
+			"command": []interface{}{"/usr/bin/migrate", "--to", "latest version"},
+			"type":    "oneshot",
+			"needs":   []interface{}{"db"},
+		},
+		"cache": map[string]interface{}{
+			"command": "/usr/bin/cache",
+			"group":   "10000",
+			"readiness": map[string]interface{}{
+				"notification-fd": 5,
+			},
+			"log": map[string]interface{}{
+				"directory": "/var/log/cache/",
+				"size":      1048576,
+			},
+		},
+		"db": map[string]interface{}{
+			"command": "/usr/bin/db",
+			"after":   []interface{}{"cache"},
+			"readiness": map[string]interface{}{
+				"check":    "pg_isready -q",
+				"interval": "500ms",
+				"timeout":  "1m",
+			},
+			"user":  "postgres",
+			"group": "wheel",
+			"environment": map[string]interface{}{
+				"PGPORT": 5432,
+				"PGDATA": "/var/lib/postgresql/data\n",
+			},
+		},
+	}))
+
+	for name, want := range map[string]string{
+		"cache":     "#!/bin/execlineb\nfdmove -c 2 1\ns6-applyuidgid -g 10000 -G 10000\n/usr/bin/cache\n",
+		"cache/log": "#!/bin/execlineb\ns6-log s1048576 T /var/log/cache\n",
+		"db":        "#!/bin/execlineb\nif { s6-svwait -U /sv/cache }\ns6-envdir -fn /sv/db/env\ns6-applyuidgid -u 70 -g 10 -G 10\ns6-notifyoncheck -n 0 -w 500 -T 60000\n/usr/bin/db\n",
+		"app":       "#!/bin/execlineb\nif { s6-svwait -U /sv/cache /sv/db /sv/migrate }\ns6-applyuidgid -u 10000 -g 10000 -G 10000,10\n/usr/bin/app\n",
+		"metrics":   "#!/bin/execlineb\nimportas -D \"\" enable ENABLE_METRICS\nifelse { eltest -z ${enable} } { s6-svc -O . }\n/usr/bin/exporter\n",
+		"vacuum":    "#!/bin/execlineb\nif { s6-svwait -U /sv/cache /sv/db }\nif { snooze -t /sv/vacuum/data/last-run -T 3600 -H * -M * -S * }\nif { redirfd -w 1 /sv/vacuum/data/last-run exit 0 }\n/usr/bin/vacuumdb\n",
+		"migrate":   "#!/bin/execlineb\nif { s6-svc -O . }\nif { s6-svwait -U /sv/cache /sv/db }\nif { /usr/bin/migrate --to \"latest version\" }\ns6-notifyoncheck -c \"exit 0\" s6-pause\n",
+	} {
+		b, err := fsys.ReadFile("sv/" + name + "/run")
+		require.NoError(t, err)
+		require.Equal(t, want, string(b), name)
+	}
+
+	for key, want := range map[string]string{
+		"PGPORT": "5432",
+		"PGDATA": "/var/lib/postgresql/data\n",
+	} {
+		b, err := fsys.ReadFile("sv/db/env/" + key)
+		require.NoError(t, err)
+		require.Equal(t, want, string(b), key)
+	}
+	for name, want := range map[string]string{
+		"migrate/notification-fd": "3\n",
+		"app/finish":              "#!/bin/execlineb -S2\ns6-applyuidgid -u 10000 -g 10000 -G 10000,10\n/usr/bin/notify \"app stopped\" $1 $2\n",
+		"cache/notification-fd":   "5\n",
+		"db/notification-fd":      "3\n",
+		"db/data/check":           "#!/bin/execlineb -P\npg_isready -q\n",
+		"app/timeout-kill":        "10000\n",
+		"app/timeout-finish":      "2500\n",
+	} {
+		b, err := fsys.ReadFile("sv/" + name)
+		require.NoError(t, err)
+		require.Equal(t, want, string(b), name)
+	}
+	fi, err := fsys.Stat("var/log/cache")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	_, err = fsys.Stat("sv/app/env")
+	require.Error(t, err, "no envdir without environment")
+	fi, err = fsys.Stat("sv/debug/down")
+	require.NoError(t, err)
+	require.True(t, fi.Mode().IsRegular())
+	_, err = fsys.Stat("sv/metrics/down")
+	require.Error(t, err, "up unless down")
+	_, err = fsys.Stat("sv/app-health")
+	require.Error(t, err, "no watchdog without healthcheck")
+	_, err = fsys.Stat("sv/db/timeout-kill")
+	require.Error(t, err, "no timeout unless set")
+
+	err = sc.WriteSupervisionTree(Services{
+		"nginx": map[string]interface{}{"command": "/usr/sbin/nginx", "user": "nginx"},
+	})
+	require.ErrorContains(t, err, "user nginx does not exist")
+}
+
+func TestScanDirectory(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	sc := New(fsys, &log.Adapter{Out: io.Discard})
+	sc.SetScanDirectory("/run/service/")
+	require.NoError(t, sc.WriteSupervisionTree(Services{
+		"app": map[string]interface{}{"command": "/usr/bin/app", "needs": []interface{}{"db"}},
+		"db":  "/usr/bin/db",
+	}))
+	b, err := fsys.ReadFile("run/service/app/run")
+	require.NoError(t, err)
+	require.Equal(t, "#!/bin/execlineb\nif { s6-svwait -u /run/service/db }\n/usr/bin/app\n", string(b))
+	_, err = fsys.Stat("sv")
+	require.Error(t, err)
+}
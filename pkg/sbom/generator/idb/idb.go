@@ -16,6 +16,7 @@ package idb
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 
 	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
@@ -50,7 +51,8 @@ func (i *IDB) Generate(opts *options.Options, path string) error {
 		return fmt.Errorf("reading installed db for copying: %w", err)
 	}
 
-	if err := i.fs.WriteFile(path, idbData, 0o600); err != nil {
+	// the SBOM goes along the others, not in the image
+	if err := os.WriteFile(path, idbData, 0o600); err != nil {
 		return fmt.Errorf("copying installed db: %w", err)
 	}
 
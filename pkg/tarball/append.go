@@ -43,9 +43,10 @@ func (m *MultiTar) Append(ctx *Context, src fs.FS, extra ...io.Writer) error {
 		all = append(all, gzip.NewWriter(w))
 	}
 
-	tw := tar.NewWriter(io.MultiWriter(all...))
+	out := io.MultiWriter(all...)
+	tw := tar.NewWriter(out)
 
-	if err := ctx.writeTar(tw, src, nil, nil); err != nil {
+	if err := ctx.writeTar(tw, src, nil, nil, newWritten(out)); err != nil {
 		return err
 	}
 
@@ -0,0 +1,221 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+)
+
+const (
+	// blockSize is the size of the blocks of a tarball.
+	blockSize = 512
+	// sparseHoleSize is the granularity at which holes are looked for, the
+	// smallest hole a sparse entry leaves out.
+	sparseHoleSize = 4096
+	// maxOctal is the largest value of the 8 bytes numeric fields of a ustar
+	// header, and maxSize that of its size.
+	maxOctal = 07777777
+	maxSize  = 077777777777
+)
+
+// sparseFragment is a part of a sparse file which is not a hole.
+type sparseFragment struct {
+	offset, length int64
+}
+
+// sparseFragments returns the parts of the content of the entry which are
+// not holes, if it should be written as a sparse entry, or nil.
+func (ctx *Context) sparseFragments(header *tar.Header, content, original io.Reader) []sparseFragment {
+	if !ctx.Sparse || header.Typeflag != tar.TypeReg || content == nil || content != original || header.Size < sparseHoleSize {
+		return nil
+	}
+	// only what fits a ustar header, along with PAX records
+	mtime := header.ModTime.Unix()
+	if header.Mode > maxOctal || header.Uid > maxOctal || header.Gid > maxOctal ||
+		mtime < 0 || mtime > maxSize || len(header.Uname) > 32 || len(header.Gname) > 32 {
+		return nil
+	}
+	ra, ok := content.(io.ReaderAt)
+	if !ok {
+		return nil
+	}
+	fragments, err := findFragments(ra, header.Size)
+	if err != nil {
+		// left to writing it as a regular file to tell
+		return nil
+	}
+	return fragments
+}
+
+// findFragments reads the content, of the given size, for the parts which
+// are not holes, or returns nil if it has none.
+func findFragments(ra io.ReaderAt, size int64) ([]sparseFragment, error) {
+	var (
+		fragments []sparseFragment
+		holes     bool
+		buf       = make([]byte, sparseHoleSize)
+	)
+	for offset := int64(0); offset < size; offset += sparseHoleSize {
+		n := size - offset
+		if n > sparseHoleSize {
+			n = sparseHoleSize
+		}
+		if _, err := ra.ReadAt(buf[:n], offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n == sparseHoleSize && isZero(buf) {
+			holes = true
+			continue
+		}
+		if last := len(fragments) - 1; last >= 0 && fragments[last].offset+fragments[last].length == offset {
+			fragments[last].length += n
+			continue
+		}
+		fragments = append(fragments, sparseFragment{offset: offset, length: n})
+	}
+	if !holes {
+		return nil, nil
+	}
+	// a file ending with a hole ends with an empty fragment, for its size
+	if last := len(fragments) - 1; last < 0 || fragments[last].offset+fragments[last].length < size {
+		fragments = append(fragments, sparseFragment{offset: size})
+	}
+	return fragments, nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeSparse writes the entry as a PAX sparse file, in the 1.0 format, which
+// the tar writer does not support, directly to the writer under it: a PAX
+// header with the name and size of the file, then a ustar header, then the
+// map of the fragments followed by their content.
+func writeSparse(w io.Writer, header *tar.Header, ra io.ReaderAt, fragments []sparseFragment) error {
+	if w == nil {
+		return fmt.Errorf("no writer for sparse entries")
+	}
+
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(fragments))
+	var size int64
+	for _, f := range fragments {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", f.offset, f.length)
+		size += f.length
+	}
+	sparseMap.Write(make([]byte, padding(int64(sparseMap.Len()))))
+	size += int64(sparseMap.Len())
+	if size > maxSize {
+		return fmt.Errorf("sparse entry of %d bytes is too large", size)
+	}
+
+	records := map[string]string{}
+	for k, v := range header.PAXRecords {
+		records[k] = v
+	}
+	records["GNU.sparse.major"] = "1"
+	records["GNU.sparse.minor"] = "0"
+	records["GNU.sparse.name"] = header.Name
+	records["GNU.sparse.realsize"] = strconv.FormatInt(header.Size, 10)
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pax bytes.Buffer
+	for _, k := range keys {
+		pax.WriteString(paxRecord(k, records[k]))
+	}
+
+	dir, base := path.Split(header.Name)
+	paxHeader := ustarHeader(header, path.Join(dir, "PaxHeaders.0", base), tar.TypeXHeader, int64(pax.Len()))
+	fileHeader := ustarHeader(header, path.Join(dir, "GNUSparseFile.0", base), tar.TypeReg, size)
+
+	for _, b := range [][]byte{paxHeader, pax.Bytes(), make([]byte, padding(int64(pax.Len()))), fileHeader, sparseMap.Bytes()} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	for _, f := range fragments {
+		if _, err := io.Copy(w, io.NewSectionReader(ra, f.offset, f.length)); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(make([]byte, padding(size)))
+	return err
+}
+
+// padding returns how many bytes pad size to the next block.
+func padding(size int64) int64 {
+	return -size & (blockSize - 1)
+}
+
+// paxRecord formats a PAX record, which starts with its own length.
+func paxRecord(k, v string) string {
+	const overhead = 3 // for the space, '=' and newline
+	size := len(k) + len(v) + overhead
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	// the length of the record may have grown its number of digits
+	if len(record) != size {
+		size = len(record)
+		record = strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	}
+	return record
+}
+
+// ustarHeader returns the header block for an entry with the attributes of
+// the header, but for its name, type and size.
+func ustarHeader(header *tar.Header, name string, typeflag byte, size int64) []byte {
+	b := make([]byte, blockSize)
+	octal := func(field []byte, v int64) {
+		copy(field, fmt.Sprintf("%0*o", len(field)-1, v))
+	}
+	if len(name) > 100 {
+		// the PAX records have the name
+		name = name[:100]
+	}
+	copy(b[0:100], name)
+	octal(b[100:108], header.Mode)
+	octal(b[108:116], int64(header.Uid))
+	octal(b[116:124], int64(header.Gid))
+	octal(b[124:136], size)
+	octal(b[136:148], header.ModTime.Unix())
+	b[156] = typeflag
+	copy(b[257:265], "ustar\x0000")
+	copy(b[265:297], header.Uname)
+	copy(b[297:329], header.Gname)
+	octal(b[329:337], 0)
+	octal(b[337:345], 0)
+
+	copy(b[148:156], "        ")
+	var sum int64
+	for _, c := range b {
+		sum += int64(c)
+	}
+	copy(b[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return b
+}
@@ -0,0 +1,466 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/passwd"
+)
+
+// DefaultMutablePaths are the directories whose files a StreamFS keeps until
+// Finish, as building an image changes them after the packages are installed,
+// e.g. etc/passwd or the installed database in lib/apk.
+var DefaultMutablePaths = []string{"etc", "lib", "run", "tmp", "var"}
+
+// ErrStreamed is the error for changing, or reading without a reference to
+// its content, a file already written to the tarball.
+var ErrStreamed = errors.New("already written to the tarball")
+
+// StreamFS is a filesystem which writes the regular files created in it to a
+// tarball as they come, rather than keeping them, but for those under the
+// mutable paths, which it writes, along with everything else, by Finish. A
+// file is written once another is created, so that its attributes can still
+// be set; after that, it can no longer be changed or removed. Its content
+// can still be read if it references it, e.g. in the extraction cache.
+//
+// The tarball is deterministic, with the streamed files in the order they
+// were created, then the others sorted by path. Streamed files have no owner
+// names, which only Finish knows from etc/passwd and etc/group.
+type StreamFS struct {
+	apkfs.FullFS
+	ctx     *Context
+	tw      *tar.Writer
+	mutable []string
+	seen    *written
+	// pending is the file to write next, once done with
+	pending string
+	// streamed are the sizes of the files written, and unreadable those whose
+	// content was not kept
+	streamed   map[string]int64
+	unreadable map[string]bool
+	// links are the hardlinks to streamed files, to write as such
+	links map[string]string
+}
+
+// NewStreamFS returns a filesystem which writes a tarball to w as files are
+// created in it, keeping those under the mutable paths until Finish.
+func NewStreamFS(ctx *Context, w io.Writer, mutable []string) *StreamFS {
+	return &StreamFS{
+		FullFS:     apkfs.NewMemFS(),
+		ctx:        ctx,
+		tw:         tar.NewWriter(w),
+		mutable:    mutable,
+		seen:       newWritten(w),
+		streamed:   map[string]int64{},
+		unreadable: map[string]bool{},
+		links:      map[string]string{},
+	}
+}
+
+// canonical returns the path of the file, relative to the root, without
+// symlinks, so that each file has only one. The file may not exist.
+func (s *StreamFS) canonical(name string) string {
+	parts := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	resolved := ""
+	for i, links := 0, 0; i < len(parts); i++ {
+		next := path.Join(resolved, parts[i])
+		fi, err := s.FullFS.Lstat(next)
+		if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		target, err := s.FullFS.Readlink(next)
+		if links++; err != nil || links > 40 {
+			resolved = next
+			continue
+		}
+		if !path.IsAbs(target) {
+			target = path.Join("/", resolved, target)
+		}
+		parts = append(strings.Split(strings.Trim(path.Clean(target), "/"), "/"), parts[i+1:]...)
+		resolved, i = "", -1
+	}
+	return resolved
+}
+
+func (s *StreamFS) isMutable(name string) bool {
+	for _, m := range s.mutable {
+		if name == m || strings.HasPrefix(name, m+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// flush writes the pending file, if any.
+func (s *StreamFS) flush() error {
+	name := s.pending
+	if name == "" {
+		return nil
+	}
+	s.pending = ""
+	fi, err := s.FullFS.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.ctx.writeEntry(s.tw, s.FullFS, name, fi, nil, nil, s.seen); err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+	s.streamed[name] = fi.Size()
+	if !s.unreadable[name] {
+		return nil
+	}
+	// drop the content, which is in the tarball now
+	f, err := s.FullFS.OpenFile(name, os.O_WRONLY|os.O_TRUNC, fi.Mode())
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// create readies the file to be streamed, returning its canonical path.
+func (s *StreamFS) create(name string) (string, bool, error) {
+	p := s.canonical(name)
+	if _, ok := s.streamed[p]; ok {
+		return "", false, &fs.PathError{Op: "open", Path: name, Err: ErrStreamed}
+	}
+	if s.isMutable(p) {
+		return p, false, nil
+	}
+	if p != s.pending {
+		if err := s.flush(); err != nil {
+			return "", false, err
+		}
+	}
+	return p, true, nil
+}
+
+func (s *StreamFS) OpenFile(name string, flag int, perm fs.FileMode) (apkfs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		return s.OpenReaderAt(name)
+	}
+	p, stream, err := s.create(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.FullFS.OpenFile(p, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if stream {
+		s.pending = p
+		s.unreadable[p] = true
+	}
+	return f, nil
+}
+
+// WriteFileReference creates a file referencing its content, which is read
+// from there to write it to the tarball, and can still be read after that.
+func (s *StreamFS) WriteFileReference(name string, ref apkfs.FileReference, mode fs.FileMode) error {
+	p, stream, err := s.create(name)
+	if err != nil {
+		return err
+	}
+	if err := s.FullFS.(apkfs.ReferenceFS).WriteFileReference(p, ref, mode); err != nil {
+		return err
+	}
+	if stream {
+		s.pending = p
+		delete(s.unreadable, p)
+	}
+	return nil
+}
+
+func (s *StreamFS) Create(name string) (apkfs.File, error) {
+	return s.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
+}
+
+func (s *StreamFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
+	f, err := s.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	return err
+}
+
+// readable returns an error for a file whose content is no longer kept.
+func (s *StreamFS) readable(op, name string) error {
+	if s.unreadable[s.canonical(name)] && s.pending != s.canonical(name) {
+		return &fs.PathError{Op: op, Path: name, Err: ErrStreamed}
+	}
+	return nil
+}
+
+func (s *StreamFS) Open(name string) (fs.File, error) {
+	return s.OpenReaderAt(name)
+}
+
+func (s *StreamFS) OpenReaderAt(name string) (apkfs.File, error) {
+	if err := s.readable("open", name); err != nil {
+		return nil, err
+	}
+	return s.FullFS.OpenReaderAt(name)
+}
+
+func (s *StreamFS) ReadFile(name string) ([]byte, error) {
+	if err := s.readable("open", name); err != nil {
+		return nil, err
+	}
+	return s.FullFS.ReadFile(name)
+}
+
+// streamedInfo is the information of a streamed file, with the size of the
+// content it no longer keeps.
+type streamedInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i *streamedInfo) Size() int64 { return i.size }
+
+func (s *StreamFS) info(name string, fi fs.FileInfo) fs.FileInfo {
+	if size, ok := s.streamed[name]; ok && s.unreadable[name] {
+		return &streamedInfo{FileInfo: fi, size: size}
+	}
+	return fi
+}
+
+func (s *StreamFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := s.FullFS.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.info(s.canonical(name), fi), nil
+}
+
+func (s *StreamFS) Lstat(name string) (fs.FileInfo, error) {
+	fi, err := s.FullFS.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return fi, nil
+	}
+	return s.info(s.canonical(name), fi), nil
+}
+
+// ReadDir lists the files of the directory, sorted by name.
+func (s *StreamFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := s.FullFS.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	dir := s.canonical(name)
+	for i, e := range entries {
+		p := path.Join(dir, e.Name())
+		if _, ok := s.streamed[p]; ok && s.unreadable[p] {
+			fi, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+			entries[i] = fs.FileInfoToDirEntry(s.info(p, fi))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// change returns an error for changing a streamed file, but for the pending
+// one.
+func (s *StreamFS) change(op, name string) error {
+	p := s.canonical(name)
+	if _, ok := s.streamed[p]; ok {
+		return &fs.PathError{Op: op, Path: name, Err: ErrStreamed}
+	}
+	return nil
+}
+
+func (s *StreamFS) Chmod(name string, perm fs.FileMode) error {
+	if fi, err := s.FullFS.Stat(name); err == nil && fi.Mode().Perm() == perm.Perm() && fi.Mode()&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky) == perm&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky) {
+		return nil
+	}
+	if err := s.change("chmod", name); err != nil {
+		return err
+	}
+	return s.FullFS.Chmod(name, perm)
+}
+
+func (s *StreamFS) Chown(name string, uid, gid int) error {
+	if fi, err := s.FullFS.Stat(name); err == nil {
+		if hdr, ok := fi.Sys().(*tar.Header); ok && hdr.Uid == uid && hdr.Gid == gid {
+			return nil
+		}
+	}
+	if err := s.change("chown", name); err != nil {
+		return err
+	}
+	return s.FullFS.Chown(name, uid, gid)
+}
+
+func (s *StreamFS) SetModTime(name string, mtime time.Time) error {
+	fi, err := s.FullFS.Lstat(name)
+	if err == nil && fi.ModTime().Equal(mtime) {
+		return nil
+	}
+	// symlinks are not streamed, whatever they point to
+	if err == nil && fi.Mode()&fs.ModeSymlink == 0 {
+		if err := s.change("setmodtime", name); err != nil {
+			return err
+		}
+	}
+	return s.FullFS.SetModTime(name, mtime)
+}
+
+func (s *StreamFS) SetXattr(name, attr string, data []byte) error {
+	if err := s.change("setxattr", name); err != nil {
+		return err
+	}
+	return s.FullFS.SetXattr(name, attr, data)
+}
+
+func (s *StreamFS) RemoveXattr(name, attr string) error {
+	if err := s.change("removexattr", name); err != nil {
+		return err
+	}
+	return s.FullFS.RemoveXattr(name, attr)
+}
+
+func (s *StreamFS) Remove(name string) error {
+	// a symlink to a streamed file is not the file itself
+	if fi, err := s.FullFS.Lstat(name); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+		return s.FullFS.Remove(name)
+	}
+	p := s.canonical(name)
+	if err := s.change("remove", name); err != nil {
+		return err
+	}
+	if p == s.pending {
+		s.pending = ""
+	}
+	delete(s.unreadable, p)
+	delete(s.links, p)
+	return s.FullFS.Remove(name)
+}
+
+// Link hardlinks the files, which the tarball has as a hardlink if the
+// target is streamed.
+func (s *StreamFS) Link(oldname, newname string) error {
+	target := s.canonical(oldname)
+	if target == s.pending {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+	if err := s.FullFS.Link(oldname, newname); err != nil {
+		return err
+	}
+	if _, ok := s.streamed[target]; ok {
+		s.links[s.canonical(newname)] = target
+	}
+	return nil
+}
+
+// Finish writes the pending file, then the files not streamed, sorted by
+// path, with the hardlinks to streamed files last, and closes the tarball.
+// The filesystem cannot be written to after that.
+func (s *StreamFS) Finish() error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	usersFile, _ := passwd.ReadUserFile(s, "etc/passwd")
+	groupsFile, _ := passwd.ReadGroupFile(s, "etc/group")
+	users := map[int]string{}
+	groups := map[int]string{}
+	for _, u := range usersFile.Entries {
+		users[int(u.UID)] = u.UserName
+	}
+	for _, g := range groupsFile.Entries {
+		groups[int(g.GID)] = g.GroupName
+	}
+	if err := s.ctx.writeTar(s.tw, &unstreamedFS{s}, users, groups, s.seen); err != nil {
+		return fmt.Errorf("writing TAR archive failed: %w", err)
+	}
+
+	names := make([]string, 0, len(s.links))
+	for name := range s.links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fi, err := s.FullFS.Lstat(name)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		header.Typeflag = tar.TypeLink
+		header.Linkname = s.links[name]
+		header.Size = 0
+		mtime := s.ctx.Timestamps.Apply(fi.ModTime(), s.ctx.SourceDateEpoch)
+		header.AccessTime = mtime
+		header.ModTime = mtime
+		header.ChangeTime = mtime
+		if err := s.tw.WriteHeader(header); err != nil {
+			return err
+		}
+	}
+	return s.tw.Close()
+}
+
+// unstreamedFS is the StreamFS without the files already written to the
+// tarball.
+type unstreamedFS struct {
+	*StreamFS
+}
+
+func (u *unstreamedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := u.StreamFS.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	dir := u.canonical(name)
+	kept := entries[:0]
+	for _, e := range entries {
+		p := path.Join(dir, e.Name())
+		if _, ok := u.streamed[p]; ok {
+			continue
+		}
+		if _, ok := u.links[p]; ok {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/apko/pkg/tarball"
+)
+
+func readTarHeaders(t *testing.T, b []byte) ([]*tar.Header, map[string]string) {
+	tr := tar.NewReader(bytes.NewReader(b))
+	var headers []*tar.Header
+	contents := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		headers = append(headers, header)
+		contents[header.Name] = string(content)
+	}
+	return headers, contents
+}
+
+func TestStreamFS(t *testing.T) {
+	ctx, err := tarball.NewContext()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	s := tarball.NewStreamFS(ctx, &buf, tarball.DefaultMutablePaths)
+
+	require.NoError(t, s.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, s.MkdirAll("etc", 0o755))
+	require.NoError(t, s.WriteFile("usr/bin/sh", []byte("sh"), 0o755))
+	// the pending file can still be changed
+	require.NoError(t, s.Chown("usr/bin/sh", 0, 0))
+	require.NoError(t, s.Chmod("usr/bin/sh", 0o700))
+	require.NoError(t, s.WriteFile("usr/bin/ls", []byte("ls"), 0o755))
+	require.NoError(t, s.WriteFile("etc/os-release", []byte("ID=test"), 0o644))
+	require.NoError(t, s.WriteFile("etc/os-release", []byte("ID=image"), 0o644))
+
+	// streamed files keep their size, not their content
+	fi, err := s.Stat("usr/bin/sh")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), fi.Size())
+	_, err = s.ReadFile("usr/bin/sh")
+	require.ErrorIs(t, err, tarball.ErrStreamed)
+	require.ErrorIs(t, s.Remove("usr/bin/sh"), tarball.ErrStreamed)
+	require.ErrorIs(t, s.Chmod("usr/bin/sh", 0o755), tarball.ErrStreamed)
+	require.NoError(t, s.Chmod("usr/bin/sh", 0o700), "a chmod which changes nothing is fine")
+
+	require.NoError(t, s.Finish())
+
+	headers, contents := readTarHeaders(t, buf.Bytes())
+	names := make([]string, 0, len(headers))
+	for _, h := range headers {
+		names = append(names, h.Name)
+	}
+	require.Equal(t, []string{"usr/bin/sh", "usr/bin/ls", "etc", "etc/os-release", "usr", "usr/bin"}, names)
+	require.Equal(t, int64(0o700), headers[0].Mode&0o777)
+	require.Equal(t, "sh", contents["usr/bin/sh"])
+	require.Equal(t, "ls", contents["usr/bin/ls"])
+	require.Equal(t, "ID=image", contents["etc/os-release"])
+}
+
+func TestStreamFSHardlinks(t *testing.T) {
+	ctx, err := tarball.NewContext()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	s := tarball.NewStreamFS(ctx, &buf, tarball.DefaultMutablePaths)
+
+	require.NoError(t, s.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, s.WriteFile("usr/bin/busybox", []byte("busybox"), 0o755))
+	require.NoError(t, s.Link("usr/bin/busybox", "usr/bin/ash"))
+	require.NoError(t, s.Finish())
+
+	headers, contents := readTarHeaders(t, buf.Bytes())
+	last := headers[len(headers)-1]
+	require.Equal(t, "usr/bin/ash", last.Name)
+	require.Equal(t, byte(tar.TypeLink), last.Typeflag)
+	require.Equal(t, "usr/bin/busybox", last.Linkname)
+	require.Equal(t, "busybox", contents["usr/bin/busybox"])
+}
@@ -16,7 +16,10 @@ package tarball
 
 import (
 	"archive/tar"
+	"io"
 	"time"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
 )
 
 type Context struct {
@@ -28,9 +31,20 @@ type Context struct {
 	OverrideGname   string
 	SkipClose       bool
 	UseChecksums    bool
+	Deduplicate     bool
+	Sparse          bool
+	Timestamps      apkfs.TimestampPolicy
 	overridePerms   map[string]tar.Header
+	mutators        []FileMutator
 }
 
+// FileMutator is called with the header and the content of each entry as
+// the tarball is written, and returns the header and content to write in
+// their place, e.g. to relocate a file or to scan it. The content is nil
+// for anything but regular files. If the content changes size, the header
+// must have the new size. Returning a nil header leaves the entry out.
+type FileMutator func(header *tar.Header, content io.Reader) (*tar.Header, io.Reader, error)
+
 type Option func(*Context) error
 
 // Generates a new context from a set of options.
@@ -110,3 +124,39 @@ func WithUseChecksums(useChecksums bool) Option {
 		return nil
 	}
 }
+
+// WithFileMutators adds mutators to call on each entry of the tarball, in
+// order, as it is written. Checksums are of the content before mutation.
+func WithFileMutators(mutators ...FileMutator) Option {
+	return func(ctx *Context) error {
+		ctx.mutators = append(ctx.mutators, mutators...)
+		return nil
+	}
+}
+
+// WithDeduplication writes regular files with the same content and
+// attributes once, the others being hardlinks to it.
+func WithDeduplication(dedup bool) Option {
+	return func(ctx *Context) error {
+		ctx.Deduplicate = dedup
+		return nil
+	}
+}
+
+// WithSparse writes regular files with large runs of zeros as sparse
+// entries, which only hold the rest of their content.
+func WithSparse(sparse bool) Option {
+	return func(ctx *Context) error {
+		ctx.Sparse = sparse
+		return nil
+	}
+}
+
+// WithTimestampPolicy sets what the modification times of the files become,
+// SOURCE_DATE_EPOCH by default.
+func WithTimestampPolicy(policy apkfs.TimestampPolicy) Option {
+	return func(ctx *Context) error {
+		ctx.Timestamps = policy
+		return nil
+	}
+}
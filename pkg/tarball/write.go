@@ -17,11 +17,14 @@ package tarball
 import (
 	"archive/tar"
 	"crypto/sha1" // nolint:gosec
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"sort"
+	"strings"
 	"syscall"
 
 	gzip "golang.org/x/build/pargzip"
@@ -31,6 +34,9 @@ import (
 	"chainguard.dev/apko/pkg/passwd"
 )
 
+// prefix of the PAX records holding extended attributes
+const paxRecordsXattrPrefix = "SCHILY.xattr."
+
 func hasHardlinks(fi fs.FileInfo) bool {
 	if stat := fi.Sys(); stat != nil {
 		si, ok := stat.(*syscall.Stat_t)
@@ -66,14 +72,13 @@ func getInodeFromFileInfo(fi fs.FileInfo) (uint64, error) {
 	return 0, fmt.Errorf("unable to stat underlying file")
 }
 
-func (ctx *Context) writeTar(tw *tar.Writer, fsys fs.FS, users, groups map[int]string) error {
+func (ctx *Context) writeTar(tw *tar.Writer, fsys fs.FS, users, groups map[int]string, seen *written) error {
 	if users == nil {
 		users = map[int]string{}
 	}
 	if groups == nil {
 		groups = map[int]string{}
 	}
-	seenFiles := map[uint64]string{}
 	// set this once, to make it easy to look up later
 	if ctx.overridePerms == nil {
 		ctx.overridePerms = map[string]tar.Header{}
@@ -94,156 +99,263 @@ func (ctx *Context) writeTar(tw *tar.Writer, fsys fs.FS, users, groups map[int]s
 			return err
 		}
 
-		var (
-			link         string
-			major, minor uint32
-			isCharDevice bool
-		)
-		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
-			rlfs, ok := fsys.(apkfs.ReadLinkFS)
-			if !ok {
-				return fmt.Errorf("readlink not supported by this fs: path (%s)", path)
-			}
+		return ctx.writeEntry(tw, fsys, path, info, users, groups, seen)
+	}); err != nil {
+		return err
+	}
 
-			if link, err = rlfs.Readlink(path); err != nil {
-				return err
-			}
+	return nil
+}
+
+// written is what was written to a tarball so far, to write the same files
+// again as hardlinks.
+type written struct {
+	// inodes are the paths of the files with hardlinks, by inode
+	inodes map[uint64]string
+	// contents are the paths of the regular files, by the digest of their
+	// content and attributes, when deduplicating
+	contents map[string]string
+	// raw is where the tar writer writes to, for the entries it cannot
+	// write itself, such as sparse files
+	raw io.Writer
+}
+
+func newWritten(raw io.Writer) *written {
+	return &written{inodes: map[uint64]string{}, contents: map[string]string{}, raw: raw}
+}
+
+// writeEntry writes the header of the file at the path, along with its
+// content for a regular file.
+func (ctx *Context) writeEntry(tw *tar.Writer, fsys fs.FS, path string, info fs.FileInfo, users, groups map[int]string, seen *written) error {
+	var (
+		link         string
+		major, minor uint32
+		isDevice     bool
+		err          error
+	)
+	if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+		rlfs, ok := fsys.(apkfs.ReadLinkFS)
+		if !ok {
+			return fmt.Errorf("readlink not supported by this fs: path (%s)", path)
 		}
 
-		if info.Mode()&os.ModeCharDevice == os.ModeCharDevice {
-			rlfs, ok := fsys.(apkfs.ReadnodFS)
-			if !ok {
-				return fmt.Errorf("read character device not supported by this fs: path (%s) %#v %#v", path, info, fsys)
-			}
-			isCharDevice = true
-			dev, err := rlfs.Readnod(path)
-			if err != nil {
-				return err
-			}
-			major = unix.Major(uint64(dev))
-			minor = unix.Minor(uint64(dev))
+		if link, err = rlfs.Readlink(path); err != nil {
+			return err
 		}
+	}
 
-		header, err := tar.FileInfoHeader(info, link)
+	if info.Mode()&os.ModeDevice == os.ModeDevice {
+		rlfs, ok := fsys.(apkfs.ReadnodFS)
+		if !ok {
+			return fmt.Errorf("read device not supported by this fs: path (%s) %#v %#v", path, info, fsys)
+		}
+		isDevice = true
+		dev, err := rlfs.Readnod(path)
 		if err != nil {
 			return err
 		}
-		// devices
-		if isCharDevice {
-			header.Devmajor = int64(major)
-			header.Devminor = int64(minor)
-		}
-		// work around some weirdness, without this we wind up with just the basename
-		header.Name = path
+		major = unix.Major(uint64(dev))
+		minor = unix.Minor(uint64(dev))
+	}
 
-		// zero out timestamps for reproducibility
-		header.AccessTime = ctx.SourceDateEpoch
-		header.ModTime = ctx.SourceDateEpoch
-		header.ChangeTime = ctx.SourceDateEpoch
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	// devices
+	if isDevice {
+		header.Devmajor = int64(major)
+		header.Devminor = int64(minor)
+	}
+	// work around some weirdness, without this we wind up with just the basename
+	header.Name = path
 
-		if name, ok := users[header.Uid]; ok {
-			header.Uname = name
-		}
-		if name, ok := groups[header.Gid]; ok {
-			header.Gname = name
-		}
+	// normalize timestamps for reproducibility
+	mtime := ctx.Timestamps.Apply(info.ModTime(), ctx.SourceDateEpoch)
+	header.AccessTime = mtime
+	header.ModTime = mtime
+	header.ChangeTime = mtime
 
-		if ctx.OverrideUIDGID {
-			header.Uid = ctx.UID
-			header.Gid = ctx.GID
-		}
+	if name, ok := users[header.Uid]; ok {
+		header.Uname = name
+	}
+	if name, ok := groups[header.Gid]; ok {
+		header.Gname = name
+	}
 
-		if ctx.OverrideUname != "" {
-			header.Uname = ctx.OverrideUname
-		}
+	if ctx.OverrideUIDGID {
+		header.Uid = ctx.UID
+		header.Gid = ctx.GID
+	}
 
-		if ctx.OverrideGname != "" {
-			header.Gname = ctx.OverrideGname
-		}
+	if ctx.OverrideUname != "" {
+		header.Uname = ctx.OverrideUname
+	}
+
+	if ctx.OverrideGname != "" {
+		header.Gname = ctx.OverrideGname
+	}
+
+	// look for the override perms with or without the leading /
+	if h, ok := ctx.overridePerms[header.Name]; ok {
+		header.Mode = h.Mode
+		header.Uid = h.Uid
+		header.Gid = h.Gid
+		header.Uname = h.Uname
+		header.Gname = h.Gname
+	}
+	if h, ok := ctx.overridePerms["/"+header.Name]; ok {
+		header.Mode = h.Mode
+		header.Uid = h.Uid
+		header.Gid = h.Gid
+		header.Uname = h.Uname
+		header.Gname = h.Gname
+	}
 
-		// look for the override perms with or without the leading /
-		if h, ok := ctx.overridePerms[header.Name]; ok {
-			header.Mode = h.Mode
-			header.Uid = h.Uid
-			header.Gid = h.Gid
-			header.Uname = h.Uname
-			header.Gname = h.Gname
+	if link != "" {
+		header.Typeflag = tar.TypeSymlink
+	}
+	if !info.IsDir() && hasHardlinks(info) {
+		inode, err := getInodeFromFileInfo(info)
+		if err != nil {
+			return err
 		}
-		if h, ok := ctx.overridePerms["/"+header.Name]; ok {
-			header.Mode = h.Mode
-			header.Uid = h.Uid
-			header.Gid = h.Gid
-			header.Uname = h.Uname
-			header.Gname = h.Gname
+
+		if oldpath, ok := seen.inodes[inode]; ok {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = oldpath
+			header.Size = 0
+		} else {
+			seen.inodes[inode] = header.Name
 		}
+	}
+
+	if ctx.UseChecksums {
+		header.PAXRecords = map[string]string{}
 
 		if link != "" {
-			header.Typeflag = tar.TypeSymlink
-		}
-		if !info.IsDir() && hasHardlinks(info) {
-			inode, err := getInodeFromFileInfo(info)
+			linkDigest := sha1.Sum([]byte(link)) // nolint:gosec
+			linkChecksum := hex.EncodeToString(linkDigest[:])
+			header.PAXRecords["APK-TOOLS.checksum.SHA1"] = linkChecksum
+		} else if info.Mode().IsRegular() {
+			data, err := fsys.Open(path)
 			if err != nil {
 				return err
 			}
+			defer data.Close()
 
-			if oldpath, ok := seenFiles[inode]; ok {
-				header.Typeflag = tar.TypeLink
-				header.Linkname = oldpath
-				header.Size = 0
-			} else {
-				seenFiles[inode] = header.Name
+			fileDigest := sha1.New() // nolint:gosec
+			if _, err := io.Copy(fileDigest, data); err != nil {
+				return err
 			}
+
+			fileChecksum := hex.EncodeToString(fileDigest.Sum(nil))
+			header.PAXRecords["APK-TOOLS.checksum.SHA1"] = fileChecksum
 		}
+	}
 
-		if ctx.UseChecksums {
-			header.PAXRecords = map[string]string{}
-
-			if link != "" {
-				linkDigest := sha1.Sum([]byte(link)) // nolint:gosec
-				linkChecksum := hex.EncodeToString(linkDigest[:])
-				header.PAXRecords["APK-TOOLS.checksum.SHA1"] = linkChecksum
-			} else if info.Mode().IsRegular() {
-				data, err := fsys.Open(path)
-				if err != nil {
-					return err
-				}
-				defer data.Close()
-
-				fileDigest := sha1.New() // nolint:gosec
-				if _, err := io.Copy(fileDigest, data); err != nil {
-					return err
-				}
-
-				fileChecksum := hex.EncodeToString(fileDigest.Sum(nil))
-				header.PAXRecords["APK-TOOLS.checksum.SHA1"] = fileChecksum
+	// extended attributes, such as file capabilities, which symlinks cannot have
+	if xfs, ok := fsys.(apkfs.XattrFS); ok && link == "" {
+		xattrs, err := xfs.ListXattrs(path)
+		if err != nil {
+			return err
+		}
+		for attr, data := range xattrs {
+			if header.PAXRecords == nil {
+				header.PAXRecords = map[string]string{}
 			}
+			header.PAXRecords[paxRecordsXattrPrefix+attr] = string(data)
 		}
+	}
 
-		if err := tw.WriteHeader(header); err != nil {
+	// identical files are written once, the others being hardlinks to it
+	var digest string
+	if ctx.Deduplicate && header.Typeflag == tar.TypeReg && header.Size > 0 {
+		if digest, err = contentDigest(fsys, path, header); err != nil {
 			return err
 		}
+		if oldpath, ok := seen.contents[digest]; ok {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = oldpath
+			header.Size = 0
+			digest = ""
+		}
+	}
 
-		if info.Mode().IsRegular() && header.Size > 0 {
-			data, err := fsys.Open(path)
-			if err != nil {
-				return err
-			}
+	var content io.Reader
+	if header.Typeflag != tar.TypeLink && info.Mode().IsRegular() && header.Size > 0 {
+		data, err := fsys.Open(path)
+		if err != nil {
+			return err
+		}
 
-			defer data.Close()
+		defer data.Close()
+		content = data
+	}
 
-			if _, err := io.Copy(tw, data); err != nil {
+	original := content
+	for _, mutate := range ctx.mutators {
+		if header, content, err = mutate(header, content); err != nil {
+			return fmt.Errorf("mutating %s: %w", path, err)
+		}
+		if header == nil {
+			return nil
+		}
+	}
+
+	// files with large holes are written as sparse entries, as they are
+	if fragments := ctx.sparseFragments(header, content, original); fragments != nil {
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		if err := writeSparse(seen.raw, header, content.(io.ReaderAt), fragments); err != nil {
+			return fmt.Errorf("writing sparse %s: %w", path, err)
+		}
+	} else {
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if content != nil {
+			if _, err := io.Copy(tw, content); err != nil {
 				return err
 			}
 		}
+	}
 
-		return nil
-	}); err != nil {
-		return err
+	// others may only link to it if it was written as it is
+	if digest != "" && header.Name == path && content == original {
+		seen.contents[digest] = path
 	}
 
 	return nil
 }
 
+// contentDigest returns the digest of the content of the file, along with
+// the attributes of the header which hardlinks share.
+func contentDigest(fsys fs.FS, path string, header *tar.Header) (string, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%o %d %d %s %s %d\n", header.Mode, header.Uid, header.Gid, header.Uname, header.Gname, header.ModTime.Unix())
+	records := make([]string, 0, len(header.PAXRecords))
+	for k, v := range header.PAXRecords {
+		if strings.HasPrefix(k, paxRecordsXattrPrefix) {
+			records = append(records, fmt.Sprintf("%s=%x", k, v))
+		}
+	}
+	sort.Strings(records)
+	fmt.Fprintf(h, "%s\n", strings.Join(records, " "))
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // WriteArchive writes a tarball to the provided io.Writer from the provided fs.FS.
 // To override permissions, set the OverridePerms when creating the Context.
 // If you need to get multiple filesystems, merge them prior to calling WriteArchive.
@@ -251,7 +363,13 @@ func (ctx *Context) WriteArchive(dst io.Writer, src fs.FS) error {
 	gzw := gzip.NewWriter(dst)
 	defer gzw.Close()
 
-	tw := tar.NewWriter(gzw)
+	return ctx.WriteTar(gzw, src)
+}
+
+// WriteTar is like WriteArchive, but writes an uncompressed tarball, leaving
+// compression up to the caller.
+func (ctx *Context) WriteTar(dst io.Writer, src fs.FS) error {
+	tw := tar.NewWriter(dst)
 	if !ctx.SkipClose {
 		defer tw.Close()
 	} else {
@@ -269,7 +387,7 @@ func (ctx *Context) WriteArchive(dst io.Writer, src fs.FS) error {
 	for _, g := range groupsFile.Entries {
 		groups[int(g.GID)] = g.GroupName
 	}
-	if err := ctx.writeTar(tw, src, users, groups); err != nil {
+	if err := ctx.writeTar(tw, src, users, groups, newWritten(dst)); err != nil {
 		return fmt.Errorf("writing TAR archive failed: %w", err)
 	}
 
@@ -0,0 +1,269 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "chainguard.dev/apko/pkg/apk/impl/fs"
+	"chainguard.dev/apko/pkg/tarball"
+)
+
+func TestWriteTarXattrs(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("bin", 0o755))
+	require.NoError(t, fsys.WriteFile("bin/ping", []byte("ping"), 0o755))
+	require.NoError(t, fsys.SetXattr("bin/ping", "security.capability", []byte{0x01, 0x00, 0x00, 0x02}))
+
+	ctx, err := tarball.NewContext()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, ctx.WriteTar(&buf, fsys))
+
+	tr := tar.NewReader(&buf)
+	found := false
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if header.Name != "bin/ping" {
+			continue
+		}
+		found = true
+		require.Equal(t, string([]byte{0x01, 0x00, 0x00, 0x02}), header.PAXRecords["SCHILY.xattr.security.capability"])
+	}
+	require.True(t, found, "bin/ping not found in the tarball")
+}
+
+func TestWriteTarSymlinks(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("usr/lib", 0o755))
+	require.NoError(t, fsys.WriteFile("usr/lib/libfoo.so.1", []byte("foo"), 0o755))
+	require.NoError(t, fsys.Symlink("libfoo.so.1", "usr/lib/libfoo.so"))
+	require.NoError(t, fsys.Symlink("usr/lib", "lib"))
+	require.NoError(t, fsys.Symlink("../share/missing", "usr/lib/dangling"))
+	require.NoError(t, fsys.Chown("usr/lib/libfoo.so.1", 1000, 1000))
+
+	ctx, err := tarball.NewContext()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, ctx.WriteTar(&buf, fsys))
+
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		headers[header.Name] = header
+	}
+	for name, target := range map[string]string{
+		"lib":               "usr/lib",
+		"usr/lib/libfoo.so": "libfoo.so.1",
+		"usr/lib/dangling":  "../share/missing",
+	} {
+		header, ok := headers[name]
+		require.True(t, ok, "%s not found in the tarball", name)
+		require.Equal(t, byte(tar.TypeSymlink), header.Typeflag, "%s is not a symlink", name)
+		require.Equal(t, target, header.Linkname)
+		require.Zero(t, header.Size)
+		// not the ownership of the target
+		require.Zero(t, header.Uid)
+	}
+	require.Equal(t, byte(tar.TypeReg), headers["usr/lib/libfoo.so.1"].Typeflag)
+	require.Equal(t, 1000, headers["usr/lib/libfoo.so.1"].Uid)
+}
+
+func TestWriteTarFileMutators(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("opt/app", 0o755))
+	require.NoError(t, fsys.WriteFile("opt/app/hello.txt", []byte("hello"), 0o644))
+	require.NoError(t, fsys.WriteFile("opt/app/secret.txt", []byte("secret"), 0o600))
+
+	var seen []string
+	ctx, err := tarball.NewContext(tarball.WithFileMutators(
+		func(header *tar.Header, content io.Reader) (*tar.Header, io.Reader, error) {
+			seen = append(seen, header.Name)
+			if header.Name == "opt/app/secret.txt" {
+				return nil, nil, nil
+			}
+			header.Name = strings.Replace(header.Name, "opt/app", "usr/share/app", 1)
+			return header, content, nil
+		},
+		func(header *tar.Header, content io.Reader) (*tar.Header, io.Reader, error) {
+			if content == nil {
+				return header, nil, nil
+			}
+			data, err := io.ReadAll(content)
+			if err != nil {
+				return nil, nil, err
+			}
+			return header, bytes.NewReader(bytes.ToUpper(data)), nil
+		},
+	))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, ctx.WriteTar(&buf, fsys))
+	sort.Strings(seen)
+	require.Equal(t, []string{"opt", "opt/app", "opt/app/hello.txt", "opt/app/secret.txt"}, seen)
+
+	files := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[header.Name] = string(data)
+	}
+	require.Equal(t, map[string]string{
+		"opt":                     "",
+		"usr/share/app":           "",
+		"usr/share/app/hello.txt": "HELLO",
+	}, files)
+}
+
+func TestWriteTarDeduplication(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("usr/share/licenses", 0o755))
+	license := []byte("Apache-2.0")
+	require.NoError(t, fsys.WriteFile("usr/share/licenses/a", license, 0o644))
+	require.NoError(t, fsys.WriteFile("usr/share/licenses/b", license, 0o644))
+	// other attributes, which a hardlink cannot have
+	require.NoError(t, fsys.WriteFile("usr/share/licenses/c", license, 0o600))
+	require.NoError(t, fsys.WriteFile("usr/share/licenses/d", []byte("MIT"), 0o644))
+
+	ctx, err := tarball.NewContext(tarball.WithDeduplication(true))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, ctx.WriteTar(&buf, fsys))
+
+	tr := tar.NewReader(&buf)
+	links := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if header.Typeflag == tar.TypeLink {
+			links[header.Name] = header.Linkname
+		}
+	}
+	require.Equal(t, map[string]string{"usr/share/licenses/b": "usr/share/licenses/a"}, links)
+}
+
+func TestWriteTarSparse(t *testing.T) {
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("var/lib", 0o755))
+	sparse := make([]byte, 64<<10)
+	copy(sparse, "start")
+	copy(sparse[40000:], "middle")
+	require.NoError(t, fsys.WriteFile("var/lib/sparse", sparse, 0o644))
+	require.NoError(t, fsys.SetXattr("var/lib/sparse", "user.kind", []byte("sparse")))
+	trailing := make([]byte, 3*4096)
+	copy(trailing, "data")
+	require.NoError(t, fsys.WriteFile("var/lib/trailing", trailing, 0o600))
+	require.NoError(t, fsys.WriteFile("var/lib/dense", bytes.Repeat([]byte("x"), 8192), 0o644))
+
+	write := func(sparse bool) *bytes.Buffer {
+		ctx, err := tarball.NewContext(tarball.WithSparse(sparse), tarball.WithSourceDateEpoch(time.Unix(0, 0)))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, ctx.WriteTar(&buf, fsys))
+		return &buf
+	}
+	dense, buf := write(false), write(true)
+	require.Less(t, buf.Len(), dense.Len()/2)
+
+	contents := map[string][]byte{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		require.Equal(t, hdr.Size, int64(len(b)))
+		contents[hdr.Name] = b
+		if hdr.Name == "var/lib/sparse" {
+			require.Equal(t, int64(0o644), hdr.Mode)
+			require.Equal(t, "sparse", hdr.PAXRecords["SCHILY.xattr.user.kind"])
+		}
+	}
+	require.Equal(t, sparse, contents["var/lib/sparse"])
+	require.Equal(t, trailing, contents["var/lib/trailing"])
+	require.Equal(t, bytes.Repeat([]byte("x"), 8192), contents["var/lib/dense"])
+	require.Len(t, contents, 5)
+}
+
+func TestWriteTarTimestamps(t *testing.T) {
+	epoch := time.Unix(1700000000, 0)
+	old, recent := epoch.Add(-24*time.Hour), epoch.Add(24*time.Hour)
+	fsys := apkfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("etc", 0o755))
+	require.NoError(t, fsys.WriteFile("etc/old", []byte("old"), 0o644))
+	require.NoError(t, fsys.WriteFile("etc/recent", []byte("recent"), 0o644))
+	require.NoError(t, fsys.SetModTime("etc", old))
+	require.NoError(t, fsys.SetModTime("etc/old", old))
+	require.NoError(t, fsys.SetModTime("etc/recent", recent))
+
+	for _, tt := range []struct {
+		policy apkfs.TimestampPolicy
+		want   map[string]time.Time
+	}{
+		{"", map[string]time.Time{"etc": epoch, "etc/old": epoch, "etc/recent": epoch}},
+		{apkfs.TimestampsEpoch, map[string]time.Time{"etc": epoch, "etc/old": epoch, "etc/recent": epoch}},
+		{apkfs.TimestampsPreserve, map[string]time.Time{"etc": old, "etc/old": old, "etc/recent": recent}},
+		{apkfs.TimestampsClamp, map[string]time.Time{"etc": old, "etc/old": old, "etc/recent": epoch}},
+		{apkfs.TimestampsZero, map[string]time.Time{"etc": time.Unix(0, 0), "etc/old": time.Unix(0, 0), "etc/recent": time.Unix(0, 0)}},
+	} {
+		ctx, err := tarball.NewContext(tarball.WithSourceDateEpoch(epoch), tarball.WithTimestampPolicy(tt.policy))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, ctx.WriteTar(&buf, fsys))
+
+		got := map[string]time.Time{}
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			got[hdr.Name] = hdr.ModTime
+		}
+		require.Len(t, got, len(tt.want))
+		for name, want := range tt.want {
+			require.True(t, want.Equal(got[name]), "%q: mtime of %s is %v, not %v", tt.policy, name, got[name], want)
+		}
+	}
+}